@@ -12,6 +12,14 @@ package client
  * - REL_CLI_TELL_TRUSTEES_PK - the trustee's identities. We react by sending our identity + ephemeral identity
  * - REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG - the shuffle from the trustees. We do some check, if they pass, we can communicate. We send the first round to the relay.
  * - REL_CLI_DOWNSTREAM_DATA - the data from the relay, for one round. We react by finishing the round (sending our data to the relay)
+ * - REL_ALL_PARAMETERS_PROPOSAL - the relay proposes to change some parameters during the session. We answer whether we accept them
+ * - REL_ALL_PARAMETERS_ACTIVATE - everybody accepted the proposed parameters, which are now in use
+ * - REL_CLI_DOWNSTREAM_COPY - a copy, over TCP, of a round we received over UDP. We check that both are the same
+ * - REL_CLI_DOWNSTREAM_DATA of a round we skipped - the relay retransmits it after our CLI_REL_DOWNSTREAM_NACK
+ * - REL_CLI_PARAMS_DIGEST - the digest of the parameters the relay sent to every client. We check that we got the same ones
+ * - REL_CLI_HISTORY_REQUEST - the relay asks for the digest of our downstream history at a round. We answer with CLI_REL_HISTORY_DIGEST
+ * - REL_CLI_HISTORY_RESYNC - our downstream history diverged from the relay's. We adopt its digests
+ * - REL_ALL_EQUIVOCATION_ALARM - the relay found the equivocation contributions of a round inconsistent. We stop until the group restarts
  *
  * local functions :
  *
@@ -22,24 +30,25 @@ package client
  */
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"strconv"
 
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/crypto"
-	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 
-	"crypto/hmac"
 	"crypto/sha256"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"github.com/dedis/prifi/prifi-lib/transform"
 	"github.com/dedis/prifi/prifi-lib/utils"
 	"github.com/dedis/prifi/utils"
 	"go.dedis.ch/kyber/v3/proof"
-	"math/rand"
+	"sort"
 	"time"
 )
 
@@ -48,8 +57,24 @@ import (
 func (p *PriFiLibClientInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUTDOWN) error {
 	log.Lvl2("Client " + strconv.Itoa(p.clientState.ID) + " : Received a SHUTDOWN message. ")
 
+	alreadyShutdown := p.stateMachine.State() == "SHUTDOWN"
 	p.stateMachine.ChangeState("SHUTDOWN")
 
+	if msg.Reason != "" {
+		p.clientState.sessionSummary.SetShutdownReason(msg.Reason, msg.Abnormal)
+	}
+	if !alreadyShutdown {
+		log.Lvl1("Client "+strconv.Itoa(p.clientState.ID)+" : shutdown report", p.clientState.sessionSummary.Report().String())
+		if p.clientState.udpVerifier != nil {
+			log.Lvl1("Client "+strconv.Itoa(p.clientState.ID)+" :", p.clientState.udpVerifier.String())
+		}
+	}
+	if p.clientState.cellCapture != nil {
+		if err := p.clientState.cellCapture.Close(); err != nil {
+			log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : could not close the cell capture,", err)
+		}
+	}
+
 	return nil
 }
 
@@ -60,14 +85,26 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	e := "Client " + strconv.Itoa(clientID)
 	p.stateMachine.SetEntity(e)
 	p.messageSender.SetEntity(e)
+	p.clientState.sessionSummary.SetEntity(e)
+	p.clientState.sessionSummary.NewEpoch(msg.ConfigHash())
 	nTrustees := msg.IntValueOrElse("NTrustees", p.clientState.nTrustees)
 	nClients := msg.IntValueOrElse("NClients", p.clientState.nClients)
 	payloadSize := msg.IntValueOrElse("PayloadSize", p.clientState.PayloadSize)
+	cellsPerRound := msg.IntValueOrElse("CellsPerRound", 1)
 	useUDP := msg.BoolValueOrElse("UseUDP", p.clientState.UseUDP)
 	dcNetType := msg.StringValueOrElse("DCNetType", "not initialized")
 	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
+	macAlgorithm, macErr := dcnet.MACAlgorithmFromName(msg.StringValueOrElse("DisruptionProtectionMAC", ""))
 	equivProtection := msg.BoolValueOrElse("EquivocationProtectionEnabled", false)
 	ForceDisruptionSinceRound3 := msg.BoolValueOrElse("ForceDisruptionSinceRound3", false)
+	trusteeQuorum := msg.IntValueOrElse("TrusteeQuorum", 0)
+	maxSlotsPerClient := msg.IntValueOrElse("MaxSlotsPerClient", 1)
+	warmupRounds := msg.IntValueOrElse("WarmupRounds", 0)
+	historyDigestInterval := msg.IntValueOrElse("HistoryDigestInterval", 0)
+	payloadTransform, transformErr := transform.Parse(msg.StringValueOrElse("PayloadTransform", ""))
+	socksCredentials, credentialsErr := config.ParseSOCKSCredentials(msg.StringValueOrElse("SocksCredentials", ""))
+	randomBeacon, err := crypto.ParseRandomBeacon(msg.StringValueOrElse("RandomBeacon", ""))
+	cryptoSuite := msg.StringValueOrElse("CryptoSuite", config.CryptoSuiteName())
 	//sanity checks
 	if clientID < -1 {
 		return errors.New("ClientID cannot be negative")
@@ -78,34 +115,91 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	if nClients < 1 {
 		return errors.New("nClients cannot be smaller than 1")
 	}
+	if trusteeQuorum > nTrustees {
+		return errors.New("only " + strconv.Itoa(nTrustees) + " trustees in this epoch, below the quorum of " + strconv.Itoa(trusteeQuorum))
+	}
 	if payloadSize < 1 {
 		return errors.New("PayloadSize cannot be 0")
 	}
+	if cellsPerRound < 1 {
+		cellsPerRound = 1
+	}
+	if err != nil {
+		return err
+	}
+	if macErr != nil {
+		return macErr
+	}
+	if transformErr != nil {
+		return transformErr
+	}
+	if credentialsErr != nil {
+		return credentialsErr
+	}
+	if payloadSize <= payloadTransform.Overhead() {
+		return errors.New("PayloadSize cannot be smaller than the overhead of the payload transform")
+	}
+	if err := config.CheckCryptoSuite(cryptoSuite); err != nil {
+		return err
+	}
 
 	switch dcNetType {
 	case "Verifiable":
-		panic("verifiable not supported yet")
+		return errors.New("verifiable DC-net not supported yet")
 	}
 
 	//set the received parameters
 	p.clientState.ID = clientID
 	p.clientState.Name = "Client-" + strconv.Itoa(clientID)
+	p.clientState.supervisor.SetEntity("Client " + strconv.Itoa(clientID))
 	p.clientState.MySlot = -1
+	p.clientState.MySlots = nil
 	p.clientState.nClients = nClients
+	p.clientState.nSlots = nClients
+	p.clientState.nSlotsOwned = p.clientState.nSlotsRequested
+	if maxSlotsPerClient < 1 {
+		maxSlotsPerClient = 1
+	}
+	if p.clientState.nSlotsOwned > maxSlotsPerClient {
+		log.Lvl2("Client", clientID, ": asked for", p.clientState.nSlotsOwned, "slots per schedule, the relay allows", maxSlotsPerClient)
+		p.clientState.nSlotsOwned = maxSlotsPerClient
+	}
 	p.clientState.nTrustees = nTrustees
+	p.clientState.TrusteeQuorum = trusteeQuorum
 	p.clientState.PayloadSize = payloadSize
+	p.clientState.CellsPerRound = cellsPerRound
+	p.clientState.WarmupRounds = warmupRounds
+	p.clientState.payloadTransform = payloadTransform
+	p.clientState.payloadTransforms = make(map[int]transform.PayloadTransform)
+	p.clientState.socksCredentials.Store(socksCredentials)
+	if len(socksCredentials) > 0 {
+		log.Lvl2("Client", clientID, ": the applications must give one of the", len(socksCredentials), "SOCKS credentials of the relay")
+	}
 	p.clientState.UseUDP = useUDP
 	p.clientState.TrusteePublicKey = make([]kyber.Point, nTrustees)
 	p.clientState.sharedSecrets = make([]kyber.Point, nTrustees)
 	p.clientState.RoundNo = int32(0)
 	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
-	p.clientState.MessageHistory = config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
+	p.clientState.downstreamAcks = newDownstreamAcks()
+	p.clientState.history = nil
+	if historyDigestInterval > 0 {
+		p.clientState.history = dcnet.NewHistoryDigests(0, dcnet.DEFAULT_HISTORY_DIGESTS_KEPT) // round 0 has no downstream data
+	}
+	p.clientState.HistoryDigestInterval = historyDigestInterval
+	p.clientState.historyReported = 0
+	p.clientState.MessageHistory = crypto.NewMessageHistory(randomBeacon)
 	p.clientState.DisruptionProtectionEnabled = disruptionProtection
+	p.clientState.MACAlgorithm = macAlgorithm
 	p.clientState.EquivocationProtectionEnabled = equivProtection
 	p.clientState.ForceDisruptionSinceRound3 = ForceDisruptionSinceRound3
+	p.clientState.ParametersEpoch = 0
 	p.clientState.MyLastRound = -10
 	p.clientState.DisruptionWrongBitPosition = -1
 	p.clientState.AllreadyDisrupted = false
+	p.clientState.paramsDigest = msg.ParamsDigest()
+	if p.clientState.udpVerifier != nil {
+		p.clientState.udpVerifier.newEpoch()
+	}
 
 	//we know our client number, if needed, parse the pcap for replay
 	if p.clientState.pcapReplay.Enabled {
@@ -141,7 +235,7 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 
 	//start the broadcast-listener goroutine
 	if useUDP {
-		go p.messageSender.MessageSender.ClientSubscribeToBroadcast(p.clientState.ID, p.ReceivedMessage, p.clientState.StartStopReceiveBroadcast)
+		p.startBroadcastListener(p.clientState.StartStopReceiveBroadcast)
 	}
 
 	log.Lvl2("Client " + strconv.Itoa(p.clientState.ID) + " has been initialized by message. ")
@@ -172,6 +266,9 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_DOWNSTREAM_DATA(msg net.REL_CL
 		//process downstream data
 		return p.ProcessDownStreamData(msg)
 	} else if msg.RoundID < p.clientState.RoundNo {
+		if p.clientState.downstreamAcks.missing(msg.RoundID) {
+			return p.applyRetransmittedData(msg)
+		}
 		log.Lvl3("Client " + strconv.Itoa(p.clientState.ID) + " : Received a REL_CLI_DOWNSTREAM_DATA for round " + strconv.Itoa(int(msg.RoundID)) + " but we are in round " + strconv.Itoa(int(p.clientState.RoundNo)) + ", discarding.")
 	} else if msg.RoundID > p.clientState.RoundNo {
 		log.Lvl3("Client "+strconv.Itoa(p.clientState.ID)+" : Skipping from round", p.clientState.RoundNo, "to round", msg.RoundID)
@@ -193,6 +290,12 @@ SOCKS/VPN data, or if we're running latency tests, we send a "ping" message to c
 */
 func (p *PriFiLibClientInstance) Received_REL_CLI_UDP_DOWNSTREAM_DATA(msg net.REL_CLI_DOWNSTREAM_DATA_UDP) error {
 
+	//before answering, so that the round is still open on the relay when it gets our request
+	p.requestDownstreamCopy(msg.REL_CLI_DOWNSTREAM_DATA)
+	if msg.RoundID > p.clientState.RoundNo {
+		p.sendDownstreamNacks(p.clientState.RoundNo, msg.RoundID)
+	}
+
 	return p.Received_REL_CLI_DOWNSTREAM_DATA(msg.REL_CLI_DOWNSTREAM_DATA)
 }
 
@@ -203,6 +306,11 @@ When this function ends, it calls SendUpstreamData() which continues the communi
 */
 func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREAM_DATA) error {
 	timing.StartMeasure("round-processing")
+	p.clientState.sessionSummary.AddRound()
+	p.clientState.sessionSummary.AddBytes(0, int64(len(msg.Data)))
+	p.recordCell(utils.CELL_CAPTURE_DOWNSTREAM, 0, msg.RoundID, len(msg.Data))
+	p.clientState.downstreamAcks.applied(msg.RoundID)
+	p.recordDownstreamHistory(msg.RoundID, msg.Data)
 
 	/*
 	 * HANDLE THE DOWNSTREAM DATA
@@ -213,35 +321,21 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 		p.handlePossibleDisruption(msg)
 	}
 
-	//if it's just one byte, no data
-	if len(msg.Data) > 1 {
+	//the relay announces that it is draining, this is not data
+	if deadline, isAnnouncement := net.ParseDrainAnnouncement(msg.Data); isAnnouncement {
+		log.Lvl1("Client", p.clientState.ID, ": the relay is draining, and shuts down at", deadline)
+		p.clientState.RelayShutdownDeadline = deadline
+	} else if len(msg.Data) > 1 {
 		//pass the data to the VPN/SOCKS5 proxy, if enabled
 		if p.clientState.DataOutputEnabled {
 			p.clientState.DataFromDCNet <- msg.Data
 		}
 		//test if it is the answer from our ping (for latency test)
-		if p.clientState.LatencyTest.DoLatencyTests && len(msg.Data) > 2 {
-
-			actionFunction := func(roundRec int32, roundDiff int32, timeDiff int64) {
-				log.Lvl3("Measured latency is", timeDiff, ", for client", p.clientState.ID, ", roundDiff", roundDiff, ", received on round", msg.RoundID)
-				p.clientState.timeStatistics["measured-latency"].AddTime(timeDiff)
-				p.clientState.timeStatistics["measured-latency"].ReportWithInfo("measured-latency")
-			}
-			prifilog.DecodeLatencyMessages(msg.Data, p.clientState.ID, msg.RoundID, actionFunction)
-		}
+		p.clientState.LatencyTest.decode(msg.Data, p.clientState.ID, msg.RoundID)
 	}
 
 	//test if we have latency test to send
-	now := time.Now()
-	if p.clientState.LatencyTest.DoLatencyTests && p.clientState.ID == 0 && now.After(p.clientState.LatencyTest.NextLatencyTest) {
-		log.Lvl1("Client 0 wants to send a latency test")
-		newLatTest := &prifilog.LatencyTestToSend{
-			CreatedAt: now,
-		}
-		p.clientState.LatencyTest.LatencyTestsToSend = append(p.clientState.LatencyTest.LatencyTestsToSend, newLatTest)
-		p.clientState.LatencyTest.NextLatencyTest = now.Add(p.clientState.LatencyTest.LatencyTestsInterval)
-		p.clientState.LatencyTest.NextLatencyTest = p.clientState.LatencyTest.NextLatencyTest.Add(time.Duration(rand.Intn(1000)) * time.Millisecond)
-	}
+	p.clientState.LatencyTest.schedule(p.clientState.ID, time.Now())
 
 	//if the flag "Resync" is on, we cannot write data up, but need to resend the keys instead
 	if msg.FlagResync == true {
@@ -260,12 +354,14 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 
 		//do the schedule
 		bmc := new(scheduler.BitMaskSlotScheduler_Client)
-		bmc.Client_ReceivedScheduleRequest(p.clientState.nClients)
+		bmc.Client_ReceivedScheduleRequest(p.clientState.nSlots)
 
-		//check if we want to transmit
+		//check if we want to transmit; we reserve all our slots
 		if p.WantsToTransmit() {
-			bmc.Client_ReserveRound(p.clientState.MySlot)
-			log.Lvl3("Client ", p.clientState.ID, "Gonna reserve slot", p.clientState.MySlot, "(we are in round", msg.RoundID, ")")
+			for _, slot := range p.clientState.MySlots {
+				bmc.Client_ReserveRound(slot)
+			}
+			log.Lvl3("Client ", p.clientState.ID, "Gonna reserve slots", p.clientState.MySlots, "(we are in round", msg.RoundID, ")")
 		}
 		contribution := bmc.Client_GetOpenScheduleContribution()
 
@@ -278,10 +374,13 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 			ClientID:       p.clientState.ID,
 			RoundID:        p.clientState.RoundNo,
 			OpenClosedData: upstreamCell}
+		p.clientState.sessionSummary.AddBytes(int64(len(upstreamCell)), 0)
+		p.recordCell(utils.CELL_CAPTURE_SCHEDULE, 0, p.clientState.RoundNo, len(upstreamCell))
 		p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
 	} else {
 		//send upstream data for next round
+		p.clientState.allocatedUpstreamSize = msg.AllocatedUpstreamSize
 		p.SendUpstreamData(msg.OwnershipID)
 	}
 
@@ -306,9 +405,34 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 	return nil
 }
 
+// ownsSlot returns true if the given slot is one of ours
+func (p *PriFiLibClientInstance) ownsSlot(slotID int) bool {
+	for _, slot := range p.clientState.MySlots {
+		if slot == slotID {
+			return true
+		}
+	}
+	return false
+}
+
+// inWarmup returns true if the current round is a warm-up round, in which our slots carry synthetic data
+func (p *PriFiLibClientInstance) inWarmup() bool {
+	return p.clientState.RoundNo >= 1 && int(p.clientState.RoundNo) <= p.clientState.WarmupRounds
+}
+
 // WantsToTransmit returns true if [we have a latency message to send] OR [we have data to send]
 func (p *PriFiLibClientInstance) WantsToTransmit() bool {
 
+	// during the warm-up, every slot carries the synthetic data the relay checks
+	if p.inWarmup() {
+		return true
+	}
+
+	// while paused, we only reserve the slots our traffic shaping profile wants anyway, and send cover cells in them
+	if p.UpstreamPaused() {
+		return p.clientState.trafficShaper.ForcesTransmission(time.Now())
+	}
+
 	//we have some pcap to send
 	if p.clientState.pcapReplay.Enabled && len(p.clientState.pcapReplay.Packets) > 0 && p.clientState.pcapReplay.currentPacket < len(p.clientState.pcapReplay.Packets) {
 		relativeNow := uint64(MsTimeStampNow()) - p.clientState.pcapReplay.time0
@@ -320,7 +444,7 @@ func (p *PriFiLibClientInstance) WantsToTransmit() bool {
 	}
 
 	// if we have a latency test message
-	if len(p.clientState.LatencyTest.LatencyTestsToSend) > 0 {
+	if p.clientState.LatencyTest.hasProbes() {
 		return true
 	}
 
@@ -329,6 +453,11 @@ func (p *PriFiLibClientInstance) WantsToTransmit() bool {
 		return true
 	}
 
+	// if our traffic shaping profile wants this slot anyway
+	if p.clientState.trafficShaper.ForcesTransmission(time.Now()) {
+		return true
+	}
+
 	// if we transmitted in the last second, keep reserving (but don't do this with pcaps)
 	if true || !p.clientState.pcapReplay.Enabled {
 		now := time.Now()
@@ -363,7 +492,7 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 
 	//if we can send data
 	slotOwner := false
-	if ownerSlotID == p.clientState.MySlot {
+	if p.ownsSlot(ownerSlotID) {
 		slotOwner = true
 		p.clientState.MyLastRound = p.clientState.RoundNo
 	}
@@ -374,23 +503,53 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 		// Making room for the b_echo_last flag
 		actualPayloadSize--
 		if actualPayloadSize <= 0 {
-			log.Fatal("Client", p.clientState.ID, "Cannot have disruption protection with less than 1 bytes payload")
+			e := "Client " + strconv.Itoa(p.clientState.ID) + " cannot have disruption protection with less than 1 bytes payload"
+			log.Error(e)
+			return errors.New(e)
 		}
 	}
 	if p.clientState.EquivocationProtectionEnabled && slotOwner {
 		actualPayloadSize -= 16
 		if actualPayloadSize <= 0 {
-			log.Fatal("Client", p.clientState.ID, "Cannot have equivocation protection with less than 16 bytes payload")
+			e := "Client " + strconv.Itoa(p.clientState.ID) + " cannot have equivocation protection with less than 16 bytes payload"
+			log.Error(e)
+			return errors.New(e)
+		}
+	}
+	if p.clientState.DisruptionProtectionEnabled && slotOwner {
+		// Making room for the MAC which ends the cell
+		actualPayloadSize -= dcnet.MACSize(p.clientState.MACAlgorithm)
+		if actualPayloadSize <= 0 {
+			e := "Client " + strconv.Itoa(p.clientState.ID) + " cannot have disruption protection with less than " + strconv.Itoa(dcnet.MACSize(p.clientState.MACAlgorithm)) + " bytes payload"
+			log.Error(e)
+			return errors.New(e)
 		}
 	}
 
-	if slotOwner {
+	//with variable slot sizes, the relay may have allocated fewer bytes to this round
+	allocatedSize := p.clientState.allocatedUpstreamSize
+	if allocatedSize > 0 && allocatedSize < actualPayloadSize {
+		actualPayloadSize = allocatedSize
+	}
+
+	//with a payload transform, the encoder of our slot takes some bytes of each payload, and may send only redundancy
+	var payloadTransform transform.PayloadTransform
+	if slotOwner && p.clientState.payloadTransform.Enabled() && !p.inWarmup() {
+		payloadTransform = p.slotPayloadTransform(ownerSlotID)
+		actualPayloadSize -= payloadTransform.Overhead()
+	}
+
+	//during the warm-up, our slot carries the synthetic data the relay expects; while paused, it carries a cover cell
+	if slotOwner && p.inWarmup() {
+		upstreamCellContent = net.NewWarmupPayload(p.clientState.RoundNo, actualPayloadSize)
+	} else if slotOwner && !p.UpstreamPaused() && (payloadTransform == nil || payloadTransform.TakesContent()) {
 
 		//this data has already been polled out of the DataForDCNet chan, so send it first
 		//this is non-nil when OpenClosedSlot is true, and that it had to poll data out
 		if p.clientState.NextDataForDCNet != nil {
-			upstreamCellContent = *p.clientState.NextDataForDCNet
+			nextData := *p.clientState.NextDataForDCNet
 			p.clientState.NextDataForDCNet = nil
+			upstreamCellContent = p.fitAllocatedSize(p.shapeUpstreamData(nextData), actualPayloadSize)
 		} else {
 
 			//if there are some pcap packets to replay
@@ -435,24 +594,14 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 
 				//either select data from the data we have to send, if any
 				case myData := <-p.clientState.DataForDCNet:
-					upstreamCellContent = myData
+					upstreamCellContent = p.fitAllocatedSize(p.shapeUpstreamData(myData), actualPayloadSize)
 
 				//or, if we have nothing to send, and we are doing Latency tests, embed a pre-crafted message that we will recognize later on
 				default:
 					upstreamCellContent = make([]byte, actualPayloadSize)
 
-					if len(p.clientState.LatencyTest.LatencyTestsToSend) > 0 {
-
-						logFn := func(timeDiff int64) {
-							p.clientState.timeStatistics["latency-msg-stayed-in-buffer"].AddTime(timeDiff)
-							p.clientState.timeStatistics["latency-msg-stayed-in-buffer"].ReportWithInfo("latency-msg-stayed-in-buffer")
-						}
-
-						bytes, outMsgs := prifilog.LatencyMessagesToBytes(p.clientState.LatencyTest.LatencyTestsToSend,
-							p.clientState.ID, p.clientState.RoundNo, actualPayloadSize, logFn)
-
-						p.clientState.LatencyTest.LatencyTestsToSend = outMsgs
-						upstreamCellContent = bytes
+					if probes := p.clientState.LatencyTest.encode(p.clientState.ID, p.clientState.RoundNo, actualPayloadSize); probes != nil {
+						upstreamCellContent = probes
 					}
 				}
 			}
@@ -461,6 +610,12 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 			//copy(content[:], upstreamCellContent[:])
 			//p.clientState.DataHistory[p.clientState.RoundNo] = content
 		}
+
+		// with super-rounds, the next cells of this round carry whatever else is waiting
+		upstreamCellContent = p.fillSuperRound(upstreamCellContent)
+	}
+	if payloadTransform != nil {
+		upstreamCellContent = payloadTransform.Encode(upstreamCellContent, actualPayloadSize+payloadTransform.Overhead())
 	}
 
 	if p.clientState.DisruptionProtectionEnabled && slotOwner {
@@ -495,7 +650,7 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 			var hash [32]byte
 			if upstreamCellContent == nil {
 				// If the content is nil, some code will later change it into an empty slice. So the Hash must be from that
-				payload_to_hash := make([]byte, p.clientState.DCNet.DCNetPayloadSize-1)
+				payload_to_hash := make([]byte, p.macOffset())
 
 				// Saving data for possible disruption
 				p.clientState.LastMessage = payload_to_hash
@@ -514,6 +669,15 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 			p.clientState.HashFromPreviousMessage = hash
 		}
 
+		// the cell ends with the MAC of its content, which the relay checks
+		if len(upstreamCellContent) > p.macOffset() {
+			e := "Client " + strconv.Itoa(p.clientState.ID) + " has " + strconv.Itoa(len(upstreamCellContent)) + " bytes to send, which leaves no room for the MAC"
+			log.Error(e)
+			return errors.New(e)
+		}
+		cellContent := make([]byte, p.macOffset())
+		copy(cellContent, upstreamCellContent)
+		upstreamCellContent = append(cellContent, p.computeMAC(ownerSlotID, p.clientState.RoundNo, cellContent)...)
 	}
 
 	// Adding the b_echo_last if the disruption protection is enabled
@@ -524,8 +688,11 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 		slice_b_echo_last[0] = b_echo_last
 	}
 	payload := append(slice_b_echo_last, upstreamCellContent...)
+	if p.clientState.DisruptionProtectionEnabled && slotOwner && !p.clientState.EquivocationProtectionEnabled {
+		p.rememberOwnedPayload(p.clientState.RoundNo, payload)
+	}
 
-	upstreamCell, plainPayload := p.clientState.DCNet.EncodeForRound(p.clientState.RoundNo, slotOwner, payload)
+	upstreamCell, plainPayload := p.clientState.DCNet.EncodeForRoundWithSize(p.clientState.RoundNo, slotOwner, payload, allocatedSize)
 
 	if p.clientState.EquivocationProtectionEnabled && p.clientState.DisruptionProtectionEnabled && slotOwner && p.clientState.B_echo_last != 1 {
 		// Saving data for possible disruption
@@ -550,22 +717,95 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 	}
 	//send the data to the relay
 	toSend := &net.CLI_REL_UPSTREAM_DATA{
-		ClientID: p.clientState.ID,
-		RoundID:  p.clientState.RoundNo,
-		Data:     upstreamCell,
+		ClientID:     p.clientState.ID,
+		RoundID:      p.clientState.RoundNo,
+		Data:         upstreamCell,
+		AckedRoundID: p.clientState.downstreamAcks.acked,
 	}
+	toSend.HistoryRoundID, toSend.HistoryDigest = p.historyReport()
+	p.clientState.sessionSummary.AddBytes(int64(len(upstreamCell)), 0)
+	var flags uint8
+	if slotOwner {
+		flags |= utils.CELL_CAPTURE_FLAG_OWNED_SLOT
+		if upstreamCellContent != nil {
+			flags |= utils.CELL_CAPTURE_FLAG_DATA
+		}
+	}
+	p.recordCell(utils.CELL_CAPTURE_UPSTREAM, flags, p.clientState.RoundNo, len(upstreamCell))
 
 	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
 	return nil
 }
 
-// TODO: Delete
-func (p *PriFiLibClientInstance) computeHmac256(message []byte) []byte {
-	key := []byte("client-secret" + strconv.Itoa(p.clientState.ID))
-	h := hmac.New(sha256.New, key)
-	h.Write(message)
-	return h.Sum(nil)
+// recordCell logs a cell in the cell capture, if enabled
+func (p *PriFiLibClientInstance) recordCell(kind uint8, flags uint8, roundID int32, size int) {
+	if p.clientState.cellCapture == nil {
+		return
+	}
+	if err := p.clientState.cellCapture.Record(kind, flags, roundID, size); err != nil {
+		log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : could not write to the cell capture,", err)
+		p.clientState.cellCapture = nil
+	}
+}
+
+// shapeUpstreamData returns the data if our traffic shaping profile lets it go now; otherwise, the data is kept
+// in NextDataForDCNet for one of our next slots, and nil is returned
+func (p *PriFiLibClientInstance) shapeUpstreamData(data []byte) []byte {
+	if p.clientState.trafficShaper.Allows(time.Now(), len(data)) {
+		return data
+	}
+	log.Lvl3("Client", p.clientState.ID, "holds back", len(data), "bytes (traffic shaping profile", p.clientState.trafficShaper.Profile+")")
+	p.clientState.NextDataForDCNet = &data
+	return nil
+}
+
+// fillSuperRound appends to the content of the first cell of a super-round the data already waiting in DataForDCNet,
+// one cell of PayloadSize each, without waiting for more. Each cell is padded, so that the relay cuts the decoded
+// super-round at the same places.
+func (p *PriFiLibClientInstance) fillSuperRound(content []byte) []byte {
+	cellSize := p.clientState.PayloadSize
+	if p.clientState.CellsPerRound <= 1 || content == nil {
+		return content
+	}
+	superRound := make([]byte, cellSize, cellSize*p.clientState.CellsPerRound)
+	copy(superRound, content)
+	for i := 1; i < p.clientState.CellsPerRound; i++ {
+		var data []byte
+		select {
+		case myData := <-p.clientState.DataForDCNet:
+			data = p.shapeUpstreamData(myData)
+		default:
+		}
+		if data == nil {
+			break
+		}
+		cell := make([]byte, cellSize)
+		copy(cell, data)
+		superRound = append(superRound, cell...)
+	}
+	log.Lvl4("Client", p.clientState.ID, "fills", len(superRound)/cellSize, "cells of", p.clientState.CellsPerRound, "in round", p.clientState.RoundNo)
+	return superRound
+}
+
+// macOffset returns where the MAC starts in the content of a cell we own, after the b_echo_last flag
+func (p *PriFiLibClientInstance) macOffset() int {
+	offset := p.clientState.DCNet.DCNetPayloadSize - 1 - dcnet.MACSize(p.clientState.MACAlgorithm)
+	if p.clientState.EquivocationProtectionEnabled {
+		offset -= 16
+	}
+	return offset
+}
+
+// computeMAC returns the MAC of the content of a cell in our slot, with the key we share with the relay for this slot
+func (p *PriFiLibClientInstance) computeMAC(slotID int, roundID int32, message []byte) []byte {
+	mac, err := p.clientState.DCNet.SlotMAC(slotID, roundID, message)
+	if err != nil {
+		// the relay will find the round disrupted, since we cannot authenticate the cell
+		log.Error("Client", p.clientState.ID, ":", err)
+		return make([]byte, dcnet.MACSize(p.clientState.MACAlgorithm))
+	}
+	return mac
 }
 
 /*
@@ -584,6 +824,14 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 		return errors.New(e)
 	}
 
+	// we only share pads with the trustees present in this epoch; the absent ones are simply omitted
+	if len(trusteesPks) != p.clientState.nTrustees || len(trusteesPks) < p.clientState.TrusteeQuorum {
+		e := "Client " + strconv.Itoa(p.clientState.ID) + " : got " + strconv.Itoa(len(trusteesPks)) + " trustees public keys, expected " +
+			strconv.Itoa(p.clientState.nTrustees) + " (quorum " + strconv.Itoa(p.clientState.TrusteeQuorum) + ")"
+		log.Error(e)
+		return errors.New(e)
+	}
+
 	p.clientState.TrusteePublicKey = make([]kyber.Point, p.clientState.nTrustees)
 	p.clientState.sharedSecrets = make([]kyber.Point, p.clientState.nTrustees)
 
@@ -593,16 +841,21 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 	}
 
 	p.clientState.DCNet = dcnet.NewDCNetEntity(p.clientState.ID,
-		dcnet.DCNET_CLIENT, p.clientState.PayloadSize, p.clientState.EquivocationProtectionEnabled, p.clientState.sharedSecrets)
+		dcnet.DCNET_CLIENT, p.clientState.PayloadSize*p.clientState.CellsPerRound, p.clientState.EquivocationProtectionEnabled, p.clientState.sharedSecrets)
+	p.clientState.DCNet.MACAlgorithm = p.clientState.MACAlgorithm
 
-	//then, generate our ephemeral keys (used for shuffling)
-	p.clientState.EphemeralPublicKey, p.clientState.ephemeralPrivateKey = crypto.NewKeyPair()
+	//then, generate our ephemeral keys (used for shuffling), one per slot we want in the schedule
+	ephPks, ephPrivateKeys := p.newEphemeralKeys()
+	p.clientState.EphemeralPublicKey, p.clientState.ephemeralPrivateKey = ephPks[0], ephPrivateKeys[0]
+	extraEphPks := ephPks[1:]
+	p.clientState.extraEphemeralPrivateKeys = ephPrivateKeys[1:]
 
 	//send the keys to the relay
 	toSend := &net.CLI_REL_TELL_PK_AND_EPH_PK{
-		ClientID: p.clientState.ID,
-		Pk:       p.clientState.PublicKey,
-		EphPk:    p.clientState.EphemeralPublicKey,
+		ClientID:    p.clientState.ID,
+		Pk:          p.clientState.PublicKey,
+		EphPk:       p.clientState.EphemeralPublicKey,
+		ExtraEphPks: extraEphPks,
 	}
 	p.messageSender.SendToRelayWithLog(toSend, "")
 
@@ -611,6 +864,24 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 	return nil
 }
 
+/*
+Received_REL_CLI_PARAMS_DIGEST handles REL_CLI_PARAMS_DIGEST messages, sent right before the shuffle result. If the
+digest differs from the one of the parameters we received, we were not configured like the rest of the group, and we
+stop before sending any data.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_PARAMS_DIGEST(msg net.REL_CLI_PARAMS_DIGEST) error {
+	if bytes.Equal(msg.Digest, p.clientState.paramsDigest) {
+		log.Lvl2("Client", p.clientState.ID, ": our parameters match the group's (digest", hex.EncodeToString(msg.Digest)+")")
+		return nil
+	}
+
+	e := "Client " + strconv.Itoa(p.clientState.ID) + " : our parameters (digest " + hex.EncodeToString(p.clientState.paramsDigest) +
+		") differ from the ones the relay sent to the group (digest " + hex.EncodeToString(msg.Digest) + "), refusing to continue"
+	log.Error(e)
+	p.stateMachine.ChangeState("SHUTDOWN")
+	return errors.New(e)
+}
+
 /*
 Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG handles REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG messages.
 These are sent after the Shuffle protocol has been done by the Trustees and the Relay.
@@ -623,22 +894,58 @@ As the client should send the first data, we do so; to keep this function simple
 "round function", that is Received_REL_CLI_DOWNSTREAM_DATA().
 */
 func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(msg net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) error {
+	//after an epoch rotation, the schedule contains our fresh ephemeral keys
+	p.useFreshEphemeralKeys(msg)
+
 	//verify the signature
 	neff := new(scheduler.NeffShuffle)
 	mySlot, err := neff.ClientVerifySigAndRecognizeSlot(p.clientState.ephemeralPrivateKey, p.clientState.TrusteePublicKey, msg.Base, msg.EphPks, msg.GetSignatures())
 	p.clientState.EphemeralPublicKeys = msg.EphPks
+	p.clientState.scheduleBase = msg.Base
+	p.clientState.ownedPayloads = make(map[int32][]byte)
 	if err != nil {
 		e := "Client " + strconv.Itoa(p.clientState.ID) + "; Can't recognize our slot ! err is " + err.Error()
 		log.Error(e)
 	}
 
-	//prepare for commmunication
+	//locate the slots of our extra ephemeral keys, if we asked for several slots
+	mySlots := []int{mySlot}
+	if err == nil && len(p.clientState.extraEphemeralPrivateKeys) > 0 {
+		extraSlots, err := neff.ClientRecognizeExtraSlots(p.clientState.extraEphemeralPrivateKeys, msg.Base, msg.EphPks)
+		if err != nil {
+			e := "Client " + strconv.Itoa(p.clientState.ID) + "; Can't recognize our extra slots ! err is " + err.Error()
+			log.Error(e)
+		} else {
+			mySlots = append(mySlots, extraSlots...)
+		}
+	}
+	sort.Ints(mySlots)
+
+	//derive the keys of the MACs of our cells, for this epoch
+	if err == nil && p.clientState.DisruptionProtectionEnabled {
+		if err := p.rotateMACKeys(msg); err != nil {
+			e := "Client " + strconv.Itoa(p.clientState.ID) + "; Can't derive the MAC keys of our slots ! err is " + err.Error()
+			log.Error(e)
+			return errors.New(e)
+		}
+	}
+
+	//prepare for commmunication. When clients joined during the session, the new schedule starts at msg.RoundID
+	rekeying := p.stateMachine.State() == "READY"
 	p.clientState.MySlot = mySlot
-	p.clientState.RoundNo = int32(0)
+	p.clientState.MySlots = mySlots
+	p.clientState.payloadTransforms = make(map[int]transform.PayloadTransform) // the relay starts new decoders
+	p.clientState.nSlots = len(msg.EphPks)
+	p.clientState.RoundNo = msg.RoundID
 	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
+	p.clientState.downstreamAcks = newDownstreamAcks()
+	p.clientState.downstreamAcks.acked = msg.RoundID // like round 0, the first round of a schedule has no downstream data
+	if p.clientState.history != nil {
+		p.clientState.history.Advance(msg.RoundID)
+	}
 
 	//if by chance we had a broadcast-listener goroutine, kill it
-	if p.clientState.UseUDP {
+	if p.clientState.UseUDP && !rekeying {
 		if p.clientState.StartStopReceiveBroadcast == nil {
 			e := "Client " + strconv.Itoa(p.clientState.ID) + " wish to start listening with UDP, but doesn't have the appropriate helper."
 			log.Error(e)
@@ -664,8 +971,8 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 	}
 	data := make([]byte, payloadSize)
 	if p.clientState.DisruptionProtectionEnabled {
-		// Making space for the b_echo_last
-		data2 := make([]byte, payloadSize-1)
+		// Making space for the b_echo_last, and for the MAC, which the relay does not check in the first round
+		data2 := make([]byte, p.macOffset())
 
 		// Saving data for possible disruption
 		p.clientState.LastMessage = data2
@@ -681,9 +988,10 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 		b_echo_last := p.clientState.B_echo_last
 		slice_b_echo_last[0] = b_echo_last
 		data = append(slice_b_echo_last, data2...)
+		data = append(data, make([]byte, dcnet.MACSize(p.clientState.MACAlgorithm))...)
 	}
 
-	upstreamCell, plainPayload := p.clientState.DCNet.EncodeForRound(0, slotOwner, data)
+	upstreamCell, plainPayload := p.clientState.DCNet.EncodeForRound(p.clientState.RoundNo, slotOwner, data)
 	if p.clientState.EquivocationProtectionEnabled && p.clientState.DisruptionProtectionEnabled {
 		// Saving data for possible disruption
 		p.clientState.LastMessage = plainPayload
@@ -693,13 +1001,54 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 
 	//send the data to the relay
 	toSend := &net.CLI_REL_UPSTREAM_DATA{
-		ClientID: p.clientState.ID,
-		RoundID:  p.clientState.RoundNo,
-		Data:     upstreamCell,
+		ClientID:     p.clientState.ID,
+		RoundID:      p.clientState.RoundNo,
+		Data:         upstreamCell,
+		AckedRoundID: p.clientState.downstreamAcks.acked,
 	}
+	toSend.HistoryRoundID, toSend.HistoryDigest = p.historyReport()
+	p.clientState.sessionSummary.AddBytes(int64(len(upstreamCell)), 0)
+	var flags uint8
+	if slotOwner {
+		flags = utils.CELL_CAPTURE_FLAG_OWNED_SLOT
+	}
+	p.recordCell(utils.CELL_CAPTURE_UPSTREAM, flags, p.clientState.RoundNo, len(upstreamCell))
 	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
 	p.clientState.RoundNo++
 
 	return nil
 }
+
+/*
+Received_REL_ALL_PARAMETERS_PROPOSAL handles REL_ALL_PARAMETERS_PROPOSAL messages.
+The relay proposes to change some parameters during the session; we accept if they can all be changed without
+restarting the protocol. The client does not use those parameters itself, it only needs to know the epoch.
+*/
+func (p *PriFiLibClientInstance) Received_REL_ALL_PARAMETERS_PROPOSAL(msg net.REL_ALL_PARAMETERS_PROPOSAL) error {
+	accepted := true
+	for k := range msg.ParamsInt {
+		if !net.IsMigratableParameter(k) {
+			log.Error("Client", p.clientState.ID, ": parameter", k, "cannot be changed during a session, refusing epoch", msg.Epoch)
+			accepted = false
+		}
+	}
+
+	toSend := &net.CLI_REL_PARAMETERS_ACK{
+		ClientID: p.clientState.ID,
+		Epoch:    msg.Epoch,
+		Accepted: accepted,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(parameters epoch "+strconv.Itoa(int(msg.Epoch))+")")
+	return nil
+}
+
+/*
+Received_REL_ALL_PARAMETERS_ACTIVATE handles REL_ALL_PARAMETERS_ACTIVATE messages.
+Everybody accepted the parameters of this epoch, and the relay now uses them.
+*/
+func (p *PriFiLibClientInstance) Received_REL_ALL_PARAMETERS_ACTIVATE(msg net.REL_ALL_PARAMETERS_ACTIVATE) error {
+	log.Lvl2("Client", p.clientState.ID, ": parameters epoch", msg.Epoch, "is now active")
+	p.clientState.ParametersEpoch = msg.Epoch
+	return nil
+}
@@ -7,11 +7,12 @@ import (
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
-	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
 	//"github.com/dedis/prifi/prifi-lib/relay"
+	"crypto/hmac"
 	"crypto/sha256"
 	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 	"testing"
@@ -69,7 +70,7 @@ func TestClient(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client := NewClient(true, true, in, out, false, "./", msw)
+	client := NewClient(true, false, true, in, out, false, "./", "", 1, "", 0, 0, msw)
 
 	//when receiving no message, client should have some parameters ready
 	cs := client.clientState
@@ -112,6 +113,13 @@ func TestClient(t *testing.T) {
 
 	msg.TrusteesPks = trusteesPubKeys
 
+	// the epoch must have at least TrusteeQuorum trustees
+	msg.Add("TrusteeQuorum", nTrustees+1)
+	if err := client.ReceivedMessage(*msg); err == nil {
+		t.Error("Client should refuse an epoch with fewer trustees than the quorum")
+	}
+	msg.Add("TrusteeQuorum", nTrustees)
+
 	if err := client.ReceivedMessage(*msg); err != nil {
 		t.Error("Client should be able to receive this message:", err)
 	}
@@ -207,7 +215,7 @@ func TestClient(t *testing.T) {
 	toSend3, _ := n.RelayView.SendTranscript()
 	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
 	for j := 0; j < nTrustees; j++ {
-		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
+		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.InitialBase, parsed3.InitialEphPks, parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
 		parsed4 := toSend4.(*net.TRU_REL_SHUFFLE_SIG)
 		n.RelayView.ReceivedSignatureFromTrustee(parsed4.TrusteeID, parsed4.Sig)
 	}
@@ -365,11 +373,7 @@ func TestClient(t *testing.T) {
 	}
 
 	//Receive some data down, with nothing to say, and latencytest=true
-	cs.LatencyTest = &prifilog.LatencyTests{
-		DoLatencyTests:       true,
-		LatencyTestsInterval: time.Second * 0,
-		NextLatencyTest:      time.Now(),
-	}
+	cs.LatencyTest = NewLatencyTester(true, false, cs.timeStatistics[LATENCY_MEASURED], cs.timeStatistics[LATENCY_STAYED_IN_BUFF])
 	dataDown = []byte{100, 101, 102}
 
 	currentTime := MsTimeStampNow()
@@ -448,7 +452,7 @@ func TestClient2(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client := NewClient(true, true, in, out, false, "./", msw)
+	client := NewClient(true, false, true, in, out, false, "./", "", 1, "", 0, 0, msw)
 	cs := client.clientState
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
@@ -507,7 +511,7 @@ func TestClient2(t *testing.T) {
 	toSend3, _ := n.RelayView.SendTranscript()
 	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
 	for j := 0; j < nTrustees; j++ {
-		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
+		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.InitialBase, parsed3.InitialEphPks, parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
 		parsed4 := toSend4.(*net.TRU_REL_SHUFFLE_SIG)
 		n.RelayView.ReceivedSignatureFromTrustee(parsed4.TrusteeID, parsed4.Sig)
 	}
@@ -579,7 +583,7 @@ func TestDisruptionClient(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client := NewClient(true, true, in, out, false, "./", msw)
+	client := NewClient(true, false, true, in, out, false, "./", "", 1, "", 0, 0, msw)
 	cs := client.clientState
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
@@ -643,13 +647,18 @@ func TestDisruptionClient(t *testing.T) {
 	toSend3, _ := n.RelayView.SendTranscript()
 	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
 	for j := 0; j < nTrustees; j++ {
-		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
+		toSend4, _ := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.InitialBase, parsed3.InitialEphPks, parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
 		parsed4 := toSend4.(*net.TRU_REL_SHUFFLE_SIG)
 		n.RelayView.ReceivedSignatureFromTrustee(parsed4.TrusteeID, parsed4.Sig)
 	}
 	toSend5, _ := n.RelayView.VerifySigsAndSendToClients(trusteesPubKeys)
 	parsed5 := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
 
+	//with the schedule, the relay sends its key on the base of the shuffle, from which the keys of the MACs derive
+	_, relayPrivateKey := crypto.NewKeyPair()
+	parsed5.Epoch = 2
+	parsed5.RelayPk = config.CryptoSuite.Point().Mul(relayPrivateKey, parsed5.Base)
+
 	//should receive a Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG
 	err4 := client.ReceivedMessage(*parsed5)
 	if err4 != nil {
@@ -659,6 +668,9 @@ func TestDisruptionClient(t *testing.T) {
 	if cs.MySlot != 0 {
 		t.Error("should have a slot", cs.MySlot)
 	}
+	if cs.DCNet.MACEpoch() != 2 || !cs.DCNet.HasMACKey(0) || cs.DCNet.HasMACKey(1) {
+		t.Error("The client should have the MAC key of its slot only, for epoch 2")
+	}
 
 	//Should send a CLI_REL_UPSTREAM_DATA
 	if len(sentToRelay) == 0 {
@@ -709,7 +721,7 @@ func TestDisruptionClient(t *testing.T) {
 
 	// now in a normal round (possibly the client will send 0's but it's a different path)
 	// Receive some data down which is the CORRECT HASH of the previous message + [1, 2, 3]
-	hash := sha256.Sum256(dcNetDecoded[1:])
+	hash := sha256.Sum256(dcNetDecoded[1 : upCellSize-sha256.Size])
 	data := []byte{1, 2, 3}
 
 	msg7 := net.REL_CLI_DOWNSTREAM_DATA{
@@ -742,6 +754,15 @@ func TestDisruptionClient(t *testing.T) {
 	if b_echo_last != 0 {
 		t.Error("The b_echo_last flag be 0, now its:", b_echo_last)
 	}
+	// the cell of our slot ends with the HMAC of its content, which the relay checks
+	macOffset := upCellSize - sha256.Size
+	// the relay derives the key of our slot from its key and from the shuffled ephemeral key of the slot
+	macKey, _ := dcnet.DeriveMACKey(config.CryptoSuite.Point().Mul(relayPrivateKey, parsed5.EphPks[0]), parsed5.Epoch)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(dcNetDecoded[1:macOffset])
+	if !bytes.Equal(dcNetDecoded[macOffset:], mac.Sum(nil)) {
+		t.Error("The cell should end with the HMAC of its content")
+	}
 
 	// now with disruption
 	//Receive some data down. Now the same data, but without the hash
@@ -778,3 +799,152 @@ func TestDisruptionClient(t *testing.T) {
 
 	t.SkipNow() //we started a goroutine, let's kill everything, we're good
 }
+
+func TestFillSuperRound(t *testing.T) {
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	in := make(chan []byte, 6)
+	client := NewClient(false, false, false, in, make(chan []byte), false, "./", "", 1, "", 0, 0, msw)
+	client.clientState.PayloadSize = 4
+
+	// without super-rounds, the content is untouched
+	client.clientState.CellsPerRound = 1
+	if content := client.fillSuperRound([]byte{1}); !bytes.Equal(content, []byte{1}) {
+		t.Error("the content should not change without super-rounds", content)
+	}
+
+	// the next cells take the waiting data, padded to PayloadSize
+	client.clientState.CellsPerRound = 3
+	in <- []byte{2, 2}
+	content := client.fillSuperRound([]byte{1, 1, 1})
+	if !bytes.Equal(content, []byte{1, 1, 1, 0, 2, 2, 0, 0}) {
+		t.Error("wrong super-round", content)
+	}
+
+	// at most CellsPerRound cells are filled
+	in <- []byte{2}
+	in <- []byte{3}
+	in <- []byte{4}
+	content = client.fillSuperRound([]byte{1})
+	if !bytes.Equal(content, []byte{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0}) || len(in) != 1 {
+		t.Error("wrong super-round", content)
+	}
+}
+
+func TestClientParamsDigest(t *testing.T) {
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	client := NewClient(false, false, false, make(chan []byte), make(chan []byte), false, "./", "", 1, "", 0, 0, msw)
+
+	params := new(net.ALL_ALL_PARAMETERS)
+	params.Add("NClients", 2)
+	params.Add("NTrustees", 1)
+	params.Add("PayloadSize", 1000)
+	params.Add("NextFreeClientID", 1)
+	if err := client.ReceivedMessage(*params); err != nil {
+		t.Fatal(err)
+	}
+	client.stateMachine.ChangeState("EPH_KEYS_SENT")
+
+	// the IDs differ between the clients, but are not part of the digest
+	params.Add("NextFreeClientID", 0)
+	if err := client.ReceivedMessage(net.REL_CLI_PARAMS_DIGEST{Digest: params.ParamsDigest()}); err != nil {
+		t.Error("the digest should match,", err)
+	}
+
+	params.Add("PayloadSize", 2000)
+	if err := client.ReceivedMessage(net.REL_CLI_PARAMS_DIGEST{Digest: params.ParamsDigest()}); err == nil {
+		t.Error("the client should refuse different parameters")
+	}
+	if client.stateMachine.State() != "SHUTDOWN" {
+		t.Error("the client should have stopped, is in state", client.stateMachine.State())
+	}
+}
+
+func TestClientSOCKSCredentials(t *testing.T) {
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	client := NewClient(false, false, false, make(chan []byte), make(chan []byte), false, "./", "", 1, "", 0, 0, msw)
+	if client.SOCKSCredentials() != nil {
+		t.Error("the client should have no credentials before the parameters")
+	}
+
+	params := new(net.ALL_ALL_PARAMETERS)
+	params.Add("NClients", 2)
+	params.Add("NTrustees", 1)
+	params.Add("PayloadSize", 1000)
+	params.Add("NextFreeClientID", 1)
+	params.Add("SocksCredentials", "browser:s3cret")
+	if err := client.ReceivedMessage(*params); err != nil {
+		t.Fatal(err)
+	}
+	if credentials := client.SOCKSCredentials(); len(credentials) != 1 || credentials["browser"] != "s3cret" {
+		t.Error("the client should take the credentials of the relay, got", credentials)
+	}
+
+	params.Add("SocksCredentials", "browser")
+	if err := client.ReceivedMessage(*params); err == nil {
+		t.Error("the client should refuse invalid credentials")
+	}
+}
+
+func TestClientRecoversFromPanics(t *testing.T) {
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	client := NewClient(false, false, false, make(chan []byte), make(chan []byte), false, "./", "", 1, "", 0, 0, msw)
+
+	params := new(net.ALL_ALL_PARAMETERS)
+	params.Add("NClients", 2)
+	params.Add("NTrustees", 1)
+	params.Add("PayloadSize", 1000)
+	params.Add("NextFreeClientID", 1)
+	if err := client.ReceivedMessage(*params); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the ephemeral keys, the client has no DC-net to process a round with
+	client.stateMachine.ChangeState("READY")
+	err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 0, Data: make([]byte, 1000)})
+	if _, ok := err.(*utils.RecoveredPanic); !ok {
+		t.Fatal("the panic should have been recovered, got", err)
+	}
+	if client.stateMachine.State() != "BEFORE_INIT" {
+		t.Error("the client should wait for new parameters, is in state", client.stateMachine.State())
+	}
+	reports := client.clientState.supervisor.Reports()
+	if len(reports) != 1 || reports[0].Entity != "Client 1" || reports[0].Subsystem != "messages" {
+		t.Error("wrong crash reports", reports)
+	}
+
+	// the client accepts the parameters of the resync
+	if err := client.ReceivedMessage(*params); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientUpstreamPaused(t *testing.T) {
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	in := make(chan []byte, 1)
+	client := NewClient(false, false, false, in, make(chan []byte), false, "./", "", 1, "", 0, 0, msw)
+	client.clientState.LastWantToSend = time.Time{}
+
+	// while paused, the data waits in the channel, and we do not reserve a slot for it
+	client.PauseUpstream()
+	if !client.UpstreamPaused() {
+		t.Error("the upstream should be paused")
+	}
+	in <- []byte{1}
+	if client.WantsToTransmit() {
+		t.Error("a paused client should not want to transmit")
+	}
+	if len(in) != 1 {
+		t.Error("a paused client should not take the data")
+	}
+
+	client.ResumeUpstream()
+	if client.UpstreamPaused() {
+		t.Error("the upstream should be resumed")
+	}
+	if !client.WantsToTransmit() {
+		t.Error("a resumed client should want to transmit its data")
+	}
+	if client.clientState.NextDataForDCNet == nil || !bytes.Equal(*client.clientState.NextDataForDCNet, []byte{1}) {
+		t.Error("the data should be taken once resumed")
+	}
+}
@@ -2,9 +2,12 @@ package client
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/proof"
 	"gopkg.in/dedis/onet.v2/log"
@@ -12,6 +15,130 @@ import (
 	"time"
 )
 
+// OWNED_PAYLOADS_HISTORY is for how many rounds we remember the payloads sent in our slots, to blame a disruption
+const OWNED_PAYLOADS_HISTORY = 100
+
+// rememberOwnedPayload keeps the payload we sent in our slot of roundID, padded like the DC-net does, and forgets the
+// ones too old to be blamed
+func (p *PriFiLibClientInstance) rememberOwnedPayload(roundID int32, payload []byte) {
+	if p.clientState.ownedPayloads == nil {
+		p.clientState.ownedPayloads = make(map[int32][]byte)
+	}
+	padded := make([]byte, p.clientState.DCNet.DCNetPayloadSize)
+	copy(padded, payload)
+	p.clientState.ownedPayloads[roundID] = padded
+	for r := range p.clientState.ownedPayloads {
+		if r <= roundID-OWNED_PAYLOADS_HISTORY {
+			delete(p.clientState.ownedPayloads, r)
+		}
+	}
+}
+
+// rotateMACKeys derives the MAC keys of our slots in the schedule msg, from our ephemeral keys and the relay's key on
+// the base of the schedule (see dcnet/mac_keys.go)
+func (p *PriFiLibClientInstance) rotateMACKeys(msg net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) error {
+	if msg.RelayPk == nil {
+		return errors.New("the relay did not send its key for the MACs of the slots")
+	}
+	keys := append([]kyber.Scalar{p.clientState.ephemeralPrivateKey}, p.clientState.extraEphemeralPrivateKeys...)
+	neff := new(scheduler.NeffShuffle)
+	slots, err := neff.ClientRecognizeExtraSlots(keys, msg.Base, msg.EphPks)
+	if err != nil {
+		return err
+	}
+	secrets := make(map[int]kyber.Point, len(slots))
+	for i, slot := range slots {
+		secrets[slot] = config.CryptoSuite.Point().Mul(keys[i], msg.RelayPk)
+	}
+	return p.clientState.DCNet.RotateMACKeys(msg.Epoch, secrets)
+}
+
+/*
+* Received_REL_ALL_DISRUPTION_DETECTED handles REL_ALL_DISRUPTION_DETECTED messages.
+* The relay found a wrong HMAC in the cell of a slot. If the slot is ours, we look for a bit we set to 0, but which
+* is 1 in the decoded cell, and blame it with a proof that we own the slot. A disruption which only cleared bits
+* cannot be blamed without revealing our content.
+ */
+func (p *PriFiLibClientInstance) Received_REL_ALL_DISRUPTION_DETECTED(msg net.REL_ALL_DISRUPTION_DETECTED) error {
+	log.Lvl1("Disruption: the relay detected a disruption in round", msg.RoundID, "slot", msg.SlotID)
+	if !p.ownsSlot(msg.SlotID) {
+		return nil
+	}
+	sent, found := p.clientState.ownedPayloads[msg.RoundID]
+	if !found {
+		log.Lvl1("Client", p.clientState.ID, ": our cell of round", msg.RoundID, "was disrupted, but we do not have it anymore")
+		return nil
+	}
+
+	bitPos := -1
+	for pos := 8; pos < 8*len(sent) && pos < 8*len(msg.Cell); pos++ {
+		if dcnet.BitAt(sent, pos) == 0 && dcnet.BitAt(msg.Cell, pos) == 1 {
+			bitPos = pos
+			break
+		}
+	}
+	if bitPos == -1 {
+		log.Lvl1("Client", p.clientState.ID, ": our cell of round", msg.RoundID, "was disrupted, but no bit we cleared was set; cannot blame it")
+		return nil
+	}
+
+	NIZK, pval := p.slotOwnershipProof(msg.SlotID)
+	if NIZK == nil {
+		e := "Client " + strconv.Itoa(p.clientState.ID) + " cannot prove that it owns slot " + strconv.Itoa(msg.SlotID)
+		log.Error(e)
+		return errors.New(e)
+	}
+	toSend := &net.CLI_REL_DISRUPTION_BLAME{
+		RoundID: msg.RoundID,
+		BitPos:  bitPos,
+		NIZK:    NIZK,
+		Pval:    pval,
+	}
+	log.Lvl1("Client", p.clientState.ID, ": our cell of round", msg.RoundID, "was disrupted, blaming bit", bitPos)
+	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(msg.RoundID))+")")
+	return nil
+}
+
+// slotOwnershipProof proves that we know the private key of the ephemeral key of slotID, in the base of the schedule.
+// Returns nil if the slot is not ours.
+func (p *PriFiLibClientInstance) slotOwnershipProof(slotID int) ([]byte, map[string]kyber.Point) {
+	if p.clientState.scheduleBase == nil || slotID < 0 || slotID >= len(p.clientState.EphemeralPublicKeys) {
+		return nil, nil
+	}
+	suite := config.CryptoSuite
+	keys := append([]kyber.Scalar{p.clientState.ephemeralPrivateKey}, p.clientState.extraEphemeralPrivateKeys...)
+	for _, x := range keys {
+		X := suite.Point().Mul(x, p.clientState.scheduleBase)
+		if !X.Equal(p.clientState.EphemeralPublicKeys[slotID]) {
+			continue
+		}
+		pval := map[string]kyber.Point{"B": p.clientState.scheduleBase, "X": X}
+		prover := proof.Rep("X", "x", "B").Prover(suite, map[string]kyber.Scalar{"x": x}, pval, nil)
+		NIZK, err := proof.HashProve(suite, "DISRUPTION", prover)
+		if err != nil {
+			log.Error("Client", p.clientState.ID, ": could not prove the ownership of slot", slotID, err)
+			return nil, nil
+		}
+		return NIZK, pval
+	}
+	return nil, nil
+}
+
+/*
+* Received_REL_ALL_REVEAL_REQUEST handles REL_ALL_REVEAL_REQUEST messages.
+* We reveal the bit at BitPos of the pad we share with each trustee for the round blamed.
+ */
+func (p *PriFiLibClientInstance) Received_REL_ALL_REVEAL_REQUEST(msg net.REL_ALL_REVEAL_REQUEST) error {
+	log.Lvl1("Disruption: the relay blames round", msg.RoundID, "at bit", msg.BitPos, ", revealing our pads")
+	toSend := &net.CLI_REL_REVEAL_BITS{
+		ClientID: p.clientState.ID,
+		RoundID:  msg.RoundID,
+		Bits:     p.clientState.DCNet.PadBitsOfRound(msg.RoundID, msg.BitPos),
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(msg.RoundID))+")")
+	return nil
+}
+
 /*
 * Received_REL_ALL_DISRUPTION_REVEAL handles REL_ALL_DISRUPTION_REVEAL messages.
 * The method calls a function from the DCNet to regenerate the bits from roundID in position BitPos
@@ -201,3 +328,15 @@ func (p *PriFiLibClientInstance) handlePossibleDisruption(msg net.REL_CLI_DOWNST
 
 	return nil
 }
+
+/*
+* Received_REL_ALL_EQUIVOCATION_ALARM handles REL_ALL_EQUIVOCATION_ALARM messages.
+* The equivocation contributions of a round were inconsistent, so the relay may have sent different data to some
+* clients; we stop sending ciphers until the relay restarts the group.
+ */
+func (p *PriFiLibClientInstance) Received_REL_ALL_EQUIVOCATION_ALARM(msg net.REL_ALL_EQUIVOCATION_ALARM) error {
+	log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : the relay raised an equivocation alarm in round", msg.RoundID, ":", msg.Reason)
+	p.clientState.sessionSummary.SetShutdownReason("the relay raised an equivocation alarm, "+msg.Reason, true)
+	p.stateMachine.ChangeState("BLAMING")
+	return nil
+}
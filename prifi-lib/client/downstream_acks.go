@@ -0,0 +1,85 @@
+package client
+
+import (
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DOWNSTREAM_ACK_MAX_GAP is how many rounds the client waits for a missing downstream round (e.g., a lost UDP
+// broadcast) to be retransmitted, before giving up on it and acknowledging the rounds after it
+const DOWNSTREAM_ACK_MAX_GAP = 64
+
+// downstreamAcks computes the cumulative ACK the client piggybacks in its upstream cells : the highest round such
+// that the client applied the downstream data of this round and of all the rounds before it
+type downstreamAcks struct {
+	acked int32
+	ahead map[int32]bool // the rounds after acked+1 which were applied
+	lost  int            // the rounds we gave up on
+}
+
+// newDownstreamAcks starts at round 0, which has no downstream data
+func newDownstreamAcks() *downstreamAcks {
+	return &downstreamAcks{ahead: make(map[int32]bool)}
+}
+
+// applied records that the downstream data of roundID was applied
+func (a *downstreamAcks) applied(roundID int32) {
+	if roundID <= a.acked {
+		return
+	}
+	a.ahead[roundID] = true
+	for a.ahead[a.acked+1] {
+		delete(a.ahead, a.acked+1)
+		a.acked++
+	}
+
+	// give up on the rounds which are missing for too long
+	for roundID-a.acked > DOWNSTREAM_ACK_MAX_GAP {
+		a.acked++
+		if a.ahead[a.acked] {
+			delete(a.ahead, a.acked)
+		} else {
+			a.lost++
+		}
+		for a.ahead[a.acked+1] {
+			delete(a.ahead, a.acked+1)
+			a.acked++
+		}
+	}
+}
+
+// missing returns true if the downstream data of roundID was not applied, and we still wait for it
+func (a *downstreamAcks) missing(roundID int32) bool {
+	return roundID > a.acked && !a.ahead[roundID]
+}
+
+// sendDownstreamNacks tells the relay that we missed the downstream data of the rounds from (included) to to
+// (excluded), i.e. lost UDP broadcasts, so that it retransmits them to us over TCP while they are still open. A gap
+// over TCP is not a loss, hence is not NACKed. We do not NACK the rounds we would give up on anyway.
+func (p *PriFiLibClientInstance) sendDownstreamNacks(from, to int32) {
+	if to-from > DOWNSTREAM_ACK_MAX_GAP {
+		from = to - DOWNSTREAM_ACK_MAX_GAP
+	}
+	for roundID := from; roundID < to; roundID++ {
+		if !p.clientState.downstreamAcks.missing(roundID) {
+			continue
+		}
+		toSend := &net.CLI_REL_DOWNSTREAM_NACK{ClientID: p.clientState.ID, RoundID: roundID}
+		p.messageSender.SendToRelayWithLog(toSend, "(NACK of round "+strconv.Itoa(int(roundID))+")")
+	}
+}
+
+// applyRetransmittedData applies the data of a downstream round we missed, and which the relay retransmitted after
+// seeing our ACKs. We already answered the rounds after it, so we do not send an upstream cell for it.
+func (p *PriFiLibClientInstance) applyRetransmittedData(msg net.REL_CLI_DOWNSTREAM_DATA) error {
+	log.Lvl3("Client " + strconv.Itoa(p.clientState.ID) + " : received the retransmission of round " + strconv.Itoa(int(msg.RoundID)))
+	p.clientState.sessionSummary.AddBytes(0, int64(len(msg.Data)))
+	if _, isAnnouncement := net.ParseDrainAnnouncement(msg.Data); !isAnnouncement && len(msg.Data) > 1 && p.clientState.DataOutputEnabled {
+		p.clientState.DataFromDCNet <- msg.Data
+	}
+	p.clientState.downstreamAcks.applied(msg.RoundID)
+	p.recordDownstreamHistory(msg.RoundID, msg.Data)
+	return nil
+}
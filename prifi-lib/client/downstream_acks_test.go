@@ -0,0 +1,96 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestDownstreamAcks(t *testing.T) {
+	a := newDownstreamAcks()
+	a.applied(1)
+	a.applied(2)
+	if a.acked != 2 {
+		t.Error("should acknowledge round 2, is", a.acked)
+	}
+
+	// round 3 is missed
+	a.applied(4)
+	a.applied(5)
+	if a.acked != 2 || !a.missing(3) || a.missing(4) {
+		t.Error("should wait for round 3, acknowledged", a.acked)
+	}
+	a.applied(3)
+	if a.acked != 5 || len(a.ahead) != 0 {
+		t.Error("should acknowledge round 5 once round 3 is applied, is", a.acked)
+	}
+
+	// round 6 is never retransmitted
+	for r := int32(7); r <= 7+DOWNSTREAM_ACK_MAX_GAP; r++ {
+		a.applied(r)
+	}
+	if a.acked != 7+DOWNSTREAM_ACK_MAX_GAP || a.lost != 1 || a.missing(6) {
+		t.Error("should give up on round 6, acknowledged", a.acked, "lost", a.lost)
+	}
+}
+
+func TestRetransmittedDownstreamData(t *testing.T) {
+	dataFromDCNet := make(chan []byte, 3)
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	client := NewClient(false, false, true, make(chan []byte), dataFromDCNet, false, "./", "", 1, "", 0, 0, msw)
+	client.clientState.RoundNo = 5
+	client.clientState.downstreamAcks.applied(1)
+	client.clientState.downstreamAcks.applied(3)
+
+	// the relay retransmits round 2, which we missed
+	if err := client.Received_REL_CLI_DOWNSTREAM_DATA(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 2, Data: []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-dataFromDCNet:
+		if len(data) != 3 {
+			t.Error("wrong data", data)
+		}
+	default:
+		t.Error("the retransmitted data should be applied")
+	}
+	if client.clientState.downstreamAcks.acked != 3 || client.clientState.RoundNo != 5 {
+		t.Error("should acknowledge round 3 and stay in round 5,", client.clientState.downstreamAcks.acked, client.clientState.RoundNo)
+	}
+
+	// an old round we applied is discarded
+	client.Received_REL_CLI_DOWNSTREAM_DATA(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 2, Data: []byte{1, 2, 3}})
+	if len(dataFromDCNet) != 0 {
+		t.Error("a round should be applied only once")
+	}
+}
+
+func TestDownstreamNacks(t *testing.T) {
+	sentToRelay = make([]interface{}, 0)
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	client := NewClient(false, false, true, make(chan []byte), make(chan []byte, 3), false, "./", "", 1, "", 0, 0, msw)
+	client.clientState.ID = 1
+	client.clientState.RoundNo = 2
+	client.clientState.downstreamAcks.applied(1)
+	client.clientState.downstreamAcks.applied(3)
+
+	// we are in round 2, and we missed rounds 2 and 4 (round 3 was retransmitted to us)
+	client.sendDownstreamNacks(2, 5)
+	if len(sentToRelay) != 2 {
+		t.Fatal("should have sent 2 NACKs, sent", len(sentToRelay))
+	}
+	for i, roundID := range []int32{2, 4} {
+		nack, ok := sentToRelay[i].(*net.CLI_REL_DOWNSTREAM_NACK)
+		if !ok || nack.RoundID != roundID || nack.ClientID != 1 {
+			t.Error("should have NACKed round", roundID, "got", sentToRelay[i])
+		}
+	}
+
+	// the rounds we would give up on are not NACKed
+	sentToRelay = make([]interface{}, 0)
+	client.sendDownstreamNacks(5, 10+DOWNSTREAM_ACK_MAX_GAP)
+	if len(sentToRelay) != DOWNSTREAM_ACK_MAX_GAP {
+		t.Error("should NACK at most", DOWNSTREAM_ACK_MAX_GAP, "rounds, sent", len(sentToRelay))
+	}
+	sentToRelay = make([]interface{}, 0)
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// newEphemeralKeys generates one ephemeral key pair per slot we want in the schedule, the main one first
+func (p *PriFiLibClientInstance) newEphemeralKeys() ([]kyber.Point, []kyber.Scalar) {
+	n := p.clientState.nSlotsOwned
+	if n < 1 {
+		n = 1
+	}
+	pks := make([]kyber.Point, n)
+	privateKeys := make([]kyber.Scalar, n)
+	for i := range pks {
+		pks[i], privateKeys[i] = crypto.NewKeyPair()
+	}
+	return pks, privateKeys
+}
+
+/*
+Received_REL_CLI_REFRESH_EPH_PKS handles REL_CLI_REFRESH_EPH_PKS messages, sent when the relay rotates the schedule.
+We send fresh ephemeral keys, so that our next slots cannot be linked to the current ones. Until a schedule with the
+fresh keys arrives, we keep the current keys : the relay might shuffle the previous ones if we answer too late.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_REFRESH_EPH_PKS(msg net.REL_CLI_REFRESH_EPH_PKS) error {
+	log.Lvl2("Client", p.clientState.ID, ": sending fresh ephemeral keys for epoch", msg.Epoch)
+
+	ephPks, ephPrivateKeys := p.newEphemeralKeys()
+	p.clientState.freshEphemeralPrivateKeys = ephPrivateKeys
+
+	toSend := &net.CLI_REL_TELL_PK_AND_EPH_PK{
+		ClientID:    p.clientState.ID,
+		Pk:          p.clientState.PublicKey,
+		EphPk:       ephPks[0],
+		ExtraEphPks: ephPks[1:],
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(fresh ephemeral keys)")
+	return nil
+}
+
+// useFreshEphemeralKeys switches to the fresh ephemeral keys, if the new schedule contains them
+func (p *PriFiLibClientInstance) useFreshEphemeralKeys(msg net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) {
+	fresh := p.clientState.freshEphemeralPrivateKeys
+	if fresh == nil {
+		return
+	}
+	neff := new(scheduler.NeffShuffle)
+	if _, err := neff.ClientRecognizeExtraSlots(fresh[:1], msg.Base, msg.EphPks); err != nil {
+		// the relay shuffled our previous keys; the fresh ones might still be in a later schedule
+		log.Lvl2("Client", p.clientState.ID, ": the new schedule does not contain our fresh ephemeral keys")
+		return
+	}
+	p.clientState.ephemeralPrivateKey = fresh[0]
+	p.clientState.EphemeralPublicKey = config.CryptoSuite.Point().Mul(fresh[0], nil)
+	p.clientState.extraEphemeralPrivateKeys = fresh[1:]
+	p.clientState.freshEphemeralPrivateKeys = nil
+}
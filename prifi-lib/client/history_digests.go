@@ -0,0 +1,67 @@
+package client
+
+/*
+When the relay sets RelayHistoryDigestInterval, the client chains the downstream data of the rounds it acknowledges
+(see dcnet/history_digests.go), and reports the digest of each checkpoint in its upstream cell. If it differs from the
+relay's, the relay asks for the digests of the rounds before it, and then gives the client its own digests from the
+first round which diverged on.
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// recordDownstreamHistory records the downstream data of roundID, and chains the rounds we acknowledge
+func (p *PriFiLibClientInstance) recordDownstreamHistory(roundID int32, data []byte) {
+	if p.clientState.history == nil {
+		return
+	}
+	p.clientState.history.Add(roundID, data)
+	p.clientState.history.Advance(p.clientState.downstreamAcks.acked)
+}
+
+// historyReport returns the digest of our downstream history at the last checkpoint, once per checkpoint, to be
+// piggybacked in the upstream cell; (0, nil) if there is no new checkpoint
+func (p *PriFiLibClientInstance) historyReport() (int32, []byte) {
+	if p.clientState.history == nil {
+		return 0, nil
+	}
+	checkpoint := p.clientState.history.Checkpoint(p.clientState.HistoryDigestInterval)
+	if checkpoint <= p.clientState.historyReported {
+		return 0, nil
+	}
+	p.clientState.historyReported = checkpoint
+	digest, _ := p.clientState.history.Digest(checkpoint)
+	return checkpoint, digest
+}
+
+// Received_REL_CLI_HISTORY_REQUEST handles REL_CLI_HISTORY_REQUEST messages. The relay looks for the first round
+// where our downstream history diverged from its own; we give it our digest of the round asked, or nil if we do not
+// have it anymore.
+func (p *PriFiLibClientInstance) Received_REL_CLI_HISTORY_REQUEST(msg net.REL_CLI_HISTORY_REQUEST) error {
+	toSend := &net.CLI_REL_HISTORY_DIGEST{ClientID: p.clientState.ID, RoundID: msg.RoundID}
+	if p.clientState.history != nil {
+		toSend.Digest, _ = p.clientState.history.Digest(msg.RoundID)
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(history digest of round "+strconv.Itoa(int(msg.RoundID))+")")
+	return nil
+}
+
+// Received_REL_CLI_HISTORY_RESYNC handles REL_CLI_HISTORY_RESYNC messages. Our downstream history diverged from the
+// relay's in round FirstRoundID (e.g., we lost it); we adopt the relay's digests from there on.
+func (p *PriFiLibClientInstance) Received_REL_CLI_HISTORY_RESYNC(msg net.REL_CLI_HISTORY_RESYNC) error {
+	if p.clientState.history == nil {
+		return nil
+	}
+	if err := p.clientState.history.Resync(msg.FirstRoundID, msg.Digests); err != nil {
+		e := "Client " + strconv.Itoa(p.clientState.ID) + " : cannot resynchronize the downstream history, " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	log.Lvl1("Client "+strconv.Itoa(p.clientState.ID)+" : our downstream history diverged in round", msg.FirstRoundID, ", resynchronized with the relay's")
+	return nil
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestHistoryDigests(t *testing.T) {
+	sentToRelay = make([]interface{}, 0)
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	client := NewClient(false, false, true, make(chan []byte), make(chan []byte, 10), false, "./", "", 1, "", 0, 0, msw)
+	client.clientState.history = dcnet.NewHistoryDigests(0, 0)
+	client.clientState.HistoryDigestInterval = 4
+
+	relay := dcnet.NewHistoryDigests(0, 0)
+	for r := int32(1); r <= 5; r++ {
+		data := []byte{byte(r)}
+		relay.Add(r, data)
+		relay.Advance(r)
+		if r == 3 {
+			data = []byte{0} // we received round 3 corrupted
+		}
+		client.clientState.downstreamAcks.applied(r)
+		client.recordDownstreamHistory(r, data)
+	}
+
+	// the digest of checkpoint 4 is reported once
+	roundID, digest := client.historyReport()
+	if ours, _ := client.clientState.history.Digest(4); roundID != 4 || !bytes.Equal(digest, ours) {
+		t.Error("The digest of round 4 should be reported, got round", roundID)
+	}
+	if roundID, digest := client.historyReport(); roundID != 0 || digest != nil {
+		t.Error("Checkpoint 4 is already reported")
+	}
+
+	// the relay asks for our digests
+	if err := client.Received_REL_CLI_HISTORY_REQUEST(net.REL_CLI_HISTORY_REQUEST{RoundID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Received_REL_CLI_HISTORY_REQUEST(net.REL_CLI_HISTORY_REQUEST{RoundID: 100}); err != nil {
+		t.Fatal(err)
+	}
+	relayDigest, _ := relay.Digest(2)
+	if len(sentToRelay) != 2 {
+		t.Fatal("Two digests should be sent, sent", len(sentToRelay))
+	}
+	if answer := sentToRelay[0].(*net.CLI_REL_HISTORY_DIGEST); answer.RoundID != 2 || !bytes.Equal(answer.Digest, relayDigest) {
+		t.Error("Wrong digest of round 2")
+	}
+	if answer := sentToRelay[1].(*net.CLI_REL_HISTORY_DIGEST); answer.Digest != nil {
+		t.Error("We do not have the digest of round 100")
+	}
+
+	// we adopt the relay's digests from round 3
+	firstRound, digests := relay.Digests(3)
+	if err := client.Received_REL_CLI_HISTORY_RESYNC(net.REL_CLI_HISTORY_RESYNC{FirstRoundID: firstRound, Digests: digests[:1]}); err == nil {
+		t.Error("A resync which does not cover round 5 should be refused")
+	}
+	if err := client.Received_REL_CLI_HISTORY_RESYNC(net.REL_CLI_HISTORY_RESYNC{FirstRoundID: firstRound, Digests: digests}); err != nil {
+		t.Fatal(err)
+	}
+	ours, _ := client.clientState.history.Digest(5)
+	theirs, _ := relay.Digest(5)
+	if !bytes.Equal(ours, theirs) {
+		t.Error("We should have the relay's digest of round 5 after the resync")
+	}
+}
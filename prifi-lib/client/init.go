@@ -12,6 +12,8 @@ package client
  * - REL_CLI_TELL_TRUSTEES_PK - the trustee's identities. We react by sending our identity + ephemeral identity
  * - REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG - the shuffle from the trustees. We do some check, if they pass, we can communicate. We send the first round to the relay.
  * - REL_CLI_DOWNSTREAM_DATA - the data from the relay, for one round. We react by finishing the round (sending our data to the relay)
+ * - REL_CLI_GOODBYE - the relay removed us from the session, after we asked to leave. We shut down
+ * - REL_CLI_REFRESH_EPH_PKS - the schedule is over. We send fresh ephemeral keys, used in the next schedule
  *
  * local functions :
  *
@@ -27,11 +29,13 @@ import (
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/transform"
 	"github.com/dedis/prifi/prifi-lib/utils"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -48,15 +52,29 @@ type ClientState struct {
 	LastMessage                   []byte
 	B_echo_last                   byte
 	DisruptionWrongBitPosition    int
+	ownedPayloads                 map[int32][]byte // the payloads we sent in our slots, to blame a disruption
 	ephemeralPrivateKey           kyber.Scalar
 	EphemeralPublicKey            kyber.Point
+	extraEphemeralPrivateKeys     []kyber.Scalar // one per additional slot we asked for
+	freshEphemeralPrivateKeys     []kyber.Scalar // the keys sent for the next schedule, main one first; nil if none
 	ID                            int
-	LatencyTest                   *prifilog.LatencyTests
+	LatencyTest                   *LatencyTester
+	sessionSummary                *prifilog.SessionSummary // totals since the client started, for the shutdown report
 	MySlot                        int
+	MySlots                       []int // all the slots we own in the schedule, sorted; contains MySlot
 	Name                          string
 	nClients                      int
+	nSlots                        int // number of slots in the schedule, >= nClients
+	nSlotsRequested               int // number of slots we want in the schedule
+	nSlotsOwned                   int // number of slots we ask for, capped by the relay's MaxSlotsPerClient
 	nTrustees                     int
+	TrusteeQuorum                 int // minimum number of trustees we accept to share pads with in an epoch
 	PayloadSize                   int
+	CellsPerRound                 int                                // number of cells of PayloadSize in each round; we fill them in order when we own the slot
+	WarmupRounds                  int                                // rounds 1 to WarmupRounds carry synthetic data, which the relay checks
+	allocatedUpstreamSize         int                                // with variable slot sizes, the size of the upstream cell of this round; 0 if it is the whole cell
+	payloadTransform              transform.Spec                     // the transform of the payloads of our slots, see package transform
+	payloadTransforms             map[int]transform.PayloadTransform // slot -> the encoder of its payloads, if the transform is enabled
 	privateKey                    kyber.Scalar
 	PublicKey                     kyber.Point
 	sharedSecrets                 []kyber.Point
@@ -67,10 +85,27 @@ type ClientState struct {
 	StartStopReceiveBroadcast     chan bool
 	timeStatistics                map[string]*prifilog.TimeStatistics
 	pcapReplay                    *PCAPReplayer
+	trafficShaper                 *TrafficShaper
 	DisruptionProtectionEnabled   bool
+	MACAlgorithm                  byte // the MAC which ends the cells of our slots with the disruption protection
 	LastWantToSend                time.Time
 	EquivocationProtectionEnabled bool
 	EphemeralPublicKeys           []kyber.Point
+	scheduleBase                  kyber.Point              // the base of EphemeralPublicKeys
+	ParametersEpoch               int32                    // the last parameters epoch activated by the relay
+	RelayShutdownDeadline         time.Time                // set when the relay announced it is draining
+	cellCapture                   *utils.CellCaptureWriter // if non-nil, the cell-level activity (no payloads) is logged there
+	udpVerifier                   *udpVerifier             // if non-nil, a sample of the UDP broadcasts is compared with a TCP copy
+	paramsDigest                  []byte                   // digest of the parameters we received for this epoch
+	supervisor                    *utils.Supervisor        // recovers the panics of the message handlers and of the UDP listener
+	downstreamAcks                *downstreamAcks          // the downstream rounds we applied, acknowledged in the upstream cells
+	history                       *dcnet.HistoryDigests    // the digests of the downstream data, nil if the relay does not check them
+	HistoryDigestInterval         int                      // we report the digest of our downstream history every that many rounds
+	historyReported               int32                    // the last checkpoint whose digest we reported
+	upstreamPaused                int32                    // 1 while the upstream is paused (see PauseUpstream), accessed atomically
+	leaveRequested                int32                    // 1 once we said goodbye to the relay (see Leave), accessed atomically
+	left                          chan bool                // closed once the relay removed us from the session
+	socksCredentials              atomic.Value             // the username/password pairs the relay accepts from the applications (map[string]string)
 	// TEST DISRUPTION
 	ForceDisruptionSinceRound3 bool
 	AllreadyDisrupted          bool
@@ -92,29 +127,27 @@ type PCAPReplayer struct {
 
 // PriFiLibInstance contains the mutable state of a PriFi entity.
 type PriFiLibClientInstance struct {
-	messageSender *net.MessageSenderWrapper
-	clientState   *ClientState
-	stateMachine  *utils.StateMachine
+	messageSender  *net.MessageSenderWrapper
+	clientState    *ClientState
+	stateMachine   *utils.StateMachine
+	incomingFaults *net.FaultInjector // drops, delays or corrupts the messages received, in the tests; nil otherwise
 }
 
 // NewClient creates a new PriFi client entity state.
-func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, msgSender *net.MessageSenderWrapper) *PriFiLibClientInstance {
+func NewClient(doLatencyTest bool, encryptLatencyTests bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, trafficShapingProfile string, slotsPerSchedule int, cellCaptureFile string, udpVerificationRate int, udpVerificationMaxDivergences int, msgSender *net.MessageSenderWrapper) *PriFiLibClientInstance {
 
 	clientState := new(ClientState)
 
 	//instantiates the static stuff
 	clientState.PublicKey, clientState.privateKey = crypto.NewKeyPair()
 	//clientState.StartStopReceiveBroadcast = make(chan bool) //this should stay nil, !=nil -> we have a listener goroutine active
-	clientState.LatencyTest = &prifilog.LatencyTests{
-		DoLatencyTests:       doLatencyTest,
-		LatencyTestsInterval: 2 * time.Second,
-		NextLatencyTest:      time.Now(),
-		LatencyTestsToSend:   make([]*prifilog.LatencyTestToSend, 0),
-	}
+	clientState.sessionSummary = prifilog.NewSessionSummary("Client")
 	clientState.timeStatistics = make(map[string]*prifilog.TimeStatistics)
-	clientState.timeStatistics["latency-msg-stayed-in-buffer"] = prifilog.NewTimeStatistics()
-	clientState.timeStatistics["measured-latency"] = prifilog.NewTimeStatistics()
+	clientState.timeStatistics[LATENCY_STAYED_IN_BUFF] = prifilog.NewTimeStatistics()
+	clientState.timeStatistics[LATENCY_MEASURED] = prifilog.NewTimeStatistics()
 	clientState.timeStatistics["round-processing"] = prifilog.NewTimeStatistics()
+	clientState.LatencyTest = NewLatencyTester(doLatencyTest, encryptLatencyTests,
+		clientState.timeStatistics[LATENCY_MEASURED], clientState.timeStatistics[LATENCY_STAYED_IN_BUFF])
 	clientState.DataForDCNet = dataForDCNet
 	clientState.NextDataForDCNet = nil
 	clientState.DataFromDCNet = dataFromDCNet
@@ -125,6 +158,29 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 		PCAPFolder: pcapFolder,
 		time0:      uint64(MsTimeStampNow()),
 	}
+	shaper, err := NewTrafficShaper(trafficShapingProfile)
+	if err != nil {
+		log.Error(err, "; not shaping the traffic.")
+		shaper, _ = NewTrafficShaper(SHAPING_NONE)
+	}
+	clientState.trafficShaper = shaper
+	if slotsPerSchedule < 1 {
+		slotsPerSchedule = 1
+	}
+	clientState.nSlotsRequested = slotsPerSchedule
+	if cellCaptureFile != "" {
+		cellCapture, err := utils.NewCellCaptureFileWriter(cellCaptureFile)
+		if err != nil {
+			log.Error("Client : could not open the cell capture file", cellCaptureFile, err)
+		} else {
+			log.Lvl1("Client : logging the cell-level activity (no payloads) to", cellCaptureFile)
+			clientState.cellCapture = cellCapture
+		}
+	}
+	clientState.udpVerifier = newUDPVerifier(udpVerificationRate, udpVerificationMaxDivergences)
+	clientState.supervisor = utils.NewSupervisor("Client", CLIENT_MAX_RESTARTS)
+	clientState.downstreamAcks = newDownstreamAcks()
+	clientState.left = make(chan bool)
 
 	//init the state machine
 	states := []string{"BEFORE_INIT", "EPH_KEYS_SENT", "READY", "BLAMING", "SHUTDOWN"}
@@ -136,7 +192,7 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 		if strings.Contains(s.(string), ", but in state SHUTDOWN") { //it's an "acceptable error"
 			log.Lvl2(s)
 		} else {
-			log.Fatal(s)
+			log.Error(s) //the message is dropped; an unexpected message must not crash the app embedding the client
 		}
 	}
 	sm.Init(states, logFn, errFn)
@@ -151,9 +207,40 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 }
 
 // ReceivedMessage must be called when a PriFi host receives a message.
-// It takes care to call the correct message handler function.
+// It takes care to call the correct message handler function. A panic in a handler does not kill the client : it is
+// reported, and the client resyncs with the relay.
 func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
+	faulted, handleNow := p.incomingFaults.Filter(msg, p.protectedReceivedMessage)
+	if !handleNow {
+		log.Lvl3("Client : fault injection, not handling a", reflect.TypeOf(msg), "now")
+		return nil
+	}
+	return p.protectedReceivedMessage(faulted)
+}
+
+// SetFaultInjectors makes the client drop, delay or corrupt some of the messages it receives (incoming) and sends
+// (outgoing), for the tests; nil delivers everything. It must be called before the messages it should apply to.
+func (p *PriFiLibClientInstance) SetFaultInjectors(incoming *net.FaultInjector, outgoing *net.FaultInjector) {
+	p.incomingFaults = incoming
+	p.messageSender.SetFaultInjector(outgoing)
+}
+
+// protectedReceivedMessage handles a message, recovering from a panic of its handler
+func (p *PriFiLibClientInstance) protectedReceivedMessage(msg interface{}) error {
+	err := p.clientState.supervisor.Protect("messages", func() error {
+		return p.receivedMessage(msg)
+	})
+	if _, ok := err.(*utils.RecoveredPanic); ok {
+		p.resyncAfterPanic()
+	}
+	if err != nil {
+		p.clientState.sessionSummary.AddError()
+	}
+
+	return err
+}
 
+func (p *PriFiLibClientInstance) receivedMessage(msg interface{}) error {
 	var err error
 
 	switch typedMsg := msg.(type) {
@@ -172,9 +259,22 @@ func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
 			err = p.Received_REL_CLI_UDP_DOWNSTREAM_DATA(typedMsg)
 		}
 	case net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG:
-		if p.stateMachine.AssertState("EPH_KEYS_SENT") {
+		// in READY, the new schedule after some clients joined during the session
+		if p.stateMachine.AssertStateOrState("EPH_KEYS_SENT", "READY") {
 			err = p.Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(typedMsg)
 		}
+	case net.REL_ALL_DISRUPTION_DETECTED:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_DISRUPTION_DETECTED(typedMsg)
+		}
+	case net.REL_ALL_EQUIVOCATION_ALARM:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_EQUIVOCATION_ALARM(typedMsg)
+		}
+	case net.REL_ALL_REVEAL_REQUEST:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_REVEAL_REQUEST(typedMsg)
+		}
 	case net.REL_ALL_DISRUPTION_REVEAL:
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_ALL_DISRUPTION_REVEAL(typedMsg)
@@ -183,9 +283,65 @@ func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_ALL_REVEAL_SHARED_SECRETS(typedMsg)
 		}
+	case net.REL_ALL_PARAMETERS_PROPOSAL:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_PARAMETERS_PROPOSAL(typedMsg)
+		}
+	case net.REL_ALL_PARAMETERS_ACTIVATE:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_PARAMETERS_ACTIVATE(typedMsg)
+		}
+	case net.REL_CLI_DOWNSTREAM_COPY:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_DOWNSTREAM_COPY(typedMsg)
+		}
+	case net.REL_CLI_GOODBYE:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_GOODBYE(typedMsg)
+		}
+	case net.REL_CLI_REFRESH_EPH_PKS:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_REFRESH_EPH_PKS(typedMsg)
+		}
+	case net.REL_CLI_HISTORY_REQUEST:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_HISTORY_REQUEST(typedMsg)
+		}
+	case net.REL_CLI_HISTORY_RESYNC:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_HISTORY_RESYNC(typedMsg)
+		}
+	case net.REL_CLI_PARAMS_DIGEST:
+		if p.stateMachine.AssertState("EPH_KEYS_SENT") {
+			err = p.Received_REL_CLI_PARAMS_DIGEST(typedMsg)
+		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
 
 	return err
 }
+
+// ShutdownReport returns the summary of the client's session, as of now
+func (p *PriFiLibClientInstance) ShutdownReport() *prifilog.ShutdownReport {
+	r := p.clientState.sessionSummary.Report()
+	r.LatencyMs = p.clientState.LatencyTest.Summary()
+	return r
+}
+
+// State returns the current state of the client, e.g. "READY"
+func (p *PriFiLibClientInstance) State() string {
+	return p.stateMachine.State()
+}
+
+// DCNetUp returns true if the client takes part in the rounds, i.e. if its SOCKS data is sent anonymously
+func (p *PriFiLibClientInstance) DCNetUp() bool {
+	return p.stateMachine.State() == "READY"
+}
+
+// SOCKSCredentials returns the username/password pairs the relay gave in the parameters, which the applications must
+// give to use our SOCKS server; nil if there are none
+func (p *PriFiLibClientInstance) SOCKSCredentials() map[string]string {
+	credentials, _ := p.clientState.socksCredentials.Load().(map[string]string)
+	return credentials
+}
@@ -0,0 +1,145 @@
+package client
+
+/*
+The latency tests measure the round-trip time through the DC-net : client 0 queues timestamped probes at a regular
+rate, and sends them in its slot when it has no other data. The relay recognizes them by their pattern
+(prifilog.LATENCY_PROBE_PATTERN), and sends them back as is in the downstream data of the next round it opens. The
+client recognizes its own probes in the downstream data, and records the time since they were created
+("measured-latency"), and the time they waited for a slot ("latency-msg-stayed-in-buffer"). The probes can be
+encrypted (see prifilog.LatencyProbeCipher), so that the relay cannot read nor forge their timestamps.
+*/
+
+import (
+	"math/rand"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DEFAULT_LATENCY_TEST_INTERVAL is the time between two probes, if no other is set
+const DEFAULT_LATENCY_TEST_INTERVAL = 2 * time.Second
+
+// The time statistics of the latency tests
+const (
+	LATENCY_MEASURED       = "measured-latency"             // round-trip time of the probes, from their creation to their echo
+	LATENCY_STAYED_IN_BUFF = "latency-msg-stayed-in-buffer" // from the creation of the probes to their sending
+)
+
+// LatencyTester creates the latency probes of a client, and measures the round-trip time of their echoes
+type LatencyTester struct {
+	enabled  bool
+	interval time.Duration                 // the probes are created every interval, plus up to interval/2 at random
+	next     time.Time                     // when the next probe is created
+	pending  []*prifilog.LatencyTestToSend // created, but not sent yet
+	cipher   *prifilog.LatencyProbeCipher  // if not nil, the probes are encrypted
+	rtt      *prifilog.TimeStatistics
+	buffered *prifilog.TimeStatistics
+}
+
+// NewLatencyTester creates a LatencyTester, which does nothing unless enabled; the time statistics are the ones where
+// the measures are recorded
+func NewLatencyTester(enabled bool, encrypted bool, rtt *prifilog.TimeStatistics, buffered *prifilog.TimeStatistics) *LatencyTester {
+	t := &LatencyTester{
+		enabled:  enabled,
+		interval: DEFAULT_LATENCY_TEST_INTERVAL,
+		next:     time.Now(),
+		pending:  make([]*prifilog.LatencyTestToSend, 0),
+		rtt:      rtt,
+		buffered: buffered,
+	}
+	if enabled && encrypted {
+		cipher, err := prifilog.NewLatencyProbeCipher()
+		if err != nil {
+			log.Error("Could not create the latency probes cipher,", err, "; not doing latency tests.")
+			t.enabled = false
+		}
+		t.cipher = cipher
+	}
+	return t
+}
+
+// Enabled returns true if the client does latency tests
+func (t *LatencyTester) Enabled() bool {
+	return t.enabled
+}
+
+// SetInterval sets the time between two probes; 0 or less means DEFAULT_LATENCY_TEST_INTERVAL
+func (t *LatencyTester) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_LATENCY_TEST_INTERVAL
+	}
+	t.interval = interval
+}
+
+// schedule creates a probe if it is time to. Only client 0 sends probes, so that the tests do not take the slots of
+// all the clients.
+func (t *LatencyTester) schedule(clientID int, now time.Time) {
+	if !t.enabled || clientID != 0 || now.Before(t.next) {
+		return
+	}
+	log.Lvl1("Client 0 wants to send a latency test")
+	t.pending = append(t.pending, &prifilog.LatencyTestToSend{CreatedAt: now})
+	t.next = now.Add(t.interval)
+	if jitter := int64(t.interval / 2); jitter > 0 {
+		t.next = t.next.Add(time.Duration(rand.Int63n(jitter)))
+	}
+}
+
+// hasProbes returns true if some probes wait to be sent
+func (t *LatencyTester) hasProbes() bool {
+	return len(t.pending) > 0
+}
+
+// encode packs as many pending probes as fit in a payload of payloadSize bytes; returns nil if there are none
+func (t *LatencyTester) encode(clientID int, roundID int32, payloadSize int) []byte {
+	if !t.hasProbes() {
+		return nil
+	}
+	logFn := func(timeDiff int64) {
+		t.buffered.AddTime(timeDiff)
+		t.buffered.ReportWithInfo(LATENCY_STAYED_IN_BUFF)
+	}
+	toBytes := prifilog.LatencyMessagesToBytes
+	if t.cipher != nil {
+		toBytes = t.cipher.LatencyMessagesToBytes
+	}
+	bytes, pending := toBytes(t.pending, clientID, roundID, payloadSize, logFn)
+	t.pending = pending
+	if len(bytes) == 0 {
+		return nil
+	}
+	return bytes
+}
+
+// decode records the round-trip time of our probes echoed in the downstream data of roundID, if any
+func (t *LatencyTester) decode(data []byte, clientID int, roundID int32) {
+	if !t.enabled || len(data) <= 2 {
+		return
+	}
+	actionFunction := func(roundRec int32, roundDiff int32, timeDiff int64) {
+		log.Lvl3("Measured latency is", timeDiff, ", for client", clientID, ", roundDiff", roundDiff, ", received on round", roundID)
+		t.rtt.AddTime(timeDiff)
+		t.rtt.ReportWithInfo(LATENCY_MEASURED)
+	}
+	if t.cipher != nil {
+		t.cipher.DecodeLatencyMessages(data, clientID, roundID, actionFunction)
+	} else {
+		prifilog.DecodeLatencyMessages(data, clientID, roundID, actionFunction)
+	}
+}
+
+// Summary returns the percentiles of the round-trip times measured so far, in ms; nil if the tests are disabled
+func (t *LatencyTester) Summary() *prifilog.TimeSummary {
+	if !t.enabled {
+		return nil
+	}
+	s := t.rtt.Summary()
+	return &s
+}
+
+// SetLatencyTestInterval sets the time between two latency probes of the client; it must be called before the client
+// starts
+func (p *PriFiLibClientInstance) SetLatencyTestInterval(interval time.Duration) {
+	p.clientState.LatencyTest.SetInterval(interval)
+}
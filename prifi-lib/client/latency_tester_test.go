@@ -0,0 +1,51 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+func TestLatencyTester(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		rtt, buffered := prifilog.NewTimeStatistics(), prifilog.NewTimeStatistics()
+		lt := NewLatencyTester(true, encrypted, rtt, buffered)
+		lt.SetInterval(100 * time.Millisecond)
+		now := time.Now()
+
+		// only client 0 sends probes, at the interval plus up to half of it
+		lt.schedule(1, now)
+		if lt.hasProbes() {
+			t.Error("Only client 0 should send probes")
+		}
+		lt.schedule(0, now)
+		lt.schedule(0, now.Add(99*time.Millisecond))
+		if len(lt.pending) != 1 || lt.next.Before(now.Add(100*time.Millisecond)) || !lt.next.Before(now.Add(150*time.Millisecond)) {
+			t.Error("Expected one probe, and the next one in 100 to 150ms, got", len(lt.pending), lt.next.Sub(now))
+		}
+
+		// the relay echoes the payload as is, and only its sender decodes it (an encrypted probe does not decrypt
+		// under the key of another client anyway)
+		probes := lt.encode(0, 5, 100)
+		if probes == nil || lt.hasProbes() || buffered.Histogram().Count() != 1 {
+			t.Fatal("The probe should have been sent")
+		}
+		if !encrypted {
+			lt.decode(probes, 1, 7)
+		}
+		lt.decode(probes, 0, 7)
+		if s := lt.Summary(); s == nil || s.Count != 1 {
+			t.Error("Expected the round-trip time of one probe, got", s)
+		}
+		if lt.encode(0, 6, 100) != nil {
+			t.Error("There are no probes left to send")
+		}
+	}
+
+	lt := NewLatencyTester(false, false, prifilog.NewTimeStatistics(), prifilog.NewTimeStatistics())
+	lt.schedule(0, time.Now())
+	if lt.hasProbes() || lt.Summary() != nil {
+		t.Error("A disabled tester should not send probes")
+	}
+}
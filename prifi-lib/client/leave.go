@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Leave asks the relay to remove this client from the session. Until the relay answers, the client keeps taking part
+// in the rounds, with cover traffic only; the returned channel is closed once the relay removed it, and the client is
+// then shut down. It can be called from any goroutine.
+func (p *PriFiLibClientInstance) Leave() (chan bool, error) {
+	if p.stateMachine.State() != "READY" {
+		return nil, errors.New("the client is not communicating, it cannot leave the session")
+	}
+	if !atomic.CompareAndSwapInt32(&p.clientState.leaveRequested, 0, 1) {
+		return p.clientState.left, nil
+	}
+	p.PauseUpstream()
+
+	log.Lvl1("Client", p.clientState.ID, ": leaving the session")
+	toSend := &net.CLI_REL_GOODBYE{ClientID: p.clientState.ID}
+	p.messageSender.SendToRelayWithLog(toSend, "")
+	return p.clientState.left, nil
+}
+
+/*
+Received_REL_CLI_GOODBYE handles REL_CLI_GOODBYE messages, the answer of the relay to CLI_REL_GOODBYE. The rounds
+after msg.LastRoundID are decoded without this client, which shuts down.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_GOODBYE(msg net.REL_CLI_GOODBYE) error {
+	if atomic.LoadInt32(&p.clientState.leaveRequested) == 0 {
+		e := "Client " + strconv.Itoa(p.clientState.ID) + " : the relay removed us from the session, but we did not ask to leave"
+		log.Error(e)
+		return errors.New(e)
+	}
+	log.Lvl1("Client", p.clientState.ID, ": left the session after round", msg.LastRoundID)
+
+	err := p.Received_ALL_ALL_SHUTDOWN(net.ALL_ALL_SHUTDOWN{Reason: "left the session"})
+	close(p.clientState.left)
+	return err
+}
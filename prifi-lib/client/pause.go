@@ -0,0 +1,28 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// PauseUpstream stops taking data from DataForDCNet : the client keeps participating in every round, but its slots
+// only carry cover (empty) cells, and the data stays in DataForDCNet until ResumeUpstream. It can be called from
+// any goroutine.
+func (p *PriFiLibClientInstance) PauseUpstream() {
+	if atomic.SwapInt32(&p.clientState.upstreamPaused, 1) == 0 {
+		log.Lvl1("Client", p.clientState.ID, ": upstream paused, sending only cover traffic")
+	}
+}
+
+// ResumeUpstream sends the data of DataForDCNet again, after PauseUpstream
+func (p *PriFiLibClientInstance) ResumeUpstream() {
+	if atomic.SwapInt32(&p.clientState.upstreamPaused, 0) == 1 {
+		log.Lvl1("Client", p.clientState.ID, ": upstream resumed")
+	}
+}
+
+// UpstreamPaused returns true if the client sends only cover traffic
+func (p *PriFiLibClientInstance) UpstreamPaused() bool {
+	return atomic.LoadInt32(&p.clientState.upstreamPaused) == 1
+}
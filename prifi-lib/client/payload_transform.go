@@ -0,0 +1,16 @@
+package client
+
+import (
+	"github.com/dedis/prifi/prifi-lib/transform"
+)
+
+// slotPayloadTransform returns the encoder of the payloads of our slot; the relay decodes them with a decoder of its
+// own for the slot, which it starts at the same time, with the schedule
+func (p *PriFiLibClientInstance) slotPayloadTransform(slot int) transform.PayloadTransform {
+	encoder, found := p.clientState.payloadTransforms[slot]
+	if !found {
+		encoder = p.clientState.payloadTransform.New()
+		p.clientState.payloadTransforms[slot] = encoder
+	}
+	return encoder
+}
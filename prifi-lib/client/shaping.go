@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+// The traffic shaping profiles a client can use. They only change when (and how much) data leaves DataForDCNet,
+// the DC-net itself is untouched. Useful for controlled traffic-analysis experiments.
+const (
+	SHAPING_NONE     = "none"     // send data as soon as we own a slot
+	SHAPING_CONSTANT = "constant" // constant upstream rate, and we reserve our slot every time
+	SHAPING_WEB      = "web"      // short bursts (page loads) separated by think times
+	SHAPING_VIDEO    = "video"    // one fixed-size segment every SHAPING_VIDEO_SEGMENT_INTERVAL
+)
+
+// SHAPING_CONSTANT_RATE is the upstream rate (bytes/s) of the "constant" profile
+const SHAPING_CONSTANT_RATE = 10000
+
+// SHAPING_WEB_BURST_DURATION is the length of a burst of the "web" profile
+const SHAPING_WEB_BURST_DURATION = 500 * time.Millisecond
+
+// SHAPING_WEB_THINK_TIME is the silence between two bursts of the "web" profile
+const SHAPING_WEB_THINK_TIME = 2 * time.Second
+
+// SHAPING_VIDEO_SEGMENT_INTERVAL is the time between two segments of the "video" profile
+const SHAPING_VIDEO_SEGMENT_INTERVAL = 2 * time.Second
+
+// SHAPING_VIDEO_SEGMENT_SIZE is the number of bytes that can be sent per segment of the "video" profile
+const SHAPING_VIDEO_SEGMENT_SIZE = 50000
+
+// TrafficShaper decides whether some upstream data can be sent in the current slot
+type TrafficShaper struct {
+	Profile     string
+	time0       time.Time
+	lastRefill  time.Time
+	lastSegment int64
+	tokens      int
+}
+
+// NewTrafficShaper returns a shaper for the given profile ("" is the same as "none")
+func NewTrafficShaper(profile string) (*TrafficShaper, error) {
+	switch profile {
+	case "":
+		profile = SHAPING_NONE
+	case SHAPING_NONE, SHAPING_CONSTANT, SHAPING_WEB, SHAPING_VIDEO:
+	default:
+		return nil, errors.New("Unknown traffic shaping profile \"" + profile + "\", valid are none, constant, web, video")
+	}
+
+	now := time.Now()
+	s := &TrafficShaper{
+		Profile:     profile,
+		time0:       now,
+		lastRefill:  now,
+		lastSegment: -1,
+	}
+	return s, nil
+}
+
+// Allows returns true if "size" bytes can be sent now, and accounts for them if so
+func (s *TrafficShaper) Allows(now time.Time, size int) bool {
+	switch s.Profile {
+	case SHAPING_CONSTANT:
+		//token bucket, which can hold at most one second of traffic (or one message)
+		elapsed := now.Sub(s.lastRefill)
+		s.lastRefill = now
+		capacity := SHAPING_CONSTANT_RATE
+		if size > capacity {
+			capacity = size
+		}
+		s.tokens += int(elapsed.Seconds() * SHAPING_CONSTANT_RATE)
+		if s.tokens > capacity {
+			s.tokens = capacity
+		}
+		if s.tokens < size {
+			return false
+		}
+		s.tokens -= size
+		return true
+
+	case SHAPING_WEB:
+		return s.inWebBurst(now)
+
+	case SHAPING_VIDEO:
+		segment := int64(now.Sub(s.time0) / SHAPING_VIDEO_SEGMENT_INTERVAL)
+		if segment != s.lastSegment {
+			s.lastSegment = segment
+			s.tokens = SHAPING_VIDEO_SEGMENT_SIZE
+		}
+		if s.tokens < size {
+			return false
+		}
+		s.tokens -= size
+		return true
+	}
+
+	return true
+}
+
+// ForcesTransmission returns true if the profile wants us to reserve our slot even without data
+func (s *TrafficShaper) ForcesTransmission(now time.Time) bool {
+	switch s.Profile {
+	case SHAPING_CONSTANT:
+		return true
+	case SHAPING_WEB:
+		return s.inWebBurst(now)
+	}
+	return false
+}
+
+func (s *TrafficShaper) inWebBurst(now time.Time) bool {
+	period := SHAPING_WEB_BURST_DURATION + SHAPING_WEB_THINK_TIME
+	return now.Sub(s.time0)%period < SHAPING_WEB_BURST_DURATION
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficShaper(t *testing.T) {
+
+	if _, err := NewTrafficShaper("not-a-profile"); err == nil {
+		t.Error("Should not accept an unknown profile")
+	}
+
+	s, err := NewTrafficShaper("")
+	if err != nil || s.Profile != SHAPING_NONE {
+		t.Error("Empty profile should be \"none\"")
+	}
+	if !s.Allows(time.Now(), 1000000) || s.ForcesTransmission(time.Now()) {
+		t.Error("Profile \"none\" should not shape anything")
+	}
+
+	// constant: the bucket starts empty, then fills at SHAPING_CONSTANT_RATE
+	s, _ = NewTrafficShaper(SHAPING_CONSTANT)
+	t0 := s.time0
+	if s.Allows(t0, 100) {
+		t.Error("Constant profile should not allow data before the bucket is filled")
+	}
+	if !s.Allows(t0.Add(100*time.Millisecond), SHAPING_CONSTANT_RATE/10) {
+		t.Error("Constant profile should allow 100ms worth of data after 100ms")
+	}
+	if s.Allows(t0.Add(100*time.Millisecond), 1) {
+		t.Error("Constant profile should have emptied its bucket")
+	}
+	if !s.ForcesTransmission(t0) {
+		t.Error("Constant profile should always reserve its slot")
+	}
+
+	// web: bursts, then think time
+	s, _ = NewTrafficShaper(SHAPING_WEB)
+	t0 = s.time0
+	if !s.Allows(t0.Add(SHAPING_WEB_BURST_DURATION/2), 1000) {
+		t.Error("Web profile should allow data during a burst")
+	}
+	if s.Allows(t0.Add(SHAPING_WEB_BURST_DURATION+SHAPING_WEB_THINK_TIME/2), 1000) {
+		t.Error("Web profile should not allow data during think time")
+	}
+
+	// video: one segment per interval
+	s, _ = NewTrafficShaper(SHAPING_VIDEO)
+	t0 = s.time0
+	if !s.Allows(t0, SHAPING_VIDEO_SEGMENT_SIZE) {
+		t.Error("Video profile should allow one full segment")
+	}
+	if s.Allows(t0.Add(SHAPING_VIDEO_SEGMENT_INTERVAL/2), 1) {
+		t.Error("Video profile should not allow more than one segment per interval")
+	}
+	if !s.Allows(t0.Add(SHAPING_VIDEO_SEGMENT_INTERVAL), 1) {
+		t.Error("Video profile should allow the next segment")
+	}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// PAYLOAD_STREAM_HEADER_SIZE is the size of the header of the frames of the stream multiplexer in the upstream
+// payloads : stream ID (4 bytes), frame type (1 byte), data length (3 bytes)
+const PAYLOAD_STREAM_HEADER_SIZE = 8
+
+// fitAllocatedSize cuts data to the size the relay allocated to the upstream cell of this round, with variable slot
+// sizes, or to the room a payload transform leaves in it. A data frame of the stream multiplexer which does not fit is
+// cut in two frames of the same stream; the second one is kept in NextDataForDCNet, for our next slots. A control
+// frame which does not fit is kept whole.
+func (p *PriFiLibClientInstance) fitAllocatedSize(data []byte, size int) []byte {
+	if data == nil || (p.clientState.allocatedUpstreamSize <= 0 && !p.clientState.payloadTransform.Enabled()) || len(data) <= size {
+		return data
+	}
+	if len(data) < PAYLOAD_STREAM_HEADER_SIZE || bytes.Equal(data[0:4], make([]byte, 4)) {
+		log.Lvl2("Client", p.clientState.ID, ": cutting", len(data), "bytes which are not a stream frame to the", size, "bytes of the slot")
+		return data[:size]
+	}
+
+	frameData := data[PAYLOAD_STREAM_HEADER_SIZE:]
+	if length := int(binary.BigEndian.Uint32(data[4:PAYLOAD_STREAM_HEADER_SIZE]) & 0x00FFFFFF); length < len(frameData) {
+		frameData = frameData[:length]
+	}
+	if PAYLOAD_STREAM_HEADER_SIZE+len(frameData) <= size {
+		// only the padding did not fit
+		return data[:PAYLOAD_STREAM_HEADER_SIZE+len(frameData)]
+	}
+	if size <= PAYLOAD_STREAM_HEADER_SIZE || data[4] != 0 {
+		// a control frame (window update, reset) is not cut
+		p.clientState.NextDataForDCNet = &data
+		return nil
+	}
+
+	n := size - PAYLOAD_STREAM_HEADER_SIZE
+	head := newStreamFrame(data[0:4], frameData[:n])
+	rest := newStreamFrame(data[0:4], frameData[n:])
+	p.clientState.NextDataForDCNet = &rest
+	log.Lvl3("Client", p.clientState.ID, ": sending", n, "bytes of stream data in a slot of", size, "bytes,", len(frameData)-n, "left")
+	return head
+}
+
+// newStreamFrame returns the frame of the stream multiplexer carrying data for the stream streamID
+func newStreamFrame(streamID []byte, data []byte) []byte {
+	frame := make([]byte, PAYLOAD_STREAM_HEADER_SIZE+len(data))
+	copy(frame[0:4], streamID)
+	binary.BigEndian.PutUint32(frame[4:PAYLOAD_STREAM_HEADER_SIZE], uint32(len(data)))
+	copy(frame[PAYLOAD_STREAM_HEADER_SIZE:], data)
+	return frame
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/transform"
+)
+
+func TestFitAllocatedSize(t *testing.T) {
+	p := &PriFiLibClientInstance{clientState: &ClientState{}}
+	streamID := []byte{0, 0, 0, 7}
+	frame := append(newStreamFrame(streamID, bytes.Repeat([]byte{1}, 40)), make([]byte, 20)...) // padded
+
+	if out := p.fitAllocatedSize(frame, 30); len(out) != len(frame) {
+		t.Error("Without variable slot sizes, the data should not be cut")
+	}
+
+	p.clientState.allocatedUpstreamSize = 50
+	if out := p.fitAllocatedSize(frame, 50); !bytes.Equal(out, frame[:48]) || p.clientState.NextDataForDCNet != nil {
+		t.Error("Only the padding should be cut when the frame fits")
+	}
+
+	out := p.fitAllocatedSize(frame, 30)
+	if len(out) != 30 || !bytes.Equal(out[0:4], streamID) || binary.BigEndian.Uint32(out[4:8]) != 22 {
+		t.Error("The frame should be cut to the allocated size, got", out)
+	}
+	rest := p.clientState.NextDataForDCNet
+	if rest == nil || len(*rest) != 26 || !bytes.Equal((*rest)[0:4], streamID) || binary.BigEndian.Uint32((*rest)[4:8]) != 18 {
+		t.Error("The rest of the frame should be kept for the next slot")
+	}
+
+	p.clientState.NextDataForDCNet = nil
+	if out := p.fitAllocatedSize(frame, PAYLOAD_STREAM_HEADER_SIZE); out != nil || p.clientState.NextDataForDCNet == nil {
+		t.Error("A slot without room for data should keep the whole frame for later")
+	}
+
+	windowUpdate := []byte{0, 0, 0, 7, 1, 0, 0, 4, 0, 1, 0, 0}
+	p.clientState.NextDataForDCNet = nil
+	if out := p.fitAllocatedSize(windowUpdate, 10); out != nil || p.clientState.NextDataForDCNet == nil {
+		t.Error("A control frame which does not fit should be kept whole for later")
+	}
+
+	notAFrame := make([]byte, 100)
+	if out := p.fitAllocatedSize(notAFrame, 30); len(out) != 30 {
+		t.Error("Data which is not a stream frame should be truncated")
+	}
+
+	p.clientState.allocatedUpstreamSize = 0
+	p.clientState.NextDataForDCNet = nil
+	p.clientState.payloadTransform, _ = transform.Parse("fec")
+	if out := p.fitAllocatedSize(frame, 30); len(out) != 30 || p.clientState.NextDataForDCNet == nil {
+		t.Error("With a payload transform, the frame should be cut to the room it leaves")
+	}
+}
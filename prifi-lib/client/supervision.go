@@ -0,0 +1,36 @@
+package client
+
+import (
+	"strconv"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// CLIENT_MAX_RESTARTS is how many times the client restarts a crashed subsystem (e.g., the UDP listener) before giving up on it
+const CLIENT_MAX_RESTARTS = 5
+
+// startBroadcastListener runs the UDP broadcast listener under the supervisor. If it panics, it is restarted with
+// the same channel; if we were already listening, it is told to start again.
+func (p *PriFiLibClientInstance) startBroadcastListener(startStopChan chan bool) {
+	started := false
+	p.clientState.supervisor.Go("udp-broadcast", func() {
+		if started && p.stateMachine.State() == "READY" && startStopChan == p.clientState.StartStopReceiveBroadcast {
+			startStopChan <- true
+		}
+		started = true
+		p.messageSender.MessageSender.ClientSubscribeToBroadcast(p.clientState.ID, p.ReceivedMessage, startStopChan)
+	})
+}
+
+// resyncAfterPanic puts the client back in its initial state after a message handler panicked, since its state for
+// this epoch cannot be trusted anymore. The relay notices the missing cipher, and resyncs everybody with new parameters.
+func (p *PriFiLibClientInstance) resyncAfterPanic() {
+	if p.stateMachine.State() == "SHUTDOWN" {
+		return
+	}
+	log.Error("Client " + strconv.Itoa(p.clientState.ID) + " : resyncing after a crash, waiting for new parameters from the relay")
+	if p.clientState.StartStopReceiveBroadcast != nil {
+		p.clientState.StartStopReceiveBroadcast <- false
+	}
+	p.stateMachine.ChangeState("BEFORE_INIT")
+}
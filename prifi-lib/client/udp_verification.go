@@ -0,0 +1,169 @@
+package client
+
+/*
+With UseUDP, the relay broadcasts the downstream data in UDP, and each client trusts that it received the same data as
+the others. A relay (or someone spoofing it on the local network) could send different data to some clients, e.g. to
+tag them. A client verifying the broadcasts picks a random sample of the rounds it received over UDP, asks the relay for
+a copy of them over TCP (CLI_REL_DOWNSTREAM_COPY_REQUEST), and compares both. The request is sent before our upstream
+cipher, so that the round is still open on the relay when it arrives. The relay does not know in advance which rounds
+are verified, hence it cannot equivocate only on the others.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// UDP_VERIFICATION_MAX_PENDING is the number of sampled rounds waiting for their TCP copy; older ones are given up
+const UDP_VERIFICATION_MAX_PENDING = 64
+
+// udpVerifier compares a sample of the UDP broadcasts with their TCP copy
+type udpVerifier struct {
+	rate           int // percentage of the rounds received over UDP which are verified
+	maxDivergences int // the client refuses to continue after this many divergences; 0 means it only reports them
+	pending        map[int32][]byte
+	verified       int
+	divergences    int
+	unverifiable   int // the relay did not have the round anymore, or the copy never came
+}
+
+// newUDPVerifier returns nil if rate is 0, i.e., if the broadcasts are not verified
+func newUDPVerifier(rate int, maxDivergences int) *udpVerifier {
+	if rate <= 0 {
+		return nil
+	}
+	if rate > 100 {
+		rate = 100
+	}
+	if maxDivergences < 0 {
+		maxDivergences = 0
+	}
+	return &udpVerifier{
+		rate:           rate,
+		maxDivergences: maxDivergences,
+		pending:        make(map[int32][]byte),
+	}
+}
+
+// newEpoch forgets the pending rounds, as the round numbers start over
+func (v *udpVerifier) newEpoch() {
+	v.pending = make(map[int32][]byte)
+}
+
+// sample decides, at random, whether this round is verified; the relay must not be able to predict it
+func (v *udpVerifier) sample() bool {
+	if v.rate >= 100 {
+		return true
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(100))
+	if err != nil {
+		return true
+	}
+	return int(n.Int64()) < v.rate
+}
+
+// expect records the round received over UDP, until its TCP copy arrives
+func (v *udpVerifier) expect(msg net.REL_CLI_DOWNSTREAM_DATA) {
+	v.pending[msg.RoundID] = downstreamDigest(msg)
+	if len(v.pending) <= UDP_VERIFICATION_MAX_PENDING {
+		return
+	}
+	rounds := make([]int, 0, len(v.pending))
+	for roundID := range v.pending {
+		rounds = append(rounds, int(roundID))
+	}
+	sort.Ints(rounds)
+	for _, roundID := range rounds[:len(rounds)-UDP_VERIFICATION_MAX_PENDING] {
+		delete(v.pending, int32(roundID))
+		v.unverifiable++
+	}
+}
+
+// check compares the TCP copy with the UDP copy of the same round. It returns an error if they differ, and nothing if
+// they match, or if the round cannot be verified
+func (v *udpVerifier) check(tcpCopy net.REL_CLI_DOWNSTREAM_COPY) error {
+	digest, ok := v.pending[tcpCopy.RoundID]
+	if !ok {
+		return nil // not sampled, or given up
+	}
+	delete(v.pending, tcpCopy.RoundID)
+	if !tcpCopy.Found {
+		v.unverifiable++
+		return nil
+	}
+	v.verified++
+	if tcpCopy.Data.RoundID == tcpCopy.RoundID && string(downstreamDigest(tcpCopy.Data)) == string(digest) {
+		return nil
+	}
+	v.divergences++
+	return errors.New("the relay sent different data for round " + strconv.Itoa(int(tcpCopy.RoundID)) + " over UDP and over TCP")
+}
+
+// tooManyDivergences returns true if the client should refuse to continue
+func (v *udpVerifier) tooManyDivergences() bool {
+	return v.maxDivergences > 0 && v.divergences >= v.maxDivergences
+}
+
+// String reports the verified rounds and the divergences
+func (v *udpVerifier) String() string {
+	return "UDP verification : " + strconv.Itoa(v.verified) + " rounds verified, " + strconv.Itoa(v.divergences) +
+		" divergences, " + strconv.Itoa(v.unverifiable) + " unverifiable"
+}
+
+// downstreamDigest hashes the downstream data as it is encoded in UDP, so that both copies are compared field by field
+func downstreamDigest(msg net.REL_CLI_DOWNSTREAM_DATA) []byte {
+	udp := &net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: msg}
+	b, _ := udp.ToBytes() // never fails
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// requestDownstreamCopy asks the relay for a TCP copy of this round, if it is in the sample
+func (p *PriFiLibClientInstance) requestDownstreamCopy(msg net.REL_CLI_DOWNSTREAM_DATA) {
+	v := p.clientState.udpVerifier
+	if v == nil || !v.sample() {
+		return
+	}
+	v.expect(msg)
+	toSend := &net.CLI_REL_DOWNSTREAM_COPY_REQUEST{
+		ClientID: p.clientState.ID,
+		RoundID:  msg.RoundID,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(copy of round "+strconv.Itoa(int(msg.RoundID))+")")
+}
+
+/*
+Received_REL_CLI_DOWNSTREAM_COPY handles REL_CLI_DOWNSTREAM_COPY messages, the TCP copy of a round we received over
+UDP. A divergence is reported; after ClientUDPVerificationMaxDivergences of them, the client refuses to continue.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_DOWNSTREAM_COPY(msg net.REL_CLI_DOWNSTREAM_COPY) error {
+	v := p.clientState.udpVerifier
+	if v == nil {
+		return nil
+	}
+	err := v.check(msg)
+	if err == nil {
+		log.Lvl3("Client", p.clientState.ID, ": round", msg.RoundID, "checked,", v.String())
+		return nil
+	}
+	log.Error("Client "+strconv.Itoa(p.clientState.ID)+" :", err.Error()+"; possible equivocation.", v.String())
+	if !v.tooManyDivergences() {
+		return nil
+	}
+
+	e := "Client " + strconv.Itoa(p.clientState.ID) + " : " + strconv.Itoa(v.divergences) +
+		" divergences between the UDP broadcasts and their TCP copy, refusing to continue"
+	log.Error(e)
+	if p.clientState.StartStopReceiveBroadcast != nil {
+		p.clientState.StartStopReceiveBroadcast <- false
+	}
+	p.stateMachine.ChangeState("SHUTDOWN")
+	return errors.New(e)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"testing"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestUDPVerifier(t *testing.T) {
+	if newUDPVerifier(0, 1) != nil {
+		t.Error("a rate of 0 should disable the verification")
+	}
+
+	v := newUDPVerifier(100, 0)
+	round := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 4, OwnershipID: 1, Data: []byte{1, 2, 3}}
+	v.expect(round)
+
+	// a copy of a round we did not sample is ignored
+	if err := v.check(net.REL_CLI_DOWNSTREAM_COPY{RoundID: 5, Found: true}); err != nil {
+		t.Error(err)
+	}
+	if err := v.check(net.REL_CLI_DOWNSTREAM_COPY{RoundID: 4, Found: true, Data: round}); err != nil {
+		t.Error("identical copies should match,", err)
+	}
+
+	v.expect(round)
+	tampered := round
+	tampered.Data = []byte{1, 2, 4}
+	if err := v.check(net.REL_CLI_DOWNSTREAM_COPY{RoundID: 4, Found: true, Data: tampered}); err == nil {
+		t.Error("different copies should not match")
+	}
+
+	v.expect(round)
+	if err := v.check(net.REL_CLI_DOWNSTREAM_COPY{RoundID: 4, Found: false}); err != nil {
+		t.Error("a closed round cannot be verified, but is not a divergence")
+	}
+	if v.verified != 2 || v.divergences != 1 || v.unverifiable != 1 {
+		t.Error("wrong counts,", v.String())
+	}
+	if v.tooManyDivergences() {
+		t.Error("with maxDivergences = 0, the client should only report the divergences")
+	}
+
+	// the oldest pending rounds are given up
+	for i := 0; i < UDP_VERIFICATION_MAX_PENDING+2; i++ {
+		v.expect(net.REL_CLI_DOWNSTREAM_DATA{RoundID: int32(i)})
+	}
+	if len(v.pending) != UDP_VERIFICATION_MAX_PENDING {
+		t.Error("should keep", UDP_VERIFICATION_MAX_PENDING, "pending rounds, has", len(v.pending))
+	}
+	if _, found := v.pending[0]; found {
+		t.Error("round 0 should have been given up")
+	}
+}
+
+func TestClientRefusesAfterDivergences(t *testing.T) {
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	sentToRelay = make([]interface{}, 0)
+	client := NewClient(false, false, false, make(chan []byte), make(chan []byte), false, "./", "", 1, "", 100, 1, msw)
+	client.clientState.ID = 2
+	client.stateMachine.ChangeState("READY")
+
+	round := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 7, Data: []byte{1, 2, 3}}
+	client.requestDownstreamCopy(round)
+	if len(sentToRelay) != 1 {
+		t.Fatal("the client should have asked for a copy of the round")
+	}
+	request, ok := sentToRelay[0].(*net.CLI_REL_DOWNSTREAM_COPY_REQUEST)
+	if !ok || request.ClientID != 2 || request.RoundID != 7 {
+		t.Error("wrong copy request", sentToRelay[0])
+	}
+
+	capture := prifilog.StartCaptureLogger(0)
+	defer capture.Stop()
+
+	tampered := round
+	tampered.OwnershipID = 1
+	err := client.ReceivedMessage(net.REL_CLI_DOWNSTREAM_COPY{RoundID: 7, Found: true, Data: tampered})
+	if err == nil {
+		t.Error("the client should refuse to continue after 1 divergence")
+	}
+	if client.stateMachine.State() != "SHUTDOWN" {
+		t.Error("the client should have stopped, is in state", client.stateMachine.State())
+	}
+	if !capture.HasError("over UDP and over TCP") {
+		t.Error("the divergence should have been logged, errors are", capture.Errors())
+	}
+}
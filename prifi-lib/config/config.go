@@ -4,8 +4,85 @@ Package config contains the cryptographic primitives that are used by the PriFi
 package config
 
 import (
+	"errors"
+	"strings"
+
+	"go.dedis.ch/kyber/v3/group/curve25519"
 	"go.dedis.ch/kyber/v3/suites"
 )
 
-// the suite used in the prifi-lib
-var CryptoSuite = suites.MustFind("Ed25519")
+// DEFAULT_CRYPTO_SUITE is the suite used when none is chosen
+const DEFAULT_CRYPTO_SUITE = "Ed25519"
+
+// CRYPTO_SUITES are the names of the suites which can be chosen with SetCryptoSuite
+var CRYPTO_SUITES = []string{"Ed25519", "P256", "Curve25519"}
+
+// the suite used in the prifi-lib : the DC-nets, the Neff shuffles, the Schnorr signatures and the keys of the
+// entities. It is chosen once per process, before creating the entities, with SetCryptoSuite.
+var CryptoSuite = suites.MustFind(DEFAULT_CRYPTO_SUITE)
+
+var cryptoSuiteName = DEFAULT_CRYPTO_SUITE
+
+// NewCryptoSuite returns the suite called name (one of CRYPTO_SUITES, case-insensitive); "" gives the
+// DEFAULT_CRYPTO_SUITE
+func NewCryptoSuite(name string) (suites.Suite, error) {
+	switch strings.ToLower(name) {
+	case "", "ed25519":
+		return suites.MustFind("Ed25519"), nil
+	case "p256":
+		return suites.MustFind("P256"), nil
+	case "curve25519":
+		return curve25519.NewBlakeSHA256Curve25519(false), nil
+	}
+	return nil, errors.New("unknown crypto suite \"" + name + "\", should be one of " + strings.Join(CRYPTO_SUITES, ", "))
+}
+
+// CanonicalCryptoSuiteName returns the name of the suite called name as in CRYPTO_SUITES, or an error if there is no
+// such suite
+func CanonicalCryptoSuiteName(name string) (string, error) {
+	if name == "" {
+		return DEFAULT_CRYPTO_SUITE, nil
+	}
+	for _, s := range CRYPTO_SUITES {
+		if strings.EqualFold(s, name) {
+			return s, nil
+		}
+	}
+	_, err := NewCryptoSuite(name)
+	return "", err
+}
+
+// SetCryptoSuite replaces CryptoSuite by the suite called name. The keys, the DC-nets and the decoders created before
+// keep the previous suite, hence this must be called before creating the entities.
+func SetCryptoSuite(name string) error {
+	canonical, err := CanonicalCryptoSuiteName(name)
+	if err != nil {
+		return err
+	}
+	suite, err := NewCryptoSuite(canonical)
+	if err != nil {
+		return err
+	}
+	CryptoSuite = suite
+	cryptoSuiteName = canonical
+	return nil
+}
+
+// CryptoSuiteName returns the name of CryptoSuite, as in CRYPTO_SUITES
+func CryptoSuiteName() string {
+	return cryptoSuiteName
+}
+
+// CheckCryptoSuite returns an error if the suite called name, as received from another entity, is not the one in use
+// in this process. The suite cannot be changed once the keys are exchanged, so all the entities must be started with
+// the same one.
+func CheckCryptoSuite(name string) error {
+	canonical, err := CanonicalCryptoSuiteName(name)
+	if err != nil {
+		return err
+	}
+	if current := CryptoSuiteName(); canonical != current {
+		return errors.New("the crypto suite is " + canonical + ", but this process uses " + current + "; all the entities must be started with the same CryptoSuite")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import "testing"
+
+func TestCryptoSuites(t *testing.T) {
+	defer SetCryptoSuite(DEFAULT_CRYPTO_SUITE)
+
+	for _, name := range CRYPTO_SUITES {
+		if err := SetCryptoSuite(name); err != nil {
+			t.Fatal(name, err)
+		}
+		if CryptoSuiteName() != name {
+			t.Error("The suite should be", name, "is", CryptoSuiteName())
+		}
+
+		// a key pair, and a point which survives the encoding
+		priv := CryptoSuite.Scalar().Pick(CryptoSuite.RandomStream())
+		pub := CryptoSuite.Point().Mul(priv, nil)
+		bytes, err := pub.MarshalBinary()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		decoded := CryptoSuite.Point()
+		if err := decoded.UnmarshalBinary(bytes); err != nil || !decoded.Equal(pub) {
+			t.Error(name, ": the point should survive the encoding", err)
+		}
+	}
+
+	if err := SetCryptoSuite("p256"); err != nil || CryptoSuiteName() != "P256" {
+		t.Error("The names should be case-insensitive", err, CryptoSuiteName())
+	}
+	if err := CheckCryptoSuite("P256"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckCryptoSuite("Ed25519"); err == nil {
+		t.Error("Ed25519 is not the suite in use")
+	}
+	if err := SetCryptoSuite("secp256k1"); err == nil || CryptoSuiteName() != "P256" {
+		t.Error("An unknown suite should be refused, and keep the suite in use")
+	}
+	if err := SetCryptoSuite(""); err != nil || CryptoSuiteName() != DEFAULT_CRYPTO_SUITE {
+		t.Error("The empty name should give the default suite", err)
+	}
+	if err := CheckCryptoSuite(""); err != nil {
+		t.Error(err)
+	}
+}
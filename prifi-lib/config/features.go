@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Feature is the name of an experimental behavior that can be toggled per deployment
+type Feature string
+
+// The features known to this version, all read by the relay, which gives the resulting parameters to the clients and
+// trustees. Unknown features are kept, and reported by the relay.
+const (
+	FEATURE_EQUIVOCATION Feature = "equivocation" // equivocation protection, overrides EquivocationProtectionEnabled
+	FEATURE_DISRUPTION   Feature = "disruption"   // disruption protection, overrides DisruptionProtectionEnabled
+	FEATURE_MIRROR       Feature = "mirror"       // copy of the decoded upstream payloads to RelayMirrorSink, for experiments only
+)
+
+// KNOWN_FEATURES lists the features this version knows of
+var KNOWN_FEATURES = []Feature{FEATURE_EQUIVOCATION, FEATURE_DISRUPTION, FEATURE_MIRROR}
+
+// FeatureFlags holds the features explicitly enabled or disabled in a deployment. The features which are not set
+// keep their default behavior.
+type FeatureFlags struct {
+	flags map[Feature]bool
+}
+
+// ParseFeatureFlags parses a comma-separated list of features, e.g. "equivocation,-disruption"; a leading '-'
+// disables the feature, a leading '+' (or nothing) enables it. The empty string gives no flags.
+func ParseFeatureFlags(s string) (*FeatureFlags, error) {
+	f := &FeatureFlags{flags: make(map[Feature]bool)}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		enabled := true
+		if item[0] == '-' || item[0] == '+' {
+			enabled = item[0] == '+'
+			item = strings.TrimSpace(item[1:])
+		}
+		if item == "" || strings.ContainsAny(item, "+-= ") {
+			return nil, errors.New("Invalid feature flag \"" + item + "\" in \"" + s + "\"")
+		}
+		f.flags[Feature(item)] = enabled
+	}
+	return f, nil
+}
+
+// IsSet returns true if the feature is explicitly enabled or disabled
+func (f *FeatureFlags) IsSet(feature Feature) bool {
+	_, ok := f.flags[feature]
+	return ok
+}
+
+// Enabled returns true if the feature is explicitly enabled
+func (f *FeatureFlags) Enabled(feature Feature) bool {
+	return f.flags[feature]
+}
+
+// ValueOrElse returns whether the feature is enabled, or elseVal if the feature is not set
+func (f *FeatureFlags) ValueOrElse(feature Feature, elseVal bool) bool {
+	if val, ok := f.flags[feature]; ok {
+		return val
+	}
+	return elseVal
+}
+
+// Set enables or disables a feature
+func (f *FeatureFlags) Set(feature Feature, enabled bool) {
+	f.flags[feature] = enabled
+}
+
+// Unknown returns the features set which are not in KNOWN_FEATURES, sorted
+func (f *FeatureFlags) Unknown() []Feature {
+	unknown := make([]Feature, 0)
+	for feature := range f.flags {
+		known := false
+		for _, k := range KNOWN_FEATURES {
+			known = known || k == feature
+		}
+		if !known {
+			unknown = append(unknown, feature)
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+	return unknown
+}
+
+// String returns the flags in the format of ParseFeatureFlags, sorted, so that equal flags give equal strings
+func (f *FeatureFlags) String() string {
+	items := make([]string, 0, len(f.flags))
+	for feature, enabled := range f.flags {
+		if enabled {
+			items = append(items, string(feature))
+		} else {
+			items = append(items, "-"+string(feature))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return strings.TrimPrefix(items[i], "-") < strings.TrimPrefix(items[j], "-")
+	})
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,42 @@
+package config
+
+import "testing"
+
+func TestFeatureFlags(t *testing.T) {
+
+	f, err := ParseFeatureFlags(" mirror, -equivocation,+newfeature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Enabled(FEATURE_MIRROR) || !f.Enabled("newfeature") || f.Enabled(FEATURE_EQUIVOCATION) {
+		t.Error("Wrong flags", f)
+	}
+	if !f.IsSet(FEATURE_EQUIVOCATION) || f.IsSet(FEATURE_DISRUPTION) {
+		t.Error("Equivocation should be set, disruption should not")
+	}
+	if f.ValueOrElse(FEATURE_EQUIVOCATION, true) || !f.ValueOrElse(FEATURE_DISRUPTION, true) {
+		t.Error("ValueOrElse should only use the default for unset features")
+	}
+	if unknown := f.Unknown(); len(unknown) != 1 || unknown[0] != "newfeature" {
+		t.Error("newfeature should be unknown", unknown)
+	}
+	if f.String() != "-equivocation,mirror,newfeature" {
+		t.Error("Wrong canonical form", f.String())
+	}
+
+	f2, err := ParseFeatureFlags(f.String())
+	if err != nil || f2.String() != f.String() {
+		t.Error("Flags should survive String and ParseFeatureFlags", err)
+	}
+
+	empty, err := ParseFeatureFlags("")
+	if err != nil || empty.String() != "" || empty.IsSet(FEATURE_MIRROR) {
+		t.Error("Empty string should give no flags", err)
+	}
+
+	for _, invalid := range []string{"-", "a b", "x=1", "--equivocation"} {
+		if _, err := ParseFeatureFlags(invalid); err == nil {
+			t.Error("Should not accept", invalid)
+		}
+	}
+}
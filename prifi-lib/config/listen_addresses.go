@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ListenAddress is an address a node listens on, and the setting it comes from
+type ListenAddress struct {
+	Setting string // e.g. "RelayMetricsAddress"
+	Network string // "tcp" or "udp"
+	Address string // host:port; an empty host is all the interfaces, and port 0 a free port chosen at startup
+}
+
+func (l ListenAddress) String() string {
+	return l.Setting + " (" + l.Network + " " + l.Address + ")"
+}
+
+// CheckListenAddresses checks that the addresses are valid host:port, and that no two of them use the same port of
+// the same network on overlapping interfaces, e.g. ":8080" and "127.0.0.1:8080". The empty addresses (listeners
+// which are off) are skipped. The host names are not resolved, hence only the listeners using the same name, or all
+// the interfaces, are found to conflict.
+func CheckListenAddresses(addresses []ListenAddress) error {
+	checked := make([]ListenAddress, 0, len(addresses))
+	for _, a := range addresses {
+		if a.Address == "" {
+			continue
+		}
+		if a.Network != "tcp" && a.Network != "udp" {
+			return errors.New(a.Setting + ": unknown network \"" + a.Network + "\", should be tcp or udp")
+		}
+		host, port, err := splitListenAddress(a.Address)
+		if err != nil {
+			return errors.New(a.Setting + ": " + err.Error())
+		}
+		if port == 0 {
+			continue
+		}
+		for _, b := range checked {
+			if b.Network != a.Network {
+				continue
+			}
+			otherHost, otherPort, _ := splitListenAddress(b.Address)
+			if otherPort == port && interfacesOverlap(host, otherHost) {
+				return errors.New(a.String() + " conflicts with " + b.String())
+			}
+		}
+		checked = append(checked, a)
+	}
+	return nil
+}
+
+// splitListenAddress returns the host and the port of addr, checking that the port is in range
+func splitListenAddress(addr string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, errors.New("invalid address \"" + addr + "\", expected host:port or :port")
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, errors.New("invalid port in \"" + addr + "\", should be between 0 and 65535")
+	}
+	if strings.ContainsAny(host, " /") {
+		return "", 0, errors.New("invalid host in \"" + addr + "\"")
+	}
+	return host, port, nil
+}
+
+// interfacesOverlap tells if listeners on host1 and host2 may receive on the same interface
+func interfacesOverlap(host1, host2 string) bool {
+	if allInterfaces(host1) || allInterfaces(host2) {
+		return true
+	}
+	ip1, ip2 := net.ParseIP(host1), net.ParseIP(host2)
+	if ip1 != nil && ip2 != nil {
+		return ip1.Equal(ip2)
+	}
+	return strings.EqualFold(host1, host2)
+}
+
+// allInterfaces tells if a listener on host receives on all the interfaces; a multicast group is joined on all of
+// them, and binds to the port on all of them
+func allInterfaces(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsUnspecified() || ip.IsMulticast())
+}
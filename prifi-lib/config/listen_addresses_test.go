@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckListenAddresses(t *testing.T) {
+	valid := []ListenAddress{
+		{"SocksServerPort", "tcp", ":8080"},
+		{"RelayMetricsAddress", "tcp", "127.0.0.1:9100"},
+		{"RelayDemoAddress", "tcp", "10.0.0.1:9100"},
+		{"RelayUDPUplinkAddress", "udp", ":8080"},
+		{"UDPBroadcastAddress", "udp", "224.0.0.1:10101"},
+		{"RelayListenAddress", "tcp", ":0"},
+		{"ClientTransport", "tcp", "[::1]:0"},
+		{"RelayDemoAddress", "tcp", ""},
+	}
+	if err := CheckListenAddresses(valid); err != nil {
+		t.Error("The addresses should not conflict,", err)
+	}
+
+	conflicts := [][]ListenAddress{
+		{{"SocksServerPort", "tcp", ":8080"}, {"RelayMetricsAddress", "tcp", "127.0.0.1:8080"}},
+		{{"RelayMetricsAddress", "tcp", "localhost:9100"}, {"RelayDemoAddress", "tcp", "LOCALHOST:9100"}},
+		{{"RelayMetricsAddress", "tcp", "[::1]:9100"}, {"RelayDemoAddress", "tcp", "[0:0::1]:9100"}},
+		{{"UDPBroadcastAddress", "udp", "224.0.0.1:10101"}, {"RelayUDPUplinkAddress", "udp", "10.0.0.1:10101"}},
+	}
+	for _, addresses := range conflicts {
+		err := CheckListenAddresses(addresses)
+		if err == nil || !strings.Contains(err.Error(), addresses[0].Setting) || !strings.Contains(err.Error(), addresses[1].Setting) {
+			t.Error("Expected a conflict between", addresses, ", got", err)
+		}
+	}
+
+	for _, addr := range []string{"8080", "host:http", ":65536", "host:-1", "a b:80"} {
+		if err := CheckListenAddresses([]ListenAddress{{"RelayMetricsAddress", "tcp", addr}}); err == nil {
+			t.Error("The address", addr, "should be refused")
+		}
+	}
+	if err := CheckListenAddresses([]ListenAddress{{"RelayMetricsAddress", "sctp", ":80"}}); err == nil {
+		t.Error("An unknown network should be refused")
+	}
+}
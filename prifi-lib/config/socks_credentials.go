@@ -0,0 +1,35 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+// SOCKS_CREDENTIAL_MAX_LENGTH is the longest username or password of the SOCKS5 username/password authentication
+// (RFC 1929)
+const SOCKS_CREDENTIAL_MAX_LENGTH = 255
+
+// ParseSOCKSCredentials parses a comma-separated list of username:password pairs, e.g. "browser:s3cret,mail:0ther",
+// which the applications may give to the SOCKS server of the clients. The empty string gives no credentials.
+func ParseSOCKSCredentials(s string) (map[string]string, error) {
+	credentials := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, ":")
+		if i <= 0 || i == len(item)-1 {
+			return nil, errors.New("invalid SOCKS credentials \"" + item + "\", expected username:password")
+		}
+		username, password := item[:i], item[i+1:]
+		if len(username) > SOCKS_CREDENTIAL_MAX_LENGTH || len(password) > SOCKS_CREDENTIAL_MAX_LENGTH {
+			return nil, errors.New("the SOCKS username and password of \"" + username + "\" cannot be longer than 255 bytes")
+		}
+		if _, found := credentials[username]; found {
+			return nil, errors.New("the SOCKS username \"" + username + "\" is given twice")
+		}
+		credentials[username] = password
+	}
+	return credentials, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSOCKSCredentials(t *testing.T) {
+	credentials, err := ParseSOCKSCredentials(" browser:s3cret, mail:a:b ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 2 || credentials["browser"] != "s3cret" || credentials["mail"] != "a:b" {
+		t.Error("Wrong credentials", credentials)
+	}
+	if credentials, err := ParseSOCKSCredentials(""); err != nil || len(credentials) != 0 {
+		t.Error("The empty string should give no credentials", credentials, err)
+	}
+
+	for _, s := range []string{"browser", ":s3cret", "browser:", "a:b,a:c", "a:" + strings.Repeat("x", 256)} {
+		if _, err := ParseSOCKSCredentials(s); err == nil {
+			t.Error("Credentials", s, "should be refused")
+		}
+	}
+}
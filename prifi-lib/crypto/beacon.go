@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+)
+
+// RandomBeacon is a public random value from an external beacon (e.g., drand), that nobody in the PriFi group could
+// predict or choose. The relay folds it into the setup of an epoch, so the epoch does not rely on the relay's local
+// randomness only.
+type RandomBeacon struct {
+	Round uint64 // the beacon's round, so anyone can fetch the value again and check it
+	Value []byte
+}
+
+// the domain separators of the values derived from a beacon
+const (
+	beaconShuffleSeedDomain   = "prifi-beacon-shuffle-seed"
+	beaconMessageHistoryInput = "prifi-beacon-message-history"
+)
+
+// String encodes the beacon as "round:hex(value)"; this is how it is sent in the parameters and stored in transcripts
+func (b *RandomBeacon) String() string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatUint(b.Round, 10) + ":" + hex.EncodeToString(b.Value)
+}
+
+// ParseRandomBeacon decodes a beacon encoded with String(). The empty string decodes to nil (no beacon)
+func ParseRandomBeacon(s string) (*RandomBeacon, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid random beacon \"" + s + "\", expected round:hex-value")
+	}
+	round, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid random beacon round \"" + parts[0] + "\"")
+	}
+	value, err := hex.DecodeString(parts[1])
+	if err != nil || len(value) == 0 {
+		return nil, errors.New("invalid random beacon value \"" + parts[1] + "\"")
+	}
+	return &RandomBeacon{Round: round, Value: value}, nil
+}
+
+// ShuffleSeed derives, from the beacon, the scalar by which the relay multiplies the initial base and the keys of the
+// Neff shuffle
+func (b *RandomBeacon) ShuffleSeed() kyber.Scalar {
+	xof := config.CryptoSuite.XOF([]byte(beaconShuffleSeedDomain + ":" + b.String()))
+	return config.CryptoSuite.Scalar().Pick(xof)
+}
+
+// NewMessageHistory returns the initial message history of an epoch. Without a beacon, it is the historical constant
+func NewMessageHistory(b *RandomBeacon) kyber.XOF {
+	if b == nil {
+		return config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
+	}
+	return config.CryptoSuite.XOF([]byte(beaconMessageHistoryInput + ":" + b.String()))
+}
@@ -0,0 +1,51 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRandomBeacon(t *testing.T) {
+	b := &RandomBeacon{Round: 1234, Value: []byte{0xde, 0xad, 0xbe, 0xef}}
+	if b.String() != "1234:deadbeef" {
+		t.Error("Wrong encoding", b.String())
+	}
+
+	b2, err := ParseRandomBeacon(b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.Round != b.Round || !bytes.Equal(b2.Value, b.Value) {
+		t.Error("Beacon did not survive encoding", b2.String())
+	}
+	if !b.ShuffleSeed().Equal(b2.ShuffleSeed()) {
+		t.Error("The same beacon should give the same seed")
+	}
+	b2.Round++
+	if b.ShuffleSeed().Equal(b2.ShuffleSeed()) {
+		t.Error("Different beacons should give different seeds")
+	}
+
+	// no beacon
+	var none *RandomBeacon
+	if none.String() != "" {
+		t.Error("A nil beacon should encode to the empty string")
+	}
+	if b3, err := ParseRandomBeacon(""); b3 != nil || err != nil {
+		t.Error("The empty string should decode to no beacon")
+	}
+	for _, invalid := range []string{"1234", "x:deadbeef", "1234:xyz", "1234:"} {
+		if _, err := ParseRandomBeacon(invalid); err == nil {
+			t.Error("Should not parse", invalid)
+		}
+	}
+
+	// the message history depends on the beacon
+	h1 := make([]byte, 16)
+	h2 := make([]byte, 16)
+	NewMessageHistory(nil).Read(h1)
+	NewMessageHistory(b).Read(h2)
+	if bytes.Equal(h1, h2) {
+		t.Error("The message history should depend on the beacon")
+	}
+}
@@ -0,0 +1,38 @@
+package crypto
+
+import (
+	"errors"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+)
+
+// the prefix of the message a trustee signs with its long-term key, so that the signature cannot be used elsewhere
+const trusteeKeyEndorsementPrefix = "prifi-trustee-session-key"
+
+/**
+ * Returns the message a trustee signs with its long-term key (the one of the group description), to bind to it the
+ * key it uses in this session
+ */
+func TrusteeKeyEndorsementMessage(sessionKey kyber.Point) ([]byte, error) {
+	pk, err := sessionKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(trusteeKeyEndorsementPrefix), pk...), nil
+}
+
+/**
+ * Checks that endorsement is the signature of sessionKey by longTermKey
+ */
+func VerifyTrusteeKeyEndorsement(longTermKey kyber.Point, sessionKey kyber.Point, endorsement []byte) error {
+	if len(endorsement) == 0 {
+		return errors.New("the session key is not endorsed")
+	}
+	msg, err := TrusteeKeyEndorsementMessage(sessionKey)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(config.CryptoSuite, longTermKey, msg, endorsement)
+}
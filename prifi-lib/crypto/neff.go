@@ -1,18 +1,34 @@
 package crypto
 
 import (
-	"math/rand"
-
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"math/big"
+	"strconv"
+
 	"github.com/dedis/prifi/prifi-lib/config"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/proof"
+	"go.dedis.ch/kyber/v3/shuffle"
+)
+
+// The context strings of the two proofs of a shuffle
+const (
+	NEFF_PAIR_SHUFFLE_CONTEXT = "NeffShufflePairs"
+	NEFF_BLINDING_CONTEXT     = "NeffShuffleBlinding"
 )
 
-// NeffShuffle implements Andrew Neff's verifiable shuffle proof scheme as described in the
-// paper "Verifiable Mixing (Shuffling) of ElGamal Pairs", April 2004.
-// The function randomly shuffles and re-randomizes a set of ElGamal pairs,
-// producing a correctness proof in the process.
-// Returns (Xbar,Ybar), the shuffled and randomized pairs.
+/*
+NeffShuffle multiplies the public keys and the base by a secret coefficient c, and shuffles the keys, so that no one
+but the trustee can link a new key to an old one. The client which owns the key x*base finds it as x*(c*base).
+
+The proof has two parts. First, the keys are put in ElGamal pairs (0, K[i]) under a fresh key h = t*base, and these
+pairs are shuffled and re-randomized with the "Verifiable Mixing (Shuffling) of ElGamal Pairs" proof of Andrew Neff
+(April 2004), into (Xbar[i], Ybar[i]) = (beta[i]*base, K[pi[i]] + beta[i]*h). Then, the trustee proves that it knows
+c and e = c*t such that c*base is the new base, and c*Ybar[i] - e*Xbar[i] = c*K[pi[i]] is the new key i. The pairs
+hide the permutation, and the second proof removes their randomness and applies c, without revealing c.
+*/
 func NeffShuffle(publicKeys []kyber.Point, base kyber.Point, doShufflePositions bool) ([]kyber.Point, kyber.Point, kyber.Scalar, []byte, error) {
 
 	if base == nil {
@@ -25,29 +41,195 @@ func NeffShuffle(publicKeys []kyber.Point, base kyber.Point, doShufflePositions
 		return nil, nil, nil, nil, errors.New("Cannot perform a shuffle is len(publicKeys) is 0")
 	}
 	suite := config.CryptoSuite
+	stream := suite.RandomStream()
+	k := len(publicKeys)
 
 	//compute new shares
-	secretCoeff := suite.Scalar().Pick(suite.RandomStream())
+	secretCoeff := suite.Scalar().Pick(stream)
 	newBase := suite.Point().Mul(secretCoeff, base)
 
+	//pick the permutation : the new key i is the old key pi[i]
+	pi := make([]int, k)
+	for i := range pi {
+		pi[i] = i
+	}
+	if doShufflePositions {
+		for i := k - 1; i > 0; i-- {
+			j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+			if err != nil {
+				return nil, nil, nil, nil, errors.New("Could not pick the permutation, " + err.Error())
+			}
+			pi[i], pi[j.Int64()] = pi[j.Int64()], pi[i]
+		}
+	}
+
 	//transform the public keys with the secret coeff
-	publicKeys2 := make([]kyber.Point, len(publicKeys))
-	for i := 0; i < len(publicKeys); i++ {
-		oldKey := publicKeys[i]
-		publicKeys2[i] = suite.Point().Mul(secretCoeff, oldKey)
+	shuffledKeys := make([]kyber.Point, k)
+	for i := 0; i < k; i++ {
+		shuffledKeys[i] = suite.Point().Mul(secretCoeff, publicKeys[pi[i]])
 	}
 
-	//shuffle the array
-	if doShufflePositions {
-		publicKeys3 := make([]kyber.Point, len(publicKeys2))
-		perm := rand.Perm(len(publicKeys2))
-		for i, v := range perm {
-			publicKeys3[v] = publicKeys2[i]
+	//shuffle and re-randomize the pairs (0, K[i]) under h
+	t := suite.Scalar().Pick(stream)
+	h := suite.Point().Mul(t, base)
+	X := make([]kyber.Point, k)
+	for i := range X {
+		X[i] = suite.Point().Null()
+	}
+	Xbar := make([]kyber.Point, k)
+	Ybar := make([]kyber.Point, k)
+	var pairProof []byte
+	if k == 1 {
+		// nothing to hide
+		Xbar[0] = suite.Point().Null()
+		Ybar[0] = publicKeys[0]
+	} else {
+		beta := make([]kyber.Scalar, k)
+		for i := range beta {
+			beta[i] = suite.Scalar().Pick(stream)
+		}
+		for i := 0; i < k; i++ {
+			Xbar[i] = suite.Point().Mul(beta[pi[i]], base)
+			Ybar[i] = suite.Point().Add(publicKeys[pi[i]], suite.Point().Mul(beta[pi[i]], h))
+		}
+		ps := new(shuffle.PairShuffle).Init(suite, k)
+		prover := func(ctx proof.ProverContext) error {
+			return ps.Prove(pi, base, h, beta, X, publicKeys, stream, ctx)
 		}
-		publicKeys2 = publicKeys3
+		var err error
+		pairProof, err = proof.HashProve(suite, NEFF_PAIR_SHUFFLE_CONTEXT, prover)
+		if err != nil {
+			return nil, nil, nil, nil, errors.New("Could not prove the shuffle of the pairs, " + err.Error())
+		}
+	}
+
+	//remove the randomness of the pairs and apply c
+	e := suite.Scalar().Mul(secretCoeff, t)
+	E := suite.Point().Mul(secretCoeff, h)
+	pred, pub := blindingPredicate(base, newBase, h, E, Xbar, Ybar, shuffledKeys)
+	prover := pred.Prover(suite, map[string]kyber.Scalar{"c": secretCoeff, "e": e}, pub, nil)
+	blindingProof, err := proof.HashProve(suite, NEFF_BLINDING_CONTEXT, prover)
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("Could not prove the blinding of the keys, " + err.Error())
 	}
 
-	proof := make([]byte, 50) // TODO : the proof should be done
+	points := append([]kyber.Point{h, E}, append(Xbar, Ybar...)...)
+	proofBytes, err := marshalNeffProof(points, pairProof, blindingProof)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return shuffledKeys, newBase, secretCoeff, proofBytes, nil
+}
+
+/*
+VerifyNeffShuffle checks the proof that newBase and newKeys are a shuffle of base and keys by NeffShuffle
+*/
+func VerifyNeffShuffle(base kyber.Point, keys []kyber.Point, newBase kyber.Point, newKeys []kyber.Point, proofBytes []byte) error {
+
+	if base == nil || newBase == nil {
+		return errors.New("Cannot verify a shuffle without its bases")
+	}
+	k := len(keys)
+	if k == 0 || len(newKeys) != k {
+		return errors.New("Cannot verify a shuffle of " + strconv.Itoa(k) + " keys into " + strconv.Itoa(len(newKeys)) + " keys")
+	}
+	suite := config.CryptoSuite
+
+	points, pairProof, blindingProof, err := unmarshalNeffProof(proofBytes, 2+2*k)
+	if err != nil {
+		return err
+	}
+	h, E := points[0], points[1]
+	Xbar, Ybar := points[2:2+k], points[2+k:]
 
-	return publicKeys2, newBase, secretCoeff, proof, nil
+	if k == 1 {
+		if !Xbar[0].Equal(suite.Point().Null()) || !Ybar[0].Equal(keys[0]) || len(pairProof) != 0 {
+			return errors.New("Invalid shuffle of one key")
+		}
+	} else {
+		X := make([]kyber.Point, k)
+		for i := range X {
+			X[i] = suite.Point().Null()
+		}
+		verifier := shuffle.Verifier(suite, base, h, X, keys, Xbar, Ybar)
+		if err := proof.HashVerify(suite, NEFF_PAIR_SHUFFLE_CONTEXT, verifier, pairProof); err != nil {
+			return errors.New("Invalid shuffle of the pairs, " + err.Error())
+		}
+	}
+
+	pred, pub := blindingPredicate(base, newBase, h, E, Xbar, Ybar, newKeys)
+	if err := proof.HashVerify(suite, NEFF_BLINDING_CONTEXT, pred.Verifier(suite, pub), blindingProof); err != nil {
+		return errors.New("Invalid blinding of the keys, " + err.Error())
+	}
+	return nil
+}
+
+// blindingPredicate returns the statement "newBase = c*base, E = c*h = e*base, and newKeys[i] = c*Ybar[i] - e*Xbar[i]",
+// and its public points
+func blindingPredicate(base, newBase, h, E kyber.Point, Xbar, Ybar, newKeys []kyber.Point) (proof.Predicate, map[string]kyber.Point) {
+	suite := config.CryptoSuite
+	pub := map[string]kyber.Point{"B": base, "B'": newBase, "H": h, "E": E}
+	preds := []proof.Predicate{proof.Rep("B'", "c", "B"), proof.Rep("E", "c", "H"), proof.Rep("E", "e", "B")}
+	for i := range newKeys {
+		si := strconv.Itoa(i)
+		pub["K'"+si] = newKeys[i]
+		pub["Y"+si] = Ybar[i]
+		pub["-X"+si] = suite.Point().Neg(Xbar[i])
+		preds = append(preds, proof.Rep("K'"+si, "c", "Y"+si, "e", "-X"+si))
+	}
+	return proof.And(preds...), pub
+}
+
+// marshalNeffProof packs the points of a proof, then the two proofs, each prefixed by its length
+func marshalNeffProof(points []kyber.Point, pairProof, blindingProof []byte) ([]byte, error) {
+	var out []byte
+	for _, p := range points {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			return nil, errors.New("Could not marshal the proof of the shuffle, " + err.Error())
+		}
+		out = append(out, b...)
+	}
+	for _, b := range [][]byte{pairProof, blindingProof} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(b)))
+		out = append(out, length...)
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// unmarshalNeffProof is the inverse of marshalNeffProof, for nPoints points
+func unmarshalNeffProof(data []byte, nPoints int) ([]kyber.Point, []byte, []byte, error) {
+	suite := config.CryptoSuite
+	pointLen := suite.PointLen()
+	if len(data) < nPoints*pointLen {
+		return nil, nil, nil, errors.New("The proof of the shuffle is too short")
+	}
+	points := make([]kyber.Point, nPoints)
+	for i := range points {
+		points[i] = suite.Point()
+		if err := points[i].UnmarshalBinary(data[i*pointLen : (i+1)*pointLen]); err != nil {
+			return nil, nil, nil, errors.New("Invalid point in the proof of the shuffle, " + err.Error())
+		}
+	}
+	data = data[nPoints*pointLen:]
+
+	proofs := make([][]byte, 2)
+	for i := range proofs {
+		if len(data) < 4 {
+			return nil, nil, nil, errors.New("The proof of the shuffle is too short")
+		}
+		length := int(binary.BigEndian.Uint32(data))
+		if length > len(data)-4 {
+			return nil, nil, nil, errors.New("The proof of the shuffle is too short")
+		}
+		proofs[i] = data[4 : 4+length]
+		data = data[4+length:]
+	}
+	if len(data) != 0 {
+		return nil, nil, nil, errors.New("Trailing bytes after the proof of the shuffle")
+	}
+	return points, proofs[0], proofs[1], nil
 }
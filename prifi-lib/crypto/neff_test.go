@@ -156,3 +156,45 @@ func TestNeffShuffle(t *testing.T) {
 	}
 
 }
+
+func TestNeffShuffleProof(t *testing.T) {
+
+	base := config.CryptoSuite.Point().Base()
+	for _, nClients := range []int{1, 2, 5} {
+		clientPks := make([]kyber.Point, nClients)
+		for i := 0; i < nClients; i++ {
+			clientPks[i], _ = NewKeyPair()
+		}
+
+		for _, shufflePositions := range []bool{true, false} {
+			shuffledKeys, newBase, _, proof, err := NeffShuffle(clientPks, base, shufflePositions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyNeffShuffle(base, clientPks, newBase, shuffledKeys, proof); err != nil {
+				t.Error("A correct shuffle of", nClients, "keys should verify,", err)
+			}
+
+			// another base, keys which were not shuffled, or a broken proof do not verify
+			otherBase := config.CryptoSuite.Point().Mul(config.CryptoSuite.Scalar().SetInt64(2), newBase)
+			if VerifyNeffShuffle(base, clientPks, otherBase, shuffledKeys, proof) == nil {
+				t.Error("A shuffle with another base should not verify")
+			}
+			replaced := make([]kyber.Point, nClients)
+			copy(replaced, shuffledKeys)
+			replaced[0], _ = NewKeyPair()
+			if VerifyNeffShuffle(base, clientPks, newBase, replaced, proof) == nil {
+				t.Error("A shuffle replacing a key should not verify")
+			}
+			broken := make([]byte, len(proof))
+			copy(broken, proof)
+			broken[len(broken)-1] ^= 1
+			if VerifyNeffShuffle(base, clientPks, newBase, shuffledKeys, broken) == nil {
+				t.Error("A broken proof should not verify")
+			}
+			if VerifyNeffShuffle(base, clientPks, newBase, shuffledKeys, make([]byte, 50)) == nil {
+				t.Error("A placeholder proof should not verify")
+			}
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package dcnet
 
 import (
+	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
 )
 
+// dcnetLog logs at the level of the "dcnet" module
+var dcnetLog = prifilog.NewModuleLogger(prifilog.MODULE_DCNET)
+
 // Relay, Trustee or Client
 type DCNET_ENTITY int
 
@@ -30,11 +36,13 @@ type DCNetEntity struct {
 	Entity                        DCNET_ENTITY
 	EquivocationProtectionEnabled bool
 	DCNetPayloadSize              int
+	MACAlgorithm                  byte // written in the header of the client ciphers, see mac.go
 
 	cryptoSuite  suites.Suite
 	sharedKeys   []kyber.Point // keys shared with other DC-net members
 	sharedPRNGs  []kyber.XOF   // PRNGs shared with other DC-net members (seeded with sharedKeys)
 	currentRound int32
+	prngFactory  func(seed []byte) kyber.XOF
 
 	//Used by the relay
 	DCNetRoundDecoder *DCNetRoundDecoder //nil if unused
@@ -43,6 +51,13 @@ type DCNetEntity struct {
 	equivocationProtection    *EquivocationProtection //nil if unused
 	equivocationContribLength int                     //0 if equivocation protection is disabled
 
+	//Large cells
+	cellPool *utils.CellPool //nil if unused
+
+	//Disruption protection, see mac_keys.go
+	macKeys  map[int][]byte // the MAC key of each slot we know the secret of
+	macEpoch int32          // the epoch of macKeys
+
 	verbose bool
 }
 
@@ -52,8 +67,23 @@ type DCNetRoundDecoder struct {
 	xorBuffer                []byte
 	equivTrusteeContribs     [][]byte
 	equivClientContribs      [][]byte
+	cellTaken                bool // true once DecodeCell gave xorBuffer away
+	macAlgorithm             byte // the MAC algorithm in the headers of the client ciphers
+	macAlgorithmMixed        bool // true if the client ciphers did not all announce the same MAC algorithm
+	nClientCiphers           int
+	equivocationErr          error // set by DecodeCell if the equivocation contributions did not match the payload
+}
+
+// PRNGPosition is where the pad streams of a DCNetEntity are : the next round to encode, and the corresponding byte
+// offset in each PRNG (each round consumes DCNetPayloadSize bytes of each PRNG)
+type PRNGPosition struct {
+	RoundID    int32
+	ByteOffset uint64
 }
 
+// PRNG_DISCARD_CHUNK_SIZE is the size of the buffer used to discard the material of non-seekable PRNGs
+const PRNG_DISCARD_CHUNK_SIZE = 64 * 1024
+
 // Used by clients, trustees
 func NewDCNetEntity(
 	entityID int,
@@ -77,21 +107,12 @@ func NewDCNetEntity(
 	}
 
 	e.cryptoSuite = config.CryptoSuite
+	e.prngFactory = e.cryptoSuite.XOF
 
 	// if the node participates in the DC-net
 	if entity != DCNET_RELAY {
 		e.sharedKeys = sharedKeys
-
-		// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
-		e.sharedPRNGs = make([]kyber.XOF, len(sharedKeys))
-		for i := range sharedKeys {
-			e.verbosePrint("key", i, ":", sharedKeys[i])
-			seed, err := sharedKeys[i].MarshalBinary()
-			if err != nil {
-				log.Fatal("Could not extract data from shared key", err)
-			}
-			e.sharedPRNGs[i] = e.cryptoSuite.XOF(seed)
-		}
+		e.sharedPRNGs = e.newSharedPRNGs()
 	} else {
 		e.sharedKeys = make([]kyber.Point, 0)
 		e.sharedPRNGs = make([]kyber.XOF, 0)
@@ -117,6 +138,82 @@ func NewDCNetEntity(
 	return e
 }
 
+// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
+func (e *DCNetEntity) newSharedPRNGs() []kyber.XOF {
+	prngs := make([]kyber.XOF, len(e.sharedKeys))
+	for i := range e.sharedKeys {
+		e.verbosePrint("key", i, ":", e.sharedKeys[i])
+		seed, err := e.sharedKeys[i].MarshalBinary()
+		if err != nil {
+			log.Fatal("Could not extract data from shared key", err)
+		}
+		prngs[i] = e.prngFactory(seed)
+	}
+	return prngs
+}
+
+// UseSeekablePRNGs re-seeds the pad streams with SeekableXOFs, so that SkipToRound does not depend on the gap.
+// This changes the pads : it must be called before round 0 by all members of the DC-net.
+func (e *DCNetEntity) UseSeekablePRNGs() {
+	e.prngFactory = func(seed []byte) kyber.XOF {
+		return NewSeekableXOF(seed)
+	}
+	e.sharedPRNGs = e.newSharedPRNGs()
+	e.currentRound = 0
+}
+
+// PRNGPosition returns the current position of the pad streams
+func (e *DCNetEntity) PRNGPosition() PRNGPosition {
+	return PRNGPosition{
+		RoundID:    e.currentRound,
+		ByteOffset: uint64(e.currentRound) * uint64(e.DCNetPayloadSize),
+	}
+}
+
+// SkipToRound moves the pad streams to the beginning of roundID, so that the next round encoded is roundID.
+// Seekable PRNGs jump there directly; the others discard the material in between (or restart from their seed, if
+// roundID is in the past).
+func (e *DCNetEntity) SkipToRound(roundID int32) {
+	if roundID < 0 {
+		panic("DCNet: cannot skip to negative round " + strconv.Itoa(int(roundID)))
+	}
+	if roundID < e.currentRound {
+		e.sharedPRNGs = e.newSharedPRNGs()
+		e.currentRound = 0
+	}
+	if roundID == e.currentRound {
+		return
+	}
+
+	dcnetLog.Lvl4("DCNet: Skipping from round", e.currentRound, "to round", roundID)
+	target := uint64(roundID) * uint64(e.DCNetPayloadSize)
+	gap := uint64(roundID-e.currentRound) * uint64(e.DCNetPayloadSize)
+
+	var dummy []byte
+	for i := range e.sharedPRNGs {
+		if seekable, ok := e.sharedPRNGs[i].(SeekableXOF); ok {
+			seekable.Seek(target)
+			continue
+		}
+		if dummy == nil {
+			chunkSize := uint64(PRNG_DISCARD_CHUNK_SIZE)
+			if gap < chunkSize {
+				chunkSize = gap
+			}
+			dummy = make([]byte, chunkSize)
+		}
+		for remaining := gap; remaining > 0; {
+			n := uint64(len(dummy))
+			if remaining < n {
+				n = remaining
+			}
+			e.sharedPRNGs[i].XORKeyStream(dummy[:n], dummy[:n])
+			remaining -= n
+		}
+	}
+	e.currentRound = roundID
+}
+
 func (e *DCNetEntity) verbosePrint(info ...interface{}) {
 	if !e.verbose {
 		return
@@ -135,12 +232,33 @@ func (e *DCNetEntity) verbosePrint(info ...interface{}) {
 	}
 
 	s2 := fmt.Sprint(info...)
-	log.Lvl1(s, s2)
+	dcnetLog.Lvl1(s, s2)
+}
+
+// UseCellPool takes the large cells from pool instead of allocating them for each round : the trustee's ciphers
+// (pool of CipherSize bytes), and the relay's decoded cells (pool of DCNetPayloadSize bytes). The caller owns each
+// cell it gets, and gives it back to the pool once done with it. It has no effect with the equivocation protection.
+func (e *DCNetEntity) UseCellPool(pool *utils.CellPool) {
+	if e.EquivocationProtectionEnabled {
+		return
+	}
+	e.cellPool = pool
+}
+
+// CipherSize returns the size of the ciphers of the trustees, as given by TrusteeEncodeForRound
+func (e *DCNetEntity) CipherSize() int {
+	return len(new(DCNetCipher).ToBytes()) + e.DCNetPayloadSize + e.equivocationContribLength
 }
 
 // Encodes "Payload" in the correct round. Will skip PRNG material if the round is in the future,
 // and crash if the round is in the past or the Payload is too long
 func (e *DCNetEntity) TrusteeEncodeForRound(roundID int32) []byte {
+	if e.cellPool != nil && e.Entity == DCNET_TRUSTEE {
+		e.SkipToRound(roundID)
+		upstreamCell := e.trusteeEncodeInPlace()
+		e.currentRound++
+		return upstreamCell
+	}
 	upstreamCell, _ := e.EncodeForRound(roundID, false, nil)
 	return upstreamCell
 }
@@ -152,48 +270,8 @@ func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []by
 		panic("DCNet: cannot encode Payload of length " + strconv.Itoa(int(len(payload))) + " max length is " + strconv.Itoa(len(payload)))
 	}
 
-	if roundID < e.currentRound {
-		sharedKeys := e.sharedKeys
-
-		// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
-		sharedPRNGsCopy := make([]kyber.XOF, len(sharedKeys))
-		for i := range sharedKeys {
-			e.verbosePrint("key", i, ":", sharedKeys[i])
-			seed, err := sharedKeys[i].MarshalBinary()
-			if err != nil {
-				log.Fatal("Could not extract data from shared key", err)
-			}
-			sharedPRNGsCopy[i] = e.cryptoSuite.XOF(seed)
-		}
-		round := int32(0)
-		for round < roundID {
-			//discard crypto material
-
-			// consume the PRNGs
-			for i := range e.sharedPRNGs {
-				dummy := make([]byte, e.DCNetPayloadSize)
-				sharedPRNGsCopy[i].XORKeyStream(dummy, dummy)
-			}
-
-			round++
-
-		}
-		e.sharedPRNGs = sharedPRNGsCopy
-		e.currentRound = roundID
-	}
-
-	for e.currentRound < roundID {
-		//discard crypto material
-		log.Lvl4("DCNet: Discarding round", e.currentRound)
+	e.SkipToRound(roundID)
 
-		// consume the PRNGs
-		for i := range e.sharedPRNGs {
-			dummy := make([]byte, e.DCNetPayloadSize)
-			e.sharedPRNGs[i].XORKeyStream(dummy, dummy)
-		}
-
-		e.currentRound++
-	}
 	var plainPayload []byte
 	var c *DCNetCipher
 	if e.Entity == DCNET_CLIENT {
@@ -208,6 +286,36 @@ func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []by
 	return c.ToBytes(), plainPayload
 }
 
+// EncodeForRoundWithSize is EncodeForRound for a round whose cell is only size bytes (variable slot sizes) : the
+// pads of the round are drawn in full, so that the pad streams stay at the same position whatever the sizes, but
+// only their first size bytes are sent. The relay decodes the first size bytes. It cannot be used with the
+// equivocation protection, whose tags cover the whole cell.
+func (e *DCNetEntity) EncodeForRoundWithSize(roundID int32, slotOwner bool, payload []byte, size int) ([]byte, []byte) {
+	if size <= 0 || size >= e.DCNetPayloadSize {
+		return e.EncodeForRound(roundID, slotOwner, payload)
+	}
+	if e.EquivocationProtectionEnabled {
+		panic("DCNet: cannot encode a cell of " + strconv.Itoa(size) + " bytes with the equivocation protection")
+	}
+	if len(payload) > size {
+		panic("DCNet: cannot encode Payload of length " + strconv.Itoa(len(payload)) + " in a cell of " + strconv.Itoa(size) + " bytes")
+	}
+
+	e.SkipToRound(roundID)
+
+	var c *DCNetCipher
+	if e.Entity == DCNET_CLIENT {
+		c, _ = e.clientEncode(slotOwner, payload)
+	} else {
+		c = e.trusteeEncode()
+	}
+	e.currentRound++
+	c.Payload = c.Payload[:size]
+
+	e.verbosePrint("r[", roundID, "]: (", size, "bytes)\n", c.Payload)
+	return c.ToBytes(), payload
+}
+
 // Adds `newdata` into the sponge representing the received downstream data
 func (e *DCNetEntity) UpdateReceivedMessageHistory(newData []byte) {
 	if e.EquivocationProtectionEnabled {
@@ -219,19 +327,17 @@ func (e *DCNetEntity) UpdateReceivedMessageHistory(newData []byte) {
 func (e *DCNetEntity) clientEncode(slotOwner bool, payload []byte) (*DCNetCipher, []byte) {
 
 	c := new(DCNetCipher)
+	c.MACAlgorithm = e.MACAlgorithm
 
-	if payload == nil {
-		payload = make([]byte, e.DCNetPayloadSize)
-	} else {
-		// deep clone and pad
-		dcnetPayloadSize := e.DCNetPayloadSize
-		if e.EquivocationProtectionEnabled && slotOwner {
-			dcnetPayloadSize -= 16
-		}
-		payload2 := make([]byte, dcnetPayloadSize)
-		copy(payload2[0:len(payload)], payload)
-		payload = payload2
+	// deep clone and pad; with the equivocation protection, the owner's payload leaves room for the tag of its
+	// encryption, even if it has nothing to send
+	dcnetPayloadSize := e.DCNetPayloadSize
+	if e.EquivocationProtectionEnabled && slotOwner {
+		dcnetPayloadSize -= 16
 	}
+	payload2 := make([]byte, dcnetPayloadSize)
+	copy(payload2[0:len(payload)], payload)
+	payload = payload2
 	c.Payload = payload
 
 	// prepare the pads
@@ -254,9 +360,7 @@ func (e *DCNetEntity) clientEncode(slotOwner bool, payload []byte) (*DCNetCipher
 
 	// DC-net encrypt the Payload
 	for i := range p_ij {
-		for k := range c.Payload {
-			c.Payload[k] ^= p_ij[i][k] // XORs in the pads
-		}
+		xorBytes(c.Payload, p_ij[i][:len(c.Payload)]) // XORs in the pads
 	}
 	return c, plainPayload[:]
 }
@@ -276,9 +380,7 @@ func (e *DCNetEntity) trusteeEncode() *DCNetCipher {
 
 	// DC-net encrypt the Payload
 	for i := range p_ij {
-		for k := range c.Payload {
-			c.Payload[k] ^= p_ij[i][k] // XORs in the pads
-		}
+		xorBytes(c.Payload, p_ij[i][:len(c.Payload)]) // XORs in the pads
 	}
 
 	// if the equivocation protection is enabled, encrypt the Payload, and add the tag
@@ -290,39 +392,66 @@ func (e *DCNetEntity) trusteeEncode() *DCNetCipher {
 	return c
 }
 
-// Function to get the bits from previous round in an exact position.
-func (e *DCNetEntity) GetBitsOfRound(roundID int32, bitPosition int32) (map[int]int, [][]byte) {
-	if roundID >= e.currentRound {
-		return nil, nil
+// trusteeEncodeInPlace encodes the trustee's cipher straight into a cell of the pool, in the format of ToBytes : the
+// pads are XORed into the payload one after the other, without a buffer per pad nor a copy of the payload. The bytes
+// are the same as with trusteeEncode.
+func (e *DCNetEntity) trusteeEncodeInPlace() []byte {
+	header := new(DCNetCipher).ToBytes() // no tag, the payload follows the header
+	out := e.cellPool.Get()[:len(header)+e.DCNetPayloadSize]
+	copy(out, header)
+
+	payload := out[len(header):]
+	for i := range payload {
+		payload[i] = 0 // the cell may be reused
+	}
+	for i := range e.sharedPRNGs {
+		e.sharedPRNGs[i].XORKeyStream(payload, payload) // XORs in the pads
 	}
+	return out
+}
 
-	sharedKeys := e.sharedKeys
+// BitAt returns the bit at bitPosition in data, counting from the most significant bit of the first byte
+func BitAt(data []byte, bitPosition int) int {
+	return int(data[bitPosition/8]>>uint(7-bitPosition%8)) & 1
+}
 
-	// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
-	sharedPRNGsCopy := make([]kyber.XOF, len(sharedKeys))
-	for i := range sharedKeys {
-		e.verbosePrint("key", i, ":", sharedKeys[i])
-		seed, err := sharedKeys[i].MarshalBinary()
-		if err != nil {
-			log.Fatal("Could not extract data from shared key", err)
-		}
-		sharedPRNGsCopy[i] = e.cryptoSuite.XOF(seed)
+// PadBitsOfRound returns the bit at bitPosition of the pad of roundID shared with each peer, in the order of the
+// shared keys. The pads are recomputed on new streams : the ones of the entity do not move, and may be in use.
+func (e *DCNetEntity) PadBitsOfRound(roundID int32, bitPosition int) map[int]int {
+	bits := make(map[int]int)
+	for i, key := range e.sharedKeys {
+		bits[i] = e.padBit(key, roundID, bitPosition)
 	}
-	round := int32(0)
-	for round < roundID {
-		//discard crypto material
+	return bits
+}
 
-		// consume the PRNGs
-		for i := range e.sharedPRNGs {
-			dummy := make([]byte, e.DCNetPayloadSize)
-			sharedPRNGsCopy[i].XORKeyStream(dummy, dummy)
-		}
+// PadBit returns the bit at bitPosition of the pad of roundID derived from sharedKey, e.g. a secret revealed to the
+// relay during a blame
+func (e *DCNetEntity) PadBit(sharedKey kyber.Point, roundID int32, bitPosition int) int {
+	return e.padBit(sharedKey, roundID, bitPosition)
+}
 
-		round++
+func (e *DCNetEntity) padBit(sharedKey kyber.Point, roundID int32, bitPosition int) int {
+	stream := &DCNetEntity{
+		DCNetPayloadSize: e.DCNetPayloadSize,
+		sharedKeys:       []kyber.Point{sharedKey},
+		prngFactory:      e.prngFactory,
+	}
+	stream.sharedPRNGs = stream.newSharedPRNGs()
+	stream.SkipToRound(roundID)
 
+	pad := make([]byte, e.DCNetPayloadSize)
+	stream.sharedPRNGs[0].XORKeyStream(pad, pad)
+	return BitAt(pad, bitPosition)
+}
+
+// Function to get the bits from previous round in an exact position.
+func (e *DCNetEntity) GetBitsOfRound(roundID int32, bitPosition int32) (map[int]int, [][]byte) {
+	if roundID >= e.currentRound {
+		return nil, nil
 	}
-	e.sharedPRNGs = sharedPRNGsCopy
-	e.currentRound = roundID
+
+	e.SkipToRound(roundID)
 
 	rtn := make(map[int]int)
 
@@ -356,60 +485,154 @@ func (e *DCNetEntity) GetBitsOfRound(roundID int32, bitPosition int32) (map[int]
 
 // Used by the relay to start decoding a round
 func (e *DCNetEntity) DecodeStart(roundID int32) {
-	e.DCNetRoundDecoder = new(DCNetRoundDecoder)
-	e.DCNetRoundDecoder.currentRoundBeingDecoded = roundID
-	e.DCNetRoundDecoder.xorBuffer = make([]byte, e.DCNetPayloadSize)
-	e.DCNetRoundDecoder.equivClientContribs = make([][]byte, 0)
-	e.DCNetRoundDecoder.equivTrusteeContribs = make([][]byte, 0)
+	e.ReleaseRoundDecoder(e.DCNetRoundDecoder) // e.g., the round was force-closed
+	e.DCNetRoundDecoder = e.NewRoundDecoder(roundID)
 }
 
-// called by the relay to decode a client contribution
-func (e *DCNetEntity) DecodeClient(roundID int32, slice []byte) {
+// NewRoundDecoder returns a decoder for roundID, with its own cell. The relay can fill the decoders of several rounds
+// at once (see AddCipher), and hands each one to the entity with UseRoundDecoder once its round is the current one.
+func (e *DCNetEntity) NewRoundDecoder(roundID int32) *DCNetRoundDecoder {
+	d := new(DCNetRoundDecoder)
+	d.currentRoundBeingDecoded = roundID
+	if e.cellPool != nil {
+		d.xorBuffer = e.cellPool.Get()[:e.DCNetPayloadSize]
+		for i := range d.xorBuffer {
+			d.xorBuffer[i] = 0 // the cell may be reused
+		}
+	} else {
+		d.xorBuffer = make([]byte, e.DCNetPayloadSize)
+	}
+	d.equivClientContribs = make([][]byte, 0)
+	d.equivTrusteeContribs = make([][]byte, 0)
+	return d
+}
 
-	dcNetCipher := DCNetCipherFromBytes(slice)
+// UseRoundDecoder makes d, filled beforehand, the decoder of the round being decoded
+func (e *DCNetEntity) UseRoundDecoder(d *DCNetRoundDecoder) {
+	if e.DCNetRoundDecoder != d {
+		e.ReleaseRoundDecoder(e.DCNetRoundDecoder)
+	}
+	e.DCNetRoundDecoder = d
+}
 
-	if roundID != e.DCNetRoundDecoder.currentRoundBeingDecoded {
-		panic("Cannot DecodeClient for round" +
-			strconv.Itoa(int(roundID)) + ", we are in round " + strconv.Itoa(int(e.DCNetRoundDecoder.currentRoundBeingDecoded)))
+// ReleaseRoundDecoder gives the cell of a decoder back to the pool, unless DecodeCell gave it away. Nobody may write
+// into the decoder anymore.
+func (e *DCNetEntity) ReleaseRoundDecoder(d *DCNetRoundDecoder) {
+	if d != nil && e.cellPool != nil && !d.cellTaken {
+		e.cellPool.Release(d.xorBuffer)
 	}
+}
+
+// RoundID returns the round a decoder decodes
+func (d *DCNetRoundDecoder) RoundID() int32 {
+	return d.currentRoundBeingDecoded
+}
+
+// CellSize returns the size of the cell a decoder decodes
+func (d *DCNetRoundDecoder) CellSize() int {
+	return len(d.xorBuffer)
+}
+
+// AddCipher records the header (and equivocation tag) of a client or trustee cipher of the round of d, and returns
+// its payload, which the caller then XORs into d with XORPayload. It must not run concurrently with itself on d.
+func (e *DCNetEntity) AddCipher(d *DCNetRoundDecoder, slice []byte, isClient bool) []byte {
+	dcNetCipher := DCNetCipherFromBytes(slice)
 
-	for i := range dcNetCipher.Payload {
-		e.DCNetRoundDecoder.xorBuffer[i] ^= dcNetCipher.Payload[i]
+	if isClient {
+		if d.nClientCiphers == 0 {
+			d.macAlgorithm = dcNetCipher.MACAlgorithm
+		} else if dcNetCipher.MACAlgorithm != d.macAlgorithm {
+			d.macAlgorithmMixed = true
+		}
+		d.nClientCiphers++
 	}
 
 	if e.EquivocationProtectionEnabled {
-		e.DCNetRoundDecoder.equivClientContribs = append(e.DCNetRoundDecoder.equivClientContribs, dcNetCipher.EquivocationProtectionTag)
+		if isClient {
+			d.equivClientContribs = append(d.equivClientContribs, dcNetCipher.EquivocationProtectionTag)
+		} else {
+			d.equivTrusteeContribs = append(d.equivTrusteeContribs, dcNetCipher.EquivocationProtectionTag)
+		}
 	}
+	return dcNetCipher.Payload
+}
+
+// XORPayload XORs the bytes from to to of a payload (if it has them) into the cell of d. Calls on ranges which do not
+// overlap can run concurrently.
+func (d *DCNetRoundDecoder) XORPayload(payload []byte, from, to int) {
+	if to > len(payload) {
+		to = len(payload)
+	}
+	if from >= to {
+		return
+	}
+	xorBytes(d.xorBuffer[from:to], payload[from:to])
 }
 
 // called by the relay to decode a client contribution
-func (e *DCNetEntity) DecodeTrustee(roundID int32, slice []byte) {
+func (e *DCNetEntity) DecodeClient(roundID int32, slice []byte) {
+	if roundID != e.DCNetRoundDecoder.currentRoundBeingDecoded {
+		panic("Cannot DecodeClient for round" +
+			strconv.Itoa(int(roundID)) + ", we are in round " + strconv.Itoa(int(e.DCNetRoundDecoder.currentRoundBeingDecoded)))
+	}
 
-	dcNetCipher := DCNetCipherFromBytes(slice)
+	payload := e.AddCipher(e.DCNetRoundDecoder, slice, true)
+	xorBytes(e.DCNetRoundDecoder.xorBuffer, payload)
+}
 
+// called by the relay to decode a client contribution
+func (e *DCNetEntity) DecodeTrustee(roundID int32, slice []byte) {
 	if roundID != e.DCNetRoundDecoder.currentRoundBeingDecoded {
 		panic("Cannot DecodeClient for round" +
 			strconv.Itoa(int(roundID)) + ", we are in round " + strconv.Itoa(int(e.DCNetRoundDecoder.currentRoundBeingDecoded)))
 	}
 
-	for i := range dcNetCipher.Payload {
-		e.DCNetRoundDecoder.xorBuffer[i] ^= dcNetCipher.Payload[i]
+	payload := e.AddCipher(e.DCNetRoundDecoder, slice, false)
+	xorBytes(e.DCNetRoundDecoder.xorBuffer, payload)
+}
+
+// DecodedMACAlgorithm returns the MAC algorithm announced by the client ciphers of the round being decoded, and false
+// if they did not all announce the same one
+func (e *DCNetEntity) DecodedMACAlgorithm() (byte, bool) {
+	d := e.DCNetRoundDecoder
+	if d == nil {
+		return e.MACAlgorithm, true
 	}
+	return d.macAlgorithm, !d.macAlgorithmMixed
+}
 
-	if e.EquivocationProtectionEnabled {
-		e.DCNetRoundDecoder.equivTrusteeContribs = append(e.DCNetRoundDecoder.equivTrusteeContribs, dcNetCipher.EquivocationProtectionTag)
+// CheckEquivocationTag checks the equivocation tag of a client or trustee cipher, before the relay decodes it; nil if
+// the equivocation protection is disabled
+func (e *DCNetEntity) CheckEquivocationTag(cipher []byte) error {
+	if !e.EquivocationProtectionEnabled {
+		return nil
+	}
+	if len(cipher) < 8 {
+		return errors.New("the cipher is too short to carry an equivocation tag")
+	}
+	return e.equivocationProtection.CheckContribution(DCNetCipherFromBytes(cipher).EquivocationProtectionTag)
+}
+
+// EquivocationError returns the error of the equivocation protection in the last cell decoded, e.g.
+// ErrEquivocationMismatch; nil if it decoded correctly, or if the protection is disabled
+func (e *DCNetEntity) EquivocationError() error {
+	if e.DCNetRoundDecoder == nil {
+		return nil
 	}
+	return e.DCNetRoundDecoder.equivocationErr
 }
 
-// Called on the relay to decode the cell, after having stored the cryptographic materials
+// Called on the relay to decode the cell, after having stored the cryptographic materials. With a cell pool, the
+// decoded cell is taken from it, and the caller gives it back once done with it.
 func (e *DCNetEntity) DecodeCell(isOpenClosedSlot bool) ([]byte, []byte) {
 	//No Equivocation -> just XOR
 	d := e.DCNetRoundDecoder
+	d.cellTaken = true
 
 	cipherText := d.xorBuffer
 	var decoded []byte
 	if e.EquivocationProtectionEnabled && !isOpenClosedSlot {
-		decoded = e.equivocationProtection.RelayDecode(d.xorBuffer, d.equivTrusteeContribs, d.equivClientContribs)
+		decoded, d.equivocationErr = e.equivocationProtection.RelayDecode(d.xorBuffer, d.equivTrusteeContribs, d.equivClientContribs)
 	} else {
 		decoded = cipherText
 	}
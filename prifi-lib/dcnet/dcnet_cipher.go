@@ -9,8 +9,13 @@ import (
 type DCNetCipher struct {
 	EquivocationProtectionTag []byte
 	Payload                   []byte
+	MACAlgorithm              byte // the MAC of the disruption protection, see mac.go; 0 (HMAC-SHA256) for the trustees
 }
 
+// The header is : start of the equivocation tag (4 bytes, -1 if none), MAC algorithm (1 byte), start of the payload
+// (3 bytes)
+const maxPayloadStart = 1<<24 - 1
+
 // Converts the DCNetCipher to []byte
 func (c *DCNetCipher) ToBytes() []byte {
 	out := make([]byte, 8)
@@ -22,8 +27,12 @@ func (c *DCNetCipher) ToBytes() []byte {
 		payloadStart += len(c.EquivocationProtectionTag)
 	}
 
+	if payloadStart > maxPayloadStart {
+		panic("DCNetCipher.ToBytes: equivocation tag too long")
+	}
 	binary.BigEndian.PutUint32(out[0:4], uint32(equivocationTagStart))
 	binary.BigEndian.PutUint32(out[4:8], uint32(payloadStart))
+	out[4] = c.MACAlgorithm
 
 	if c.EquivocationProtectionTag != nil {
 		out = append(out, c.EquivocationProtectionTag...)
@@ -44,7 +53,8 @@ func DCNetCipherFromBytes(data []byte) *DCNetCipher {
 	minusOneInUint32 := math.MaxInt32
 
 	equivocationTagStart := int(binary.BigEndian.Uint32(data[0:4]))
-	payloadStart := int(binary.BigEndian.Uint32(data[4:8]))
+	c.MACAlgorithm = data[4]
+	payloadStart := int(binary.BigEndian.Uint32(data[4:8]) & maxPayloadStart)
 
 	if equivocationTagStart != minusOneInUint32 {
 		c.EquivocationProtectionTag = data[8:payloadStart]
@@ -20,7 +20,7 @@ func assertEqual(a, b *DCNetCipher) bool {
 	if !bytes.Equal(a.Payload, b.Payload) {
 		return false
 	}
-	return true
+	return a.MACAlgorithm == b.MACAlgorithm
 }
 
 func TestDCNetSerialization(t *testing.T) {
@@ -73,4 +73,14 @@ func ChangeLength(length int, t *testing.T) {
 		fmt.Printf("%+v\n", a)
 		fmt.Printf("%+v\n", DCNetCipherFromBytes(a.ToBytes()))
 	}
+	a = DCNetCipher{
+		EquivocationProtectionTag: randomBytes(length),
+		Payload:                   randomBytes(length),
+		MACAlgorithm:              MAC_POLY1305,
+	}
+	if !assertEqual(&a, DCNetCipherFromBytes(a.ToBytes())) || len(a.ToBytes()) != 8+2*length {
+		t.Error("DCNetCipher could not be marshalled-unmarshalled with a MAC algorithm")
+		fmt.Printf("%+v\n", a)
+		fmt.Printf("%+v\n", DCNetCipherFromBytes(a.ToBytes()))
+	}
 }
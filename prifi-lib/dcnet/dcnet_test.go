@@ -165,6 +165,9 @@ func SimulateRounds(t *testing.T, tg *TestGroup, maxRounds int32) {
 		}
 
 		output, _ := tg.Relay.DCNetEntity.DecodeCell(false)
+		if err := tg.Relay.DCNetEntity.EquivocationError(); err != nil {
+			t.Error("The histories are the same,", err)
+		}
 
 		//fmt.Println("-----------------")
 		//fmt.Println(output)
@@ -175,3 +178,192 @@ func SimulateRounds(t *testing.T, tg *TestGroup, maxRounds int32) {
 		}
 	}
 }
+
+func TestSkipToRound(t *testing.T) {
+
+	for _, seekable := range []bool{false, true} {
+		tg := NewTestGroup(t, false, 100, 1, 1)
+		if seekable {
+			for _, n := range append(tg.Clients, tg.Trustees...) {
+				n.DCNetEntity.UseSeekablePRNGs()
+			}
+		}
+		trustee := tg.Trustees[0].DCNetEntity
+
+		// a reference entity, which encodes every round
+		reference := NewDCNetEntity(0, DCNET_TRUSTEE, 100, false, tg.Trustees[0].sharedSecrets)
+		if seekable {
+			reference.UseSeekablePRNGs()
+		}
+		expected := make([][]byte, 50)
+		for r := range expected {
+			expected[r] = reference.TrusteeEncodeForRound(int32(r))
+		}
+
+		trustee.SkipToRound(40)
+		if pos := trustee.PRNGPosition(); pos.RoundID != 40 || pos.ByteOffset != 4000 {
+			t.Error("Wrong position after SkipToRound(40):", pos)
+		}
+		if !bytes.Equal(trustee.TrusteeEncodeForRound(40), expected[40]) {
+			t.Error("Round 40 differs after SkipToRound, seekable =", seekable)
+		}
+
+		// going back restarts from the seed
+		trustee.SkipToRound(3)
+		if !bytes.Equal(trustee.TrusteeEncodeForRound(3), expected[3]) {
+			t.Error("Round 3 differs after skipping backwards, seekable =", seekable)
+		}
+		if !bytes.Equal(trustee.TrusteeEncodeForRound(10), expected[10]) {
+			t.Error("Round 10 differs, seekable =", seekable)
+		}
+	}
+
+	// a client and a trustee using seekable PRNGs still cancel out
+	tg := NewTestGroup(t, false, 100, 2, 2)
+	for _, n := range append(tg.Clients, tg.Trustees...) {
+		n.DCNetEntity.UseSeekablePRNGs()
+	}
+	SimulateRounds(t, tg, 10)
+}
+
+func TestEncodeForRoundWithSize(t *testing.T) {
+	tg := NewTestGroup(t, false, 100, 3, 2)
+	sizes := []int{100, 10, 1, 57, 0, 100}
+
+	for roundID, size := range sizes {
+		message := randomBytes(size)
+		expectedLength := size
+		if size == 0 {
+			message = nil
+			expectedLength = 100
+		}
+
+		tg.Relay.DCNetEntity.DecodeStart(int32(roundID))
+		for i := range tg.Clients {
+			var m []byte
+			if i == 1 {
+				m, _ = tg.Clients[i].DCNetEntity.EncodeForRoundWithSize(int32(roundID), true, message, size)
+			} else {
+				m, _ = tg.Clients[i].DCNetEntity.EncodeForRoundWithSize(int32(roundID), false, nil, size)
+			}
+			if len(DCNetCipherFromBytes(m).Payload) != expectedLength {
+				t.Error("The cipher of round", roundID, "should be", expectedLength, "bytes, is", len(DCNetCipherFromBytes(m).Payload))
+			}
+			tg.Relay.DCNetEntity.DecodeClient(int32(roundID), m)
+		}
+		// the trustees do not know the sizes, their ciphers are complete
+		for i := range tg.Trustees {
+			tg.Relay.DCNetEntity.DecodeTrustee(int32(roundID), tg.Trustees[i].DCNetEntity.TrusteeEncodeForRound(int32(roundID)))
+		}
+
+		output, _ := tg.Relay.DCNetEntity.DecodeCell(false)
+		if size == 0 {
+			if !bytes.Equal(output, make([]byte, 100)) {
+				t.Error("DC-net encoding failed for a full round")
+			}
+		} else if !bytes.Equal(output[:size], message) {
+			t.Error("DC-net encoding failed for a cell of", size, "bytes")
+		}
+	}
+}
+
+func TestEmptyOwnerPayloadWithEquivocation(t *testing.T) {
+	tg := NewTestGroup(t, true, 100, 2, 1)
+
+	// the owner has nothing to send, e.g. it is paused or leaving
+	tg.Relay.DCNetEntity.DecodeStart(0)
+	for i := range tg.Clients {
+		m, _ := tg.Clients[i].DCNetEntity.EncodeForRound(0, i == 0, nil)
+		if len(DCNetCipherFromBytes(m).Payload) != 100 {
+			t.Error("The cipher of client", i, "should be 100 bytes, is", len(DCNetCipherFromBytes(m).Payload))
+		}
+		tg.Relay.DCNetEntity.DecodeClient(0, m)
+	}
+	tg.Relay.DCNetEntity.DecodeTrustee(0, tg.Trustees[0].DCNetEntity.TrusteeEncodeForRound(0))
+
+	output, _ := tg.Relay.DCNetEntity.DecodeCell(false)
+	if !bytes.Equal(output, make([]byte, 100-16)) {
+		t.Error("The empty payload of the owner should be decoded")
+	}
+}
+
+func TestPadBitsOfRound(t *testing.T) {
+	tg := NewTestGroup(t, false, 100, 1, 2)
+	trustee := tg.Trustees[0].DCNetEntity
+	ciphers := make([][]byte, 5)
+	for r := range ciphers {
+		ciphers[r] = DCNetCipherFromBytes(trustee.TrusteeEncodeForRound(int32(r))).Payload
+	}
+
+	// the cipher of a trustee is the XOR of its pads
+	for _, pos := range []int{0, 7, 8, 413, 799} {
+		bits := trustee.PadBitsOfRound(2, pos)
+		if len(bits) != 1 || bits[0] != BitAt(ciphers[2], pos) {
+			t.Error("Wrong pad bits at", pos, bits)
+		}
+		if trustee.PadBit(tg.Trustees[0].sharedSecrets[0], 2, pos) != bits[0] {
+			t.Error("PadBit should give the bit of the pad derived from the secret")
+		}
+	}
+
+	// the client shares the same pad with the trustee
+	client := tg.Clients[0].DCNetEntity
+	if client.PadBitsOfRound(2, 413)[0] != BitAt(ciphers[2], 413) {
+		t.Error("The client and the trustee should have the same pad")
+	}
+
+	// the streams of the entity did not move
+	if pos := trustee.PRNGPosition(); pos.RoundID != 5 {
+		t.Error("PadBitsOfRound should not move the streams", pos)
+	}
+	reference := NewDCNetEntity(0, DCNET_TRUSTEE, 100, false, tg.Trustees[0].sharedSecrets)
+	reference.SkipToRound(5)
+	if !bytes.Equal(trustee.TrusteeEncodeForRound(5), reference.TrusteeEncodeForRound(5)) {
+		t.Error("Round 5 differs after PadBitsOfRound")
+	}
+}
+
+func TestBitAt(t *testing.T) {
+	data := []byte{0x80, 0x01}
+	for pos, expected := range map[int]int{0: 1, 1: 0, 7: 0, 8: 0, 15: 1} {
+		if BitAt(data, pos) != expected {
+			t.Error("Wrong bit at", pos)
+		}
+	}
+}
+
+func TestSeekableXOF(t *testing.T) {
+
+	x := NewSeekableXOF([]byte("seed"))
+	stream := make([]byte, 1000)
+	x.Read(stream)
+	if x.Position() != 1000 {
+		t.Error("Position should be 1000, is", x.Position())
+	}
+
+	for _, offset := range []uint64{0, 1, 15, 16, 17, 500, 999} {
+		x.Seek(offset)
+		b := make([]byte, 1)
+		x.Read(b)
+		if b[0] != stream[offset] {
+			t.Error("Seek to", offset, "does not give the same stream")
+		}
+	}
+
+	x.Seek(123)
+	clone := x.Clone()
+	a := make([]byte, 10)
+	b := make([]byte, 10)
+	x.Read(a)
+	clone.Read(b)
+	if !bytes.Equal(a, b) || !bytes.Equal(a, stream[123:133]) {
+		t.Error("Clone should continue the same stream")
+	}
+
+	other := NewSeekableXOF([]byte("other seed"))
+	c := make([]byte, 10)
+	other.Read(c)
+	if bytes.Equal(c, stream[0:10]) {
+		t.Error("Different seeds should give different streams")
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/onet/v3/log"
+	"strconv"
 )
 
 // Clients compute:
@@ -24,6 +26,11 @@ import (
 // c = k_i + c'
 //
 
+// ErrEquivocationMismatch is returned by RelayDecode when the payload does not authenticate under the key recovered
+// from the contributions : the history of a client differs from the relay's, or a contribution (or the payload) was
+// tampered with
+var ErrEquivocationMismatch = errors.New("the payload does not authenticate under the key recovered from the equivocation contributions")
+
 // Equivocation holds the functions needed for equivocation protection
 type EquivocationProtection struct {
 	history    kyber.Scalar
@@ -58,7 +65,9 @@ func (e *EquivocationProtection) UpdateHistory(data []byte) {
 	if err != nil {
 		log.Fatal("Could not unmarshall bytes", err)
 	}
-	toBeHashed := make([]byte, len(historyB)+len(data))
+	toBeHashed := make([]byte, 0, len(historyB)+len(data))
+	toBeHashed = append(toBeHashed, historyB...)
+	toBeHashed = append(toBeHashed, data...)
 	newPayload := sha256.Sum256(toBeHashed)
 	e.history.SetBytes(newPayload[:])
 }
@@ -158,8 +167,20 @@ func (e *EquivocationProtection) TrusteeProve() []byte {
 	return nil
 }
 
-// given all contributions, decodes the payload
-func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesContributions [][]byte, clientsContributions [][]byte) []byte {
+// CheckContribution checks that the contribution of a client or a trustee is the encoding of a scalar
+func (e *EquivocationProtection) CheckContribution(contribution []byte) error {
+	if size := e.suite.Scalar().MarshalSize(); len(contribution) != size {
+		return errors.New("the equivocation contribution has " + strconv.Itoa(len(contribution)) + " bytes instead of " + strconv.Itoa(size))
+	}
+	if err := e.suite.Scalar().UnmarshalBinary(contribution); err != nil {
+		return errors.New("the equivocation contribution is not a scalar, " + err.Error())
+	}
+	return nil
+}
+
+// given all contributions, decodes the payload. If it does not authenticate under the key recovered from the
+// contributions, a cell of zeros is returned, with ErrEquivocationMismatch.
+func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesContributions [][]byte, clientsContributions [][]byte) ([]byte, error) {
 
 	//reconstitute the abstract.Point values
 	trustee_kappa_j := make([]kyber.Scalar, len(trusteesContributions))
@@ -194,20 +215,20 @@ func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesCo
 	}
 
 	if len(k_bytes) == 0 {
-		log.Lvl1("Error: Equivocation couldn't recover the k_bytes value")
-		log.Lvl1("encryptedPayload:", encryptedPayload)
+		dcnetLog.Lvl1("Error: Equivocation couldn't recover the k_bytes value")
+		dcnetLog.Lvl1("encryptedPayload:", encryptedPayload)
 		for k, v := range trusteesContributions {
-			log.Lvl1("trusteesContributions:", v, "mapped to", trustee_kappa_j[k])
+			dcnetLog.Lvl1("trusteesContributions:", v, "mapped to", trustee_kappa_j[k])
 		}
 		for k, v := range clientsContributions {
-			log.Lvl1("clientsContributions:", v, "mapped to", client_kappa_i[k])
+			dcnetLog.Lvl1("clientsContributions:", v, "mapped to", client_kappa_i[k])
 		}
-		log.Lvl1("sumTrustees:", sumTrustees)
-		log.Lvl1("sumClients:", sumClients)
-		log.Lvl1("history:", e.history)
-		log.Lvl1("prod:", prod)
-		log.Lvl1("k_i:", k_i)
-		return make([]byte, 0)
+		dcnetLog.Lvl1("sumTrustees:", sumTrustees)
+		dcnetLog.Lvl1("sumClients:", sumClients)
+		dcnetLog.Lvl1("history:", e.history)
+		dcnetLog.Lvl1("prod:", prod)
+		dcnetLog.Lvl1("k_i:", k_i)
+		return make([]byte, 0), errors.New("could not recover the key of the payload from the equivocation contributions")
 	}
 
 	// decrypt the payload
@@ -225,9 +246,8 @@ func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesCo
 
 	message, err := aesgcm.Open(nil, nonce, encryptedPayload, nil)
 	if err != nil {
-		//TODO: Bubble up this disruption in the client
-		message = make([]byte, len(encryptedPayload)-16)
+		return make([]byte, len(encryptedPayload)-16), ErrEquivocationMismatch
 	}
 
-	return message
+	return message, nil
 }
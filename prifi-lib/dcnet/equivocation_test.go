@@ -108,7 +108,10 @@ func equivocationTestForDataLength(t *testing.T, payloadSize int) {
 	clientContrib[0] = kappa1
 	clientContrib[1] = kappa2
 
-	payloadPlaintext := e_relay.RelayDecode(x_prim1, trusteesContrib, clientContrib)
+	payloadPlaintext, err := e_relay.RelayDecode(x_prim1, trusteesContrib, clientContrib)
+	if err != nil {
+		t.Error("the contributions should be consistent,", err)
+	}
 
 	if bytes.Compare(payload, payloadPlaintext) != 0 {
 		log.Lvl1(payload)
@@ -116,3 +119,43 @@ func equivocationTestForDataLength(t *testing.T, payloadSize int) {
 		t.Error("payloads don't match")
 	}
 }
+
+func TestEquivocationDivergingHistories(t *testing.T) {
+	tg := NewTestGroup(t, true, 100, 2, 1)
+	relay := tg.Relay.DCNetEntity
+
+	// client 1 did not receive the same downstream data as the others
+	downstream := randomBytes(100)
+	tg.Clients[0].DCNetEntity.UpdateReceivedMessageHistory(downstream)
+	tg.Relay.DCNetEntity.UpdateReceivedMessageHistory(downstream)
+	downstream[0] ^= 1
+	tg.Clients[1].DCNetEntity.UpdateReceivedMessageHistory(downstream)
+
+	c0, _ := tg.Clients[0].DCNetEntity.EncodeForRound(0, true, randomBytes(relay.DCNetPayloadSize-16))
+	c1, _ := tg.Clients[1].DCNetEntity.EncodeForRound(0, false, nil)
+	tr := tg.Trustees[0].DCNetEntity.TrusteeEncodeForRound(0)
+	for _, c := range [][]byte{c0, c1, tr} {
+		if err := relay.CheckEquivocationTag(c); err != nil {
+			t.Error("The tags are well-formed,", err)
+		}
+	}
+
+	relay.DecodeStart(0)
+	relay.DecodeClient(0, c0)
+	relay.DecodeClient(0, c1)
+	relay.DecodeTrustee(0, tr)
+	relay.DecodeCell(false)
+	if relay.EquivocationError() != ErrEquivocationMismatch {
+		t.Error("The relay should notice that the histories diverged, got", relay.EquivocationError())
+	}
+
+	// a cipher whose tag was cut
+	cipher := DCNetCipherFromBytes(c1)
+	cipher.EquivocationProtectionTag = cipher.EquivocationProtectionTag[1:]
+	if relay.CheckEquivocationTag(cipher.ToBytes()) == nil {
+		t.Error("A tag of the wrong size should be refused")
+	}
+	if relay.CheckEquivocationTag([]byte{1, 2}) == nil {
+		t.Error("A cipher without header should be refused")
+	}
+}
@@ -0,0 +1,178 @@
+package dcnet
+
+/*
+The history digests let the relay check that each client received the same downstream data as it sent. Both chain the
+hash of the downstream data of each round, in the order of the rounds (whatever the order they were received in) :
+digest(r) = H(digest(r-1) || r || H(data(r))), and digest(r) = digest(r-1) for a round without data, e.g. one the
+client gave up on. A lost, corrupted or equivocated round thus changes the digests of all the rounds after it.
+
+Every interval rounds (a checkpoint), the client reports its digest in its upstream cell, and the relay compares it
+with its own. When they differ, the first round which diverged lies between the last checkpoint which agreed and this
+one; the relay finds it with a binary search (DivergenceSearch), asking the client for its digests of the rounds in
+between, and gives the client its own digests from this round on, which the client adopts (a resync), instead of
+restarting the group.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// DEFAULT_HISTORY_DIGESTS_KEPT is for how many rounds the digests are kept, for the binary search
+const DEFAULT_HISTORY_DIGESTS_KEPT = 1024
+
+// HistoryDigests chains the hashes of the downstream data of the rounds
+type HistoryDigests struct {
+	chained int32            // the digest covers every round up to this one
+	digests map[int32][]byte // the digests of the last rounds chained
+	pending map[int32][]byte // the hashes of the data of the rounds after chained, which arrived out of order
+	kept    int32            // how many digests are kept
+	oldest  int32            // the oldest round whose digest is kept
+}
+
+// NewHistoryDigests starts a chain at round startRound, which has no downstream data, keeping the digests of the last
+// kept rounds (DEFAULT_HISTORY_DIGESTS_KEPT if 0 or less)
+func NewHistoryDigests(startRound int32, kept int) *HistoryDigests {
+	if kept <= 0 {
+		kept = DEFAULT_HISTORY_DIGESTS_KEPT
+	}
+	h := &HistoryDigests{
+		chained: startRound,
+		digests: make(map[int32][]byte),
+		pending: make(map[int32][]byte),
+		kept:    int32(kept),
+		oldest:  startRound,
+	}
+	h.digests[startRound] = make([]byte, sha256.Size)
+	return h
+}
+
+// Add records the downstream data of roundID, which is chained by Advance. The data of a round already chained is
+// ignored.
+func (h *HistoryDigests) Add(roundID int32, data []byte) {
+	if roundID <= h.chained {
+		return
+	}
+	sum := sha256.Sum256(data)
+	h.pending[roundID] = sum[:]
+}
+
+// Advance chains the rounds up to roundID; the ones whose data was not added are chained without data
+func (h *HistoryDigests) Advance(roundID int32) {
+	for h.chained < roundID {
+		previous := h.digests[h.chained]
+		h.chained++
+		dataHash, found := h.pending[h.chained]
+		if !found {
+			h.digests[h.chained] = previous
+		} else {
+			delete(h.pending, h.chained)
+			round := make([]byte, 4)
+			binary.BigEndian.PutUint32(round, uint32(h.chained))
+			d := sha256.New()
+			d.Write(previous)
+			d.Write(round)
+			d.Write(dataHash)
+			h.digests[h.chained] = d.Sum(nil)
+		}
+		for h.chained-h.oldest >= h.kept {
+			delete(h.digests, h.oldest)
+			h.oldest++
+		}
+	}
+}
+
+// Chained returns the last round chained
+func (h *HistoryDigests) Chained() int32 {
+	return h.chained
+}
+
+// Oldest returns the oldest round whose digest is kept
+func (h *HistoryDigests) Oldest() int32 {
+	return h.oldest
+}
+
+// Digest returns the digest of the rounds up to roundID; false if roundID is not chained yet, or was forgotten
+func (h *HistoryDigests) Digest(roundID int32) ([]byte, bool) {
+	d, found := h.digests[roundID]
+	return d, found
+}
+
+// Checkpoint returns the last checkpoint chained, i.e. the last multiple of interval up to Chained()
+func (h *HistoryDigests) Checkpoint(interval int) int32 {
+	if interval <= 0 {
+		return h.oldest
+	}
+	cp := h.chained - h.chained%int32(interval)
+	if cp < h.oldest {
+		return h.oldest
+	}
+	return cp
+}
+
+// Digests returns the digests of the rounds from roundID (or the oldest one kept, if after) up to Chained(), and the
+// round of the first one
+func (h *HistoryDigests) Digests(roundID int32) (int32, [][]byte) {
+	if roundID < h.oldest {
+		roundID = h.oldest
+	}
+	digests := make([][]byte, 0)
+	for r := roundID; r <= h.chained; r++ {
+		digests = append(digests, h.digests[r])
+	}
+	return roundID, digests
+}
+
+// Resync adopts the digests of the rounds from firstRound on given by the relay, replacing ours for the rounds
+// chained; they must cover Chained(). The rounds after it are chained from the relay's digest.
+func (h *HistoryDigests) Resync(firstRound int32, digests [][]byte) error {
+	if firstRound > h.chained || firstRound+int32(len(digests)) <= h.chained {
+		return errors.New("the digests of rounds " + strconv.Itoa(int(firstRound)) + " to " +
+			strconv.Itoa(int(firstRound)+len(digests)-1) + " do not cover round " + strconv.Itoa(int(h.chained)))
+	}
+	for i, d := range digests {
+		if len(d) != sha256.Size {
+			return errors.New("the digest of round " + strconv.Itoa(int(firstRound)+i) + " has a wrong size")
+		}
+	}
+	for r := firstRound; r <= h.chained; r++ {
+		if r >= h.oldest {
+			h.digests[r] = digests[r-firstRound]
+		}
+	}
+	return nil
+}
+
+// DivergenceSearch finds the first round whose digests differ, by binary search between a round whose digests agreed
+// and one whose digests differ. As the digests chain the rounds, they differ for all the rounds after it.
+type DivergenceSearch struct {
+	agreed int32 // the last round known to agree
+	differ int32 // the first round known to differ
+}
+
+// NewDivergenceSearch starts a search between a round whose digests agreed and a later one whose digests differ
+func NewDivergenceSearch(agreed, differ int32) *DivergenceSearch {
+	return &DivergenceSearch{agreed: agreed, differ: differ}
+}
+
+// Next returns the next round to compare, and true; or the first round which diverged, and false, once found
+func (s *DivergenceSearch) Next() (int32, bool) {
+	if s.differ-s.agreed <= 1 {
+		return s.differ, false
+	}
+	return s.agreed + (s.differ-s.agreed)/2, true
+}
+
+// Compared records whether the digests of roundID agree; a round out of the range searched is ignored
+func (s *DivergenceSearch) Compared(roundID int32, agree bool) {
+	if roundID <= s.agreed || roundID >= s.differ {
+		return
+	}
+	if agree {
+		s.agreed = roundID
+	} else {
+		s.differ = roundID
+	}
+}
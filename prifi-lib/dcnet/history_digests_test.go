@@ -0,0 +1,235 @@
+package dcnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the tests are deterministic : the data of a round only depends on its number
+func roundData(roundID int32) []byte {
+	return bytes.Repeat([]byte{byte(roundID), byte(roundID >> 8)}, 10+int(roundID%7))
+}
+
+// historyRun runs the rounds from..to on the relay's and a client's chains, the client chaining each round lag rounds
+// after the relay (like its cumulative ACK). received tells what the client got for a round; nil if it lost it.
+// It returns the first checkpoint whose digests differ, or -1.
+func historyRun(relay, client *HistoryDigests, from, to, lag int32, interval int, received func(int32) []byte) int32 {
+	reported := client.Checkpoint(interval)
+	for r := from; r <= to; r++ {
+		relay.Add(r, roundData(r))
+		relay.Advance(r)
+		if data := received(r); data != nil {
+			client.Add(r, data)
+		}
+		client.Advance(r - lag)
+
+		if cp := client.Checkpoint(interval); cp > reported {
+			reported = cp
+			d1, _ := relay.Digest(cp)
+			d2, _ := client.Digest(cp)
+			if !bytes.Equal(d1, d2) {
+				return cp
+			}
+		}
+	}
+	return -1
+}
+
+// localize runs the binary search for the first divergent round, and returns it with the number of digests asked
+func localize(relay, client *HistoryDigests, agreed, differ int32) (int32, int) {
+	search := NewDivergenceSearch(agreed, differ)
+	asked := 0
+	for {
+		r, more := search.Next()
+		if !more {
+			return r, asked
+		}
+		asked++
+		d1, _ := relay.Digest(r)
+		d2, found := client.Digest(r)
+		search.Compared(r, found && bytes.Equal(d1, d2))
+	}
+}
+
+func TestHistoryDigestsAgree(t *testing.T) {
+	relay := NewHistoryDigests(0, 0)
+	client := NewHistoryDigests(0, 0)
+
+	// the client gets the rounds out of order, but chains them in order
+	order := []int32{2, 1, 3, 5, 4, 6}
+	for _, r := range order {
+		client.Add(r, roundData(r))
+	}
+	client.Advance(6)
+	relay.Add(1, roundData(1))
+	relay.Add(2, roundData(2))
+	relay.Advance(3) // round 3 is not chained yet when Advance is called, it has no data
+	relay.Add(3, roundData(3))
+	if d1, _ := relay.Digest(3); bytes.Equal(d1, client.digests[3]) {
+		t.Error("Round 3 was chained without data on the relay")
+	}
+
+	relay = NewHistoryDigests(0, 0)
+	for r := int32(1); r <= 6; r++ {
+		relay.Add(r, roundData(r))
+		relay.Advance(r)
+	}
+	for r := int32(0); r <= 6; r++ {
+		d1, _ := relay.Digest(r)
+		d2, _ := client.Digest(r)
+		if !bytes.Equal(d1, d2) {
+			t.Error("The digests of round", r, "should agree")
+		}
+	}
+	if d, _ := relay.Digest(3); bytes.Equal(d, relay.digests[2]) {
+		t.Error("The digest of round 3 should cover its data")
+	}
+
+	// a round without data keeps the digest of the round before
+	relay.Advance(7)
+	if d, _ := relay.Digest(7); !bytes.Equal(d, relay.digests[6]) {
+		t.Error("A round without data should not change the digest")
+	}
+
+	// the same data in another round gives another digest
+	other := NewHistoryDigests(0, 0)
+	other.Add(2, roundData(1))
+	other.Add(1, roundData(2))
+	other.Advance(2)
+	if d, _ := other.Digest(2); bytes.Equal(d, relay.digests[2]) {
+		t.Error("Swapping the data of two rounds should change the digest")
+	}
+
+	// a late data does not change what is chained
+	before, _ := relay.Digest(5)
+	relay.Add(5, []byte("late"))
+	if after, _ := relay.Digest(5); !bytes.Equal(before, after) {
+		t.Error("The data of a chained round should be ignored")
+	}
+}
+
+func TestHistoryDivergenceDetection(t *testing.T) {
+	interval := 16
+	for _, lag := range []int32{0, 3} {
+		for diverged := int32(1); diverged <= 64; diverged++ {
+			for _, lost := range []bool{true, false} {
+				relay := NewHistoryDigests(0, 0)
+				client := NewHistoryDigests(0, 0)
+				received := func(r int32) []byte {
+					if r != diverged {
+						return roundData(r)
+					}
+					if lost {
+						return nil
+					}
+					d := roundData(r)
+					d[0] ^= 1
+					return d
+				}
+
+				// detected at the first checkpoint after the divergence
+				detected := historyRun(relay, client, 1, 200, lag, interval, received)
+				expected := (diverged + int32(interval) - 1) / int32(interval) * int32(interval)
+				if detected != expected {
+					t.Fatal("Round", diverged, "diverged (lost", lost, ", lag", lag, "), detected at", detected, "instead of", expected)
+				}
+
+				// found in log2(interval) digests
+				first, asked := localize(relay, client, expected-int32(interval), detected)
+				if first != diverged || asked > 4 {
+					t.Fatal("Found round", first, "with", asked, "digests, instead of", diverged)
+				}
+
+				// after the resync, the next checkpoints agree
+				firstRound, digests := relay.Digests(first)
+				if err := client.Resync(firstRound, digests); err != nil {
+					t.Fatal(err)
+				}
+				if d, _ := client.Digest(client.Chained()); !bytes.Equal(d, relay.digests[client.Chained()]) {
+					t.Fatal("The client should have the relay's digest after the resync")
+				}
+				if d := historyRun(relay, client, 201, 300, lag, interval, roundData); d != -1 {
+					t.Fatal("The digests should agree after the resync, they differ at", d)
+				}
+			}
+		}
+	}
+}
+
+func TestHistoryDigestsKept(t *testing.T) {
+	h := NewHistoryDigests(10, 8)
+	for r := int32(11); r <= 30; r++ {
+		h.Add(r, roundData(r))
+		h.Advance(r)
+	}
+	if h.Oldest() != 23 || h.Chained() != 30 || len(h.digests) != 8 {
+		t.Error("The digests of the last 8 rounds should be kept, kept", h.Oldest(), "to", h.Chained())
+	}
+	if _, found := h.Digest(22); found {
+		t.Error("The digest of round 22 should be forgotten")
+	}
+	if _, found := h.Digest(31); found {
+		t.Error("Round 31 is not chained")
+	}
+	if cp := h.Checkpoint(16); cp != 23 {
+		t.Error("Checkpoint 16 is forgotten, the oldest round should be given, got", cp)
+	}
+	if cp := h.Checkpoint(4); cp != 28 {
+		t.Error("Wrong checkpoint", cp)
+	}
+	if first, digests := h.Digests(0); first != 23 || len(digests) != 8 {
+		t.Error("Wrong digests", first, len(digests))
+	}
+
+	relay := NewHistoryDigests(10, 8)
+	relay.Advance(40)
+	_, digests := relay.Digests(35)
+	if err := h.Resync(31, digests); err == nil {
+		t.Error("The resync should start before round 30")
+	}
+	if err := h.Resync(25, digests[:3]); err == nil {
+		t.Error("The resync should cover round 30")
+	}
+	digests[0] = digests[0][1:]
+	if err := h.Resync(28, digests); err == nil {
+		t.Error("A digest of the wrong size should be refused")
+	}
+}
+
+func TestDivergenceSearch(t *testing.T) {
+	s := NewDivergenceSearch(0, 16)
+	if r, more := s.Next(); r != 8 || !more {
+		t.Error("The search should start in the middle, got", r)
+	}
+	s.Compared(8, true)
+	s.Compared(20, false) // out of the range, ignored
+	if r, _ := s.Next(); r != 12 {
+		t.Error("Expected round 12, got", r)
+	}
+	s.Compared(12, false)
+	s.Compared(10, true)
+	s.Compared(11, true)
+	if r, more := s.Next(); r != 12 || more {
+		t.Error("Round 12 is the first which diverged, got", r, more)
+	}
+}
+
+func TestUpdateHistoryDeterministic(t *testing.T) {
+	e1 := NewEquivocation()
+	e2 := NewEquivocation()
+	for r := int32(1); r <= 10; r++ {
+		e1.UpdateHistory(roundData(r))
+		e2.UpdateHistory(roundData(r))
+	}
+	if !e1.history.Equal(e2.history) {
+		t.Error("The same data should give the same history")
+	}
+
+	e1.UpdateHistory(roundData(11))
+	e1.UpdateHistory(roundData(12))
+	e2.UpdateHistory(roundData(12))
+	e2.UpdateHistory(roundData(11))
+	if e1.history.Equal(e2.history) {
+		t.Error("The order of the data should change the history")
+	}
+}
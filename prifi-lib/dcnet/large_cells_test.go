@@ -0,0 +1,72 @@
+package dcnet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/utils"
+	"go.dedis.ch/kyber/v3"
+)
+
+func TestTrusteeEncodeInPlace(t *testing.T) {
+	payloadSize := utils.LARGE_CELL_SIZE
+	keys := make([]kyber.Point, 3)
+	for i := range keys {
+		keys[i] = config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream())
+	}
+
+	reference := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, keys)
+	pooled := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, keys)
+	pool := utils.NewCellPool(pooled.CipherSize(), 1)
+	pooled.UseCellPool(pool)
+
+	for _, roundID := range []int32{0, 1, 2, 5, 6} {
+		expected := reference.TrusteeEncodeForRound(roundID)
+		cipher := pooled.TrusteeEncodeForRound(roundID)
+		if !bytes.Equal(cipher, expected) {
+			t.Fatal("The pooled cipher of round", roundID, "differs from the allocated one")
+		}
+		if !pool.Release(cipher) {
+			t.Error("The cipher should come from the pool")
+		}
+	}
+	if allocations, _ := pool.Stats(); allocations != 1 {
+		t.Error("The released cipher should be reused", allocations)
+	}
+
+	// no pool with the equivocation protection
+	equivocation := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, true, keys)
+	equivocation.UseCellPool(pool)
+	if equivocation.cellPool != nil {
+		t.Error("The equivocation protection should not use the pool")
+	}
+}
+
+func TestDecodeIntoPooledCell(t *testing.T) {
+	payloadSize := utils.LARGE_CELL_SIZE
+	relay := NewDCNetEntity(0, DCNET_RELAY, payloadSize, false, nil)
+	pool := utils.NewCellPool(payloadSize, 4)
+	relay.UseCellPool(pool)
+
+	cipher := &DCNetCipher{Payload: bytes.Repeat([]byte{0x0F}, payloadSize)}
+
+	// a round abandoned before being decoded gives its cell back
+	relay.DecodeStart(0)
+	relay.DecodeClient(0, cipher.ToBytes())
+	relay.DecodeStart(1)
+	if pool.Leased() != 1 {
+		t.Error("The cell of the abandoned round should be released", pool.Leased())
+	}
+
+	// the decoded cell starts from zero even if reused, and belongs to the caller
+	relay.DecodeClient(1, cipher.ToBytes())
+	decoded, _ := relay.DecodeCell(false)
+	if !bytes.Equal(decoded, cipher.Payload) {
+		t.Error("Wrong decoding in a reused cell")
+	}
+	relay.DecodeStart(2)
+	if pool.Leased() != 2 || !pool.Release(decoded) {
+		t.Error("The decoded cell should stay with the caller until released")
+	}
+}
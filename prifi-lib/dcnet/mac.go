@@ -0,0 +1,106 @@
+package dcnet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/poly1305"
+)
+
+/*
+The disruption protection ends the cell of the owner of a slot with a MAC of its content, which the relay checks. The
+MAC algorithm is chosen for the group (DisruptionProtectionMAC), and every client cipher tells it in its header (see
+DCNetCipher), so that the relay knows how the cells of a round were authenticated :
+- "hmac-sha256" (the default) : HMAC-SHA256 with the key of the slot, 32 bytes
+- "blake2b" : keyed BLAKE2b-256 with the key of the slot, 32 bytes, faster than HMAC-SHA256 on large cells
+- "poly1305" : Poly1305 with a one-time key derived from the key of the slot and the round, 16 bytes, the fastest
+*/
+
+// The MAC algorithms of the disruption protection, as written in the header of the ciphers
+const (
+	MAC_HMAC_SHA256 byte = iota
+	MAC_BLAKE2B
+	MAC_POLY1305
+)
+
+var macAlgorithmNames = map[byte]string{
+	MAC_HMAC_SHA256: "hmac-sha256",
+	MAC_BLAKE2B:     "blake2b",
+	MAC_POLY1305:    "poly1305",
+}
+
+// MACAlgorithmFromName returns the MAC algorithm called name; "" is the default, HMAC-SHA256
+func MACAlgorithmFromName(name string) (byte, error) {
+	if name == "" {
+		return MAC_HMAC_SHA256, nil
+	}
+	for algorithm, n := range macAlgorithmNames {
+		if n == name {
+			return algorithm, nil
+		}
+	}
+	return 0, errors.New("unknown MAC algorithm \"" + name + "\", should be hmac-sha256, blake2b or poly1305")
+}
+
+// MACAlgorithmName returns the name of a MAC algorithm, "unknown" if it is not one
+func MACAlgorithmName(algorithm byte) string {
+	if name, found := macAlgorithmNames[algorithm]; found {
+		return name
+	}
+	return "unknown"
+}
+
+// MACSize returns the size of the MACs of an algorithm
+func MACSize(algorithm byte) int {
+	if algorithm == MAC_POLY1305 {
+		return poly1305.TagSize
+	}
+	return sha256.Size
+}
+
+// ComputeMAC returns the MAC of message with the key of a slot, in round roundID
+func ComputeMAC(algorithm byte, key []byte, roundID int32, message []byte) []byte {
+	switch algorithm {
+	case MAC_BLAKE2B:
+		if len(key) > blake2b.Size {
+			k := sha256.Sum256(key)
+			key = k[:]
+		}
+		h, err := blake2b.New256(key)
+		if err != nil {
+			panic("ComputeMAC: " + err.Error())
+		}
+		h.Write(message)
+		return h.Sum(nil)
+	case MAC_POLY1305:
+		// a Poly1305 key authenticates a single message, hence one key per round
+		var roundKey [32]byte
+		copy(roundKey[:], poly1305RoundKey(key, roundID))
+		var tag [poly1305.TagSize]byte
+		poly1305.Sum(&tag, message, &roundKey)
+		return tag[:]
+	default:
+		h := hmac.New(sha256.New, key)
+		h.Write(message)
+		return h.Sum(nil)
+	}
+}
+
+// VerifyMAC returns true iff mac is the MAC of message with the key of a slot, in round roundID
+func VerifyMAC(algorithm byte, key []byte, roundID int32, message []byte, mac []byte) bool {
+	return subtle.ConstantTimeCompare(mac, ComputeMAC(algorithm, key, roundID, message)) == 1
+}
+
+// poly1305RoundKey derives the one-time Poly1305 key of round roundID from the key of a slot
+func poly1305RoundKey(key []byte, roundID int32) []byte {
+	label := make([]byte, 4)
+	binary.BigEndian.PutUint32(label, uint32(roundID))
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("poly1305"))
+	h.Write(label)
+	return h.Sum(nil)
+}
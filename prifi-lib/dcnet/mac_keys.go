@@ -0,0 +1,87 @@
+package dcnet
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"go.dedis.ch/kyber/v3"
+)
+
+/*
+The MAC of a slot is keyed with a secret which only the owner of the slot and the relay know : the Diffie-Hellman
+secret of the relay's key and of the ephemeral key of the slot. With the schedule, the relay sends its public key on
+the base of the shuffle, R = r*B; the owner of the slot computes x*R, and the relay r*(x*B) from the shuffled
+ephemeral key x*B of the slot. The relay thus knows the key of every slot without learning which client owns it. The
+key is derived anew for each epoch (each schedule), along with the ephemeral keys.
+*/
+
+// MAC_KEY_LABEL separates the derivation of the MAC keys from the other uses of the shared secrets
+const MAC_KEY_LABEL = "prifi-disruption-mac-key"
+
+// DeriveMACKey derives the MAC key of a slot, for epoch, from the secret its owner shares with the relay
+func DeriveMACKey(sharedSecret kyber.Point, epoch int32) ([]byte, error) {
+	secret, err := sharedSecret.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	epochBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(epochBytes, uint32(epoch))
+
+	h := sha256.New()
+	h.Write([]byte(MAC_KEY_LABEL))
+	h.Write(epochBytes)
+	h.Write(secret)
+	return h.Sum(nil), nil
+}
+
+// RotateMACKeys replaces the MAC keys by the ones of epoch, derived from the secrets shared with the relay, by slot.
+// A client gives the secrets of its slots, the relay the ones of every slot.
+func (e *DCNetEntity) RotateMACKeys(epoch int32, sharedSecrets map[int]kyber.Point) error {
+	keys := make(map[int][]byte, len(sharedSecrets))
+	for slot, secret := range sharedSecrets {
+		if secret == nil {
+			return errors.New("no shared secret for the MAC key of slot " + strconv.Itoa(slot))
+		}
+		key, err := DeriveMACKey(secret, epoch)
+		if err != nil {
+			return err
+		}
+		keys[slot] = key
+	}
+	e.macKeys = keys
+	e.macEpoch = epoch
+	dcnetLog.Lvl3("DC-net : MAC keys of", len(keys), "slots for epoch", epoch)
+	return nil
+}
+
+// MACEpoch returns the epoch of the current MAC keys
+func (e *DCNetEntity) MACEpoch() int32 {
+	return e.macEpoch
+}
+
+// HasMACKey returns true if the MAC key of slot is known
+func (e *DCNetEntity) HasMACKey(slot int) bool {
+	_, found := e.macKeys[slot]
+	return found
+}
+
+// SlotMAC returns the MAC of message in slot, in round roundID, with MACAlgorithm and the key of the slot
+func (e *DCNetEntity) SlotMAC(slot int, roundID int32, message []byte) ([]byte, error) {
+	key, found := e.macKeys[slot]
+	if !found {
+		return nil, errors.New("no MAC key for slot " + strconv.Itoa(slot))
+	}
+	return ComputeMAC(e.MACAlgorithm, key, roundID, message), nil
+}
+
+// VerifySlotMAC returns true iff mac is the MAC of message in slot, in round roundID, with algorithm; it is false if
+// the key of the slot is unknown
+func (e *DCNetEntity) VerifySlotMAC(algorithm byte, slot int, roundID int32, message []byte, mac []byte) bool {
+	key, found := e.macKeys[slot]
+	if !found {
+		return false
+	}
+	return VerifyMAC(algorithm, key, roundID, message, mac)
+}
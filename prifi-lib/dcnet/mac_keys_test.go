@@ -0,0 +1,78 @@
+package dcnet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+)
+
+func TestSlotMACKeys(t *testing.T) {
+	suite := config.CryptoSuite
+	rand := suite.XOF([]byte("MACKeys"))
+	base := suite.Point().Mul(suite.Scalar().Pick(rand), nil) // the base of the shuffle
+	relayPriv := suite.Scalar().Pick(rand)
+	relayPk := suite.Point().Mul(relayPriv, base)
+
+	// the ephemeral keys of two slots, on the base of the shuffle
+	ephPrivs := []kyber.Scalar{suite.Scalar().Pick(rand), suite.Scalar().Pick(rand)}
+	ephPks := make([]kyber.Point, len(ephPrivs))
+	for i := range ephPrivs {
+		ephPks[i] = suite.Point().Mul(ephPrivs[i], base)
+	}
+
+	relay := NewDCNetEntity(0, DCNET_RELAY, 100, false, nil)
+	relaySecrets := make(map[int]kyber.Point)
+	for slot, pk := range ephPks {
+		relaySecrets[slot] = suite.Point().Mul(relayPriv, pk)
+	}
+	if err := relay.RotateMACKeys(3, relaySecrets); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner of slot 1 only knows the key of its slot, which is the one of the relay
+	client := NewDCNetEntity(0, DCNET_CLIENT, 100, false, nil)
+	client.MACAlgorithm = MAC_BLAKE2B
+	if err := client.RotateMACKeys(3, map[int]kyber.Point{1: suite.Point().Mul(ephPrivs[1], relayPk)}); err != nil {
+		t.Fatal(err)
+	}
+	if client.MACEpoch() != 3 || !client.HasMACKey(1) || client.HasMACKey(0) {
+		t.Error("The client should have the key of slot 1 only, for epoch 3")
+	}
+
+	message := randomBytes(100)
+	mac, err := client.SlotMAC(1, 7, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !relay.VerifySlotMAC(MAC_BLAKE2B, 1, 7, message, mac) {
+		t.Error("The relay should verify the MAC of the owner of slot 1")
+	}
+	if relay.VerifySlotMAC(MAC_BLAKE2B, 0, 7, message, mac) {
+		t.Error("The MAC of slot 1 should not verify in slot 0")
+	}
+	if relay.VerifySlotMAC(MAC_BLAKE2B, 2, 7, message, mac) {
+		t.Error("Nothing should verify in a slot without a key")
+	}
+	if _, err := client.SlotMAC(0, 7, message); err == nil {
+		t.Error("The client should not compute the MAC of a slot it does not own")
+	}
+
+	// the keys change with the epoch
+	if err := relay.RotateMACKeys(4, relaySecrets); err != nil {
+		t.Fatal(err)
+	}
+	if relay.VerifySlotMAC(MAC_BLAKE2B, 1, 7, message, mac) {
+		t.Error("The MAC of epoch 3 should not verify in epoch 4")
+	}
+	key3, _ := DeriveMACKey(relaySecrets[1], 3)
+	key4, _ := DeriveMACKey(relaySecrets[1], 4)
+	if bytes.Equal(key3, key4) {
+		t.Error("The MAC keys of two epochs should differ")
+	}
+
+	if err := relay.RotateMACKeys(5, map[int]kyber.Point{0: nil}); err == nil {
+		t.Error("Should not derive a key without a secret")
+	}
+}
@@ -0,0 +1,64 @@
+package dcnet
+
+import (
+	"testing"
+)
+
+func TestMACAlgorithms(t *testing.T) {
+	if a, err := MACAlgorithmFromName(""); err != nil || a != MAC_HMAC_SHA256 {
+		t.Error("The default MAC should be HMAC-SHA256")
+	}
+	if _, err := MACAlgorithmFromName("md5"); err == nil {
+		t.Error("Should not accept an unknown MAC algorithm")
+	}
+
+	key := []byte("client-secret3")
+	message := randomBytes(1000)
+	for _, name := range []string{"hmac-sha256", "blake2b", "poly1305"} {
+		a, err := MACAlgorithmFromName(name)
+		if err != nil || MACAlgorithmName(a) != name {
+			t.Error("Could not parse", name)
+		}
+		mac := ComputeMAC(a, key, 7, message)
+		if len(mac) != MACSize(a) {
+			t.Error(name, ": the MAC should be", MACSize(a), "bytes, is", len(mac))
+		}
+		if !VerifyMAC(a, key, 7, message, mac) {
+			t.Error(name, ": the MAC should verify")
+		}
+		if VerifyMAC(a, []byte("client-secret4"), 7, message, mac) {
+			t.Error(name, ": the MAC should not verify with another key")
+		}
+		tampered := append([]byte{}, message...)
+		tampered[500] ^= 1
+		if VerifyMAC(a, key, 7, tampered, mac) {
+			t.Error(name, ": the MAC should not verify a modified message")
+		}
+	}
+
+	if VerifyMAC(MAC_POLY1305, key, 8, message, ComputeMAC(MAC_POLY1305, key, 7, message)) {
+		t.Error("Poly1305 should use a different key in each round")
+	}
+}
+
+func TestDecodedMACAlgorithm(t *testing.T) {
+	relay := NewDCNetEntity(0, DCNET_RELAY, 100, false, nil)
+	header := func(algorithm byte) []byte {
+		c := DCNetCipher{Payload: make([]byte, 100), MACAlgorithm: algorithm}
+		return c.ToBytes()
+	}
+
+	relay.DecodeStart(0)
+	relay.DecodeClient(0, header(MAC_BLAKE2B))
+	relay.DecodeClient(0, header(MAC_BLAKE2B))
+	if a, agreed := relay.DecodedMACAlgorithm(); a != MAC_BLAKE2B || !agreed {
+		t.Error("The relay should see the MAC algorithm announced by all the clients")
+	}
+
+	relay.DecodeStart(1)
+	relay.DecodeClient(1, header(MAC_BLAKE2B))
+	relay.DecodeClient(1, header(MAC_POLY1305))
+	if _, agreed := relay.DecodedMACAlgorithm(); agreed {
+		t.Error("The relay should see that the clients announced different MAC algorithms")
+	}
+}
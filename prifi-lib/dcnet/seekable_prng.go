@@ -0,0 +1,97 @@
+package dcnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"go.dedis.ch/kyber/v3"
+)
+
+// SeekableXOF is a PRNG that can jump to any position of its stream without generating the material in between
+type SeekableXOF interface {
+	kyber.XOF
+
+	// Seek moves to the given byte offset of the stream
+	Seek(offset uint64)
+
+	// Position returns the current byte offset in the stream
+	Position() uint64
+}
+
+// ctrXOF is a SeekableXOF based on AES-256 in counter mode. The key is the SHA-256 of the seed (and of the data
+// written before the first read), the byte at offset o is in the counter block o/16, so seeking is O(1)
+type ctrXOF struct {
+	key    [32]byte
+	offset uint64
+	stream cipher.Stream
+}
+
+// NewSeekableXOF creates a SeekableXOF seeded with seed
+func NewSeekableXOF(seed []byte) SeekableXOF {
+	x := &ctrXOF{key: sha256.Sum256(seed)}
+	x.Seek(0)
+	return x
+}
+
+// Seek implements SeekableXOF
+func (x *ctrXOF) Seek(offset uint64) {
+	block, err := aes.NewCipher(x.key[:])
+	if err != nil {
+		panic("dcnet: cannot create AES cipher: " + err.Error())
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], offset/aes.BlockSize)
+	x.stream = cipher.NewCTR(block, iv)
+	x.offset = offset - offset%aes.BlockSize
+
+	// discard the beginning of the block
+	skip := make([]byte, offset%aes.BlockSize)
+	x.XORKeyStream(skip, skip)
+}
+
+// Position implements SeekableXOF
+func (x *ctrXOF) Position() uint64 {
+	return x.offset
+}
+
+// Write absorbs data into the key. Like the other XOFs, it panics if called after Read (use Reseed first)
+func (x *ctrXOF) Write(data []byte) (int, error) {
+	if x.offset != 0 {
+		panic("dcnet: Write called after Read on a seekable XOF")
+	}
+	x.key = sha256.Sum256(append(x.key[:], data...))
+	x.Seek(0)
+	return len(data), nil
+}
+
+// Read implements io.Reader
+func (x *ctrXOF) Read(dst []byte) (int, error) {
+	for i := range dst {
+		dst[i] = 0
+	}
+	x.XORKeyStream(dst, dst)
+	return len(dst), nil
+}
+
+// XORKeyStream implements cipher.Stream
+func (x *ctrXOF) XORKeyStream(dst, src []byte) {
+	x.stream.XORKeyStream(dst, src)
+	x.offset += uint64(len(src))
+}
+
+// Reseed implements kyber.XOF
+func (x *ctrXOF) Reseed() {
+	newKey := make([]byte, 32)
+	x.Read(newKey)
+	copy(x.key[:], newKey)
+	x.Seek(0)
+}
+
+// Clone implements kyber.XOF
+func (x *ctrXOF) Clone() kyber.XOF {
+	c := &ctrXOF{key: x.key}
+	c.Seek(x.offset)
+	return c
+}
@@ -0,0 +1,19 @@
+package dcnet
+
+/*
+The DC-net spends most of its time XORing pads into the ciphers. On the platforms which load unaligned machine words
+cheaply (amd64, arm64, ...), xorBytes XORs a word at a time (xor_words.go); everywhere else (arm32, wasm, mips, ...),
+or when built with the "purego" tag, it uses the plain byte loop below (xor_purego.go). Both produce the same bytes, so
+entities built for different platforms can be part of the same DC-net.
+
+The "purego" tag also selects the pure-Go code of the standard library and of golang.org/x/crypto (AES, BLAKE2, ...),
+which are used by the PRNGs of the DC-net :
+	go build -tags purego ./...
+*/
+
+// xorBytesGeneric sets dst[i] ^= src[i] for i < len(src); dst must be at least as long as src
+func xorBytesGeneric(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(amd64 || arm64 || 386 || ppc64le || s390x || riscv64) || purego
+// +build !amd64,!arm64,!386,!ppc64le,!s390x,!riscv64 purego
+
+package dcnet
+
+// XOR_WORDS_AVAILABLE is true if xorBytes XORs a machine word at a time
+const XOR_WORDS_AVAILABLE = false
+
+// xorBytes sets dst[i] ^= src[i] for i < len(src); dst must be at least as long as src
+func xorBytes(dst, src []byte) {
+	xorBytesGeneric(dst, src)
+}
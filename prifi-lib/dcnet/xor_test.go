@@ -0,0 +1,57 @@
+package dcnet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func TestXorBytesMatchesGeneric(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buf := make([]byte, 300)
+	for length := 0; length < 100; length++ {
+		// unaligned slices too
+		for offset := 0; offset < 9; offset++ {
+			r.Read(buf)
+			src := buf[offset : offset+length]
+			dst := append([]byte{}, buf[150+offset:150+offset+length+offset]...)
+			expected := append([]byte{}, dst...)
+
+			xorBytes(dst, src)
+			xorBytesGeneric(expected, src)
+			if !bytes.Equal(dst, expected) {
+				t.Fatal("xorBytes and xorBytesGeneric differ for length", length, "offset", offset, "words", XOR_WORDS_AVAILABLE)
+			}
+		}
+	}
+}
+
+// The ciphers must be the same on every platform, whether the word-wise XOR or the pure-Go fallback is used : this
+// test passes with "go test", "go test -tags purego", and e.g. GOARCH=386 or GOARCH=arm. The clients' ciphers with the
+// equivocation protection are randomized, so only those of the trustees are compared then.
+func TestDCNetKnownAnswer(t *testing.T) {
+	expected := map[bool]string{
+		false: "602efa5957424f9a1ea4ec47f38cfdea47c232d9ce349c3a564e67aeb9c5aa09",
+		true:  "d6a188573c3cb11889e067c142b7d465ba47aff4bb708786c4657e8767a003ff",
+	}
+	for _, equivocation := range []bool{false, true} {
+		tg := NewTestGroup(t, equivocation, 1000, 2, 2)
+		h := sha256.New()
+		for roundID := int32(0); roundID < 5; roundID++ {
+			for _, c := range tg.Clients {
+				m, _ := c.DCNetEntity.EncodeForRound(roundID, c == tg.Clients[0], []byte("known answer"))
+				if !equivocation {
+					h.Write(m)
+				}
+			}
+			for _, tr := range tg.Trustees {
+				h.Write(tr.DCNetEntity.TrusteeEncodeForRound(roundID))
+			}
+		}
+		if digest := hex.EncodeToString(h.Sum(nil)); digest != expected[equivocation] {
+			t.Error("wrong ciphers with equivocation =", equivocation, "word-wise XOR =", XOR_WORDS_AVAILABLE, ":", digest)
+		}
+	}
+}
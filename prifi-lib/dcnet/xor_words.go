@@ -0,0 +1,32 @@
+//go:build (amd64 || arm64 || 386 || ppc64le || s390x || riscv64) && !purego
+// +build amd64 arm64 386 ppc64le s390x riscv64
+// +build !purego
+
+package dcnet
+
+import "unsafe"
+
+// XOR_WORDS_AVAILABLE is true if xorBytes XORs a machine word at a time
+const XOR_WORDS_AVAILABLE = true
+
+const wordSize = int(unsafe.Sizeof(uintptr(0)))
+
+// xorBytes sets dst[i] ^= src[i] for i < len(src); dst must be at least as long as src
+func xorBytes(dst, src []byte) {
+	n := len(src)
+	if n == 0 {
+		return
+	}
+	_ = dst[n-1]
+	words := n / wordSize
+	if words > 0 {
+		dw := (*[1 << 28]uintptr)(unsafe.Pointer(&dst[0]))[:words:words]
+		sw := (*[1 << 28]uintptr)(unsafe.Pointer(&src[0]))[:words:words]
+		for i := range sw {
+			dw[i] ^= sw[i]
+		}
+	}
+	for i := words * wordSize; i < n; i++ {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Package localnet runs a complete PriFi network in one process : a relay, its trustees, and its clients, each client
+with a SOCKS server. The nodes talk over the standalone transport on the loopback interface, and the relay forwards the
+decoded streams to a SOCKS5 exit, which is started in the process too unless ExitAddress is given. It is meant for
+demos, tutorials and tests, e.g.
+
+	network, err := localnet.Start(localnet.Config{Clients: 2})
+	if err != nil {
+		return err
+	}
+	defer network.Stop()
+	network.WaitForRounds(10, 30*time.Second)
+	// point a browser or curl --socks5 to network.SocksAddress(0)
+
+There is no UDP broadcast, and the parameters are the ones of DefaultToml, with Toml applied over them. The nodes share
+the crypto suite of the process : Start sets it to the CryptoSuite of Toml (Ed25519 by default).
+*/
+package localnet
+
+import (
+	"errors"
+	gonet "net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/standalone"
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DefaultToml is the prifi.toml of the network : a DC-net without protections, which sends downstream only the data
+// of the streams, and never stops on its own
+const DefaultToml = `
+PayloadSize = 1000
+CellSizeDown = 10000
+RelayWindowSize = 2
+RelayReportingLimit = -1
+DCNetType = "Simple"
+RelayUseDummyDataDown = false
+DisruptionProtectionEnabled = false
+EquivocationProtectionEnabled = false
+RelayRoundTimeOut = 5000
+RelayMaxNumberOfConsecutiveFailedRounds = 3
+RelayTrusteeCacheLowBound = 10
+RelayTrusteeCacheHighBound = 20
+`
+
+// CONNECT_TIMEOUT is how long the clients and the trustees wait for the relay to accept their connection
+const CONNECT_TIMEOUT = 5 * time.Second
+
+// Config describes the network to start; the zero value is a network of one client and one trustee
+type Config struct {
+	// the number of clients and trustees, 1 if <= 0
+	Clients  int
+	Trustees int
+
+	// the prifi.toml parameters which replace the ones of DefaultToml, e.g. "RelayWindowSize = 5"
+	Toml string
+
+	// the SOCKS server of client i listens on 127.0.0.1:SocksBasePort+i; if 0, on free ports (see SocksAddress)
+	SocksBasePort int
+
+	// the SOCKS5 server the relay forwards the streams to; if empty, one is started in the process
+	ExitAddress string
+
+	// the address the relay listens on, "127.0.0.1:0" (a free port) if empty
+	RelayAddress string
+
+	// for the tests, the faults injected in the messages received by the relay, and by client or trustee i (see
+	// net.FaultInjector); nil, or a missing entry, delivers everything
+	RelayFaults   *net.FaultInjector
+	ClientFaults  []*net.FaultInjector
+	TrusteeFaults []*net.FaultInjector
+}
+
+// Network is a running PriFi network
+type Network struct {
+	sync.Mutex
+
+	Relay    *prifi_lib.PriFiLibInstance
+	Clients  []*prifi_lib.PriFiLibInstance
+	Trustees []*prifi_lib.PriFiLibInstance
+
+	// the experiment results of the relay, e.g. when RelayReportingLimit is reached
+	Results chan interface{}
+
+	relayTransport *standalone.RelayTransport
+	nodeTransports []*standalone.NodeTransport
+	socksServers   []*stream_multiplexer.IngressServer
+	egressStop     chan bool
+	exitListener   gonet.Listener
+	exitAddress    string
+	stopped        bool
+}
+
+// Start starts the relay, the trustees and the clients, and returns once the relay started the protocol
+func Start(config Config) (*Network, error) {
+	nClients, nTrustees := config.Clients, config.Trustees
+	if nClients <= 0 {
+		nClients = 1
+	}
+	if nTrustees <= 0 {
+		nTrustees = 1
+	}
+	tomlConfig, err := tomlWithDefaults(config.Toml)
+	if err != nil {
+		return nil, err
+	}
+	if err := standalone.ApplyCryptoSuite(tomlConfig); err != nil {
+		return nil, err
+	}
+	params, err := standalone.RelayParameters(tomlConfig, nClients, nTrustees)
+	if err != nil {
+		return nil, err
+	}
+	payloadSize := standalone.IntOrElse(tomlConfig, "PayloadSize", 1000)
+	failureMode, err := stream_multiplexer.ParseFailureMode(standalone.StringOrElse(tomlConfig, "ClientSocksFailureMode", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Network{
+		Results:    make(chan interface{}, 100),
+		egressStop: make(chan bool, 1),
+	}
+	if err := n.startExit(config.ExitAddress); err != nil {
+		return nil, err
+	}
+
+	// the relay, and its egress towards the exit
+	relayAddress := config.RelayAddress
+	if relayAddress == "" {
+		relayAddress = "127.0.0.1:0"
+	}
+	if n.relayTransport, err = standalone.NewRelayTransport(relayAddress); err != nil {
+		n.Stop()
+		return nil, err
+	}
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte)
+	go stream_multiplexer.StartEgressHandler(n.exitAddress, payloadSize, upstreamChan, downstreamChan, n.egressStop, false)
+	timeoutHandler := func(clients, trustees []int) {
+		log.Error("Localnet : round timed out, missing clients", clients, "and trustees", trustees)
+	}
+	n.Relay = prifi_lib.NewPriFiRelay(true, downstreamChan, upstreamChan, n.Results, timeoutHandler, n.relayTransport)
+	n.Relay.SetFaultInjectors(config.RelayFaults, nil)
+	go n.relayTransport.Serve(n.Relay.ReceivedMessage)
+
+	for i := 0; i < nTrustees; i++ {
+		transport, err := n.dialRelay(standalone.TRUSTEE, i)
+		if err != nil {
+			n.Stop()
+			return nil, err
+		}
+		trustee := prifi_lib.NewPriFiTrustee(false, false, 0, 0, transport)
+		trustee.SetFaultInjectors(faultsOf(config.TrusteeFaults, i), nil)
+		n.Trustees = append(n.Trustees, trustee)
+		go transport.Serve(trustee.ReceivedMessage)
+	}
+
+	for i := 0; i < nClients; i++ {
+		port := 0
+		if config.SocksBasePort > 0 {
+			port = config.SocksBasePort + i
+		}
+		upstreamChan := make(chan []byte)
+		downstreamChan := make(chan []byte)
+		transport, err := n.dialRelay(standalone.CLIENT, i)
+		if err != nil {
+			n.Stop()
+			return nil, err
+		}
+		client := prifi_lib.NewPriFiClient(false, false, true, upstreamChan, downstreamChan, false, "", "", 1, "", 0, 0, transport)
+		client.SetFaultInjectors(faultsOf(config.ClientFaults, i), nil)
+		n.Clients = append(n.Clients, client)
+
+		options := stream_multiplexer.IngressOptions{ListenAddress: "127.0.0.1", FailureMode: failureMode, DCNetUp: client.DCNetUp}
+		socksServer, err := stream_multiplexer.ListenIngressServer(port, payloadSize, options, upstreamChan, downstreamChan, make(chan bool, 1), false)
+		if err != nil {
+			n.Stop()
+			return nil, err
+		}
+		n.socksServers = append(n.socksServers, socksServer)
+		go socksServer.Serve()
+		go transport.Serve(client.ReceivedMessage)
+	}
+
+	n.relayTransport.WaitForNodes(nClients, nTrustees)
+	if err := n.Relay.ReceivedMessage(*params); err != nil {
+		n.Stop()
+		return nil, err
+	}
+	log.Lvl2("Localnet : relay on", n.relayTransport.Addr(), "with", nClients, "clients and", nTrustees, "trustees, exit on", n.exitAddress)
+	return n, nil
+}
+
+// tomlWithDefaults parses DefaultToml, and replaces its parameters by the ones of extra
+func tomlWithDefaults(extra string) (map[string]interface{}, error) {
+	tomlConfig, err := standalone.ParseToml(DefaultToml)
+	if err != nil {
+		return nil, err
+	}
+	extraConfig, err := standalone.ParseToml(extra)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extraConfig {
+		tomlConfig[k] = v
+	}
+	return tomlConfig, nil
+}
+
+// faultsOf returns the fault injector of node i, nil if there is none
+func faultsOf(faults []*net.FaultInjector, i int) *net.FaultInjector {
+	if i < len(faults) {
+		return faults[i]
+	}
+	return nil
+}
+
+// startExit starts a SOCKS5 server on a free port of the loopback interface, unless the exit is given
+func (n *Network) startExit(exitAddress string) error {
+	if exitAddress != "" {
+		n.exitAddress = exitAddress
+		return nil
+	}
+	server, err := socks5.New(&socks5.Config{})
+	if err != nil {
+		return err
+	}
+	listener, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	n.exitListener = listener
+	n.exitAddress = listener.Addr().String()
+	go server.Serve(listener)
+	return nil
+}
+
+// dialRelay connects a node to the relay, and keeps its transport to close it in Stop()
+func (n *Network) dialRelay(role standalone.Role, id int) (*standalone.NodeTransport, error) {
+	transport, err := standalone.DialRelay(n.relayTransport.Addr().String(), role, id, CONNECT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	n.nodeTransports = append(n.nodeTransports, transport)
+	return transport, nil
+}
+
+// RelayAddress returns the address the relay listens on
+func (n *Network) RelayAddress() string {
+	return n.relayTransport.Addr().String()
+}
+
+// SocksAddress returns the address of the SOCKS server of client i, e.g. "127.0.0.1:8080"
+func (n *Network) SocksAddress(i int) string {
+	return "127.0.0.1:" + strconv.Itoa(n.socksServers[i].Port())
+}
+
+// ExitAddress returns the address of the SOCKS5 server the relay forwards the streams to
+func (n *Network) ExitAddress() string {
+	return n.exitAddress
+}
+
+// WaitForRounds waits until every client did at least the given number of rounds
+func (n *Network) WaitForRounds(rounds int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, client := range n.Clients {
+		for client.ShutdownReport().Rounds < rounds {
+			if time.Now().After(deadline) {
+				return errors.New("the clients did not do " + strconv.FormatInt(rounds, 10) + " rounds in " + timeout.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Stop shuts the nodes down, and closes the connections and the SOCKS servers
+func (n *Network) Stop() {
+	n.Lock()
+	defer n.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+
+	for _, instance := range append(append([]*prifi_lib.PriFiLibInstance{n.Relay}, n.Clients...), n.Trustees...) {
+		if instance != nil {
+			instance.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+		}
+	}
+	for _, transport := range n.nodeTransports {
+		transport.Close()
+	}
+	if n.relayTransport != nil {
+		n.relayTransport.Close()
+	}
+	for _, socksServer := range n.socksServers {
+		socksServer.Stop()
+	}
+	n.egressStop <- true
+	if n.exitListener != nil {
+		n.exitListener.Close()
+	}
+}
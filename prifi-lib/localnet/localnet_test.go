@@ -0,0 +1,158 @@
+package localnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	gonet "net"
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+// socks5Connect opens a connection to target through the SOCKS5 server at proxy, without authentication
+func socks5Connect(proxy string, target *gonet.TCPAddr) (gonet.Conn, error) {
+	conn, err := gonet.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, target.IP.To4()...)
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(target.Port))
+	request = append(request, port...)
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the method selection (2 bytes), then the reply to the CONNECT with an IPv4 address (10 bytes)
+	answer := make([]byte, 12)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer[1] != 0 || answer[3] != 0 {
+		conn.Close()
+		return nil, io.ErrUnexpectedEOF
+	}
+	return conn, nil
+}
+
+func TestLocalNetwork(t *testing.T) {
+	network, err := Start(Config{Clients: 2, Toml: "RelayWindowSize = 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.Stop()
+
+	if len(network.Clients) != 2 || len(network.Trustees) != 1 {
+		t.Error("The network should have 2 clients and 1 trustee")
+	}
+	if err := network.WaitForRounds(5, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// an echo server, reached through the SOCKS server of a client, the DC-net and the exit
+	echo, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := socks5Connect(network.SocksAddress(1), echo.Addr().(*gonet.TCPAddr))
+	if err != nil {
+		t.Fatal("Could not connect through the SOCKS server of client 1,", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	message := []byte("hello through the DC-net")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(answer, message) {
+		t.Error("The echo server answered", string(answer))
+	}
+
+	network.Stop()
+	network.Stop()
+}
+
+func TestTomlWithDefaults(t *testing.T) {
+	tomlConfig, err := tomlWithDefaults("RelayWindowSize = 5\nRelayDecodeWorkers = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tomlConfig["RelayWindowSize"] != int64(5) || tomlConfig["RelayDecodeWorkers"] != int64(2) ||
+		tomlConfig["PayloadSize"] != int64(1000) {
+		t.Error("The parameters should replace the defaults, got", tomlConfig)
+	}
+	if _, err := tomlWithDefaults("RelayWindowSize = "); err == nil {
+		t.Error("An invalid prifi.toml should be refused")
+	}
+}
+
+func TestLocalNetworkFaults(t *testing.T) {
+	// client 1 never receives the downstream data of round 6, hence never answers it : the relay has to close the
+	// round after its timeout, and client 1 skips to round 7. The cipher of trustee 0 for round 9 arrives late.
+	clientFaults := net.NewFaultInjector()
+	clientFaults.Drop(net.REL_CLI_DOWNSTREAM_DATA{}, 6)
+	relayFaults := net.NewFaultInjector()
+	relayFaults.Delay(net.TRU_REL_DC_CIPHER{}, 9, 50*time.Millisecond)
+
+	network, err := Start(Config{
+		Clients:      2,
+		Toml:         "RelayWindowSize = 1\nRelayRoundTimeOut = 300",
+		RelayFaults:  relayFaults,
+		ClientFaults: []*net.FaultInjector{nil, clientFaults},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.Stop()
+
+	if err := network.WaitForRounds(12, 30*time.Second); err != nil {
+		t.Fatal("The rounds should continue after the timeout,", err)
+	}
+	if clientFaults.Injected(net.FAULT_DROP) != 1 || relayFaults.Injected(net.FAULT_DELAY) != 1 {
+		t.Error("The faults were not injected")
+	}
+}
+
+func TestLocalNetworkCryptoSuites(t *testing.T) {
+	// the suite is the one of the process, the next networks are back to Ed25519
+	defer config.SetCryptoSuite(config.DEFAULT_CRYPTO_SUITE)
+
+	for _, suite := range []string{"P256", "Curve25519"} {
+		network, err := Start(Config{Clients: 2, Toml: "RelayWindowSize = 1\nCryptoSuite = \"" + suite + "\""})
+		if err != nil {
+			t.Fatal(suite, err)
+		}
+		if config.CryptoSuiteName() != suite {
+			t.Error("The network should use", suite, "not", config.CryptoSuiteName())
+		}
+		err = network.WaitForRounds(5, 30*time.Second)
+		network.Stop()
+		if err != nil {
+			t.Fatal(suite, err)
+		}
+	}
+
+	if _, err := Start(Config{Toml: "CryptoSuite = \"secp256k1\""}); err == nil {
+		t.Error("An unknown suite should be refused")
+	}
+}
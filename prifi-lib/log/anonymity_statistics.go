@@ -0,0 +1,132 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// SlotAnonymity is the effective anonymity set of the owner of a slot : the number of clients which took part in every
+// round of the epoch where this slot carried data. Any of them can be the sender; the others are ruled out, since a
+// client which did not send its cipher cannot have sent the data.
+type SlotAnonymity struct {
+	Slot         int
+	DataRounds   int // rounds of the epoch where the slot carried data
+	AnonymitySet int
+}
+
+// slotParticipants is the intersection of the participants of the rounds where a slot carried data
+type slotParticipants struct {
+	dataRounds   int
+	lastRound    int32 // to count a super-round once
+	participants map[int]bool
+	warned       bool
+}
+
+// AnonymityStatistics computes, for each slot of the epoch, the effective anonymity set of its owner, from which clients
+// actually sent their cipher in the rounds where data appeared in this slot. With partial participation (clients
+// leaving, or missing rounds), this set can be much smaller than the number of clients of the epoch. It is safe to use
+// from several goroutines, since it is exported by the metrics endpoint.
+type AnonymityStatistics struct {
+	sync.Mutex
+	threshold int
+	slots     map[int]*slotParticipants
+}
+
+// NewAnonymityStatistics creates an AnonymityStatistics which warns when a set drops below threshold (0 never warns)
+func NewAnonymityStatistics(threshold int) *AnonymityStatistics {
+	return &AnonymityStatistics{
+		threshold: threshold,
+		slots:     make(map[int]*slotParticipants),
+	}
+}
+
+// NewEpoch forgets the sets of the previous epoch (the slots are shuffled again), and sets the threshold
+func (a *AnonymityStatistics) NewEpoch(threshold int) {
+	a.Lock()
+	defer a.Unlock()
+	a.threshold = threshold
+	a.slots = make(map[int]*slotParticipants)
+}
+
+// AddDataRound records that slot carried data in roundID, which the given clients took part in. It returns the new
+// anonymity set of the slot, and true the first time in the epoch it is below the threshold.
+func (a *AnonymityStatistics) AddDataRound(roundID int32, slot int, participants []int) (SlotAnonymity, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	s, found := a.slots[slot]
+	if !found {
+		s = &slotParticipants{lastRound: -1, participants: make(map[int]bool)}
+		for _, c := range participants {
+			s.participants[c] = true
+		}
+		a.slots[slot] = s
+	} else {
+		inRound := make(map[int]bool)
+		for _, c := range participants {
+			inRound[c] = true
+		}
+		for c := range s.participants {
+			if !inRound[c] {
+				delete(s.participants, c)
+			}
+		}
+	}
+	if s.lastRound != roundID || !found {
+		s.dataRounds++
+		s.lastRound = roundID
+	}
+
+	res := SlotAnonymity{Slot: slot, DataRounds: s.dataRounds, AnonymitySet: len(s.participants)}
+	if a.threshold > 0 && res.AnonymitySet < a.threshold && !s.warned {
+		s.warned = true
+		return res, true
+	}
+	return res, false
+}
+
+// Slots returns the anonymity set of each slot which carried data in this epoch, by slot
+func (a *AnonymityStatistics) Slots() []SlotAnonymity {
+	a.Lock()
+	defer a.Unlock()
+	res := make([]SlotAnonymity, 0, len(a.slots))
+	for slot, s := range a.slots {
+		res = append(res, SlotAnonymity{Slot: slot, DataRounds: s.dataRounds, AnonymitySet: len(s.participants)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Slot < res[j].Slot })
+	return res
+}
+
+// Smallest returns the slot with the smallest anonymity set of this epoch, and false if no slot carried data
+func (a *AnonymityStatistics) Smallest() (SlotAnonymity, bool) {
+	slots := a.Slots()
+	if len(slots) == 0 {
+		return SlotAnonymity{}, false
+	}
+	smallest := slots[0]
+	for _, s := range slots[1:] {
+		if s.AnonymitySet < smallest.AnonymitySet {
+			smallest = s
+		}
+	}
+	return smallest, true
+}
+
+// WritePrometheus writes the anonymity set of each active slot, and the smallest one, in the Prometheus text format
+func (a *AnonymityStatistics) WritePrometheus(w io.Writer, prefix string) error {
+	slots := a.Slots()
+	_, err := fmt.Fprintf(w, "# TYPE %s_slot_anonymity_set gauge\n", prefix)
+	for _, s := range slots {
+		fmt.Fprintf(w, "%s_slot_anonymity_set{slot=\"%v\"} %v\n", prefix, s.Slot, s.AnonymitySet)
+	}
+	fmt.Fprintf(w, "# TYPE %s_slot_data_rounds gauge\n", prefix)
+	for _, s := range slots {
+		fmt.Fprintf(w, "%s_slot_data_rounds{slot=\"%v\"} %v\n", prefix, s.Slot, s.DataRounds)
+	}
+	if smallest, ok := a.Smallest(); ok {
+		fmt.Fprintf(w, "# TYPE %s_min_anonymity_set gauge\n%s_min_anonymity_set %v\n", prefix, prefix, smallest.AnonymitySet)
+	}
+	return err
+}
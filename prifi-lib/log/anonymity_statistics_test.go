@@ -0,0 +1,56 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAnonymityStatistics(t *testing.T) {
+	stats := NewAnonymityStatistics(3)
+
+	// slot 0 carried data with everyone, then with clients 0, 1 and 3
+	if s, below := stats.AddDataRound(1, 0, []int{0, 1, 2, 3}); s.AnonymitySet != 4 || below {
+		t.Error("Wrong anonymity set", s, below)
+	}
+	if s, below := stats.AddDataRound(2, 0, []int{0, 1, 3}); s.AnonymitySet != 3 || s.DataRounds != 2 || below {
+		t.Error("Wrong anonymity set", s, below)
+	}
+	// the other cells of the same super-round are not another round
+	if s, _ := stats.AddDataRound(2, 0, []int{0, 1, 3}); s.DataRounds != 2 {
+		t.Error("A super-round should be counted once", s)
+	}
+	// client 0 missed a round, only 1 and 3 can be the sender; the warning is given once
+	if s, below := stats.AddDataRound(3, 0, []int{1, 2, 3}); s.AnonymitySet != 2 || !below {
+		t.Error("The set should be below the threshold", s, below)
+	}
+	if _, below := stats.AddDataRound(4, 0, []int{1, 3}); below {
+		t.Error("The warning should be given once per slot")
+	}
+	stats.AddDataRound(4, 1, []int{0, 1, 2})
+
+	slots := stats.Slots()
+	if len(slots) != 2 || slots[0].Slot != 0 || slots[0].AnonymitySet != 2 || slots[1].AnonymitySet != 3 {
+		t.Error("Wrong slots", slots)
+	}
+	if smallest, ok := stats.Smallest(); !ok || smallest.Slot != 0 {
+		t.Error("Wrong smallest set", smallest, ok)
+	}
+
+	var b bytes.Buffer
+	stats.WritePrometheus(&b, "prifi_relay")
+	for _, expected := range []string{`prifi_relay_slot_anonymity_set{slot="1"} 3`, `prifi_relay_slot_data_rounds{slot="0"} 4`, "prifi_relay_min_anonymity_set 2"} {
+		if !strings.Contains(b.String(), expected) {
+			t.Error("The metrics should contain", expected, ":", b.String())
+		}
+	}
+
+	// the slots are shuffled again in the next epoch
+	stats.NewEpoch(0)
+	if _, ok := stats.Smallest(); ok {
+		t.Error("The sets should be reset")
+	}
+	if _, below := stats.AddDataRound(1, 0, []int{2}); below {
+		t.Error("A threshold of 0 should never warn")
+	}
+}
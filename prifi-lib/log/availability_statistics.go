@@ -0,0 +1,255 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CLIENT and TRUSTEE are the kinds of entities whose availability is tracked
+const (
+	CLIENT  = "client"
+	TRUSTEE = "trustee"
+)
+
+// RELIABILITY_EWMA_ALPHA is the weight of the last round in the reliability score of an entity
+const RELIABILITY_EWMA_ALPHA = 0.05
+
+// RELIABILITY_MIN_DEADLINE_FACTOR is the fraction of the round timeout given to an entity whose score is 0; an entity
+// whose score is 1 gets the whole timeout
+const RELIABILITY_MIN_DEADLINE_FACTOR = 0.25
+
+// EntityAvailability is the availability of one client or trustee
+type EntityAvailability struct {
+	Kind     string
+	ID       int
+	Rounds   int64     // number of rounds in which a cipher was expected from this entity
+	Missed   int64     // number of those rounds which timed out without this entity's cipher
+	MissRate float64   // Missed / Rounds
+	Score    float64   // exponentially weighted rate of the rounds in which its cipher came on time, starts at 1
+	LastSeen time.Time // time of the last cipher received from this entity, zero if never
+}
+
+// StalledRoundDiagnostic describes a round that timed out, and the entities responsible for it
+type StalledRoundDiagnostic struct {
+	RoundID                 int32
+	Time                    time.Time
+	ConsecutiveFailedRounds int
+	MissingClients          []EntityAvailability
+	MissingTrustees         []EntityAvailability
+}
+
+type entityKey struct {
+	kind string
+	id   int
+}
+
+// AvailabilityStatistics tracks, for each client and trustee, how many rounds it missed and when it was last seen,
+// and keeps the diagnostics of the last stalled rounds. It is safe to use from several goroutines.
+type AvailabilityStatistics struct {
+	sync.Mutex
+	entities       map[entityKey]*EntityAvailability
+	stalledRounds  int64
+	diagnostics    []StalledRoundDiagnostic
+	maxDiagnostics int
+}
+
+// NewAvailabilityStatistics creates a new AvailabilityStatistics struct, which remembers the last maxDiagnostics stalled rounds
+func NewAvailabilityStatistics(maxDiagnostics int) *AvailabilityStatistics {
+	return &AvailabilityStatistics{
+		entities:       make(map[entityKey]*EntityAvailability),
+		diagnostics:    make([]StalledRoundDiagnostic, 0),
+		maxDiagnostics: maxDiagnostics,
+	}
+}
+
+// must be called with the lock held
+func (stats *AvailabilityStatistics) entity(kind string, id int) *EntityAvailability {
+	k := entityKey{kind, id}
+	e, ok := stats.entities[k]
+	if !ok {
+		e = &EntityAvailability{Kind: kind, ID: id, Score: 1}
+		stats.entities[k] = e
+	}
+	return e
+}
+
+// Seen records that we just received a cipher from this entity
+func (stats *AvailabilityStatistics) Seen(kind string, id int) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.entity(kind, id).LastSeen = time.Now()
+}
+
+// must be called with the lock held
+func (stats *AvailabilityStatistics) addRound(kind string, n int, missing []int) {
+	isMissing := make(map[int]bool, len(missing))
+	for _, id := range missing {
+		isMissing[id] = true
+		stats.entity(kind, id).Missed++
+	}
+	for id := 0; id < n; id++ {
+		e := stats.entity(kind, id)
+		e.Rounds++
+		onTime := 1.0
+		if isMissing[id] {
+			onTime = 0
+		}
+		e.Score = RELIABILITY_EWMA_ALPHA*onTime + (1-RELIABILITY_EWMA_ALPHA)*e.Score
+	}
+	for k, e := range stats.entities {
+		if k.kind == kind && e.Rounds > 0 {
+			e.MissRate = float64(e.Missed) / float64(e.Rounds)
+		}
+	}
+}
+
+// must be called with the lock held; returns copies
+func (stats *AvailabilityStatistics) availabilityOf(kind string, ids []int) []EntityAvailability {
+	res := make([]EntityAvailability, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, *stats.entity(kind, id))
+	}
+	return res
+}
+
+// RoundCompleted records that a round completed, with a cipher from the nClients clients and the nTrustees trustees
+func (stats *AvailabilityStatistics) RoundCompleted(nClients, nTrustees int) {
+	stats.Lock()
+	defer stats.Unlock()
+
+	stats.addRound(CLIENT, nClients, nil)
+	stats.addRound(TRUSTEE, nTrustees, nil)
+}
+
+// RoundStalled records that the round timed out without the ciphers of missingClients and missingTrustees,
+// and returns the corresponding diagnostic
+func (stats *AvailabilityStatistics) RoundStalled(roundID int32, consecutiveFailedRounds, nClients, nTrustees int,
+	missingClients, missingTrustees []int) StalledRoundDiagnostic {
+	stats.Lock()
+	defer stats.Unlock()
+
+	stats.addRound(CLIENT, nClients, missingClients)
+	stats.addRound(TRUSTEE, nTrustees, missingTrustees)
+	stats.stalledRounds++
+
+	d := StalledRoundDiagnostic{
+		RoundID:                 roundID,
+		Time:                    time.Now(),
+		ConsecutiveFailedRounds: consecutiveFailedRounds,
+		MissingClients:          stats.availabilityOf(CLIENT, missingClients),
+		MissingTrustees:         stats.availabilityOf(TRUSTEE, missingTrustees),
+	}
+
+	stats.diagnostics = append(stats.diagnostics, d)
+	if len(stats.diagnostics) > stats.maxDiagnostics {
+		stats.diagnostics = stats.diagnostics[len(stats.diagnostics)-stats.maxDiagnostics:]
+	}
+	return d
+}
+
+// Deadline returns how long the relay waits for the cipher of an entity having this reliability score, given the
+// round timeout
+func Deadline(roundTimeout time.Duration, score float64) time.Duration {
+	if score < 0 {
+		score = 0
+	} else if score > 1 {
+		score = 1
+	}
+	factor := RELIABILITY_MIN_DEADLINE_FACTOR + (1-RELIABILITY_MIN_DEADLINE_FACTOR)*score
+	return time.Duration(float64(roundTimeout) * factor)
+}
+
+// RoundDeadline returns how long the relay waits for the ciphers of missingClients and missingTrustees, i.e. the
+// deadline of the most reliable of them; the round does not need to wait longer, and the less reliable entities are
+// not waited for as long as the reliable ones. It is roundTimeout if no cipher is missing.
+func (stats *AvailabilityStatistics) RoundDeadline(roundTimeout time.Duration, missingClients, missingTrustees []int) time.Duration {
+	if len(missingClients)+len(missingTrustees) == 0 {
+		return roundTimeout
+	}
+	stats.Lock()
+	defer stats.Unlock()
+
+	var deadline time.Duration
+	for _, e := range append(stats.availabilityOf(CLIENT, missingClients), stats.availabilityOf(TRUSTEE, missingTrustees)...) {
+		if d := Deadline(roundTimeout, e.Score); d > deadline {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// Diagnostics returns the diagnostics of the last stalled rounds, oldest first
+func (stats *AvailabilityStatistics) Diagnostics() []StalledRoundDiagnostic {
+	stats.Lock()
+	defer stats.Unlock()
+
+	res := make([]StalledRoundDiagnostic, len(stats.diagnostics))
+	copy(res, stats.diagnostics)
+	return res
+}
+
+// Snapshot returns a copy of the availability of each entity, sorted by kind and ID
+func (stats *AvailabilityStatistics) Snapshot() []EntityAvailability {
+	stats.Lock()
+	defer stats.Unlock()
+
+	res := make([]EntityAvailability, 0, len(stats.entities))
+	for _, e := range stats.entities {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// String returns a one-line description of the diagnostic, for the logs
+func (d StalledRoundDiagnostic) String() string {
+	str := fmt.Sprintf("Round %v stalled (%v consecutive);", d.RoundID, d.ConsecutiveFailedRounds)
+	for _, e := range append(d.MissingClients, d.MissingTrustees...) {
+		lastSeen := "never"
+		if !e.LastSeen.IsZero() {
+			lastSeen = d.Time.Sub(e.LastSeen).String() + " ago"
+		}
+		str += fmt.Sprintf(" missing %s %v (missed %v/%v rounds, last seen %s)", e.Kind, e.ID, e.Missed, e.Rounds, lastSeen)
+	}
+	return str
+}
+
+// WritePrometheus writes the availability of each entity in the Prometheus text exposition format, with the given metric prefix
+func (stats *AvailabilityStatistics) WritePrometheus(w io.Writer, prefix string) error {
+	snapshot := stats.Snapshot()
+	stats.Lock()
+	stalledRounds := stats.stalledRounds
+	stats.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# TYPE %s_stalled_rounds_total counter\n%s_stalled_rounds_total %v\n", prefix, prefix, stalledRounds); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# TYPE %s_entity_rounds_total counter\n", prefix)
+	for _, e := range snapshot {
+		fmt.Fprintf(w, "%s_entity_rounds_total{kind=\"%s\",id=\"%v\"} %v\n", prefix, e.Kind, e.ID, e.Rounds)
+	}
+	fmt.Fprintf(w, "# TYPE %s_entity_missed_rounds_total counter\n", prefix)
+	for _, e := range snapshot {
+		fmt.Fprintf(w, "%s_entity_missed_rounds_total{kind=\"%s\",id=\"%v\"} %v\n", prefix, e.Kind, e.ID, e.Missed)
+	}
+	fmt.Fprintf(w, "# TYPE %s_entity_reliability_score gauge\n", prefix)
+	for _, e := range snapshot {
+		fmt.Fprintf(w, "%s_entity_reliability_score{kind=\"%s\",id=\"%v\"} %.4f\n", prefix, e.Kind, e.ID, e.Score)
+	}
+	_, err := fmt.Fprintf(w, "# TYPE %s_entity_last_seen_timestamp_seconds gauge\n", prefix)
+	for _, e := range snapshot {
+		if e.LastSeen.IsZero() {
+			continue
+		}
+		_, err = fmt.Fprintf(w, "%s_entity_last_seen_timestamp_seconds{kind=\"%s\",id=\"%v\"} %v\n", prefix, e.Kind, e.ID, e.LastSeen.Unix())
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityStatistics(t *testing.T) {
+
+	stats := NewAvailabilityStatistics(2)
+	stats.Seen(CLIENT, 0)
+	stats.Seen(TRUSTEE, 0)
+	stats.RoundCompleted(2, 1)
+	stats.RoundCompleted(2, 1)
+
+	d := stats.RoundStalled(2, 1, 2, 1, []int{1}, []int{})
+	if d.RoundID != 2 || len(d.MissingClients) != 1 || len(d.MissingTrustees) != 0 {
+		t.Fatal("Wrong diagnostic", d)
+	}
+	c := d.MissingClients[0]
+	if c.Kind != CLIENT || c.ID != 1 || c.Rounds != 3 || c.Missed != 1 || c.MissRate != float64(1)/3 {
+		t.Error("Wrong availability for client 1", c)
+	}
+	if !c.LastSeen.IsZero() {
+		t.Error("Client 1 was never seen")
+	}
+	if !strings.Contains(d.String(), "missing client 1 (missed 1/3 rounds, last seen never)") {
+		t.Error("Wrong description", d.String())
+	}
+
+	stats.RoundStalled(3, 2, 2, 1, []int{1}, []int{0})
+	stats.RoundStalled(4, 3, 2, 1, []int{}, []int{0})
+	diagnostics := stats.Diagnostics()
+	if len(diagnostics) != 2 || diagnostics[0].RoundID != 3 || diagnostics[1].RoundID != 4 {
+		t.Error("Should keep the last 2 diagnostics, oldest first", diagnostics)
+	}
+
+	snapshot := stats.Snapshot()
+	if len(snapshot) != 3 || snapshot[0].Kind != CLIENT || snapshot[2].Kind != TRUSTEE {
+		t.Fatal("Wrong snapshot", snapshot)
+	}
+	if snapshot[0].MissRate != 0 || snapshot[1].Missed != 2 || snapshot[2].MissRate != 0.4 {
+		t.Error("Wrong miss rates", snapshot)
+	}
+	if snapshot[0].LastSeen.IsZero() || snapshot[2].LastSeen.IsZero() {
+		t.Error("Client 0 and trustee 0 were seen")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := stats.WritePrometheus(buf, "prifi_relay"); err != nil {
+		t.Error(err)
+	}
+	out := buf.String()
+	expected := []string{
+		"prifi_relay_stalled_rounds_total 3",
+		"prifi_relay_entity_rounds_total{kind=\"client\",id=\"1\"} 5",
+		"prifi_relay_entity_missed_rounds_total{kind=\"trustee\",id=\"0\"} 2",
+		"prifi_relay_entity_last_seen_timestamp_seconds{kind=\"client\",id=\"0\"}",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Error("Metrics output should contain", e)
+		}
+	}
+	if strings.Contains(out, "last_seen_timestamp_seconds{kind=\"client\",id=\"1\"}") {
+		t.Error("Client 1 was never seen, it should have no last-seen time")
+	}
+}
+
+func TestReliabilityScores(t *testing.T) {
+
+	stats := NewAvailabilityStatistics(10)
+	stats.RoundCompleted(2, 1)
+	for i := 0; i < 20; i++ {
+		stats.RoundStalled(int32(i), 1, 2, 1, []int{1}, []int{})
+	}
+
+	snapshot := stats.Snapshot()
+	if snapshot[0].Score != 1 || snapshot[2].Score != 1 {
+		t.Error("Client 0 and trustee 0 were always on time", snapshot)
+	}
+	expected := math.Pow(1-RELIABILITY_EWMA_ALPHA, 20)
+	if math.Abs(snapshot[1].Score-expected) > 1e-9 {
+		t.Error("Wrong score for client 1, expected", expected, "got", snapshot[1].Score)
+	}
+
+	timeout := 1000 * time.Millisecond
+	if d := Deadline(timeout, 1); d != timeout {
+		t.Error("A reliable entity should get the whole timeout, got", d)
+	}
+	if d := Deadline(timeout, 0); d != 250*time.Millisecond {
+		t.Error("An unreliable entity should get a quarter of the timeout, got", d)
+	}
+	if d := stats.RoundDeadline(timeout, []int{1}, []int{}); d >= timeout || d <= 250*time.Millisecond {
+		t.Error("Client 1 is often late, it should get less than the timeout, got", d)
+	}
+	if d := stats.RoundDeadline(timeout, []int{0, 1}, []int{}); d != timeout {
+		t.Error("The round should wait for the most reliable missing entity, got", d)
+	}
+	if d := stats.RoundDeadline(timeout, nil, nil); d != timeout {
+		t.Error("Nothing is missing, the deadline should be the timeout, got", d)
+	}
+
+	buf := new(bytes.Buffer)
+	stats.WritePrometheus(buf, "prifi_relay")
+	if !strings.Contains(buf.String(), "prifi_relay_entity_reliability_score{kind=\"client\",id=\"0\"} 1.0000") {
+		t.Error("Metrics output should contain the reliability scores", buf.String())
+	}
+}
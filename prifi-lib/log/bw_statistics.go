@@ -2,13 +2,18 @@ package log
 
 import (
 	"fmt"
+	"io"
+	"sort"
+	"sync"
 	"time"
 
 	"go.dedis.ch/onet/v3/log"
 )
 
-//BitrateStatistics holds statistics about the bitrate, such as instant/total up/down/down (via udp)/retransmitted bits
+//BitrateStatistics holds statistics about the bitrate, such as instant/total up/down/down (via udp)/retransmitted bits.
+//It is safe to use from several goroutines, e.g. the metrics endpoint.
 type BitrateStatistics struct {
+	sync.Mutex
 	begin      time.Time
 	nextReport time.Time
 	period     time.Duration
@@ -34,6 +39,47 @@ type BitrateStatistics struct {
 	instantDownstreamRetransmitBytes int64
 
 	reportNo int
+
+	// sliding windows, one slot per second
+	slots [BITRATE_SLIDING_WINDOW_SLOTS]bitrateSlot
+	now   func() time.Time
+
+	// per-entity breakdown
+	clientBytes  map[int]int64
+	trusteeBytes map[int]int64
+}
+
+// BITRATE_SLIDING_WINDOW_SLOTS is the number of one-second slots kept, hence the longest sliding window
+const BITRATE_SLIDING_WINDOW_SLOTS = 60
+
+// BITRATE_WINDOWS are the sliding windows over which the rates are computed
+var BITRATE_WINDOWS = []time.Duration{1 * time.Second, 10 * time.Second, 60 * time.Second}
+
+// bitrateSlot holds the counts of one second
+type bitrateSlot struct {
+	second          int64
+	upstreamCells   int64
+	upstreamBytes   int64
+	downstreamBytes int64
+}
+
+// BitrateWindow holds the rates over one sliding window (the last complete seconds)
+type BitrateWindow struct {
+	Window                time.Duration
+	RoundsPerSec          float64
+	UpstreamBytesPerSec   float64
+	DownstreamBytesPerSec float64
+}
+
+// BitrateReport is the structured form of the BitrateStatistics
+type BitrateReport struct {
+	ReportNo             int
+	Windows              []BitrateWindow
+	TotalUpstreamCells   int64
+	TotalUpstreamBytes   int64
+	TotalDownstreamBytes int64         // via TCP, UDP, and retransmitted
+	ClientBytes          map[int]int64 // clientID -> number of bytes of upstream ciphers received
+	TrusteeBytes         map[int]int64 // trusteeID -> number of bytes of ciphers received
 }
 
 //NewBitRateStatistics create a new BitrateStatistics struct, with a period (for reporting) of 5 second
@@ -41,14 +87,27 @@ func NewBitRateStatistics(cellSize int) *BitrateStatistics {
 	fiveSec := time.Duration(5) * time.Second
 	now := time.Now()
 	stats := BitrateStatistics{
-		begin:      now,
-		nextReport: now,
-		reportNo:   0,
-		period:     fiveSec,
-		cellSize:   cellSize}
+		begin:        now,
+		nextReport:   now,
+		reportNo:     0,
+		period:       fiveSec,
+		cellSize:     cellSize,
+		now:          time.Now,
+		clientBytes:  make(map[int]int64),
+		trusteeBytes: make(map[int]int64)}
 	return &stats
 }
 
+// slot returns the slot of the current second, resetting it if it holds an older second
+func (stats *BitrateStatistics) slot() *bitrateSlot {
+	second := stats.now().Unix()
+	s := &stats.slots[second%BITRATE_SLIDING_WINDOW_SLOTS]
+	if s.second != second {
+		*s = bitrateSlot{second: second}
+	}
+	return s
+}
+
 // Dump prints all the contents of the BitrateStatistics
 func (stats *BitrateStatistics) Dump() {
 	log.Lvlf1("%+v\n", stats)
@@ -56,31 +115,116 @@ func (stats *BitrateStatistics) Dump() {
 
 //AddDownstreamCell adds N bytes to the count of downstream bits
 func (stats *BitrateStatistics) AddDownstreamCell(nBytes int64) {
+	stats.Lock()
+	defer stats.Unlock()
 	stats.totalDownstreamCells++
 	stats.totalDownstreamBytes += nBytes
 	stats.instantDownstreamBytes += nBytes
+	stats.slot().downstreamBytes += nBytes
 }
 
 //AddDownstreamUDPCell adds N bytes to the count of downstream (via udp) bits
 func (stats *BitrateStatistics) AddDownstreamUDPCell(nBytes int64, nclients int) {
+	stats.Lock()
+	defer stats.Unlock()
 	stats.totalDownstreamUDPCells++
 	stats.totalDownstreamUDPBytes += nBytes
 	stats.instantDownstreamUDPBytes += nBytes
+	stats.slot().downstreamBytes += nBytes
 }
 
 //AddDownstreamRetransmitCell adds N bytes to the count of retransmitted bits
 func (stats *BitrateStatistics) AddDownstreamRetransmitCell(nBytes int64) {
+	stats.Lock()
+	defer stats.Unlock()
 	stats.totalDownstreamRetransmitCells++
 	stats.totalDownstreamRetransmitBytes += nBytes
 	stats.instantDownstreamRetransmitBytes += nBytes
+	stats.slot().downstreamBytes += nBytes
 }
 
 //AddUpstreamCell adds N bytes to the count of upstream bits
 func (stats *BitrateStatistics) AddUpstreamCell(nBytes int64) {
+	stats.Lock()
+	defer stats.Unlock()
 	stats.totalUpstreamCells++
 	stats.totalUpstreamBytes += nBytes
 	stats.instantUpstreamCells++
 	stats.instantUpstreamBytes += nBytes
+	slot := stats.slot()
+	slot.upstreamCells++
+	slot.upstreamBytes += nBytes
+}
+
+// AddClientBytes adds N bytes to the count of the ciphers received from this client
+func (stats *BitrateStatistics) AddClientBytes(clientID int, nBytes int64) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.clientBytes[clientID] += nBytes
+}
+
+// AddTrusteeBytes adds N bytes to the count of the ciphers received from this trustee
+func (stats *BitrateStatistics) AddTrusteeBytes(trusteeID int, nBytes int64) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.trusteeBytes[trusteeID] += nBytes
+}
+
+// Windows returns the rates over each of the BITRATE_WINDOWS. The current second is not complete, hence not counted.
+func (stats *BitrateStatistics) Windows() []BitrateWindow {
+	stats.Lock()
+	defer stats.Unlock()
+	return stats.windows()
+}
+
+func (stats *BitrateStatistics) windows() []BitrateWindow {
+	now := stats.now().Unix()
+	windows := make([]BitrateWindow, 0, len(BITRATE_WINDOWS))
+	for _, w := range BITRATE_WINDOWS {
+		seconds := int64(w / time.Second)
+		var cells, up, down int64
+		for second := now - seconds; second < now; second++ {
+			s := stats.slots[second%BITRATE_SLIDING_WINDOW_SLOTS]
+			if s.second == second {
+				cells += s.upstreamCells
+				up += s.upstreamBytes
+				down += s.downstreamBytes
+			}
+		}
+		windows = append(windows, BitrateWindow{
+			Window:                w,
+			RoundsPerSec:          float64(cells) / float64(seconds),
+			UpstreamBytesPerSec:   float64(up) / float64(seconds),
+			DownstreamBytesPerSec: float64(down) / float64(seconds),
+		})
+	}
+	return windows
+}
+
+// Structured returns the sliding-window rates, the totals and the per-entity breakdown
+func (stats *BitrateStatistics) Structured() BitrateReport {
+	stats.Lock()
+	defer stats.Unlock()
+	return stats.structured()
+}
+
+func (stats *BitrateStatistics) structured() BitrateReport {
+	r := BitrateReport{
+		ReportNo:             stats.reportNo,
+		Windows:              stats.windows(),
+		TotalUpstreamCells:   stats.totalUpstreamCells,
+		TotalUpstreamBytes:   stats.totalUpstreamBytes,
+		TotalDownstreamBytes: stats.totalDownstreamBytes + stats.totalDownstreamUDPBytes + stats.totalDownstreamRetransmitBytes,
+		ClientBytes:          make(map[int]int64, len(stats.clientBytes)),
+		TrusteeBytes:         make(map[int]int64, len(stats.trusteeBytes)),
+	}
+	for k, v := range stats.clientBytes {
+		r.ClientBytes[k] = v
+	}
+	for k, v := range stats.trusteeBytes {
+		r.TrusteeBytes[k] = v
+	}
+	return r
 }
 
 //Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
@@ -90,6 +234,9 @@ func (stats *BitrateStatistics) Report() string {
 
 //ReportWithInfo prints (if t>period=5 seconds have passed since the last report) all the information, with extra data "info"
 func (stats *BitrateStatistics) ReportWithInfo(info string) string {
+	stats.Lock()
+	defer stats.Unlock()
+
 	now := time.Now()
 	if now.After(stats.nextReport) {
 
@@ -103,11 +250,14 @@ func (stats *BitrateStatistics) ReportWithInfo(info string) string {
 			float64(stats.instantDownstreamRetransmitBytes)/1024/stats.period.Seconds(),
 			stats.totalUpstreamCells,
 			int64(stats.totalUpstreamCells)*int64(stats.cellSize))
+		if info != "" {
+			str += ". Info: " + info
+		}
 
 		log.Lvlf1(str)
 
 		//json output
-		strJSON := fmt.Sprintf("{ \"type\"=\"relay_bw\", \"report_id\"=\"%v\", \"round_per_sec\"=\"%0.1f\", \"up_kbps\"=\"%0.1f\", \"down_kbps\"=\"%0.1f\", \"down_udp_kbps\"=\"%0.1f\", \"down_re_udp_kbps\"=\"%0.1f\" }\n",
+		strJSON := fmt.Sprintf("{ \"type\"=\"relay_bw\", \"report_id\"=\"%v\", \"round_per_sec\"=\"%0.1f\", \"up_kbps\"=\"%0.1f\", \"down_kbps\"=\"%0.1f\", \"down_udp_kbps\"=\"%0.1f\", \"down_re_udp_kbps\"=\"%0.1f\"",
 			stats.reportNo,
 			float64(stats.instantUpstreamCells)/stats.period.Seconds(),
 			float64(stats.instantUpstreamBytes)/1024/stats.period.Seconds(),
@@ -115,6 +265,25 @@ func (stats *BitrateStatistics) ReportWithInfo(info string) string {
 			float64(stats.instantDownstreamUDPBytes)/1024/stats.period.Seconds(),
 			float64(stats.instantDownstreamRetransmitBytes)/1024/stats.period.Seconds())
 
+		// sliding windows, and per-entity bytes, in the same format
+		structured := stats.structured()
+		windowsJSON := ""
+		for _, w := range structured.Windows {
+			sec := int64(w.Window / time.Second)
+			windowsJSON += fmt.Sprintf(", \"round_per_sec_%vs\"=\"%0.1f\", \"up_kbps_%vs\"=\"%0.1f\", \"down_kbps_%vs\"=\"%0.1f\"",
+				sec, w.RoundsPerSec, sec, w.UpstreamBytesPerSec/1024, sec, w.DownstreamBytesPerSec/1024)
+		}
+		for _, id := range sortedIDs(structured.ClientBytes) {
+			windowsJSON += fmt.Sprintf(", \"client_%v_bytes\"=\"%v\"", id, structured.ClientBytes[id])
+		}
+		for _, id := range sortedIDs(structured.TrusteeBytes) {
+			windowsJSON += fmt.Sprintf(", \"trustee_%v_bytes\"=\"%v\"", id, structured.TrusteeBytes[id])
+		}
+		if info != "" {
+			windowsJSON += fmt.Sprintf(", \"info\"=\"%s\"", info)
+		}
+		strJSON += windowsJSON + " }\n"
+
 		// Next report time
 		stats.instantUpstreamCells = 0
 		stats.instantUpstreamBytes = 0
@@ -130,3 +299,55 @@ func (stats *BitrateStatistics) ReportWithInfo(info string) string {
 
 	return ""
 }
+
+// WritePrometheus writes the totals of the upstream and downstream cells and bytes, the bytes of the ciphers of each
+// entity, and the rates over the sliding windows, in the Prometheus text exposition format
+func (stats *BitrateStatistics) WritePrometheus(w io.Writer, prefix string) error {
+	stats.Lock()
+	r := stats.structured()
+	downstream := map[string]int64{
+		"tcp":        stats.totalDownstreamBytes,
+		"udp":        stats.totalDownstreamUDPBytes,
+		"retransmit": stats.totalDownstreamRetransmitBytes,
+	}
+	stats.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# TYPE %s_upstream_cells_total counter\n%s_upstream_cells_total %v\n", prefix, prefix, r.TotalUpstreamCells); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# TYPE %s_upstream_bytes_total counter\n%s_upstream_bytes_total %v\n", prefix, prefix, r.TotalUpstreamBytes)
+	fmt.Fprintf(w, "# TYPE %s_downstream_bytes_total counter\n", prefix)
+	for _, transport := range []string{"tcp", "udp", "retransmit"} {
+		fmt.Fprintf(w, "%s_downstream_bytes_total{transport=\"%s\"} %v\n", prefix, transport, downstream[transport])
+	}
+	fmt.Fprintf(w, "# TYPE %s_cipher_bytes_total counter\n", prefix)
+	for _, id := range sortedIDs(r.ClientBytes) {
+		fmt.Fprintf(w, "%s_cipher_bytes_total{kind=\"%s\",id=\"%v\"} %v\n", prefix, CLIENT, id, r.ClientBytes[id])
+	}
+	for _, id := range sortedIDs(r.TrusteeBytes) {
+		fmt.Fprintf(w, "%s_cipher_bytes_total{kind=\"%s\",id=\"%v\"} %v\n", prefix, TRUSTEE, id, r.TrusteeBytes[id])
+	}
+	for _, gauge := range []struct {
+		name  string
+		value func(BitrateWindow) float64
+	}{
+		{"rounds_per_second", func(w BitrateWindow) float64 { return w.RoundsPerSec }},
+		{"upstream_bytes_per_second", func(w BitrateWindow) float64 { return w.UpstreamBytesPerSec }},
+		{"downstream_bytes_per_second", func(w BitrateWindow) float64 { return w.DownstreamBytesPerSec }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s_%s gauge\n", prefix, gauge.name)
+		for _, window := range r.Windows {
+			fmt.Fprintf(w, "%s_%s{window=\"%s\"} %g\n", prefix, gauge.name, window.Window, gauge.value(window))
+		}
+	}
+	return nil
+}
+
+func sortedIDs(m map[int]int64) []int {
+	ids := make([]int, 0, len(m))
+	for k := range m {
+		ids = append(ids, k)
+	}
+	sort.Ints(ids)
+	return ids
+}
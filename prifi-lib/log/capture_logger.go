@@ -0,0 +1,111 @@
+package log
+
+import (
+	"strings"
+	"sync"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The levels onet's log gives to warnings and errors (its own constants are not exported)
+const (
+	LOG_LEVEL_WARNING = -20
+	LOG_LEVEL_ERROR   = -19
+)
+
+// LogEntry is one message received by a CaptureLogger
+type LogEntry struct {
+	Level   int
+	Message string
+}
+
+// CaptureLogger records the messages written to onet's log, so that the tests can check that a warning or an error
+// was logged, e.g. on a protocol violation or a timeout. The messages still go to the other loggers.
+type CaptureLogger struct {
+	sync.Mutex
+	key      int
+	debugLvl int
+	entries  []LogEntry
+}
+
+// StartCaptureLogger starts recording the warnings and errors, and the messages up to debugLvl
+func StartCaptureLogger(debugLvl int) *CaptureLogger {
+	c := &CaptureLogger{debugLvl: debugLvl}
+	c.key = log.RegisterLogger(c)
+	return c
+}
+
+// Stop stops recording; the recorded messages can still be read
+func (c *CaptureLogger) Stop() {
+	log.UnregisterLogger(c.key)
+}
+
+// Log implements onet's log.Logger
+func (c *CaptureLogger) Log(level int, msg string) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = append(c.entries, LogEntry{Level: level, Message: msg})
+}
+
+// Close implements onet's log.Logger
+func (c *CaptureLogger) Close() {}
+
+// GetLoggerInfo implements onet's log.Logger; we only want the messages, without the caller nor the time
+func (c *CaptureLogger) GetLoggerInfo() *log.LoggerInfo {
+	return &log.LoggerInfo{DebugLvl: c.debugLvl, RawMessage: true}
+}
+
+// Entries returns all the recorded messages
+func (c *CaptureLogger) Entries() []LogEntry {
+	c.Lock()
+	defer c.Unlock()
+	return append([]LogEntry{}, c.entries...)
+}
+
+// Errors returns the recorded errors
+func (c *CaptureLogger) Errors() []string {
+	return c.messagesOfLevel(LOG_LEVEL_ERROR)
+}
+
+// Warnings returns the recorded warnings
+func (c *CaptureLogger) Warnings() []string {
+	return c.messagesOfLevel(LOG_LEVEL_WARNING)
+}
+
+// HasError returns true if an error containing substr was recorded
+func (c *CaptureLogger) HasError(substr string) bool {
+	return containsSubstring(c.Errors(), substr)
+}
+
+// HasWarning returns true if a warning containing substr was recorded
+func (c *CaptureLogger) HasWarning(substr string) bool {
+	return containsSubstring(c.Warnings(), substr)
+}
+
+// Reset forgets the recorded messages
+func (c *CaptureLogger) Reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = nil
+}
+
+func (c *CaptureLogger) messagesOfLevel(level int) []string {
+	c.Lock()
+	defer c.Unlock()
+	messages := make([]string, 0)
+	for _, e := range c.entries {
+		if e.Level == level {
+			messages = append(messages, e.Message)
+		}
+	}
+	return messages
+}
+
+func containsSubstring(messages []string, substr string) bool {
+	for _, m := range messages {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
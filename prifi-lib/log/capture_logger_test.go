@@ -0,0 +1,44 @@
+package log
+
+import (
+	"errors"
+	"testing"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestCaptureLogger(t *testing.T) {
+	c := StartCaptureLogger(2)
+
+	log.Error("Relay : round", 3, "timed out")
+	log.Error("Client : wrong signature,", errors.New("bad point"))
+	log.Warn("Trustee : cache almost full")
+	log.Lvl2("shown at level 2")
+	log.Lvl3("hidden at level 2")
+
+	if errs := c.Errors(); len(errs) != 2 || errs[0] != "Relay : round 3 timed out" {
+		t.Error("Wrong errors", errs)
+	}
+	if !c.HasError("bad point") || c.HasError("cache") {
+		t.Error("HasError should look at the errors only")
+	}
+	if !c.HasWarning("cache almost full") || len(c.Warnings()) != 1 {
+		t.Error("Wrong warnings", c.Warnings())
+	}
+	entries := c.Entries()
+	if len(entries) != 4 || entries[3].Level != 2 || entries[3].Message != "shown at level 2" {
+		t.Error("Wrong entries", entries)
+	}
+
+	c.Reset()
+	if len(c.Entries()) != 0 {
+		t.Error("Reset should forget the messages")
+	}
+
+	// once stopped, nothing is recorded anymore
+	c.Stop()
+	log.Error("after the stop")
+	if len(c.Errors()) != 0 {
+		t.Error("A stopped logger should not record", c.Errors())
+	}
+}
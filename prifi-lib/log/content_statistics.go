@@ -0,0 +1,136 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// ContentType is the kind of content of a decoded upstream payload
+type ContentType int
+
+// The content types, in the order of the reports
+const (
+	CONTENT_EMPTY         ContentType = iota // no stream data, the slot owner had nothing to send
+	CONTENT_SOCKS_CONNECT                    // the start of a SOCKS stream (greeting or CONNECT request)
+	CONTENT_DATA                             // stream data
+	CONTENT_LATENCY_PROBE                    // a latency-test message
+	CONTENT_KEEPALIVE                        // a keepalive of an idle stream, or another control frame (no data)
+	CONTENT_INVALID                          // not decodable, e.g. because of a disruption
+	numberOfContentTypes
+)
+
+func (t ContentType) String() string {
+	switch t {
+	case CONTENT_EMPTY:
+		return "empty"
+	case CONTENT_SOCKS_CONNECT:
+		return "socks-connect"
+	case CONTENT_DATA:
+		return "data"
+	case CONTENT_LATENCY_PROBE:
+		return "latency-probe"
+	case CONTENT_KEEPALIVE:
+		return "keepalive"
+	case CONTENT_INVALID:
+		return "invalid"
+	}
+	return "unknown"
+}
+
+// contentCounters counts the payloads of each type, and how many of their bytes are useful
+type contentCounters struct {
+	payloads    [numberOfContentTypes]int64
+	usefulBytes int64
+	totalBytes  int64
+}
+
+func (c *contentCounters) add(t ContentType, usefulBytes, totalBytes int) {
+	c.payloads[t]++
+	c.usefulBytes += int64(usefulBytes)
+	c.totalBytes += int64(totalBytes)
+}
+
+func (c *contentCounters) String() string {
+	var rounds int64
+	for _, n := range c.payloads {
+		rounds += n
+	}
+	str := ""
+	for t := ContentType(0); t < numberOfContentTypes; t++ {
+		percent := 0.0
+		if rounds > 0 {
+			percent = 100 * float64(c.payloads[t]) / float64(rounds)
+		}
+		str += fmt.Sprintf("%v %v (%0.1f%%), ", t, c.payloads[t], percent)
+	}
+	usage := 0.0
+	if c.totalBytes > 0 {
+		usage = 100 * float64(c.usefulBytes) / float64(c.totalBytes)
+	}
+	return fmt.Sprintf("%vuseful bytes %v/%v (%0.1f%%)", str, c.usefulBytes, c.totalBytes, usage)
+}
+
+// ContentStatistics counts the types of the decoded upstream payloads (one per round), since the last report and
+// since the beginning of the epoch, to see how much of the DC-net capacity carries real data
+type ContentStatistics struct {
+	nextReport  time.Time
+	period      time.Duration
+	reportNo    int
+	sinceReport contentCounters
+	epoch       contentCounters
+}
+
+// NewContentStatistics creates a new ContentStatistics struct, with a period (for reporting) of 5 second
+func NewContentStatistics() *ContentStatistics {
+	return &ContentStatistics{
+		nextReport: time.Now(),
+		period:     time.Duration(5) * time.Second,
+	}
+}
+
+// AddPayload counts a decoded payload of totalBytes, of which usefulBytes are stream data
+func (stats *ContentStatistics) AddPayload(t ContentType, usefulBytes, totalBytes int) {
+	if t < 0 || t >= numberOfContentTypes {
+		t = CONTENT_INVALID
+	}
+	stats.sinceReport.add(t, usefulBytes, totalBytes)
+	stats.epoch.add(t, usefulBytes, totalBytes)
+}
+
+// NewEpoch resets the counters of the epoch
+func (stats *ContentStatistics) NewEpoch() {
+	stats.epoch = contentCounters{}
+}
+
+// EpochPayloads returns the number of payloads of type t since the beginning of the epoch
+func (stats *ContentStatistics) EpochPayloads(t ContentType) int64 {
+	if t < 0 || t >= numberOfContentTypes {
+		return 0
+	}
+	return stats.epoch.payloads[t]
+}
+
+// Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
+func (stats *ContentStatistics) Report() string {
+	return stats.ReportWithInfo("")
+}
+
+// ReportWithInfo prints (if t>period=5 seconds have passed since the last report) all the information, with extra data
+func (stats *ContentStatistics) ReportWithInfo(info string) string {
+	now := time.Now()
+	if now.After(stats.nextReport) {
+
+		//human-readable output
+		str := fmt.Sprintf("[%v] Content: %v; epoch: %v. Info: %s", stats.reportNo, stats.sinceReport.String(), stats.epoch.String(), info)
+		log.Lvl1(str)
+
+		stats.sinceReport = contentCounters{}
+		stats.nextReport = now.Add(stats.period)
+		stats.reportNo++
+
+		return str
+	}
+	return ""
+}
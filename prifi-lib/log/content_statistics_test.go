@@ -0,0 +1,37 @@
+package log
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentStatistics(t *testing.T) {
+	stats := NewContentStatistics()
+	stats.AddPayload(CONTENT_DATA, 900, 1000)
+	stats.AddPayload(CONTENT_EMPTY, 0, 1000)
+	stats.AddPayload(CONTENT_EMPTY, 0, 1000)
+	stats.AddPayload(CONTENT_LATENCY_PROBE, 0, 1000)
+	stats.AddPayload(ContentType(42), 0, 1000)
+
+	if stats.EpochPayloads(CONTENT_EMPTY) != 2 || stats.EpochPayloads(CONTENT_INVALID) != 1 {
+		t.Error("Wrong epoch counters", stats.epoch)
+	}
+	report := stats.ReportWithInfo("info")
+	for _, expected := range []string{"Content: empty 2 (40.0%), socks-connect 0 (0.0%), data 1 (20.0%)", "useful bytes 900/5000 (18.0%)", "Info: info"} {
+		if !strings.Contains(report, expected) {
+			t.Error("The report should contain", expected, ":", report)
+		}
+	}
+	if stats.Report() != "" {
+		t.Error("There should be no report before the end of the period")
+	}
+
+	// the counters of the report period are reset, the epoch ones only with the epoch
+	if stats.sinceReport.totalBytes != 0 || stats.epoch.totalBytes != 5000 {
+		t.Error("Wrong counters after the report", stats.sinceReport, stats.epoch)
+	}
+	stats.NewEpoch()
+	if stats.EpochPayloads(CONTENT_EMPTY) != 0 {
+		t.Error("The epoch counters should be reset")
+	}
+}
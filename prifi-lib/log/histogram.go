@@ -0,0 +1,175 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// HISTOGRAM_SUB_BUCKETS is the number of linear sub-buckets per power of two. Values below it are counted exactly;
+// above, the relative error of a bucket is at most 1/HISTOGRAM_SUB_BUCKETS (like an HDR histogram with ~1 significant digit)
+const HISTOGRAM_SUB_BUCKETS = 16
+
+// histogramSubBucketBits is log2(HISTOGRAM_SUB_BUCKETS)
+const histogramSubBucketBits = 4
+
+// Histogram counts non-negative values in log-linear buckets, using a constant memory whatever the number of values.
+// Negative values are counted as 0. It is safe to use from several goroutines.
+type Histogram struct {
+	sync.Mutex
+	counts []int64
+	count  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+// HistogramBucket is a non-empty bucket of a Histogram, with all values in [LowerBound, UpperBound]
+type HistogramBucket struct {
+	LowerBound int64
+	UpperBound int64
+	Count      int64
+}
+
+// NewHistogram creates an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, 0)}
+}
+
+// bucketIndex returns the index of the bucket of v >= 0
+func bucketIndex(v int64) int {
+	if v < HISTOGRAM_SUB_BUCKETS {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - histogramSubBucketBits - 1
+	return HISTOGRAM_SUB_BUCKETS*(shift+1) + int(v>>uint(shift)) - HISTOGRAM_SUB_BUCKETS
+}
+
+// bucketBounds returns the smallest and largest values of the bucket i
+func bucketBounds(i int) (int64, int64) {
+	if i < HISTOGRAM_SUB_BUCKETS {
+		return int64(i), int64(i)
+	}
+	shift := uint(i/HISTOGRAM_SUB_BUCKETS - 1)
+	lower := int64(HISTOGRAM_SUB_BUCKETS+i%HISTOGRAM_SUB_BUCKETS) << shift
+	return lower, lower + (int64(1) << shift) - 1
+}
+
+// Record adds a value to the histogram
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	i := bucketIndex(v)
+	for len(h.counts) <= i {
+		h.counts = append(h.counts, 0)
+	}
+	h.counts[i]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of values recorded
+func (h *Histogram) Count() int64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.count
+}
+
+// Mean returns the mean of the values recorded, or 0 if there are none
+func (h *Histogram) Mean() float64 {
+	h.Lock()
+	defer h.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return float64(h.sum) / float64(h.count)
+}
+
+// Max returns the largest value recorded
+func (h *Histogram) Max() int64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.max
+}
+
+// Percentile returns the value below which p percent of the values are (the upper bound of the bucket where
+// this happens, so it over-estimates by at most the bucket width), or 0 if there are no values
+func (h *Histogram) Percentile(p float64) int64 {
+	h.Lock()
+	defer h.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(p / 100 * float64(h.count))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			_, upper := bucketBounds(i)
+			if upper > h.max {
+				return h.max
+			}
+			if upper < h.min {
+				return h.min
+			}
+			return upper
+		}
+	}
+	return h.max
+}
+
+// Buckets returns the non-empty buckets, in increasing order
+func (h *Histogram) Buckets() []HistogramBucket {
+	h.Lock()
+	defer h.Unlock()
+
+	buckets := make([]HistogramBucket, 0)
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		lower, upper := bucketBounds(i)
+		buckets = append(buckets, HistogramBucket{LowerBound: lower, UpperBound: upper, Count: c})
+	}
+	return buckets
+}
+
+// WritePrometheus writes the histogram in the Prometheus text exposition format, as the metric "name" with the given
+// labels (e.g. `measure="round-duration"`, can be empty). The "# TYPE" line is not written, since several histograms
+// can share a metric name.
+func (h *Histogram) WritePrometheus(w io.Writer, name, labels string) error {
+	bucketLabels := labels
+	if bucketLabels != "" {
+		bucketLabels += ","
+	}
+	cumulative := int64(0)
+	for _, b := range h.Buckets() {
+		cumulative += b.Count
+		if _, err := fmt.Fprintf(w, "%s_bucket{%sle=\"%v\"} %v\n", name, bucketLabels, b.UpperBound, cumulative); err != nil {
+			return err
+		}
+	}
+
+	h.Lock()
+	count, sum := h.count, h.sum
+	h.Unlock()
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %v\n", name, bucketLabels, count)
+	fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels, sum)
+	_, err := fmt.Fprintf(w, "%s_count{%s} %v\n", name, labels, count)
+	return err
+}
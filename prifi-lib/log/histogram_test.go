@@ -0,0 +1,90 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+
+	// each value is in its bucket, and the buckets are contiguous
+	previousUpper := int64(-1)
+	for i := 0; i < 20*HISTOGRAM_SUB_BUCKETS; i++ {
+		lower, upper := bucketBounds(i)
+		if lower != previousUpper+1 || upper < lower {
+			t.Fatal("Bucket", i, "is [", lower, ",", upper, "], previous upper bound", previousUpper)
+		}
+		if bucketIndex(lower) != i || bucketIndex(upper) != i {
+			t.Fatal("Bounds of bucket", i, "are not in it")
+		}
+		if lower >= HISTOGRAM_SUB_BUCKETS && float64(upper-lower+1)/float64(lower) > 1/float64(HISTOGRAM_SUB_BUCKETS) {
+			t.Error("Bucket", i, "is too wide")
+		}
+		previousUpper = upper
+	}
+}
+
+func TestHistogram(t *testing.T) {
+
+	h := NewHistogram()
+	if h.Percentile(50) != 0 || h.Mean() != 0 {
+		t.Error("Empty histogram should give 0")
+	}
+	for v := int64(1); v <= 1000; v++ {
+		h.Record(v)
+	}
+	h.Record(-5)
+
+	if h.Count() != 1001 || h.Max() != 1000 {
+		t.Error("Wrong count or max", h.Count(), h.Max())
+	}
+	for _, p := range []float64{50, 90, 99} {
+		exact := int64(p * 10)
+		got := h.Percentile(p)
+		if got < exact || float64(got-exact) > float64(exact)/HISTOGRAM_SUB_BUCKETS {
+			t.Error("Percentile", p, "is", got, ", expected about", exact)
+		}
+	}
+	if h.Percentile(100) != 1000 || h.Percentile(0) != 0 {
+		t.Error("Wrong extreme percentiles", h.Percentile(0), h.Percentile(100))
+	}
+
+	total := int64(0)
+	for _, b := range h.Buckets() {
+		total += b.Count
+	}
+	if total != 1001 {
+		t.Error("Buckets should contain all values, contain", total)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := h.WritePrometheus(buf, "x", "measure=\"m\""); err != nil {
+		t.Error(err)
+	}
+	for _, e := range []string{"x_bucket{measure=\"m\",le=\"0\"} 1\n", "x_bucket{measure=\"m\",le=\"+Inf\"} 1001\n", "x_count{measure=\"m\"} 1001\n", "x_sum{measure=\"m\"} 500500\n"} {
+		if !strings.Contains(buf.String(), e) {
+			t.Error("Output should contain", e)
+		}
+	}
+}
+
+func TestTimeStatisticsPercentiles(t *testing.T) {
+
+	stats := NewTimeStatistics()
+	for i := 0; i < 2*MAX_LATENCY_STORED; i++ {
+		stats.AddTime(int64(i % 10))
+	}
+	if stats.Percentile(50) != 4 || stats.Histogram().Count() != 2*MAX_LATENCY_STORED {
+		t.Error("Percentiles should be computed over all values", stats.Percentile(50), stats.Histogram().Count())
+	}
+	if !strings.Contains(stats.Report(), "p50 4, p90 8, p99 9, max 9") {
+		t.Error("Report should contain the percentiles")
+	}
+
+	buf := new(bytes.Buffer)
+	WriteTimeStatisticsPrometheus(buf, "prifi_relay", map[string]*TimeStatistics{"round-duration": stats})
+	if !strings.Contains(buf.String(), "prifi_relay_time_ms_count{measure=\"round-duration\"} 200") {
+		t.Error("Wrong export", buf.String())
+	}
+}
@@ -4,18 +4,14 @@ import (
 	"encoding/binary"
 	"strconv"
 	"time"
+
+	"go.dedis.ch/onet/v3/log"
 )
 
-const pattern uint16 = uint16(43690) //1010101010101010
-const latencyMsgLength int = 12      // 4bytes roundID + 8bytes timeStamp
+// LATENCY_PROBE_PATTERN starts the upstream payloads which are latency probes; the relay echoes them downstream
+const LATENCY_PROBE_PATTERN uint16 = 0xAAAA // 1010101010101010
 
-// Regroups the information about doing latency tests
-type LatencyTests struct {
-	DoLatencyTests       bool
-	LatencyTestsInterval time.Duration
-	NextLatencyTest      time.Time
-	LatencyTestsToSend   []*LatencyTestToSend
-}
+const latencyMsgLength int = 12 // 4bytes roundID + 8bytes timeStamp
 
 // One buffered latency test message. We only need to store the "createdAt" time.
 type LatencyTestToSend struct {
@@ -37,7 +33,8 @@ func LatencyMessagesToBytes(msgs []*LatencyTestToSend, clientID int, roundID int
 	}
 
 	if payLoadLength < 18 {
-		panic("Trying to do a Latency test, but payload is smaller than 18 bytes.")
+		log.Error("Trying to do a Latency test, but payload is smaller than 18 bytes.")
+		return make([]byte, 0), msgs
 	}
 
 	// [0:2] PATTERN
@@ -47,7 +44,7 @@ func LatencyMessagesToBytes(msgs []*LatencyTestToSend, clientID int, roundID int
 	// [10:18] Time of sending
 
 	buffer := make([]byte, payLoadLength)
-	binary.BigEndian.PutUint16(buffer[0:2], pattern)
+	binary.BigEndian.PutUint16(buffer[0:2], LATENCY_PROBE_PATTERN)
 	//later, put number of messages in [2;4]
 	binary.BigEndian.PutUint16(buffer[4:6], uint16(clientID))
 	posInBuffer := 6
@@ -86,15 +83,19 @@ func LatencyMessagesToBytes(msgs []*LatencyTestToSend, clientID int, roundID int
 func DecodeLatencyMessages(buffer []byte, clientID int, receptionRoundID int32, actionFunction func(int32, int32, int64)) {
 
 	//check if it is a latency message
+	if len(buffer) < 6 {
+		return
+	}
 	patternComp := uint16(binary.BigEndian.Uint16(buffer[0:2]))
-	if patternComp != pattern {
+	if patternComp != LATENCY_PROBE_PATTERN {
 		return
 	}
 
 	//get the number of timestamps, and check the size
 	nMessages := int(binary.BigEndian.Uint16(buffer[2:4]))
-	if 4+(nMessages)*latencyMsgLength > len(buffer) {
-		panic("Invalid message, " + strconv.Itoa(nMessages) + " msg, but size is " + strconv.Itoa(len(buffer)))
+	if 6+(nMessages)*latencyMsgLength > len(buffer) {
+		log.Error("Invalid latency message, " + strconv.Itoa(nMessages) + " msg, but size is " + strconv.Itoa(len(buffer)))
+		return
 	}
 
 	//check that it is our messages
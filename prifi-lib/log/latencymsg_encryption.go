@@ -0,0 +1,101 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Layout of an encrypted latency message:
+// [0:2] PATTERN, so the relay still recognizes (and echoes) the message
+// [2:4] 0, i.e., "zero messages", so that clients decoding in cleartext ignore it
+// [4:6] length of the ciphertext
+// [6:18] nonce
+// [18:] ciphertext of a cleartext latency message (see LatencyMessagesToBytes), with its 16-bytes tag
+const latencyNonceLength = 12
+const latencyHeaderLength = 6 + latencyNonceLength
+
+// LATENCY_ENCRYPTION_OVERHEAD is the number of bytes an encrypted latency message takes on top of a cleartext one
+const LATENCY_ENCRYPTION_OVERHEAD = latencyHeaderLength + 16
+
+// LatencyProbeCipher encrypts and authenticates the latency messages of one client. Since the client which sends a
+// probe is the one which receives its echo, the key is random and never leaves the client. The relay still learns
+// that a cell is a probe (it has to, to echo it), but it cannot read, forge nor replay the timestamps it contains.
+type LatencyProbeCipher struct {
+	aead               cipher.AEAD
+	lastDecodedRoundID int32
+}
+
+// NewLatencyProbeCipher creates a LatencyProbeCipher with a fresh random key
+func NewLatencyProbeCipher() (*LatencyProbeCipher, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LatencyProbeCipher{aead: aead, lastDecodedRoundID: -1}, nil
+}
+
+// LatencyMessagesToBytes is like the cleartext LatencyMessagesToBytes, but encrypts the result. The payload must
+// hold at least 18+LATENCY_ENCRYPTION_OVERHEAD bytes.
+func (c *LatencyProbeCipher) LatencyMessagesToBytes(msgs []*LatencyTestToSend, clientID int, roundID int32, payLoadLength int, reportFunction func(int64)) ([]byte, []*LatencyTestToSend) {
+	if len(msgs) == 0 {
+		return make([]byte, 0), msgs
+	}
+
+	if payLoadLength < 18+LATENCY_ENCRYPTION_OVERHEAD {
+		log.Error("Trying to do an encrypted Latency test, but payload is smaller than 52 bytes.")
+		return make([]byte, 0), msgs
+	}
+
+	plaintext, msgs := LatencyMessagesToBytes(msgs, clientID, roundID, payLoadLength-LATENCY_ENCRYPTION_OVERHEAD, reportFunction)
+
+	buffer := make([]byte, latencyHeaderLength, payLoadLength)
+	binary.BigEndian.PutUint16(buffer[0:2], LATENCY_PROBE_PATTERN)
+	binary.BigEndian.PutUint16(buffer[4:6], uint16(len(plaintext)+c.aead.Overhead()))
+	if _, err := rand.Read(buffer[6:latencyHeaderLength]); err != nil {
+		log.Error("Could not generate a nonce for a latency message, " + err.Error())
+		return make([]byte, 0), msgs
+	}
+	buffer = c.aead.Seal(buffer, buffer[6:latencyHeaderLength], plaintext, buffer[0:6])
+
+	return buffer, msgs
+}
+
+// DecodeLatencyMessages is like the cleartext DecodeLatencyMessages, for messages encrypted by this cipher. Messages
+// which do not decrypt (not ours, or tampered with), or which are not more recent than the last decoded one
+// (replayed), are ignored.
+func (c *LatencyProbeCipher) DecodeLatencyMessages(buffer []byte, clientID int, receptionRoundID int32, actionFunction func(int32, int32, int64)) {
+	if len(buffer) < latencyHeaderLength || binary.BigEndian.Uint16(buffer[0:2]) != LATENCY_PROBE_PATTERN || binary.BigEndian.Uint16(buffer[2:4]) != 0 {
+		return
+	}
+	ciphertextLength := int(binary.BigEndian.Uint16(buffer[4:6]))
+	if latencyHeaderLength+ciphertextLength > len(buffer) {
+		return
+	}
+
+	plaintext, err := c.aead.Open(nil, buffer[6:latencyHeaderLength], buffer[latencyHeaderLength:latencyHeaderLength+ciphertextLength], buffer[0:6])
+	if err != nil || len(plaintext) < 6 {
+		return
+	}
+
+	// all the messages of a buffer were sent in the same round
+	if binary.BigEndian.Uint16(plaintext[2:4]) > 0 {
+		originalRoundID := int32(binary.BigEndian.Uint32(plaintext[6:10]))
+		if originalRoundID <= c.lastDecodedRoundID {
+			return
+		}
+		c.lastDecodedRoundID = originalRoundID
+	}
+	DecodeLatencyMessages(plaintext, clientID, receptionRoundID, actionFunction)
+}
@@ -9,17 +9,17 @@ import (
 
 func TestLatencyMessages(t *testing.T) {
 
-	latencyTests := &LatencyTests{}
+	latencyTestsToSend := make([]*LatencyTestToSend, 0)
 
 	now := time.Now()
 	newLatTest := &LatencyTestToSend{
 		CreatedAt: now.Add(-10 * time.Second),
 	}
-	latencyTests.LatencyTestsToSend = append(latencyTests.LatencyTestsToSend, newLatTest)
+	latencyTestsToSend = append(latencyTestsToSend, newLatTest)
 	newLatTest = &LatencyTestToSend{
 		CreatedAt: now.Add(-1 * time.Second),
 	}
-	latencyTests.LatencyTestsToSend = append(latencyTests.LatencyTestsToSend, newLatTest)
+	latencyTestsToSend = append(latencyTestsToSend, newLatTest)
 
 	clientID := 2
 	roundID := int32(4)
@@ -27,8 +27,10 @@ func TestLatencyMessages(t *testing.T) {
 	logFn := func(timeDiff int64) {
 		fmt.Println(timeDiff)
 	}
-	bytes, outMsgs := LatencyMessagesToBytes(latencyTests.LatencyTestsToSend, clientID, roundID, payloadLength, logFn)
-	latencyTests.LatencyTestsToSend = outMsgs
+	bytes, outMsgs := LatencyMessagesToBytes(latencyTestsToSend, clientID, roundID, payloadLength, logFn)
+	if len(outMsgs) != 0 {
+		t.Error("Both messages should fit in the payload")
+	}
 
 	fmt.Println(hex.Dump(bytes))
 
@@ -38,3 +40,61 @@ func TestLatencyMessages(t *testing.T) {
 	receptionRoundID := int32(20)
 	DecodeLatencyMessages(bytes, clientID, receptionRoundID, actionFunction)
 }
+
+func TestEncryptedLatencyMessages(t *testing.T) {
+
+	cipher, err := NewLatencyProbeCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []*LatencyTestToSend{{CreatedAt: time.Now()}, {CreatedAt: time.Now()}}
+	clientID := 2
+	payloadLength := 100
+	logFn := func(timeDiff int64) {}
+
+	bytes, outMsgs := cipher.LatencyMessagesToBytes(msgs, clientID, int32(4), payloadLength, logFn)
+	if len(outMsgs) != 0 || len(bytes) > payloadLength {
+		t.Error("Should have packed both messages in", payloadLength, "bytes")
+	}
+
+	decoded := 0
+	actionFunction := func(roundRec int32, roundDiff int32, timeDiff int64) {
+		if roundRec != 4 || roundDiff != 16 {
+			t.Error("Wrong round", roundRec, roundDiff)
+		}
+		decoded++
+	}
+
+	// the relay only sees the pattern, and clients decoding in cleartext ignore the message
+	DecodeLatencyMessages(bytes, clientID, int32(20), actionFunction)
+	if decoded != 0 {
+		t.Error("An encrypted message should not decode in cleartext")
+	}
+
+	// another key cannot open it
+	other, _ := NewLatencyProbeCipher()
+	other.DecodeLatencyMessages(bytes, clientID, int32(20), actionFunction)
+	if decoded != 0 {
+		t.Error("An encrypted message should not decode under another key")
+	}
+
+	// a tampered message is ignored
+	tampered := make([]byte, len(bytes))
+	copy(tampered, bytes)
+	tampered[len(tampered)-1] ^= 1
+	cipher.DecodeLatencyMessages(tampered, clientID, int32(20), actionFunction)
+	if decoded != 0 {
+		t.Error("A tampered message should be ignored")
+	}
+
+	cipher.DecodeLatencyMessages(bytes, clientID, int32(20), actionFunction)
+	if decoded != 2 {
+		t.Error("Should have decoded 2 messages, got", decoded)
+	}
+
+	// a replayed message is ignored
+	cipher.DecodeLatencyMessages(bytes, clientID, int32(21), actionFunction)
+	if decoded != 2 {
+		t.Error("A replayed message should be ignored")
+	}
+}
@@ -1,7 +1,10 @@
 package log
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBWStatistics(t *testing.T) {
@@ -13,6 +16,89 @@ func TestBWStatistics(t *testing.T) {
 	b.Report()
 	b.Dump()
 }
+
+func TestBWStatisticsWindows(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBitRateStatistics(1000)
+	b.now = func() time.Time { return now }
+
+	// 2 cells in second 1000, 1 in second 995, 1 in second 900 (out of all windows)
+	b.AddUpstreamCell(1000)
+	b.AddUpstreamCell(1000)
+	b.AddDownstreamCell(500)
+	now = time.Unix(995, 0)
+	b.AddUpstreamCell(2000)
+	now = time.Unix(900, 0)
+	b.AddUpstreamCell(4000)
+	now = time.Unix(1001, 0)
+	b.AddDownstreamUDPCell(100, 2) // current second, not counted yet
+
+	windows := b.Windows()
+	if len(windows) != len(BITRATE_WINDOWS) {
+		t.Fatal("Wrong number of windows", windows)
+	}
+	if windows[0].RoundsPerSec != 2 || windows[0].UpstreamBytesPerSec != 2000 || windows[0].DownstreamBytesPerSec != 500 {
+		t.Error("Wrong 1s window", windows[0])
+	}
+	if windows[1].RoundsPerSec != 0.3 || windows[1].UpstreamBytesPerSec != 400 {
+		t.Error("Wrong 10s window", windows[1])
+	}
+	if windows[2].UpstreamBytesPerSec != float64(4000)/60 {
+		t.Error("Wrong 60s window", windows[2])
+	}
+
+	b.AddClientBytes(0, 100)
+	b.AddClientBytes(1, 50)
+	b.AddClientBytes(0, 100)
+	b.AddTrusteeBytes(0, 10)
+	r := b.Structured()
+	if r.ClientBytes[0] != 200 || r.ClientBytes[1] != 50 || r.TrusteeBytes[0] != 10 {
+		t.Error("Wrong per-entity bytes", r)
+	}
+	if r.TotalUpstreamCells != 4 || r.TotalUpstreamBytes != 8000 || r.TotalDownstreamBytes != 600 {
+		t.Error("Wrong totals", r)
+	}
+
+	report := b.Report()
+	for _, e := range []string{"\"up_kbps_10s\"=\"0.4\"", "\"client_0_bytes\"=\"200\"", "\"trustee_0_bytes\"=\"10\" }"} {
+		if !strings.Contains(report, e) {
+			t.Error("Report should contain", e, report)
+		}
+	}
+}
+
+func TestBWStatisticsPrometheus(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBitRateStatistics(1000)
+	b.now = func() time.Time { return now }
+	b.AddUpstreamCell(1000)
+	b.AddDownstreamCell(500)
+	b.AddDownstreamUDPCell(200, 2)
+	b.AddClientBytes(1, 300)
+	b.AddTrusteeBytes(0, 40)
+	now = time.Unix(1001, 0)
+
+	buf := new(bytes.Buffer)
+	if err := b.WritePrometheus(buf, "prifi_relay"); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{
+		"prifi_relay_upstream_cells_total 1\n",
+		"prifi_relay_upstream_bytes_total 1000\n",
+		"prifi_relay_downstream_bytes_total{transport=\"tcp\"} 500\n",
+		"prifi_relay_downstream_bytes_total{transport=\"udp\"} 200\n",
+		"prifi_relay_cipher_bytes_total{kind=\"client\",id=\"1\"} 300\n",
+		"prifi_relay_cipher_bytes_total{kind=\"trustee\",id=\"0\"} 40\n",
+		"prifi_relay_upstream_bytes_per_second{window=\"1s\"} 1000\n",
+		"prifi_relay_downstream_bytes_per_second{window=\"10s\"} 70\n",
+		"# TYPE prifi_relay_rounds_per_second gauge\n",
+	} {
+		if !strings.Contains(buf.String(), e) {
+			t.Error("The metrics should contain", e, buf.String())
+		}
+	}
+}
+
 func TestLatencyStatistics(t *testing.T) {
 	b := NewTimeStatistics()
 	b.AddTime(int64(1000))
@@ -0,0 +1,153 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// MESSAGE_LATENCY_BUCKETS_US are the upper bounds (in microseconds) of the processing-time histogram buckets.
+// The last, implicit bucket is +Inf.
+var MESSAGE_LATENCY_BUCKETS_US = []int64{10, 100, 1000, 10000, 100000, 1000000}
+
+// MessageTypeStatistics holds the statistics for one message type
+type MessageTypeStatistics struct {
+	Count           int64
+	Errors          int64
+	TotalDurationUs int64
+	Histogram       []int64 // Histogram[i] is the number of messages processed in <= MESSAGE_LATENCY_BUCKETS_US[i] (not cumulative); the last one is +Inf
+}
+
+// MessageStatistics holds the processing statistics (count, errors, latency histogram) of each message type.
+// Contrarily to the other statistics, it is safe to use from several goroutines, since it is read by the metrics endpoint.
+type MessageStatistics struct {
+	sync.Mutex
+	begin      time.Time
+	nextReport time.Time
+	period     time.Duration
+	reportNo   int
+
+	perType map[string]*MessageTypeStatistics
+}
+
+// NewMessageStatistics creates a new MessageStatistics struct, with a period (for reporting) of 5 second
+func NewMessageStatistics() *MessageStatistics {
+	now := time.Now()
+	return &MessageStatistics{
+		begin:      now,
+		nextReport: now,
+		period:     time.Duration(5) * time.Second,
+		perType:    make(map[string]*MessageTypeStatistics),
+	}
+}
+
+// AddMessage records that a message of type msgType was processed in duration, and whether it failed
+func (stats *MessageStatistics) AddMessage(msgType string, duration time.Duration, failed bool) {
+	stats.Lock()
+	defer stats.Unlock()
+
+	s, ok := stats.perType[msgType]
+	if !ok {
+		s = &MessageTypeStatistics{Histogram: make([]int64, len(MESSAGE_LATENCY_BUCKETS_US)+1)}
+		stats.perType[msgType] = s
+	}
+
+	us := duration.Nanoseconds() / 1e3
+	s.Count++
+	s.TotalDurationUs += us
+	if failed {
+		s.Errors++
+	}
+	bucket := len(MESSAGE_LATENCY_BUCKETS_US)
+	for i, bound := range MESSAGE_LATENCY_BUCKETS_US {
+		if us <= bound {
+			bucket = i
+			break
+		}
+	}
+	s.Histogram[bucket]++
+}
+
+// Snapshot returns a copy of the statistics, by message type
+func (stats *MessageStatistics) Snapshot() map[string]MessageTypeStatistics {
+	stats.Lock()
+	defer stats.Unlock()
+
+	snapshot := make(map[string]MessageTypeStatistics, len(stats.perType))
+	for k, v := range stats.perType {
+		copied := *v
+		copied.Histogram = make([]int64, len(v.Histogram))
+		copy(copied.Histogram, v.Histogram)
+		snapshot[k] = copied
+	}
+	return snapshot
+}
+
+// Report prints (if t>period=5 seconds have passed since the last report) the count and mean processing time of each message type
+func (stats *MessageStatistics) Report() string {
+	stats.Lock()
+	now := time.Now()
+	if !now.After(stats.nextReport) {
+		stats.Unlock()
+		return ""
+	}
+	stats.nextReport = now.Add(stats.period)
+	reportNo := stats.reportNo
+	stats.reportNo++
+	stats.Unlock()
+
+	snapshot := stats.Snapshot()
+	str := fmt.Sprintf("[%v] Messages processed:", reportNo)
+	for _, k := range sortedKeys(snapshot) {
+		v := snapshot[k]
+		str += fmt.Sprintf(" %s=%v (%v errors, mean %v us)", k, v.Count, v.Errors, v.TotalDurationUs/v.Count)
+	}
+	log.Lvl2(str)
+	return str
+}
+
+// WritePrometheus writes the statistics in the Prometheus text exposition format, with the given metric prefix
+func (stats *MessageStatistics) WritePrometheus(w io.Writer, prefix string) error {
+	snapshot := stats.Snapshot()
+	keys := sortedKeys(snapshot)
+
+	if _, err := fmt.Fprintf(w, "# TYPE %s_messages_total counter\n", prefix); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s_messages_total{type=\"%s\"} %v\n", prefix, k, snapshot[k].Count)
+	}
+	fmt.Fprintf(w, "# TYPE %s_message_errors_total counter\n", prefix)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s_message_errors_total{type=\"%s\"} %v\n", prefix, k, snapshot[k].Errors)
+	}
+	fmt.Fprintf(w, "# TYPE %s_message_processing_seconds histogram\n", prefix)
+	for _, k := range keys {
+		v := snapshot[k]
+		cumulative := int64(0)
+		for i, bound := range MESSAGE_LATENCY_BUCKETS_US {
+			cumulative += v.Histogram[i]
+			fmt.Fprintf(w, "%s_message_processing_seconds_bucket{type=\"%s\",le=\"%g\"} %v\n", prefix, k, float64(bound)/1e6, cumulative)
+		}
+		fmt.Fprintf(w, "%s_message_processing_seconds_bucket{type=\"%s\",le=\"+Inf\"} %v\n", prefix, k, v.Count)
+		fmt.Fprintf(w, "%s_message_processing_seconds_sum{type=\"%s\"} %g\n", prefix, k, float64(v.TotalDurationUs)/1e6)
+		_, err := fmt.Fprintf(w, "%s_message_processing_seconds_count{type=\"%s\"} %v\n", prefix, k, v.Count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]MessageTypeStatistics) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,57 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageStatistics(t *testing.T) {
+
+	stats := NewMessageStatistics()
+	stats.AddMessage("CLI_REL_UPSTREAM_DATA", 5*time.Microsecond, false)
+	stats.AddMessage("CLI_REL_UPSTREAM_DATA", 2*time.Millisecond, false)
+	stats.AddMessage("TRU_REL_DC_CIPHER", 10*time.Second, true)
+
+	snapshot := stats.Snapshot()
+	up := snapshot["CLI_REL_UPSTREAM_DATA"]
+	if up.Count != 2 || up.Errors != 0 || up.TotalDurationUs != 2005 {
+		t.Error("Wrong statistics for CLI_REL_UPSTREAM_DATA", up)
+	}
+	if up.Histogram[0] != 1 || up.Histogram[3] != 1 {
+		t.Error("Wrong histogram for CLI_REL_UPSTREAM_DATA", up.Histogram)
+	}
+	cipher := snapshot["TRU_REL_DC_CIPHER"]
+	if cipher.Errors != 1 || cipher.Histogram[len(MESSAGE_LATENCY_BUCKETS_US)] != 1 {
+		t.Error("Wrong statistics for TRU_REL_DC_CIPHER", cipher)
+	}
+
+	// the snapshot is a copy
+	up.Histogram[0] = 100
+	if stats.Snapshot()["CLI_REL_UPSTREAM_DATA"].Histogram[0] != 1 {
+		t.Error("Snapshot should not share the histogram")
+	}
+
+	if stats.Report() == "" {
+		t.Error("First report should not be empty")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := stats.WritePrometheus(buf, "prifi_relay"); err != nil {
+		t.Error(err)
+	}
+	out := buf.String()
+	expected := []string{
+		"prifi_relay_messages_total{type=\"CLI_REL_UPSTREAM_DATA\"} 2",
+		"prifi_relay_message_errors_total{type=\"TRU_REL_DC_CIPHER\"} 1",
+		"prifi_relay_message_processing_seconds_bucket{type=\"CLI_REL_UPSTREAM_DATA\",le=\"0.01\"} 2",
+		"prifi_relay_message_processing_seconds_bucket{type=\"TRU_REL_DC_CIPHER\",le=\"1\"} 0",
+		"prifi_relay_message_processing_seconds_count{type=\"TRU_REL_DC_CIPHER\"} 1",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Error("Metrics output should contain", e)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package log
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The modules whose log level can be set on their own
+const (
+	MODULE_RELAY     = "relay"     // the relay's protocol logic
+	MODULE_DCNET     = "dcnet"     // the DC-net ciphers, per round
+	MODULE_SCHEDULER = "scheduler" // the slots, the open-closed map and the schedules
+	MODULE_SOCKS     = "socks"     // the SOCKS ingress and egress servers
+	MODULE_NET       = "net"       // the transport of the messages (SDA, UDP, fast channels)
+)
+
+// MODULES lists the modules, in the order of the reports
+var MODULES = []string{MODULE_RELAY, MODULE_DCNET, MODULE_SCHEDULER, MODULE_SOCKS, MODULE_NET}
+
+// moduleLevels holds the level of the modules which do not use the global level (log.DebugVisible())
+var moduleLevels = struct {
+	sync.RWMutex
+	levels map[string]int
+}{levels: make(map[string]int)}
+
+// ModuleLogger logs like onet's log.LvlX, at the level of its module if it has one, else at the global level
+type ModuleLogger struct {
+	module string
+}
+
+// NewModuleLogger returns the logger of module
+func NewModuleLogger(module string) ModuleLogger {
+	return ModuleLogger{module: module}
+}
+
+// ModuleLevel returns the level of module, and false if it uses the global level
+func ModuleLevel(module string) (int, bool) {
+	moduleLevels.RLock()
+	defer moduleLevels.RUnlock()
+	lvl, ok := moduleLevels.levels[module]
+	return lvl, ok
+}
+
+// SetModuleLevel sets the level of module; a negative level makes it use the global level again
+func SetModuleLevel(module string, lvl int) error {
+	return UpdateModuleLevels(map[string]int{module: lvl})
+}
+
+// UpdateModuleLevels sets the level of each module of changes, a negative level making it use the global level
+// again. The other modules keep their level. Nothing is changed if one of the changes is invalid.
+func UpdateModuleLevels(changes map[string]int) error {
+	for module, lvl := range changes {
+		if !isModule(module) {
+			return errors.New("unknown log module \"" + module + "\", should be one of " + strings.Join(MODULES, ", "))
+		}
+		if lvl > 5 {
+			return errors.New("log level " + strconv.Itoa(lvl) + " of module " + module + " is above 5")
+		}
+	}
+	moduleLevels.Lock()
+	defer moduleLevels.Unlock()
+	for module, lvl := range changes {
+		if lvl < 0 {
+			delete(moduleLevels.levels, module)
+		} else {
+			moduleLevels.levels[module] = lvl
+		}
+	}
+	return nil
+}
+
+// EffectiveModuleLevels returns the level used by each module, whether it is its own or the global one
+func EffectiveModuleLevels() map[string]int {
+	levels := make(map[string]int, len(MODULES))
+	for _, module := range MODULES {
+		lvl, ok := ModuleLevel(module)
+		if !ok {
+			lvl = log.DebugVisible()
+		}
+		levels[module] = lvl
+	}
+	return levels
+}
+
+// SetModuleLevels sets the levels given as "module=level,module=level"; the modules not listed use the global level.
+// Nothing is changed if the string is invalid.
+func SetModuleLevels(s string) error {
+	levels, err := ParseModuleLevels(s)
+	if err != nil {
+		return err
+	}
+	moduleLevels.Lock()
+	defer moduleLevels.Unlock()
+	moduleLevels.levels = levels
+	return nil
+}
+
+// ParseModuleLevels parses "module=level,module=level", e.g. "scheduler=4,dcnet=1"
+func ParseModuleLevels(s string) (map[string]int, error) {
+	levels := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("log level \"" + entry + "\" should be module=level")
+		}
+		module := strings.TrimSpace(kv[0])
+		if !isModule(module) {
+			return nil, errors.New("unknown log module \"" + module + "\", should be one of " + strings.Join(MODULES, ", "))
+		}
+		lvl, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || lvl < 0 || lvl > 5 {
+			return nil, errors.New("log level of module " + module + " should be between 0 and 5, is \"" + kv[1] + "\"")
+		}
+		levels[module] = lvl
+	}
+	return levels, nil
+}
+
+// ModuleLevelsString prints the levels of the modules which do not use the global level, e.g. "scheduler=4"
+func ModuleLevelsString() string {
+	moduleLevels.RLock()
+	defer moduleLevels.RUnlock()
+	entries := make([]string, 0, len(moduleLevels.levels))
+	for module, lvl := range moduleLevels.levels {
+		entries = append(entries, module+"="+strconv.Itoa(lvl))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func isModule(module string) bool {
+	for _, m := range MODULES {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible returns true if the messages of level lvl are shown for this module
+func (l ModuleLogger) Visible(lvl int) bool {
+	level, ok := ModuleLevel(l.module)
+	if !ok {
+		level = log.DebugVisible()
+	}
+	return lvl <= level
+}
+
+// Lvl1 logs at level 1 for this module
+func (l ModuleLogger) Lvl1(args ...interface{}) {
+	if l.Visible(1) {
+		log.LLvl1(args...)
+	}
+}
+
+// Lvl2 logs at level 2 for this module
+func (l ModuleLogger) Lvl2(args ...interface{}) {
+	if l.Visible(2) {
+		log.LLvl2(args...)
+	}
+}
+
+// Lvl3 logs at level 3 for this module
+func (l ModuleLogger) Lvl3(args ...interface{}) {
+	if l.Visible(3) {
+		log.LLvl3(args...)
+	}
+}
+
+// Lvl4 logs at level 4 for this module
+func (l ModuleLogger) Lvl4(args ...interface{}) {
+	if l.Visible(4) {
+		log.LLvl4(args...)
+	}
+}
+
+// Lvl5 logs at level 5 for this module
+func (l ModuleLogger) Lvl5(args ...interface{}) {
+	if l.Visible(5) {
+		log.LLvl5(args...)
+	}
+}
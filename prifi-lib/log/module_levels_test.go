@@ -0,0 +1,56 @@
+package log
+
+import (
+	"testing"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestModuleLevels(t *testing.T) {
+	defer SetModuleLevels("")
+	global := log.DebugVisible()
+	defer log.SetDebugVisible(global)
+	log.SetDebugVisible(2)
+
+	scheduler := NewModuleLogger(MODULE_SCHEDULER)
+	dcnet := NewModuleLogger(MODULE_DCNET)
+	if scheduler.Visible(3) || !dcnet.Visible(2) {
+		t.Error("Without their own level, the modules should use the global level")
+	}
+
+	if err := SetModuleLevels(" scheduler=4, dcnet=0 "); err != nil {
+		t.Fatal(err)
+	}
+	if !scheduler.Visible(4) || scheduler.Visible(5) || dcnet.Visible(1) {
+		t.Error("The modules should use their own level")
+	}
+	if s := ModuleLevelsString(); s != "dcnet=0,scheduler=4" {
+		t.Error("Wrong levels", s)
+	}
+	if levels := EffectiveModuleLevels(); levels[MODULE_RELAY] != 2 || levels[MODULE_SCHEDULER] != 4 {
+		t.Error("Wrong effective levels", levels)
+	}
+
+	// one invalid change cancels the others
+	if err := UpdateModuleLevels(map[string]int{MODULE_DCNET: -1, "nope": 1}); err == nil {
+		t.Error("An unknown module should be refused")
+	}
+	if lvl, ok := ModuleLevel(MODULE_DCNET); !ok || lvl != 0 {
+		t.Error("dcnet should still be at level 0")
+	}
+	if err := UpdateModuleLevels(map[string]int{MODULE_DCNET: -1, MODULE_SOCKS: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if s := ModuleLevelsString(); s != "scheduler=4,socks=1" {
+		t.Error("Wrong levels", s)
+	}
+
+	for _, s := range []string{"scheduler", "scheduler=6", "scheduler=-1", "scheduler=x", "sched=2"} {
+		if err := SetModuleLevels(s); err == nil {
+			t.Error("Levels", s, "should be refused")
+		}
+	}
+	if s := ModuleLevelsString(); s != "scheduler=4,socks=1" {
+		t.Error("Invalid levels should not change anything, got", s)
+	}
+}
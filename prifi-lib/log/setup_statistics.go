@@ -0,0 +1,155 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The phases of a setup of the relay, in order. A rekeying (clients joining or leaving, epoch rotation) starts at the
+// shuffle, the keys of the clients being collected during the previous schedule.
+const (
+	SETUP_KEY_COLLECTION = "key-collection" // until the relay has the public keys of every trustee and client
+	SETUP_SHUFFLE        = "shuffle"        // the Neff shuffles of the trustees
+	SETUP_SIGNATURES     = "signatures"     // the signatures of the transcript, until the schedule is sent to the clients
+	SETUP_FIRST_ROUND    = "first-round"    // the first round of the schedule, in which the clients verify it
+)
+
+// SETUP_TOTAL is the measure of the whole setups
+const SETUP_TOTAL = "total"
+
+// SETUP_PHASES are the phases of a setup, in order
+var SETUP_PHASES = []string{SETUP_KEY_COLLECTION, SETUP_SHUFFLE, SETUP_SIGNATURES, SETUP_FIRST_ROUND}
+
+// SetupStatistics measures the setups (the key collection, the shuffle and the signatures) apart from the rounds of
+// the schedules they produce, so that the round statistics only cover the steady state
+type SetupStatistics struct {
+	sync.Mutex
+	times  map[string]*TimeStatistics // in ms, per phase and for the whole setups (SETUP_TOTAL)
+	setups int
+
+	// the setup in progress
+	inProgress bool
+	started    time.Time
+	phase      string
+	phaseStart time.Time
+	durations  []string // "<phase> <ms> ms", for the report
+}
+
+// NewSetupStatistics returns the statistics of no setup
+func NewSetupStatistics() *SetupStatistics {
+	s := &SetupStatistics{times: make(map[string]*TimeStatistics)}
+	for _, phase := range append(SETUP_PHASES, SETUP_TOTAL) {
+		s.times[phase] = NewTimeStatistics()
+	}
+	return s
+}
+
+// StartSetup starts a new setup at phase, discarding the one in progress if any (e.g. after a resync)
+func (s *SetupStatistics) StartSetup(phase string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.startSetup(phase, now)
+}
+
+func (s *SetupStatistics) startSetup(phase string, now time.Time) {
+	s.inProgress = true
+	s.started = now
+	s.phase = phase
+	s.phaseStart = now
+	s.durations = make([]string, 0, len(SETUP_PHASES))
+}
+
+// StartPhase ends the current phase of the setup in progress, and starts phase; it starts a setup if none is in
+// progress
+func (s *SetupStatistics) StartPhase(phase string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.inProgress {
+		s.startSetup(phase, now)
+		return
+	}
+	s.endPhase(now)
+	s.phase = phase
+	s.phaseStart = now
+}
+
+// endPhase records the duration of the current phase
+func (s *SetupStatistics) endPhase(now time.Time) {
+	ms := now.Sub(s.phaseStart).Nanoseconds() / 1e6
+	s.times[s.phase].AddTime(ms)
+	s.durations = append(s.durations, fmt.Sprintf("%s %d ms", s.phase, ms))
+}
+
+// EndSetup ends the setup in progress, and returns its report; "" if no setup is in progress
+func (s *SetupStatistics) EndSetup(now time.Time) string {
+	s.Lock()
+	defer s.Unlock()
+	if !s.inProgress {
+		return ""
+	}
+	s.endPhase(now)
+	s.inProgress = false
+	s.setups++
+
+	total := now.Sub(s.started).Nanoseconds() / 1e6
+	s.times[SETUP_TOTAL].AddTime(total)
+	return fmt.Sprintf("Setup: #%d in %d ms (%s)", s.setups, total, strings.Join(s.durations, ", "))
+}
+
+// InProgress returns true between the start and the end of a setup
+func (s *SetupStatistics) InProgress() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.inProgress
+}
+
+// Setups returns the number of setups done
+func (s *SetupStatistics) Setups() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.setups
+}
+
+// Percentile returns the p-th percentile of the durations of phase (or SETUP_TOTAL), in ms
+func (s *SetupStatistics) Percentile(phase string, p float64) int64 {
+	s.Lock()
+	defer s.Unlock()
+	if stats, found := s.times[phase]; found {
+		return stats.Percentile(p)
+	}
+	return 0
+}
+
+// Summaries returns the summary of the durations of each phase, and of the whole setups (SETUP_TOTAL), in ms
+func (s *SetupStatistics) Summaries() map[string]TimeSummary {
+	s.Lock()
+	defer s.Unlock()
+	summaries := make(map[string]TimeSummary, len(s.times))
+	for phase, stats := range s.times {
+		summaries[phase] = stats.Summary()
+	}
+	return summaries
+}
+
+// WritePrometheus writes the number of setups, and the histograms of the durations of their phases, in the
+// Prometheus text format
+func (s *SetupStatistics) WritePrometheus(w io.Writer, prefix string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# TYPE %s_setups_total counter\n%s_setups_total %v\n", prefix, prefix, s.setups); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "# TYPE %s_setup_time_ms histogram\n", prefix); err != nil {
+		return err
+	}
+	for _, phase := range append(SETUP_PHASES, SETUP_TOTAL) {
+		if err := s.times[phase].Histogram().WritePrometheus(w, prefix+"_setup_time_ms", "phase=\""+phase+"\""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
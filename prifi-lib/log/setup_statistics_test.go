@@ -0,0 +1,66 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupStatistics(t *testing.T) {
+	s := NewSetupStatistics()
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	if s.EndSetup(at(0)) != "" || s.InProgress() {
+		t.Error("No setup should be in progress")
+	}
+
+	// the first setup
+	s.StartSetup(SETUP_KEY_COLLECTION, at(0))
+	s.StartPhase(SETUP_SHUFFLE, at(100))
+	s.StartPhase(SETUP_SIGNATURES, at(400))
+	s.StartPhase(SETUP_FIRST_ROUND, at(450))
+	report := s.EndSetup(at(500))
+	if report != "Setup: #1 in 500 ms (key-collection 100 ms, shuffle 300 ms, signatures 50 ms, first-round 50 ms)" {
+		t.Error("Wrong report", report)
+	}
+
+	// a rekeying starts at the shuffle
+	s.StartPhase(SETUP_SHUFFLE, at(1000))
+	if !s.InProgress() {
+		t.Error("The shuffle should start a setup")
+	}
+	s.StartPhase(SETUP_SIGNATURES, at(1200))
+	s.StartPhase(SETUP_FIRST_ROUND, at(1300))
+	report = s.EndSetup(at(1310))
+	if !strings.HasPrefix(report, "Setup: #2 in 310 ms (shuffle 200 ms,") || s.Setups() != 2 {
+		t.Error("Wrong report", report)
+	}
+
+	// a resync discards the setup in progress
+	s.StartSetup(SETUP_KEY_COLLECTION, at(2000))
+	s.StartSetup(SETUP_KEY_COLLECTION, at(3000))
+	if report := s.EndSetup(at(3010)); !strings.HasPrefix(report, "Setup: #3 in 10 ms") {
+		t.Error("Wrong report", report)
+	}
+	if s.Percentile(SETUP_SHUFFLE, 100) != 300 || s.Percentile(SETUP_TOTAL, 100) != 500 {
+		t.Error("Wrong percentiles", s.Percentile(SETUP_SHUFFLE, 100), s.Percentile(SETUP_TOTAL, 100))
+	}
+
+	var b bytes.Buffer
+	if err := s.WritePrometheus(&b, "prifi_relay"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"prifi_relay_setups_total 3\n",
+		"prifi_relay_setup_time_ms_count{phase=\"shuffle\"} 2\n",
+		"prifi_relay_setup_time_ms_count{phase=\"total\"} 3\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Error("Missing", line, "in", b.String())
+		}
+	}
+}
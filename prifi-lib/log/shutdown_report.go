@@ -0,0 +1,132 @@
+package log
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// ShutdownReport is the final summary an entity emits when it shuts down, meant to be harvested by the experiment
+// scripts
+type ShutdownReport struct {
+	Entity        string
+	Abnormal      bool   // true if the entity was shut down because of a failure
+	Reason        string // why the entity was shut down
+	Rounds        int64
+	BytesUp       int64 // upstream bytes sent (clients, trustees) or decoded (relay)
+	BytesDown     int64 // downstream bytes received (clients) or sent (relay)
+	Errors        int64 // messages whose handling returned an error
+	Epochs        int   // number of times the entity was (re-)configured by an ALL_ALL_PARAMETERS
+	ConfigHash    string
+	UptimeSeconds float64
+	LatencyMs     *TimeSummary `json:",omitempty"` // the round-trip times of the latency probes of a client, if it does latency tests
+}
+
+// String returns the report as a single line of JSON
+func (r *ShutdownReport) String() string {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ExitCode returns the status a process should exit with after this report: 1 if the shutdown was abnormal, 0 otherwise
+func (r *ShutdownReport) ExitCode() int {
+	if r != nil && r.Abnormal {
+		return 1
+	}
+	return 0
+}
+
+// SessionSummary accumulates what goes in the ShutdownReport of an entity, over its whole life. It is safe to use from
+// several goroutines, since a shutdown can be triggered by a signal.
+type SessionSummary struct {
+	sync.Mutex
+	report    ShutdownReport
+	startedAt time.Time
+}
+
+// NewSessionSummary creates an empty SessionSummary, starting now
+func NewSessionSummary(entity string) *SessionSummary {
+	return &SessionSummary{
+		report:    ShutdownReport{Entity: entity, Reason: "requested"},
+		startedAt: time.Now(),
+	}
+}
+
+// SetEntity changes the name of the entity, e.g. when it learns its ID
+func (s *SessionSummary) SetEntity(entity string) {
+	s.Lock()
+	defer s.Unlock()
+	s.report.Entity = entity
+}
+
+// NewEpoch is called each time the entity is configured
+func (s *SessionSummary) NewEpoch(configHash string) {
+	s.Lock()
+	defer s.Unlock()
+	s.report.Epochs++
+	s.report.ConfigHash = configHash
+}
+
+// AddRound counts one more round
+func (s *SessionSummary) AddRound() {
+	s.Lock()
+	defer s.Unlock()
+	s.report.Rounds++
+}
+
+// AddBytes counts upstream and downstream bytes
+func (s *SessionSummary) AddBytes(up, down int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.report.BytesUp += up
+	s.report.BytesDown += down
+}
+
+// AddError counts one more message whose handling failed
+func (s *SessionSummary) AddError() {
+	s.Lock()
+	defer s.Unlock()
+	s.report.Errors++
+}
+
+// SetShutdownReason records why the entity shuts down; an abnormal reason is never overwritten by a normal one
+func (s *SessionSummary) SetShutdownReason(reason string, abnormal bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.report.Abnormal && !abnormal {
+		return
+	}
+	s.report.Reason = reason
+	s.report.Abnormal = abnormal
+}
+
+// Report returns the ShutdownReport as of now
+func (s *SessionSummary) Report() *ShutdownReport {
+	s.Lock()
+	defer s.Unlock()
+	r := s.report
+	r.UptimeSeconds = time.Since(s.startedAt).Seconds()
+	return &r
+}
+
+// MergeShutdownReports sums the totals of the reports of two consecutive sessions of an entity (e.g., two runs of the
+// protocol in the same process); the reason, configuration and name are the ones of the last session. Either can be nil.
+func MergeShutdownReports(previous, last *ShutdownReport) *ShutdownReport {
+	if previous == nil {
+		return last
+	}
+	if last == nil {
+		return previous
+	}
+	r := *last
+	r.Rounds += previous.Rounds
+	r.BytesUp += previous.BytesUp
+	r.BytesDown += previous.BytesDown
+	r.Errors += previous.Errors
+	r.Epochs += previous.Epochs
+	r.UptimeSeconds += previous.UptimeSeconds
+	return &r
+}
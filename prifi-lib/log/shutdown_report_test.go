@@ -0,0 +1,48 @@
+package log
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestShutdownReport(t *testing.T) {
+	s := NewSessionSummary("Client")
+	s.SetEntity("Client 3")
+	s.NewEpoch("abcd")
+	s.AddRound()
+	s.AddRound()
+	s.AddBytes(10, 20)
+	s.AddError()
+
+	r := s.Report()
+	if r.Entity != "Client 3" || r.Rounds != 2 || r.BytesUp != 10 || r.BytesDown != 20 || r.Errors != 1 || r.Epochs != 1 || r.ConfigHash != "abcd" {
+		t.Error("Wrong report", r)
+	}
+	if r.Abnormal || r.ExitCode() != 0 {
+		t.Error("A requested shutdown is normal")
+	}
+
+	decoded := new(ShutdownReport)
+	if err := json.Unmarshal([]byte(r.String()), decoded); err != nil || *decoded != *r {
+		t.Error("The report should be valid JSON", r.String(), err)
+	}
+
+	s.SetShutdownReason("too many consecutive failed rounds", true)
+	s.SetShutdownReason("requested", false)
+	r = s.Report()
+	if !r.Abnormal || r.Reason != "too many consecutive failed rounds" || r.ExitCode() != 1 {
+		t.Error("An abnormal reason should not be overwritten", r)
+	}
+
+	merged := MergeShutdownReports(r, NewSessionSummary("Client 3").Report())
+	if merged.Rounds != 2 || merged.Abnormal {
+		t.Error("Wrong merged report", merged)
+	}
+	if MergeShutdownReports(nil, r) != r || MergeShutdownReports(r, nil) != r {
+		t.Error("Merging with nil should return the other report")
+	}
+	var nilReport *ShutdownReport
+	if nilReport.ExitCode() != 0 {
+		t.Error("No report means a normal exit")
+	}
+}
@@ -2,6 +2,8 @@ package log
 
 import (
 	"fmt"
+	"io"
+	"sort"
 	"time"
 
 	"go.dedis.ch/onet/v3/log"
@@ -18,7 +20,8 @@ type TimeStatistics struct {
 	reportNo         int
 	totalValuesAdded int
 
-	times []int64
+	times     []int64    // the last MAX_LATENCY_STORED values, for the mean and confidence interval
+	histogram *Histogram // all the values, for the percentiles
 }
 
 //NewLatencyStatistics create a new LatencyStatistics struct, with a period (for reporting) of 5 second
@@ -31,7 +34,8 @@ func NewTimeStatistics() *TimeStatistics {
 		period:           fiveSec,
 		reportNo:         0,
 		totalValuesAdded: 0,
-		times:            make([]int64, 0)}
+		times:            make([]int64, 0),
+		histogram:        NewHistogram()}
 	return &stats
 }
 
@@ -52,6 +56,7 @@ func (stats *TimeStatistics) TimeStatistics() (string, string, string) {
 func (stats *TimeStatistics) AddTime(latency int64) {
 	stats.times = append(stats.times, latency)
 	stats.totalValuesAdded++
+	stats.histogram.Record(latency)
 
 	//we remove the first items
 	if len(stats.times) > MAX_LATENCY_STORED {
@@ -60,6 +65,39 @@ func (stats *TimeStatistics) AddTime(latency int64) {
 	}
 }
 
+// Percentile returns the p-th percentile of all the values added (not only the last MAX_LATENCY_STORED ones)
+func (stats *TimeStatistics) Percentile(p float64) int64 {
+	return stats.histogram.Percentile(p)
+}
+
+// TimeSummary summarizes all the values added to a TimeStatistics, in ms
+type TimeSummary struct {
+	Count int64
+	Mean  float64
+	P50   int64
+	P90   int64
+	P99   int64
+	Max   int64
+}
+
+// Summary returns the summary of all the values added; it only reads the histogram, so it can be called while
+// another goroutine adds values
+func (stats *TimeStatistics) Summary() TimeSummary {
+	return TimeSummary{
+		Count: stats.histogram.Count(),
+		Mean:  RoundWithPrecision(stats.histogram.Mean(), 2),
+		P50:   stats.histogram.Percentile(50),
+		P90:   stats.histogram.Percentile(90),
+		P99:   stats.histogram.Percentile(99),
+		Max:   stats.histogram.Max(),
+	}
+}
+
+// Histogram returns the histogram of all the values added
+func (stats *TimeStatistics) Histogram() *Histogram {
+	return stats.histogram
+}
+
 //Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
 func (stats *TimeStatistics) Report() string {
 	return stats.ReportWithInfo("")
@@ -73,7 +111,8 @@ func (stats *TimeStatistics) ReportWithInfo(info string) string {
 		mean, variance, n := stats.TimeStatistics()
 
 		//human-readable output
-		str := fmt.Sprintf("[%v] %s ms +- %s (over %s, happened %v). Info: %s", stats.reportNo, mean, variance, n, stats.totalValuesAdded, info)
+		str := fmt.Sprintf("[%v] %s ms +- %s (over %s, happened %v, p50 %v, p90 %v, p99 %v, max %v). Info: %s", stats.reportNo, mean, variance, n,
+			stats.totalValuesAdded, stats.Percentile(50), stats.Percentile(90), stats.Percentile(99), stats.histogram.Max(), info)
 
 		log.Lvl1(str)
 
@@ -88,3 +127,23 @@ func (stats *TimeStatistics) ReportWithInfo(info string) string {
 	}
 	return ""
 }
+
+// WriteTimeStatisticsPrometheus writes the histograms of the given statistics in the Prometheus text exposition format,
+// as the metric prefix_time_ms with the label measure=<key>
+func WriteTimeStatisticsPrometheus(w io.Writer, prefix string, stats map[string]*TimeStatistics) error {
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if _, err := fmt.Fprintf(w, "# TYPE %s_time_ms histogram\n", prefix); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := stats[k].histogram.WritePrometheus(w, prefix+"_time_ms", "measure=\""+k+"\""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
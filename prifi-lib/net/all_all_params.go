@@ -1,9 +1,31 @@
 package net
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
 	"go.dedis.ch/kyber/v3"
 )
 
+// the parameters which differ between the entities of a same session, or between the epochs of a same
+// configuration, and are not part of ConfigHash()
+var perEntityParameters = map[string]bool{
+	"NextFreeClientID":  true,
+	"NextFreeTrusteeID": true,
+	"StartNow":          true,
+	"RelayRandomBeacon": true,
+	"RandomBeacon":      true,
+}
+
+// the parameters which differ between the entities of a same epoch, and are not part of ParamsDigest()
+var entityIDParameters = map[string]bool{
+	"NextFreeClientID":  true,
+	"NextFreeTrusteeID": true,
+	"StartNow":          true,
+}
+
 // ALL_ALL_PARAMETERS message contains all the parameters used by the protocol.
 type ALL_ALL_PARAMETERS struct {
 	TrusteesPks []kyber.Point // only filled when the relay sends this to the clients
@@ -37,6 +59,24 @@ func (m *ALL_ALL_PARAMETERS) Add(key string, val interface{}) {
 
 }
 
+// Clone returns a copy of the parameters, which can be changed without changing these
+func (m *ALL_ALL_PARAMETERS) Clone() *ALL_ALL_PARAMETERS {
+	c := &ALL_ALL_PARAMETERS{ForceParams: m.ForceParams}
+	if m.TrusteesPks != nil {
+		c.TrusteesPks = append([]kyber.Point{}, m.TrusteesPks...)
+	}
+	for k, v := range m.ParamsInt {
+		c.Add(k, v)
+	}
+	for k, v := range m.ParamsStr {
+		c.Add(k, v)
+	}
+	for k, v := range m.ParamsBool {
+		c.Add(k, v)
+	}
+	return c
+}
+
 /**
  * From the message, returns the "data[key]" if it exists, or "elseVal"
  */
@@ -66,3 +106,43 @@ func (m *ALL_ALL_PARAMETERS) StringValueOrElse(key string, elseVal string) strin
 	}
 	return elseVal
 }
+
+// ConfigHash returns a short hash of the parameters, sorted by key, so that runs with the same configuration can be
+// grouped; the IDs given to the entities are not included
+func (m *ALL_ALL_PARAMETERS) ConfigHash() string {
+	return hex.EncodeToString(m.hashParameters(perEntityParameters)[:8])
+}
+
+// ParamsDigest returns the hash of the parameters, sorted by key, without the IDs given to the entities. Unlike
+// ConfigHash(), it covers the values which change at each epoch (e.g. the random beacon), so that the relay and a
+// client can check that they ended up with exactly the same parameters.
+func (m *ALL_ALL_PARAMETERS) ParamsDigest() []byte {
+	return m.hashParameters(entityIDParameters)
+}
+
+// hashParameters hashes the parameters, sorted by key, except the excluded ones
+func (m *ALL_ALL_PARAMETERS) hashParameters(excluded map[string]bool) []byte {
+	lines := make([]string, 0, len(m.ParamsInt)+len(m.ParamsStr)+len(m.ParamsBool))
+	for k, v := range m.ParamsInt {
+		if !excluded[k] {
+			lines = append(lines, fmt.Sprintf("%s=%d", k, v))
+		}
+	}
+	for k, v := range m.ParamsStr {
+		if !excluded[k] {
+			lines = append(lines, fmt.Sprintf("%s=%q", k, v))
+		}
+	}
+	for k, v := range m.ParamsBool {
+		if !excluded[k] {
+			lines = append(lines, fmt.Sprintf("%s=%t", k, v))
+		}
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l + "\n"))
+	}
+	return h.Sum(nil)
+}
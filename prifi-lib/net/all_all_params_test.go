@@ -1,6 +1,7 @@
 package net
 
 import (
+	"bytes"
 	"go.dedis.ch/protobuf"
 	"testing"
 )
@@ -137,3 +138,66 @@ func TestEncodeDecodeEmpty(t *testing.T) {
 		t.Error("key1 should be otherVal")
 	}
 }
+
+func TestConfigHash(t *testing.T) {
+	m1 := new(ALL_ALL_PARAMETERS)
+	m1.Add("PayloadSize", 1000)
+	m1.Add("DCNetType", "Simple")
+	m1.Add("UseUDP", true)
+	m1.Add("NextFreeClientID", 0)
+
+	m2 := new(ALL_ALL_PARAMETERS)
+	m2.Add("NextFreeClientID", 1)
+	m2.Add("UseUDP", true)
+	m2.Add("DCNetType", "Simple")
+	m2.Add("PayloadSize", 1000)
+
+	if m1.ConfigHash() != m2.ConfigHash() {
+		t.Error("The hash should not depend on the order nor on the IDs")
+	}
+	m2.Add("PayloadSize", 1001)
+	if m1.ConfigHash() == m2.ConfigHash() {
+		t.Error("The hash should depend on the parameters")
+	}
+}
+
+func TestParamsDigest(t *testing.T) {
+	m1 := new(ALL_ALL_PARAMETERS)
+	m1.Add("PayloadSize", 1000)
+	m1.Add("RandomBeacon", "1:abcd")
+	m1.Add("NextFreeClientID", 0)
+
+	m2 := new(ALL_ALL_PARAMETERS)
+	m2.Add("NextFreeClientID", 1)
+	m2.Add("RandomBeacon", "1:abcd")
+	m2.Add("PayloadSize", 1000)
+
+	if !bytes.Equal(m1.ParamsDigest(), m2.ParamsDigest()) {
+		t.Error("The digest should not depend on the order nor on the IDs")
+	}
+	m2.Add("RandomBeacon", "2:ef01")
+	if bytes.Equal(m1.ParamsDigest(), m2.ParamsDigest()) {
+		t.Error("The digest should cover the random beacon")
+	}
+	if m1.ConfigHash() != m2.ConfigHash() {
+		t.Error("The config hash should not cover the random beacon")
+	}
+}
+
+func TestParamsClone(t *testing.T) {
+	m := new(ALL_ALL_PARAMETERS)
+	m.Add("NClients", 3)
+	m.Add("DCNetType", "Simple")
+	m.Add("UseUDP", true)
+	m.ForceParams = true
+
+	c := m.Clone()
+	if !bytes.Equal(m.ParamsDigest(), c.ParamsDigest()) || !c.ForceParams {
+		t.Error("The clone should have the same parameters")
+	}
+	c.Add("NClients", 4)
+	c.Add("NextFreeClientID", 3)
+	if m.IntValueOrElse("NClients", 0) != 3 || m.IntValueOrElse("NextFreeClientID", -1) != -1 {
+		t.Error("Changing the clone should not change the original")
+	}
+}
@@ -0,0 +1,31 @@
+package net
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// DRAIN_ANNOUNCEMENT_PATTERN starts the downstream control cell in which the relay announces that it is draining,
+// i.e., that it will shut down at the given deadline. Like the latency tests, it is sent in the relay's priority
+// (control) downstream data.
+const DRAIN_ANNOUNCEMENT_PATTERN uint32 = 0x5A5AA5A5
+
+// DRAIN_ANNOUNCEMENT_LENGTH is the size of a drain announcement: pattern (4 bytes), deadline in ms since the epoch (8 bytes)
+const DRAIN_ANNOUNCEMENT_LENGTH = 12
+
+// NewDrainAnnouncement encodes the announcement that the relay shuts down at deadline
+func NewDrainAnnouncement(deadline time.Time) []byte {
+	b := make([]byte, DRAIN_ANNOUNCEMENT_LENGTH)
+	binary.BigEndian.PutUint32(b[0:4], DRAIN_ANNOUNCEMENT_PATTERN)
+	binary.BigEndian.PutUint64(b[4:12], uint64(deadline.UnixNano()/1e6))
+	return b
+}
+
+// ParseDrainAnnouncement returns the shutdown deadline if data is a drain announcement (possibly padded)
+func ParseDrainAnnouncement(data []byte) (time.Time, bool) {
+	if len(data) < DRAIN_ANNOUNCEMENT_LENGTH || binary.BigEndian.Uint32(data[0:4]) != DRAIN_ANNOUNCEMENT_PATTERN {
+		return time.Time{}, false
+	}
+	ms := int64(binary.BigEndian.Uint64(data[4:12]))
+	return time.Unix(0, ms*1e6), true
+}
@@ -0,0 +1,190 @@
+package net
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+A FaultInjector drops, delays or corrupts chosen messages of chosen rounds, so that the unit tests can exercise the
+timeouts and the retransmissions directly, e.g.
+
+	faults := net.NewFaultInjector()
+	faults.Drop(net.CLI_REL_UPSTREAM_DATA{}, 3) // the cipher of round 3 never arrives
+	relay.SetFaultInjectors(faults, nil)
+
+The relay, the clients and the trustees apply one FaultInjector to the messages they receive, and one to the messages
+they send (through their MessageSenderWrapper). A nil FaultInjector delivers everything, and is what the nodes use
+outside of the tests.
+*/
+
+// FaultAction is what happens to a message matched by a FaultRule
+type FaultAction int
+
+// The possible FaultActions
+const (
+	FAULT_DELIVER FaultAction = iota // the message is delivered as is
+	FAULT_DROP                       // the message is lost
+	FAULT_DELAY                      // the message is delivered after FaultRule.Delay
+	FAULT_CORRUPT                    // the first byte of the Data of the message is flipped
+)
+
+// FAULT_ANY_ROUND matches the messages of every round, and the messages without a round
+const FAULT_ANY_ROUND int32 = -1
+
+// FaultRule describes the messages to fault, and how
+type FaultRule struct {
+	Message interface{}   // a message of the type to match, e.g. net.TRU_REL_DC_CIPHER{}; nil matches every type
+	RoundID int32         // the RoundID of the messages to match, or FAULT_ANY_ROUND
+	Action  FaultAction   // what to do with the matched messages
+	Delay   time.Duration // with FAULT_DELAY, how long the messages are held
+	Times   int           // the rule applies to the first Times matching messages; to all of them if 0
+}
+
+// FaultInjector applies FaultRules to messages; the first rule which matches a message decides what happens to it
+type FaultInjector struct {
+	sync.Mutex
+	rules    []*FaultRule
+	matched  []int // for each rule, the number of messages it faulted
+	injected map[FaultAction]int
+}
+
+// NewFaultInjector returns a FaultInjector without rules, which delivers everything
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{
+		rules:    make([]*FaultRule, 0),
+		matched:  make([]int, 0),
+		injected: make(map[FaultAction]int),
+	}
+}
+
+// Add adds a rule, after the existing ones
+func (f *FaultInjector) Add(rule FaultRule) {
+	f.Lock()
+	defer f.Unlock()
+	f.rules = append(f.rules, &rule)
+	f.matched = append(f.matched, 0)
+}
+
+// Drop loses every message of the type of msg, for roundID
+func (f *FaultInjector) Drop(msg interface{}, roundID int32) {
+	f.Add(FaultRule{Message: msg, RoundID: roundID, Action: FAULT_DROP})
+}
+
+// Delay holds every message of the type of msg, for roundID, during delay
+func (f *FaultInjector) Delay(msg interface{}, roundID int32, delay time.Duration) {
+	f.Add(FaultRule{Message: msg, RoundID: roundID, Action: FAULT_DELAY, Delay: delay})
+}
+
+// Corrupt flips the first byte of the Data of every message of the type of msg, for roundID
+func (f *FaultInjector) Corrupt(msg interface{}, roundID int32) {
+	f.Add(FaultRule{Message: msg, RoundID: roundID, Action: FAULT_CORRUPT})
+}
+
+// Injected returns how many messages were dropped, delayed or corrupted
+func (f *FaultInjector) Injected(action FaultAction) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.injected[action]
+}
+
+// match returns the rule which applies to msg, and counts the fault; nil if msg is delivered as is
+func (f *FaultInjector) match(msg interface{}) *FaultRule {
+	if f == nil {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+
+	msgType := messageType(msg)
+	roundID, hasRound := MessageRoundID(msg)
+	for i, rule := range f.rules {
+		if rule.Message != nil && messageType(rule.Message) != msgType {
+			continue
+		}
+		if rule.RoundID != FAULT_ANY_ROUND && (!hasRound || rule.RoundID != roundID) {
+			continue
+		}
+		if rule.Times > 0 && f.matched[i] >= rule.Times {
+			continue
+		}
+		f.matched[i]++
+		if rule.Action == FAULT_DELIVER {
+			return nil
+		}
+		f.injected[rule.Action]++
+		return rule
+	}
+	return nil
+}
+
+// Filter applies the rules to a received message : it returns the message to handle now (possibly corrupted), and
+// false if the message is dropped or delayed; a delayed message is given to deliver once the delay is over
+func (f *FaultInjector) Filter(msg interface{}, deliver func(interface{}) error) (interface{}, bool) {
+	rule := f.match(msg)
+	if rule == nil {
+		return msg, true
+	}
+	switch rule.Action {
+	case FAULT_DROP:
+		return nil, false
+	case FAULT_DELAY:
+		time.AfterFunc(rule.Delay, func() {
+			deliver(msg)
+		})
+		return nil, false
+	case FAULT_CORRUPT:
+		return CorruptMessage(msg), true
+	}
+	return msg, true
+}
+
+// MessageRoundID returns the RoundID of msg (a message or a pointer to it), and false if it has none
+func MessageRoundID(msg interface{}) (int32, bool) {
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	field := v.FieldByName("RoundID")
+	if !field.IsValid() || field.Kind() != reflect.Int32 {
+		return 0, false
+	}
+	return int32(field.Int()), true
+}
+
+// CorruptMessage returns a copy of msg whose Data has its first byte flipped; msg is not modified. A message without
+// Data, or with an empty one, is returned as is.
+func CorruptMessage(msg interface{}) interface{} {
+	original := reflect.ValueOf(msg)
+	isPointer := original.Kind() == reflect.Ptr
+	v := reflect.Indirect(original)
+	if v.Kind() != reflect.Struct {
+		return msg
+	}
+	data := v.FieldByName("Data")
+	if !data.IsValid() || data.Kind() != reflect.Slice || data.Type().Elem().Kind() != reflect.Uint8 || data.Len() == 0 {
+		return msg
+	}
+
+	corrupted := make([]byte, data.Len())
+	copy(corrupted, data.Bytes())
+	corrupted[0] ^= 0xFF
+
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	c.Elem().FieldByName("Data").SetBytes(corrupted)
+	if isPointer {
+		return c.Interface()
+	}
+	return c.Elem().Interface()
+}
+
+// messageType returns the type of msg, without the pointer
+func messageType(msg interface{}) reflect.Type {
+	t := reflect.TypeOf(msg)
+	if t != nil && t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,89 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	var nilInjector *FaultInjector
+	if msg, now := nilInjector.Filter(CLI_REL_UPSTREAM_DATA{RoundID: 1}, nil); !now || msg.(CLI_REL_UPSTREAM_DATA).RoundID != 1 {
+		t.Error("Without a FaultInjector, everything should be delivered")
+	}
+
+	f := NewFaultInjector()
+	f.Drop(CLI_REL_UPSTREAM_DATA{}, 3)
+	f.Add(FaultRule{Message: TRU_REL_DC_CIPHER{}, RoundID: FAULT_ANY_ROUND, Action: FAULT_CORRUPT, Times: 1})
+
+	if _, now := f.Filter(CLI_REL_UPSTREAM_DATA{RoundID: 2}, nil); !now {
+		t.Error("Only the round 3 should be dropped")
+	}
+	if _, now := f.Filter(&CLI_REL_UPSTREAM_DATA{RoundID: 3}, nil); now {
+		t.Error("The round 3 should be dropped, also when sent by pointer")
+	}
+	if _, now := f.Filter(REL_CLI_DOWNSTREAM_DATA{RoundID: 3}, nil); !now {
+		t.Error("Only the upstream data should be dropped")
+	}
+
+	cipher := &TRU_REL_DC_CIPHER{RoundID: 7, Data: []byte{1, 2, 3}}
+	msg, now := f.Filter(cipher, nil)
+	corrupted, ok := msg.(*TRU_REL_DC_CIPHER)
+	if !now || !ok || corrupted.Data[0] != 0xFE || corrupted.Data[1] != 2 || corrupted.RoundID != 7 {
+		t.Error("The cipher should be corrupted, got", msg)
+	}
+	if cipher.Data[0] != 1 {
+		t.Error("The corruption should not modify the original message")
+	}
+	if msg, _ := f.Filter(cipher, nil); msg != cipher {
+		t.Error("Only the first cipher should be corrupted")
+	}
+	udp := REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA{RoundID: 4, Data: []byte{5}}}
+	if c := CorruptMessage(udp).(REL_CLI_DOWNSTREAM_DATA_UDP); c.Data[0] != 0xFA || c.RoundID != 4 || udp.Data[0] != 5 {
+		t.Error("The embedded data should be corrupted, got", c)
+	}
+
+	delivered := make(chan interface{}, 1)
+	f.Delay(REL_CLI_DOWNSTREAM_DATA{}, 5, 10*time.Millisecond)
+	if _, now := f.Filter(REL_CLI_DOWNSTREAM_DATA{RoundID: 5}, func(msg interface{}) error {
+		delivered <- msg
+		return nil
+	}); now {
+		t.Error("The round 5 should be delayed")
+	}
+	select {
+	case msg := <-delivered:
+		if roundID, _ := MessageRoundID(msg); roundID != 5 {
+			t.Error("The delayed message should be delivered as is, got", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("The delayed message was never delivered")
+	}
+
+	if f.Injected(FAULT_DROP) != 1 || f.Injected(FAULT_CORRUPT) != 1 || f.Injected(FAULT_DELAY) != 1 {
+		t.Error("Wrong counts of injected faults")
+	}
+	if _, hasRound := MessageRoundID(CLI_REL_TELL_PK_AND_EPH_PK{}); hasRound {
+		t.Error("This message has no round")
+	}
+}
+
+func TestMessageSenderWrapperFaults(t *testing.T) {
+	sent := 0
+	msgSender := new(TestMessageSender)
+	msw, err := NewMessageSenderWrapper(false, nil, nil, func(e error) { sent = -1 }, msgSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFaultInjector()
+	f.Drop(nil, FAULT_ANY_ROUND)
+	msw.SetFaultInjector(f)
+
+	// a dropped message is lost silently, even if sending it would have failed
+	if !msw.SendToClientWithLog(0, "hello", "") || sent != 0 || f.Injected(FAULT_DROP) != 1 {
+		t.Error("The message should have been dropped")
+	}
+	msw.SetFaultInjector(nil)
+	if msw.SendToClientWithLog(0, "hello", "") {
+		t.Error("Without faults, the message should be sent (and fail)")
+	}
+}
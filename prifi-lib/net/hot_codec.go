@@ -0,0 +1,214 @@
+package net
+
+/*
+CLI_REL_UPSTREAM_DATA and REL_CLI_DOWNSTREAM_DATA are sent every round, and the reflection-based protobuf encoding of
+onet shows up in the profiles. Both implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, which protobuf
+uses instead of reflection, with a hand-rolled codec for their fixed layout. It produces exactly the bytes of the
+reflection-based encoding (zigzag varints for the integers, length-delimited byte slices, fields numbered in order),
+so nodes using either encoding understand each other.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// the protobuf wire types used by the hot messages
+const (
+	wireVarint          = 0
+	wire64Bit           = 1
+	wireLengthDelimited = 2
+	wire32Bit           = 5
+)
+
+// MarshalBinary encodes the message as protobuf would, without reflection
+func (m *CLI_REL_UPSTREAM_DATA) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 6*binary.MaxVarintLen64+len(m.Data)+len(m.HistoryDigest)+6)
+	buf = appendSvarintField(buf, 1, int64(m.ClientID))
+	buf = appendSvarintField(buf, 2, int64(m.RoundID))
+	buf = appendBytesField(buf, 3, m.Data)
+	buf = appendSvarintField(buf, 4, int64(m.AckedRoundID))
+	buf = appendSvarintField(buf, 5, int64(m.HistoryRoundID))
+	buf = appendBytesField(buf, 6, m.HistoryDigest)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the message as protobuf would, without reflection. Data points into buf.
+func (m *CLI_REL_UPSTREAM_DATA) UnmarshalBinary(buf []byte) error {
+	*m = CLI_REL_UPSTREAM_DATA{}
+	return decodeFields(buf, func(field uint64, wiretype int, v uint64, vb []byte) error {
+		var err error
+		switch field {
+		case 1:
+			var id int64
+			id, err = signedField(wiretype, v)
+			m.ClientID = int(id)
+		case 2:
+			var round int64
+			round, err = signedField(wiretype, v)
+			m.RoundID = int32(round)
+		case 3:
+			m.Data, err = bytesField(wiretype, vb)
+		case 4:
+			var acked int64
+			acked, err = signedField(wiretype, v)
+			m.AckedRoundID = int32(acked)
+		case 5:
+			var history int64
+			history, err = signedField(wiretype, v)
+			m.HistoryRoundID = int32(history)
+		case 6:
+			m.HistoryDigest, err = bytesField(wiretype, vb)
+		}
+		return err
+	})
+}
+
+// MarshalBinary encodes the message as protobuf would, without reflection
+func (m *REL_CLI_DOWNSTREAM_DATA) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 5*binary.MaxVarintLen64+len(m.HashOfPreviousUpstreamData)+len(m.Data)+6)
+	buf = appendSvarintField(buf, 1, int64(m.RoundID))
+	buf = appendSvarintField(buf, 2, int64(m.OwnershipID))
+	buf = appendBytesField(buf, 3, m.HashOfPreviousUpstreamData)
+	buf = appendBytesField(buf, 4, m.Data)
+	buf = appendBoolField(buf, 5, m.FlagResync)
+	buf = appendBoolField(buf, 6, m.FlagOpenClosedRequest)
+	buf = appendSvarintField(buf, 7, int64(m.AllocatedUpstreamSize))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the message as protobuf would, without reflection. The byte slices point into buf.
+func (m *REL_CLI_DOWNSTREAM_DATA) UnmarshalBinary(buf []byte) error {
+	*m = REL_CLI_DOWNSTREAM_DATA{}
+	return decodeFields(buf, func(field uint64, wiretype int, v uint64, vb []byte) error {
+		var err error
+		switch field {
+		case 1:
+			var round int64
+			round, err = signedField(wiretype, v)
+			m.RoundID = int32(round)
+		case 2:
+			var owner int64
+			owner, err = signedField(wiretype, v)
+			m.OwnershipID = int(owner)
+		case 3:
+			m.HashOfPreviousUpstreamData, err = bytesField(wiretype, vb)
+		case 4:
+			m.Data, err = bytesField(wiretype, vb)
+		case 5:
+			m.FlagResync, err = boolField(wiretype, v)
+		case 6:
+			m.FlagOpenClosedRequest, err = boolField(wiretype, v)
+		case 7:
+			var size int64
+			size, err = signedField(wiretype, v)
+			m.AllocatedUpstreamSize = int(size)
+		}
+		return err
+	})
+}
+
+func appendSvarintField(buf []byte, field uint64, v int64) []byte {
+	buf = appendUvarint(buf, field<<3|wireVarint)
+	return appendUvarint(buf, uint64(v<<1)^uint64(v>>63))
+}
+
+func appendBytesField(buf []byte, field uint64, b []byte) []byte {
+	buf = appendUvarint(buf, field<<3|wireLengthDelimited)
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendBoolField(buf []byte, field uint64, b bool) []byte {
+	buf = appendUvarint(buf, field<<3|wireVarint)
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// decodeFields calls decodeField for each field of buf, with its varint value v, or its content vb if it is
+// length-delimited. Like protobuf, it skips the unknown fields.
+func decodeFields(buf []byte, decodeField func(field uint64, wiretype int, v uint64, vb []byte) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errors.New("bad protobuf field key")
+		}
+		buf = buf[n:]
+		wiretype := int(key & 7)
+
+		var v uint64
+		var vb []byte
+		switch wiretype {
+		case wireVarint:
+			v, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errors.New("bad protobuf varint value")
+			}
+			buf = buf[n:]
+		case wire32Bit:
+			if len(buf) < 4 {
+				return errors.New("bad protobuf 32-bit value")
+			}
+			v = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		case wire64Bit:
+			if len(buf) < 8 {
+				return errors.New("bad protobuf 64-bit value")
+			}
+			v = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case wireLengthDelimited:
+			v, n = binary.Uvarint(buf)
+			if n <= 0 || v > uint64(len(buf)-n) {
+				return errors.New("bad protobuf length-delimited value")
+			}
+			vb = buf[n : n+int(v) : n+int(v)]
+			buf = buf[n+int(v):]
+		default:
+			return errors.New("unknown protobuf wire-type " + strconv.Itoa(wiretype))
+		}
+
+		if err := decodeField(key>>3, wiretype, v, vb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func signedField(wiretype int, v uint64) (int64, error) {
+	switch wiretype {
+	case wireVarint:
+		return int64(v>>1) ^ -int64(v&1), nil
+	case wire32Bit:
+		return int64(int32(v)), nil
+	case wire64Bit:
+		return int64(v), nil
+	}
+	return 0, errors.New("bad wiretype for sint")
+}
+
+func bytesField(wiretype int, vb []byte) ([]byte, error) {
+	if wiretype != wireLengthDelimited {
+		return nil, errors.New("bad wiretype for repeated field")
+	}
+	return vb, nil
+}
+
+func boolField(wiretype int, v uint64) (bool, error) {
+	if wiretype != wireVarint {
+		return false, errors.New("bad wiretype for bool")
+	}
+	if v > 1 {
+		return false, errors.New("invalid bool value")
+	}
+	return v != 0, nil
+}
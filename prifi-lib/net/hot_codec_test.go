@@ -0,0 +1,200 @@
+package net
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"go.dedis.ch/protobuf"
+)
+
+// the same messages, without the hand-rolled codec, so that protobuf encodes them with reflection
+type reflectUpstream CLI_REL_UPSTREAM_DATA
+type reflectDownstream REL_CLI_DOWNSTREAM_DATA
+
+func hotMessages() ([]CLI_REL_UPSTREAM_DATA, []REL_CLI_DOWNSTREAM_DATA) {
+	data := bytes.Repeat([]byte{0xAB}, 1500)
+	upstream := []CLI_REL_UPSTREAM_DATA{
+		{},
+		{ClientID: 3, RoundID: 42, Data: data, AckedRoundID: 41},
+		{ClientID: -1, RoundID: -2147483648, Data: []byte{}},
+		{ClientID: 2, RoundID: 65, Data: data[:10], AckedRoundID: 64, HistoryRoundID: 64, HistoryDigest: bytes.Repeat([]byte{2}, 32)},
+	}
+	downstream := []REL_CLI_DOWNSTREAM_DATA{
+		{},
+		{RoundID: 7, OwnershipID: 2, HashOfPreviousUpstreamData: bytes.Repeat([]byte{1}, 32), Data: data, FlagResync: true},
+		{RoundID: 2147483647, OwnershipID: -1, Data: []byte{0}, FlagOpenClosedRequest: true},
+		{RoundID: 8, OwnershipID: 1, Data: data[:10], AllocatedUpstreamSize: 300},
+	}
+	return upstream, downstream
+}
+
+func TestHotCodecMatchesProtobuf(t *testing.T) {
+	upstream, downstream := hotMessages()
+
+	for _, msg := range upstream {
+		fast, err := protobuf.Encode(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := reflectUpstream(msg)
+		slow, err := protobuf.Encode(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fast, slow) {
+			t.Error("CLI_REL_UPSTREAM_DATA encodings differ for", msg.ClientID, msg.RoundID)
+		}
+
+		decoded := CLI_REL_UPSTREAM_DATA{}
+		if err := protobuf.Decode(slow, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		decodedSlow := reflectUpstream{}
+		if err := protobuf.Decode(fast, &decodedSlow); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.ClientID != msg.ClientID || decoded.RoundID != msg.RoundID || !bytes.Equal(decoded.Data, msg.Data) ||
+			decoded.AckedRoundID != msg.AckedRoundID || decoded.HistoryRoundID != msg.HistoryRoundID ||
+			!bytes.Equal(decoded.HistoryDigest, msg.HistoryDigest) {
+			t.Error("wrong decoding", decoded.ClientID, decoded.RoundID, len(decoded.Data), decoded.AckedRoundID, decoded.HistoryRoundID)
+		}
+		if !reflect.DeepEqual(decoded, CLI_REL_UPSTREAM_DATA(decodedSlow)) {
+			t.Error("both decoders should give the same message")
+		}
+	}
+
+	for _, msg := range downstream {
+		fast, err := protobuf.Encode(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := reflectDownstream(msg)
+		slow, err := protobuf.Encode(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fast, slow) {
+			t.Error("REL_CLI_DOWNSTREAM_DATA encodings differ for round", msg.RoundID)
+		}
+
+		decoded := REL_CLI_DOWNSTREAM_DATA{}
+		if err := protobuf.Decode(slow, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		decodedSlow := reflectDownstream{}
+		if err := protobuf.Decode(fast, &decodedSlow); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, REL_CLI_DOWNSTREAM_DATA(decodedSlow)) {
+			t.Error("both decoders should give the same message", decoded, decodedSlow)
+		}
+		if decoded.RoundID != msg.RoundID || decoded.OwnershipID != msg.OwnershipID || !bytes.Equal(decoded.Data, msg.Data) ||
+			decoded.FlagResync != msg.FlagResync || decoded.FlagOpenClosedRequest != msg.FlagOpenClosedRequest {
+			t.Error("wrong decoding for round", msg.RoundID)
+		}
+	}
+
+	// a message containing a REL_CLI_DOWNSTREAM_DATA is encoded by reflection, and decoded by the hand-rolled codec
+	copyMsg := &REL_CLI_DOWNSTREAM_COPY{RoundID: 7, Found: true, Data: downstream[1]}
+	b, err := protobuf.Encode(copyMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedCopy := REL_CLI_DOWNSTREAM_COPY{}
+	if err := protobuf.Decode(b, &decodedCopy); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedCopy.Data, downstream[1]) {
+		t.Error("wrong decoding of the embedded REL_CLI_DOWNSTREAM_DATA")
+	}
+}
+
+func TestHotCodecInvalidInput(t *testing.T) {
+	msg := &REL_CLI_DOWNSTREAM_DATA{}
+	invalid := [][]byte{
+		{0x80},                    // truncated key
+		{0x08},                    // missing varint
+		{0x1a, 0x05, 0x01},        // length beyond the buffer
+		{0x28, 0x02},              // bool of value 2
+		{0x08 | 0x02, 0x00, 0x0b}, // field 1 length-delimited, then an invalid wire type
+	}
+	for _, b := range invalid {
+		if err := msg.UnmarshalBinary(b); err == nil {
+			t.Error("should not decode", b)
+		}
+	}
+
+	// unknown fields are skipped
+	if err := msg.UnmarshalBinary([]byte{0x78, 0x01, 0x08, 0x04}); err != nil || msg.RoundID != 2 {
+		t.Error("should skip the unknown field 15", err, msg.RoundID)
+	}
+}
+
+func BenchmarkUpstreamDataEncode(b *testing.B) {
+	upstream, _ := hotMessages()
+	msg := &upstream[1]
+	for i := 0; i < b.N; i++ {
+		protobuf.Encode(msg)
+	}
+}
+
+func BenchmarkUpstreamDataEncodeReflection(b *testing.B) {
+	upstream, _ := hotMessages()
+	msg := reflectUpstream(upstream[1])
+	for i := 0; i < b.N; i++ {
+		protobuf.Encode(&msg)
+	}
+}
+
+func BenchmarkUpstreamDataDecode(b *testing.B) {
+	upstream, _ := hotMessages()
+	buf, _ := protobuf.Encode(&upstream[1])
+	msg := &CLI_REL_UPSTREAM_DATA{}
+	for i := 0; i < b.N; i++ {
+		protobuf.Decode(buf, msg)
+	}
+}
+
+func BenchmarkUpstreamDataDecodeReflection(b *testing.B) {
+	upstream, _ := hotMessages()
+	buf, _ := protobuf.Encode(&upstream[1])
+	msg := &reflectUpstream{}
+	for i := 0; i < b.N; i++ {
+		protobuf.Decode(buf, msg)
+	}
+}
+
+func BenchmarkDownstreamDataEncode(b *testing.B) {
+	_, downstream := hotMessages()
+	msg := &downstream[1]
+	for i := 0; i < b.N; i++ {
+		protobuf.Encode(msg)
+	}
+}
+
+func BenchmarkDownstreamDataEncodeReflection(b *testing.B) {
+	_, downstream := hotMessages()
+	msg := reflectDownstream(downstream[1])
+	for i := 0; i < b.N; i++ {
+		protobuf.Encode(&msg)
+	}
+}
+
+func BenchmarkDownstreamDataDecode(b *testing.B) {
+	_, downstream := hotMessages()
+	buf, _ := protobuf.Encode(&downstream[1])
+	msg := &REL_CLI_DOWNSTREAM_DATA{}
+	for i := 0; i < b.N; i++ {
+		protobuf.Decode(buf, msg)
+	}
+}
+
+func BenchmarkDownstreamDataDecodeReflection(b *testing.B) {
+	_, downstream := hotMessages()
+	buf, _ := protobuf.Encode(&downstream[1])
+	msg := &reflectDownstream{}
+	for i := 0; i < b.N; i++ {
+		protobuf.Decode(buf, msg)
+	}
+}
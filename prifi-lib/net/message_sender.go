@@ -38,6 +38,7 @@ type MessageSenderWrapper struct {
 	logSuccessFunction   func(interface{})
 	logErrorFunction     func(interface{})
 	networkErrorHappened func(error)
+	faults               *FaultInjector // drops, delays or corrupts the messages sent, in the tests; nil otherwise
 }
 
 /**
@@ -77,6 +78,13 @@ func (m *MessageSenderWrapper) SetEntity(e string) {
 	m.entity = e
 }
 
+/**
+ * Sets the FaultInjector applied to the messages sent, for the tests; nil sends everything
+ */
+func (m *MessageSenderWrapper) SetFaultInjector(faults *FaultInjector) {
+	m.faults = faults
+}
+
 /**
  * Send a message to client i. will automatically print what it does (Lvl3) if loggingenabled, and
  * will call networkErrorHappened on error
@@ -113,8 +121,15 @@ func (m *MessageSenderWrapper) SendToRelayWithLog(msg interface{}, extraInfos st
  * Helper function for both SendToRelay
  */
 func (m *MessageSenderWrapper) sendToWithLog(sendingFunc func(interface{}) error, msg interface{}, extraInfos string) bool {
-	err := sendingFunc(msg)
 	msgName := reflect.TypeOf(msg).String()
+	msg, sendNow := m.faults.Filter(msg, sendingFunc)
+	if !sendNow {
+		if m.loggingEnabled {
+			m.logSuccessFunction(m.entity + ": Fault injection, did not send a " + msgName + " now." + extraInfos)
+		}
+		return true
+	}
+	err := sendingFunc(msg)
 	if err != nil {
 		e := m.entity + ": Tried to send a " + msgName + ", but some network error occurred. Err is: " + err.Error()
 		if m.networkErrorHappened != nil {
@@ -136,8 +151,17 @@ func (m *MessageSenderWrapper) sendToWithLog(sendingFunc func(interface{}) error
  * Helper function for both SendToClientWithLog and SendToTrusteeWithLog
  */
 func (m *MessageSenderWrapper) sendToWithLog2(sendingFunc func(int, interface{}) error, i int, msg interface{}, extraInfos string) bool {
-	err := sendingFunc(i, msg)
 	msgName := reflect.TypeOf(msg).String()
+	msg, sendNow := m.faults.Filter(msg, func(msg interface{}) error {
+		return sendingFunc(i, msg)
+	})
+	if !sendNow {
+		if m.loggingEnabled {
+			m.logSuccessFunction("Fault injection, did not send a " + msgName + " now." + extraInfos)
+		}
+		return true
+	}
+	err := sendingFunc(i, msg)
 	if err != nil {
 		e := "Relay: Tried to send a " + msgName + ", but some network error occurred. Err is: " + err.Error()
 		if m.networkErrorHappened != nil {
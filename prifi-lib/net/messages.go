@@ -25,33 +25,59 @@ import (
 // REL_TRU_TELL_TRANSCRIPT
 // TRU_REL_DC_CIPHER
 // TRU_REL_SHUFFLE_SIG
+// TRU_REL_SHUFFLE_REJECTED
 // REL_TRU_TELL_RATE_CHANGE
 // TRU_REL_TELL_NEW_BASE_AND_EPH_PKS
 // TRU_REL_TELL_PK
 // REL_TRU_TELL_RATE_CHANGE
+// REL_ALL_PARAMETERS_PROPOSAL
+// CLI_REL_PARAMETERS_ACK
+// TRU_REL_PARAMETERS_ACK
+// REL_ALL_PARAMETERS_ACTIVATE
+// CLI_REL_DOWNSTREAM_COPY_REQUEST
+// REL_CLI_DOWNSTREAM_COPY
+// REL_CLI_PARAMS_DIGEST
+// TRU_REL_LOAD_REPORT
+// CLI_REL_GOODBYE
+// REL_CLI_GOODBYE
+// REL_CLI_REFRESH_EPH_PKS
+// CLI_REL_DOWNSTREAM_NACK
+// REL_ALL_EQUIVOCATION_ALARM
+// REL_CLI_HISTORY_REQUEST
+// CLI_REL_HISTORY_DIGEST
+// REL_CLI_HISTORY_RESYNC
 
 //not used yet :
 // REL_CLI_DOWNSTREAM_DATA
-// CLI_REL_DOWNSTREAM_NACK
 
-// ALL_ALL_SHUTDOWN message tells the participants to stop the protocol.
+// ALL_ALL_SHUTDOWN message tells the participants to stop the protocol. When the relay sends it, Abnormal tells
+// whether the protocol was killed because of a failure, and Reason says why.
 type ALL_ALL_SHUTDOWN struct {
+	Abnormal bool
+	Reason   string
 }
 
 // CLI_REL_TELL_PK_AND_EPH_PK message contains the public key and ephemeral key of a client
-// and is sent to the relay.
+// and is sent to the relay. A client asking for several slots per schedule adds one ephemeral
+// key per additional slot in ExtraEphPks.
 type CLI_REL_TELL_PK_AND_EPH_PK struct {
-	ClientID int
-	Pk       kyber.Point
-	EphPk    kyber.Point
+	ClientID    int
+	Pk          kyber.Point
+	EphPk       kyber.Point
+	ExtraEphPks []kyber.Point
 }
 
 // CLI_REL_UPSTREAM_DATA message contains the upstream data of a client for a given round
 // and is sent to the relay.
 type CLI_REL_UPSTREAM_DATA struct {
-	ClientID int
-	RoundID  int32 // rounds increase 1 by 1, only represent ciphers
-	Data     []byte
+	ClientID     int
+	RoundID      int32 // rounds increase 1 by 1, only represent ciphers
+	Data         []byte
+	AckedRoundID int32 // cumulative ACK : the client applied the downstream data of every round up to this one
+
+	// the digest of the downstream data up to the checkpoint HistoryRoundID, once per checkpoint; nil otherwise
+	HistoryRoundID int32
+	HistoryDigest  []byte
 }
 
 // CLI_REL_OPENCLOSED_DATA message contains whether slots are gonna be Open or Closed in the next round
@@ -70,6 +96,7 @@ type REL_CLI_DOWNSTREAM_DATA struct {
 	Data                       []byte
 	FlagResync                 bool
 	FlagOpenClosedRequest      bool
+	AllocatedUpstreamSize      int // with variable slot sizes, the size of the upstream payload of this round; 0 means PayloadSize
 }
 
 //Converts []ByteArray -> [][]byte and returns it
@@ -87,14 +114,19 @@ type REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG struct {
 	Base         kyber.Point
 	EphPks       []kyber.Point
 	TrusteesSigs []ByteArray
+	RoundID      int32       // the first round of this schedule; 0, unless clients joined during the session
+	Epoch        int32       // the epoch of this schedule, in which the MAC keys of the slots are derived
+	RelayPk      kyber.Point // the relay's public key on Base; the owner of a slot derives its MAC key from it
 }
 
 // REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE message contains the public keys and ephemeral keys
 // of the clients and is sent by the relay to the trustees.
 type REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE struct {
-	Pks    []kyber.Point
-	EphPks []kyber.Point
-	Base   kyber.Point
+	Pks     []kyber.Point
+	EphPks  []kyber.Point
+	Base    kyber.Point
+	RoundID int32 // the first round of the schedule being shuffled; 0, unless clients joined during the session
+	Epoch   int32 // the epoch of the schedule being shuffled; the trustees tag their ciphers with it
 }
 
 //protobuf can't handle [][]abstract.Point, so we do []PublicKeyArray
@@ -126,11 +158,14 @@ func (m *REL_TRU_TELL_TRANSCRIPT) GetProofs() [][]byte {
 }
 
 // REL_TRU_TELL_TRANSCRIPT message contains all the shuffles perfomrmed in a Neff shuffle round.
-// It is sent by the relay to the trustees to be verified.
+// It is sent by the relay to the trustees to be verified. InitialBase and InitialEphPks are the input of the first
+// shuffle; each next shuffle takes the output of the previous one.
 type REL_TRU_TELL_TRANSCRIPT struct {
-	Bases  []kyber.Point
-	EphPks []PublicKeyArray
-	Proofs []ByteArray
+	InitialBase   kyber.Point
+	InitialEphPks []kyber.Point
+	Bases         []kyber.Point
+	EphPks        []PublicKeyArray
+	Proofs        []ByteArray
 }
 
 // TRU_REL_DC_CIPHER message contains the DC-net cipher of a trustee for a given round and is sent to the relay.
@@ -138,6 +173,7 @@ type TRU_REL_DC_CIPHER struct {
 	RoundID   int32
 	TrusteeID int
 	Data      []byte
+	Epoch     int32 // the epoch of the schedule the cipher was computed for, so the relay drops the stale ones
 }
 
 // TRU_REL_SHUFFLE_SIG contains the signatures shuffled by a trustee and is sent to the relay.
@@ -146,10 +182,19 @@ type TRU_REL_SHUFFLE_SIG struct {
 	Sig       []byte
 }
 
+// TRU_REL_SHUFFLE_REJECTED is sent by a trustee to the relay instead of TRU_REL_SHUFFLE_SIG, when the proof of the
+// Shuffle-th shuffle of the transcript does not verify. The relay checks that shuffle again to find who cheated.
+type TRU_REL_SHUFFLE_REJECTED struct {
+	TrusteeID int
+	Shuffle   int
+	Reason    string
+}
+
 // REL_TRU_TELL_RATE_CHANGE message asks the trustees to update their window capacity to adapt their
 // sending rate and is sent by the relay.
 type REL_TRU_TELL_RATE_CHANGE struct {
 	WindowCapacity int
+	Window         int // if > 0, the relay now stops the trustee once this many of its ciphers are buffered
 }
 
 // TRU_REL_TELL_NEW_BASE_AND_EPH_PKS message contains the new ephemeral key of a trustee and
@@ -163,8 +208,9 @@ type TRU_REL_TELL_NEW_BASE_AND_EPH_PKS struct {
 
 // TRU_REL_TELL_PK message contains the public key of a trustee and is sent to the relay.
 type TRU_REL_TELL_PK struct {
-	TrusteeID int
-	Pk        kyber.Point
+	TrusteeID   int
+	Pk          kyber.Point
+	Endorsement []byte // the signature of Pk by the trustee's long-term key, see crypto.TrusteeKeyEndorsementMessage; empty if it has none
 }
 
 /*
@@ -193,7 +239,7 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 
 	//convert the message to bytes
 	hashLen := len(m.REL_CLI_DOWNSTREAM_DATA.HashOfPreviousUpstreamData)
-	buf := make([]byte, 4+4+4+hashLen+len(m.REL_CLI_DOWNSTREAM_DATA.Data)+4+4)
+	buf := make([]byte, 4+4+4+hashLen+len(m.REL_CLI_DOWNSTREAM_DATA.Data)+4+4+4)
 
 	resyncInt := 0
 	if m.REL_CLI_DOWNSTREAM_DATA.FlagResync {
@@ -204,7 +250,7 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 		openclosedInt = 1
 	}
 
-	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [8:end-8 data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
+	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [8:end-12 data] [end-12:end-8 allocatedUpstreamSize] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
 	binary.BigEndian.PutUint32(buf[0:4], uint32(m.REL_CLI_DOWNSTREAM_DATA.RoundID))
 	binary.BigEndian.PutUint32(buf[4:8], uint32(m.REL_CLI_DOWNSTREAM_DATA.OwnershipID))
 	binary.BigEndian.PutUint32(buf[8:12], uint32(hashLen))
@@ -214,9 +260,10 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 		startIndex += hashLen
 	}
 
+	binary.BigEndian.PutUint32(buf[len(buf)-12:len(buf)-8], uint32(m.REL_CLI_DOWNSTREAM_DATA.AllocatedUpstreamSize))
 	binary.BigEndian.PutUint32(buf[len(buf)-8:len(buf)-4], uint32(resyncInt)) //todo : to be coded on one byte
 	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(openclosedInt))       //todo : to be coded on one byte
-	copy(buf[startIndex:len(buf)-8], m.REL_CLI_DOWNSTREAM_DATA.Data)
+	copy(buf[startIndex:len(buf)-12], m.REL_CLI_DOWNSTREAM_DATA.Data)
 
 	return buf, nil
 
@@ -225,20 +272,21 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 // FromBytes decodes the message contained in the message's byteEncoded field.
 func (m *REL_CLI_DOWNSTREAM_DATA_UDP) FromBytes(buffer []byte) (interface{}, error) {
 
-	//the smallest message is 4 bytes, indicating a length of 0
-	if len(buffer) < 8 { //4 (roundID) + 4 (flagResync)
-		e := "Messages.go : FromBytes() : cannot decode, smaller than 8 bytes"
+	//the smallest message has no hash and no data
+	if len(buffer) < 24 { //4 (roundID) + 4 (OwnershipID) + 4 (length of hash) + 4 (allocatedUpstreamSize) + 4 (flagResync) + 4 (flagOpenClosed)
+		e := "Messages.go : FromBytes() : cannot decode, smaller than 24 bytes"
 		return REL_CLI_DOWNSTREAM_DATA_UDP{}, errors.New(e)
 	}
 
-	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [8:end-8 data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
+	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [8:end-12 data] [end-12:end-8 allocatedUpstreamSize] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
 	roundID := int32(binary.BigEndian.Uint32(buffer[0:4]))
 	ownerShipID := int(binary.BigEndian.Uint32(buffer[4:8]))
 	hashLen := int(binary.BigEndian.Uint32(buffer[8:12]))
+	allocatedUpstreamSize := int(binary.BigEndian.Uint32(buffer[len(buffer)-12 : len(buffer)-8]))
 	flagResyncInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-8 : len(buffer)-4]))
 	flagOpenClosedInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-4:]))
 	hashOfPreviousUpstreamData := buffer[12 : 12+hashLen]
-	data := buffer[12+hashLen : len(buffer)-8]
+	data := buffer[12+hashLen : len(buffer)-12]
 
 	flagResync := false
 	if flagResyncInt == 1 {
@@ -249,7 +297,7 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) FromBytes(buffer []byte) (interface{}, err
 		flagOpenClosed = true
 	}
 
-	innerMessage := REL_CLI_DOWNSTREAM_DATA{roundID, ownerShipID, hashOfPreviousUpstreamData, data, flagResync, flagOpenClosed}
+	innerMessage := REL_CLI_DOWNSTREAM_DATA{roundID, ownerShipID, hashOfPreviousUpstreamData, data, flagResync, flagOpenClosed, allocatedUpstreamSize}
 	resultMessage := REL_CLI_DOWNSTREAM_DATA_UDP{innerMessage}
 
 	return resultMessage, nil
@@ -261,6 +309,45 @@ type REL_CLI_DISRUPTED_ROUND struct {
 	Data    []byte
 }
 
+// REL_ALL_DISRUPTION_DETECTED is sent by the relay to the clients and the trustees when the cell of a slot did not carry
+// the HMAC of its content, i.e. when the round was disrupted. Cell is the decoded cell, in which the owner of the slot
+// looks for a bit it did not set, to blame with CLI_REL_DISRUPTION_BLAME
+type REL_ALL_DISRUPTION_DETECTED struct {
+	RoundID int32
+	SlotID  int
+	Cell    []byte
+}
+
+// REL_ALL_EQUIVOCATION_ALARM is sent by the relay to the clients and the trustees when the equivocation contributions
+// of a round were inconsistent, i.e. when the clients may not have received the same downstream data. Everybody stops
+// the rounds (state BLAMING), until the group is restarted.
+type REL_ALL_EQUIVOCATION_ALARM struct {
+	RoundID int32
+	Reason  string
+}
+
+// REL_ALL_REVEAL_REQUEST is sent by the relay to the clients and the trustees to blame a disrupted round : each reveals
+// the bit at BitPos of the pads it shares for the round
+type REL_ALL_REVEAL_REQUEST struct {
+	RoundID int32
+	BitPos  int
+}
+
+// CLI_REL_REVEAL_BITS contains the bits of the pads of a client for a REL_ALL_REVEAL_REQUEST, by trustee
+type CLI_REL_REVEAL_BITS struct {
+	ClientID int
+	RoundID  int32
+	Bits     map[int]int
+}
+
+// TRU_REL_REVEAL_BITS contains the bits of the pads of a trustee for a REL_ALL_REVEAL_REQUEST, in the order of the
+// clients of the schedule
+type TRU_REL_REVEAL_BITS struct {
+	TrusteeID int
+	RoundID   int32
+	Bits      map[int]int
+}
+
 // CLI_REL_DISRUPTION_BLAME contains a disrupted roundID and the position where a bit was flipped, and is sent to the relay
 type CLI_REL_DISRUPTION_BLAME struct {
 	RoundID int32
@@ -315,3 +402,128 @@ type TRU_REL_SHARED_SECRET struct {
 	NIZK      []byte
 	Pub       map[string]kyber.Point
 }
+
+// MIGRATABLE_PARAMETERS are the parameters that can be changed during a session with REL_ALL_PARAMETERS_PROPOSAL,
+// without restarting the protocol
+var MIGRATABLE_PARAMETERS = []string{"WindowSize", "DownstreamCellSize", "RelayRoundTimeOut", "RelayTrusteeCacheLowBound",
+	"RelayTrusteeCacheHighBound", "RelayMaxNumberOfConsecutiveFailedRounds"}
+
+// REL_REL_PROPOSE_PARAMETERS asks the relay to start a parameter change. It is not sent over the network, but
+// injected in the relay by its operator.
+type REL_REL_PROPOSE_PARAMETERS struct {
+	ParamsInt map[string]int
+}
+
+// REL_ALL_PARAMETERS_PROPOSAL proposes new values for some MIGRATABLE_PARAMETERS, to be used from the parameters
+// epoch Epoch on, and is sent by the relay to the clients and trustees, which answer with a *_REL_PARAMETERS_ACK
+type REL_ALL_PARAMETERS_PROPOSAL struct {
+	Epoch     int32
+	ParamsInt map[string]int
+}
+
+// CLI_REL_PARAMETERS_ACK tells the relay whether a client accepts the parameters of an epoch
+type CLI_REL_PARAMETERS_ACK struct {
+	ClientID int
+	Epoch    int32
+	Accepted bool
+}
+
+// TRU_REL_PARAMETERS_ACK tells the relay whether a trustee accepts the parameters of an epoch
+type TRU_REL_PARAMETERS_ACK struct {
+	TrusteeID int
+	Epoch     int32
+	Accepted  bool
+}
+
+// REL_ALL_PARAMETERS_ACTIVATE tells the clients and trustees that everybody accepted the parameters of an epoch,
+// and that they are now in use
+type REL_ALL_PARAMETERS_ACTIVATE struct {
+	Epoch int32
+}
+
+// CLI_REL_DOWNSTREAM_COPY_REQUEST asks the relay to send, over TCP, a copy of the downstream data of a round the
+// client received over UDP, so that it can compare them
+type CLI_REL_DOWNSTREAM_COPY_REQUEST struct {
+	ClientID int
+	RoundID  int32
+}
+
+// CLI_REL_DOWNSTREAM_NACK tells the relay that the client missed the downstream data of a round (e.g., a lost UDP
+// broadcast), which the relay retransmits over TCP to this client only
+type CLI_REL_DOWNSTREAM_NACK struct {
+	ClientID int
+	RoundID  int32
+}
+
+// REL_CLI_HISTORY_REQUEST asks a client for the digest of its downstream history at RoundID, while the relay looks
+// for the first round where it diverged from the relay's (see dcnet.HistoryDigests)
+type REL_CLI_HISTORY_REQUEST struct {
+	RoundID int32
+}
+
+// CLI_REL_HISTORY_DIGEST is the answer to REL_CLI_HISTORY_REQUEST. Digest is nil if the client does not have the
+// digest of this round anymore.
+type CLI_REL_HISTORY_DIGEST struct {
+	ClientID int
+	RoundID  int32
+	Digest   []byte
+}
+
+// REL_CLI_HISTORY_RESYNC gives a client whose downstream history diverged the relay's digests of the rounds from
+// FirstRoundID (the first round which diverged) on, which the client adopts
+type REL_CLI_HISTORY_RESYNC struct {
+	FirstRoundID int32
+	Digests      [][]byte
+}
+
+// REL_CLI_DOWNSTREAM_COPY is the answer to CLI_REL_DOWNSTREAM_COPY_REQUEST. Found is false if the relay does not have
+// the round anymore (it was closed), in which case Data is empty.
+type REL_CLI_DOWNSTREAM_COPY struct {
+	RoundID int32
+	Found   bool
+	Data    REL_CLI_DOWNSTREAM_DATA
+}
+
+// REL_CLI_PARAMS_DIGEST carries the digest (ALL_ALL_PARAMETERS.ParamsDigest()) of the parameters the relay sent to
+// all the clients for this epoch. It is sent right before the shuffle result, so that a client which received other
+// parameters than the rest of the group notices it before sending any data.
+type REL_CLI_PARAMS_DIGEST struct {
+	Digest []byte
+}
+
+// TRU_REL_LOAD_REPORT tells the relay how much of its CPU budget a trustee uses to compute its ciphers. An overloaded
+// trustee asks the relay for a smaller window, which the relay grants with REL_TRU_TELL_RATE_CHANGE.
+type TRU_REL_LOAD_REPORT struct {
+	TrusteeID  int
+	Load       int // in percent of one core, over the last period
+	Budget     int // in percent of one core
+	Overloaded bool
+}
+
+// CLI_REL_GOODBYE tells the relay that the client leaves the session. The client keeps sending its ciphers (with
+// cover traffic only) until the relay answers with REL_CLI_GOODBYE.
+type CLI_REL_GOODBYE struct {
+	ClientID int
+}
+
+// REL_CLI_GOODBYE tells a client which said goodbye that it left the group : the rounds after LastRoundID are
+// decoded without it, and it can stop.
+type REL_CLI_GOODBYE struct {
+	LastRoundID int32
+}
+
+// REL_CLI_REFRESH_EPH_PKS asks the clients for fresh ephemeral keys, which they send with CLI_REL_TELL_PK_AND_EPH_PK;
+// the trustees shuffle them for the schedule of Epoch, once the current one is over.
+type REL_CLI_REFRESH_EPH_PKS struct {
+	Epoch int32
+}
+
+// IsMigratableParameter returns true if the parameter can be changed with REL_ALL_PARAMETERS_PROPOSAL
+func IsMigratableParameter(key string) bool {
+	for _, k := range MIGRATABLE_PARAMETERS {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
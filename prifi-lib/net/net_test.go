@@ -7,6 +7,7 @@ import (
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"go.dedis.ch/kyber/v3"
 	"testing"
+	"time"
 )
 
 func genDataSlice() []byte {
@@ -152,6 +153,7 @@ func TestUDPMessage(t *testing.T) {
 	content.FlagResync = true
 	content.Data = genDataSlice()
 	content.FlagOpenClosedRequest = true
+	content.AllocatedUpstreamSize = 300
 
 	msg.SetContent(*content)
 
@@ -186,6 +188,9 @@ func TestUDPMessage(t *testing.T) {
 	if !bytes.Equal(parsedMsg.Data, content.Data) {
 		t.Error("Data unparsed incorrectly")
 	}
+	if parsedMsg.AllocatedUpstreamSize != content.AllocatedUpstreamSize {
+		t.Error("AllocatedUpstreamSize unparsed incorrectly")
+	}
 
 	//this should fail, cannot read the size if len<4
 	void = new(REL_CLI_DOWNSTREAM_DATA_UDP)
@@ -196,3 +201,49 @@ func TestUDPMessage(t *testing.T) {
 		t.Error("REL_CLI_DOWNSTREAM_DATA_UDP should not allow to decode message < 4 bytes")
 	}
 }
+
+func TestDrainAnnouncement(t *testing.T) {
+	deadline := time.Unix(1500000000, 123000000)
+	b := NewDrainAnnouncement(deadline)
+	if len(b) != DRAIN_ANNOUNCEMENT_LENGTH {
+		t.Error("A drain announcement should be", DRAIN_ANNOUNCEMENT_LENGTH, "bytes, is", len(b))
+	}
+
+	// the announcement may be padded to the cell size
+	padded := append(b, make([]byte, 100)...)
+	parsed, ok := ParseDrainAnnouncement(padded)
+	if !ok {
+		t.Error("Should recognize a drain announcement")
+	}
+	if !parsed.Equal(deadline) {
+		t.Error("Deadline should be", deadline, "but is", parsed)
+	}
+
+	if _, ok := ParseDrainAnnouncement(make([]byte, 100)); ok {
+		t.Error("Should not recognize random data as a drain announcement")
+	}
+	if _, ok := ParseDrainAnnouncement(b[:4]); ok {
+		t.Error("Should not recognize a truncated drain announcement")
+	}
+}
+
+func TestWarmupPayload(t *testing.T) {
+	b := NewWarmupPayload(12, 100)
+	if len(b) != 100 || !CheckWarmupPayload(12, b) {
+		t.Error("Should recognize the warm-up payload of the round")
+	}
+	if CheckWarmupPayload(13, b) {
+		t.Error("Should not recognize the warm-up payload of another round")
+	}
+	b[3] = 5 // the client ID, with the disruption protection
+	if !CheckWarmupPayload(12, b) {
+		t.Error("The 4th byte should not be checked")
+	}
+	b[99] ^= 1
+	if CheckWarmupPayload(12, b) {
+		t.Error("Should not recognize a corrupted warm-up payload")
+	}
+	if CheckWarmupPayload(12, make([]byte, 100)) || CheckWarmupPayload(12, b[:4]) {
+		t.Error("Should not recognize empty or truncated payloads")
+	}
+}
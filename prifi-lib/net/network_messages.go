@@ -0,0 +1,52 @@
+package net
+
+// NetworkMessages returns an instance of each message sent over the network, for the network layers (the SDA
+// protocol, or the standalone transport) to register them. Local messages (ALL_ALL_SHUTDOWN,
+// REL_REL_PROPOSE_PARAMETERS) and the UDP broadcast REL_CLI_DOWNSTREAM_DATA_UDP are not included.
+// If we forget some messages here, the network layers will fail to send them !
+func NetworkMessages() []interface{} {
+	return []interface{}{
+		ALL_ALL_PARAMETERS{},
+		CLI_REL_TELL_PK_AND_EPH_PK{},
+		CLI_REL_UPSTREAM_DATA{},
+		REL_CLI_DOWNSTREAM_DATA{},
+		CLI_REL_OPENCLOSED_DATA{},
+		REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG{},
+		REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE{},
+		REL_TRU_TELL_TRANSCRIPT{},
+		TRU_REL_DC_CIPHER{},
+		REL_TRU_TELL_RATE_CHANGE{},
+		TRU_REL_SHUFFLE_SIG{},
+		TRU_REL_SHUFFLE_REJECTED{},
+		TRU_REL_TELL_NEW_BASE_AND_EPH_PKS{},
+		TRU_REL_TELL_PK{},
+		REL_CLI_DISRUPTED_ROUND{},
+		REL_ALL_DISRUPTION_DETECTED{},
+		REL_ALL_REVEAL_REQUEST{},
+		CLI_REL_REVEAL_BITS{},
+		TRU_REL_REVEAL_BITS{},
+		CLI_REL_DISRUPTION_BLAME{},
+		REL_ALL_DISRUPTION_REVEAL{},
+		CLI_REL_DISRUPTION_REVEAL{},
+		TRU_REL_DISRUPTION_REVEAL{},
+		REL_ALL_REVEAL_SHARED_SECRETS{},
+		CLI_REL_SHARED_SECRET{},
+		TRU_REL_SHARED_SECRET{},
+		REL_ALL_PARAMETERS_PROPOSAL{},
+		CLI_REL_PARAMETERS_ACK{},
+		TRU_REL_PARAMETERS_ACK{},
+		REL_ALL_PARAMETERS_ACTIVATE{},
+		CLI_REL_DOWNSTREAM_COPY_REQUEST{},
+		REL_CLI_DOWNSTREAM_COPY{},
+		REL_CLI_PARAMS_DIGEST{},
+		TRU_REL_LOAD_REPORT{},
+		CLI_REL_GOODBYE{},
+		REL_CLI_GOODBYE{},
+		REL_CLI_REFRESH_EPH_PKS{},
+		CLI_REL_DOWNSTREAM_NACK{},
+		REL_ALL_EQUIVOCATION_ALARM{},
+		REL_CLI_HISTORY_REQUEST{},
+		CLI_REL_HISTORY_DIGEST{},
+		REL_CLI_HISTORY_RESYNC{},
+	}
+}
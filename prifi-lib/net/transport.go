@@ -0,0 +1,157 @@
+package net
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+A Transport carries the data of the rounds (upstream ciphers, downstream cells) between the relay and a client, as
+frames of encoded messages. The control messages (parameters, keys, shuffle) always go through the connection the
+node joined with. The relay offers its transports to the clients in ALL_ALL_PARAMETERS ("Transports", see
+FormatTransportOffers), and each client picks one, e.g. UDP for a client behind a NAT which breaks long TCP
+connections; a client which picks none, or cannot reach the one it picked, keeps using its control connection.
+
+"tcp" and "udp" are built in, other transports can be added with RegisterTransport. The relay refuses to offer, and
+the clients to prefer, a transport which is not registered.
+QUIC is not built in : the standard library has no QUIC, and PriFi does not depend on a third-party implementation
+for it. A deployment which wants it can register one, wrapping e.g. quic-go, with RegisterTransport("quic", ...).
+*/
+
+// The names of the built-in transports
+const (
+	TRANSPORT_TCP = "tcp"
+	TRANSPORT_UDP = "udp"
+)
+
+// TransportConn carries frames between the relay and one client
+type TransportConn interface {
+	// Send sends one frame. It fails if the frame is too large for the transport, without closing the connection.
+	Send(frame []byte) error
+
+	// Receive blocks until a frame arrives, or the connection is closed
+	Receive() ([]byte, error)
+
+	// RemoteAddr returns the address of the other end
+	RemoteAddr() string
+
+	Close() error
+}
+
+// TransportListener accepts the connections of the clients on the relay
+type TransportListener interface {
+	Accept() (TransportConn, error)
+
+	// Addr returns the address the relay listens on
+	Addr() string
+
+	Close() error
+}
+
+// Transport creates the connections between the relay and the clients
+type Transport interface {
+	Name() string
+
+	// Reliable tells if the frames are delivered in order and without loss. If not, a lost frame is handled like a
+	// lost cipher : its round times out.
+	Reliable() bool
+
+	// MaxFrameSize returns the size of the largest frame Send accepts
+	MaxFrameSize() int
+
+	// Listen is used by the relay
+	Listen(addr string) (TransportListener, error)
+
+	// Dial is used by a client
+	Dial(addr string) (TransportConn, error)
+}
+
+var transports = struct {
+	sync.RWMutex
+	factories map[string]func() Transport
+}{factories: map[string]func() Transport{
+	TRANSPORT_TCP: func() Transport { return new(tcpTransport) },
+	TRANSPORT_UDP: func() Transport { return new(udpTransport) },
+}}
+
+// RegisterTransport makes a transport available under name, replacing any previous one
+func RegisterTransport(name string, factory func() Transport) {
+	transports.Lock()
+	defer transports.Unlock()
+	transports.factories[name] = factory
+}
+
+// NewTransport returns the transport of the given name
+func NewTransport(name string) (Transport, error) {
+	transports.RLock()
+	defer transports.RUnlock()
+	if factory, ok := transports.factories[name]; ok {
+		return factory(), nil
+	}
+	return nil, errors.New("unknown transport \"" + name + "\", available are " + strings.Join(availableTransports(), ", "))
+}
+
+// AvailableTransports returns the names of the registered transports
+func AvailableTransports() []string {
+	transports.RLock()
+	defer transports.RUnlock()
+	return availableTransports()
+}
+
+func availableTransports() []string {
+	names := make([]string, 0, len(transports.factories))
+	for name := range transports.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TransportOffer is a transport the relay listens on, and the address where the clients reach it
+type TransportOffer struct {
+	Name    string
+	Address string
+}
+
+// ParseTransportOffers parses offers formatted as "name=host:port,name=host:port", e.g. "udp=relay.example.org:7001".
+// An empty string has no offer.
+func ParseTransportOffers(s string) ([]TransportOffer, error) {
+	offers := make([]TransportOffer, 0)
+	if strings.TrimSpace(s) == "" {
+		return offers, nil
+	}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.New("invalid transport offer \"" + part + "\", expected name=host:port")
+		}
+		if seen[kv[0]] {
+			return nil, errors.New("transport \"" + kv[0] + "\" is offered twice")
+		}
+		seen[kv[0]] = true
+		offers = append(offers, TransportOffer{Name: kv[0], Address: kv[1]})
+	}
+	return offers, nil
+}
+
+// FormatTransportOffers is the inverse of ParseTransportOffers
+func FormatTransportOffers(offers []TransportOffer) string {
+	parts := make([]string, len(offers))
+	for i, o := range offers {
+		parts[i] = o.Name + "=" + o.Address
+	}
+	return strings.Join(parts, ",")
+}
+
+// PickTransportOffer returns the offer of the transport named preferred, and false if the relay does not offer it
+func PickTransportOffer(offers []TransportOffer, preferred string) (TransportOffer, bool) {
+	for _, o := range offers {
+		if o.Name == preferred {
+			return o, true
+		}
+	}
+	return TransportOffer{}, false
+}
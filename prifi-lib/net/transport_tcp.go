@@ -0,0 +1,108 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	gonet "net"
+	"strconv"
+	"sync"
+)
+
+// TCP_TRANSPORT_MAX_FRAME_SIZE is the size of the largest frame of the "tcp" transport
+const TCP_TRANSPORT_MAX_FRAME_SIZE = 64 * 1024 * 1024
+
+// tcpTransport sends each frame prefixed by its length on a TCP connection
+type tcpTransport struct{}
+
+func (t *tcpTransport) Name() string {
+	return TRANSPORT_TCP
+}
+
+func (t *tcpTransport) Reliable() bool {
+	return true
+}
+
+func (t *tcpTransport) MaxFrameSize() int {
+	return TCP_TRANSPORT_MAX_FRAME_SIZE
+}
+
+func (t *tcpTransport) Listen(addr string) (TransportListener, error) {
+	listener, err := gonet.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpListener{listener: listener}, nil
+}
+
+func (t *tcpTransport) Dial(addr string) (TransportConn, error) {
+	conn, err := gonet.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConn{conn: conn}, nil
+}
+
+type tcpListener struct {
+	listener gonet.Listener
+}
+
+func (l *tcpListener) Accept() (TransportConn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConn{conn: conn}, nil
+}
+
+func (l *tcpListener) Addr() string {
+	return l.listener.Addr().String()
+}
+
+func (l *tcpListener) Close() error {
+	return l.listener.Close()
+}
+
+// tcpConn is safe for one reader and concurrent writers
+type tcpConn struct {
+	sync.Mutex
+	conn gonet.Conn
+}
+
+func (c *tcpConn) Send(frame []byte) error {
+	if len(frame) > TCP_TRANSPORT_MAX_FRAME_SIZE {
+		return errors.New("frame of " + strconv.Itoa(len(frame)) + " bytes is too large for the tcp transport")
+	}
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(frame)))
+	copy(buf[4:], frame)
+
+	c.Lock()
+	defer c.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *tcpConn) Receive() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > TCP_TRANSPORT_MAX_FRAME_SIZE {
+		return nil, errors.New("frame of " + strconv.FormatUint(uint64(length), 10) + " bytes is too large for the tcp transport")
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (c *tcpConn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *tcpConn) Close() error {
+	return c.conn.Close()
+}
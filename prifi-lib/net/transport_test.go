@@ -0,0 +1,116 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTransportOffers(t *testing.T) {
+	offers, err := ParseTransportOffers(" udp=relay.example.org:7001, tcp=10.0.0.1:7002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offers) != 2 || offers[0] != (TransportOffer{"udp", "relay.example.org:7001"}) || offers[1] != (TransportOffer{"tcp", "10.0.0.1:7002"}) {
+		t.Error("Wrong offers", offers)
+	}
+	if s := FormatTransportOffers(offers); s != "udp=relay.example.org:7001,tcp=10.0.0.1:7002" {
+		t.Error("Wrong formatted offers", s)
+	}
+	if offer, ok := PickTransportOffer(offers, TRANSPORT_TCP); !ok || offer.Address != "10.0.0.1:7002" {
+		t.Error("Should pick the tcp offer", offer, ok)
+	}
+	if _, ok := PickTransportOffer(offers, "quic"); ok {
+		t.Error("quic is not offered")
+	}
+
+	if offers, err := ParseTransportOffers(""); err != nil || len(offers) != 0 {
+		t.Error("An empty string has no offer", offers, err)
+	}
+	for _, invalid := range []string{"udp", "udp=", "=host:1", "udp=a:1,udp=b:2"} {
+		if _, err := ParseTransportOffers(invalid); err == nil {
+			t.Error("Offers", invalid, "should be refused")
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	for _, name := range []string{TRANSPORT_TCP, TRANSPORT_UDP} {
+		transport, err := NewTransport(name)
+		if err != nil || transport.Name() != name {
+			t.Error("Could not create the", name, "transport", err)
+		}
+	}
+	if _, err := NewTransport("quic"); err == nil {
+		t.Error("quic is not built in")
+	}
+	if _, err := NewTransport("carrier-pigeon"); err == nil {
+		t.Error("Unknown transports should be refused")
+	}
+}
+
+// testTransportRoundTrip sends a frame each way between a client and the relay
+func testTransportRoundTrip(t *testing.T, name string) {
+	transport, err := NewTransport(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := transport.Dial(listener.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Send([]byte("upstream")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan TransportConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	var relay TransportConn
+	select {
+	case relay = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The", name, "listener did not accept the client")
+	}
+	defer relay.Close()
+
+	if frame, err := relay.Receive(); err != nil || !bytes.Equal(frame, []byte("upstream")) {
+		t.Error("Wrong upstream frame", frame, err)
+	}
+	if err := relay.Send([]byte("downstream")); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := client.Receive(); err != nil || !bytes.Equal(frame, []byte("downstream")) {
+		t.Error("Wrong downstream frame", frame, err)
+	}
+
+	// a frame too large is refused, without closing the connection
+	if err := client.Send(make([]byte, transport.MaxFrameSize()+1)); err == nil {
+		t.Error("A frame larger than", transport.MaxFrameSize(), "should be refused")
+	}
+	if err := client.Send([]byte("again")); err != nil {
+		t.Error("The connection should still be usable", err)
+	}
+	if frame, err := relay.Receive(); err != nil || !bytes.Equal(frame, []byte("again")) {
+		t.Error("Wrong upstream frame", frame, err)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	testTransportRoundTrip(t, TRANSPORT_TCP)
+}
+
+func TestUDPTransport(t *testing.T) {
+	testTransportRoundTrip(t, TRANSPORT_UDP)
+}
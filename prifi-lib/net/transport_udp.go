@@ -0,0 +1,218 @@
+package net
+
+import (
+	"errors"
+	gonet "net"
+	"strconv"
+	"sync"
+)
+
+// UDP_TRANSPORT_MAX_FRAME_SIZE is the size of the largest frame of the "udp" transport, which sends one datagram per
+// frame; larger frames go through the control connection
+const UDP_TRANSPORT_MAX_FRAME_SIZE = 65507
+
+// UDP_TRANSPORT_QUEUE is the number of received frames of a connection waiting for Receive; past that, they are dropped
+const UDP_TRANSPORT_QUEUE = 64
+
+// UDP_TRANSPORT_MAX_PEERS is the number of clients a listener of the "udp" transport accepts at once
+const UDP_TRANSPORT_MAX_PEERS = 1024
+
+// udpTransport sends each frame in one datagram. Frames may be lost, duplicated or reordered.
+type udpTransport struct{}
+
+func (t *udpTransport) Name() string {
+	return TRANSPORT_UDP
+}
+
+func (t *udpTransport) Reliable() bool {
+	return false
+}
+
+func (t *udpTransport) MaxFrameSize() int {
+	return UDP_TRANSPORT_MAX_FRAME_SIZE
+}
+
+func (t *udpTransport) Listen(addr string) (TransportListener, error) {
+	pc, err := gonet.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		pc:       pc,
+		peers:    make(map[string]*udpConn),
+		accepted: make(chan *udpConn, 16),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (t *udpTransport) Dial(addr string) (TransportConn, error) {
+	conn, err := gonet.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newUDPConn(conn.RemoteAddr().String(), func(frame []byte) error {
+		_, err := conn.Write(frame)
+		return err
+	}, func() {
+		conn.Close()
+	})
+	go func() {
+		buf := make([]byte, UDP_TRANSPORT_MAX_FRAME_SIZE)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			c.deliver(append([]byte(nil), buf[:n]...))
+		}
+	}()
+	return c, nil
+}
+
+// udpListener reads the datagrams of all the clients on one socket, and gives them to the connection of their sender
+type udpListener struct {
+	sync.Mutex
+	pc       gonet.PacketConn
+	peers    map[string]*udpConn
+	accepted chan *udpConn
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, UDP_TRANSPORT_MAX_FRAME_SIZE)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.Lock()
+			for _, peer := range l.peers {
+				peer.closeOnly()
+			}
+			l.peers = make(map[string]*udpConn)
+			l.Unlock()
+			close(l.accepted)
+			return
+		}
+		frame := append([]byte(nil), buf[:n]...)
+
+		l.Lock()
+		peer, ok := l.peers[addr.String()]
+		if !ok {
+			if len(l.peers) >= UDP_TRANSPORT_MAX_PEERS {
+				l.Unlock()
+				continue
+			}
+			peer = l.newPeer(addr)
+			select {
+			case l.accepted <- peer:
+				l.peers[addr.String()] = peer
+			default:
+				// no one accepts, drop the datagram; the client will send another one
+				l.Unlock()
+				continue
+			}
+		}
+		l.Unlock()
+		peer.deliver(frame)
+	}
+}
+
+func (l *udpListener) newPeer(addr gonet.Addr) *udpConn {
+	key := addr.String()
+	var peer *udpConn
+	peer = newUDPConn(key, func(frame []byte) error {
+		_, err := l.pc.WriteTo(frame, addr)
+		return err
+	}, func() {
+		l.Lock()
+		defer l.Unlock()
+		if l.peers[key] == peer {
+			delete(l.peers, key)
+		}
+	})
+	return peer
+}
+
+func (l *udpListener) Accept() (TransportConn, error) {
+	peer, ok := <-l.accepted
+	if !ok {
+		return nil, errors.New("the udp listener is closed")
+	}
+	return peer, nil
+}
+
+func (l *udpListener) Addr() string {
+	return l.pc.LocalAddr().String()
+}
+
+func (l *udpListener) Close() error {
+	return l.pc.Close()
+}
+
+// udpConn is one client of a udpListener, or the socket of a client
+type udpConn struct {
+	remote    string
+	write     func([]byte) error
+	onClose   func()
+	frames    chan []byte
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newUDPConn(remote string, write func([]byte) error, onClose func()) *udpConn {
+	return &udpConn{
+		remote:  remote,
+		write:   write,
+		onClose: onClose,
+		frames:  make(chan []byte, UDP_TRANSPORT_QUEUE),
+		closed:  make(chan bool),
+	}
+}
+
+// deliver queues a received frame, or drops it if Receive is too slow
+func (c *udpConn) deliver(frame []byte) {
+	select {
+	case c.frames <- frame:
+	default:
+	}
+}
+
+func (c *udpConn) Send(frame []byte) error {
+	if len(frame) > UDP_TRANSPORT_MAX_FRAME_SIZE {
+		return errors.New("frame of " + strconv.Itoa(len(frame)) + " bytes is too large for the udp transport")
+	}
+	select {
+	case <-c.closed:
+		return errors.New("the udp connection to " + c.remote + " is closed")
+	default:
+	}
+	return c.write(frame)
+}
+
+func (c *udpConn) Receive() ([]byte, error) {
+	select {
+	case frame := <-c.frames:
+		return frame, nil
+	case <-c.closed:
+		return nil, errors.New("the udp connection to " + c.remote + " is closed")
+	}
+}
+
+func (c *udpConn) RemoteAddr() string {
+	return c.remote
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+	return nil
+}
+
+// closeOnly closes the connection when its listener closes
+func (c *udpConn) closeOnly() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
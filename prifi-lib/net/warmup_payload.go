@@ -0,0 +1,44 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// WARMUP_PAYLOAD_PATTERN starts the synthetic upstream payloads sent during the warm-up rounds
+const WARMUP_PAYLOAD_PATTERN uint16 = 0x3C3C
+
+// WARMUP_PAYLOAD_HEADER_SIZE is the size of the header of a warm-up payload: pattern (2 bytes), 2 bytes left to the
+// disruption protection (which writes the client ID in the 4th byte), round ID (4 bytes)
+const WARMUP_PAYLOAD_HEADER_SIZE = 8
+
+// NewWarmupPayload returns the synthetic payload of size bytes that the owner of the slot sends in a warm-up round. It
+// only depends on the round, so that the relay knows what it should decode.
+func NewWarmupPayload(roundID int32, size int) []byte {
+	b := make([]byte, 0, size+sha256.Size)
+	header := make([]byte, WARMUP_PAYLOAD_HEADER_SIZE)
+	binary.BigEndian.PutUint16(header[0:2], WARMUP_PAYLOAD_PATTERN)
+	binary.BigEndian.PutUint32(header[4:8], uint32(roundID))
+	b = append(b, header...)
+
+	// the rest is a hash chain, so that every bit of the payload is checked
+	counter := make([]byte, 8)
+	for i := uint32(0); len(b) < size; i++ {
+		binary.BigEndian.PutUint32(counter[0:4], uint32(roundID))
+		binary.BigEndian.PutUint32(counter[4:8], i)
+		h := sha256.Sum256(counter)
+		b = append(b, h[:]...)
+	}
+	return b[:size]
+}
+
+// CheckWarmupPayload returns true if payload is the warm-up payload of the round, ignoring the bytes the disruption
+// protection may change
+func CheckWarmupPayload(roundID int32, payload []byte) bool {
+	if len(payload) < WARMUP_PAYLOAD_HEADER_SIZE {
+		return false
+	}
+	expected := NewWarmupPayload(roundID, len(payload))
+	return bytes.Equal(payload[:2], expected[:2]) && bytes.Equal(payload[4:], expected[4:])
+}
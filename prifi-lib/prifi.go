@@ -1,7 +1,11 @@
 package prifi_lib
 
 import (
+	"errors"
+	"time"
+
 	"github.com/dedis/prifi/prifi-lib/client"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/relay"
 	"github.com/dedis/prifi/prifi-lib/trustee"
@@ -26,6 +30,9 @@ type PriFiLibInstance struct { //todo remove this, like it was done for client
 //Prifi's "Relay", "Client" and "Trustee" instance all can receive a message
 type SpecializedLibInstance interface {
 	ReceivedMessage(msg interface{}) error
+	ShutdownReport() *prifilog.ShutdownReport
+	State() string
+	SetFaultInjectors(incoming *net.FaultInjector, outgoing *net.FaultInjector)
 }
 
 // Possible role of PriFi entities.
@@ -39,9 +46,9 @@ const (
 )
 
 // NewPriFiClient creates a new PriFi client
-func NewPriFiClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, msgSender net.MessageSender) *PriFiLibInstance {
+func NewPriFiClient(doLatencyTest bool, encryptLatencyTests bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, trafficShapingProfile string, slotsPerSchedule int, cellCaptureFile string, udpVerificationRate int, udpVerificationMaxDivergences int, msgSender net.MessageSender) *PriFiLibInstance {
 	msw := newMessageSenderWrapper(msgSender)
-	c := client.NewClient(doLatencyTest, dataOutputEnabled, dataForDCNet, dataFromDCNet, doReplayPcap, pcapFolder, msw)
+	c := client.NewClient(doLatencyTest, encryptLatencyTests, dataOutputEnabled, dataForDCNet, dataFromDCNet, doReplayPcap, pcapFolder, trafficShapingProfile, slotsPerSchedule, cellCaptureFile, udpVerificationRate, udpVerificationMaxDivergences, msw)
 	p := &PriFiLibInstance{
 		role:                   PRIFI_ROLE_CLIENT,
 		specializedLibInstance: c,
@@ -63,7 +70,7 @@ func NewPriFiRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromD
 }
 
 // NewPriFiTrustee creates a new PriFi trustee
-func NewPriFiTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgSender net.MessageSender) *PriFiLibInstance {
+func NewPriFiTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, cpuBudget int, msgSender net.MessageSender) *PriFiLibInstance {
 	//msw := newMessageSenderWrapper(msgSender)
 
 	errHandling := func(e error) { /* do nothing yet, we are alerted of errors via the SDA */ }
@@ -75,7 +82,7 @@ func NewPriFiTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int,
 		log.Fatal("Could not create a MessageSenderWrapper, error is", err)
 	}
 
-	t := trustee.NewTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, msw)
+	t := trustee.NewTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, cpuBudget, msw)
 	p := &PriFiLibInstance{
 		role:                   PRIFI_ROLE_TRUSTEE,
 		specializedLibInstance: t,
@@ -95,6 +102,100 @@ func (p *PriFiLibInstance) ReceivedMessage(msg interface{}) error {
 	return nil
 }
 
+// ShutdownReport returns the summary of this entity's session, as of now; it is final once the entity received
+// ALL_ALL_SHUTDOWN
+func (p *PriFiLibInstance) ShutdownReport() *prifilog.ShutdownReport {
+	return p.specializedLibInstance.ShutdownReport()
+}
+
+// State returns the current state of this entity, e.g. "READY" for a client
+func (p *PriFiLibInstance) State() string {
+	return p.specializedLibInstance.State()
+}
+
+// DCNetUp returns true if this entity is a client taking part in the rounds, i.e. if its SOCKS data is sent
+// anonymously
+func (p *PriFiLibInstance) DCNetUp() bool {
+	c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance)
+	return ok && c.DCNetUp()
+}
+
+// SOCKSCredentials returns the username/password pairs the relay gave to this client for its SOCKS server; nil if
+// this entity is not a client, or there are none
+func (p *PriFiLibInstance) SOCKSCredentials() map[string]string {
+	if c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance); ok {
+		return c.SOCKSCredentials()
+	}
+	return nil
+}
+
+// SetFaultInjectors makes this entity drop, delay or corrupt some of the messages it receives (incoming) and sends
+// (outgoing), for the tests; nil delivers everything
+func (p *PriFiLibInstance) SetFaultInjectors(incoming *net.FaultInjector, outgoing *net.FaultInjector) {
+	p.specializedLibInstance.SetFaultInjectors(incoming, outgoing)
+}
+
+// SetTrusteeKeyEndorser makes a trustee endorse its key of the session with endorse, which signs with its long-term key
+func (p *PriFiLibInstance) SetTrusteeKeyEndorser(endorse func(msg []byte) ([]byte, error)) error {
+	t, ok := p.specializedLibInstance.(*trustee.PriFiLibTrusteeInstance)
+	if !ok {
+		return errors.New("only a trustee can endorse its key")
+	}
+	t.SetKeyEndorser(endorse)
+	return nil
+}
+
+// AnnounceDrain makes a relay announce to the clients that it shuts down at deadline
+func (p *PriFiLibInstance) AnnounceDrain(deadline time.Time) error {
+	r, ok := p.specializedLibInstance.(*relay.PriFiLibRelayInstance)
+	if !ok {
+		return errors.New("only a relay can announce a drain")
+	}
+	return r.AnnounceDrain(deadline)
+}
+
+// AdmitClient makes a relay admit the client which connected with clientID during the session
+func (p *PriFiLibInstance) AdmitClient(clientID int) error {
+	r, ok := p.specializedLibInstance.(*relay.PriFiLibRelayInstance)
+	if !ok {
+		return errors.New("only a relay can admit a client")
+	}
+	return r.AdmitClient(clientID)
+}
+
+// SetUpstreamPaused makes a client send only cover traffic (paused = true), or its data again (paused = false)
+func (p *PriFiLibInstance) SetUpstreamPaused(paused bool) error {
+	c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance)
+	if !ok {
+		return errors.New("only a client can pause its upstream")
+	}
+	if paused {
+		c.PauseUpstream()
+	} else {
+		c.ResumeUpstream()
+	}
+	return nil
+}
+
+// SetLatencyTestInterval sets the time between two latency probes of a client; 0 means the default
+func (p *PriFiLibInstance) SetLatencyTestInterval(interval time.Duration) error {
+	c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance)
+	if !ok {
+		return errors.New("only a client can do latency tests")
+	}
+	c.SetLatencyTestInterval(interval)
+	return nil
+}
+
+// LeaveSession makes a client leave the session; the returned channel is closed once the relay removed it
+func (p *PriFiLibInstance) LeaveSession() (chan bool, error) {
+	c, ok := p.specializedLibInstance.(*client.PriFiLibClientInstance)
+	if !ok {
+		return nil, errors.New("only a client can leave the session")
+	}
+	return c.Leave()
+}
+
 func newMessageSenderWrapper(msgSender net.MessageSender) *net.MessageSenderWrapper {
 
 	errHandling := func(e error) { /* do nothing yet, we are alerted of errors via the SDA */ }
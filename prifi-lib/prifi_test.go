@@ -35,8 +35,8 @@ func TestPrifi(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client0 := NewPriFiClient(true, true, in, out, false, "./", msgSender)
-	client1 := NewPriFiClient(true, true, in, out, false, "./", msgSender)
+	client0 := NewPriFiClient(true, true, true, in, out, false, "./", "", 1, "", 0, 0, msgSender)
+	client1 := NewPriFiClient(true, true, true, in, out, false, "./", "", 1, "", 0, 0, msgSender)
 
 	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
 	resultChan := make(chan interface{}, 1)
@@ -46,8 +46,8 @@ func TestPrifi(t *testing.T) {
 	alwaysSlowDown := true
 	neverSlowDown := false
 	baseSleepTime := 1000
-	trustee0 := NewPriFiTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, msgSender)
-	trustee1 := NewPriFiTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, msgSender)
+	trustee0 := NewPriFiTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, 0, msgSender)
+	trustee1 := NewPriFiTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, 0, msgSender)
 
 	//TODO : emulate network connectivity, and run for a few rounds
 
@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"fmt"
+)
+
+// roundParticipants returns the IDs of the clients whose cipher is in the round being decoded
+func roundParticipants(clientSlices [][]byte) []int {
+	participants := make([]int, 0, len(clientSlices))
+	for i, s := range clientSlices {
+		if s != nil {
+			participants = append(participants, i)
+		}
+	}
+	return participants
+}
+
+// recordSlotAnonymity is called when data appears in roundID : the owner of its slot is one of the clients which took
+// part in it. If this leaves fewer than RelayMinAnonymitySet candidates for the slot in this epoch, the operator is
+// warned (once per slot and epoch).
+func (p *PriFiLibRelayInstance) recordSlotAnonymity(roundID int32) {
+	sent := p.relayState.roundManager.GetDataAlreadySent(roundID)
+	if sent == nil || sent.OwnershipID < 0 {
+		return // e.g. round 0, which has no downstream data
+	}
+	slot, below := p.relayState.anonymityStatistics.AddDataRound(roundID, sent.OwnershipID, p.relayState.roundParticipants)
+	if below {
+		relayLog.Lvl1("WARNING: Relay : the data of slot", slot.Slot, "comes from one of only", slot.AnonymitySet,
+			"clients (over", slot.DataRounds, "rounds), below RelayMinAnonymitySet; its sender has a small anonymity set")
+	}
+}
+
+// reportEpochAnonymity logs the smallest anonymity set of the epoch which ends, for the experiments
+func (p *PriFiLibRelayInstance) reportEpochAnonymity() {
+	smallest, ok := p.relayState.anonymityStatistics.Smallest()
+	if !ok {
+		return
+	}
+	str := fmt.Sprintf("smallest anonymity set %v (slot %v, %v rounds with data), over %v active slots and %v clients",
+		smallest.AnonymitySet, smallest.Slot, smallest.DataRounds, len(p.relayState.anonymityStatistics.Slots()), p.relayState.nClients)
+	relayLog.Lvl2("Relay : epoch", str)
+	p.collectExperimentResult("Anonymity: " + str)
+}
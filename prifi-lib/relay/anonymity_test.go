@@ -0,0 +1,13 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoundParticipants(t *testing.T) {
+	clientSlices := [][]byte{{1}, nil, {}, nil, {4}}
+	if p := roundParticipants(clientSlices); !reflect.DeepEqual(p, []int{0, 2, 4}) {
+		t.Error("Wrong participants", p)
+	}
+}
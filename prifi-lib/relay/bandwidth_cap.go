@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BANDWIDTH_CAP_BURST is how far ahead of the cap the relay may send, e.g. to open the rounds of its window at once
+const BANDWIDTH_CAP_BURST = time.Second
+
+// BandwidthCap bounds the bytes the relay sends, across all the slots : the downstream cells to the clients (once per
+// client over TCP, once over UDP) and the data of the decoded upstream payloads to the SOCKS exit. It is a virtual
+// clock : each byte sent pushes the clock by 1/bytesPerSecond, and the relay waits before opening a round while the
+// clock is more than BANDWIDTH_CAP_BURST ahead of time. Over any interval of T seconds, the relay sends at most
+// bytesPerSecond * (T + BANDWIDTH_CAP_BURST) bytes, plus one round; this does not depend on the traffic.
+type BandwidthCap struct {
+	sync.Mutex
+	bytesPerSecond int64
+	clock          time.Time // when the bytes sent so far are paid for
+	now            func() time.Time
+
+	// statistics
+	bytesSent int64
+	waits     int64
+	waited    time.Duration
+}
+
+// NewBandwidthCap creates a cap of bytesPerSecond, which must be positive
+func NewBandwidthCap(bytesPerSecond int) *BandwidthCap {
+	return &BandwidthCap{
+		bytesPerSecond: int64(bytesPerSecond),
+		now:            time.Now,
+	}
+}
+
+// BytesPerSecond returns the cap
+func (c *BandwidthCap) BytesPerSecond() int {
+	return int(c.bytesPerSecond)
+}
+
+// Sent records that the relay sent n bytes
+func (c *BandwidthCap) Sent(n int64) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if c.clock.Before(now) {
+		c.clock = now
+	}
+	c.clock = c.clock.Add(time.Duration(n * int64(time.Second) / c.bytesPerSecond))
+	c.bytesSent += n
+}
+
+// Delay returns how long the relay must wait before sending more, 0 if it is within the cap
+func (c *BandwidthCap) Delay() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	delay := c.clock.Sub(c.now()) - BANDWIDTH_CAP_BURST
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Wait sleeps until the relay can send more
+func (c *BandwidthCap) Wait() {
+	delay := c.Delay()
+	if delay <= 0 {
+		return
+	}
+	c.Lock()
+	c.waits++
+	c.waited += delay
+	c.Unlock()
+	time.Sleep(delay)
+}
+
+// MaxDownstreamCellSize returns the largest downstream cell which fits in the burst of the cap, along with the
+// upstream payloads of a round, given to recipients (the clients over TCP, 1 over UDP). It is <= 0 if the upstream
+// payloads alone do not fit.
+func (c *BandwidthCap) MaxDownstreamCellSize(upstreamBytesPerRound int, recipients int) int {
+	burst := int(c.bytesPerSecond * int64(BANDWIDTH_CAP_BURST) / int64(time.Second))
+	if recipients < 1 {
+		recipients = 1
+	}
+	return (burst - upstreamBytesPerRound) / recipients
+}
+
+// WritePrometheus writes the state of the cap, in the Prometheus text format
+func (c *BandwidthCap) WritePrometheus(w io.Writer, prefix string) error {
+	c.Lock()
+	capBytes, sent, waits, waited := c.bytesPerSecond, c.bytesSent, c.waits, c.waited
+	c.Unlock()
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_bandwidth_cap_bytes_per_second gauge\n%s_bandwidth_cap_bytes_per_second %v\n", prefix, prefix, capBytes)
+	fmt.Fprintf(w, "# TYPE %s_bandwidth_cap_sent_bytes_total counter\n%s_bandwidth_cap_sent_bytes_total %v\n", prefix, prefix, sent)
+	fmt.Fprintf(w, "# TYPE %s_bandwidth_cap_waits_total counter\n%s_bandwidth_cap_waits_total %v\n", prefix, prefix, waits)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# TYPE %s_bandwidth_cap_waited_seconds_total counter\n%s_bandwidth_cap_waited_seconds_total %v\n", prefix, prefix, waited.Seconds())
+	return err
+}
+
+// applyBandwidthCap checks that the rounds of this epoch fit in the cap, if any, and shrinks the downstream cells
+// padded with dummy data if needed. It fails if the upstream payloads of one round alone exceed the burst.
+func (p *PriFiLibRelayInstance) applyBandwidthCap() error {
+	c := p.relayState.bandwidthCap
+	if c == nil {
+		return nil
+	}
+	recipients := p.nActiveClients()
+	if p.relayState.UseUDP {
+		recipients = 1
+	}
+	upstream := p.relayState.PayloadSize * p.relayState.CellsPerRound
+	maxDownstream := c.MaxDownstreamCellSize(upstream, recipients)
+	if maxDownstream <= 0 {
+		return errors.New("the upstream payloads of one round (" + strconv.Itoa(upstream) + " bytes) exceed RelayGroupBandwidthCap (" +
+			strconv.Itoa(c.BytesPerSecond()) + " bytes/s)")
+	}
+	if p.relayState.DownstreamCellSize > maxDownstream {
+		relayLog.Lvl1("Relay : downstream cells of", p.relayState.DownstreamCellSize, "bytes to", recipients,
+			"recipients exceed RelayGroupBandwidthCap, using", maxDownstream, "bytes")
+		p.relayState.DownstreamCellSize = maxDownstream
+	}
+	return nil
+}
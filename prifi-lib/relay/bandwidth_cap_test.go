@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthCap(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := NewBandwidthCap(1000)
+	c.now = func() time.Time { return now }
+
+	// up to one second of the cap is sent without waiting
+	c.Sent(600)
+	if c.Delay() != 0 {
+		t.Error("The burst should not wait, got", c.Delay())
+	}
+	c.Sent(900)
+	if c.Delay() != 500*time.Millisecond {
+		t.Error("1500 bytes at 1000 bytes/s with a burst of 1s should wait 500ms, got", c.Delay())
+	}
+
+	// time pays the bytes back
+	now = now.Add(300 * time.Millisecond)
+	if c.Delay() != 200*time.Millisecond {
+		t.Error("Should wait 200ms, got", c.Delay())
+	}
+	now = now.Add(10 * time.Second)
+	if c.Delay() != 0 {
+		t.Error("Should not wait after an idle period, got", c.Delay())
+	}
+
+	// an idle period does not build up credit beyond the burst
+	c.Sent(2000)
+	if c.Delay() != time.Second {
+		t.Error("The credit of an idle period should not exceed the burst, got", c.Delay())
+	}
+
+	// over a long run, the rate is the cap
+	sent := int64(0)
+	start := now
+	for i := 0; i < 100; i++ {
+		now = now.Add(c.Delay())
+		c.Sent(250)
+		sent += 250
+	}
+	elapsed := now.Sub(start).Seconds()
+	if rate := float64(sent) / (elapsed + BANDWIDTH_CAP_BURST.Seconds()); rate > 1000 {
+		t.Error("The rate should not exceed the cap, got", rate)
+	}
+
+	if max := c.MaxDownstreamCellSize(400, 3); max != 200 {
+		t.Error("(1000-400)/3 bytes should fit, got", max)
+	}
+	if max := c.MaxDownstreamCellSize(1200, 3); max > 0 {
+		t.Error("The upstream alone exceeds the cap, got", max)
+	}
+
+	var b bytes.Buffer
+	if err := c.WritePrometheus(&b, "prifi_relay"); err != nil || !strings.Contains(b.String(), "prifi_relay_bandwidth_cap_bytes_per_second 1000") {
+		t.Error("Wrong metrics", b.String(), err)
+	}
+}
+
+func TestApplyBandwidthCap(t *testing.T) {
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 4, PayloadSize: 1000, CellsPerRound: 1,
+		DownstreamCellSize: 10000, clientsLeft: make(map[int]bool)}}
+	if err := p.applyBandwidthCap(); err != nil || p.relayState.DownstreamCellSize != 10000 {
+		t.Error("Without cap, nothing changes")
+	}
+
+	p.relayState.bandwidthCap = NewBandwidthCap(9000)
+	if err := p.applyBandwidthCap(); err != nil || p.relayState.DownstreamCellSize != 2000 {
+		t.Error("The downstream cells should shrink to (9000-1000)/4 bytes, got", p.relayState.DownstreamCellSize, err)
+	}
+	p.relayState.UseUDP = true
+	p.relayState.DownstreamCellSize = 10000
+	if err := p.applyBandwidthCap(); err != nil || p.relayState.DownstreamCellSize != 8000 {
+		t.Error("Over UDP, the cells are sent once, got", p.relayState.DownstreamCellSize, err)
+	}
+
+	p.relayState.bandwidthCap = NewBandwidthCap(900)
+	if err := p.applyBandwidthCap(); err == nil {
+		t.Error("A cap below the upstream of one round should be refused")
+	}
+}
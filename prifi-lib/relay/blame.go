@@ -0,0 +1,298 @@
+package relay
+
+/*
+When the relay detects a disrupted round (the cell of a slot did not carry its HMAC, see checkCellHmac), it keeps the
+decoded cell and the ciphers of the round, and tells the clients and the trustees with REL_ALL_DISRUPTION_DETECTED.
+The owner of the slot looks for a bit it set to 0, but which is 1 in the decoded cell, and blames it with
+CLI_REL_DISRUPTION_BLAME, proving that it knows the private key of the slot. The relay then asks everyone for the bits
+of their pads at this position, with REL_ALL_REVEAL_REQUEST :
+- a client or a trustee whose cipher is not the XOR of the bits it revealed is the disruptor;
+- otherwise, a client and a trustee revealed different bits for the pad they share. The relay asks the trustee for
+  their shared secret, with a proof that it is the Diffie-Hellman of their keys, and recomputes the pad : the one which
+  revealed the wrong bit is the disruptor.
+A disruptive client is excluded from the next schedule, like a client leaving the session (see departure.go). The
+trustees cannot be replaced during the session : the relay ends it through the timeout handler.
+*/
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// disruptedRound is what the relay keeps of a disrupted round, until it is blamed
+type disruptedRound struct {
+	slot           int
+	cell           []byte         // the decoded cell, with the b_echo_last flag and the HMAC
+	clientCiphers  map[int][]byte // the payloads of the ciphers of the round, by client
+	trusteeCiphers map[int][]byte // the payloads of the ciphers of the round, by trustee
+	clientIDs      []int          // the clients of the schedule, in the order of the pads of the trustees
+	payloadSize    int            // the size of the pads
+	blamed         bool
+}
+
+// blame is the blame of a disrupted round in progress
+type blame struct {
+	roundID     int32
+	bitPos      int
+	blameProof  []byte // the proof that the blame comes from the owner of the slot
+	round       *disruptedRound
+	clientBits  map[int]map[int]int // the bits revealed, by client then trustee
+	trusteeBits map[int]map[int]int // the bits revealed, by trustee then client
+
+	// the client and the trustee whose bits differ, while the trustee reveals their secret; -1 before
+	suspectClient  int
+	suspectTrustee int
+
+	// the secret of the suspected pair revealed by the trustee, and its proof; nil before
+	sharedSecret      kyber.Point
+	sharedSecretProof []byte
+}
+
+// recordDisruptedRound keeps the decoded cell and the ciphers of a disrupted round, which are forgotten when the round
+// closes
+func (p *PriFiLibRelayInstance) recordDisruptedRound(roundID int32, slot int, cell []byte) *disruptedRound {
+	d := &disruptedRound{
+		slot:           slot,
+		cell:           append([]byte{}, cell...),
+		clientCiphers:  make(map[int][]byte),
+		trusteeCiphers: make(map[int][]byte),
+		clientIDs:      p.activeClientIDs(),
+	}
+	if p.relayState.DCNet != nil {
+		d.payloadSize = p.relayState.DCNet.DCNetPayloadSize
+	}
+	for id, history := range p.relayState.CiphertextsHistoryClients {
+		if cipher, found := history[roundID]; found {
+			d.clientCiphers[int(id)] = append([]byte{}, dcnet.DCNetCipherFromBytes(cipher).Payload...)
+		}
+	}
+	for id, history := range p.relayState.CiphertextsHistoryTrustees {
+		if cipher, found := history[roundID]; found {
+			d.trusteeCiphers[int(id)] = append([]byte{}, dcnet.DCNetCipherFromBytes(cipher).Payload...)
+		}
+	}
+	if p.relayState.disruptedRounds == nil {
+		p.relayState.disruptedRounds = make(map[int32]*disruptedRound)
+	}
+	p.relayState.disruptedRounds[roundID] = d
+	return d
+}
+
+// startBlame handles the blame of a disrupted round by the owner of its slot : it checks that the blame comes from the
+// owner, and that the bit blamed is set in the cell, then asks everyone for the bits of their pads
+func (p *PriFiLibRelayInstance) startBlame(msg net.CLI_REL_DISRUPTION_BLAME, d *disruptedRound) error {
+	if d.blamed || p.relayState.blame != nil {
+		relayLog.Lvl2("Disruption: round", msg.RoundID, "is already blamed, or another blame is in progress; ignoring the blame")
+		return nil
+	}
+	if err := p.verifySlotOwnership(d.slot, msg.NIZK); err != nil {
+		e := "Relay : the blame of round " + strconv.Itoa(int(msg.RoundID)) + " does not come from the owner of slot " +
+			strconv.Itoa(d.slot) + ", " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	if msg.BitPos < 8 || msg.BitPos >= 8*len(d.cell) || dcnet.BitAt(d.cell, msg.BitPos) != 1 {
+		e := "Relay : the blame of round " + strconv.Itoa(int(msg.RoundID)) + " points to bit " + strconv.Itoa(msg.BitPos) +
+			", which is not set in the cell"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	d.blamed = true
+	p.relayState.blame = &blame{
+		roundID:        msg.RoundID,
+		bitPos:         msg.BitPos,
+		blameProof:     msg.NIZK,
+		round:          d,
+		clientBits:     make(map[int]map[int]int),
+		trusteeBits:    make(map[int]map[int]int),
+		suspectClient:  -1,
+		suspectTrustee: -1,
+	}
+	relayLog.Lvl1("Disruption: blaming round", msg.RoundID, "at bit", msg.BitPos, ", asking", len(d.clientCiphers),
+		"clients and", len(d.trusteeCiphers), "trustees for their pads")
+
+	toSend := &net.REL_ALL_REVEAL_REQUEST{
+		RoundID: msg.RoundID,
+		BitPos:  msg.BitPos,
+	}
+	for _, id := range sortedIDs(d.clientCiphers) {
+		p.messageSender.SendToClientWithLog(id, toSend, "(client "+strconv.Itoa(id)+", blame)")
+	}
+	for _, id := range sortedIDs(d.trusteeCiphers) {
+		p.messageSender.SendToTrusteeWithLog(id, toSend, "(trustee "+strconv.Itoa(id)+", blame)")
+	}
+	return nil
+}
+
+// verifySlotOwnership checks a proof of knowledge of the private key of the ephemeral key of slot, in the base of the
+// schedule
+func (p *PriFiLibRelayInstance) verifySlotOwnership(slot int, NIZK []byte) error {
+	if p.relayState.scheduleBase == nil || slot < 0 || slot >= len(p.relayState.EphemeralPublicKeys) {
+		return errors.New("the slot is not in the schedule")
+	}
+	return verifySlotOwnershipProof(p.relayState.scheduleBase, p.relayState.EphemeralPublicKeys[slot], NIZK)
+}
+
+/*
+Received_CLI_REL_REVEAL_BITS handles CLI_REL_REVEAL_BITS messages, the bits of the pads of a client for the round
+blamed. The bits are checked once all the clients and the trustees of the round revealed theirs.
+*/
+func (p *PriFiLibRelayInstance) Received_CLI_REL_REVEAL_BITS(msg net.CLI_REL_REVEAL_BITS) error {
+	b := p.relayState.blame
+	if b == nil || b.roundID != msg.RoundID {
+		relayLog.Lvl2("Relay : ignoring the bits of client", msg.ClientID, "for round", msg.RoundID, ", it is not blamed")
+		return nil
+	}
+	if _, found := b.round.clientCiphers[msg.ClientID]; !found {
+		relayLog.Lvl2("Relay : ignoring the bits of client", msg.ClientID, ", it did not take part in round", msg.RoundID)
+		return nil
+	}
+	b.clientBits[msg.ClientID] = msg.Bits
+	return p.checkRevealedBits()
+}
+
+/*
+Received_TRU_REL_REVEAL_BITS handles TRU_REL_REVEAL_BITS messages, the bits of the pads of a trustee for the round
+blamed, in the order of the clients of the schedule.
+*/
+func (p *PriFiLibRelayInstance) Received_TRU_REL_REVEAL_BITS(msg net.TRU_REL_REVEAL_BITS) error {
+	b := p.relayState.blame
+	if b == nil || b.roundID != msg.RoundID {
+		relayLog.Lvl2("Relay : ignoring the bits of trustee", msg.TrusteeID, "for round", msg.RoundID, ", it is not blamed")
+		return nil
+	}
+	if _, found := b.round.trusteeCiphers[msg.TrusteeID]; !found {
+		relayLog.Lvl2("Relay : ignoring the bits of trustee", msg.TrusteeID, ", it did not take part in round", msg.RoundID)
+		return nil
+	}
+	bits := make(map[int]int)
+	for index, bit := range msg.Bits {
+		if index >= 0 && index < len(b.round.clientIDs) {
+			bits[b.round.clientIDs[index]] = bit
+		}
+	}
+	b.trusteeBits[msg.TrusteeID] = bits
+	return p.checkRevealedBits()
+}
+
+// checkRevealedBits looks for the disruptor once everyone revealed its bits : first a client which did not reveal one
+// bit for each trustee of the round, then an entity whose cipher does not match its pads, then a client and a trustee which disagree on the pad they share
+func (p *PriFiLibRelayInstance) checkRevealedBits() error {
+	b := p.relayState.blame
+	d := b.round
+	if len(b.clientBits) < len(d.clientCiphers) || len(b.trusteeBits) < len(d.trusteeCiphers) || b.suspectTrustee != -1 {
+		return nil
+	}
+
+	for _, id := range sortedIDs(d.clientCiphers) {
+		if !validRevealedBits(b.clientBits[id], sortedIDs(d.trusteeCiphers)) {
+			return p.concludeBlame(true, id, "it did not reveal exactly one bit for each trustee of the round")
+		}
+	}
+	for _, id := range sortedIDs(d.clientCiphers) {
+		if xorBits(b.clientBits[id]) != dcnet.BitAt(d.clientCiphers[id], b.bitPos) {
+			return p.concludeBlame(true, id, "its cipher is not the XOR of the pads it revealed")
+		}
+	}
+	for _, id := range sortedIDs(d.trusteeCiphers) {
+		if xorBits(b.trusteeBits[id]) != dcnet.BitAt(d.trusteeCiphers[id], b.bitPos) {
+			return p.concludeBlame(false, id, "its cipher is not the XOR of the pads it revealed")
+		}
+	}
+
+	for _, clientID := range sortedIDs(d.clientCiphers) {
+		for _, trusteeID := range sortedIDs(d.trusteeCiphers) {
+			if b.clientBits[clientID][trusteeID] == b.trusteeBits[trusteeID][clientID] {
+				continue
+			}
+			index := sort.SearchInts(d.clientIDs, clientID)
+			relayLog.Lvl1("Disruption: client", clientID, "and trustee", trusteeID, "revealed different pads for round",
+				b.roundID, ", asking the trustee for their shared secret")
+			b.suspectClient, b.suspectTrustee = clientID, trusteeID
+			toSend := &net.REL_ALL_REVEAL_SHARED_SECRETS{EntityID: index}
+			p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(trustee "+strconv.Itoa(trusteeID)+", blame)")
+			return nil
+		}
+	}
+
+	log.Error("Disruption: the pads revealed for round", b.roundID, "are consistent, no disruptor found")
+	p.relayState.blame = nil
+	delete(p.relayState.disruptedRounds, b.roundID)
+	return nil
+}
+
+// resolveSuspectPair checks the secret the suspected trustee shares with the suspected client, and recomputes their
+// pad : the one which revealed another bit is the disruptor
+func (p *PriFiLibRelayInstance) resolveSuspectPair(msg net.TRU_REL_SHARED_SECRET) error {
+	b := p.relayState.blame
+	b.sharedSecret, b.sharedSecretProof = msg.Secret, msg.NIZK
+	if msg.Secret == nil || verifySharedSecretProof(p.relayState.clients[b.suspectClient].PublicKey,
+		p.relayState.trustees[msg.TrusteeID].PublicKey, msg.Secret, msg.NIZK) != nil {
+		return p.concludeBlame(false, msg.TrusteeID, "the secret it revealed for client "+strconv.Itoa(b.suspectClient)+
+			" does not verify")
+	}
+
+	bit := p.relayState.DCNet.PadBit(msg.Secret, b.roundID, b.bitPos)
+	if b.trusteeBits[msg.TrusteeID][b.suspectClient] != bit {
+		return p.concludeBlame(false, msg.TrusteeID, "it revealed a wrong bit of its pad with client "+strconv.Itoa(b.suspectClient))
+	}
+	return p.concludeBlame(true, b.suspectClient, "it revealed a wrong bit of its pad with trustee "+strconv.Itoa(msg.TrusteeID))
+}
+
+// concludeBlame ends the blame with its disruptor, and signs the evidence of it : a client is excluded from the next
+// schedule, a trustee ends the session
+func (p *PriFiLibRelayInstance) concludeBlame(isClient bool, id int, reason string) error {
+	b := p.relayState.blame
+	p.relayState.blame = nil
+	delete(p.relayState.disruptedRounds, b.roundID)
+	p.recordBlameEvidence(b, isClient, id, reason)
+
+	if isClient {
+		log.Error("Disruption: client", id, "disrupted round", b.roundID, ",", reason)
+		p.excludeClient(id)
+		return nil
+	}
+	log.Error("Disruption: trustee", id, "disrupted round", b.roundID, ",", reason, "; the trustees cannot be replaced during the session, ending it")
+	p.relayState.sessionSummary.SetShutdownReason("trustee "+strconv.Itoa(id)+" disrupted the DC-net", true)
+	p.relayState.timeoutHandler(nil, []int{id})
+	return nil
+}
+
+// xorBits returns the XOR of bits
+func xorBits(bits map[int]int) int {
+	result := 0
+	for _, bit := range bits {
+		result ^= bit
+	}
+	return result & 1
+}
+
+// validRevealedBits tells whether bits has a bit, 0 or 1, for each of ids and for nothing else
+func validRevealedBits(bits map[int]int, ids []int) bool {
+	if len(bits) != len(ids) {
+		return false
+	}
+	for _, id := range ids {
+		if bit, found := bits[id]; !found || (bit != 0 && bit != 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedIDs returns the IDs of ciphers, sorted
+func sortedIDs(ciphers map[int][]byte) []int {
+	ids := make([]int, 0, len(ciphers))
+	for id := range ciphers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
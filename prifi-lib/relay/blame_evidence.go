@@ -0,0 +1,378 @@
+package relay
+
+/*
+When a blame finds the disruptor of a round (see blame.go), the relay packages what it based its decision on into a
+BlameEvidence, which it signs : the proof that the blame came from the owner of the slot, the bit of each cipher at
+the position blamed with a commitment to the cipher (its SHA-256), the bits of the pads everyone revealed and, when a
+client and a trustee disagreed on their pad, the secret the trustee revealed with its proof. BlameEvidence.Verify
+checks the signature, the proofs, and that the evidence designates the disruptor, so that the exclusion of a client
+(or the end of the session, for a trustee) can be justified to the other members of the group and to auditors.
+
+The evidence of the last blames is served on the metrics endpoint (BLAME_EVIDENCE_PATH), and written to
+RelayBlameEvidenceDir, one JSON file per blame, if set.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/proof"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// BLAME_EVIDENCE_PATH is where the evidence of the last blames is exported, in JSON
+const BLAME_EVIDENCE_PATH = "/blames"
+
+// BLAME_EVIDENCE_KEPT is the number of evidences the relay keeps in memory for BLAME_EVIDENCE_PATH
+const BLAME_EVIDENCE_KEPT = 20
+
+// BlameEvidence is the signed record of a blame, from which anyone can check who disrupted the round
+type BlameEvidence struct {
+	Epoch            int32 // the epoch of the schedule of the round
+	RoundID          int32
+	Slot             int
+	BitPos           int // the bit blamed by the owner of the slot, set in the decoded cell
+	DCNetPayloadSize int // the size of the pads, to recompute the pad of a revealed secret
+
+	ScheduleBase  string // hex, the base of the schedule
+	SlotPublicKey string // hex, the ephemeral key of the slot, on ScheduleBase
+	BlameProof    string // hex, the proof of knowledge of the private key of SlotPublicKey, by the author of the blame
+
+	Clients  map[int]*CipherEvidence // the ciphers of the round, and the bits of the pads revealed, by client
+	Trustees map[int]*CipherEvidence // by trustee
+
+	// when a client and a trustee revealed different bits for the pad they share, the secret the trustee revealed
+	SuspectClient     int    // -1 if no pair was suspected
+	SuspectTrustee    int    // -1 if no pair was suspected
+	ClientPublicKey   string // hex, of SuspectClient
+	TrusteePublicKey  string // hex, of SuspectTrustee
+	SharedSecret      string // hex, "" if the trustee revealed none
+	SharedSecretProof string // hex, that SharedSecret is the Diffie-Hellman of the two keys
+
+	DisruptorIsClient bool
+	DisruptorID       int
+	Reason            string
+
+	CreatedAt      int64  // unix time, in seconds
+	RelayPublicKey string // hex
+	Signature      string // hex Schnorr signature of the other fields, by RelayPublicKey
+}
+
+// CipherEvidence is what a blame keeps of the cipher of an entity
+type CipherEvidence struct {
+	CipherHash   string      // hex SHA-256 of the payload of the cipher, a commitment to it
+	Bit          int         // the bit of the cipher at BitPos
+	RevealedBits map[int]int // the bits at BitPos of the pads it revealed : by trustee for a client, by client for a trustee
+}
+
+// blameEvidences keeps the last evidences for the metrics endpoint, which reads them from its own goroutine
+type blameEvidences struct {
+	sync.Mutex
+	evidences []*BlameEvidence
+}
+
+func (e *blameEvidences) add(evidence *BlameEvidence) {
+	e.Lock()
+	defer e.Unlock()
+	e.evidences = append(e.evidences, evidence)
+	if len(e.evidences) > BLAME_EVIDENCE_KEPT {
+		e.evidences = e.evidences[1:]
+	}
+}
+
+func (e *blameEvidences) list() []*BlameEvidence {
+	e.Lock()
+	defer e.Unlock()
+	return append([]*BlameEvidence{}, e.evidences...)
+}
+
+// signedBytes returns what the signature covers : the evidence without its signature, in JSON
+func (e *BlameEvidence) signedBytes() []byte {
+	unsigned := *e
+	unsigned.Signature = ""
+	b, _ := json.Marshal(unsigned) // cannot fail on this struct
+	return b
+}
+
+// disruptor returns a description of the disruptor, e.g. "client 1"
+func (e *BlameEvidence) disruptor() string {
+	if e.DisruptorIsClient {
+		return "client " + strconv.Itoa(e.DisruptorID)
+	}
+	return "trustee " + strconv.Itoa(e.DisruptorID)
+}
+
+// Verify checks that the evidence was signed by the relay having the key relayPublicKey, that the blame came from the
+// owner of the slot, and that the ciphers, the revealed bits and the revealed secret designate the disruptor
+func (e *BlameEvidence) Verify(relayPublicKey kyber.Point) error {
+	suite := config.CryptoSuite
+	pk, err := relayPublicKey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(pk) != e.RelayPublicKey {
+		return errors.New("the evidence of round " + strconv.Itoa(int(e.RoundID)) + " was not signed by this relay")
+	}
+	sig, err := hex.DecodeString(e.Signature)
+	if err != nil {
+		return errors.New("invalid signature encoding, " + err.Error())
+	}
+	if err := schnorr.Verify(suite, relayPublicKey, e.signedBytes(), sig); err != nil {
+		return err
+	}
+
+	base, err := decodePoint(e.ScheduleBase)
+	if err != nil {
+		return errors.New("invalid base of the schedule, " + err.Error())
+	}
+	slotPk, err := decodePoint(e.SlotPublicKey)
+	if err != nil {
+		return errors.New("invalid key of the slot, " + err.Error())
+	}
+	blameProof, err := hex.DecodeString(e.BlameProof)
+	if err != nil {
+		return errors.New("invalid proof of the blame, " + err.Error())
+	}
+	if err := verifySlotOwnershipProof(base, slotPk, blameProof); err != nil {
+		return errors.New("the blame does not come from the owner of slot " + strconv.Itoa(e.Slot) + ", " + err.Error())
+	}
+
+	isClient, id, err := e.findDisruptor()
+	if err != nil {
+		return err
+	}
+	if isClient != e.DisruptorIsClient || id != e.DisruptorID {
+		designated := &BlameEvidence{DisruptorIsClient: isClient, DisruptorID: id}
+		return errors.New("the evidence designates " + designated.disruptor() + ", not " + e.disruptor())
+	}
+	return nil
+}
+
+// findDisruptor looks for the disruptor in the evidence, as the relay did : first a client which did not reveal one bit
+// for each trustee, then an entity whose cipher is not the XOR of the pads it revealed, then the one of the suspected pair which revealed a wrong bit of their pad
+func (e *BlameEvidence) findDisruptor() (bool, int, error) {
+	for _, id := range sortedEvidenceIDs(e.Clients) {
+		if !validRevealedBits(e.Clients[id].RevealedBits, sortedEvidenceIDs(e.Trustees)) {
+			return true, id, nil
+		}
+	}
+	for _, id := range sortedEvidenceIDs(e.Clients) {
+		if xorBits(e.Clients[id].RevealedBits) != e.Clients[id].Bit {
+			return true, id, nil
+		}
+	}
+	for _, id := range sortedEvidenceIDs(e.Trustees) {
+		if xorBits(e.Trustees[id].RevealedBits) != e.Trustees[id].Bit {
+			return false, id, nil
+		}
+	}
+
+	client, clientFound := e.Clients[e.SuspectClient]
+	trustee, trusteeFound := e.Trustees[e.SuspectTrustee]
+	if !clientFound || !trusteeFound {
+		return false, 0, errors.New("the ciphers match the pads revealed, and no pair is suspected")
+	}
+	trusteeBit := trustee.RevealedBits[e.SuspectClient]
+	if client.RevealedBits[e.SuspectTrustee] == trusteeBit {
+		return false, 0, errors.New("client " + strconv.Itoa(e.SuspectClient) + " and trustee " +
+			strconv.Itoa(e.SuspectTrustee) + " revealed the same pad")
+	}
+
+	clientPk, err := decodePoint(e.ClientPublicKey)
+	if err != nil {
+		return false, 0, errors.New("invalid key of the client, " + err.Error())
+	}
+	trusteePk, err := decodePoint(e.TrusteePublicKey)
+	if err != nil {
+		return false, 0, errors.New("invalid key of the trustee, " + err.Error())
+	}
+	secret, err := decodePoint(e.SharedSecret)
+	if err != nil {
+		return false, e.SuspectTrustee, nil // the trustee revealed no valid secret
+	}
+	secretProof, err := hex.DecodeString(e.SharedSecretProof)
+	if err != nil || verifySharedSecretProof(clientPk, trusteePk, secret, secretProof) != nil {
+		return false, e.SuspectTrustee, nil
+	}
+
+	pads := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, e.DCNetPayloadSize, false, nil)
+	if pads.PadBit(secret, e.RoundID, e.BitPos) != trusteeBit {
+		return false, e.SuspectTrustee, nil
+	}
+	return true, e.SuspectClient, nil
+}
+
+// String returns the evidence as indented JSON
+func (e *BlameEvidence) String() string {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ReadBlameEvidence reads an evidence written to RelayBlameEvidenceDir; it still has to be verified
+func ReadBlameEvidence(path string) (*BlameEvidence, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	evidence := new(BlameEvidence)
+	if err := json.Unmarshal(b, evidence); err != nil {
+		return nil, err
+	}
+	return evidence, nil
+}
+
+// recordBlameEvidence signs the evidence of the blame b, which found its disruptor, and publishes it
+func (p *PriFiLibRelayInstance) recordBlameEvidence(b *blame, isClient bool, id int, reason string) {
+	d := b.round
+	evidence := &BlameEvidence{
+		Epoch:             p.relayState.scheduleEpoch,
+		RoundID:           b.roundID,
+		Slot:              d.slot,
+		BitPos:            b.bitPos,
+		DCNetPayloadSize:  d.payloadSize,
+		ScheduleBase:      encodePoint(p.relayState.scheduleBase),
+		BlameProof:        hex.EncodeToString(b.blameProof),
+		Clients:           make(map[int]*CipherEvidence),
+		Trustees:          make(map[int]*CipherEvidence),
+		SuspectClient:     b.suspectClient,
+		SuspectTrustee:    b.suspectTrustee,
+		DisruptorIsClient: isClient,
+		DisruptorID:       id,
+		Reason:            reason,
+		CreatedAt:         time.Now().Unix(),
+	}
+	if d.slot >= 0 && d.slot < len(p.relayState.EphemeralPublicKeys) {
+		evidence.SlotPublicKey = encodePoint(p.relayState.EphemeralPublicKeys[d.slot])
+	}
+	for id, cipher := range d.clientCiphers {
+		evidence.Clients[id] = newCipherEvidence(cipher, b.bitPos, b.clientBits[id])
+	}
+	for id, cipher := range d.trusteeCiphers {
+		evidence.Trustees[id] = newCipherEvidence(cipher, b.bitPos, b.trusteeBits[id])
+	}
+	if b.suspectTrustee != -1 {
+		evidence.ClientPublicKey = encodePoint(p.relayState.clients[b.suspectClient].PublicKey)
+		evidence.TrusteePublicKey = encodePoint(p.relayState.trustees[b.suspectTrustee].PublicKey)
+		evidence.SharedSecret = encodePoint(b.sharedSecret)
+		evidence.SharedSecretProof = hex.EncodeToString(b.sharedSecretProof)
+	}
+
+	if p.relayState.PublicKey == nil || p.relayState.privateKey == nil {
+		log.Error("Relay : no key to sign the evidence of the blame of round", b.roundID)
+		return
+	}
+	evidence.RelayPublicKey = encodePoint(p.relayState.PublicKey)
+	sig, err := schnorr.Sign(config.CryptoSuite, p.relayState.privateKey, evidence.signedBytes())
+	if err != nil {
+		log.Error("Relay : could not sign the evidence of the blame of round", b.roundID, err)
+		return
+	}
+	evidence.Signature = hex.EncodeToString(sig)
+
+	relayLog.Lvl1("Disruption: signed the evidence that", evidence.disruptor(), "disrupted round", b.roundID)
+	p.relayState.blameEvidences.add(evidence)
+	if p.relayState.BlameEvidenceDir != "" {
+		writeBlameEvidence(p.relayState.BlameEvidenceDir, evidence)
+	}
+}
+
+// newCipherEvidence returns the evidence of a cipher, with the bits of the pads revealed by its entity
+func newCipherEvidence(cipher []byte, bitPos int, revealedBits map[int]int) *CipherEvidence {
+	h := sha256.Sum256(cipher)
+	bits := make(map[int]int, len(revealedBits))
+	for id, bit := range revealedBits {
+		bits[id] = bit
+	}
+	return &CipherEvidence{CipherHash: hex.EncodeToString(h[:]), Bit: dcnet.BitAt(cipher, bitPos), RevealedBits: bits}
+}
+
+// writeBlameEvidence writes the evidence to its own file in dir. Failing to do so is not fatal for the protocol
+func writeBlameEvidence(dir string, evidence *BlameEvidence) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error("Relay : could not create the blame evidence directory", dir, err)
+		return
+	}
+	name := "blame-epoch" + strconv.Itoa(int(evidence.Epoch)) + "-round" + strconv.Itoa(int(evidence.RoundID)) + ".json"
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(evidence.String()+"\n"), 0644); err != nil {
+		log.Error("Relay : could not write the blame evidence to", path, err)
+		return
+	}
+	relayLog.Lvl1("Disruption: evidence of the blame of round", evidence.RoundID, "written to", path)
+}
+
+// verifySlotOwnershipProof checks a proof of knowledge of the private key of slotPk, on base
+func verifySlotOwnershipProof(base, slotPk kyber.Point, NIZK []byte) error {
+	suite := config.CryptoSuite
+	pval := map[string]kyber.Point{"B": base, "X": slotPk}
+	verifier := proof.Rep("X", "x", "B").Verifier(suite, pval)
+	return proof.HashVerify(suite, "DISRUPTION", verifier, NIZK)
+}
+
+// verifySharedSecretProof checks a proof that secret is the Diffie-Hellman of the keys of a client and of a trustee,
+// by the trustee
+func verifySharedSecretProof(clientPk, trusteePk, secret kyber.Point, NIZK []byte) error {
+	suite := config.CryptoSuite
+	pub := map[string]kyber.Point{
+		"B":    suite.Point().Base(),
+		"BT":   clientPk,
+		"T":    secret,
+		"X[0]": trusteePk,
+	}
+	pred := proof.Or(proof.And(proof.Rep("X[0]", "x", "B"), proof.Rep("T", "x", "BT")))
+	return proof.HashVerify(suite, "SHAREDKEY", pred.Verifier(suite, pub), NIZK)
+}
+
+// encodePoint returns the hex encoding of point, "" if it is nil
+func encodePoint(point kyber.Point) string {
+	if point == nil {
+		return ""
+	}
+	b, err := point.MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// decodePoint decodes a point encoded by encodePoint
+func decodePoint(s string) (kyber.Point, error) {
+	if s == "" {
+		return nil, errors.New("no point")
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	point := config.CryptoSuite.Point()
+	if err := point.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return point, nil
+}
+
+// sortedEvidenceIDs returns the IDs of evidences, sorted
+func sortedEvidenceIDs(evidences map[int]*CipherEvidence) []int {
+	ids := make([]int, 0, len(evidences))
+	for id := range evidences {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
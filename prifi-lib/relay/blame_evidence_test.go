@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+)
+
+// blameRound runs the blame of bitPos in the round of g, in which client 1 flipped this bit and lies about its pad
+// with the trustee if lying; it returns the evidence of the blame
+func blameRound(t *testing.T, g *blameGroup, bitPos int, lying bool) *BlameEvidence {
+	p := g.relay
+	flip(g.clientCiphers[1], bitPos)
+	p.checkCellHmac(g.roundID, g.decode())
+	if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos)); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range g.clients {
+		bits := c.PadBitsOfRound(g.roundID, bitPos)
+		if i == 1 && lying {
+			bits[0] ^= 1
+		}
+		p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: i, RoundID: g.roundID, Bits: bits})
+	}
+	p.Received_TRU_REL_REVEAL_BITS(net.TRU_REL_REVEAL_BITS{TrusteeID: 0, RoundID: g.roundID, Bits: g.trustee.PadBitsOfRound(g.roundID, bitPos)})
+	if lying {
+		p.Received_TRU_REL_SHARED_SECRETS(g.trusteeSecret(1))
+	}
+
+	evidences := p.relayState.blameEvidences.list()
+	if len(evidences) != 1 {
+		t.Fatal("The relay should have the evidence of the blame, has", len(evidences))
+	}
+	return evidences[0]
+}
+
+func TestBlameEvidence(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	dir, err := ioutil.TempDir("", "prifi-blames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := newBlameGroup()
+	g.relay.relayState.BlameEvidenceDir = dir
+	e := blameRound(t, g, 8*10+3, false)
+	relayPk := g.relay.relayState.PublicKey
+	if !e.DisruptorIsClient || e.DisruptorID != 1 || e.SuspectTrustee != -1 || len(e.Clients) != 2 || len(e.Trustees) != 1 {
+		t.Fatal("Wrong evidence", e)
+	}
+	if err := e.Verify(relayPk); err != nil {
+		t.Error("The evidence should verify,", err)
+	}
+
+	// the file written is the same evidence
+	read, err := ReadBlameEvidence(filepath.Join(dir, "blame-epoch0-round"+strconv.Itoa(int(g.roundID))+".json"))
+	if err != nil {
+		t.Fatal("The evidence should be written to the directory,", err)
+	}
+	if err := read.Verify(relayPk); err != nil || read.DisruptorID != 1 {
+		t.Error("The evidence read from the file should verify,", err)
+	}
+
+	otherKey, _ := crypto.NewKeyPair()
+	if e.Verify(otherKey) == nil {
+		t.Error("The evidence should not verify with another key")
+	}
+	tampered := *e
+	tampered.DisruptorID = 0
+	if tampered.Verify(relayPk) == nil {
+		t.Error("A tampered evidence should not verify")
+	}
+
+	// even signed by the relay, an evidence must designate its disruptor
+	tampered.Signature = ""
+	sig, _ := schnorr.Sign(config.CryptoSuite, g.relay.relayState.privateKey, tampered.signedBytes())
+	tampered.Signature = hex.EncodeToString(sig)
+	if err := tampered.Verify(relayPk); err == nil {
+		t.Error("The evidence designates client 1, not client 0")
+	}
+	tampered = *e
+	tampered.BlameProof = e.BlameProof[:10]
+	tampered.Signature = ""
+	sig, _ = schnorr.Sign(config.CryptoSuite, g.relay.relayState.privateKey, tampered.signedBytes())
+	tampered.Signature = hex.EncodeToString(sig)
+	if err := tampered.Verify(relayPk); err == nil {
+		t.Error("The blame should come from the owner of the slot")
+	}
+}
+
+func TestBlameEvidenceOfLyingClient(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	g := newBlameGroup()
+	e := blameRound(t, g, 8*20+7, true)
+	if !e.DisruptorIsClient || e.DisruptorID != 1 || e.SuspectClient != 1 || e.SuspectTrustee != 0 || e.SharedSecret == "" {
+		t.Fatal("Wrong evidence", e)
+	}
+	if err := e.Verify(g.relay.relayState.PublicKey); err != nil {
+		t.Error("The evidence should verify,", err)
+	}
+
+	// with another secret, the evidence would designate the trustee
+	tampered := *e
+	tampered.SharedSecret = encodePoint(config.CryptoSuite.Point().Mul(g.trusteePriv, g.clientPks[0]))
+	if isClient, id, err := tampered.findDisruptor(); err != nil || isClient || id != 0 {
+		t.Error("A secret which does not verify designates the trustee", isClient, id, err)
+	}
+
+	// nor can a client reveal a bit for a trustee which does not exist
+	tampered = *e
+	client := *e.Clients[1]
+	client.RevealedBits = map[int]int{0: client.RevealedBits[0], 5: 0}
+	tampered.Clients = map[int]*CipherEvidence{0: e.Clients[0], 1: &client}
+	if isClient, id, err := tampered.findDisruptor(); err != nil || !isClient || id != 1 {
+		t.Error("A client revealing a bit for another trustee is the disruptor", isClient, id, err)
+	}
+}
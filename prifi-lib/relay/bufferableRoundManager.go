@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/net"
@@ -12,22 +13,56 @@ import (
 	"time"
 )
 
+// ErrDuplicateCipher is returned when a cipher is added again for the same round (e.g., a client retransmitted it
+// after a suspected loss); it is only counted once
+var ErrDuplicateCipher = errors.New("duplicate cipher")
+
+// CipherConflictError is returned when an entity sends two different ciphers for the same round of the same epoch, a
+// protocol violation; the first cipher is kept
+type CipherConflictError struct {
+	Epoch    int32
+	RoundID  int32
+	EntityID int
+	IsClient bool
+}
+
+func (e *CipherConflictError) Error() string {
+	entity := "trustee"
+	if e.IsClient {
+		entity = "client"
+	}
+	return "Two different ciphers from " + entity + " " + strconv.Itoa(e.EntityID) + " for round " +
+		strconv.Itoa(int(e.RoundID)) + " of epoch " + strconv.Itoa(int(e.Epoch))
+}
+
 // Stores ciphers for different rounds. Manages the transition between rounds, the rate limiting of trustees
 type BufferableRoundManager struct {
 	sync.Mutex
 
 	//immutable
-	nClients                    int
-	nTrustees                   int
+	nClients  int
+	nTrustees int
+
+	//number of slots in the schedule, only changes with SetNumberOfSlots() after a shuffle
+	nSlots int
+
+	//only changes with SetWindowSize(), when the parameters are migrated
 	maxNumberOfConcurrentRounds int
 
+	//the clients which left the session : we do not wait for their ciphers anymore
+	clientsLeft map[int]bool
+
 	//the ACK map for this round
 	clientAckMap  map[int]bool
 	trusteeAckMap map[int]bool
 
 	//hold the real data. map(trustee/clientID -> map( roundID -> data))
-	bufferedClientCiphers  map[int]map[int32][]byte
-	bufferedTrusteeCiphers map[int]map[int32][]byte
+	bufferedClientCiphers  map[int]map[int32]bufferedCipher
+	bufferedTrusteeCiphers map[int]map[int32]bufferedCipher
+
+	//the epoch of the schedule, only changes with Flush(). The buffered ciphers are tagged with the epoch they were
+	//computed for
+	epoch int32
 
 	//we remember the last round we close for OpenNextRound()
 	lastRoundClosed int32
@@ -55,9 +90,16 @@ type BufferableRoundManager struct {
 	stopSent                 map[int]bool
 	resumeFunction           func(int)
 	resumeSent               map[int]bool
+	trusteeHighBounds        map[int]int //per-trustee HighBound, e.g. for an overloaded trustee
 }
 
-func sortedIntMapOfIntMapDump(m map[int]map[int32][]byte) {
+// bufferedCipher is a cipher waiting for its round, tagged with the epoch of the schedule it was computed for
+type bufferedCipher struct {
+	epoch int32
+	data  []byte
+}
+
+func sortedIntMapOfIntMapDump(m map[int]map[int32]bufferedCipher) {
 	nodes := make([]int, 0, len(m))
 	for i := range m {
 		nodes = append(nodes, i)
@@ -85,7 +127,7 @@ func (b *BufferableRoundManager) MemoryUsage() {
 
 		thisClientSize := uint64(0)
 		for _, v := range thisClientCiphers {
-			thisClientSize += uint64(len(v))
+			thisClientSize += uint64(len(v.data))
 		}
 		if thisClientSize != 0 {
 			strClients += fmt.Sprintf("%v:%v B ", i, thisClientSize)
@@ -98,14 +140,14 @@ func (b *BufferableRoundManager) MemoryUsage() {
 
 		thisTrusteeSize := uint64(0)
 		for _, v := range thisTrusteeCiphers {
-			thisTrusteeSize += uint64(len(v))
+			thisTrusteeSize += uint64(len(v.data))
 		}
 		if thisTrusteeSize != 0 {
 			strTrustees += fmt.Sprintf("%v:%v B ", i, thisTrusteeSize)
 		}
 		trusteeSizeOfCipherBuffered += thisTrusteeSize
 	}
-	log.Lvl1("[BufferableRoundManager] trustees:", trusteeNumberOfCipherBuffered, "=", trusteeSizeOfCipherBuffered,
+	relayLog.Lvl1("[BufferableRoundManager] trustees:", trusteeNumberOfCipherBuffered, "=", trusteeSizeOfCipherBuffered,
 		"B (", strTrustees, "); clients:", clientNumberOfCipherBuffered, "=", clientSizeOfCipherBuffered, "B (", strClients, ")")
 	// (config:", b.nClients, "clients", b.nTrustees, "trustees, window =", b.maxNumberOfConcurrentRounds, "b.sendStopResumeMessage =",	b.DoSendStopResumeMessages, ", lowBound =", b.LowBound, ", highBound =", b.HighBound, ")")
 }
@@ -126,22 +168,22 @@ func (b *BufferableRoundManager) Dump() {
 	b.Lock()
 	defer b.Unlock()
 
-	log.Lvl1("------------------------")
-	log.Lvl1("BufferableRoundManager with ", b.nClients, "clients", b.nTrustees, "trustees, window =", b.maxNumberOfConcurrentRounds)
+	relayLog.Lvl1("------------------------")
+	relayLog.Lvl1("BufferableRoundManager with ", b.nClients, "clients", b.nTrustees, "trustees, window =", b.maxNumberOfConcurrentRounds)
 	open, r := b.currentRound()
-	log.Lvl1("Current round:", r, "open=", open, "Has all ciphers ? ", b.hasAllCiphersForCurrentRound())
+	relayLog.Lvl1("Current round:", r, "open=", open, "Has all ciphers ? ", b.hasAllCiphersForCurrentRound())
 	for k, v := range b.openRounds {
-		log.Lvl1("Open rounds:", k, v)
+		relayLog.Lvl1("Open rounds:", k, v)
 	}
-	log.Lvl1("ACK MAP Clients")
+	relayLog.Lvl1("ACK MAP Clients")
 	sortedIntMapDump(b.clientAckMap)
-	log.Lvl1("ACK MAP Trustees")
+	relayLog.Lvl1("ACK MAP Trustees")
 	sortedIntMapDump(b.trusteeAckMap)
 	//log.Lvl1("Buffered MAP Clients")
 	//sortedIntMapOfIntMapDump(b.bufferedClientCiphers)
 	//log.Lvl1("Buffered MAP Trustees")
 	//sortedIntMapOfIntMapDump(b.bufferedTrusteeCiphers)
-	log.Lvl1("------------------------")
+	relayLog.Lvl1("------------------------")
 }
 
 // NewBufferableRoundManager creates a Round Manager that handles the buffering of cipher, the rounds and their transitions, and the rate-limiting
@@ -153,11 +195,13 @@ func NewBufferableRoundManager(nClients, nTrustees, maxNumberOfConcurrentRounds
 	b := new(BufferableRoundManager)
 
 	b.nClients = nClients
+	b.nSlots = nClients
 	b.nTrustees = nTrustees
 	b.maxNumberOfConcurrentRounds = maxNumberOfConcurrentRounds
 	b.lastRoundClosed = -1 // next is round 0
 	b.lastOwner = -1       // next is client 0
 	b.nextOCSlotRound = 1  // first is 1, the first downstream data from relay
+	b.clientsLeft = make(map[int]bool)
 
 	b.resetACKmaps()
 
@@ -165,8 +209,9 @@ func NewBufferableRoundManager(nClients, nTrustees, maxNumberOfConcurrentRounds
 	b.openRounds = make(map[int32]time.Time)
 	b.storedOwnerSchedule = nil
 
-	b.bufferedClientCiphers = make(map[int]map[int32][]byte)
-	b.bufferedTrusteeCiphers = make(map[int]map[int32][]byte)
+	b.bufferedClientCiphers = make(map[int]map[int32]bufferedCipher)
+	b.bufferedTrusteeCiphers = make(map[int]map[int32]bufferedCipher)
+	b.trusteeHighBounds = make(map[int]int)
 
 	return b
 }
@@ -242,7 +287,7 @@ func (b *BufferableRoundManager) UpdateAndGetNextOwnerID() int {
 
 func (b *BufferableRoundManager) updateAndGetNextOwnerID() int {
 
-	nextOwnerIDCandidate := (b.lastOwner + 1) % b.nClients
+	nextOwnerIDCandidate := (b.lastOwner + 1) % b.nSlots
 
 	if b.storedOwnerSchedule == nil || len(b.storedOwnerSchedule) == 0 {
 
@@ -255,7 +300,7 @@ func (b *BufferableRoundManager) updateAndGetNextOwnerID() int {
 	// check if disabled in the schedule, iterate until find a non-closed slot (or go further than the schedule in time)
 	loopCount := 0
 	for found && !open {
-		nextOwnerIDCandidate = (nextOwnerIDCandidate + 1) % b.nClients
+		nextOwnerIDCandidate = (nextOwnerIDCandidate + 1) % b.nSlots
 		open, found = b.storedOwnerSchedule[nextOwnerIDCandidate]
 
 		if loopCount == len(b.storedOwnerSchedule) {
@@ -326,12 +371,12 @@ func (b *BufferableRoundManager) CollectRoundData() ([][]byte, [][]byte, error)
 	//prepare the output, discard those ciphers
 	clientsOut := make([][]byte, 0)
 	for i := 0; i < b.nClients; i++ {
-		clientsOut = append(clientsOut, b.bufferedClientCiphers[i][currentRoundID])
+		clientsOut = append(clientsOut, b.bufferedClientCiphers[i][currentRoundID].data)
 		delete(b.bufferedClientCiphers[i], currentRoundID)
 	}
 	trusteesOut := make([][]byte, 0)
 	for i := 0; i < b.nTrustees; i++ {
-		trusteesOut = append(trusteesOut, b.bufferedTrusteeCiphers[i][currentRoundID])
+		trusteesOut = append(trusteesOut, b.bufferedTrusteeCiphers[i][currentRoundID].data)
 		delete(b.bufferedTrusteeCiphers[i], currentRoundID)
 	}
 
@@ -439,7 +484,7 @@ func (b *BufferableRoundManager) resetACKmaps() {
 	b.trusteeAckMap = make(map[int]bool)
 
 	for i := 0; i < b.nClients; i++ {
-		b.clientAckMap[i] = false
+		b.clientAckMap[i] = b.clientsLeft[i]
 	}
 	for i := 0; i < b.nTrustees; i++ {
 		b.trusteeAckMap[i] = false
@@ -460,6 +505,142 @@ func (b *BufferableRoundManager) NextDownstreamRoundForOpenClosedRequest() int32
 	return b.nextOCSlotRound
 }
 
+// SetNumberOfSlots sets the number of slots the owners cycle through, i.e., the number of shuffled ephemeral keys,
+// which is more than the number of clients if some of them own several slots
+func (b *BufferableRoundManager) SetNumberOfSlots(nSlots int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if nSlots < 1 {
+		nSlots = b.nClients
+	}
+	b.nSlots = nSlots
+}
+
+// RestartAt forgets the buffered ciphers and the schedule, for a new schedule of nClients clients whose first round is
+// roundID, e.g. after some clients joined during the session. It fails if a round is still open.
+func (b *BufferableRoundManager) RestartAt(nClients int, roundID int32) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.openRounds) > 0 {
+		return errors.New("Cannot restart at round " + strconv.Itoa(int(roundID)) + ", " + strconv.Itoa(len(b.openRounds)) + " rounds are still open")
+	}
+
+	b.nClients = nClients
+	b.nSlots = nClients
+	b.lastRoundClosed = roundID - 1
+	b.lastOwner = -1
+	b.nextOCSlotRound = roundID + 1
+	b.storedOwnerSchedule = nil
+	b.dataAlreadySent = make(map[int32]*net.REL_CLI_DOWNSTREAM_DATA)
+	b.bufferedClientCiphers = make(map[int]map[int32]bufferedCipher)
+	b.bufferedTrusteeCiphers = make(map[int]map[int32]bufferedCipher)
+
+	// the trustees start sending again with the new schedule
+	for trusteeID := range b.stopSent {
+		b.stopSent[trusteeID] = false
+		b.resumeSent[trusteeID] = false
+	}
+	b.resetACKmaps()
+	return nil
+}
+
+// Flush starts the given epoch, e.g. when a new schedule is shuffled after a resync : the buffered ciphers of the other
+// epochs are dropped, so they cannot be collected with the ones of the new schedule, and the ACK maps are recomputed
+// from the remaining ciphers. Returns the number of ciphers dropped.
+func (b *BufferableRoundManager) Flush(epoch int32) int {
+	b.Lock()
+	defer b.Unlock()
+
+	dropped := 0
+	for _, buffer := range []map[int]map[int32]bufferedCipher{b.bufferedClientCiphers, b.bufferedTrusteeCiphers} {
+		for _, ciphers := range buffer {
+			for roundID, cipher := range ciphers {
+				if cipher.epoch != epoch {
+					delete(ciphers, roundID)
+					dropped++
+				}
+			}
+		}
+	}
+
+	if epoch != b.epoch {
+		// the trustees start sending again with the new schedule
+		for trusteeID := range b.stopSent {
+			b.stopSent[trusteeID] = false
+			b.resumeSent[trusteeID] = false
+		}
+	}
+	b.epoch = epoch
+
+	b.resetACKmaps()
+	if anyRoundOpen, roundID := b.currentRound(); anyRoundOpen {
+		for i := 0; i < b.nClients; i++ {
+			if _, exists := b.bufferedClientCiphers[i][roundID]; exists {
+				b.clientAckMap[i] = true
+			}
+		}
+		for i := 0; i < b.nTrustees; i++ {
+			if _, exists := b.bufferedTrusteeCiphers[i][roundID]; exists {
+				b.trusteeAckMap[i] = true
+			}
+		}
+	}
+	return dropped
+}
+
+// Epoch returns the epoch started by the last Flush()
+func (b *BufferableRoundManager) Epoch() int32 {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.epoch
+}
+
+// WindowStatus is a snapshot of the rounds of a BufferableRoundManager
+type WindowStatus struct {
+	Epoch           int32
+	CurrentRound    int32 // the smallest open round, -1 if no round is open
+	LastRoundClosed int32
+	OpenRounds      int // the rounds open, at most WindowSize unless the window just shrank
+	WindowSize      int
+	Clients         int // the clients whose ciphers we wait for, without those which left
+	Trustees        int
+}
+
+// WindowStatus returns a snapshot of the rounds, for the status endpoint
+func (b *BufferableRoundManager) WindowStatus() WindowStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	_, currentRound := b.currentRound()
+	return WindowStatus{
+		Epoch:           b.epoch,
+		CurrentRound:    currentRound,
+		LastRoundClosed: b.lastRoundClosed,
+		OpenRounds:      len(b.openRounds),
+		WindowSize:      b.maxNumberOfConcurrentRounds,
+		Clients:         b.nClients - len(b.clientsLeft),
+		Trustees:        b.nTrustees,
+	}
+}
+
+// RemoveClient stops waiting for the ciphers of clientID, which left the session; the rounds it took part in must be
+// closed. Its ID is not reused, the rounds are collected with a nil cipher for it.
+func (b *BufferableRoundManager) RemoveClient(clientID int) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.openRounds) > 0 {
+		return errors.New("Cannot remove client " + strconv.Itoa(clientID) + ", " + strconv.Itoa(len(b.openRounds)) + " rounds are still open")
+	}
+	b.clientsLeft[clientID] = true
+	delete(b.bufferedClientCiphers, clientID)
+	b.resetACKmaps()
+	return nil
+}
+
 // SetStoredRoundSchedule stores the schedule, and resets the nextOwner to be 0
 func (b *BufferableRoundManager) SetStoredRoundSchedule(s map[int]bool) {
 	b.Lock()
@@ -508,11 +689,57 @@ func (b *BufferableRoundManager) GetDataAlreadySent(roundID int32) *net.REL_CLI_
 	return nil
 }
 
-// AddTrusteeCipher adds a trustee cipher for a given round
+// FindDataAlreadySent returns the "DataAlreadySent" field for the given round, and false if the round is not open
+// anymore; unlike GetDataAlreadySent, it can be used for a round requested by a client
+func (b *BufferableRoundManager) FindDataAlreadySent(roundID int32) (*net.REL_CLI_DOWNSTREAM_DATA, bool) {
+	b.Lock()
+	defer b.Unlock()
+	data, found := b.dataAlreadySent[roundID]
+	return data, found && data != nil
+}
+
+// BufferedCiphers returns the ciphers of the current epoch already received for a given round, by client and trustee ID
+func (b *BufferableRoundManager) BufferedCiphers(roundID int32) (map[int][]byte, map[int][]byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	clients := make(map[int][]byte)
+	for id, ciphers := range b.bufferedClientCiphers {
+		if c, found := ciphers[roundID]; found && c.epoch == b.epoch {
+			clients[id] = c.data
+		}
+	}
+	trustees := make(map[int][]byte)
+	for id, ciphers := range b.bufferedTrusteeCiphers {
+		if c, found := ciphers[roundID]; found && c.epoch == b.epoch {
+			trustees[id] = c.data
+		}
+	}
+	return clients, trustees
+}
+
+// AddTrusteeCipher adds a trustee cipher for a given round, of the current epoch
 func (b *BufferableRoundManager) AddTrusteeCipher(roundID int32, trusteeID int, data []byte) error {
 	b.Lock()
 	defer b.Unlock()
 
+	return b.addTrusteeCipher(b.epoch, roundID, trusteeID, data)
+}
+
+// AddTrusteeCipherOfEpoch adds a trustee cipher for a given round, computed for the schedule of the given epoch. The
+// ciphers of another epoch than the current one are refused, they were computed for a previous schedule.
+func (b *BufferableRoundManager) AddTrusteeCipherOfEpoch(epoch, roundID int32, trusteeID int, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if epoch != b.epoch {
+		return errors.New("Can't accept a trustee cipher of epoch " + strconv.Itoa(int(epoch)) + ", the schedule is of epoch " +
+			strconv.Itoa(int(b.epoch)))
+	}
+	return b.addTrusteeCipher(epoch, roundID, trusteeID, data)
+}
+
+func (b *BufferableRoundManager) addTrusteeCipher(epoch, roundID int32, trusteeID int, data []byte) error {
 	_, currendRound := b.currentRound()
 	//if !anyRoundOpenend {
 	//	log.Fatal("Can't add trustee cipher, no round opened")
@@ -524,7 +751,9 @@ func (b *BufferableRoundManager) AddTrusteeCipher(roundID int32, trusteeID int,
 	if roundID < currendRound {
 		return errors.New("Can't accept a trustee cipher in the past")
 	}
-	b.addToBuffer(&b.bufferedTrusteeCiphers, roundID, trusteeID, data)
+	if err := b.addToBuffer(&b.bufferedTrusteeCiphers, false, epoch, roundID, trusteeID, data); err != nil {
+		return err
+	}
 
 	if roundID == currendRound {
 		b.trusteeAckMap[trusteeID] = true
@@ -535,7 +764,7 @@ func (b *BufferableRoundManager) AddTrusteeCipher(roundID int32, trusteeID int,
 	return nil
 }
 
-// AddClientCipher adds a client cipher for a given round
+// AddClientCipher adds a client cipher for a given round, of the current epoch
 func (b *BufferableRoundManager) AddClientCipher(roundID int32, clientID int, data []byte) error {
 
 	b.Lock()
@@ -550,10 +779,15 @@ func (b *BufferableRoundManager) AddClientCipher(roundID int32, clientID int, da
 	if data == nil {
 		return errors.New("Can't accept a nil client cipher")
 	}
+	if b.clientsLeft[clientID] {
+		return errors.New("Can't accept a cipher from client " + strconv.Itoa(clientID) + ", it left the session")
+	}
 	if roundID < currendRound {
 		return errors.New("Can't accept a client cipher in the past")
 	}
-	b.addToBuffer(&b.bufferedClientCiphers, roundID, clientID, data)
+	if err := b.addToBuffer(&b.bufferedClientCiphers, true, b.epoch, roundID, clientID, data); err != nil {
+		return err
+	}
 
 	if roundID == currendRound {
 		b.clientAckMap[clientID] = true
@@ -654,10 +888,73 @@ func (b *BufferableRoundManager) AddRateLimiter(lowBound, highBound int, stopFun
 	return nil
 }
 
+// SetWindowSize changes the maximum number of rounds opened at the same time. If it shrinks below the number of
+// rounds currently opened, those stay opened, but no round can be opened until enough of them are closed
+func (b *BufferableRoundManager) SetWindowSize(maxNumberOfConcurrentRounds int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.maxNumberOfConcurrentRounds = maxNumberOfConcurrentRounds
+}
+
+// SetRateLimiterBounds changes the bounds of the RateLimiter added with AddRateLimiter()
+func (b *BufferableRoundManager) SetRateLimiterBounds(lowBound, highBound int) error {
+	if lowBound < 0 || lowBound > highBound {
+		return errors.New("Lowbound must be > 0 and < highBound")
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.LowBound = lowBound
+	b.HighBound = highBound
+	return nil
+}
+
+// SetTrusteeHighBound makes the RateLimiter stop this trustee once highBound of its ciphers are buffered, instead of
+// HighBound; it is capped to HighBound, and at least LowBound+1. A highBound <= 0 goes back to HighBound. Returns the
+// bound in use for this trustee.
+func (b *BufferableRoundManager) SetTrusteeHighBound(trusteeID, highBound int) int {
+	b.Lock()
+	defer b.Unlock()
+
+	if highBound <= 0 || highBound >= b.HighBound {
+		delete(b.trusteeHighBounds, trusteeID)
+		return b.HighBound
+	}
+	if highBound <= b.LowBound {
+		highBound = b.LowBound + 1
+	}
+	b.trusteeHighBounds[trusteeID] = highBound
+	return highBound
+}
+
+// TrusteeHighBound returns the number of buffered ciphers at which the RateLimiter stops this trustee
+func (b *BufferableRoundManager) TrusteeHighBound(trusteeID int) int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.trusteeHighBound(trusteeID)
+}
+
+func (b *BufferableRoundManager) trusteeHighBound(trusteeID int) int {
+	if highBound, found := b.trusteeHighBounds[trusteeID]; found && highBound < b.HighBound {
+		return highBound
+	}
+	return b.HighBound
+}
+
+// IsTrusteeStopped returns true if the RateLimiter told this trustee to stop sending
+func (b *BufferableRoundManager) IsTrusteeStopped(trusteeID int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.stopSent[trusteeID]
+}
+
 func (b *BufferableRoundManager) sendRateChangeIfNeeded(trusteeID int) {
 	if b.DoSendStopResumeMessages {
 		n := b.NumberOfBufferedCiphers(trusteeID)
-		if n >= b.HighBound && !b.stopSent[trusteeID] {
+		if n >= b.trusteeHighBound(trusteeID) && !b.stopSent[trusteeID] {
 			b.stopFunction(trusteeID)
 			b.stopSent[trusteeID] = true
 			b.resumeSent[trusteeID] = false
@@ -669,10 +966,20 @@ func (b *BufferableRoundManager) sendRateChangeIfNeeded(trusteeID int) {
 	}
 }
 
-func (b *BufferableRoundManager) addToBuffer(bufferPtr *map[int]map[int32][]byte, roundID int32, entityID int, data []byte) {
+// addToBuffer buffers the cipher of entityID for (epoch, roundID). The insertion is idempotent : if the same cipher
+// is already buffered (e.g., it was retransmitted), ErrDuplicateCipher is returned; if a different one is, the first
+// one is kept and a *CipherConflictError is returned. A cipher of another epoch is replaced.
+func (b *BufferableRoundManager) addToBuffer(bufferPtr *map[int]map[int32]bufferedCipher, isClient bool, epoch, roundID int32, entityID int, data []byte) error {
 	buffer := *bufferPtr
 	if buffer[entityID] == nil {
-		buffer[entityID] = make(map[int32][]byte)
+		buffer[entityID] = make(map[int32]bufferedCipher)
+	}
+	if previous, found := buffer[entityID][roundID]; found && previous.epoch == epoch {
+		if bytes.Equal(previous.data, data) {
+			return ErrDuplicateCipher
+		}
+		return &CipherConflictError{Epoch: epoch, RoundID: roundID, EntityID: entityID, IsClient: isClient}
 	}
-	buffer[entityID][roundID] = data
+	buffer[entityID][roundID] = bufferedCipher{epoch: epoch, data: data}
+	return nil
 }
@@ -105,6 +105,38 @@ func TestOwnerSlots(test *testing.T) {
 	}
 }
 
+func TestOwnerSlotsWithSeveralSlotsPerClient(test *testing.T) {
+
+	window := 1
+	nClients := 2
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+
+	//one client asked for 3 slots, the other for 1
+	b.SetNumberOfSlots(4)
+
+	for _, expected := range []int{0, 1, 2, 3, 0} {
+		if owner := b.UpdateAndGetNextOwnerID(); owner != expected {
+			test.Error("UpdateAndGetNextOwnerID should be at", expected, "but is", owner)
+		}
+	}
+
+	//the schedule covers all the slots
+	schedule := map[int]bool{0: false, 1: true, 2: false, 3: true}
+	b.SetStoredRoundSchedule(schedule)
+	for _, expected := range []int{1, 3, 1} {
+		if owner := b.UpdateAndGetNextOwnerID(); owner != expected {
+			test.Error("UpdateAndGetNextOwnerID should be at", expected, "but is", owner)
+		}
+	}
+
+	//an invalid number of slots falls back to one per client
+	b.SetNumberOfSlots(0)
+	if b.nSlots != nClients {
+		test.Error("nSlots should be", nClients, "but is", b.nSlots)
+	}
+}
+
 func TestRoundSuccessionWithSchedule(test *testing.T) {
 
 	window := 10
@@ -521,3 +553,239 @@ func TestRateLimiter(test *testing.T) {
 		test.Error("Resume should have been called")
 	}
 }
+
+func TestRestartAt(test *testing.T) {
+
+	window := 2
+	nClients := 1
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+	b.OpenNextRound()
+
+	// a cipher buffered for a round of the previous schedule
+	b.AddTrusteeCipher(5, 0, genDataSlice())
+
+	if err := b.RestartAt(2, 5); err == nil {
+		test.Error("BufferManager should not restart while a round is open")
+	}
+	b.ForceCloseRound()
+	if err := b.RestartAt(2, 5); err != nil {
+		test.Error("BufferManager should restart once no round is open,", err)
+	}
+
+	if b.NumberOfBufferedCiphers(0) != 0 {
+		test.Error("The ciphers of the previous schedule should be forgotten")
+	}
+	if b.NextRoundToOpen() != 5 {
+		test.Error("The new schedule should start at round 5, starts at", b.NextRoundToOpen())
+	}
+	if b.NextDownstreamRoundForOpenClosedRequest() != 6 {
+		test.Error("The first open-closed request should be right after the first round")
+	}
+	if b.UpdateAndGetNextOwnerID() != 0 {
+		test.Error("The slots should start again from slot 0")
+	}
+
+	b.OpenNextRound()
+	if c, _ := b.MissingCiphersForCurrentRound(); len(c) != 2 {
+		test.Error("The new schedule has 2 clients, missing ciphers are", c)
+	}
+}
+
+func TestRemoveClient(test *testing.T) {
+
+	window := 1
+	nClients := 2
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+	b.OpenNextRound()
+
+	if err := b.RemoveClient(1); err == nil {
+		test.Error("BufferManager should not remove a client while a round is open")
+	}
+	b.ForceCloseRound()
+	if err := b.RemoveClient(1); err != nil {
+		test.Error("BufferManager should remove a client once no round is open,", err)
+	}
+	if err := b.RestartAt(nClients, 1); err != nil {
+		test.Error(err)
+	}
+
+	b.OpenNextRound()
+	if c, _ := b.MissingCiphersForCurrentRound(); len(c) != 1 || c[0] != 0 {
+		test.Error("BufferManager should not wait for the client which left, missing ciphers are", c)
+	}
+	if err := b.AddClientCipher(1, 1, genDataSlice()); err == nil {
+		test.Error("BufferManager should refuse the ciphers of the client which left")
+	}
+	b.AddClientCipher(1, 0, genDataSlice())
+	b.AddTrusteeCipher(1, 0, genDataSlice())
+	clients, _, err := b.CollectRoundData()
+	if err != nil {
+		test.Error("BufferManager should collect the round without the client which left,", err)
+	}
+	if len(clients) != nClients || clients[0] == nil || clients[1] != nil {
+		test.Error("The client which left should have a nil cipher")
+	}
+}
+
+func TestRetransmittedCiphers(test *testing.T) {
+
+	window := 2
+	nClients := 2
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+	b.OpenNextRound()
+	b.OpenNextRound()
+
+	client0 := genDataSlice()
+	if err := b.AddClientCipher(0, 0, client0); err != nil {
+		test.Error(err)
+	}
+	retransmitted := make([]byte, len(client0))
+	copy(retransmitted, client0)
+	if err := b.AddClientCipher(0, 0, retransmitted); err != ErrDuplicateCipher {
+		test.Error("BufferManager should recognize a retransmitted cipher, got", err)
+	}
+	if c, _ := b.MissingCiphersForCurrentRound(); len(c) != 1 || c[0] != 1 {
+		test.Error("A retransmitted cipher should not change the ACKs, missing ciphers are", c)
+	}
+
+	// a future round is buffered the same way
+	trustee0 := genDataSlice()
+	b.AddTrusteeCipher(1, 0, trustee0)
+	if err := b.AddTrusteeCipher(1, 0, trustee0); err != ErrDuplicateCipher {
+		test.Error("BufferManager should recognize a retransmitted cipher of a future round, got", err)
+	}
+	if b.NumberOfBufferedCiphers(0) != 1 {
+		test.Error("A retransmitted cipher should be buffered only once")
+	}
+
+	// a different cipher for the same round is a conflict, and the first one is kept
+	err := b.AddClientCipher(0, 0, genDataSlice())
+	conflict, ok := err.(*CipherConflictError)
+	if !ok {
+		test.Fatal("BufferManager should detect two different ciphers for the same round, got", err)
+	}
+	if !conflict.IsClient || conflict.EntityID != 0 || conflict.RoundID != 0 || conflict.Epoch != 0 {
+		test.Error("The conflict should be on client 0, round 0, epoch 0, got", conflict)
+	}
+	if err := b.AddTrusteeCipher(1, 0, genDataSlice()); err == nil {
+		test.Error("BufferManager should detect two different trustee ciphers for the same round")
+	} else if conflict, ok := err.(*CipherConflictError); !ok || conflict.IsClient {
+		test.Error("The conflict should be on a trustee, got", err)
+	}
+
+	b.AddClientCipher(0, 1, genDataSlice())
+	b.AddTrusteeCipher(0, 0, genDataSlice())
+	clients, _, err := b.CollectRoundData()
+	if err != nil {
+		test.Error(err)
+	}
+	if !bytes.Equal(clients[0], client0) {
+		test.Error("The first cipher of client 0 should be collected")
+	}
+}
+
+func TestFlushDropsStaleCiphers(test *testing.T) {
+
+	window := 2
+	nClients := 1
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+
+	// during the setup of a resync, a trustee cipher of the previous schedule is buffered for round 0
+	stale := []byte{1, 2, 3}
+	b.AddTrusteeCipher(0, 0, stale)
+
+	if dropped := b.Flush(1); dropped != 1 {
+		test.Error("Flush should drop the cipher of the previous epoch, dropped", dropped)
+	}
+	if b.Epoch() != 1 {
+		test.Error("Flush should start epoch 1, epoch is", b.Epoch())
+	}
+	if b.NumberOfBufferedCiphers(0) != 0 {
+		test.Error("The cipher of the previous epoch should be forgotten")
+	}
+
+	// it is still on its way, and arrives after the flush
+	if err := b.AddTrusteeCipherOfEpoch(0, 0, 0, stale); err == nil {
+		test.Error("BufferManager should refuse a cipher of the previous epoch")
+	}
+
+	b.OpenNextRound()
+	if _, t := b.MissingCiphersForCurrentRound(); len(t) != 1 {
+		test.Error("Round 0 should still wait for the trustee, the stale cipher was not acked")
+	}
+
+	fresh := []byte{4, 5, 6}
+	if err := b.AddTrusteeCipherOfEpoch(1, 0, 0, fresh); err != nil {
+		test.Error("BufferManager should accept a cipher of the current epoch,", err)
+	}
+	b.AddClientCipher(0, 0, genDataSlice())
+	_, trustees, err := b.CollectRoundData()
+	if err != nil {
+		test.Error(err)
+	}
+	if len(trustees) != 1 || !bytes.Equal(trustees[0], fresh) {
+		test.Error("Round 0 should be collected with the cipher of the new epoch, got", trustees)
+	}
+}
+
+func TestFlushRecomputesACKs(test *testing.T) {
+
+	window := 2
+	nClients := 1
+	nTrustees := 2
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+	b.OpenNextRound()
+
+	b.AddTrusteeCipher(0, 0, genDataSlice())
+	b.AddTrusteeCipher(0, 1, genDataSlice())
+	b.AddTrusteeCipher(1, 0, genDataSlice())
+
+	// flushing the current epoch keeps every cipher
+	if dropped := b.Flush(0); dropped != 0 {
+		test.Error("Flush of the current epoch should not drop anything, dropped", dropped)
+	}
+	if _, t := b.MissingCiphersForCurrentRound(); len(t) != 0 {
+		test.Error("The ciphers of the trustees should still be acked, missing", t)
+	}
+
+	if dropped := b.Flush(1); dropped != 3 {
+		test.Error("Flush should drop the 3 ciphers of epoch 0, dropped", dropped)
+	}
+	if _, t := b.MissingCiphersForCurrentRound(); len(t) != 2 {
+		test.Error("The dropped ciphers should not be acked anymore, missing", t)
+	}
+	if b.HasAllCiphersForCurrentRound() {
+		test.Error("The round cannot be complete without the ciphers of the trustees")
+	}
+}
+
+func TestFlushResumesStoppedTrustees(test *testing.T) {
+
+	window := 1
+	nClients := 1
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+
+	stopped, resumed := 0, 0
+	b.AddRateLimiter(1, 2, func(int) { stopped++ }, func(int) { resumed++ })
+
+	b.AddTrusteeCipher(0, 0, genDataSlice())
+	b.AddTrusteeCipher(1, 0, genDataSlice())
+	if !b.IsTrusteeStopped(0) || stopped != 1 {
+		test.Error("The trustee should have been stopped")
+	}
+
+	resumed = 0
+	b.Flush(1)
+	if b.IsTrusteeStopped(0) {
+		test.Error("The trustee starts sending again with the new schedule")
+	}
+	b.AddTrusteeCipherOfEpoch(1, 0, 0, genDataSlice())
+	if resumed != 1 {
+		test.Error("The trustee should be told to resume, its stale ciphers were dropped")
+	}
+}
@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+/*
+checkClientIdentity refuses the public keys of a client which cannot be the one it claims to be : an ID outside of
+0..nClients-1, an ID already used by a client with other keys (two clients configured with the same ID), or keys
+already used by a client with another ID (one client configured twice). Without it, the second client would silently
+replace the first one in relayState.clients, and the shuffle would go on with one client missing. The first client
+keeps its slot; the conflict is logged as an error, for the operator to fix the configuration.
+Sending the same keys twice for the same ID is not a conflict.
+*/
+func (p *PriFiLibRelayInstance) checkClientIdentity(msg net.CLI_REL_TELL_PK_AND_EPH_PK) error {
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients {
+		e := "Relay : refusing the public keys of client " + strconv.Itoa(msg.ClientID) + ", the IDs of this epoch are 0 to " +
+			strconv.Itoa(p.relayState.nClients-1)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if msg.Pk == nil || msg.EphPk == nil {
+		e := "Relay : refusing the public keys of client " + strconv.Itoa(msg.ClientID) + ", some are missing"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	existing := p.relayState.clients[msg.ClientID]
+	if existing.Connected && (!existing.PublicKey.Equal(msg.Pk) || !existing.EphemeralPublicKey.Equal(msg.EphPk)) {
+		e := "Relay : two clients claim the ID " + strconv.Itoa(msg.ClientID) + " with different keys; refusing the second one. " +
+			"Check that each client is configured with its own ID"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if i := p.publicKeyOwner(msg.Pk); i != -1 && i != msg.ClientID {
+		e := "Relay : client " + strconv.Itoa(msg.ClientID) + " has the same public key as client " + strconv.Itoa(i) +
+			"; refusing it. Check that the same client is not started twice with different IDs"
+		log.Error(e)
+		return errors.New(e)
+	}
+	return nil
+}
+
+// publicKeyOwner returns the ID of the client which sent the public key pk, including the clients which joined during
+// the session and wait to be admitted, or -1 if there is none
+func (p *PriFiLibRelayInstance) publicKeyOwner(pk kyber.Point) int {
+	for i, c := range p.relayState.clients {
+		if c.Connected && c.PublicKey.Equal(pk) {
+			return i
+		}
+	}
+	for i, c := range p.relayState.pendingClients {
+		if c.keys != nil && c.keys.Pk.Equal(pk) {
+			return i
+		}
+	}
+	return -1
+}
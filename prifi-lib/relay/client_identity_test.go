@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestDuplicateClientIDs(t *testing.T) {
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 10), timeoutHandler,
+		newTestMessageSenderWrapper(new(TestMessageSender)))
+	relay.relayState.nClients = 2
+	relay.relayState.clients = make([]NodeRepresentation, 2)
+	relay.relayState.MaxSlotsPerClient = 1
+
+	pk, _ := crypto.NewKeyPair()
+	ephPk, _ := crypto.NewKeyPair()
+	otherPk, _ := crypto.NewKeyPair()
+	first := net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: pk, EphPk: ephPk}
+
+	if err := relay.Received_CLI_REL_TELL_PK_AND_EPH_PK(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Received_CLI_REL_TELL_PK_AND_EPH_PK(first); err != nil || relay.relayState.nClientsPkCollected != 1 {
+		t.Error("the same keys sent twice should be counted once", err, relay.relayState.nClientsPkCollected)
+	}
+
+	// another client with the same ID
+	err := relay.Received_CLI_REL_TELL_PK_AND_EPH_PK(net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: otherPk, EphPk: ephPk})
+	if err == nil || !strings.Contains(err.Error(), "two clients claim the ID 0") {
+		t.Error("a second client with ID 0 should be refused,", err)
+	}
+	if !relay.relayState.clients[0].PublicKey.Equal(pk) || relay.relayState.nClientsPkCollected != 1 {
+		t.Error("the first client should keep its slot")
+	}
+
+	// the same client with another ID
+	err = relay.Received_CLI_REL_TELL_PK_AND_EPH_PK(net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 1, Pk: pk, EphPk: ephPk})
+	if err == nil || !strings.Contains(err.Error(), "same public key as client 0") {
+		t.Error("a client using the key of client 0 should be refused,", err)
+	}
+
+	if err := relay.Received_CLI_REL_TELL_PK_AND_EPH_PK(net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 2, Pk: otherPk, EphPk: ephPk}); err == nil {
+		t.Error("an ID out of range should be refused")
+	}
+	if relay.relayState.nClientsPkCollected != 1 || relay.relayState.clients[1].Connected {
+		t.Error("the refused clients should not be counted")
+	}
+}
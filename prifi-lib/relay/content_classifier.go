@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"encoding/binary"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+// The framing of the stream-multiplexer in the upstream payloads: stream ID (4 bytes), frame type (1 byte), data
+// length (3 bytes), data. Only the frames of type 0 carry stream data, the others control the flow of the streams.
+const (
+	PAYLOAD_STREAM_ID_SIZE     = 4
+	PAYLOAD_STREAM_HEADER_SIZE = 8
+)
+
+// The first two bytes of the latency-test and pcap meta messages
+const (
+	PAYLOAD_PATTERN_LATENCY_PROBE = int(prifilog.LATENCY_PROBE_PATTERN) // 1010101010101010
+	PAYLOAD_PATTERN_PCAP_META     = 21845                               // 0101010101010101
+)
+
+// classifyPayload tells what a decoded upstream payload contains, and how many of its bytes are useful. It only looks
+// at the framing and the first bytes of the stream data; a SOCKS greeting or request is recognized by its format, so
+// a data frame which happens to look like one is counted as a SOCKS connect.
+func classifyPayload(payload []byte) (prifilog.ContentType, int) {
+	if len(payload) >= 2 {
+		switch int(binary.BigEndian.Uint16(payload[0:2])) {
+		case PAYLOAD_PATTERN_LATENCY_PROBE:
+			return prifilog.CONTENT_LATENCY_PROBE, 0
+		case PAYLOAD_PATTERN_PCAP_META:
+			// replayed traffic, standing for real data
+			return prifilog.CONTENT_DATA, len(payload)
+		}
+	}
+
+	// same rule as the egress server: no stream ID means no data
+	if len(payload) < PAYLOAD_STREAM_ID_SIZE || isZero(payload[0:PAYLOAD_STREAM_ID_SIZE]) {
+		return prifilog.CONTENT_EMPTY, 0
+	}
+	if len(payload) < PAYLOAD_STREAM_HEADER_SIZE {
+		return prifilog.CONTENT_INVALID, 0
+	}
+	size := int(binary.BigEndian.Uint32(payload[PAYLOAD_STREAM_ID_SIZE:PAYLOAD_STREAM_HEADER_SIZE]))
+	data := payload[PAYLOAD_STREAM_HEADER_SIZE:]
+	if size == 0 || payload[PAYLOAD_STREAM_ID_SIZE] != 0 {
+		// a keepalive, or a window update or reset of a stream
+		return prifilog.CONTENT_KEEPALIVE, 0
+	}
+	if size > len(data) {
+		return prifilog.CONTENT_INVALID, 0
+	}
+	data = data[:size]
+
+	if isSOCKSConnect(data) {
+		return prifilog.CONTENT_SOCKS_CONNECT, size
+	}
+	return prifilog.CONTENT_DATA, size
+}
+
+// isSOCKSConnect returns true if data is exactly a SOCKS5 greeting, a SOCKS5 CONNECT request, or a SOCKS4(a) CONNECT
+// request
+func isSOCKSConnect(data []byte) bool {
+	if len(data) < 3 {
+		return false
+	}
+	switch data[0] {
+	case 5:
+		// greeting : version, number of methods, methods
+		if int(data[1]) > 0 && len(data) == 2+int(data[1]) {
+			return true
+		}
+		// request : version, CONNECT, reserved, address type, address, port
+		if data[1] != 1 || data[2] != 0 || len(data) < 4 {
+			return false
+		}
+		switch data[3] {
+		case 1:
+			return len(data) == 4+4+2
+		case 3:
+			return len(data) >= 5 && len(data) == 5+int(data[4])+2
+		case 4:
+			return len(data) == 4+16+2
+		}
+	case 4:
+		// CONNECT : version, command, port, IPv4, user ID, 0 (then the domain and 0 for SOCKS4a)
+		return data[1] == 1 && len(data) >= 9 && data[len(data)-1] == 0
+	}
+	return false
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"testing"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+// frame builds an upstream payload of size bytes carrying data on stream 1
+func frame(data []byte, size int) []byte {
+	payload := make([]byte, size)
+	copy(payload, []byte{0, 0, 0, 1, 0, 0, 0, byte(len(data))})
+	copy(payload[PAYLOAD_STREAM_HEADER_SIZE:], data)
+	return payload
+}
+
+func TestClassifyPayload(t *testing.T) {
+	latencyProbe := make([]byte, 100)
+	latencyProbe[0], latencyProbe[1] = 170, 170
+
+	cases := []struct {
+		payload     []byte
+		contentType prifilog.ContentType
+		usefulBytes int
+	}{
+		{make([]byte, 100), prifilog.CONTENT_EMPTY, 0},
+		{latencyProbe, prifilog.CONTENT_LATENCY_PROBE, 0},
+		{frame([]byte("GET / HTTP/1.1\r\n"), 100), prifilog.CONTENT_DATA, 16},
+		{frame([]byte{5, 1, 0}, 100), prifilog.CONTENT_SOCKS_CONNECT, 3},
+		{frame([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}, 100), prifilog.CONTENT_SOCKS_CONNECT, 10},
+		{frame(append([]byte{5, 1, 0, 3, 3, 'a', '.', 'b'}, 1, 187), 100), prifilog.CONTENT_SOCKS_CONNECT, 10},
+		{frame([]byte{4, 1, 0, 80, 10, 0, 0, 1, 0}, 100), prifilog.CONTENT_SOCKS_CONNECT, 9},
+		{frame([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80, 1}, 100), prifilog.CONTENT_DATA, 11},
+		{[]byte{0, 0, 0, 1, 0, 0}, prifilog.CONTENT_INVALID, 0},
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 0, 1, 2}, prifilog.CONTENT_KEEPALIVE, 0},
+		{[]byte{0, 0, 0, 1, 1, 0, 0, 4, 0, 1, 0, 0}, prifilog.CONTENT_KEEPALIVE, 0},
+		{[]byte{0, 0, 0, 1, 2, 0, 0, 0, 1, 2}, prifilog.CONTENT_KEEPALIVE, 0},
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 5, 1, 2}, prifilog.CONTENT_INVALID, 0},
+	}
+	for i, c := range cases {
+		contentType, usefulBytes := classifyPayload(c.payload)
+		if contentType != c.contentType || usefulBytes != c.usefulBytes {
+			t.Error("Case", i, ": expected", c.contentType, c.usefulBytes, "got", contentType, usefulBytes)
+		}
+	}
+}
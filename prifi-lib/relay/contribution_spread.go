@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+The spread of a round, for a class of entities (the clients, or the trustees), is the time between the first and the
+last cipher of this class the relay received for the round. A large client spread means that a few slow clients bound
+the round time, and a larger window only helps if they are slow now and then; a large trustee spread, that a slow
+trustee does. Together with waiting-on-clients and waiting-on-trustees (which class sent the last cipher of a round),
+they tell the operators what to tune. The trustees compute their ciphers in advance, so their spread is usually that
+of the pace at which they get ahead of the rounds.
+
+The spreads are added to the time statistics of the relay, as client-spread and trustee-spread, in ms.
+*/
+
+// CLIENT_SPREAD and TRUSTEE_SPREAD are the time statistics of the spreads of the ciphers of the rounds
+const (
+	CLIENT_SPREAD  = "client-spread"
+	TRUSTEE_SPREAD = "trustee-spread"
+)
+
+// contributionSpreads remembers when the first and the last ciphers of each class arrived, for the rounds not
+// processed yet
+type contributionSpreads struct {
+	sync.Mutex
+	rounds map[int32]*roundContributions
+}
+
+// roundContributions is when the first and the last ciphers of each class arrived for a round; zero if none did
+type roundContributions struct {
+	firstClient, lastClient   time.Time
+	firstTrustee, lastTrustee time.Time
+}
+
+func newContributionSpreads() *contributionSpreads {
+	return &contributionSpreads{rounds: make(map[int32]*roundContributions)}
+}
+
+// received records that a cipher of a client (or of a trustee) for roundID arrived at now
+func (c *contributionSpreads) received(roundID int32, isClient bool, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	r, found := c.rounds[roundID]
+	if !found {
+		r = new(roundContributions)
+		c.rounds[roundID] = r
+	}
+	if isClient {
+		if r.firstClient.IsZero() {
+			r.firstClient = now
+		}
+		r.lastClient = now
+	} else {
+		if r.firstTrustee.IsZero() {
+			r.firstTrustee = now
+		}
+		r.lastTrustee = now
+	}
+}
+
+// done returns the spreads of the ciphers of the clients and of the trustees for roundID, and false if no cipher of
+// this round was recorded. It forgets roundID, and the rounds before it, which were closed without all their ciphers.
+func (c *contributionSpreads) done(roundID int32) (time.Duration, time.Duration, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	r, found := c.rounds[roundID]
+	for round := range c.rounds {
+		if round <= roundID {
+			delete(c.rounds, round)
+		}
+	}
+	if !found {
+		return 0, 0, false
+	}
+	return r.lastClient.Sub(r.firstClient), r.lastTrustee.Sub(r.firstTrustee), true
+}
@@ -0,0 +1,36 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContributionSpreads(t *testing.T) {
+	c := newContributionSpreads()
+	t0 := time.Now()
+
+	// the trustees are ahead, one client is slow
+	c.received(1, false, t0)
+	c.received(1, false, t0.Add(5*time.Millisecond))
+	c.received(2, false, t0.Add(6*time.Millisecond))
+	c.received(1, true, t0.Add(10*time.Millisecond))
+	c.received(1, true, t0.Add(12*time.Millisecond))
+	c.received(1, true, t0.Add(90*time.Millisecond))
+
+	clientSpread, trusteeSpread, ok := c.done(1)
+	if !ok || clientSpread != 80*time.Millisecond || trusteeSpread != 5*time.Millisecond {
+		t.Error("Wrong spreads for round 1", clientSpread, trusteeSpread, ok)
+	}
+	if _, _, ok := c.done(1); ok {
+		t.Error("Round 1 should be forgotten once done")
+	}
+
+	// a single cipher has no spread; round 3 ends the rounds before it, which were closed without their ciphers
+	c.received(3, true, t0.Add(100*time.Millisecond))
+	if clientSpread, trusteeSpread, ok := c.done(3); !ok || clientSpread != 0 || trusteeSpread != 0 {
+		t.Error("Wrong spreads for round 3", clientSpread, trusteeSpread, ok)
+	}
+	if len(c.rounds) != 0 {
+		t.Error("Round 2 should be forgotten after round 3, still have", c.rounds)
+	}
+}
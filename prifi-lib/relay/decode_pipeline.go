@@ -0,0 +1,252 @@
+package relay
+
+/*
+With RelayDecodeWorkers > 0, the relay decodes the rounds in a pipeline, instead of XORing all the ciphers of a round
+on the goroutine handling the messages once the round is complete. Each open round has its own decoder, and each
+cipher is XORed into it by a pool of workers as soon as it arrives (or, for the ciphers buffered before their round,
+as soon as the round opens) : with a window > 1, the decoding of round r overlaps with the collection of the ciphers
+of round r+1, and with the processing of the decoded cells. Large cells are cut in stripes, which the workers XOR
+concurrently. Once a round has all its ciphers, the relay waits for its decoder, and processes the decoded cell as
+before, in order.
+The ciphers XORed by the pipeline are checked against the ones the round manager collected for the round; if they
+differ (e.g. a client sent its cipher twice, or the schedule was flushed), the round is decoded again from scratch.
+The equivocation protection combines the ciphers in order, and is not pipelined.
+*/
+
+import (
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+)
+
+// DECODE_PIPELINE_STRIPE_SIZE is the smallest stripe of a cell the workers XOR separately
+const DECODE_PIPELINE_STRIPE_SIZE = 16 * 1024
+
+// DECODE_PIPELINE_QUEUE_SIZE is the number of stripes waiting for a worker, per worker
+const DECODE_PIPELINE_QUEUE_SIZE = 64
+
+// decodePipeline XORs the ciphers of the open rounds into their decoder, on a pool of workers
+type decodePipeline struct {
+	workers    int
+	stripeSize int
+	jobs       chan decodeJob
+	dcNet      *dcnet.DCNetEntity // the entity the decoders come from; they are dropped when the relay replaces it
+	rounds     map[int32]*pipelinedRound
+
+	// statistics
+	ciphers   int // XORed before their round was complete
+	redecoded int // rounds decoded again, because the collected ciphers differed
+}
+
+// pipelinedRound is the decoder of an open round, and the ciphers XORed into it
+type pipelinedRound struct {
+	decoder  *dcnet.DCNetRoundDecoder
+	stripes  []sync.Mutex // a stripe is XORed by one worker at a time
+	pending  sync.WaitGroup
+	clients  map[int][]byte
+	trustees map[int][]byte
+}
+
+// decodeJob XORs one stripe of a cipher into the decoder of its round
+type decodeJob struct {
+	round   *pipelinedRound
+	stripe  int
+	payload []byte
+	from    int
+	to      int
+}
+
+// newDecodePipeline starts workers goroutines; nil if workers is not positive
+func newDecodePipeline(workers int) *decodePipeline {
+	if workers <= 0 {
+		return nil
+	}
+	dp := &decodePipeline{
+		workers:    workers,
+		stripeSize: DECODE_PIPELINE_STRIPE_SIZE,
+		jobs:       make(chan decodeJob, workers*DECODE_PIPELINE_QUEUE_SIZE),
+		rounds:     make(map[int32]*pipelinedRound),
+	}
+	for i := 0; i < workers; i++ {
+		go dp.work()
+	}
+	return dp
+}
+
+func (dp *decodePipeline) work() {
+	for job := range dp.jobs {
+		job.round.stripes[job.stripe].Lock()
+		job.round.decoder.XORPayload(job.payload, job.from, job.to)
+		job.round.stripes[job.stripe].Unlock()
+		job.round.pending.Done()
+	}
+}
+
+// stop drops the decoders, and stops the workers
+func (dp *decodePipeline) stop() {
+	dp.reset(nil)
+	close(dp.jobs)
+}
+
+// reset drops the decoders, which come from another entity than dcNet
+func (dp *decodePipeline) reset(dcNet *dcnet.DCNetEntity) {
+	for roundID, r := range dp.rounds {
+		r.pending.Wait()
+		dp.dcNet.ReleaseRoundDecoder(r.decoder)
+		delete(dp.rounds, roundID)
+	}
+	dp.dcNet = dcNet
+}
+
+// newRound returns an empty decoder for roundID, with as many stripes as workers, as long as they are large enough
+func (dp *decodePipeline) newRound(roundID int32) *pipelinedRound {
+	d := dp.dcNet.NewRoundDecoder(roundID)
+	nStripes := d.CellSize() / dp.stripeSize
+	if nStripes > dp.workers {
+		nStripes = dp.workers
+	}
+	if nStripes < 1 {
+		nStripes = 1
+	}
+	return &pipelinedRound{
+		decoder:  d,
+		stripes:  make([]sync.Mutex, nStripes),
+		clients:  make(map[int][]byte),
+		trustees: make(map[int][]byte),
+	}
+}
+
+// add hands the cipher of a client (or trustee) for roundID to the workers
+func (dp *decodePipeline) add(dcNet *dcnet.DCNetEntity, roundID int32, isClient bool, entityID int, cipher []byte) {
+	if dcNet != dp.dcNet {
+		dp.reset(dcNet)
+	}
+	r, found := dp.rounds[roundID]
+	if !found {
+		r = dp.newRound(roundID)
+		dp.rounds[roundID] = r
+	}
+	seen := r.trustees
+	if isClient {
+		seen = r.clients
+	}
+	if _, found := seen[entityID]; found {
+		return // a second cipher for the round; the collected ciphers will differ, and the round is decoded again
+	}
+	seen[entityID] = cipher
+	dp.ciphers++
+	dp.xor(r, dcNet.AddCipher(r.decoder, cipher, isClient))
+}
+
+// xor cuts payload in the stripes of r, for the workers
+func (dp *decodePipeline) xor(r *pipelinedRound, payload []byte) {
+	size := r.decoder.CellSize()
+	n := len(r.stripes)
+	r.pending.Add(n)
+	for i := 0; i < n; i++ {
+		dp.jobs <- decodeJob{round: r, stripe: i, payload: payload, from: i * size / n, to: (i + 1) * size / n}
+	}
+}
+
+// take waits for the decoder of roundID and returns it, once the round manager collected all its ciphers. The
+// decoders of the previous rounds, which were closed without being decoded, are dropped.
+func (dp *decodePipeline) take(dcNet *dcnet.DCNetEntity, roundID int32, clientSlices, trusteesSlices [][]byte) *dcnet.DCNetRoundDecoder {
+	if dcNet != dp.dcNet {
+		dp.reset(dcNet)
+	}
+	for id, r := range dp.rounds {
+		if id < roundID {
+			r.pending.Wait()
+			dcNet.ReleaseRoundDecoder(r.decoder)
+			delete(dp.rounds, id)
+		}
+	}
+
+	r, found := dp.rounds[roundID]
+	delete(dp.rounds, roundID)
+	if found && !(sameCiphers(r.clients, clientSlices) && sameCiphers(r.trustees, trusteesSlices)) {
+		dp.redecoded++
+		r.pending.Wait()
+		dcNet.ReleaseRoundDecoder(r.decoder)
+		found = false
+	}
+	if !found {
+		r = dp.newRound(roundID)
+	}
+
+	// the ciphers the pipeline did not see yet
+	for i, s := range clientSlices {
+		if _, seen := r.clients[i]; s != nil && !seen {
+			dp.xor(r, dcNet.AddCipher(r.decoder, s, true))
+		}
+	}
+	for i, s := range trusteesSlices {
+		if _, seen := r.trustees[i]; s != nil && !seen {
+			dp.xor(r, dcNet.AddCipher(r.decoder, s, false))
+		}
+	}
+	r.pending.Wait()
+	return r.decoder
+}
+
+// sameCiphers returns true if the ciphers in seen are the collected ones (the same slices, not only the same bytes),
+// some collected ones possibly not being seen yet
+func sameCiphers(seen map[int][]byte, collected [][]byte) bool {
+	for id, s := range seen {
+		if id >= len(collected) || !sameSlice(s, collected[id]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSlice(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+// decodeCiphers XORs the collected ciphers of roundID into the decoder of the DC-net; with the pipeline, it takes
+// the decoder the workers filled instead
+func (p *PriFiLibRelayInstance) decodeCiphers(roundID int32, clientSlices, trusteesSlices [][]byte) {
+	if dp := p.relayState.decodePipeline; dp != nil {
+		p.relayState.DCNet.UseRoundDecoder(dp.take(p.relayState.DCNet, roundID, clientSlices, trusteesSlices))
+		return
+	}
+	for _, s := range clientSlices {
+		if s == nil {
+			// a client which left the session
+			continue
+		}
+		p.relayState.DCNet.DecodeClient(roundID, s)
+	}
+	for _, s := range trusteesSlices {
+		p.relayState.DCNet.DecodeTrustee(roundID, s)
+	}
+}
+
+// pipelineCipher hands a cipher the round manager accepted to the pipeline, if its round is open
+func (p *PriFiLibRelayInstance) pipelineCipher(roundID int32, isClient bool, entityID int, cipher []byte) {
+	dp := p.relayState.decodePipeline
+	if dp == nil || p.relayState.DCNet == nil || !p.relayState.roundManager.IsRoundOpenend(roundID) {
+		return
+	}
+	dp.add(p.relayState.DCNet, roundID, isClient, entityID, cipher)
+}
+
+// pipelineBufferedCiphers hands the ciphers buffered for roundID (mostly the trustees'), which just opened, to the
+// pipeline
+func (p *PriFiLibRelayInstance) pipelineBufferedCiphers(roundID int32) {
+	dp := p.relayState.decodePipeline
+	if dp == nil || p.relayState.DCNet == nil {
+		return
+	}
+	clients, trustees := p.relayState.roundManager.BufferedCiphers(roundID)
+	for id, c := range clients {
+		dp.add(p.relayState.DCNet, roundID, true, id, c)
+	}
+	for id, c := range trustees {
+		dp.add(p.relayState.DCNet, roundID, false, id, c)
+	}
+}
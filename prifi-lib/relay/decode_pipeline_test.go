@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"go.dedis.ch/kyber/v3"
+)
+
+// pipelineTestGroup returns the DC-net entities of clients and trustees sharing random secrets
+func pipelineTestGroup(nClients, nTrustees, cellSize int) ([]*dcnet.DCNetEntity, []*dcnet.DCNetEntity) {
+	secrets := make([][]kyber.Point, nTrustees)
+	clients := make([]*dcnet.DCNetEntity, nClients)
+	for i := range clients {
+		clientSecrets := make([]kyber.Point, nTrustees)
+		for j := range clientSecrets {
+			_, private := crypto.NewKeyPair()
+			clientSecrets[j] = config.CryptoSuite.Point().Mul(private, nil)
+			secrets[j] = append(secrets[j], clientSecrets[j])
+		}
+		clients[i] = dcnet.NewDCNetEntity(i, dcnet.DCNET_CLIENT, cellSize, false, clientSecrets)
+	}
+	trustees := make([]*dcnet.DCNetEntity, nTrustees)
+	for j := range trustees {
+		trustees[j] = dcnet.NewDCNetEntity(j, dcnet.DCNET_TRUSTEE, cellSize, false, secrets[j])
+	}
+	return clients, trustees
+}
+
+func TestDecodePipeline(t *testing.T) {
+	if newDecodePipeline(0) != nil {
+		t.Error("Without workers, there should be no pipeline")
+	}
+
+	cellSize := 1000
+	clients, trustees := pipelineTestGroup(3, 2, cellSize)
+	relay := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, cellSize, false, nil)
+	dp := newDecodePipeline(3)
+	defer dp.stop()
+	dp.stripeSize = 100 // 3 stripes per cell
+
+	// the ciphers of rounds 0 to 4, the payload of round r being owned by client r%3
+	payloads := make([][]byte, 5)
+	clientCiphers := make([][][]byte, 5)
+	trusteeCiphers := make([][][]byte, 5)
+	for r := range payloads {
+		payloads[r] = bytes.Repeat([]byte{byte(r + 1)}, 900)
+		for i, c := range clients {
+			var payload []byte
+			if i == r%3 {
+				payload = payloads[r]
+			}
+			cipher, _ := c.EncodeForRound(int32(r), i == r%3, payload)
+			clientCiphers[r] = append(clientCiphers[r], cipher)
+		}
+		for _, tr := range trustees {
+			trusteeCiphers[r] = append(trusteeCiphers[r], tr.TrusteeEncodeForRound(int32(r)))
+		}
+	}
+	decoded := func(d *dcnet.DCNetRoundDecoder) []byte {
+		relay.UseRoundDecoder(d)
+		cell, _ := relay.DecodeCell(false)
+		return cell
+	}
+
+	// rounds 0 and 1 are open at once, their ciphers arrive interleaved
+	dp.add(relay, 1, false, 0, trusteeCiphers[1][0])
+	for i := range clients {
+		dp.add(relay, 0, true, i, clientCiphers[0][i])
+		dp.add(relay, 1, true, i, clientCiphers[1][i])
+	}
+	dp.add(relay, 0, false, 0, trusteeCiphers[0][0])
+	dp.add(relay, 0, false, 1, trusteeCiphers[0][1])
+	dp.add(relay, 1, false, 1, trusteeCiphers[1][1])
+	if dp.ciphers != 10 || len(dp.rounds) != 2 {
+		t.Error("The pipeline should decode the 10 ciphers of rounds 0 and 1 as they arrive", dp.ciphers, len(dp.rounds))
+	}
+	for r := int32(0); r <= 1; r++ {
+		if cell := decoded(dp.take(relay, r, clientCiphers[r], trusteeCiphers[r])); !bytes.Equal(cell[:900], payloads[r]) {
+			t.Error("Round", r, "should decode to its payload")
+		}
+	}
+
+	// the ciphers the pipeline did not see are decoded when the round is taken
+	dp.add(relay, 2, true, 0, clientCiphers[2][0])
+	if cell := decoded(dp.take(relay, 2, clientCiphers[2], trusteeCiphers[2])); !bytes.Equal(cell[:900], payloads[2]) {
+		t.Error("Round 2 should decode to its payload, with the ciphers not seen by the pipeline")
+	}
+
+	// a cipher which is not the collected one makes the round decoded again
+	dp.add(relay, 3, true, 1, append([]byte{}, clientCiphers[3][0]...))
+	if cell := decoded(dp.take(relay, 3, clientCiphers[3], trusteeCiphers[3])); !bytes.Equal(cell[:900], payloads[3]) ||
+		dp.redecoded != 1 {
+		t.Error("Round 3 should be decoded again from the collected ciphers")
+	}
+
+	// the decoders of rounds closed without being decoded are dropped
+	dp.add(relay, 10, true, 0, clientCiphers[4][0])
+	dp.take(relay, 11, nil, nil)
+	if len(dp.rounds) != 0 {
+		t.Error("The decoders of the previous rounds should be dropped")
+	}
+
+	// a new entity drops the decoders of the previous one
+	dp.add(relay, 12, true, 0, clientCiphers[4][0])
+	other := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, cellSize, false, nil)
+	dp.add(other, 13, true, 0, clientCiphers[4][0])
+	if _, found := dp.rounds[12]; found || dp.dcNet != other {
+		t.Error("The decoders should be dropped when the relay replaces its DC-net entity")
+	}
+}
@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// deliveryTracker keeps the cumulative ACKs the clients piggyback in their upstream cells, i.e. the highest round
+// such that the client applied the downstream data of this round and of all the rounds before. Unlike the number of
+// cells broadcast, it tells which downstream data actually reached each client.
+type deliveryTracker struct {
+	sync.Mutex
+	broadcast       int32         // the highest downstream round sent
+	acked           map[int]int32 // client ID -> cumulative ACK
+	retransmitted   map[int]int32 // client ID -> highest round retransmitted to it
+	delivered       int64         // the downstream rounds acknowledged, summed over the clients
+	retransmissions int64
+	nacks           int64
+}
+
+func newDeliveryTracker(nClients int) *deliveryTracker {
+	d := &deliveryTracker{
+		acked:         make(map[int]int32),
+		retransmitted: make(map[int]int32),
+	}
+	for i := 0; i < nClients; i++ {
+		d.acked[i] = 0 // round 0 has no downstream data
+	}
+	return d
+}
+
+// StartAt tracks a client from roundID on, e.g. in the schedule made when clients joined during the session. Like
+// round 0, the first round of a schedule has no downstream data : there is nothing to acknowledge up to roundID.
+func (d *deliveryTracker) StartAt(clientID int, roundID int32) {
+	d.Lock()
+	defer d.Unlock()
+	d.acked[clientID] = roundID
+	d.retransmitted[clientID] = roundID
+	if roundID > d.broadcast {
+		d.broadcast = roundID
+	}
+}
+
+// Forget stops tracking a client, e.g. which left the session
+func (d *deliveryTracker) Forget(clientID int) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.acked, clientID)
+	delete(d.retransmitted, clientID)
+}
+
+// Sent records that the downstream data of roundID was sent
+func (d *deliveryTracker) Sent(roundID int32) {
+	d.Lock()
+	defer d.Unlock()
+	if roundID > d.broadcast {
+		d.broadcast = roundID
+	}
+}
+
+// Ack records the cumulative ACK of a client. The ACKs are cumulative, so an older one is ignored; an ACK of a round
+// we did not send yet is bogus, and ignored as well. Returns false if the ACK was ignored.
+func (d *deliveryTracker) Ack(clientID int, ackedRoundID int32) bool {
+	d.Lock()
+	defer d.Unlock()
+	previous, known := d.acked[clientID]
+	if !known || ackedRoundID > d.broadcast {
+		return false
+	}
+	if ackedRoundID > previous {
+		d.delivered += int64(ackedRoundID - previous)
+		d.acked[clientID] = ackedRoundID
+	}
+	return true
+}
+
+// Acked returns the cumulative ACK of a client
+func (d *deliveryTracker) Acked(clientID int) int32 {
+	d.Lock()
+	defer d.Unlock()
+	return d.acked[clientID]
+}
+
+// ShouldRetransmit returns true if the client did not acknowledge roundID, and it was not retransmitted to it yet;
+// the caller retransmits it
+func (d *deliveryTracker) ShouldRetransmit(clientID int, roundID int32) bool {
+	d.Lock()
+	defer d.Unlock()
+	acked, known := d.acked[clientID]
+	if !known || acked >= roundID || d.retransmitted[clientID] >= roundID {
+		return false
+	}
+	d.retransmitted[clientID] = roundID
+	d.retransmissions++
+	return true
+}
+
+// Nacked counts a NACK, i.e. a client telling that it missed a downstream round
+func (d *deliveryTracker) Nacked() {
+	d.Lock()
+	defer d.Unlock()
+	d.nacks++
+}
+
+// WritePrometheus writes the delivery metrics, in the Prometheus text format
+func (d *deliveryTracker) WritePrometheus(w io.Writer, prefix string) error {
+	d.Lock()
+	clients := make([]int, 0, len(d.acked))
+	for clientID := range d.acked {
+		clients = append(clients, clientID)
+	}
+	sort.Ints(clients)
+	acked := make([]int32, len(clients))
+	for i, clientID := range clients {
+		acked[i] = d.acked[clientID]
+	}
+	broadcast, delivered, retransmissions, nacks := d.broadcast, d.delivered, d.retransmissions, d.nacks
+	d.Unlock()
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_downstream_broadcast_round gauge\n%s_downstream_broadcast_round %v\n", prefix, prefix, broadcast)
+	fmt.Fprintf(w, "# TYPE %s_downstream_acked_round gauge\n", prefix)
+	for i, clientID := range clients {
+		fmt.Fprintf(w, "%s_downstream_acked_round{client=\"%v\"} %v\n", prefix, clientID, acked[i])
+	}
+	fmt.Fprintf(w, "# TYPE %s_downstream_delivered_total counter\n%s_downstream_delivered_total %v\n", prefix, prefix, delivered)
+	fmt.Fprintf(w, "# TYPE %s_downstream_nacks_total counter\n%s_downstream_nacks_total %v\n", prefix, prefix, nacks)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# TYPE %s_downstream_retransmissions_total counter\n%s_downstream_retransmissions_total %v\n", prefix, prefix, retransmissions)
+	return err
+}
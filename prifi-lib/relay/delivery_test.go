@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	d := newDeliveryTracker(2)
+	for r := int32(1); r <= 5; r++ {
+		d.Sent(r)
+	}
+
+	if !d.Ack(0, 5) || !d.Ack(1, 3) {
+		t.Error("the ACKs of sent rounds should be accepted")
+	}
+	if !d.Ack(0, 4) || d.Acked(0) != 5 {
+		t.Error("an older ACK should not move the cumulative ACK back, is", d.Acked(0))
+	}
+	if d.Ack(1, 6) || d.Acked(1) != 3 {
+		t.Error("the ACK of a round we did not send should be ignored")
+	}
+	if d.Ack(2, 1) {
+		t.Error("the ACK of an unknown client should be ignored")
+	}
+	if d.delivered != 8 {
+		t.Error("8 downstream rounds were delivered, counted", d.delivered)
+	}
+
+	if d.ShouldRetransmit(0, 5) {
+		t.Error("client 0 acknowledged round 5")
+	}
+	if !d.ShouldRetransmit(1, 4) {
+		t.Error("client 1 did not acknowledge round 4")
+	}
+	if d.ShouldRetransmit(1, 4) {
+		t.Error("round 4 should be retransmitted only once")
+	}
+	d.Nacked()
+
+	var buf bytes.Buffer
+	if err := d.WritePrometheus(&buf, "prifi_relay"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"prifi_relay_downstream_broadcast_round 5",
+		"prifi_relay_downstream_acked_round{client=\"1\"} 3",
+		"prifi_relay_downstream_delivered_total 8",
+		"prifi_relay_downstream_retransmissions_total 1",
+		"prifi_relay_downstream_nacks_total 1",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Error("missing metric", line, "in", buf.String())
+		}
+	}
+}
+
+func TestDeliveryTrackerStartAt(t *testing.T) {
+	d := newDeliveryTracker(1)
+	for r := int32(1); r <= 9; r++ {
+		d.Sent(r)
+	}
+
+	// client 1 joins in the schedule starting at round 10, which has no downstream data
+	d.StartAt(1, 10)
+	if d.Acked(1) != 10 || !d.Ack(1, 10) {
+		t.Error("the client should start with round 10 acknowledged, is", d.Acked(1))
+	}
+	if d.ShouldRetransmit(1, 9) {
+		t.Error("the rounds before the client joined should not be retransmitted to it")
+	}
+	d.Sent(11)
+	if !d.ShouldRetransmit(1, 11) {
+		t.Error("client 1 did not acknowledge round 11")
+	}
+}
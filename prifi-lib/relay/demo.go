@@ -0,0 +1,281 @@
+package relay
+
+/*
+In demo mode, the relay accepts spectators : anyone can connect to RelayDemoAddress, and follow the group's activity
+without taking part in it. They only get aggregated statistics (rounds, throughput, size of the group), delayed by
+RelayDemoDelay seconds so that they cannot be matched with what a spectator sees or does in the room; they never get
+cells, nor anything about a given client. The spectators are served by their own listener, separate from the metrics
+endpoint (which names the slow clients, and lets its users change the log levels), and their number is capped, so that
+a workshop does not affect the live group.
+
+GET /status returns the delayed statistics in JSON, and /ws is a WebSocket which pushes them every second.
+*/
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/gorilla/websocket"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DEMO_STATUS_PATH is where the spectators get the delayed statistics, in JSON
+const DEMO_STATUS_PATH = "/status"
+
+// DEMO_WEBSOCKET_PATH is the WebSocket which pushes the delayed statistics to the spectators
+const DEMO_WEBSOCKET_PATH = "/ws"
+
+// DEMO_SAMPLE_PERIOD is how often the statistics are sampled, and pushed to the spectators
+const DEMO_SAMPLE_PERIOD = time.Second
+
+// DEMO_MAX_SPECTATORS is the maximum number of spectators connected to the WebSocket at the same time
+const DEMO_MAX_SPECTATORS = 100
+
+// DEMO_DEFAULT_DELAY is the delay of the statistics, in seconds, if RelayDemoDelay is not set
+const DEMO_DEFAULT_DELAY = 30
+
+// DemoStatus is what the spectators see : aggregated statistics of the group, as they were DelaySeconds ago
+type DemoStatus struct {
+	Time            time.Time // when these statistics were sampled
+	DelaySeconds    int
+	Epochs          int
+	Rounds          int64
+	RoundsPerSecond float64
+	BytesUp         int64 // decoded upstream bytes, since the relay started
+	BytesDown       int64 // downstream bytes sent, since the relay started
+	Clients         int
+	Trustees        int
+	Spectators      int // connected now, not delayed
+}
+
+// demoServer samples the relay's statistics, and serves them to the spectators once they are old enough
+type demoServer struct {
+	sync.Mutex
+	addr       string // as configured
+	listenAddr string // as bound, e.g. with the port chosen for ":0"
+	delay      time.Duration
+	summary    *prifilog.SessionSummary
+	nClients   int
+	nTrustees  int
+	samples    []DemoStatus // oldest first, covering the last delay
+	spectators int
+	server     *http.Server
+	stop       chan bool
+}
+
+func newDemoServer(summary *prifilog.SessionSummary, delay time.Duration) *demoServer {
+	return &demoServer{
+		summary: summary,
+		delay:   delay,
+		samples: make([]DemoStatus, 0),
+		stop:    make(chan bool),
+	}
+}
+
+// setGroup sets the size of the group of this epoch
+func (d *demoServer) setGroup(nClients, nTrustees int) {
+	d.Lock()
+	defer d.Unlock()
+	d.nClients = nClients
+	d.nTrustees = nTrustees
+}
+
+// sample records the statistics as of now, and forgets the ones which are older than needed
+func (d *demoServer) sample(now time.Time) {
+	report := d.summary.Report()
+
+	d.Lock()
+	defer d.Unlock()
+	s := DemoStatus{
+		Time:         now,
+		DelaySeconds: int(d.delay / time.Second),
+		Epochs:       report.Epochs,
+		Rounds:       report.Rounds,
+		BytesUp:      report.BytesUp,
+		BytesDown:    report.BytesDown,
+		Clients:      d.nClients,
+		Trustees:     d.nTrustees,
+	}
+	if n := len(d.samples); n > 0 {
+		previous := d.samples[n-1]
+		if elapsed := now.Sub(previous.Time).Seconds(); elapsed > 0 && s.Rounds >= previous.Rounds {
+			s.RoundsPerSecond = float64(s.Rounds-previous.Rounds) / elapsed
+		}
+	}
+	d.samples = append(d.samples, s)
+
+	// keep the newest sample which is old enough to be shown, and the ones after it
+	first := 0
+	for i := range d.samples {
+		if now.Sub(d.samples[i].Time) >= d.delay {
+			first = i
+		}
+	}
+	d.samples = d.samples[first:]
+}
+
+// delayed returns the newest statistics which are at least delay old, and false if there are none yet
+func (d *demoServer) delayed(now time.Time) (DemoStatus, bool) {
+	d.Lock()
+	defer d.Unlock()
+	for i := len(d.samples) - 1; i >= 0; i-- {
+		if now.Sub(d.samples[i].Time) >= d.delay {
+			s := d.samples[i]
+			s.Spectators = d.spectators
+			return s, true
+		}
+	}
+	return DemoStatus{}, false
+}
+
+// addSpectator returns false if there are already DEMO_MAX_SPECTATORS spectators
+func (d *demoServer) addSpectator() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.spectators >= DEMO_MAX_SPECTATORS {
+		return false
+	}
+	d.spectators++
+	return true
+}
+
+func (d *demoServer) removeSpectator() {
+	d.Lock()
+	defer d.Unlock()
+	d.spectators--
+}
+
+func (d *demoServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s, ok := d.delayed(time.Now())
+	if !ok {
+		http.Error(w, "no statistics yet, they are shown with a delay of "+d.delay.String(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+var demoUpgrader = websocket.Upgrader{
+	// the spectators' page can be served from anywhere, and they cannot change anything
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (d *demoServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !d.addSpectator() {
+		http.Error(w, "too many spectators", http.StatusServiceUnavailable)
+		return
+	}
+	defer d.removeSpectator()
+
+	conn, err := demoUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// the spectators have nothing to say; reading only notices when they leave
+	closed := make(chan bool)
+	conn.SetReadLimit(512)
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(DEMO_SAMPLE_PERIOD)
+	defer ticker.Stop()
+	for {
+		if s, ok := d.delayed(time.Now()); ok {
+			conn.SetWriteDeadline(time.Now().Add(DEMO_SAMPLE_PERIOD))
+			if err := conn.WriteJSON(s); err != nil {
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// start listens on addr, and samples the statistics until Close
+func (d *demoServer) start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	d.addr = addr
+	d.listenAddr = listener.Addr().String()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DEMO_STATUS_PATH, d.serveStatus)
+	mux.HandleFunc(DEMO_WEBSOCKET_PATH, d.serveWebSocket)
+	d.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := d.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("Relay : demo endpoint stopped;", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(DEMO_SAMPLE_PERIOD)
+		defer ticker.Stop()
+		d.sample(time.Now())
+		for {
+			select {
+			case now := <-ticker.C:
+				d.sample(now)
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close disconnects the spectators, and stops the sampling
+func (d *demoServer) Close() {
+	close(d.stop)
+	if d.server != nil {
+		d.server.Close()
+	}
+}
+
+// startDemoServer serves the delayed statistics to the spectators on addr. The spectators stay connected across the
+// epochs, unless the address or the delay changes. An empty addr disables the demo mode.
+func (p *PriFiLibRelayInstance) startDemoServer(addr string, delaySeconds int) {
+	if d := p.relayState.demoServer; d != nil && (d.addr != addr || d.delay != time.Duration(delaySeconds)*time.Second) {
+		p.stopDemoServer()
+	}
+	if addr == "" {
+		return
+	}
+	if p.relayState.demoServer == nil {
+		d := newDemoServer(p.relayState.sessionSummary, time.Duration(delaySeconds)*time.Second)
+		if err := d.start(addr); err != nil {
+			log.Error("Relay : could not start the demo endpoint on", addr, err)
+			return
+		}
+		p.relayState.demoServer = d
+		relayLog.Lvl1("Relay : demo mode, spectators can follow the statistics (delayed by", delaySeconds, "s) on", addr+DEMO_STATUS_PATH, "and", addr+DEMO_WEBSOCKET_PATH)
+	}
+	p.relayState.demoServer.setGroup(p.relayState.nClients, p.relayState.nTrustees)
+}
+
+// stopDemoServer disconnects the spectators, if any
+func (p *PriFiLibRelayInstance) stopDemoServer() {
+	if p.relayState.demoServer != nil {
+		p.relayState.demoServer.Close()
+		p.relayState.demoServer = nil
+	}
+}
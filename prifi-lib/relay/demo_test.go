@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/gorilla/websocket"
+)
+
+func TestDemoStatusIsDelayed(t *testing.T) {
+	summary := prifilog.NewSessionSummary("Relay")
+	d := newDemoServer(summary, 10*time.Second)
+	d.setGroup(3, 2)
+
+	start := time.Now()
+	d.sample(start)
+	for i := 0; i < 20; i++ {
+		summary.AddRound()
+	}
+	summary.AddBytes(1000, 3000)
+	d.sample(start.Add(5 * time.Second))
+
+	if _, ok := d.delayed(start.Add(9 * time.Second)); ok {
+		t.Error("no statistics should be shown before the delay")
+	}
+	s, ok := d.delayed(start.Add(12 * time.Second))
+	if !ok || s.Rounds != 0 || !s.Time.Equal(start) {
+		t.Error("the statistics of 10s ago should be shown, got", s)
+	}
+	s, _ = d.delayed(start.Add(15 * time.Second))
+	if s.Rounds != 20 || s.RoundsPerSecond != 4 || s.BytesUp != 1000 || s.BytesDown != 3000 || s.Clients != 3 || s.Trustees != 2 || s.DelaySeconds != 10 {
+		t.Error("wrong delayed statistics", s)
+	}
+
+	// the samples older than needed are forgotten
+	d.sample(start.Add(30 * time.Second))
+	if len(d.samples) != 2 {
+		t.Error("only the last shown sample and the newer ones should be kept, have", len(d.samples))
+	}
+
+	for i := 0; i < DEMO_MAX_SPECTATORS; i++ {
+		if !d.addSpectator() {
+			t.Fatal("spectator", i, "should be accepted")
+		}
+	}
+	if d.addSpectator() {
+		t.Error("there should be at most DEMO_MAX_SPECTATORS spectators")
+	}
+}
+
+func TestDemoServer(t *testing.T) {
+	d := newDemoServer(prifilog.NewSessionSummary("Relay"), 0)
+	d.setGroup(4, 1)
+	if err := d.start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the first sample is taken at start, and shown right away with no delay
+	time.Sleep(100 * time.Millisecond)
+	resp, err := http.Get("http://" + d.listenAddr + DEMO_STATUS_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := DemoStatus{}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	resp.Body.Close()
+	if err != nil || s.Clients != 4 || s.Trustees != 1 {
+		t.Error("wrong status", s, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+d.listenAddr+DEMO_WEBSOCKET_PATH, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s = DemoStatus{}
+	if err := conn.ReadJSON(&s); err != nil || s.Clients != 4 || s.Spectators != 1 {
+		t.Error("the WebSocket should push the status", s, err)
+	}
+}
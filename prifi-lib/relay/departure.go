@@ -0,0 +1,112 @@
+package relay
+
+/*
+A client may leave the session without being shut down by the relay : it sends CLI_REL_GOODBYE, and keeps sending its
+ciphers (with cover traffic only) until the relay answers. Like for a client joining, the relay stops opening rounds;
+once the open rounds are finished, it answers with REL_CLI_GOODBYE, and the trustees shuffle again the ephemeral keys
+of the remaining clients, for a schedule starting at the next round. The trustees forget the secrets shared with the
+client which left; the rounds are decoded without its ciphers, instead of waiting for them until the timeout.
+The ID of the client is not reused : the other clients keep theirs, and the round manager stops waiting for its
+ciphers.
+*/
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+/*
+Received_CLI_REL_GOODBYE handles CLI_REL_GOODBYE messages, sent by a client which wants to leave the session. The
+client is removed at the next round boundary, by the next rekeying.
+*/
+func (p *PriFiLibRelayInstance) Received_CLI_REL_GOODBYE(msg net.CLI_REL_GOODBYE) error {
+	if p.stateMachine.State() != "COMMUNICATING" && p.relayState.rekeying == nil {
+		e := "Relay : client " + strconv.Itoa(msg.ClientID) + " wants to leave, but the relay is not communicating"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients || p.relayState.clientsLeft[msg.ClientID] {
+		e := "Relay : client " + strconv.Itoa(msg.ClientID) + " wants to leave, but it is not in the group"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if _, found := p.relayState.clientsLeaving[msg.ClientID]; found {
+		relayLog.Lvl2("Relay : client", msg.ClientID, "said goodbye again, ignoring it")
+		return nil
+	}
+	if p.nActiveClients()-len(p.relayState.clientsLeaving) <= 1 {
+		e := "Relay : client " + strconv.Itoa(msg.ClientID) + " wants to leave, but the group would be empty; refusing it"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	p.relayState.clientsLeaving[msg.ClientID] = time.Now()
+	relayLog.Lvl1("Relay : client", msg.ClientID, "leaves the session, removing it at the next round boundary")
+	return nil
+}
+
+// nActiveClients returns the number of clients in the group, without the ones which left the session
+func (p *PriFiLibRelayInstance) nActiveClients() int {
+	return p.relayState.nClients - len(p.relayState.clientsLeft)
+}
+
+// activeClientIDs returns the IDs of the clients in the group, without the ones which left the session; the trustees
+// share their pads with them in this order
+func (p *PriFiLibRelayInstance) activeClientIDs() []int {
+	ids := make([]int, 0, p.nActiveClients())
+	for i := 0; i < p.relayState.nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			ids = append(ids, i)
+		}
+	}
+	return ids
+}
+
+// excludeClient removes a client which disrupted the DC-net at the next round boundary, like a client leaving the
+// session : the next schedule is shuffled without it. If it is the last client, the session ends through the timeout
+// handler.
+func (p *PriFiLibRelayInstance) excludeClient(clientID int) {
+	if _, found := p.relayState.clientsLeaving[clientID]; found {
+		return
+	}
+	if p.nActiveClients()-len(p.relayState.clientsLeaving) <= 1 {
+		log.Error("Relay : cannot exclude client", clientID, ", the group would be empty; ending the session")
+		p.relayState.sessionSummary.SetShutdownReason("client "+strconv.Itoa(clientID)+" disrupted the DC-net", true)
+		p.relayState.timeoutHandler([]int{clientID}, nil)
+		return
+	}
+	p.relayState.clientsLeaving[clientID] = time.Now()
+	relayLog.Lvl1("Relay : excluding client", clientID, "at the next round boundary")
+}
+
+// removeLeavingClients removes the clients which said goodbye from the group, and tells them that the rounds after
+// lastRoundID are decoded without them. No round must be open. Returns the IDs of the clients removed.
+func (p *PriFiLibRelayInstance) removeLeavingClients(lastRoundID int32) ([]int, error) {
+	left := make([]int, 0, len(p.relayState.clientsLeaving))
+	for id := range p.relayState.clientsLeaving {
+		left = append(left, id)
+	}
+	sort.Ints(left)
+
+	for _, id := range left {
+		if err := p.relayState.roundManager.RemoveClient(id); err != nil {
+			return nil, err
+		}
+		relayLog.Lvl1("Relay : removing client", id, "after round", lastRoundID, ", it said goodbye",
+			time.Since(p.relayState.clientsLeaving[id]), "ago")
+		toSend := &net.REL_CLI_GOODBYE{LastRoundID: lastRoundID}
+		p.messageSender.SendToClientWithLog(id, toSend, "(client "+strconv.Itoa(id)+", leaving)")
+
+		p.relayState.clients[id].Connected = false
+		p.relayState.clientsLeft[id] = true
+		p.relayState.delivery.Forget(id)
+		delete(p.relayState.CiphertextsHistoryClients, int32(id))
+		delete(p.relayState.clientsLeaving, id)
+	}
+	return left, nil
+}
@@ -2,17 +2,23 @@ package relay
 
 import (
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 
+	"errors"
 	"fmt"
 	"go.dedis.ch/kyber/v3/proof"
 	"strconv"
 )
 
-// Received_CLI_REL_BLAME
+// Received_CLI_REL_BLAME; a round which failed its HMAC check is blamed as in blame.go
 func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_BLAME(msg net.CLI_REL_DISRUPTION_BLAME) error {
+	if d, found := p.relayState.disruptedRounds[msg.RoundID]; found {
+		return p.startBlame(msg, d)
+	}
+
 	pred := proof.Rep("X", "x", "B")
 	suite := config.CryptoSuite
 	//B := suite.Point().Base()
@@ -21,17 +27,17 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_BLAME(msg net.CLI_RE
 		verifier := pred.Verifier(suite, pval)
 		err := proof.HashVerify(suite, "DISRUPTION", verifier, msg.NIZK)
 		if err != nil {
-			log.Lvl1("Proof failed to verify: ", key)
+			relayLog.Lvl1("Proof failed to verify: ", key)
 			continue
 		}
-		log.Lvl1("Proof verified.", key)
+		relayLog.Lvl1("Proof verified.", key)
 	}*/
 	verifier := pred.Verifier(suite, msg.Pval)
 	err := proof.HashVerify(suite, "DISRUPTION", verifier, msg.NIZK)
 	if err != nil {
 		log.Fatal("Proof failed to verify: ")
 	}
-	log.Lvl1("Proof verified.")
+	relayLog.Lvl1("Proof verified.")
 
 	// TODO: p.stateMachine.ChangeState("BLAMING")
 
@@ -71,7 +77,7 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_BLAME(msg net.CLI_RE
  */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_REVEAL(msg net.CLI_REL_DISRUPTION_REVEAL) error {
 
-	log.Lvl1("Disruption Phase 1: Received bits from Client", msg.ClientID, "value", msg.Bits)
+	relayLog.Lvl1("Disruption Phase 1: Received bits from Client", msg.ClientID, "value", msg.Bits)
 	var pred_array []proof.Predicate
 	suite := config.CryptoSuite
 	for i := 1; i < p.relayState.nTrustees; i++ {
@@ -84,7 +90,7 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_REVEAL(msg net.CLI_R
 	if err != nil {
 		log.Fatal("Proof failed to verify: ")
 	}
-	log.Lvl3("Proof verified.")
+	relayLog.Lvl3("Proof verified.")
 
 	p.relayState.clientBitMap[msg.ClientID] = msg.Bits
 
@@ -92,7 +98,7 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_REVEAL(msg net.CLI_R
 	if !result {
 		log.Fatal("Disruption Phase 1: Disruptor is Client", msg.ClientID, ".")
 	} else if (len(p.relayState.clientBitMap) == p.relayState.nClients) && (len(p.relayState.trusteeBitMap) == p.relayState.nTrustees) {
-		log.Lvl1("Disruption Phase 1: Trustee", msg.ClientID, ", is consistent with itself, checking mismatches with all trustees...")
+		relayLog.Lvl1("Disruption Phase 1: Trustee", msg.ClientID, ", is consistent with itself, checking mismatches with all trustees...")
 		mismatch := p.checkMismatchingPairs()
 		if mismatch {
 			toClient := &net.REL_ALL_REVEAL_SHARED_SECRETS{
@@ -121,7 +127,7 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_REVEAL(msg net.CLI_R
  */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_DISRUPTION_REVEAL(msg net.TRU_REL_DISRUPTION_REVEAL) error {
 
-	log.Lvl1("Disruption Phase 1: Received bits from Trustee", msg.TrusteeID, "value", msg.Bits)
+	relayLog.Lvl1("Disruption Phase 1: Received bits from Trustee", msg.TrusteeID, "value", msg.Bits)
 
 	var pred_array []proof.Predicate
 	suite := config.CryptoSuite
@@ -135,14 +141,14 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_DISRUPTION_REVEAL(msg net.TRU_R
 	if err != nil {
 		log.Fatal("Proof failed to verify: ")
 	}
-	log.Lvl3("Proof verified.")
+	relayLog.Lvl3("Proof verified.")
 
 	p.relayState.trusteeBitMap[msg.TrusteeID] = msg.Bits
 	result := p.compareBits(msg.TrusteeID, msg.Bits, p.relayState.CiphertextsHistoryTrustees)
 	if !result {
 		log.Fatal("Disruption Phase 1: Disruptor is Trustee", msg.TrusteeID, ".")
 	} else if (len(p.relayState.clientBitMap) == p.relayState.nClients) && (len(p.relayState.trusteeBitMap) == p.relayState.nTrustees) {
-		log.Lvl1("Disruption Phase 1: Trustee", msg.TrusteeID, ", is consistent with itself, checking mismatches with all clients...")
+		relayLog.Lvl1("Disruption Phase 1: Trustee", msg.TrusteeID, ", is consistent with itself, checking mismatches with all clients...")
 		mismatch := p.checkMismatchingPairs()
 		if mismatch {
 			toClient := &net.REL_ALL_REVEAL_SHARED_SECRETS{
@@ -169,7 +175,7 @@ func (p *PriFiLibRelayInstance) compareBits(id int, bits map[int]int, Ciphertext
 	bitPosition := p.relayState.blamingData.BitPos
 	bytePosition := bitPosition/8 + 9 // LB->CV: why + 9 ? avoid magic numbers :)
 
-	log.Lvl2("Disruption: comparing", bits, "with", CiphertextsHistory[int32(id)][int32(round)])
+	relayLog.Lvl2("Disruption: comparing", bits, "with", CiphertextsHistory[int32(id)][int32(round)])
 
 	byteToGet := CiphertextsHistory[int32(id)][int32(round)][bytePosition]
 	bitInBytePosition := (8-bitPosition%8)%8 - 1
@@ -214,7 +220,11 @@ Received_TRU_REL_SHARED_SECRETS handles TRU_REL_SECRET messages
 Check the NIZK, if correct regenerate the cipher up to the disrupted round and check if this trustee is the disruptor
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_SHARED_SECRETS(msg net.TRU_REL_SHARED_SECRET) error {
-	log.Lvl1("Disruption Phase 2: Received shared secret from Trustee", msg.TrusteeID, "for client", msg.ClientID, "value", msg.Secret)
+	if b := p.relayState.blame; b != nil && b.suspectTrustee == msg.TrusteeID {
+		return p.resolveSuspectPair(msg)
+	}
+
+	relayLog.Lvl1("Disruption Phase 2: Received shared secret from Trustee", msg.TrusteeID, "for client", msg.ClientID, "value", msg.Secret)
 
 	M := "SHAREDKEY"
 	X := make([]kyber.Point, 1)
@@ -236,13 +246,13 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_SHARED_SECRETS(msg net.TRU_REL_
 	if err != nil {
 		log.Error("signature failed to verify: ", err)
 	}
-	log.Lvl3("Linkable Ring Signature verified.")
+	relayLog.Lvl3("Linkable Ring Signature verified.")
 
 	val := p.replayRounds(msg.Secret)
 	if val != p.relayState.blamingData.TrusteeBitRevealed {
 		log.Fatal("Disruption Phase 2: Disruptor is Trustee", msg.TrusteeID, ".")
 	} else {
-		log.Lvl1("Disruption Phase 2: Trustee", msg.TrusteeID, "didn't lie, so it should be Client", msg.ClientID, ".")
+		relayLog.Lvl1("Disruption Phase 2: Trustee", msg.TrusteeID, "didn't lie, so it should be Client", msg.ClientID, ".")
 	}
 	return nil
 }
@@ -252,7 +262,7 @@ Received_CLI_REL_SHARED_SECRET handles CLI_REL_SECRET messages
 Check the NIZK, if correct regenerate the cipher up to the disrupted round and check if this client is the disruptor
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_SHARED_SECRET(msg net.CLI_REL_SHARED_SECRET) error {
-	log.Lvl1("Disruption Phase 2: Received shared secret from Client", msg.ClientID, "for Trustee", msg.TrusteeID, "value", msg.Secret)
+	relayLog.Lvl1("Disruption Phase 2: Received shared secret from Client", msg.ClientID, "for Trustee", msg.TrusteeID, "value", msg.Secret)
 
 	M := "SHAREDKEY"
 	X := make([]kyber.Point, 1)
@@ -274,13 +284,13 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_SHARED_SECRET(msg net.CLI_REL_S
 	if err != nil {
 		log.Error("signature failed to verify: ", err)
 	}
-	log.Lvl3("Linkable Ring Signature verified.")
+	relayLog.Lvl3("Linkable Ring Signature verified.")
 
 	val := p.replayRounds(msg.Secret)
 	if val != p.relayState.blamingData.ClientBitRevealed {
 		log.Fatal("Disruption Phase 2: Disruptor is Client", msg.ClientID, ".")
 	} else {
-		log.Lvl1("Disruption Phase 2: Client", msg.ClientID, "didn't lie, so it should be Client", msg.TrusteeID, ".")
+		relayLog.Lvl1("Disruption Phase 2: Client", msg.ClientID, "didn't lie, so it should be Client", msg.TrusteeID, ".")
 	}
 	return nil
 }
@@ -323,3 +333,63 @@ func (p *PriFiLibRelayInstance) replayRounds(secret kyber.Point) int {
 
 	return rtn
 }
+
+// rotateMACKeys derives the MAC keys of the slots of the schedule of epoch, from our secret with the shuffled
+// ephemeral key of each slot (see dcnet/mac_keys.go)
+func (p *PriFiLibRelayInstance) rotateMACKeys(epoch int32, ephPks []kyber.Point) error {
+	if p.relayState.DCNet == nil {
+		return errors.New("no DC-net to rotate the MAC keys of")
+	}
+	secrets := make(map[int]kyber.Point, len(ephPks))
+	for slot, ephPk := range ephPks {
+		secrets[slot] = config.CryptoSuite.Point().Mul(p.relayState.privateKey, ephPk)
+	}
+	return p.relayState.DCNet.RotateMACKeys(epoch, secrets)
+}
+
+/*
+* checkCellHmac splits the b_echo_last flag and the MAC off the decoded cell of roundID, and checks the MAC against
+* the owner of the slot, with the MAC algorithm of the group. The client ciphers announce the algorithm in their
+* header; a client announcing another one is misconfigured, and the MAC of its cells will not match. If the MAC does
+* not match, the round was disrupted : it is kept for the blame (see blame.go), and the clients and trustees are told.
+* The first round of a schedule has no owner yet, and is not checked.
+* Returns the content of the cell, without the flag nor the MAC, and true; or nil and false if the round was
+* disrupted, as its content cannot be trusted.
+ */
+func (p *PriFiLibRelayInstance) checkCellHmac(roundID int32, cell []byte) ([]byte, bool) {
+	algorithm := p.relayState.MACAlgorithm
+	macSize := dcnet.MACSize(algorithm)
+	if len(cell) < 1+macSize {
+		return cell[1:], true
+	}
+	content, mac := cell[1:len(cell)-macSize], cell[len(cell)-macSize:]
+
+	if p.relayState.DCNet != nil {
+		if announced, agreed := p.relayState.DCNet.DecodedMACAlgorithm(); !agreed || announced != algorithm {
+			relayLog.Lvl1("Disruption: the client ciphers of round", roundID, "do not all announce the MAC algorithm of the group,",
+				dcnet.MACAlgorithmName(algorithm), "(announced:", dcnet.MACAlgorithmName(announced), ", all the same:", agreed, ")")
+		}
+	}
+
+	sent := p.relayState.roundManager.GetDataAlreadySent(roundID)
+	if sent == nil || sent.OwnershipID < 0 || p.relayState.DCNet == nil ||
+		p.relayState.DCNet.VerifySlotMAC(algorithm, sent.OwnershipID, roundID, content, mac) {
+		return content, true
+	}
+
+	relayLog.Lvl1("Disruption: the cell of round", roundID, "(slot", sent.OwnershipID, ") has a wrong MAC, the round was disrupted")
+	d := p.recordDisruptedRound(roundID, sent.OwnershipID, cell)
+
+	toSend := &net.REL_ALL_DISRUPTION_DETECTED{
+		RoundID: roundID,
+		SlotID:  sent.OwnershipID,
+		Cell:    d.cell,
+	}
+	for j := 0; j < p.relayState.nClients; j++ {
+		p.messageSender.SendToClientWithLog(j, toSend, "")
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "")
+	}
+	return nil, false
+}
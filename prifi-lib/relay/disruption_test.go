@@ -0,0 +1,387 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/proof"
+)
+
+func relayWithRoundOwner(owner int) (*PriFiLibRelayInstance, int32) {
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 2, nTrustees: 1}}
+	p.messageSender = newTestMessageSenderWrapper(new(TestMessageSender))
+	p.relayState.roundManager = NewBufferableRoundManager(2, 1, 1)
+	p.relayState.DCNet = dcNetWithMACKeys(100)
+	roundID := p.relayState.roundManager.OpenNextRound()
+	p.relayState.roundManager.SetDataAlreadySent(roundID, &net.REL_CLI_DOWNSTREAM_DATA{RoundID: roundID, OwnershipID: owner})
+	return p, roundID
+}
+
+// testMACSecret is the secret the owner of slot shares with the relay in these tests
+func testMACSecret(slot int) kyber.Point {
+	return config.CryptoSuite.Point().Mul(config.CryptoSuite.Scalar().SetInt64(int64(slot+1)), nil)
+}
+
+// testMACKey is the MAC key of slot in epoch 0
+func testMACKey(slot int) []byte {
+	key, _ := dcnet.DeriveMACKey(testMACSecret(slot), 0)
+	return key
+}
+
+// dcNetWithMACKeys returns the DC-net of a relay which knows the MAC keys of slots 0 and 1, in epoch 0
+func dcNetWithMACKeys(payloadSize int) *dcnet.DCNetEntity {
+	e := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, payloadSize, false, nil)
+	e.RotateMACKeys(0, map[int]kyber.Point{0: testMACSecret(0), 1: testMACSecret(1)})
+	return e
+}
+
+// cellWithHmac returns a decoded cell : the b_echo_last flag, the content, and its HMAC
+func cellWithHmac(slotID int, content []byte) []byte {
+	h := hmac.New(sha256.New, testMACKey(slotID))
+	h.Write(content)
+	return append(append([]byte{0}, content...), h.Sum(nil)...)
+}
+
+func TestCheckCellHmac(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	content := []byte("some upstream data")
+	p, roundID := relayWithRoundOwner(1)
+
+	if out, intact := p.checkCellHmac(roundID, cellWithHmac(1, content)); !intact || !bytes.Equal(out, content) {
+		t.Error("The flag and the HMAC should be split off the content", out)
+	}
+	if len(p.relayState.disruptedRounds) != 0 || len(sentToClient) != 0 || len(sentToTrustee) != 0 {
+		t.Error("A cell with the HMAC of its slot is not disrupted")
+	}
+
+	// the HMAC of another slot, or a flipped bit, is a disruption
+	flipped := cellWithHmac(1, content)
+	flipped[3] ^= 1
+	for _, cell := range [][]byte{cellWithHmac(0, content), flipped} {
+		sentToClient = make([]interface{}, 0)
+		sentToTrustee = make([]interface{}, 0)
+		p, roundID := relayWithRoundOwner(1)
+		if out, intact := p.checkCellHmac(roundID, cell); intact || out != nil {
+			t.Error("The content of a disrupted round should not be returned", out)
+		}
+		if d, found := p.relayState.disruptedRounds[roundID]; !found || d.slot != 1 || !bytes.Equal(d.cell, cell) {
+			t.Error("The round should be kept as disrupted, in slot 1")
+		}
+		if len(sentToClient) != 2 || len(sentToTrustee) != 1 {
+			t.Fatal("The clients and the trustees should be told of the disruption", len(sentToClient), len(sentToTrustee))
+		}
+		msg, _ := getClientMessage("REL_ALL_DISRUPTION_DETECTED")
+		detected, ok := msg.(*net.REL_ALL_DISRUPTION_DETECTED)
+		if !ok || detected.RoundID != roundID || detected.SlotID != 1 || !bytes.Equal(detected.Cell, cell) {
+			t.Error("Wrong REL_ALL_DISRUPTION_DETECTED", msg)
+		}
+	}
+
+	// with another MAC algorithm, the MAC has another size, and is checked with the key of the round
+	sentToClient = make([]interface{}, 0)
+	p, roundID = relayWithRoundOwner(1)
+	p.relayState.MACAlgorithm = dcnet.MAC_POLY1305
+	mac := dcnet.ComputeMAC(dcnet.MAC_POLY1305, testMACKey(1), roundID, content)
+	if out, intact := p.checkCellHmac(roundID, append(append([]byte{0}, content...), mac...)); !intact || !bytes.Equal(out, content) ||
+		len(p.relayState.disruptedRounds) != 0 {
+		t.Error("A cell with the Poly1305 MAC of its slot and round is not disrupted", out)
+	}
+	mac = dcnet.ComputeMAC(dcnet.MAC_POLY1305, testMACKey(1), roundID+1, content)
+	if _, intact := p.checkCellHmac(roundID, append(append([]byte{0}, content...), mac...)); intact || len(p.relayState.disruptedRounds) != 1 {
+		t.Error("A Poly1305 MAC of another round is a disruption")
+	}
+
+	// the first round of a schedule has no owner
+	sentToClient = make([]interface{}, 0)
+	p, roundID = relayWithRoundOwner(-1)
+	if _, intact := p.checkCellHmac(roundID, make([]byte, 100)); !intact || len(p.relayState.disruptedRounds) != 0 || len(sentToClient) != 0 {
+		t.Error("A round without owner is not checked")
+	}
+}
+
+const blamePayloadSize = 100
+
+// blameGroup is a relay, two clients and a trustee running one round of the DC-net, in which client 0 owns the slot
+type blameGroup struct {
+	relay            *PriFiLibRelayInstance
+	roundID          int32
+	clients          []*dcnet.DCNetEntity
+	trustee          *dcnet.DCNetEntity
+	trusteePriv      kyber.Scalar
+	clientPks        []kyber.Point
+	ownerEphPriv     kyber.Scalar
+	clientCiphers    [][]byte
+	trusteeCipher    []byte
+	timedOutClients  []int
+	timedOutTrustees []int
+}
+
+func newBlameGroup() *blameGroup {
+	g := new(blameGroup)
+	p, roundID := relayWithRoundOwner(0)
+	g.relay, g.roundID = p, roundID
+
+	trusteePk, trusteePriv := crypto.NewKeyPair()
+	g.trusteePriv = trusteePriv
+	g.clientPks = make([]kyber.Point, 2)
+	secrets := make([]kyber.Point, 2)
+	for i := range g.clientPks {
+		pk, priv := crypto.NewKeyPair()
+		g.clientPks[i] = pk
+		secrets[i] = config.CryptoSuite.Point().Mul(priv, trusteePk)
+		g.clients = append(g.clients, dcnet.NewDCNetEntity(i, dcnet.DCNET_CLIENT, blamePayloadSize, false, []kyber.Point{secrets[i]}))
+	}
+	g.trustee = dcnet.NewDCNetEntity(0, dcnet.DCNET_TRUSTEE, blamePayloadSize, false, secrets)
+
+	ephPk, ephPriv := crypto.NewKeyPair()
+	g.ownerEphPriv = ephPriv
+	otherEphPk, _ := crypto.NewKeyPair()
+
+	s := p.relayState
+	s.clients = []NodeRepresentation{{0, true, g.clientPks[0], ephPk, nil}, {1, true, g.clientPks[1], otherEphPk, nil}}
+	s.trustees = []NodeRepresentation{{0, true, trusteePk, nil, nil}}
+	s.clientsLeft = make(map[int]bool)
+	s.clientsLeaving = make(map[int]time.Time)
+	s.scheduleBase = config.CryptoSuite.Point().Base()
+	s.EphemeralPublicKeys = []kyber.Point{ephPk, otherEphPk}
+	s.DCNet = dcNetWithMACKeys(blamePayloadSize)
+	s.sessionSummary = prifilog.NewSessionSummary("Relay")
+	s.PublicKey, s.privateKey = crypto.NewKeyPair()
+	s.blameEvidences = new(blameEvidences)
+	s.timeoutHandler = func(clients, trustees []int) {
+		g.timedOutClients, g.timedOutTrustees = clients, trustees
+	}
+
+	// client 0 sends zeros in its slot, with the HMAC
+	content := make([]byte, blamePayloadSize-1-sha256.Size)
+	payload := cellWithHmac(0, content)
+	c0, _ := g.clients[0].EncodeForRound(roundID, true, payload)
+	c1, _ := g.clients[1].EncodeForRound(roundID, false, nil)
+	g.clientCiphers = [][]byte{c0, c1}
+	g.trusteeCipher = g.trustee.TrusteeEncodeForRound(roundID)
+	return g
+}
+
+// flip flips the bit at bitPos in the payload of a cipher
+func flip(cipher []byte, bitPos int) {
+	payload := dcnet.DCNetCipherFromBytes(cipher).Payload
+	payload[bitPos/8] ^= byte(0x80 >> uint(bitPos%8))
+}
+
+// decode gives the ciphers of the round to the relay, decodes it, and returns the cell
+func (g *blameGroup) decode() []byte {
+	s := g.relay.relayState
+	s.CiphertextsHistoryClients = map[int32]map[int32][]byte{0: {g.roundID: g.clientCiphers[0]}, 1: {g.roundID: g.clientCiphers[1]}}
+	s.CiphertextsHistoryTrustees = map[int32]map[int32][]byte{0: {g.roundID: g.trusteeCipher}}
+	s.DCNet.DecodeStart(g.roundID)
+	for _, c := range g.clientCiphers {
+		s.DCNet.DecodeClient(g.roundID, c)
+	}
+	s.DCNet.DecodeTrustee(g.roundID, g.trusteeCipher)
+	cell, _ := s.DCNet.DecodeCell(false)
+	return cell
+}
+
+// ownerBlame is the blame of the owner of slot 0
+func (g *blameGroup) ownerBlame(bitPos int) net.CLI_REL_DISRUPTION_BLAME {
+	suite := config.CryptoSuite
+	pval := map[string]kyber.Point{"B": suite.Point().Base(), "X": g.relay.relayState.EphemeralPublicKeys[0]}
+	prover := proof.Rep("X", "x", "B").Prover(suite, map[string]kyber.Scalar{"x": g.ownerEphPriv}, pval, nil)
+	NIZK, _ := proof.HashProve(suite, "DISRUPTION", prover)
+	return net.CLI_REL_DISRUPTION_BLAME{RoundID: g.roundID, BitPos: bitPos, NIZK: NIZK, Pval: pval}
+}
+
+// trusteeSecret is the secret the trustee shares with a client, and its proof, as the trustee reveals it
+func (g *blameGroup) trusteeSecret(clientID int) net.TRU_REL_SHARED_SECRET {
+	suite := config.CryptoSuite
+	secret := suite.Point().Mul(g.trusteePriv, g.clientPks[clientID])
+	pub := map[string]kyber.Point{"B": suite.Point().Base(), "BT": g.clientPks[clientID], "T": secret,
+		"X[0]": g.relay.relayState.trustees[0].PublicKey}
+	pred := proof.Or(proof.And(proof.Rep("X[0]", "x", "B"), proof.Rep("T", "x", "BT")))
+	choice := map[proof.Predicate]int{pred: 0}
+	prover := pred.Prover(suite, map[string]kyber.Scalar{"x": g.trusteePriv}, pub, choice)
+	NIZK, _ := proof.HashProve(suite, "SHAREDKEY", prover)
+	return net.TRU_REL_SHARED_SECRET{TrusteeID: 0, ClientID: clientID, Secret: secret, NIZK: NIZK, Pub: pub}
+}
+
+func TestBlameClientCipher(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	// client 1 flips a bit of the slot of client 0
+	g := newBlameGroup()
+	bitPos := 8*10 + 3
+	flip(g.clientCiphers[1], bitPos)
+	p := g.relay
+	p.checkCellHmac(g.roundID, g.decode())
+	if _, found := p.relayState.disruptedRounds[g.roundID]; !found {
+		t.Fatal("The round should be detected as disrupted")
+	}
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	// a blame without the key of the slot is refused, so is a bit which is not set
+	forged := g.ownerBlame(bitPos)
+	forged.NIZK[0] ^= 1
+	if err := p.Received_CLI_REL_DISRUPTION_BLAME(forged); err == nil || p.relayState.blame != nil {
+		t.Error("A blame which does not come from the owner of the slot should be refused")
+	}
+	if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos + 1)); err == nil || p.relayState.blame != nil {
+		t.Error("A blame of a bit which is not set should be refused")
+	}
+
+	if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentToClient) != 2 || len(sentToTrustee) != 1 {
+		t.Fatal("The relay should ask the clients and the trustee for their pads", len(sentToClient), len(sentToTrustee))
+	}
+	msg, _ := getTrusteeMessage("REL_ALL_REVEAL_REQUEST")
+	request, ok := msg.(*net.REL_ALL_REVEAL_REQUEST)
+	if !ok || request.RoundID != g.roundID || request.BitPos != bitPos {
+		t.Fatal("Wrong REL_ALL_REVEAL_REQUEST", msg)
+	}
+
+	// everyone reveals its pads honestly : the cipher of client 1 does not match them
+	for i, c := range g.clients {
+		p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: i, RoundID: g.roundID, Bits: c.PadBitsOfRound(g.roundID, bitPos)})
+	}
+	if p.relayState.blame == nil {
+		t.Fatal("The blame should wait for the trustee")
+	}
+	p.Received_TRU_REL_REVEAL_BITS(net.TRU_REL_REVEAL_BITS{TrusteeID: 0, RoundID: g.roundID, Bits: g.trustee.PadBitsOfRound(g.roundID, bitPos)})
+
+	if p.relayState.blame != nil || len(p.relayState.disruptedRounds) != 0 {
+		t.Error("The blame should be over")
+	}
+	if _, excluded := p.relayState.clientsLeaving[1]; !excluded || len(p.relayState.clientsLeaving) != 1 {
+		t.Error("Client 1 should be excluded at the next round boundary", p.relayState.clientsLeaving)
+	}
+
+	// another blame of the round is ignored
+	if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos)); err != nil || p.relayState.blame != nil {
+		t.Error("The round was blamed already")
+	}
+}
+
+func TestBlameLyingClient(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	// client 1 flips a bit, and lies about its pad so that it matches its cipher
+	g := newBlameGroup()
+	bitPos := 8*20 + 7
+	flip(g.clientCiphers[1], bitPos)
+	p := g.relay
+	p.checkCellHmac(g.roundID, g.decode())
+	if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos)); err != nil {
+		t.Fatal(err)
+	}
+	lie := g.clients[1].PadBitsOfRound(g.roundID, bitPos)
+	lie[0] ^= 1
+	p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: 0, RoundID: g.roundID, Bits: g.clients[0].PadBitsOfRound(g.roundID, bitPos)})
+	p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: 1, RoundID: g.roundID, Bits: lie})
+	sentToTrustee = make([]interface{}, 0)
+	p.Received_TRU_REL_REVEAL_BITS(net.TRU_REL_REVEAL_BITS{TrusteeID: 0, RoundID: g.roundID, Bits: g.trustee.PadBitsOfRound(g.roundID, bitPos)})
+
+	// the trustee is asked for the secret it shares with client 1
+	msg, err := getTrusteeMessage("REL_ALL_REVEAL_SHARED_SECRETS")
+	if err != nil {
+		t.Fatal("The trustee should be asked for its shared secret")
+	}
+	if reveal := msg.(*net.REL_ALL_REVEAL_SHARED_SECRETS); reveal.EntityID != 1 {
+		t.Error("The trustee should reveal the secret of client 1, not", reveal.EntityID)
+	}
+	if len(p.relayState.clientsLeaving) != 0 {
+		t.Error("No one is excluded before the secret is revealed")
+	}
+
+	// a secret which does not verify makes the trustee the culprit; here it is the right one
+	p.Received_TRU_REL_SHARED_SECRETS(g.trusteeSecret(1))
+	if _, excluded := p.relayState.clientsLeaving[1]; !excluded || p.relayState.blame != nil {
+		t.Error("Client 1 lied about its pad, it should be excluded")
+	}
+	if g.timedOutTrustees != nil {
+		t.Error("The trustee is honest")
+	}
+}
+
+func TestBlameClientRevealingOtherTrustees(t *testing.T) {
+	for _, extra := range []map[int]int{{5: 1}, {0: 2}} {
+		sentToClient = make([]interface{}, 0)
+		sentToTrustee = make([]interface{}, 0)
+
+		// client 1 flips a bit, and reveals a bit for a trustee which does not exist, or a bit which is not 0 or 1
+		g := newBlameGroup()
+		bitPos := 8*25 + 2
+		flip(g.clientCiphers[1], bitPos)
+		p := g.relay
+		p.checkCellHmac(g.roundID, g.decode())
+		if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos)); err != nil {
+			t.Fatal(err)
+		}
+		bits := g.clients[1].PadBitsOfRound(g.roundID, bitPos)
+		for id, bit := range extra {
+			bits[id] = bit
+		}
+		p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: 0, RoundID: g.roundID, Bits: g.clients[0].PadBitsOfRound(g.roundID, bitPos)})
+		p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: 1, RoundID: g.roundID, Bits: bits})
+		p.Received_TRU_REL_REVEAL_BITS(net.TRU_REL_REVEAL_BITS{TrusteeID: 0, RoundID: g.roundID, Bits: g.trustee.PadBitsOfRound(g.roundID, bitPos)})
+
+		if _, excluded := p.relayState.clientsLeaving[1]; !excluded || p.relayState.blame != nil {
+			t.Error("Client 1 revealed", bits, ", it should be excluded")
+		}
+		for _, msg := range sentToTrustee {
+			if _, ok := msg.(*net.REL_ALL_REVEAL_SHARED_SECRETS); ok {
+				t.Error("The trustee should not be asked for its shared secret")
+			}
+		}
+	}
+}
+
+func TestBlameTrustee(t *testing.T) {
+	for _, wrongSecret := range []bool{false, true} {
+		sentToClient = make([]interface{}, 0)
+		sentToTrustee = make([]interface{}, 0)
+
+		// the trustee flips a bit, and lies about its pad with client 0
+		g := newBlameGroup()
+		bitPos := 8*30 + 1
+		flip(g.trusteeCipher, bitPos)
+		p := g.relay
+		p.checkCellHmac(g.roundID, g.decode())
+		if err := p.Received_CLI_REL_DISRUPTION_BLAME(g.ownerBlame(bitPos)); err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range g.clients {
+			p.Received_CLI_REL_REVEAL_BITS(net.CLI_REL_REVEAL_BITS{ClientID: i, RoundID: g.roundID, Bits: c.PadBitsOfRound(g.roundID, bitPos)})
+		}
+		lie := g.trustee.PadBitsOfRound(g.roundID, bitPos)
+		lie[0] ^= 1
+		p.Received_TRU_REL_REVEAL_BITS(net.TRU_REL_REVEAL_BITS{TrusteeID: 0, RoundID: g.roundID, Bits: lie})
+
+		secret := g.trusteeSecret(0)
+		if wrongSecret {
+			secret.Secret = config.CryptoSuite.Point().Mul(g.trusteePriv, g.clientPks[1])
+		}
+		p.Received_TRU_REL_SHARED_SECRETS(secret)
+		if len(g.timedOutTrustees) != 1 || g.timedOutTrustees[0] != 0 || len(p.relayState.clientsLeaving) != 0 {
+			t.Error("The trustee disrupted the round, the session should end", g.timedOutTrustees, "wrong secret =", wrongSecret)
+		}
+		if evidences := p.relayState.blameEvidences.list(); len(evidences) != 1 || evidences[0].DisruptorIsClient ||
+			evidences[0].Verify(p.relayState.PublicKey) != nil {
+			t.Error("The evidence should designate the trustee, and verify", evidences, "wrong secret =", wrongSecret)
+		}
+	}
+}
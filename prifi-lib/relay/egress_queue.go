@@ -0,0 +1,287 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib/utils"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The drop policies of the EgressQueue, applied when both the memory and the spill file are full
+const (
+	EGRESS_DROP_NEWEST = "drop-newest" // the incoming payload is dropped
+	EGRESS_DROP_OLDEST = "drop-oldest" // the oldest queued payloads are dropped to make room
+)
+
+// EgressQueue sits between the relay and the consumer of the decoded upstream payloads (e.g., the SOCKS exit), so that
+// a stalled consumer does not block the relay, nor make it buffer without bound. Payloads are kept in memory up to
+// maxBytes, then appended to a spill file up to maxSpillBytes if spillDir is set, then dropped according to the drop
+// policy. They are given to the consumer in order.
+type EgressQueue struct {
+	sync.Mutex
+	out           chan []byte
+	maxBytes      int
+	maxSpillBytes int
+	dropPolicy    string
+
+	memory      [][]byte // the oldest payloads; all of them are older than the spilled ones
+	memoryBytes int
+
+	spillFile      *os.File // nil if spilling is disabled
+	spillReadPos   int64
+	spillWritePos  int64
+	spillCount     int
+	nextSpillBytes int // size of the oldest spilled payload, 0 if none
+
+	nonEmpty *sync.Cond
+	closed   bool
+
+	// statistics
+	enqueued     int64
+	spilled      int64
+	dropped      int64
+	droppedBytes int64
+}
+
+// NewEgressQueue creates a queue which forwards to out. If spillDir is empty, nothing is written to disk.
+func NewEgressQueue(out chan []byte, maxBytes int, spillDir string, maxSpillBytes int, dropPolicy string) (*EgressQueue, error) {
+	if maxBytes < 1 {
+		return nil, errors.New("the egress queue needs a positive memory budget")
+	}
+	if dropPolicy == "" {
+		dropPolicy = EGRESS_DROP_NEWEST
+	}
+	if dropPolicy != EGRESS_DROP_NEWEST && dropPolicy != EGRESS_DROP_OLDEST {
+		return nil, errors.New("unknown egress queue drop policy \"" + dropPolicy + "\"")
+	}
+
+	q := &EgressQueue{
+		out:           out,
+		maxBytes:      maxBytes,
+		maxSpillBytes: maxSpillBytes,
+		dropPolicy:    dropPolicy,
+		memory:        make([][]byte, 0),
+	}
+	q.nonEmpty = sync.NewCond(&q.Mutex)
+
+	if spillDir != "" && maxSpillBytes > 0 {
+		f, err := ioutil.TempFile(spillDir, "prifi-egress-spill-")
+		if err != nil {
+			return nil, err
+		}
+		q.spillFile = f
+	}
+
+	go q.forwardLoop()
+	return q, nil
+}
+
+// Push queues a payload, without blocking. It returns false if the payload was dropped.
+func (q *EgressQueue) Push(data []byte) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	for !q.fits(len(data)) {
+		if q.dropPolicy == EGRESS_DROP_NEWEST || !q.dropOldest() {
+			q.dropped++
+			q.droppedBytes += int64(len(data))
+			relayLog.Lvl3("Relay : egress queue full, dropping a payload of", len(data), "bytes")
+			utils.ReleaseCell(data)
+			return false
+		}
+	}
+
+	if q.spillCount == 0 && q.memoryBytes+len(data) <= q.maxBytes {
+		q.memory = append(q.memory, data)
+		q.memoryBytes += len(data)
+	} else if err := q.spill(data); err != nil {
+		log.Error("Relay : could not spill a payload to disk, dropping it;", err)
+		q.dropped++
+		q.droppedBytes += int64(len(data))
+		utils.ReleaseCell(data)
+		return false
+	} else {
+		utils.ReleaseCell(data) // the spill file has a copy
+	}
+	q.enqueued++
+	q.nonEmpty.Signal()
+	return true
+}
+
+// fits tells if a payload of the given size can be queued; to keep the order, it goes to memory only if nothing is
+// spilled
+func (q *EgressQueue) fits(size int) bool {
+	if q.spillCount == 0 && q.memoryBytes+size <= q.maxBytes {
+		return true
+	}
+	return q.spillFile != nil && q.spilledBytes()+int64(4+size) <= int64(q.maxSpillBytes)
+}
+
+// dropOldest drops the oldest queued payload, and returns false if the queue was empty
+func (q *EgressQueue) dropOldest() bool {
+	data, ok := q.popLocked()
+	if !ok {
+		return false
+	}
+	q.dropped++
+	q.droppedBytes += int64(len(data))
+	utils.ReleaseCell(data)
+	return true
+}
+
+func (q *EgressQueue) spilledBytes() int64 {
+	return q.spillWritePos - q.spillReadPos
+}
+
+// spill appends a length-prefixed payload to the spill file
+func (q *EgressQueue) spill(data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := q.spillFile.WriteAt(buf, q.spillWritePos); err != nil {
+		return err
+	}
+	if q.spillCount == 0 {
+		q.nextSpillBytes = len(data)
+	}
+	q.spillWritePos += int64(len(buf))
+	q.spillCount++
+	q.spilled++
+	return nil
+}
+
+// unspill reads the oldest spilled payload
+func (q *EgressQueue) unspill() ([]byte, error) {
+	data := make([]byte, q.nextSpillBytes)
+	if _, err := q.spillFile.ReadAt(data, q.spillReadPos+4); err != nil {
+		return nil, err
+	}
+	q.spillReadPos += int64(4 + len(data))
+	q.spillCount--
+	q.nextSpillBytes = 0
+
+	if q.spillCount == 0 {
+		// reuse the file from the start
+		q.spillReadPos, q.spillWritePos = 0, 0
+		if err := q.spillFile.Truncate(0); err != nil {
+			log.Error("Relay : could not truncate the egress spill file;", err)
+		}
+	} else {
+		header := make([]byte, 4)
+		if _, err := q.spillFile.ReadAt(header, q.spillReadPos); err != nil {
+			return nil, err
+		}
+		q.nextSpillBytes = int(binary.BigEndian.Uint32(header))
+	}
+	return data, nil
+}
+
+// refill moves the oldest spilled payloads to memory, while they fit
+func (q *EgressQueue) refill() {
+	for q.spillCount > 0 && (len(q.memory) == 0 || q.memoryBytes+q.nextSpillBytes <= q.maxBytes) {
+		data, err := q.unspill()
+		if err != nil {
+			log.Error("Relay : could not read the egress spill file, dropping the spilled payloads;", err)
+			q.dropped += int64(q.spillCount)
+			q.droppedBytes += q.spilledBytes() - int64(4*q.spillCount)
+			q.spillReadPos, q.spillWritePos, q.spillCount, q.nextSpillBytes = 0, 0, 0, 0
+			q.spillFile.Truncate(0)
+			return
+		}
+		q.memory = append(q.memory, data)
+		q.memoryBytes += len(data)
+	}
+}
+
+// popLocked removes the oldest payload; the lock must be held
+func (q *EgressQueue) popLocked() ([]byte, bool) {
+	q.refill()
+	if len(q.memory) == 0 {
+		return nil, false
+	}
+	data := q.memory[0]
+	q.memory[0] = nil
+	q.memory = q.memory[1:]
+	q.memoryBytes -= len(data)
+	q.refill()
+	return data, true
+}
+
+// forwardLoop gives the payloads to the consumer, blocking on it instead of the relay
+func (q *EgressQueue) forwardLoop() {
+	for {
+		q.Lock()
+		for len(q.memory) == 0 && q.spillCount == 0 && !q.closed {
+			q.nonEmpty.Wait()
+		}
+		if q.closed {
+			q.Unlock()
+			return
+		}
+		data, _ := q.popLocked()
+		q.Unlock()
+
+		q.out <- data
+	}
+}
+
+// Len returns the number of queued payloads, in memory and on disk
+func (q *EgressQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.memory) + q.spillCount
+}
+
+// Close stops forwarding, drops what is queued and removes the spill file. A forward blocked on the consumer is
+// abandoned.
+func (q *EgressQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, data := range q.memory {
+		utils.ReleaseCell(data)
+	}
+	q.memory = nil
+	q.memoryBytes = 0
+	q.spillCount = 0
+	if q.spillFile != nil {
+		q.spillFile.Close()
+		os.Remove(q.spillFile.Name())
+	}
+	q.nonEmpty.Broadcast()
+}
+
+// WritePrometheus writes the queue depth and the enqueued, spilled and dropped counters, in the Prometheus text format
+func (q *EgressQueue) WritePrometheus(w io.Writer, prefix string) error {
+	q.Lock()
+	memoryBytes, spilledBytes, queued := q.memoryBytes, q.spilledBytes(), len(q.memory)+q.spillCount
+	enqueued, spilled, dropped, droppedBytes := q.enqueued, q.spilled, q.dropped, q.droppedBytes
+	q.Unlock()
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_egress_queue_payloads gauge\n%s_egress_queue_payloads %v\n", prefix, prefix, queued)
+	fmt.Fprintf(w, "# TYPE %s_egress_queue_bytes gauge\n", prefix)
+	fmt.Fprintf(w, "%s_egress_queue_bytes{storage=\"memory\"} %v\n", prefix, memoryBytes)
+	fmt.Fprintf(w, "%s_egress_queue_bytes{storage=\"disk\"} %v\n", prefix, spilledBytes)
+	fmt.Fprintf(w, "# TYPE %s_egress_queue_enqueued_total counter\n%s_egress_queue_enqueued_total %v\n", prefix, prefix, enqueued)
+	fmt.Fprintf(w, "# TYPE %s_egress_queue_spilled_total counter\n%s_egress_queue_spilled_total %v\n", prefix, prefix, spilled)
+	fmt.Fprintf(w, "# TYPE %s_egress_queue_dropped_total counter\n%s_egress_queue_dropped_total %v\n", prefix, prefix, dropped)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# TYPE %s_egress_queue_dropped_bytes_total counter\n%s_egress_queue_dropped_bytes_total %v\n", prefix, prefix, droppedBytes)
+	return err
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func payload(b byte, size int) []byte {
+	return bytes.Repeat([]byte{b}, size)
+}
+
+func receiveOrFail(t *testing.T, out chan []byte) []byte {
+	select {
+	case data := <-out:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("The egress queue did not forward anything")
+	}
+	return nil
+}
+
+func TestEgressQueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-egress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewEgressQueue(make(chan []byte), 10, "", 0, "drop-random"); err == nil {
+		t.Error("Unknown drop policies should be refused")
+	}
+
+	// the consumer is stalled: it never reads before all the payloads are pushed
+	out := make(chan []byte)
+	q, err := NewEgressQueue(out, 20, dir, 50, EGRESS_DROP_NEWEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// 2 in memory (one of which may be held by the forwarder), 3 on disk (14 bytes each), then dropped
+	for i := byte(0); i < 7; i++ {
+		q.Push(payload(i, 10))
+	}
+	if q.dropped == 0 || q.spilled == 0 {
+		t.Error("Should have spilled and dropped payloads", q.spilled, q.dropped)
+	}
+
+	// everything which was not dropped comes out, in order
+	received := 0
+	for int64(received)+q.dropped < 7 {
+		data := receiveOrFail(t, out)
+		if !bytes.Equal(data, payload(byte(received), 10)) {
+			t.Error("Payload", received, "came out wrong or out of order", data)
+		}
+		received++
+	}
+	if q.Len() != 0 {
+		t.Error("The queue should be empty")
+	}
+
+	// the spill file is reused from the start once empty
+	if q.spillWritePos != 0 || q.spillCount != 0 {
+		t.Error("The spill file should be empty", q.spillWritePos, q.spillCount)
+	}
+
+	var metrics bytes.Buffer
+	q.WritePrometheus(&metrics, "prifi_relay")
+	if !strings.Contains(metrics.String(), "prifi_relay_egress_queue_dropped_total ") {
+		t.Error("Missing metrics", metrics.String())
+	}
+
+	q.Close()
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Error("The spill file should be removed on close")
+	}
+}
+
+func TestEgressQueueDropOldest(t *testing.T) {
+	out := make(chan []byte)
+	q, err := NewEgressQueue(out, 30, "", 0, EGRESS_DROP_OLDEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := byte(0); i < 10; i++ {
+		if !q.Push(payload(i, 10)) {
+			t.Error("With drop-oldest, the newest payload should always be queued")
+		}
+	}
+
+	// the forwarder may hold payload 0, then the queue holds the 3 newest ones
+	last := byte(0)
+	for received := int64(0); received+q.dropped < 10; received++ {
+		last = receiveOrFail(t, out)[0]
+	}
+	if last != 9 {
+		t.Error("The newest payload should be kept, got", last)
+	}
+	if q.dropped < 6 {
+		t.Error("Should have dropped the oldest payloads, dropped", q.dropped)
+	}
+}
@@ -0,0 +1,148 @@
+package relay
+
+/*
+The epoch rotation re-randomizes the slots periodically : once a schedule is RelayEpochRounds rounds or
+RelayEpochDuration seconds old, the relay asks the clients for fresh ephemeral keys (REL_CLI_REFRESH_EPH_PKS), and the
+trustees shuffle them for a schedule starting at the next round, like when clients join or leave (see rekeying.go). A
+client which keeps its ephemeral keys across schedules is linked to its new slot by anybody who knew the previous one;
+with fresh keys, the new schedule is independent of the previous one.
+The relay waits EPOCH_REFRESH_TIMEOUT for the keys; the clients which did not answer keep their previous keys.
+*/
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+// EPOCH_REFRESH_TIMEOUT is how long the relay waits for the fresh ephemeral keys of the clients before shuffling
+const EPOCH_REFRESH_TIMEOUT = 10 * time.Second
+
+// epochRotation decides when the relay starts a new schedule with fresh ephemeral keys
+type epochRotation struct {
+	rounds            int32         // a schedule lasts at most this many rounds, 0 if not bounded
+	duration          time.Duration // a schedule lasts at most this long, 0 if not bounded
+	scheduleStartedAt time.Time
+
+	// the fresh keys requested for the next schedule, by client ID; nil if none were requested
+	freshKeys   map[int]*net.CLI_REL_TELL_PK_AND_EPH_PK
+	requestedAt time.Time
+}
+
+// newEpochRotation returns nil if neither rounds nor seconds bound the schedules
+func newEpochRotation(rounds int, seconds int) *epochRotation {
+	if rounds <= 0 && seconds <= 0 {
+		return nil
+	}
+	r := &epochRotation{scheduleStartedAt: time.Now()}
+	if rounds > 0 {
+		r.rounds = int32(rounds)
+	}
+	if seconds > 0 {
+		r.duration = time.Duration(seconds) * time.Second
+	}
+	return r
+}
+
+// due returns true if the schedule which started at firstRound is over, before opening nextRound
+func (r *epochRotation) due(firstRound, nextRound int32, now time.Time) bool {
+	if r.rounds > 0 && nextRound-firstRound >= r.rounds {
+		return true
+	}
+	return r.duration > 0 && now.Sub(r.scheduleStartedAt) >= r.duration
+}
+
+// checkEpochRotation asks the clients for fresh ephemeral keys if the schedule is over, and no other change of the
+// group is in progress
+func (p *PriFiLibRelayInstance) checkEpochRotation() {
+	r := p.relayState.epochRotation
+	if r == nil || r.freshKeys != nil || p.relayState.rekeying != nil || p.relayState.pendingParameters != nil {
+		return
+	}
+	if !r.due(p.relayState.scheduleFirstRound, p.relayState.roundManager.NextRoundToOpen(), time.Now()) {
+		return
+	}
+
+	relayLog.Lvl1("Relay : the schedule of epoch", p.relayState.scheduleEpoch, "started at round", p.relayState.scheduleFirstRound,
+		"is over, asking the clients for fresh ephemeral keys")
+	r.freshKeys = make(map[int]*net.CLI_REL_TELL_PK_AND_EPH_PK)
+	r.requestedAt = time.Now()
+	toSend := &net.REL_CLI_REFRESH_EPH_PKS{Epoch: p.relayState.scheduleEpoch + 1}
+	for i := 0; i < p.relayState.nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", epoch rotation)")
+		}
+	}
+}
+
+// bufferFreshKeys keeps the fresh ephemeral keys of a client of the group, if they were requested. Returns false if
+// they were not.
+func (p *PriFiLibRelayInstance) bufferFreshKeys(msg net.CLI_REL_TELL_PK_AND_EPH_PK) bool {
+	r := p.relayState.epochRotation
+	if r == nil || r.freshKeys == nil {
+		return false
+	}
+	if msg.Pk == nil || msg.EphPk == nil || !msg.Pk.Equal(p.relayState.clients[msg.ClientID].PublicKey) {
+		relayLog.Lvl1("Relay : ignoring the fresh ephemeral keys of client", msg.ClientID, ", its public key does not match")
+		return true
+	}
+	if len(msg.ExtraEphPks) > p.relayState.MaxSlotsPerClient-1 {
+		msg.ExtraEphPks = msg.ExtraEphPks[:p.relayState.MaxSlotsPerClient-1]
+	}
+	r.freshKeys[msg.ClientID] = &msg
+	relayLog.Lvl2("Relay : received the fresh ephemeral keys of client", msg.ClientID)
+	return true
+}
+
+// epochRotationReady returns true if the fresh keys were requested, and all the clients staying in the group sent
+// them, or EPOCH_REFRESH_TIMEOUT passed
+func (p *PriFiLibRelayInstance) epochRotationReady() bool {
+	r := p.relayState.epochRotation
+	if r == nil || r.freshKeys == nil {
+		return false
+	}
+	if time.Since(r.requestedAt) >= EPOCH_REFRESH_TIMEOUT {
+		return true
+	}
+	for i := 0; i < p.relayState.nClients; i++ {
+		_, leaving := p.relayState.clientsLeaving[i]
+		if _, found := r.freshKeys[i]; !found && !p.relayState.clientsLeft[i] && !leaving {
+			return false
+		}
+	}
+	return true
+}
+
+// applyFreshKeys replaces the ephemeral keys of the clients which sent fresh ones, before the shuffle, and returns
+// their number
+func (p *PriFiLibRelayInstance) applyFreshKeys() int {
+	r := p.relayState.epochRotation
+	if r == nil || r.freshKeys == nil {
+		return 0
+	}
+	applied, missing := 0, make([]int, 0)
+	for i := 0; i < p.relayState.nClients; i++ {
+		if p.relayState.clientsLeft[i] {
+			continue
+		}
+		keys, found := r.freshKeys[i]
+		if !found {
+			missing = append(missing, i)
+			continue
+		}
+		p.relayState.clients[i].EphemeralPublicKey = keys.EphPk
+		p.relayState.clients[i].ExtraEphemeralPublicKeys = keys.ExtraEphPks
+		applied++
+	}
+	if len(missing) > 0 {
+		relayLog.Lvl1("Relay : clients", missing, "did not send fresh ephemeral keys in time, they keep their previous ones")
+	}
+	r.freshKeys = nil
+	return applied
+}
+
+// scheduleStarted is called once the clients received a new schedule
+func (r *epochRotation) scheduleStarted() {
+	r.scheduleStartedAt = time.Now()
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+)
+
+func TestEpochRotationDue(t *testing.T) {
+	if newEpochRotation(0, 0) != nil || newEpochRotation(-1, 0) != nil {
+		t.Error("Without rounds nor duration, there should be no rotation")
+	}
+
+	r := newEpochRotation(100, 0)
+	now := r.scheduleStartedAt.Add(time.Hour)
+	if r.due(10, 109, now) || !r.due(10, 110, now) {
+		t.Error("The schedule should last exactly 100 rounds")
+	}
+
+	r = newEpochRotation(0, 60)
+	if r.due(0, 1000000, r.scheduleStartedAt.Add(59*time.Second)) || !r.due(0, 1, r.scheduleStartedAt.Add(60*time.Second)) {
+		t.Error("The schedule should last exactly 60 seconds")
+	}
+	r.scheduleStartedAt = r.scheduleStartedAt.Add(-time.Hour)
+	r.scheduleStarted()
+	if r.due(0, 1, time.Now()) {
+		t.Error("A new schedule should not be due right away")
+	}
+}
+
+func TestEpochRotationFreshKeys(t *testing.T) {
+	clients := make([]NodeRepresentation, 3)
+	for i := range clients {
+		pk, _ := crypto.NewKeyPair()
+		ephPk, _ := crypto.NewKeyPair()
+		clients[i] = NodeRepresentation{ID: i, PublicKey: pk, EphemeralPublicKey: ephPk}
+	}
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 3, clients: clients, MaxSlotsPerClient: 2,
+		clientsLeft: map[int]bool{2: true}, clientsLeaving: make(map[int]time.Time)}}
+	fresh := func(id int, pk kyber.Point, extra int) net.CLI_REL_TELL_PK_AND_EPH_PK {
+		ephPk, _ := crypto.NewKeyPair()
+		msg := net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: id, Pk: pk, EphPk: ephPk, ExtraEphPks: make([]kyber.Point, 0)}
+		for i := 0; i < extra; i++ {
+			extraPk, _ := crypto.NewKeyPair()
+			msg.ExtraEphPks = append(msg.ExtraEphPks, extraPk)
+		}
+		return msg
+	}
+
+	if p.bufferFreshKeys(fresh(0, clients[0].PublicKey, 0)) || p.epochRotationReady() || p.applyFreshKeys() != 0 {
+		t.Error("Without rotation, the keys of the clients are not fresh keys")
+	}
+
+	p.relayState.epochRotation = newEpochRotation(10, 0)
+	if p.bufferFreshKeys(fresh(0, clients[0].PublicKey, 0)) {
+		t.Error("Fresh keys which were not requested should not be buffered")
+	}
+	p.relayState.epochRotation.freshKeys = make(map[int]*net.CLI_REL_TELL_PK_AND_EPH_PK)
+	p.relayState.epochRotation.requestedAt = time.Now()
+
+	if !p.bufferFreshKeys(fresh(0, clients[1].PublicKey, 0)) || len(p.relayState.epochRotation.freshKeys) != 0 {
+		t.Error("The fresh keys of a client should be ignored if its public key does not match")
+	}
+	msg0 := fresh(0, clients[0].PublicKey, 3)
+	if !p.bufferFreshKeys(msg0) || p.epochRotationReady() {
+		t.Error("The relay should wait for client 1")
+	}
+	msg1 := fresh(1, clients[1].PublicKey, 0)
+	if !p.bufferFreshKeys(msg1) || !p.epochRotationReady() {
+		t.Error("The rotation should be ready once all the clients still in the group sent their keys")
+	}
+
+	if applied := p.applyFreshKeys(); applied != 2 {
+		t.Error("The fresh keys of 2 clients should be applied, got", applied)
+	}
+	if !clients[0].EphemeralPublicKey.Equal(msg0.EphPk) || len(clients[0].ExtraEphemeralPublicKeys) != 1 ||
+		!clients[1].EphemeralPublicKey.Equal(msg1.EphPk) {
+		t.Error("The ephemeral keys should be replaced, with at most MaxSlotsPerClient slots per client")
+	}
+	if p.relayState.epochRotation.freshKeys != nil || p.epochRotationReady() {
+		t.Error("The fresh keys should be used only once")
+	}
+
+	// a client which does not answer keeps its previous keys, after the timeout
+	p.relayState.epochRotation.freshKeys = make(map[int]*net.CLI_REL_TELL_PK_AND_EPH_PK)
+	p.relayState.epochRotation.requestedAt = time.Now().Add(-EPOCH_REFRESH_TIMEOUT)
+	p.bufferFreshKeys(fresh(0, clients[0].PublicKey, 0))
+	previous := clients[1].EphemeralPublicKey
+	if !p.epochRotationReady() || p.applyFreshKeys() != 1 || !clients[1].EphemeralPublicKey.Equal(previous) {
+		t.Error("After the timeout, the clients which did not answer should keep their previous keys")
+	}
+}
@@ -0,0 +1,176 @@
+package relay
+
+/*
+At the end of each epoch (when the relay is re-configured, or shuts down), the relay signs a summary of it : the epoch,
+its configuration, the number of rounds, of participants and of slots, and the hash of the setup transcript. The
+summaries are served on the metrics endpoint (EPOCHS_PATH), and optionally appended to a file (one JSON per line), so
+that clients and auditors get a compact record of the service, which the relay cannot deny later.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// EPOCHS_PATH is where the signed summaries of the last epochs are exported, in JSON
+const EPOCHS_PATH = "/epochs"
+
+// EPOCH_SUMMARIES_KEPT is the number of summaries the relay keeps in memory for EPOCHS_PATH
+const EPOCH_SUMMARIES_KEPT = 100
+
+// EpochSummary is the signed record of one epoch of the relay
+type EpochSummary struct {
+	Epoch          int
+	ConfigHash     string
+	StartedAt      int64 // unix time, in seconds
+	EndedAt        int64
+	Rounds         int64
+	Clients        int
+	Trustees       int
+	Slots          int
+	TranscriptHash string // hex SHA-256 of the setup transcript, "" if no shuffle finished during the epoch
+	RelayPublicKey string // hex
+	Signature      string // hex Schnorr signature of the other fields, by RelayPublicKey
+}
+
+// epochRecord is what the relay knows about the current epoch
+type epochRecord struct {
+	started        bool
+	startedAt      time.Time
+	rounds         int64
+	transcriptHash []byte
+}
+
+// epochSummaries keeps the last summaries for the metrics endpoint, which reads them from its own goroutine
+type epochSummaries struct {
+	sync.Mutex
+	summaries []*EpochSummary
+}
+
+func (e *epochSummaries) add(summary *EpochSummary) {
+	e.Lock()
+	defer e.Unlock()
+	e.summaries = append(e.summaries, summary)
+	if len(e.summaries) > EPOCH_SUMMARIES_KEPT {
+		e.summaries = e.summaries[1:]
+	}
+}
+
+func (e *epochSummaries) list() []*EpochSummary {
+	e.Lock()
+	defer e.Unlock()
+	return append([]*EpochSummary{}, e.summaries...)
+}
+
+// signedBytes returns what the signature covers : the summary without its signature, in JSON
+func (s *EpochSummary) signedBytes() []byte {
+	unsigned := *s
+	unsigned.Signature = ""
+	b, _ := json.Marshal(unsigned) // cannot fail on this struct
+	return b
+}
+
+// String returns the summary as a single line of JSON
+func (s *EpochSummary) String() string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// Verify checks that the summary was signed by the relay having the key relayPublicKey
+func (s *EpochSummary) Verify(relayPublicKey kyber.Point) error {
+	pk, err := relayPublicKey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(pk) != s.RelayPublicKey {
+		return errors.New("the summary of epoch " + strconv.Itoa(s.Epoch) + " was not signed by this relay")
+	}
+	sig, err := hex.DecodeString(s.Signature)
+	if err != nil {
+		return errors.New("invalid signature encoding, " + err.Error())
+	}
+	return schnorr.Verify(config.CryptoSuite, relayPublicKey, s.signedBytes(), sig)
+}
+
+// startEpochRecord starts recording a new epoch; the previous one must have been closed
+func (p *PriFiLibRelayInstance) startEpochRecord() {
+	p.relayState.currentEpoch = epochRecord{started: true, startedAt: time.Now()}
+}
+
+// setTranscriptHash records the hash of the setup transcript of the current epoch
+func (p *PriFiLibRelayInstance) setTranscriptHash(transcript []byte) {
+	h := sha256.Sum256(transcript)
+	p.relayState.currentEpoch.transcriptHash = h[:]
+}
+
+// closeEpochRecord signs the summary of the current epoch, if any, and publishes it
+func (p *PriFiLibRelayInstance) closeEpochRecord() {
+	current := p.relayState.currentEpoch
+	if !current.started {
+		return
+	}
+	p.relayState.currentEpoch = epochRecord{}
+	p.reportEpochAnonymity()
+
+	report := p.relayState.sessionSummary.Report()
+	summary := &EpochSummary{
+		Epoch:      report.Epochs,
+		ConfigHash: report.ConfigHash,
+		StartedAt:  current.startedAt.Unix(),
+		EndedAt:    time.Now().Unix(),
+		Rounds:     current.rounds,
+		Clients:    p.relayState.nClients,
+		Trustees:   p.relayState.nTrustees,
+		Slots:      p.relayState.nSlots,
+	}
+	if current.transcriptHash != nil {
+		summary.TranscriptHash = hex.EncodeToString(current.transcriptHash)
+	}
+	pk, err := p.relayState.PublicKey.MarshalBinary()
+	if err != nil {
+		log.Error("Relay : could not encode the public key for the epoch summary,", err)
+		return
+	}
+	summary.RelayPublicKey = hex.EncodeToString(pk)
+	sig, err := schnorr.Sign(config.CryptoSuite, p.relayState.privateKey, summary.signedBytes())
+	if err != nil {
+		log.Error("Relay : could not sign the epoch summary,", err)
+		return
+	}
+	summary.Signature = hex.EncodeToString(sig)
+
+	relayLog.Lvl1("Relay : epoch summary", summary.String())
+	p.collectExperimentResult("EpochSummary: " + summary.String())
+	p.relayState.epochSummaries.add(summary)
+	if p.relayState.EpochSummaryLogPath != "" {
+		appendEpochSummary(p.relayState.EpochSummaryLogPath, summary)
+	}
+}
+
+// appendEpochSummary appends the summary to the file at path, as one line of JSON. Failing to do so is not fatal for
+// the protocol
+func appendEpochSummary(path string, summary *EpochSummary) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("Relay : could not open the epoch summary log", path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(summary.String() + "\n"); err != nil {
+		log.Error("Relay : could not append the epoch summary to", path, err)
+	}
+}
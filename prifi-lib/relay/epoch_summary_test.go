@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestEpochSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-epochs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "epochs.log")
+
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	resultChan := make(chan interface{}, 10)
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), resultChan, timeoutHandler, msw)
+	rs := relay.relayState
+
+	params := func(nClients int) {
+		msg := new(net.ALL_ALL_PARAMETERS)
+		msg.ForceParams = true
+		msg.Add("NClients", nClients)
+		msg.Add("NTrustees", 1)
+		msg.Add("PayloadSize", 1500)
+		msg.Add("DCNetType", "Simple")
+		msg.Add("RelayEpochSummaryLog", path)
+		if err := relay.ReceivedMessage(*msg); err != nil {
+			t.Fatal("Relay should be able to receive this message, but", err)
+		}
+	}
+
+	params(2)
+	if len(rs.epochSummaries.list()) != 0 {
+		t.Error("No epoch should be summarized yet")
+	}
+	rs.currentEpoch.rounds = 42
+	relay.setTranscriptHash([]byte("transcript"))
+
+	// re-configuring the relay closes the first epoch
+	params(3)
+	summaries := rs.epochSummaries.list()
+	if len(summaries) != 1 {
+		t.Fatal("Expected 1 summary, got", len(summaries))
+	}
+	s := summaries[0]
+	if s.Epoch != 1 || s.Rounds != 42 || s.Clients != 2 || s.Trustees != 1 || s.TranscriptHash == "" {
+		t.Error("Wrong summary", s)
+	}
+	if err := s.Verify(rs.PublicKey); err != nil {
+		t.Error("The summary should be signed by the relay,", err)
+	}
+	tampered := *s
+	tampered.Rounds++
+	if tampered.Verify(rs.PublicKey) == nil {
+		t.Error("A tampered summary should not verify")
+	}
+	otherKey, _ := crypto.NewKeyPair()
+	if s.Verify(otherKey) == nil {
+		t.Error("The summary should not verify with another key")
+	}
+
+	// shutting down closes the second one
+	relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	summaries = rs.epochSummaries.list()
+	if len(summaries) != 2 || summaries[1].Epoch != 2 || summaries[1].Clients != 3 || summaries[1].Rounds != 0 || summaries[1].TranscriptHash != "" {
+		t.Fatal("Wrong summaries after the shutdown", summaries)
+	}
+
+	// both were appended to the log
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		var logged EpochSummary
+		if err := json.Unmarshal(scanner.Bytes(), &logged); err != nil {
+			t.Fatal(err)
+		}
+		if err := logged.Verify(rs.PublicKey); err != nil {
+			t.Error("The logged summary should verify,", err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Error("Expected 2 logged summaries, got", n)
+	}
+}
@@ -0,0 +1,64 @@
+package relay
+
+/*
+With the equivocation protection, the owner of a slot encrypts its payload under a fresh key, which the relay recovers
+from the tags of the ciphers : the sum of the clients' tags, minus the history times the sum of the trustees' tags.
+This only gives the key if every client hashed the same downstream data in its history as the relay, i.e. if the relay
+did not send different data to some clients. The relay checks that each cipher carries a well-formed tag, and that
+the payload authenticates under the key recovered (see dcnet.EquivocationProtection.RelayDecode). Otherwise, it raises
+an alarm : it stops the rounds (state BLAMING), tells the clients and the trustees with REL_ALL_EQUIVOCATION_ALARM, so
+that they stop too, and ends the session, which restarts the group with fresh histories. Without proofs of the tags,
+the relay cannot tell a diverging history from a tampered tag or payload, hence the alarm blames nobody.
+*/
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// errEquivocationAlarm is returned when a round raised an equivocation alarm, and was not processed further
+var errEquivocationAlarm = errors.New("equivocation alarm")
+
+// checkEquivocationTags checks the tag of each cipher of a round, before they are decoded
+func (p *PriFiLibRelayInstance) checkEquivocationTags(clientSlices, trusteesSlices [][]byte) error {
+	for clientID, s := range clientSlices {
+		if s == nil {
+			// a client which left the session
+			continue
+		}
+		if err := p.relayState.DCNet.CheckEquivocationTag(s); err != nil {
+			return errors.New("client " + strconv.Itoa(clientID) + " : " + err.Error())
+		}
+	}
+	for trusteeID, s := range trusteesSlices {
+		if err := p.relayState.DCNet.CheckEquivocationTag(s); err != nil {
+			return errors.New("trustee " + strconv.Itoa(trusteeID) + " : " + err.Error())
+		}
+	}
+	return nil
+}
+
+// raiseEquivocationAlarm stops the rounds after the equivocation contributions of roundID were found inconsistent,
+// tells the clients and the trustees, and ends the session; it returns errEquivocationAlarm
+func (p *PriFiLibRelayInstance) raiseEquivocationAlarm(roundID int32, cause error) error {
+	reason := "the equivocation contributions of round " + strconv.Itoa(int(roundID)) + " are inconsistent, " + cause.Error()
+	log.Error("Relay : " + reason + "; the clients may not have received the same data, stopping the rounds")
+	p.stateMachine.ChangeState("BLAMING")
+	p.relayState.sessionSummary.SetShutdownReason(reason, true)
+	p.relayState.roundJournal.saveOnError(reason, time.Now())
+
+	toSend := &net.REL_ALL_EQUIVOCATION_ALARM{RoundID: roundID, Reason: reason}
+	for j := 0; j < p.relayState.nClients; j++ {
+		p.messageSender.SendToClientWithLog(j, toSend, "")
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "")
+	}
+
+	p.relayState.timeoutHandler(nil, nil)
+	return errEquivocationAlarm
+}
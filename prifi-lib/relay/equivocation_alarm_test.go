@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
+)
+
+// cipherWithTag returns a cipher carrying tag as equivocation tag
+func cipherWithTag(tag []byte) []byte {
+	c := &dcnet.DCNetCipher{EquivocationProtectionTag: tag, Payload: make([]byte, 10)}
+	return c.ToBytes()
+}
+
+func TestCheckEquivocationTags(t *testing.T) {
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 2, nTrustees: 1}}
+	p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, 100, true, nil)
+
+	tag, _ := config.CryptoSuite.Scalar().Pick(config.CryptoSuite.RandomStream()).MarshalBinary()
+	valid := cipherWithTag(tag)
+	if err := p.checkEquivocationTags([][]byte{valid, nil}, [][]byte{valid}); err != nil {
+		t.Error("The tags are well-formed, and client 1 left,", err)
+	}
+
+	err := p.checkEquivocationTags([][]byte{valid, cipherWithTag(tag[1:])}, [][]byte{valid})
+	if err == nil || !strings.HasPrefix(err.Error(), "client 1") {
+		t.Error("The tag of client 1 should be refused, got", err)
+	}
+	err = p.checkEquivocationTags([][]byte{valid, valid}, [][]byte{{1, 2}})
+	if err == nil || !strings.HasPrefix(err.Error(), "trustee 0") {
+		t.Error("The cipher of trustee 0 should be refused, got", err)
+	}
+
+	// without the protection, nothing is checked
+	p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, 100, false, nil)
+	if err := p.checkEquivocationTags([][]byte{{1, 2}}, [][]byte{{1, 2}}); err != nil {
+		t.Error("The tags should not be checked without the protection,", err)
+	}
+}
+
+func TestRaiseEquivocationAlarm(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	restarted := false
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 2, nTrustees: 1}}
+	p.messageSender = newTestMessageSenderWrapper(new(TestMessageSender))
+	p.relayState.timeoutHandler = func(clients, trustees []int) { restarted = true }
+	p.relayState.sessionSummary = prifilog.NewSessionSummary("Relay")
+	p.relayState.roundJournal = newRoundJournal()
+	states := []string{"BEFORE_INIT", "COMMUNICATING", "BLAMING", "SHUTDOWN"}
+	p.stateMachine = new(utils.StateMachine)
+	p.stateMachine.Init(states, func(s interface{}) {}, func(s interface{}) {})
+	p.stateMachine.ChangeState("COMMUNICATING")
+
+	if err := p.raiseEquivocationAlarm(12, errors.New("some cause")); err != errEquivocationAlarm {
+		t.Error("Expected errEquivocationAlarm, got", err)
+	}
+	if p.stateMachine.State() != "BLAMING" {
+		t.Error("The relay should be in state BLAMING, not", p.stateMachine.State())
+	}
+	if !restarted {
+		t.Error("The relay should end the session")
+	}
+	if len(sentToClient) != 2 || len(sentToTrustee) != 1 {
+		t.Fatal("The alarm should be sent to the 2 clients and the trustee, sent", len(sentToClient), len(sentToTrustee))
+	}
+	for _, m := range append(sentToClient, sentToTrustee...) {
+		alarm, ok := m.(*net.REL_ALL_EQUIVOCATION_ALARM)
+		if !ok || alarm.RoundID != 12 || !strings.Contains(alarm.Reason, "some cause") {
+			t.Error("Wrong alarm", m)
+		}
+	}
+	if r := p.relayState.sessionSummary.Report(); !r.Abnormal || !strings.Contains(r.Reason, "round 12") {
+		t.Error("The shutdown reason should be the alarm, got", r.Reason)
+	}
+}
@@ -0,0 +1,159 @@
+package relay
+
+/*
+The experiment schedule lets one run sweep over several values of some parameters (e.g. the window size, or the
+downstream cell size), instead of restarting everything for each value. It is a list of steps, each with the round
+from which it applies, given in RelayExperimentSchedule as
+	"<round>:<Parameter>=<value>,<Parameter>=<value>;<round>:..."
+e.g. "1000:WindowSize=2;2000:WindowSize=4,DownstreamCellSize=20000".
+
+When the relay closes the round before a step, it proposes the step's values with the parameters migration, so the
+clients and trustees agree on them; the values are active a few rounds later, once everybody acked. The statistics
+collected by the relay are tagged with the active values of the scheduled parameters.
+*/
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// experimentStep is one step of an experiment schedule
+type experimentStep struct {
+	round  int32
+	params map[string]int
+}
+
+// experimentSchedule is the list of steps of an experiment, sorted by round
+type experimentSchedule struct {
+	steps    []experimentStep
+	nextStep int
+}
+
+// parseExperimentSchedule parses the value of RelayExperimentSchedule. An empty value gives an empty schedule.
+func parseExperimentSchedule(s string) (*experimentSchedule, error) {
+	schedule := &experimentSchedule{steps: make([]experimentStep, 0)}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return schedule, nil
+	}
+
+	for _, stepString := range strings.Split(s, ";") {
+		parts := strings.SplitN(strings.TrimSpace(stepString), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("experiment step \"" + stepString + "\" should be <round>:<Parameter>=<value>,...")
+		}
+		round, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || round < 1 {
+			return nil, errors.New("experiment step \"" + stepString + "\" should start with a round > 0")
+		}
+		if n := len(schedule.steps); n > 0 && int32(round) <= schedule.steps[n-1].round {
+			return nil, errors.New("the rounds of the experiment steps should be increasing, " + strconv.Itoa(round) + " is not")
+		}
+
+		params := make(map[string]int)
+		for _, paramString := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(paramString), "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("experiment parameter \"" + paramString + "\" should be <Parameter>=<value>")
+			}
+			key := strings.TrimSpace(kv[0])
+			if !net.IsMigratableParameter(key) {
+				return nil, errors.New("parameter " + key + " cannot be changed during a session")
+			}
+			value, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, errors.New("the value of " + key + " should be an integer, is \"" + kv[1] + "\"")
+			}
+			params[key] = value
+		}
+		schedule.steps = append(schedule.steps, experimentStep{round: int32(round), params: params})
+	}
+	return schedule, nil
+}
+
+// dueStep returns the step to propose once the round roundID is closed, if any
+func (s *experimentSchedule) dueStep(roundID int32) *experimentStep {
+	if s == nil || s.nextStep >= len(s.steps) || s.steps[s.nextStep].round > roundID+1 {
+		return nil
+	}
+	step := &s.steps[s.nextStep]
+	s.nextStep++
+	return step
+}
+
+// scheduledParameters returns the parameters changed by some step, in the order of net.MIGRATABLE_PARAMETERS
+func (s *experimentSchedule) scheduledParameters() []string {
+	if s == nil {
+		return nil
+	}
+	keys := make([]string, 0)
+	for _, k := range net.MIGRATABLE_PARAMETERS {
+		for _, step := range s.steps {
+			if _, ok := step.params[k]; ok {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// proposeExperimentStep proposes the parameters of the experiment step due after the round roundID, if any
+func (p *PriFiLibRelayInstance) proposeExperimentStep(roundID int32) {
+	step := p.relayState.experimentSchedule.dueStep(roundID)
+	if step == nil {
+		return
+	}
+	relayLog.Lvl1("Relay : experiment step of round", step.round, "reached, proposing", paramsToString(step.params))
+	if err := p.Received_REL_REL_PROPOSE_PARAMETERS(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: step.params}); err != nil {
+		log.Error("Relay : skipping the experiment step of round", step.round, ":", err)
+	}
+}
+
+// experimentConfig describes the active values of the parameters of the experiment schedule, e.g.
+// "WindowSize=2, DownstreamCellSize=20000", and CellsPerRound if the rounds are super-rounds. It is empty if there is
+// no schedule and no super-rounds.
+func (p *PriFiLibRelayInstance) experimentConfig() string {
+	active := make(map[string]int)
+	for _, k := range p.relayState.experimentSchedule.scheduledParameters() {
+		switch k {
+		case "WindowSize":
+			active[k] = p.relayState.WindowSize
+		case "DownstreamCellSize":
+			active[k] = p.relayState.DownstreamCellSize
+		case "RelayRoundTimeOut":
+			active[k] = p.relayState.RoundTimeOut
+		case "RelayTrusteeCacheLowBound":
+			active[k] = p.relayState.TrusteeCacheLowBound
+		case "RelayTrusteeCacheHighBound":
+			active[k] = p.relayState.TrusteeCacheHighBound
+		case "RelayMaxNumberOfConsecutiveFailedRounds":
+			active[k] = p.relayState.MaxNumberOfConsecutiveFailedRounds
+		}
+	}
+	config := paramsToString(active)
+	if p.relayState.CellsPerRound > 1 {
+		if config != "" {
+			config += ", "
+		}
+		config += "CellsPerRound=" + strconv.Itoa(p.relayState.CellsPerRound)
+	}
+	return config
+}
+
+// statisticsInfo is the info attached to the statistics reports: the name of the statistic, and the active
+// experiment configuration, if any
+func (p *PriFiLibRelayInstance) statisticsInfo(name string) string {
+	config := p.experimentConfig()
+	if config == "" {
+		return name
+	}
+	if name == "" {
+		return "config: " + config
+	}
+	return name + ", config: " + config
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestParseExperimentSchedule(t *testing.T) {
+	schedule, err := parseExperimentSchedule(" 100:WindowSize=2 ; 200:WindowSize=4, DownstreamCellSize=2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule.steps) != 2 || schedule.steps[0].round != 100 || schedule.steps[1].params["DownstreamCellSize"] != 2000 {
+		t.Error("Wrong schedule", schedule.steps)
+	}
+	if keys := schedule.scheduledParameters(); len(keys) != 2 || keys[0] != "WindowSize" || keys[1] != "DownstreamCellSize" {
+		t.Error("Wrong scheduled parameters", keys)
+	}
+
+	if schedule, err := parseExperimentSchedule(""); err != nil || len(schedule.steps) != 0 {
+		t.Error("An empty schedule should have no steps")
+	}
+
+	invalid := []string{
+		"WindowSize=2",
+		"0:WindowSize=2",
+		"100:WindowSize",
+		"100:WindowSize=two",
+		"100:PayloadSize=1000",
+		"200:WindowSize=2;100:WindowSize=3",
+	}
+	for _, s := range invalid {
+		if _, err := parseExperimentSchedule(s); err == nil {
+			t.Error("Schedule", s, "should have been refused")
+		}
+	}
+}
+
+func TestExperimentSchedule(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	resultChan := make(chan interface{}, 10)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	dataForClients := make(chan []byte, 6)
+	dataFromDCNet := make(chan []byte, 3)
+
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	rs := relay.relayState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("DownstreamCellSize", 1000)
+	msg.Add("WindowSize", 1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayExperimentSchedule", "10:WindowSize=2;20:DownstreamCellSize=3000")
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+	if rs.experimentSchedule == nil || len(rs.experimentSchedule.steps) != 2 {
+		t.Fatal("The schedule should have 2 steps")
+	}
+	if info := relay.statisticsInfo("round-duration"); info != "round-duration, config: WindowSize=1, DownstreamCellSize=1000" {
+		t.Error("Wrong statistics info", info)
+	}
+
+	relay.stateMachine.ChangeState("COMMUNICATING")
+	rs.numberOfNonAckedDownstreamPackets = 10
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	// nothing is proposed before the round of the first step
+	relay.proposeExperimentStep(5)
+	if len(sentToClient) != 0 || rs.pendingParameters != nil {
+		t.Error("No step should be proposed at round 5")
+	}
+
+	// after round 9, the first step is proposed, then activated once acked
+	relay.proposeExperimentStep(9)
+	if len(sentToClient) != 1 || len(sentToTrustee) != 1 {
+		t.Fatal("The first step should have been proposed")
+	}
+	if proposal := sentToClient[0].(*net.REL_ALL_PARAMETERS_PROPOSAL); proposal.ParamsInt["WindowSize"] != 2 {
+		t.Error("Wrong proposal", proposal)
+	}
+	relay.proposeExperimentStep(10)
+	if rs.pendingParameters.epoch != 1 {
+		t.Error("The first step should not be proposed twice")
+	}
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 0, Epoch: 1, Accepted: true})
+	relay.ReceivedMessage(net.TRU_REL_PARAMETERS_ACK{TrusteeID: 0, Epoch: 1, Accepted: true})
+	if rs.WindowSize != 2 {
+		t.Error("WindowSize should be 2, is", rs.WindowSize)
+	}
+	if config := relay.experimentConfig(); config != "WindowSize=2, DownstreamCellSize=1000" {
+		t.Error("Wrong experiment config", config)
+	}
+
+	// a late round still triggers the next step
+	relay.proposeExperimentStep(25)
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 0, Epoch: 2, Accepted: true})
+	relay.ReceivedMessage(net.TRU_REL_PARAMETERS_ACK{TrusteeID: 0, Epoch: 2, Accepted: true})
+	if rs.DownstreamCellSize != 3000 || rs.WindowSize != 2 {
+		t.Error("DownstreamCellSize should be 3000 and WindowSize 2, are", rs.DownstreamCellSize, rs.WindowSize)
+	}
+	if relay.relayState.experimentSchedule.dueStep(100) != nil {
+		t.Error("The schedule should be over")
+	}
+}
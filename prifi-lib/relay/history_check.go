@@ -0,0 +1,216 @@
+package relay
+
+/*
+With RelayHistoryDigestInterval, the relay checks that each client received the same downstream data as it sent (see
+dcnet/history_digests.go). Every interval rounds, a client reports in its upstream cell the digest of the downstream
+data it applied up to the last checkpoint. A round the client lost, or received corrupted, thus shows at the first
+checkpoint after it, once the client acknowledged it (or gave up on it). The relay then asks the client for its
+digests of the rounds in between, by binary search, until it finds the first round which diverged, and sends the client
+its own digests from this round on, which the client adopts. Only this client is resynchronized; the rounds go on.
+A client joining during the session has no digests of the rounds before it joined, and is resynchronized the same way.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// historyCheck compares the digests of the downstream history reported by the clients with the relay's
+type historyCheck struct {
+	sync.Mutex
+	interval      int
+	digests       *dcnet.HistoryDigests
+	clients       map[int]*clientHistory
+	divergences   int64 // the checkpoints whose digests differed
+	digestsAsked  int64 // the digests asked to the clients by the binary searches
+	resyncs       int64
+	lastDiverged  map[int]int32 // client ID -> the first round which diverged, in the last search
+	resyncedBytes int64
+}
+
+// clientHistory is what the relay knows of the history of a client
+type clientHistory struct {
+	agreed int32                   // the last round whose digests agreed
+	search *dcnet.DivergenceSearch // non-nil while looking for the first round which diverged
+}
+
+// newHistoryCheck checks the digests every interval rounds; nil if interval is 0
+func newHistoryCheck(interval int) *historyCheck {
+	if interval <= 0 {
+		return nil
+	}
+	return &historyCheck{
+		interval:     interval,
+		digests:      dcnet.NewHistoryDigests(0, dcnet.DEFAULT_HISTORY_DIGESTS_KEPT), // round 0 has no downstream data
+		clients:      make(map[int]*clientHistory),
+		lastDiverged: make(map[int]int32),
+	}
+}
+
+func (h *historyCheck) client(clientID int) *clientHistory {
+	c, found := h.clients[clientID]
+	if !found {
+		c = &clientHistory{}
+		h.clients[clientID] = c
+	}
+	return c
+}
+
+// sent chains the downstream data of roundID, which is sent to the clients
+func (h *historyCheck) sent(roundID int32, data []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.digests.Add(roundID, data)
+	h.digests.Advance(roundID)
+}
+
+// reported compares the digest a client reported for a checkpoint with ours; true if they differ, in which case a
+// search for the first round which diverged starts
+func (h *historyCheck) reported(clientID int, roundID int32, digest []byte) bool {
+	h.Lock()
+	defer h.Unlock()
+	c := h.client(clientID)
+	ours, found := h.digests.Digest(roundID)
+	if !found || c.search != nil || roundID <= c.agreed {
+		return false
+	}
+	if bytes.Equal(ours, digest) {
+		c.agreed = roundID
+		return false
+	}
+
+	h.divergences++
+	agreed := c.agreed
+	if agreed < h.digests.Oldest() {
+		// we cannot look further back
+		agreed = h.digests.Oldest()
+	}
+	c.search = dcnet.NewDivergenceSearch(agreed, roundID)
+	return true
+}
+
+// answered records the digest a client gave for a round of the search; false if no search is in progress. A digest
+// the client or the relay does not have anymore counts as diverged.
+func (h *historyCheck) answered(clientID int, roundID int32, digest []byte) bool {
+	h.Lock()
+	defer h.Unlock()
+	c := h.client(clientID)
+	if c.search == nil {
+		return false
+	}
+	ours, found := h.digests.Digest(roundID)
+	c.search.Compared(roundID, found && digest != nil && bytes.Equal(ours, digest))
+	return true
+}
+
+// next returns the next round whose digest to ask the client for, and true; or the first round which diverged, and
+// false
+func (h *historyCheck) next(clientID int) (int32, bool) {
+	h.Lock()
+	defer h.Unlock()
+	roundID, more := h.client(clientID).search.Next()
+	if more {
+		h.digestsAsked++
+	}
+	return roundID, more
+}
+
+// resync ends the search, and returns our digests from firstRound, the first round which diverged, on
+func (h *historyCheck) resync(clientID int, firstRound int32) (int32, [][]byte) {
+	h.Lock()
+	defer h.Unlock()
+	c := h.client(clientID)
+	c.search = nil
+	c.agreed = firstRound // the client adopts our digests from there
+	h.resyncs++
+	h.lastDiverged[clientID] = firstRound
+	first, digests := h.digests.Digests(firstRound)
+	h.resyncedBytes += int64(len(digests) * len(digests[0]))
+	return first, digests
+}
+
+// WritePrometheus writes the history metrics, in the Prometheus text format
+func (h *historyCheck) WritePrometheus(w io.Writer, prefix string) error {
+	h.Lock()
+	clients := make([]int, 0, len(h.lastDiverged))
+	for clientID := range h.lastDiverged {
+		clients = append(clients, clientID)
+	}
+	sort.Ints(clients)
+	diverged := make([]int32, len(clients))
+	for i, clientID := range clients {
+		diverged[i] = h.lastDiverged[clientID]
+	}
+	interval, divergences, asked, resyncs, resyncedBytes := h.interval, h.divergences, h.digestsAsked, h.resyncs, h.resyncedBytes
+	h.Unlock()
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_history_digest_interval gauge\n%s_history_digest_interval %v\n", prefix, prefix, interval)
+	fmt.Fprintf(w, "# TYPE %s_history_divergences_total counter\n%s_history_divergences_total %v\n", prefix, prefix, divergences)
+	fmt.Fprintf(w, "# TYPE %s_history_digests_asked_total counter\n%s_history_digests_asked_total %v\n", prefix, prefix, asked)
+	fmt.Fprintf(w, "# TYPE %s_history_resyncs_total counter\n%s_history_resyncs_total %v\n", prefix, prefix, resyncs)
+	fmt.Fprintf(w, "# TYPE %s_history_resync_bytes_total counter\n%s_history_resync_bytes_total %v\n", prefix, prefix, resyncedBytes)
+	fmt.Fprintf(w, "# TYPE %s_history_first_diverged_round gauge\n", prefix)
+	for i, clientID := range clients {
+		fmt.Fprintf(w, "%s_history_first_diverged_round{client=\"%v\"} %v\n", prefix, clientID, diverged[i])
+	}
+	return err
+}
+
+// recordDownstreamHistory chains the downstream data of roundID, if the history is checked
+func (p *PriFiLibRelayInstance) recordDownstreamHistory(roundID int32, data []byte) {
+	if p.relayState.historyCheck != nil {
+		p.relayState.historyCheck.sent(roundID, data)
+	}
+}
+
+// checkHistoryDigest compares the digest piggybacked in an upstream cell, if any, with ours
+func (p *PriFiLibRelayInstance) checkHistoryDigest(msg net.CLI_REL_UPSTREAM_DATA) {
+	if p.relayState.historyCheck == nil || msg.HistoryDigest == nil {
+		return
+	}
+	if p.relayState.historyCheck.reported(msg.ClientID, msg.HistoryRoundID, msg.HistoryDigest) {
+		relayLog.Lvl1("Relay : the downstream history of client", msg.ClientID, "diverged before round", msg.HistoryRoundID, ", looking for the first round which diverged")
+		p.continueHistorySearch(msg.ClientID)
+	}
+}
+
+// Received_CLI_REL_HISTORY_DIGEST handles CLI_REL_HISTORY_DIGEST messages, the answers of a client to our
+// REL_CLI_HISTORY_REQUEST while we look for the first round where its history diverged
+func (p *PriFiLibRelayInstance) Received_CLI_REL_HISTORY_DIGEST(msg net.CLI_REL_HISTORY_DIGEST) error {
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients {
+		e := "Relay : received a history digest from unknown client " + strconv.Itoa(msg.ClientID)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if p.relayState.historyCheck == nil || !p.relayState.historyCheck.answered(msg.ClientID, msg.RoundID, msg.Digest) {
+		relayLog.Lvl3("Relay : ignoring the history digest of round", msg.RoundID, "from client", msg.ClientID, ", we are not looking for a divergence")
+		return nil
+	}
+	p.continueHistorySearch(msg.ClientID)
+	return nil
+}
+
+// continueHistorySearch asks the client for the digest of the next round of the search, or resynchronizes it once
+// the first round which diverged is found
+func (p *PriFiLibRelayInstance) continueHistorySearch(clientID int) {
+	roundID, more := p.relayState.historyCheck.next(clientID)
+	if more {
+		toSend := &net.REL_CLI_HISTORY_REQUEST{RoundID: roundID}
+		p.messageSender.SendToClientWithLog(clientID, toSend, "(history digest of round "+strconv.Itoa(int(roundID))+")")
+		return
+	}
+
+	firstRound, digests := p.relayState.historyCheck.resync(clientID, roundID)
+	relayLog.Lvl1("Relay : the downstream history of client", clientID, "diverged in round", roundID, ", resynchronizing it")
+	toSend := &net.REL_CLI_HISTORY_RESYNC{FirstRoundID: firstRound, Digests: digests}
+	p.messageSender.SendToClientWithLog(clientID, toSend, "(history resync from round "+strconv.Itoa(int(firstRound))+")")
+}
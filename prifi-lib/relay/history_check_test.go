@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+// answerHistoryMessages plays a client with the given chain : it answers the requests the relay sent, and applies
+// its resyncs. It returns the number of digests asked, and the first round of the resync, or -1.
+func answerHistoryMessages(t *testing.T, p *PriFiLibRelayInstance, clientID int, history *dcnet.HistoryDigests) (int, int32) {
+	asked, resynced := 0, int32(-1)
+	for len(sentToClient) > 0 {
+		msg := sentToClient[0]
+		sentToClient = sentToClient[1:]
+		switch m := msg.(type) {
+		case *net.REL_CLI_HISTORY_REQUEST:
+			asked++
+			digest, _ := history.Digest(m.RoundID)
+			answer := net.CLI_REL_HISTORY_DIGEST{ClientID: clientID, RoundID: m.RoundID, Digest: digest}
+			if err := p.Received_CLI_REL_HISTORY_DIGEST(answer); err != nil {
+				t.Fatal(err)
+			}
+		case *net.REL_CLI_HISTORY_RESYNC:
+			resynced = m.FirstRoundID
+			if err := history.Resync(m.FirstRoundID, m.Digests); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatal("Unexpected message", msg)
+		}
+	}
+	return asked, resynced
+}
+
+func TestHistoryCheck(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	interval := 8
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 2}}
+	p.messageSender = newTestMessageSenderWrapper(new(TestMessageSender))
+	p.relayState.historyCheck = newHistoryCheck(interval)
+
+	// client 1 loses round 13, and receives round 30 corrupted
+	clients := []*dcnet.HistoryDigests{dcnet.NewHistoryDigests(0, 0), dcnet.NewHistoryDigests(0, 0)}
+	reported := []int32{0, 0}
+	resyncs := make([]int32, 0)
+	for r := int32(1); r <= 60; r++ {
+		data := bytes.Repeat([]byte{byte(r)}, 20)
+		p.recordDownstreamHistory(r, data)
+
+		for clientID, history := range clients {
+			received := data
+			if clientID == 1 && r == 30 {
+				received = append([]byte{0}, data[1:]...)
+			}
+			if clientID != 1 || r != 13 {
+				history.Add(r, received)
+			}
+			history.Advance(r - 2) // the ACKs lag behind
+
+			msg := net.CLI_REL_UPSTREAM_DATA{ClientID: clientID, RoundID: r}
+			if cp := history.Checkpoint(interval); cp > reported[clientID] {
+				reported[clientID] = cp
+				msg.HistoryRoundID = cp
+				msg.HistoryDigest, _ = history.Digest(cp)
+			}
+			p.checkHistoryDigest(msg)
+			asked, resynced := answerHistoryMessages(t, p, clientID, history)
+			if resynced < 0 {
+				continue
+			}
+			if clientID != 1 {
+				t.Error("Client", clientID, "should not be resynchronized")
+			}
+			if asked > 3 {
+				t.Error("The search should ask at most 3 digests, asked", asked)
+			}
+			resyncs = append(resyncs, resynced)
+		}
+	}
+
+	if len(resyncs) != 2 || resyncs[0] != 13 || resyncs[1] != 30 {
+		t.Error("Client 1 should be resynchronized from rounds 13 and 30, got", resyncs)
+	}
+	for clientID, history := range clients {
+		ours, _ := p.relayState.historyCheck.digests.Digest(history.Chained())
+		theirs, _ := history.Digest(history.Chained())
+		if !bytes.Equal(ours, theirs) {
+			t.Error("The history of client", clientID, "should agree with the relay's")
+		}
+	}
+
+	// an answer without a search in progress is ignored
+	if err := p.Received_CLI_REL_HISTORY_DIGEST(net.CLI_REL_HISTORY_DIGEST{ClientID: 0, RoundID: 3}); err != nil || len(sentToClient) != 0 {
+		t.Error("An unexpected digest should be ignored", err)
+	}
+	if err := p.Received_CLI_REL_HISTORY_DIGEST(net.CLI_REL_HISTORY_DIGEST{ClientID: 2, RoundID: 3}); err == nil {
+		t.Error("A digest from an unknown client should be refused")
+	}
+
+	var metrics strings.Builder
+	p.relayState.historyCheck.WritePrometheus(&metrics, METRICS_PREFIX)
+	for _, line := range []string{"prifi_relay_history_divergences_total 2", "prifi_relay_history_resyncs_total 2",
+		"prifi_relay_history_first_diverged_round{client=\"1\"} 30"} {
+		if !strings.Contains(metrics.String(), line) {
+			t.Error("The metrics should contain", line)
+		}
+	}
+
+	// without RelayHistoryDigestInterval, nothing is checked
+	if newHistoryCheck(0) != nil {
+		t.Error("The history should not be checked with an interval of 0")
+	}
+}
@@ -15,9 +15,13 @@ Then, this file simple handle the answer to the different message kind :
 - TRU_REL_TELL_NEW_BASE_AND_EPH_PKS - when we receive the result of one shuffle, we forward it to the next trustee
 - TRU_REL_SHUFFLE_SIG - when the shuffle has been done by all trustee, we send the transcript, and they answer with a signature, which we
 						   broadcast to the clients
+- TRU_REL_SHUFFLE_REJECTED - a trustee could not verify a shuffle of the transcript; we verify it again, and end the session
+						   blaming either the trustee which did this shuffle, or the one which rejected it
 - CLI_REL_UPSTREAM_DATA - data for the DC-net
+- CLI_REL_GOODBYE - a client leaves the session; we remove it at the next round boundary, and shuffle again without it
 - REL_CLI_UDP_DOWNSTREAM_DATA - is NEVER received here, but casted to CLI_REL_UPSTREAM_DATA by messages.go
 - TRU_REL_DC_CIPHER - data for the DC-net
+- TRU_REL_LOAD_REPORT - the CPU load of a trustee; we lower the window of an overloaded trustee
 
 local functions :
 
@@ -34,25 +38,37 @@ considered disconnected
 import (
 	"errors"
 
+	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"github.com/dedis/prifi/prifi-lib/transform"
 	"github.com/dedis/prifi/prifi-lib/utils"
+	"github.com/dedis/prifi/utils"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 
 	"github.com/dedis/prifi/prifi-lib/crypto"
+	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
+)
+
+// relayLog and schedulerLog log at the level of the "relay" and "scheduler" modules
+var (
+	relayLog     = prifilog.NewModuleLogger(prifilog.MODULE_RELAY)
+	schedulerLog = prifilog.NewModuleLogger(prifilog.MODULE_SCHEDULER)
 )
 
 // PriFiLibInstance contains the mutable state of a PriFi entity.
 type PriFiLibRelayInstance struct {
-	messageSender *net.MessageSenderWrapper
-	relayState    *RelayState
-	stateMachine  *utils.StateMachine
+	messageSender  *net.MessageSenderWrapper
+	relayState     *RelayState
+	stateMachine   *utils.StateMachine
+	incomingFaults *net.FaultInjector // drops, delays or corrupts the messages received, in the tests; nil otherwise
 }
 
 // NewPriFiRelay creates a new PriFi relay entity state.
@@ -71,15 +87,29 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	relayState.ExperimentResultData = make([]string, 0)
 	relayState.PriorityDataForClients = make(chan []byte, 10) // This is used for relay's control message (like latency-tests) d
 	relayState.schedulesStatistics = prifilog.NewSchedulesStatistics()
+	relayState.contentStatistics = prifilog.NewContentStatistics()
+	relayState.anonymityStatistics = prifilog.NewAnonymityStatistics(0)
 	relayState.timeStatistics = make(map[string]*prifilog.TimeStatistics)
 	relayState.timeStatistics["round-duration"] = prifilog.NewTimeStatistics()
 	relayState.timeStatistics["waiting-on-clients"] = prifilog.NewTimeStatistics()
 	relayState.timeStatistics["waiting-on-trustees"] = prifilog.NewTimeStatistics()
 	relayState.timeStatistics["sending-data"] = prifilog.NewTimeStatistics()
 	relayState.timeStatistics["pcap-delay"] = prifilog.NewTimeStatistics()
+	relayState.timeStatistics[CLIENT_SPREAD] = prifilog.NewTimeStatistics()
+	relayState.timeStatistics[TRUSTEE_SPREAD] = prifilog.NewTimeStatistics()
+	relayState.timeStatistics[PROBE_ECHO] = prifilog.NewTimeStatistics()
+	relayState.setupStatistics = prifilog.NewSetupStatistics()
+	relayState.messageStatistics = prifilog.NewMessageStatistics()
+	relayState.availabilityStatistics = prifilog.NewAvailabilityStatistics(MAX_STALLED_ROUND_DIAGNOSTICS)
+	relayState.sessionSummary = prifilog.NewSessionSummary("Relay")
+	relayState.epochSummaries = new(epochSummaries)
+	relayState.blameEvidences = new(blameEvidences)
+	relayState.roundJournal = newRoundJournal()
+	relayState.FeatureFlags, _ = config.ParseFeatureFlags("")
 	relayState.PublicKey, relayState.privateKey = crypto.NewKeyPair()
 	relayState.slotScheduler = new(scheduler.BitMaskSlotScheduler_Relay)
 	relayState.roundManager = new(BufferableRoundManager)
+	relayState.scheduleEpoch = -1 // the first schedule is of epoch 0
 	relayState.processingLock = *new(sync.Mutex)
 	neffShuffle := new(scheduler.NeffShuffle)
 	neffShuffle.Init()
@@ -90,11 +120,11 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	states := []string{"BEFORE_INIT", "COLLECTING_TRUSTEES_PKS", "COLLECTING_CLIENT_PKS", "COLLECTING_SHUFFLES", "COLLECTING_SHUFFLE_SIGNATURES", "COMMUNICATING", "BLAMING", "SHUTDOWN"}
 	sm := new(utils.StateMachine)
 	logFn := func(s interface{}) {
-		log.Lvl2(s)
+		relayLog.Lvl2(s)
 	}
 	errFn := func(s interface{}) {
 		if strings.Contains(s.(string), ", but in state SHUTDOWN") { //it's an "acceptable error"
-			log.Lvl4(s)
+			relayLog.Lvl4(s)
 		} else {
 			log.Fatal(s)
 		}
@@ -116,6 +146,8 @@ type NodeRepresentation struct {
 	Connected          bool
 	PublicKey          kyber.Point
 	EphemeralPublicKey kyber.Point
+	// one per additional slot the client owns
+	ExtraEphemeralPublicKeys []kyber.Point
 }
 
 // BlamingData is a struct used in the blame phase of the disruption protection.
@@ -145,6 +177,13 @@ type RelayState struct {
 	MessageHistory                         kyber.XOF
 	Name                                   string
 	nClients                               int
+	nSlots                                 int // number of slots in the schedule; more than nClients if some clients own several slots
+	MaxSlotsPerClient                      int
+	rateController                         *RoundRateController // nil if the pacing is static
+	pacer                                  *roundPacer          // spaces the rounds, see pacing.go
+	bandwidthCap                           *BandwidthCap        // nil if the egress of the relay is not capped
+	latencyProbesReceivedAt                []time.Time          // when the probes waiting in PriorityDataForClients were decoded
+	latencyProbesRounds                    map[int32]time.Time  // round -> when the probe it echoes was decoded
 	nClientsPkCollected                    int
 	nTrustees                              int
 	nTrusteesPkCollected                   int
@@ -152,10 +191,17 @@ type RelayState struct {
 	PublicKey                              kyber.Point
 	ExperimentRoundLimit                   int
 	trustees                               []NodeRepresentation
+	trusteesKeyEndorsements                [][]byte // the signatures of the trustees' keys by their long-term keys, for the setup transcripts
 	PayloadSize                            int
+	CellsPerRound                          int                     // number of DC-net cells of PayloadSize carried by each round ("super-rounds")
+	clientParams                           *net.ALL_ALL_PARAMETERS // the parameters sent to the clients for this epoch, also sent to the clients joining later
+	clientParamsDigest                     []byte                  // digest of the parameters sent to the clients for this epoch
 	UseDummyDataDown                       bool
 	UseOpenClosedSlots                     bool
 	UseUDP                                 bool
+	TransportOffers                        string // the transports offered to the clients for the data of the rounds, see net.ParseTransportOffers
+	SocksCredentials                       string // the username:password pairs the clients accept from the applications, see config.ParseSOCKSCredentials
+	unreliableTransport                    bool   // true if one of them may lose downstream data
 	numberOfNonAckedDownstreamPackets      int
 	WindowSize                             int
 	ExperimentResultChannel                chan interface{}
@@ -163,12 +209,37 @@ type RelayState struct {
 	timeoutHandler                         func([]int, []int)
 	bitrateStatistics                      *prifilog.BitrateStatistics
 	schedulesStatistics                    *prifilog.SchedulesStatistics
+	contentStatistics                      *prifilog.ContentStatistics   // what the decoded upstream payloads contain
+	anonymityStatistics                    *prifilog.AnonymityStatistics // the effective anonymity set of each slot which carried data in this epoch
+	roundParticipants                      []int                         // the clients whose cipher is in the round being decoded
 	timeStatistics                         map[string]*prifilog.TimeStatistics
+	setupStatistics                        *prifilog.SetupStatistics        // the key collection, shuffles and signatures, apart from the rounds
+	roundTimers                            map[int32]*timing.Timer          // the timers of the rounds in flight, with their "sending-data" and "waiting-on-someone" children
+	messageStatistics                      *prifilog.MessageStatistics      // count and processing time of each message type, filled in ReceivedMessage
+	availabilityStatistics                 *prifilog.AvailabilityStatistics // missed rounds and last-seen times of each client and trustee
+	sessionSummary                         *prifilog.SessionSummary         // totals since the relay started, for the shutdown report
+	currentEpoch                           epochRecord                      // what goes in the signed summary of this epoch
+	epochSummaries                         *epochSummaries                  // the signed summaries of the last epochs
+	EpochSummaryLogPath                    string                           // if non-empty, the signed epoch summaries are appended there
+	blameEvidences                         *blameEvidences                  // the signed evidence of the last blames
+	BlameEvidenceDir                       string                           // if non-empty, the signed evidence of each blame is written there
+	metricsServer                          *http.Server                     // if non-nil, exports messageStatistics and availabilityStatistics
+	demoServer                             *demoServer                      // if non-nil, serves delayed aggregated statistics to spectators
 	slotScheduler                          *scheduler.BitMaskSlotScheduler_Relay
 	dcNetType                              string
 	time0                                  uint64
 	pcapLogger                             *utils.PCAPLog
+	flowCapture                            *utils.PCAPNGWriter  // if non-nil, each decoded payload is written there with its FlowLabel
+	mirrorSink                             *mirrorSink          // if non-nil, each decoded payload is copied there, for experiments only
+	delivery                               *deliveryTracker     // the downstream rounds each client acknowledged
+	historyCheck                           *historyCheck        // nil if the clients do not report the digests of their downstream history
+	contributionSpreads                    *contributionSpreads // when the first and last ciphers of each round arrived
+	roundJournal                           *roundJournal        // the timings, ciphers, sizes and outcome of the last rounds
+	trusteeLoads                           *trusteeLoads        // the CPU load reported by the trustees, and their windows
+	egressQueue                            *EgressQueue         // if non-nil, the decoded payloads go through it instead of straight to DataFromDCNet
+	cellPool                               *utils.CellPool      // if non-nil, the large decoded cells are taken from it
 	DisruptionProtectionEnabled            bool
+	MACAlgorithm                           byte // the MAC which ends the cells with the disruption protection, see dcnet/mac.go
 	OpenClosedSlotsMinDelayBetweenRequests int
 	OpenClosedSlotsRequestsRoundID         map[int32]bool // contains roundID -> true if that round should be a OC slot request
 	numberOfConsecutiveFailedRounds        int
@@ -178,6 +249,28 @@ type RelayState struct {
 	TrusteeCacheLowBound                   int // Number of ciphertexts buffered by trustees. When <= TRUSTEE_CACHE_LOWBOUND, resume sending
 	TrusteeCacheHighBound                  int // Number of ciphertexts buffered by trustees. When >= TRUSTEE_CACHE_HIGHBOUND, stop sending
 	EquivocationProtectionEnabled          bool
+	TranscriptExportPath                   string                             // If non-empty, the setup transcript is written there after each shuffle
+	TrusteeQuorum                          int                                // Minimum number of trustees in an epoch; the pads of absent trustees are omitted. 0 means no minimum
+	RandomBeacon                           *crypto.RandomBeacon               // external randomness folded into this epoch's shuffle and message history, nil if none
+	FeatureFlags                           *config.FeatureFlags               // experimental behaviors toggled for this deployment
+	parametersEpoch                        int32                              // incremented each time new parameters are activated during the session
+	pendingParameters                      *parametersProposal                // the parameters proposed to the clients and trustees, nil if none
+	lastProposedParametersEpoch            int32                              // the epoch of the last proposal, active or not
+	experimentSchedule                     *experimentSchedule                // the parameters to change at given rounds, for a sweep in one run
+	minAnonymitySet                        int                                // RelayMinAnonymitySet, kept for the epochs started by a rekeying
+	pendingClients                         map[int]*pendingClient             // the clients which joined during the session, admitted at the next rekeying
+	rekeying                               *rekeying                          // non-nil while the schedule is shuffled again to admit the pending clients
+	clientsLeaving                         map[int]time.Time                  // the clients which said goodbye, removed at the next rekeying
+	epochRotation                          *epochRotation                     // nil if the schedule only changes with the group
+	warmup                                 *warmup                            // nil if the epoch starts without warm-up rounds
+	slotSizes                              *slotSizer                         // nil if the upstream cells have the same size in all rounds
+	payloadTransform                       transform.Spec                     // the transform of the payloads of the slots, see payload_transform.go
+	payloadDecoders                        map[int]transform.PayloadTransform // slot -> the decoder of its payloads, if the transform is enabled
+	payloadTransformStatistics             *payloadTransformStatistics        // the contents rebuilt and lost by the decoders
+	decodePipeline                         *decodePipeline                    // nil if the rounds are decoded once complete, on the goroutine handling the messages
+	clientsLeft                            map[int]bool                       // the clients which left the session; their IDs are not reused
+	scheduleFirstRound                     int32                              // the first round of the current schedule; 0, unless clients joined during the session
+	scheduleEpoch                          int32                              // incremented for each shuffled schedule, also across resyncs; the trustees tag their ciphers with it
 
 	// sync
 	processingLock sync.Mutex // either we treat a message, or a timeout, never both
@@ -185,6 +278,8 @@ type RelayState struct {
 	//disruption protection
 	LastMessageOfClients       map[int32][]byte
 	BEchoFlags                 map[int32]byte
+	disruptedRounds            map[int32]*disruptedRound // the rounds whose cell had a wrong HMAC, until they are blamed
+	blame                      *blame                    // non-nil while a disrupted round is blamed
 	CiphertextsHistoryTrustees map[int32]map[int32][]byte
 	CiphertextsHistoryClients  map[int32]map[int32][]byte
 	DisruptionReveal           bool
@@ -192,6 +287,7 @@ type RelayState struct {
 	trusteeBitMap              map[int]map[int]int
 	blamingData                BlamingData
 	EphemeralPublicKeys        []kyber.Point
+	scheduleBase               kyber.Point // the base of the shuffled ephemeral keys, in which the slot owners prove ownership
 
 	//disruption testing
 	ForceDisruptionSinceRound3 bool
@@ -204,10 +300,32 @@ type RelayState struct {
 // ReceivedMessage must be called when a PriFi host receives a message.
 // It takes care to call the correct message handler function.
 func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
+	faulted, handleNow := p.incomingFaults.Filter(msg, p.receivedMessage)
+	if !handleNow {
+		relayLog.Lvl3("Relay : fault injection, not handling a", reflect.TypeOf(msg), "now")
+		return nil
+	}
+	return p.receivedMessage(faulted)
+}
+
+// SetFaultInjectors makes the relay drop, delay or corrupt some of the messages it receives (incoming) and sends
+// (outgoing), for the tests; nil delivers everything. It must be called before the messages it should apply to.
+func (p *PriFiLibRelayInstance) SetFaultInjectors(incoming *net.FaultInjector, outgoing *net.FaultInjector) {
+	p.incomingFaults = incoming
+	p.messageSender.SetFaultInjector(outgoing)
+}
+
+func (p *PriFiLibRelayInstance) receivedMessage(msg interface{}) error {
 
 	p.relayState.processingLock.Lock()
 	defer p.relayState.processingLock.Unlock()
 
+	if p.relayState.rekeying != nil && !p.handledWhileRekeying(msg) {
+		relayLog.Lvl3("Relay : shuffling again to change the clients, dropping a", reflect.TypeOf(msg).Name())
+		return nil
+	}
+
+	start := time.Now()
 	var err error
 	switch typedMsg := msg.(type) {
 	case net.ALL_ALL_PARAMETERS:
@@ -248,8 +366,12 @@ func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("COLLECTING_TRUSTEES_PKS") {
 			err = p.Received_TRU_REL_TELL_PK(typedMsg)
 		}
+	case net.CLI_REL_GOODBYE:
+		err = p.Received_CLI_REL_GOODBYE(typedMsg)
 	case net.CLI_REL_TELL_PK_AND_EPH_PK:
-		if p.stateMachine.AssertState("COLLECTING_CLIENT_PKS") {
+		if p.stateMachine.State() == "COMMUNICATING" || p.relayState.rekeying != nil {
+			err = p.bufferLateClient(typedMsg)
+		} else if p.stateMachine.AssertState("COLLECTING_CLIENT_PKS") {
 			err = p.Received_CLI_REL_TELL_PK_AND_EPH_PK(typedMsg)
 		}
 	case net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS:
@@ -260,13 +382,84 @@ func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("COLLECTING_SHUFFLE_SIGNATURES") {
 			err = p.Received_TRU_REL_SHUFFLE_SIG(typedMsg)
 		}
+	case net.TRU_REL_SHUFFLE_REJECTED:
+		if p.stateMachine.AssertState("COLLECTING_SHUFFLE_SIGNATURES") {
+			err = p.Received_TRU_REL_SHUFFLE_REJECTED(typedMsg)
+		}
+	case net.CLI_REL_REVEAL_BITS:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_REVEAL_BITS(typedMsg)
+		}
+	case net.TRU_REL_REVEAL_BITS:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_TRU_REL_REVEAL_BITS(typedMsg)
+		}
 	case net.CLI_REL_DISRUPTION_BLAME:
 		if p.stateMachine.AssertState("COMMUNICATING") {
 			err = p.Received_CLI_REL_DISRUPTION_BLAME(typedMsg)
 		}
+	case net.REL_REL_PROPOSE_PARAMETERS:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_REL_REL_PROPOSE_PARAMETERS(typedMsg)
+		}
+	case net.CLI_REL_PARAMETERS_ACK:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_PARAMETERS_ACK(typedMsg)
+		}
+	case net.TRU_REL_PARAMETERS_ACK:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_TRU_REL_PARAMETERS_ACK(typedMsg)
+		}
+	case net.CLI_REL_DOWNSTREAM_COPY_REQUEST:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_DOWNSTREAM_COPY_REQUEST(typedMsg)
+		}
+	case net.CLI_REL_DOWNSTREAM_NACK:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_DOWNSTREAM_NACK(typedMsg)
+		}
+	case net.CLI_REL_HISTORY_DIGEST:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_HISTORY_DIGEST(typedMsg)
+		}
+	case net.TRU_REL_LOAD_REPORT:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_TRU_REL_LOAD_REPORT(typedMsg)
+		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
 
+	if msg != nil {
+		p.relayState.messageStatistics.AddMessage(reflect.TypeOf(msg).Name(), time.Since(start), err != nil)
+	}
+	if err != nil {
+		p.relayState.sessionSummary.AddError()
+	}
+
 	return err
 }
+
+// ShutdownReport returns the summary of the relay's session, as of now
+func (p *PriFiLibRelayInstance) ShutdownReport() *prifilog.ShutdownReport {
+	return p.relayState.sessionSummary.Report()
+}
+
+// State returns the current state of the relay, e.g. "COMMUNICATING"
+func (p *PriFiLibRelayInstance) State() string {
+	return p.stateMachine.State()
+}
+
+// AnnounceDrain tells the clients, in the next downstream control cell, that the relay shuts down at deadline
+func (p *PriFiLibRelayInstance) AnnounceDrain(deadline time.Time) error {
+	if p.stateMachine.State() != "COMMUNICATING" {
+		return errors.New("the relay is not communicating, cannot announce the drain")
+	}
+	select {
+	case p.relayState.PriorityDataForClients <- net.NewDrainAnnouncement(deadline):
+		relayLog.Lvl1("Relay : announced to the clients that we shut down at", deadline)
+		return nil
+	default:
+		return errors.New("the relay's control channel is full, cannot announce the drain")
+	}
+}
@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"github.com/dedis/prifi/prifi-lib/utils"
+)
+
+// RELAY_CELL_POOL_MAX_LEASED bounds the decoded cells in use at once, e.g. waiting in the egress queue, or being
+// written by the exit. Past that, the cells are allocated as usual.
+const RELAY_CELL_POOL_MAX_LEASED = 64
+
+// setupCellPool takes the decoded cells from a pool if they are large (file-transfer experiments), instead of
+// allocating one for each round. The decoded cell is passed by reference to the exit, which gives it back with
+// utils.ReleaseCell; if no one takes it, the relay gives it back itself. The disruption protection keeps the decoded
+// cells, the equivocation protection decodes into a new buffer, and super-rounds cut the cell in several payloads, so
+// none of them use the pool.
+func (p *PriFiLibRelayInstance) setupCellPool() {
+	p.closeCellPool()
+
+	cellSize := p.relayState.PayloadSize * p.relayState.CellsPerRound
+	if cellSize < utils.LARGE_CELL_SIZE || p.relayState.CellsPerRound > 1 ||
+		p.relayState.DisruptionProtectionEnabled || p.relayState.EquivocationProtectionEnabled {
+		return
+	}
+	pool := utils.NewCellPool(cellSize, RELAY_CELL_POOL_MAX_LEASED)
+	utils.RegisterCellPool(pool)
+	p.relayState.cellPool = pool
+	p.relayState.DCNet.UseCellPool(pool)
+	relayLog.Lvl2("Relay : cells of", cellSize, "bytes, the decoded cells are taken from a pool and passed by reference to the exit")
+}
+
+// releaseDecodedCell gives back a decoded cell which no one else took
+func (p *PriFiLibRelayInstance) releaseDecodedCell(cell []byte) {
+	if p.relayState.cellPool != nil {
+		p.relayState.cellPool.Release(cell)
+	}
+}
+
+// closeCellPool stops using the pool; the cells the exit still holds are then left to the garbage collector
+func (p *PriFiLibRelayInstance) closeCellPool() {
+	pool := p.relayState.cellPool
+	if pool == nil {
+		return
+	}
+	utils.UnregisterCellPool(pool)
+	p.relayState.cellPool = nil
+	allocations, reuses := pool.Stats()
+	relayLog.Lvl2("Relay : cell pool closed,", allocations, "cells allocated,", reuses, "reused")
+}
@@ -0,0 +1,54 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/utils"
+)
+
+func relayWithCells(payloadSize, cellsPerRound int, disruption bool) *PriFiLibRelayInstance {
+	p := &PriFiLibRelayInstance{relayState: &RelayState{
+		PayloadSize:                 payloadSize,
+		CellsPerRound:               cellsPerRound,
+		DisruptionProtectionEnabled: disruption,
+	}}
+	p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, payloadSize*cellsPerRound, false, nil)
+	return p
+}
+
+func TestSetupCellPool(t *testing.T) {
+	for _, p := range []*PriFiLibRelayInstance{
+		relayWithCells(1000, 1, false),
+		relayWithCells(utils.LARGE_CELL_SIZE, 2, false),
+		relayWithCells(utils.LARGE_CELL_SIZE, 1, true),
+	} {
+		p.setupCellPool()
+		if p.relayState.cellPool != nil {
+			t.Error("No pool for small cells, super-rounds or the disruption protection")
+		}
+	}
+
+	p := relayWithCells(utils.LARGE_CELL_SIZE, 1, false)
+	p.setupCellPool()
+	pool := p.relayState.cellPool
+	if pool == nil {
+		t.Fatal("Large cells should be taken from a pool")
+	}
+
+	// the exit releases the decoded cells it receives, the relay the ones no one took
+	p.relayState.DCNet.DecodeStart(0)
+	forExit, _ := p.relayState.DCNet.DecodeCell(false)
+	p.relayState.DCNet.DecodeStart(1)
+	unused, _ := p.relayState.DCNet.DecodeCell(false)
+	p.releaseDecodedCell(unused)
+	utils.ReleaseCell(forExit)
+	if pool.Leased() != 0 {
+		t.Error("All the decoded cells should be back in the pool", pool.Leased())
+	}
+
+	p.closeCellPool()
+	if p.relayState.cellPool != nil {
+		t.Error("The pool should be closed")
+	}
+}
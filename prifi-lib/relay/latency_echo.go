@@ -0,0 +1,65 @@
+package relay
+
+/*
+The relay echoes the latency probes of the clients (see client/latency_tester.go) : a decoded upstream payload starting
+with prifilog.LATENCY_PROBE_PATTERN is sent back as is, before any other data, in the next round the relay opens. The
+probes may be encrypted, so the relay does not read them; it only measures its own share of their round-trip time,
+from the decoding of a probe to the end of the round which echoed it (PROBE_ECHO). The rate controller, if any, adjusts
+the window and the pacing to these measures.
+*/
+
+import (
+	"encoding/binary"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+// PROBE_ECHO is the time statistic of the probes, from their decoding to the end of the round which echoed them
+const PROBE_ECHO = "probe-echo"
+
+// isLatencyProbe tells if a decoded upstream payload is a latency probe
+func isLatencyProbe(payload []byte) bool {
+	return len(payload) >= 2 && binary.BigEndian.Uint16(payload[0:2]) == prifilog.LATENCY_PROBE_PATTERN
+}
+
+// echoLatencyProbe queues a probe decoded in the current round, to be sent back in the next round opened
+func (p *PriFiLibRelayInstance) echoLatencyProbe(probe []byte) {
+	if p.relayState.cellPool != nil {
+		probe = append([]byte(nil), probe...) // the decoded cell also goes to the exit, which releases it
+	}
+	p.relayState.PriorityDataForClients <- probe
+	p.relayState.latencyProbesReceivedAt = append(p.relayState.latencyProbesReceivedAt, time.Now())
+}
+
+// latencyProbeSent is called when roundID is opened with priority data; if it is a probe, the round is the one which
+// echoes it
+func (p *PriFiLibRelayInstance) latencyProbeSent(roundID int32, data []byte) {
+	if !isLatencyProbe(data) || len(p.relayState.latencyProbesReceivedAt) == 0 {
+		return
+	}
+	p.relayState.latencyProbesRounds[roundID] = p.relayState.latencyProbesReceivedAt[0]
+	p.relayState.latencyProbesReceivedAt = p.relayState.latencyProbesReceivedAt[1:]
+}
+
+// latencyProbeEchoed records the echo time of the probe sent in roundID, if any, and feeds it to the rate controller,
+// which applies its new window and pacing. The round is over, so the clients received the echo.
+func (p *PriFiLibRelayInstance) latencyProbeEchoed(roundID int32) {
+	probeReceivedAt, found := p.relayState.latencyProbesRounds[roundID]
+	if !found {
+		return
+	}
+	delete(p.relayState.latencyProbesRounds, roundID)
+	echoMs := time.Since(probeReceivedAt).Nanoseconds() / 1e6
+	p.relayState.timeStatistics[PROBE_ECHO].AddTime(echoMs)
+	if p.relayState.rateController == nil {
+		return
+	}
+
+	if p.relayState.rateController.AddSample(echoMs) {
+		p.relayState.WindowSize = p.relayState.rateController.Window()
+		p.relayState.roundManager.SetWindowSize(p.relayState.WindowSize)
+		p.relayState.ProcessingLoopSleepTime = int(p.relayState.rateController.SleepTime() / time.Millisecond)
+		p.relayState.pacer.setMinInterval(p.relayState.rateController.SleepTime())
+	}
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+func TestLatencyEcho(t *testing.T) {
+	p := &PriFiLibRelayInstance{relayState: &RelayState{
+		PriorityDataForClients:  make(chan []byte, 10),
+		latencyProbesReceivedAt: make([]time.Time, 0),
+		latencyProbesRounds:     make(map[int32]time.Time),
+		timeStatistics:          map[string]*prifilog.TimeStatistics{PROBE_ECHO: prifilog.NewTimeStatistics()},
+	}}
+
+	probe := make([]byte, 20)
+	binary.BigEndian.PutUint16(probe[0:2], prifilog.LATENCY_PROBE_PATTERN)
+	if !isLatencyProbe(probe) || isLatencyProbe(probe[0:1]) || isLatencyProbe(make([]byte, 20)) {
+		t.Error("Only the payloads starting with the pattern are probes")
+	}
+
+	p.echoLatencyProbe(probe)
+	echo := <-p.relayState.PriorityDataForClients
+	if len(echo) != len(probe) || binary.BigEndian.Uint16(echo[0:2]) != prifilog.LATENCY_PROBE_PATTERN {
+		t.Fatal("The probe should be echoed as is")
+	}
+
+	// other priority data (e.g. a drain announcement) does not take the time of the probe
+	p.latencyProbeSent(7, []byte{1, 2, 3})
+	p.latencyProbeSent(8, echo)
+	if _, found := p.relayState.latencyProbesRounds[7]; found {
+		t.Error("Round 7 does not echo a probe")
+	}
+	if _, found := p.relayState.latencyProbesRounds[8]; !found || len(p.relayState.latencyProbesReceivedAt) != 0 {
+		t.Fatal("Round 8 should echo the probe")
+	}
+
+	p.latencyProbeEchoed(7)
+	p.latencyProbeEchoed(8)
+	if n := p.relayState.timeStatistics[PROBE_ECHO].Histogram().Count(); n != 1 {
+		t.Error("Expected one echo time, got", n)
+	}
+	if len(p.relayState.latencyProbesRounds) != 0 {
+		t.Error("The echoed round should be forgotten")
+	}
+}
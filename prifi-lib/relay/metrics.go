@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// METRICS_PATH is where the relay's processing statistics are exported, in the Prometheus text format
+const METRICS_PATH = "/metrics"
+
+// DIAGNOSTICS_PATH is where the diagnostics of the last stalled rounds are exported, in JSON
+const DIAGNOSTICS_PATH = "/diagnostics"
+
+// LOG_LEVELS_PATH is where the log levels of the modules are shown (GET) and changed (POST, e.g. scheduler=4 or
+// dcnet=global). The changes are only accepted from the relay's host
+const LOG_LEVELS_PATH = "/loglevels"
+
+// METRICS_PREFIX is prepended to the name of each exported metric
+const METRICS_PREFIX = "prifi_relay"
+
+// startMetricsServer serves the per-message-type processing statistics, the availability of each entity, the bitrates,
+// the payloads rebuilt by the payload transform and the histograms of the time statistics on addr, the diagnostics of
+// the last stalled rounds, the signed summaries of the last epochs, the signed evidence of the last blames, the journal
+// of the last rounds, and the status of the relay. An empty addr disables the endpoint. It also lets the operator change the log level of each
+// module at runtime, from the relay's host.
+func (p *PriFiLibRelayInstance) startMetricsServer(addr string) {
+	p.stopMetricsServer()
+	if addr == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error("Relay : could not start the metrics endpoint on", addr, err)
+		return
+	}
+
+	stats := p.relayState.messageStatistics
+	availability := p.relayState.availabilityStatistics
+	timeStatistics := p.relayState.timeStatistics
+	setupStatistics := p.relayState.setupStatistics
+	egressQueue := p.relayState.egressQueue
+	rateController := p.relayState.rateController
+	pacer := p.relayState.pacer
+	bandwidthCap := p.relayState.bandwidthCap
+	delivery := p.relayState.delivery
+	historyCheck := p.relayState.historyCheck
+	trusteeLoads := p.relayState.trusteeLoads
+	anonymity := p.relayState.anonymityStatistics
+	bitrate := p.relayState.bitrateStatistics
+	payloadTransform := p.relayState.payloadTransformStatistics
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := stats.WritePrometheus(w, METRICS_PREFIX); err != nil {
+			return
+		}
+		if err := availability.WritePrometheus(w, METRICS_PREFIX); err != nil {
+			return
+		}
+		if egressQueue != nil {
+			egressQueue.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if rateController != nil {
+			rateController.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if pacer != nil {
+			pacer.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if bandwidthCap != nil {
+			bandwidthCap.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if delivery != nil {
+			delivery.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if historyCheck != nil {
+			historyCheck.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if trusteeLoads != nil {
+			trusteeLoads.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if anonymity != nil {
+			anonymity.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if bitrate != nil {
+			bitrate.WritePrometheus(w, METRICS_PREFIX)
+		}
+		if payloadTransform != nil {
+			payloadTransform.WritePrometheus(w, METRICS_PREFIX)
+		}
+		prifilog.WriteTimeStatisticsPrometheus(w, METRICS_PREFIX, timeStatistics)
+		setupStatistics.WritePrometheus(w, METRICS_PREFIX)
+	})
+	mux.HandleFunc(DIAGNOSTICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Entities      []prifilog.EntityAvailability
+			StalledRounds []prifilog.StalledRoundDiagnostic
+		}{availability.Snapshot(), availability.Diagnostics()})
+	})
+
+	summaries := p.relayState.epochSummaries
+	mux.HandleFunc(EPOCHS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries.list())
+	})
+	evidences := p.relayState.blameEvidences
+	mux.HandleFunc(BLAME_EVIDENCE_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(evidences.list())
+	})
+	mux.HandleFunc(ROUND_JOURNAL_PATH, p.relayState.roundJournal.serve)
+	mux.HandleFunc(STATUS_PATH, p.statusHandler())
+	mux.HandleFunc(LOG_LEVELS_PATH, serveLogLevels)
+
+	server := &http.Server{Handler: mux}
+	p.relayState.metricsServer = server
+	relayLog.Lvl1("Relay : exporting processing statistics on", listener.Addr().String()+METRICS_PATH)
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("Relay : metrics endpoint stopped;", err)
+		}
+	}()
+}
+
+// serveLogLevels shows the log level of each module, after applying the changes given in a POST: module=level, or
+// module=global to use the global level again. A higher level can write the contents and timings of the rounds to the
+// logs, so the changes are refused unless they come from the loopback; anyone reaching the endpoint can read them.
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !fromLoopback(r) {
+			log.Lvl2("Relay : refused a change of the log levels from", r.RemoteAddr)
+			http.Error(w, "the log levels can only be changed from the relay's host", http.StatusForbidden)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes := make(map[string]int)
+		for module, values := range r.PostForm {
+			value := values[len(values)-1]
+			if value == "global" {
+				changes[module] = -1
+				continue
+			}
+			lvl, err := strconv.Atoi(value)
+			if err != nil || lvl < 0 {
+				http.Error(w, "log level of module "+module+" should be between 0 and 5, or \"global\", is \""+value+"\"", http.StatusBadRequest)
+				return
+			}
+			changes[module] = lvl
+		}
+		if err := prifilog.UpdateModuleLevels(changes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Lvl1("Relay : log levels of the modules changed to \"" + prifilog.ModuleLevelsString() + "\"")
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Global    int
+		Modules   map[string]int
+		Overrides string
+	}{log.DebugVisible(), prifilog.EffectiveModuleLevels(), prifilog.ModuleLevelsString()})
+}
+
+// fromLoopback returns true if r comes from the relay's host
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// stopMetricsServer stops the metrics endpoint, if any
+func (p *PriFiLibRelayInstance) stopMetricsServer() {
+	if p.relayState.metricsServer != nil {
+		p.relayState.metricsServer.Close()
+		p.relayState.metricsServer = nil
+	}
+}
@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestServeLogLevels(t *testing.T) {
+	defer prifilog.SetModuleLevels("")
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, LOG_LEVELS_PATH, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "127.0.0.1:40000"
+		w := httptest.NewRecorder()
+		serveLogLevels(w, req)
+		return w
+	}
+
+	w := post(url.Values{"scheduler": {"4"}, "dcnet": {"1"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("The change should be accepted, got", w.Code, w.Body.String())
+	}
+	var levels struct {
+		Modules   map[string]int
+		Overrides string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&levels); err != nil {
+		t.Fatal(err)
+	}
+	if levels.Overrides != "dcnet=1,scheduler=4" || levels.Modules["scheduler"] != 4 {
+		t.Error("Wrong levels", levels)
+	}
+
+	if w := post(url.Values{"dcnet": {"global"}}); w.Code != http.StatusOK || prifilog.ModuleLevelsString() != "scheduler=4" {
+		t.Error("dcnet should use the global level again, levels are", prifilog.ModuleLevelsString())
+	}
+	for _, form := range []url.Values{{"scheduler": {"x"}}, {"scheduler": {"9"}}, {"sched": {"2"}}} {
+		if w := post(form); w.Code != http.StatusBadRequest {
+			t.Error("Change", form, "should be refused, got", w.Code)
+		}
+	}
+	if prifilog.ModuleLevelsString() != "scheduler=4" {
+		t.Error("Refused changes should not change the levels, are", prifilog.ModuleLevelsString())
+	}
+
+	// from another host, the levels can be read but not changed
+	for _, remote := range []string{"192.0.2.1:40000", "[2001:db8::1]:40000", "not an address"} {
+		req := httptest.NewRequest(http.MethodPost, LOG_LEVELS_PATH, strings.NewReader("scheduler=5"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		serveLogLevels(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Error("A change from", remote, "should be refused, got", w.Code)
+		}
+	}
+	if prifilog.ModuleLevelsString() != "scheduler=4" {
+		t.Error("A change from another host should not change the levels, are", prifilog.ModuleLevelsString())
+	}
+	req := httptest.NewRequest(http.MethodGet, LOG_LEVELS_PATH, nil)
+	w = httptest.NewRecorder()
+	serveLogLevels(w, req)
+	if w.Code != http.StatusOK {
+		t.Error("The levels should be readable from another host, got", w.Code)
+	}
+}
+
+func TestRelayStatus(t *testing.T) {
+	timeoutHandler := func(clients, trustees []int) {}
+	msw := newTestMessageSenderWrapper(new(TestMessageSender))
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 10), timeoutHandler, msw)
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 3)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("WindowSize", 2)
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+	rs := relay.relayState
+	rs.roundManager.OpenNextRound()
+	rs.timeStatistics["round-duration"].AddTime(10)
+	rs.timeStatistics["round-duration"].AddTime(30)
+	rs.availabilityStatistics.Seen("client", 1)
+
+	w := httptest.NewRecorder()
+	relay.statusHandler()(w, httptest.NewRequest(http.MethodGet, STATUS_PATH, nil))
+	var status RelayStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != relay.stateMachine.State() || status.Clients != 3 || status.Trustees != 1 {
+		t.Error("Wrong state or group", status)
+	}
+	if status.CurrentRound != 0 || status.OpenRounds != 1 || status.WindowSize != 2 {
+		t.Error("Wrong window", status.WindowStatus)
+	}
+	if s := status.TimesMs["round-duration"]; s.Count != 2 || s.Mean != 20 || s.Max != 30 {
+		t.Error("Wrong round durations", s)
+	}
+	if _, found := status.SetupTimes["total"]; !found {
+		t.Error("The status should have the setup durations", status.SetupTimes)
+	}
+	if len(status.Entities) != 1 || status.Entities[0].Kind != "client" || status.Entities[0].ID != 1 {
+		t.Error("Wrong entities", status.Entities)
+	}
+}
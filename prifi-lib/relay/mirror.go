@@ -0,0 +1,104 @@
+//go:build mirror
+// +build mirror
+
+package relay
+
+/*
+The mirror sink copies the decoded upstream payloads of the relay to a file or a UNIX socket, for the analysis tools
+of an experiment (e.g., a traffic classifier fed with what leaves the DC-net). It breaks the point of running a relay
+for anyone but the experimenter, so it is only compiled in with the "mirror" build tag, and only used when the
+deployment also enables the "mirror" feature flag.
+
+Each payload is written as a record : the round ID (4 bytes), the length of the payload (4 bytes), both big-endian,
+then the payload. The records are written by a separate goroutine; if the sink is slower than the DC-net, records are
+dropped rather than slowing the rounds down, and counted.
+*/
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// MIRROR_SINK_AVAILABLE is true if the relay was built with the "mirror" build tag
+const MIRROR_SINK_AVAILABLE = true
+
+// MIRROR_SINK_QUEUE is how many records can wait for the sink before they are dropped
+const MIRROR_SINK_QUEUE = 1024
+
+type mirrorSink struct {
+	target  string
+	w       io.WriteCloser
+	records chan []byte
+	done    chan bool
+	dropped int64
+	written int64
+}
+
+// newMirrorSink opens target, which is either "unix:<path>" for a UNIX socket, or the path of a file the records are appended to
+func newMirrorSink(target string) (*mirrorSink, error) {
+	var w io.WriteCloser
+	var err error
+	if strings.HasPrefix(target, "unix:") {
+		w, err = net.Dial("unix", strings.TrimPrefix(target, "unix:"))
+	} else {
+		w, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mirrorSink{
+		target:  target,
+		w:       w,
+		records: make(chan []byte, MIRROR_SINK_QUEUE),
+		done:    make(chan bool),
+	}
+	go m.writeRecords()
+	return m, nil
+}
+
+// Mirror queues a copy of the payload decoded in roundID, or drops it if the queue is full
+func (m *mirrorSink) Mirror(roundID int32, payload []byte) {
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(roundID))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(payload)))
+	copy(record[8:], payload)
+
+	select {
+	case m.records <- record:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+// Close writes the queued records, and closes the sink
+func (m *mirrorSink) Close() {
+	close(m.records)
+	<-m.done
+	relayLog.Lvl2("Relay : mirror sink", m.target, "closed,", atomic.LoadInt64(&m.written), "payloads written,", atomic.LoadInt64(&m.dropped), "dropped")
+}
+
+func (m *mirrorSink) writeRecords() {
+	failed := false
+	for record := range m.records {
+		if failed {
+			atomic.AddInt64(&m.dropped, 1)
+			continue
+		}
+		if _, err := m.w.Write(record); err != nil {
+			log.Error("Relay : could not write to the mirror sink", m.target, ", dropping the next payloads;", err)
+			failed = true
+			atomic.AddInt64(&m.dropped, 1)
+			continue
+		}
+		atomic.AddInt64(&m.written, 1)
+	}
+	m.w.Close()
+	close(m.done)
+}
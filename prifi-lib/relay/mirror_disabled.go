@@ -0,0 +1,20 @@
+//go:build !mirror
+// +build !mirror
+
+package relay
+
+import "errors"
+
+// MIRROR_SINK_AVAILABLE is true if the relay was built with the "mirror" build tag
+const MIRROR_SINK_AVAILABLE = false
+
+// mirrorSink is not compiled in the production builds, see mirror.go
+type mirrorSink struct{}
+
+func newMirrorSink(target string) (*mirrorSink, error) {
+	return nil, errors.New("this relay was built without the \"mirror\" build tag, it cannot mirror the decoded traffic")
+}
+
+func (m *mirrorSink) Mirror(roundID int32, payload []byte) {}
+
+func (m *mirrorSink) Close() {}
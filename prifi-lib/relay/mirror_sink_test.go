@@ -0,0 +1,72 @@
+//go:build mirror
+// +build mirror
+
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorSinkFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror")
+	m, err := newMirrorSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Mirror(7, []byte{1, 2, 3})
+	m.Mirror(8, []byte{})
+	m.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0, 7, 0, 0, 0, 3, 1, 2, 3, 0, 0, 0, 8, 0, 0, 0, 0}
+	if !bytes.Equal(b, expected) {
+		t.Error("wrong records", b)
+	}
+	if m.written != 2 || m.dropped != 0 {
+		t.Error("wrong counts", m.written, m.dropped)
+	}
+}
+
+func TestMirrorSinkUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	m, err := newMirrorSink("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{0xAB}, 1000)
+	m.Mirror(42, payload)
+	m.Close()
+
+	b := <-received
+	if len(b) != 1008 || binary.BigEndian.Uint32(b[0:4]) != 42 || binary.BigEndian.Uint32(b[4:8]) != 1000 || !bytes.Equal(b[8:], payload) {
+		t.Error("wrong record received on the socket", len(b))
+	}
+
+	if _, err := newMirrorSink("unix:" + filepath.Join(t.TempDir(), "none.sock")); err == nil {
+		t.Error("should not open a socket nobody listens on")
+	}
+}
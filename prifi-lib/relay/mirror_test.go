@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestMirrorSinkParameters(t *testing.T) {
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 10), timeoutHandler,
+		newTestMessageSenderWrapper(new(TestMessageSender)))
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1000)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayMirrorSink", filepath.Join(t.TempDir(), "mirror"))
+
+	err := relay.ReceivedMessage(*msg)
+	if err == nil || !strings.Contains(err.Error(), "feature flag") {
+		t.Fatal("the mirror sink should need the feature flag, got", err)
+	}
+
+	msg.Add("FeatureFlags", "mirror")
+	err = relay.ReceivedMessage(*msg)
+	if MIRROR_SINK_AVAILABLE {
+		if err != nil || relay.relayState.mirrorSink == nil {
+			t.Error("the mirror sink should be open,", err)
+		}
+		relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+		if relay.relayState.mirrorSink != nil {
+			t.Error("the mirror sink should be closed at shutdown")
+		}
+	} else if err == nil || !strings.Contains(err.Error(), "build tag") {
+		t.Error("a relay built without the mirror should refuse to start,", err)
+	}
+}
@@ -0,0 +1,151 @@
+package relay
+
+/*
+The pacing spaces the rounds of the relay : with RelayTargetRoundRate > 0, a round starts at most every
+1/RelayTargetRoundRate seconds. After a round, the relay only sleeps for what is left of the interval once the time
+spent in the round is subtracted, so the rounds do not get slower than the target because of the sleep; a round late
+by less than an interval is compensated by the next ones, and a round later than that is not, so that the relay does
+not burst to catch up after a stall. Without a target rate (0, the default), the relay never sleeps and runs as fast as
+the participants allow. RelayProcessingLoopSleepTime, if > 0, is a minimum interval between the rounds, as is the
+pacing of the RoundRateController.
+*/
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// PACER_RATE_WINDOW is the number of rounds over which the achieved round rate is computed
+const PACER_RATE_WINDOW = 100
+
+// PACER_REPORT_PERIOD is how often the pacing is reported with the other statistics
+const PACER_REPORT_PERIOD = 5 * time.Second
+
+// roundPacer computes the sleep between the rounds, and measures the round rate the relay achieves
+type roundPacer struct {
+	sync.Mutex
+	targetRate  int           // rounds per second, 0 if not paced
+	minInterval time.Duration // RelayProcessingLoopSleepTime, or the pacing of the RoundRateController
+	next        time.Time     // when the next round may start; zero before the first round
+
+	roundEnds  []time.Time // the last PACER_RATE_WINDOW rounds
+	slept      time.Duration
+	nextReport time.Time
+}
+
+// newRoundPacer returns a pacer targeting targetRate rounds per second (0 : as fast as possible), with at least
+// minInterval between two rounds
+func newRoundPacer(targetRate int, minInterval time.Duration) *roundPacer {
+	if targetRate < 0 {
+		targetRate = 0
+	}
+	return &roundPacer{
+		targetRate:  targetRate,
+		minInterval: minInterval,
+		roundEnds:   make([]time.Time, 0, PACER_RATE_WINDOW),
+		nextReport:  time.Now().Add(PACER_REPORT_PERIOD),
+	}
+}
+
+// interval returns the time between the start of two rounds, 0 if the rounds are not paced
+func (r *roundPacer) interval() time.Duration {
+	interval := time.Duration(0)
+	if r.targetRate > 0 {
+		interval = time.Second / time.Duration(r.targetRate)
+	}
+	if r.minInterval > interval {
+		interval = r.minInterval
+	}
+	return interval
+}
+
+// setMinInterval changes the minimum interval between two rounds, e.g. when the RoundRateController adjusts it
+func (r *roundPacer) setMinInterval(minInterval time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.minInterval = minInterval
+}
+
+// roundDone records that a round ended at now, and returns how long to wait before starting the next one
+func (r *roundPacer) roundDone(now time.Time) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.roundEnds) == PACER_RATE_WINDOW {
+		r.roundEnds = r.roundEnds[1:]
+	}
+	r.roundEnds = append(r.roundEnds, now)
+
+	interval := r.interval()
+	if interval <= 0 {
+		r.next = time.Time{}
+		return 0
+	}
+	if r.next.IsZero() || r.next.Before(now.Add(-interval)) {
+		// first round, or late by more than an interval : we do not catch up
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	r.next = r.next.Add(interval)
+	r.slept += wait
+	return wait
+}
+
+// achievedRate returns the number of rounds per second over the last PACER_RATE_WINDOW rounds, 0 if unknown
+func (r *roundPacer) achievedRate() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.achievedRateLocked()
+}
+
+func (r *roundPacer) achievedRateLocked() float64 {
+	if len(r.roundEnds) < 2 {
+		return 0
+	}
+	elapsed := r.roundEnds[len(r.roundEnds)-1].Sub(r.roundEnds[0])
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(len(r.roundEnds)-1) / elapsed.Seconds()
+}
+
+// report returns the target and the achieved round rate every PACER_REPORT_PERIOD, "" in between
+func (r *roundPacer) report(now time.Time) string {
+	r.Lock()
+	defer r.Unlock()
+	if now.Before(r.nextReport) {
+		return ""
+	}
+	r.nextReport = now.Add(PACER_REPORT_PERIOD)
+
+	target := "none"
+	if interval := r.interval(); interval > 0 {
+		target = fmt.Sprintf("%0.1f round/sec", float64(time.Second)/float64(interval))
+	}
+	return fmt.Sprintf("Pacing: target %v, achieved %0.1f round/sec, slept %v ms", target, r.achievedRateLocked(),
+		r.slept.Nanoseconds()/1e6)
+}
+
+// WritePrometheus writes the target and achieved round rates, in the Prometheus text format
+func (r *roundPacer) WritePrometheus(w io.Writer, prefix string) error {
+	r.Lock()
+	target := 0.0
+	if interval := r.interval(); interval > 0 {
+		target = float64(time.Second) / float64(interval)
+	}
+	achieved, slept := r.achievedRateLocked(), r.slept.Seconds()
+	r.Unlock()
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_round_rate_target gauge\n%s_round_rate_target %v\n", prefix, prefix, target)
+	fmt.Fprintf(w, "# TYPE %s_round_rate gauge\n%s_round_rate %v\n", prefix, prefix, achieved)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# TYPE %s_pacing_sleep_seconds_total counter\n%s_pacing_sleep_seconds_total %v\n", prefix, prefix, slept)
+	return err
+}
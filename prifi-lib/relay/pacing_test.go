@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundPacer(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	r := newRoundPacer(0, 0)
+	for i := 0; i < 10; i++ {
+		if wait := r.roundDone(at(i)); wait != 0 {
+			t.Error("Without a target rate, the relay should never sleep, got", wait)
+		}
+	}
+
+	// 10 rounds per second : the time spent in the round is subtracted from the interval
+	r = newRoundPacer(10, 0)
+	if wait := r.roundDone(at(0)); wait != 0 {
+		t.Error("The first round should not wait, got", wait)
+	}
+	if wait := r.roundDone(at(30)); wait != 70*time.Millisecond {
+		t.Error("A round of 30 ms should wait 70 ms, got", wait)
+	}
+	// the next round may start at 100 ms; it ends at 250 ms, late by 50 ms, which the next one compensates
+	if wait := r.roundDone(at(250)); wait != 0 {
+		t.Error("A late round should not wait, got", wait)
+	}
+	if wait := r.roundDone(at(260)); wait != 40*time.Millisecond {
+		t.Error("The round after a late one should start at 300 ms, waits", wait)
+	}
+	// a stall of more than an interval is not caught up
+	if wait := r.roundDone(at(1000)); wait != 0 {
+		t.Error("A stalled round should not wait, got", wait)
+	}
+	if wait := r.roundDone(at(1010)); wait != 90*time.Millisecond {
+		t.Error("After a stall, the rounds should not burst, waits", wait)
+	}
+
+	// the minimum interval (RelayProcessingLoopSleepTime, or the RoundRateController) wins if it is slower
+	r = newRoundPacer(10, 500*time.Millisecond)
+	r.roundDone(at(0))
+	if wait := r.roundDone(at(100)); wait != 400*time.Millisecond {
+		t.Error("The minimum interval should space the rounds by 500 ms, waits", wait)
+	}
+	r.setMinInterval(0)
+	if wait := r.roundDone(at(1050)); wait != 0 {
+		t.Error("The round which may start at 1000 ms ended at 1050 ms, it should not wait, got", wait)
+	}
+	if wait := r.roundDone(at(1060)); wait != 40*time.Millisecond {
+		t.Error("Without the minimum interval, the target rate should apply again, waits", wait)
+	}
+}
+
+func TestRoundPacerStatistics(t *testing.T) {
+	start := time.Now()
+	r := newRoundPacer(100, 0)
+	if r.achievedRate() != 0 {
+		t.Error("The rate should be unknown before two rounds")
+	}
+	for i := 0; i <= PACER_RATE_WINDOW+10; i++ {
+		r.roundDone(start.Add(time.Duration(i) * 20 * time.Millisecond))
+	}
+	if rate := r.achievedRate(); rate < 49.9 || rate > 50.1 {
+		t.Error("A round every 20 ms is 50 rounds per second, got", rate)
+	}
+
+	if r.report(start) != "" {
+		t.Error("The pacing should be reported every", PACER_REPORT_PERIOD)
+	}
+	report := r.report(start.Add(PACER_REPORT_PERIOD + time.Second))
+	if !strings.Contains(report, "target 100.0 round/sec") || !strings.Contains(report, "achieved 50.0 round/sec") {
+		t.Error("Wrong report", report)
+	}
+
+	var b bytes.Buffer
+	if err := r.WritePrometheus(&b, "prifi_relay"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "prifi_relay_round_rate_target 100\n") || !strings.Contains(b.String(), "prifi_relay_round_rate 50") {
+		t.Error("Wrong metrics", b.String())
+	}
+}
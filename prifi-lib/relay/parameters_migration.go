@@ -0,0 +1,198 @@
+package relay
+
+/*
+Parameters migration lets the operator change some parameters (net.MIGRATABLE_PARAMETERS: window size, downstream cell
+size, timeouts, rate limits) during a session, without restarting the protocol. It is a two-phase protocol :
+- the operator injects a REL_REL_PROPOSE_PARAMETERS in the relay, which proposes the new values for the next
+  parameters epoch (REL_ALL_PARAMETERS_PROPOSAL) to all clients and trustees;
+- once all of them accepted (*_REL_PARAMETERS_ACK), the relay activates the new values, between two rounds, and tells
+  everybody (REL_ALL_PARAMETERS_ACTIVATE).
+If anybody refuses, the proposal is dropped. A new proposal replaces the pending one, with a new epoch. The changes last until the
+protocol restarts, which uses the parameters of prifi.toml again.
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// parametersProposal is a proposal waiting for the acks of the clients and trustees
+type parametersProposal struct {
+	epoch       int32
+	params      map[string]int
+	clientAcks  map[int]bool
+	trusteeAcks map[int]bool
+}
+
+// Received_REL_REL_PROPOSE_PARAMETERS validates the new values, and proposes them to all clients and trustees
+func (p *PriFiLibRelayInstance) Received_REL_REL_PROPOSE_PARAMETERS(msg net.REL_REL_PROPOSE_PARAMETERS) error {
+	if err := p.validateParameters(msg.ParamsInt); err != nil {
+		e := "Relay : refusing the parameters change; " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	// epochs are never reused, so that the late acks of a replaced or refused proposal cannot be counted
+	if p.relayState.pendingParameters != nil {
+		relayLog.Lvl1("Relay : the parameters change for epoch", p.relayState.pendingParameters.epoch, "is replaced by a new proposal")
+	}
+	p.relayState.lastProposedParametersEpoch++
+	epoch := p.relayState.lastProposedParametersEpoch
+
+	params := make(map[string]int, len(msg.ParamsInt))
+	for k, v := range msg.ParamsInt {
+		params[k] = v
+	}
+	p.relayState.pendingParameters = &parametersProposal{
+		epoch:       epoch,
+		params:      params,
+		clientAcks:  make(map[int]bool),
+		trusteeAcks: make(map[int]bool),
+	}
+
+	relayLog.Lvl1("Relay : proposing parameters", params, "for epoch", epoch)
+	toSend := &net.REL_ALL_PARAMETERS_PROPOSAL{Epoch: epoch, ParamsInt: params}
+	for i := 0; i < p.relayState.nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			p.messageSender.SendToClientWithLog(i, toSend, "")
+		}
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "")
+	}
+	return nil
+}
+
+// validateParameters checks that the parameters can be migrated, and that the new values are consistent
+func (p *PriFiLibRelayInstance) validateParameters(params map[string]int) error {
+	if len(params) == 0 {
+		return errors.New("no parameters to change")
+	}
+	for k, v := range params {
+		if !net.IsMigratableParameter(k) {
+			return errors.New("parameter " + k + " cannot be changed during a session")
+		}
+		if v < 1 && k != "RelayTrusteeCacheLowBound" {
+			return errors.New("parameter " + k + " must be positive, is " + strconv.Itoa(v))
+		}
+		if v < 0 {
+			return errors.New("parameter " + k + " cannot be negative, is " + strconv.Itoa(v))
+		}
+	}
+
+	low := p.relayState.TrusteeCacheLowBound
+	if v, ok := params["RelayTrusteeCacheLowBound"]; ok {
+		low = v
+	}
+	high := p.relayState.TrusteeCacheHighBound
+	if v, ok := params["RelayTrusteeCacheHighBound"]; ok {
+		high = v
+	}
+	if low > high {
+		return errors.New("RelayTrusteeCacheLowBound (" + strconv.Itoa(low) + ") is larger than RelayTrusteeCacheHighBound (" + strconv.Itoa(high) + ")")
+	}
+	return nil
+}
+
+// Received_CLI_REL_PARAMETERS_ACK records the answer of a client to the pending proposal
+func (p *PriFiLibRelayInstance) Received_CLI_REL_PARAMETERS_ACK(msg net.CLI_REL_PARAMETERS_ACK) error {
+	return p.receivedParametersAck("Client", msg.ClientID, msg.Epoch, msg.Accepted)
+}
+
+// Received_TRU_REL_PARAMETERS_ACK records the answer of a trustee to the pending proposal
+func (p *PriFiLibRelayInstance) Received_TRU_REL_PARAMETERS_ACK(msg net.TRU_REL_PARAMETERS_ACK) error {
+	return p.receivedParametersAck("Trustee", msg.TrusteeID, msg.Epoch, msg.Accepted)
+}
+
+func (p *PriFiLibRelayInstance) receivedParametersAck(entity string, id int, epoch int32, accepted bool) error {
+	proposal := p.relayState.pendingParameters
+	if proposal == nil || proposal.epoch != epoch {
+		relayLog.Lvl2("Relay : ignoring the parameters ack of", entity, id, "for epoch", epoch, "(not pending)")
+		return nil
+	}
+
+	if !accepted {
+		log.Error("Relay :", entity, id, "refused the parameters of epoch", epoch, ", dropping the proposal")
+		p.relayState.pendingParameters = nil
+		return nil
+	}
+	if entity == "Client" && p.relayState.clientsLeft[id] {
+		relayLog.Lvl2("Relay : ignoring the parameters ack of client", id, ", it left the session")
+		return nil
+	}
+	if entity == "Client" {
+		proposal.clientAcks[id] = true
+	} else {
+		proposal.trusteeAcks[id] = true
+	}
+
+	if len(proposal.clientAcks) == p.nActiveClients() && len(proposal.trusteeAcks) == p.relayState.nTrustees {
+		p.activateParameters(proposal)
+	}
+	return nil
+}
+
+// activateParameters starts using the parameters of the proposal, which everybody accepted. We are between two
+// rounds (we hold the processing lock), so the in-flight rounds keep going; a smaller window simply prevents opening
+// new rounds until enough are closed.
+func (p *PriFiLibRelayInstance) activateParameters(proposal *parametersProposal) {
+	for k, v := range proposal.params {
+		switch k {
+		case "WindowSize":
+			p.relayState.WindowSize = v
+			p.relayState.roundManager.SetWindowSize(v)
+			if p.relayState.rateController != nil {
+				p.relayState.rateController.SetWindow(v)
+			}
+		case "DownstreamCellSize":
+			p.relayState.DownstreamCellSize = v
+			p.applyBandwidthCap() // only shrinks the cells, the upstream fitted already
+		case "RelayRoundTimeOut":
+			p.relayState.RoundTimeOut = v
+		case "RelayTrusteeCacheLowBound":
+			p.relayState.TrusteeCacheLowBound = v
+		case "RelayTrusteeCacheHighBound":
+			p.relayState.TrusteeCacheHighBound = v
+		case "RelayMaxNumberOfConsecutiveFailedRounds":
+			p.relayState.MaxNumberOfConsecutiveFailedRounds = v
+		}
+	}
+	// validated in Received_REL_REL_PROPOSE_PARAMETERS, cannot fail
+	p.relayState.roundManager.SetRateLimiterBounds(p.relayState.TrusteeCacheLowBound, p.relayState.TrusteeCacheHighBound)
+	p.relayState.parametersEpoch = proposal.epoch
+	p.relayState.pendingParameters = nil
+
+	round := p.relayState.roundManager.lastRoundClosed
+	relayLog.Lvl1("Relay : activated parameters", proposal.params, "for epoch", proposal.epoch, "after round", round)
+	p.collectExperimentResult("ParametersEpoch " + strconv.Itoa(int(proposal.epoch)) + " (after round " + strconv.Itoa(int(round)) + "): " + paramsToString(proposal.params))
+
+	toSend := &net.REL_ALL_PARAMETERS_ACTIVATE{Epoch: proposal.epoch}
+	for i := 0; i < p.relayState.nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			p.messageSender.SendToClientWithLog(i, toSend, "")
+		}
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "")
+	}
+
+	// a larger window lets us open rounds right now
+	p.downstreamPhase_sendMany()
+}
+
+// paramsToString prints the parameters in the order of net.MIGRATABLE_PARAMETERS
+func paramsToString(params map[string]int) string {
+	s := ""
+	for _, k := range net.MIGRATABLE_PARAMETERS {
+		if v, ok := params[k]; ok {
+			if s != "" {
+				s += ", "
+			}
+			s += k + "=" + strconv.Itoa(v)
+		}
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"testing"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestParametersMigration(t *testing.T) {
+
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	resultChan := make(chan interface{}, 10)
+
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	dataForClients := make(chan []byte, 6)
+	dataFromDCNet := make(chan []byte, 3)
+
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	rs := relay.relayState
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1500)
+	msg.Add("WindowSize", 1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 1000)
+	msg.Add("RelayTrusteeCacheLowBound", 10)
+	msg.Add("RelayTrusteeCacheHighBound", 15)
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+
+	// pretend we are in the middle of a session, with enough rounds in flight that a larger window opens none
+	relay.stateMachine.ChangeState("COMMUNICATING")
+	rs.numberOfNonAckedDownstreamPackets = 10
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+
+	// invalid proposals are refused, with an error
+	capture := prifilog.StartCaptureLogger(0)
+	defer capture.Stop()
+	invalid := []map[string]int{
+		{},
+		{"PayloadSize": 1000},
+		{"WindowSize": 0},
+		{"RelayTrusteeCacheLowBound": 20},
+	}
+	for _, params := range invalid {
+		if err := relay.ReceivedMessage(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: params}); err == nil {
+			t.Error("Parameters", params, "should have been refused")
+		}
+	}
+	if errors := capture.Errors(); len(errors) != len(invalid) || !capture.HasError("parameter PayloadSize cannot be changed during a session") {
+		t.Error("Each refused proposal should log why, got", errors)
+	}
+	if len(sentToClient) != 0 || len(sentToTrustee) != 0 {
+		t.Error("No proposal should have been sent")
+	}
+
+	// a valid proposal is sent to everybody
+	proposed := map[string]int{"WindowSize": 3, "RelayTrusteeCacheLowBound": 2, "RelayTrusteeCacheHighBound": 5}
+	if err := relay.ReceivedMessage(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: proposed}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentToClient) != 2 || len(sentToTrustee) != 1 {
+		t.Fatal("The proposal should have been sent to the 2 clients and the trustee")
+	}
+	proposal := sentToTrustee[0].(*net.REL_ALL_PARAMETERS_PROPOSAL)
+	if proposal.Epoch != 1 || proposal.ParamsInt["WindowSize"] != 3 {
+		t.Error("Wrong proposal", proposal)
+	}
+
+	// nothing changes until everybody accepted
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 0, Epoch: 1, Accepted: true})
+	relay.ReceivedMessage(net.TRU_REL_PARAMETERS_ACK{TrusteeID: 0, Epoch: 1, Accepted: true})
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 0, Epoch: 1, Accepted: true})
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 1, Epoch: 0, Accepted: true})
+	if rs.WindowSize != 1 || rs.parametersEpoch != 0 {
+		t.Error("Parameters should not be active yet")
+	}
+
+	sentToClient = make([]interface{}, 0)
+	sentToTrustee = make([]interface{}, 0)
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 1, Epoch: 1, Accepted: true})
+	if rs.WindowSize != 3 || rs.roundManager.maxNumberOfConcurrentRounds != 3 {
+		t.Error("WindowSize should be 3, is", rs.WindowSize, rs.roundManager.maxNumberOfConcurrentRounds)
+	}
+	if rs.TrusteeCacheLowBound != 2 || rs.roundManager.LowBound != 2 || rs.roundManager.HighBound != 5 {
+		t.Error("The rate limiter bounds were not updated")
+	}
+	if rs.RoundTimeOut != 1000 {
+		t.Error("RoundTimeOut should not have changed")
+	}
+	if rs.parametersEpoch != 1 || rs.pendingParameters != nil {
+		t.Error("Epoch 1 should be active, and nothing pending")
+	}
+	if len(sentToClient) != 2 || len(sentToTrustee) != 1 {
+		t.Fatal("The activation should have been sent to the 2 clients and the trustee")
+	}
+	if activate := sentToClient[0].(*net.REL_ALL_PARAMETERS_ACTIVATE); activate.Epoch != 1 {
+		t.Error("Wrong activation", activate)
+	}
+
+	// a refusal drops the proposal, with an error naming who refused
+	capture.Reset()
+	if err := relay.ReceivedMessage(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: map[string]int{"RelayRoundTimeOut": 500}}); err != nil {
+		t.Fatal(err)
+	}
+	relay.ReceivedMessage(net.TRU_REL_PARAMETERS_ACK{TrusteeID: 0, Epoch: 2, Accepted: false})
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 0, Epoch: 2, Accepted: true})
+	relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: 1, Epoch: 2, Accepted: true})
+	if rs.RoundTimeOut != 1000 || rs.parametersEpoch != 1 || rs.pendingParameters != nil {
+		t.Error("A refused proposal should not be activated")
+	}
+	if !capture.HasError("Trustee 0 refused the parameters of epoch 2") {
+		t.Error("The refusal should be logged, got", capture.Errors())
+	}
+
+	// a new proposal replaces the pending one, whose acks are then ignored; epochs are never reused
+	relay.ReceivedMessage(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: map[string]int{"RelayRoundTimeOut": 500}})
+	relay.ReceivedMessage(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: map[string]int{"RelayRoundTimeOut": 700}})
+	if rs.pendingParameters.epoch != 4 {
+		t.Error("The last proposal should be for epoch 4, is", rs.pendingParameters.epoch)
+	}
+	for _, epoch := range []int32{2, 3} {
+		for i := 0; i < 2; i++ {
+			relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: i, Epoch: epoch, Accepted: true})
+		}
+		relay.ReceivedMessage(net.TRU_REL_PARAMETERS_ACK{TrusteeID: 0, Epoch: epoch, Accepted: true})
+	}
+	if rs.RoundTimeOut != 1000 {
+		t.Error("Acks for a refused or replaced proposal should be ignored")
+	}
+	for i := 0; i < 2; i++ {
+		relay.ReceivedMessage(net.CLI_REL_PARAMETERS_ACK{ClientID: i, Epoch: 4, Accepted: true})
+	}
+	relay.ReceivedMessage(net.TRU_REL_PARAMETERS_ACK{TrusteeID: 0, Epoch: 4, Accepted: true})
+	if rs.RoundTimeOut != 700 || rs.parametersEpoch != 4 {
+		t.Error("RoundTimeOut should be 700 from epoch 4, is", rs.RoundTimeOut, "epoch", rs.parametersEpoch)
+	}
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib/transform"
+)
+
+/*
+With a PayloadTransform (see package transform), the owner of a slot encodes the payload of each round of its slot,
+and the relay decodes the payloads of each slot with a decoder of its own. The decoder may hold a payload (e.g. behind
+a lost round, until the FEC rebuilds it), or deliver several at once; each delivered content is then handled as the
+payload of a normal round, padded to PayloadSize. The decoders are flushed when the schedule changes, since the slots
+change owners. The transform needs each round to carry one payload of the same size, hence cannot be combined with
+super-rounds, variable slot sizes, the open/closed slots, nor the disruption and equivocation protections.
+*/
+
+// payloadTransformStatistics counts the contents rebuilt and lost by the decoders of the slots
+type payloadTransformStatistics struct {
+	sync.Mutex
+	spec    string
+	rebuilt int64
+	lost    int64
+}
+
+func newPayloadTransformStatistics(spec transform.Spec) *payloadTransformStatistics {
+	return &payloadTransformStatistics{spec: spec.String()}
+}
+
+// add counts the contents rebuilt and lost by a decoder since its last statistics, before
+func (s *payloadTransformStatistics) add(before, after transform.Statistics) {
+	s.Lock()
+	defer s.Unlock()
+	s.rebuilt += after.Rebuilt - before.Rebuilt
+	s.lost += after.Lost - before.Lost
+}
+
+// counts returns the contents rebuilt and lost so far
+func (s *payloadTransformStatistics) counts() (int64, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.rebuilt, s.lost
+}
+
+// WritePrometheus writes the contents rebuilt and lost by the decoders, in the Prometheus text format
+func (s *payloadTransformStatistics) WritePrometheus(w io.Writer, prefix string) error {
+	rebuilt, lost := s.counts()
+	_, err := fmt.Fprintf(w, "# TYPE %s_payload_transform_rebuilt_total counter\n", prefix)
+	fmt.Fprintf(w, "%s_payload_transform_rebuilt_total{transform=\"%v\"} %v\n", prefix, s.spec, rebuilt)
+	fmt.Fprintf(w, "# TYPE %s_payload_transform_lost_total counter\n", prefix)
+	fmt.Fprintf(w, "%s_payload_transform_lost_total{transform=\"%v\"} %v\n", prefix, s.spec, lost)
+	return err
+}
+
+// decodeTransformedPayload gives the decoded payload of roundID to the decoder of its slot, and processes the
+// contents it delivers
+func (p *PriFiLibRelayInstance) decodeTransformedPayload(roundID int32, payload []byte) error {
+	sent := p.relayState.roundManager.GetDataAlreadySent(roundID)
+	if sent == nil || sent.OwnershipID < 0 {
+		return p.processUpstreamPayload(roundID, payload) // e.g. round 0, which no slot owns
+	}
+
+	decoder, found := p.relayState.payloadDecoders[sent.OwnershipID]
+	if !found {
+		decoder = p.relayState.payloadTransform.New()
+		p.relayState.payloadDecoders[sent.OwnershipID] = decoder
+	}
+	before := decoder.Statistics()
+	contents := decoder.Decode(roundID, payload)
+	p.countTransformedPayloads(sent.OwnershipID, before, decoder.Statistics())
+
+	// the decoder copied what it keeps
+	p.releaseDecodedCell(payload)
+	return p.processTransformedContents(contents, len(payload))
+}
+
+// flushPayloadDecoders processes the contents the decoders still hold, and forgets them
+func (p *PriFiLibRelayInstance) flushPayloadDecoders() error {
+	decoders := p.relayState.payloadDecoders
+	p.relayState.payloadDecoders = make(map[int]transform.PayloadTransform)
+	for slot, decoder := range decoders {
+		before := decoder.Statistics()
+		contents := decoder.Flush()
+		p.countTransformedPayloads(slot, before, decoder.Statistics())
+		if err := p.processTransformedContents(contents, p.relayState.PayloadSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processTransformedContents handles the contents delivered by a decoder as payloads of size bytes
+func (p *PriFiLibRelayInstance) processTransformedContents(contents []transform.Content, size int) error {
+	for _, c := range contents {
+		padded := make([]byte, size)
+		copy(padded, c.Data)
+		if err := p.processUpstreamPayload(c.RoundID, padded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countTransformedPayloads adds what the decoder of slot rebuilt and lost to the statistics
+func (p *PriFiLibRelayInstance) countTransformedPayloads(slot int, before, after transform.Statistics) {
+	if p.relayState.payloadTransformStatistics == nil || before == after {
+		return
+	}
+	p.relayState.payloadTransformStatistics.add(before, after)
+	if after.Lost > before.Lost {
+		relayLog.Lvl2("Relay : the", p.relayState.payloadTransform.Name, "transform of slot", slot, "could not rebuild", after.Lost-before.Lost, "payload(s)")
+	}
+}
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/transform"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestPayloadTransform(t *testing.T) {
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	dataFromDCNet := make(chan []byte, 10)
+	relay := NewRelay(true, make(chan []byte, 6), dataFromDCNet, make(chan interface{}, 10), timeoutHandler,
+		newTestMessageSenderWrapper(new(TestMessageSender)))
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 2)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 100)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("WindowSize", 10)
+	msg.Add("PayloadTransform", "fec:data=2,parity=1")
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+	if relay.relayState.payloadTransform.String() != "fec:data=2,parity=1,interleave=1" {
+		t.Error("The transform should be the FEC, is", relay.relayState.payloadTransform)
+	}
+
+	// slot 1 owns the next rounds
+	ownedRound := func() int32 {
+		roundID := relay.relayState.roundManager.OpenNextRound()
+		relay.relayState.roundManager.SetDataAlreadySent(roundID, &net.REL_CLI_DOWNSTREAM_DATA{RoundID: roundID, OwnershipID: 1})
+		return roundID
+	}
+
+	// the payload of the first round is lost, and rebuilt from the parity of the third
+	spec, _ := transform.Parse("fec:data=2,parity=1")
+	encoder := spec.New()
+	contents := [][]byte{[]byte("first"), []byte("second"), nil}
+	for i, content := range contents {
+		roundID := ownedRound()
+		payload := encoder.Encode(content, 100)
+		if i == 0 {
+			continue
+		}
+		if err := relay.decodeTransformedPayload(roundID, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range contents[:2] {
+		select {
+		case data := <-dataFromDCNet:
+			if len(data) != 100 || !bytes.Equal(data[:len(expected)], expected) {
+				t.Error("The relay should output", string(expected), "padded to the payload size, got", data)
+			}
+		default:
+			t.Fatal("The relay should output", string(expected))
+		}
+	}
+	if rebuilt, lost := relay.relayState.payloadTransformStatistics.counts(); rebuilt != 1 || lost != 0 {
+		t.Error("One payload should be rebuilt, got", rebuilt, "rebuilt and", lost, "lost")
+	}
+
+	// the decoders give up on what they hold when the schedule changes
+	ownedRound()
+	encoder.Encode([]byte("lost"), 100)
+	relay.decodeTransformedPayload(ownedRound(), encoder.Encode([]byte("held"), 100))
+	if len(dataFromDCNet) != 0 {
+		t.Error("The content of the last round should wait for the lost one")
+	}
+	if err := relay.flushPayloadDecoders(); err != nil || len(relay.relayState.payloadDecoders) != 0 {
+		t.Error("The decoders should be flushed and forgotten,", err)
+	}
+	if data := <-dataFromDCNet; !bytes.HasPrefix(data, []byte("held")) {
+		t.Error("The held content should be output when flushing, got", data)
+	}
+
+	msg.Add("CellsPerRound", 2)
+	if err := relay.ReceivedMessage(*msg); err == nil {
+		t.Error("The payload transform should be refused with super-rounds")
+	}
+	msg.Add("CellsPerRound", 1)
+	msg.Add("PayloadSize", transform.FEC_OVERHEAD)
+	if err := relay.ReceivedMessage(*msg); err == nil {
+		t.Error("A payload without room for data should be refused")
+	}
+	msg.Add("PayloadSize", 100)
+	msg.Add("PayloadTransform", "rot13")
+	if err := relay.ReceivedMessage(*msg); err == nil {
+		t.Error("An unknown payload transform should be refused")
+	}
+}
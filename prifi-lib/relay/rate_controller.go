@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The constants of the RoundRateController
+const (
+	RATE_CONTROLLER_SAMPLES           = 100  // the p95 is computed over the last RATE_CONTROLLER_SAMPLES probes
+	RATE_CONTROLLER_ADJUST_EVERY      = 10   // number of new probes between two adjustments
+	RATE_CONTROLLER_SLEEP_STEP_MS     = 10   // the inter-round sleep grows by this much when we have headroom
+	RATE_CONTROLLER_MAX_SLEEP_MS      = 1000 // the inter-round sleep never exceeds this
+	RATE_CONTROLLER_HEADROOM_FRACTION = 0.8  // we slow down only when the p95 is below this fraction of the target
+)
+
+// RoundRateController adjusts the inter-round pacing and the window size of the relay so that the p95 latency of the
+// latency probes stays close to a target, instead of running as fast as the slowest participant allows. The latency
+// of a probe is measured by the relay, from the decoding of the probe upstream to the end of the round which echoed it
+// downstream; this does not need to read the probe, so it works with encrypted probes too.
+//
+// When the p95 is above the target, the controller speeds up: it first removes the inter-round sleep, then opens more
+// rounds in parallel. When the p95 is well below the target, it does the opposite, to save bandwidth and CPU.
+type RoundRateController struct {
+	sync.Mutex
+	targetP95Ms int64
+	minWindow   int
+	maxWindow   int
+
+	window  int
+	sleepMs int
+
+	samples                []int64 // the last RATE_CONTROLLER_SAMPLES latencies, in ms
+	samplesSinceAdjustment int
+	lastP95                int64
+
+	// statistics
+	samplesTotal int64
+	speedUps     int64
+	slowDowns    int64
+}
+
+// NewRoundRateController creates a controller targeting targetP95Ms, starting from the current window and sleep
+// time. The window is kept in [1; maxWindow]; a maxWindow smaller than the window means the window never grows.
+func NewRoundRateController(targetP95Ms int, window int, maxWindow int, sleepMs int) *RoundRateController {
+	if window < 1 {
+		window = 1
+	}
+	if maxWindow < window {
+		maxWindow = window
+	}
+	if sleepMs < 0 {
+		sleepMs = 0
+	}
+	return &RoundRateController{
+		targetP95Ms: int64(targetP95Ms),
+		minWindow:   1,
+		maxWindow:   maxWindow,
+		window:      window,
+		sleepMs:     sleepMs,
+		samples:     make([]int64, 0, RATE_CONTROLLER_SAMPLES),
+		lastP95:     -1,
+	}
+}
+
+// AddSample records the latency of one probe, and returns true if the window or the sleep time changed
+func (c *RoundRateController) AddSample(latencyMs int64) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	c.samples = append(c.samples, latencyMs)
+	if len(c.samples) > RATE_CONTROLLER_SAMPLES {
+		c.samples = c.samples[1:]
+	}
+	c.samplesTotal++
+	c.samplesSinceAdjustment++
+
+	if c.samplesSinceAdjustment < RATE_CONTROLLER_ADJUST_EVERY {
+		return false
+	}
+	c.samplesSinceAdjustment = 0
+	c.lastP95 = percentile95(c.samples)
+
+	window, sleepMs := c.window, c.sleepMs
+	if c.lastP95 > c.targetP95Ms {
+		// too slow: stop pacing first, then pipeline more rounds
+		if c.sleepMs > RATE_CONTROLLER_SLEEP_STEP_MS {
+			c.sleepMs /= 2
+		} else if c.sleepMs > 0 {
+			c.sleepMs = 0
+		} else if c.window < c.maxWindow {
+			c.window++
+		}
+		if c.window != window || c.sleepMs != sleepMs {
+			c.speedUps++
+		}
+	} else if float64(c.lastP95) < RATE_CONTROLLER_HEADROOM_FRACTION*float64(c.targetP95Ms) {
+		// we have headroom: pipeline less first, then pace the rounds
+		if c.window > c.minWindow {
+			c.window--
+		} else if c.sleepMs < RATE_CONTROLLER_MAX_SLEEP_MS {
+			c.sleepMs += RATE_CONTROLLER_SLEEP_STEP_MS
+			if c.sleepMs > RATE_CONTROLLER_MAX_SLEEP_MS {
+				c.sleepMs = RATE_CONTROLLER_MAX_SLEEP_MS
+			}
+		}
+		if c.window != window || c.sleepMs != sleepMs {
+			c.slowDowns++
+		}
+	}
+
+	if c.window != window || c.sleepMs != sleepMs {
+		relayLog.Lvl2("Relay : latency p95 is", c.lastP95, "ms (target", c.targetP95Ms, "ms), window", window, "->", c.window, ", sleep", sleepMs, "->", c.sleepMs, "ms")
+		return true
+	}
+	return false
+}
+
+// Window returns the window size the relay should use
+func (c *RoundRateController) Window() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.window
+}
+
+// SetWindow changes the window, e.g. when new parameters are activated; it is kept within the bounds
+func (c *RoundRateController) SetWindow(window int) {
+	c.Lock()
+	defer c.Unlock()
+	if window < c.minWindow {
+		window = c.minWindow
+	}
+	if window > c.maxWindow {
+		c.maxWindow = window
+	}
+	c.window = window
+}
+
+// SleepTime returns the inter-round sleep time the relay should use
+func (c *RoundRateController) SleepTime() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return time.Duration(c.sleepMs) * time.Millisecond
+}
+
+// percentile95 returns the 95th percentile of the values, or -1 if there are none
+func percentile95(values []int64) int64 {
+	if len(values) == 0 {
+		return -1
+	}
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := (len(sorted)*95+99)/100 - 1
+	return sorted[index]
+}
+
+// WritePrometheus writes the state of the controller, in the Prometheus text format
+func (c *RoundRateController) WritePrometheus(w io.Writer, prefix string) error {
+	c.Lock()
+	target, p95, window, sleepMs := c.targetP95Ms, c.lastP95, c.window, c.sleepMs
+	samples, speedUps, slowDowns := c.samplesTotal, c.speedUps, c.slowDowns
+	c.Unlock()
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_rate_controller_target_p95_ms gauge\n%s_rate_controller_target_p95_ms %v\n", prefix, prefix, target)
+	fmt.Fprintf(w, "# TYPE %s_rate_controller_p95_ms gauge\n%s_rate_controller_p95_ms %v\n", prefix, prefix, p95)
+	fmt.Fprintf(w, "# TYPE %s_rate_controller_window gauge\n%s_rate_controller_window %v\n", prefix, prefix, window)
+	fmt.Fprintf(w, "# TYPE %s_rate_controller_sleep_ms gauge\n%s_rate_controller_sleep_ms %v\n", prefix, prefix, sleepMs)
+	fmt.Fprintf(w, "# TYPE %s_rate_controller_samples_total counter\n%s_rate_controller_samples_total %v\n", prefix, prefix, samples)
+	fmt.Fprintf(w, "# TYPE %s_rate_controller_adjustments_total counter\n", prefix)
+	fmt.Fprintf(w, "%s_rate_controller_adjustments_total{direction=\"faster\"} %v\n", prefix, speedUps)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s_rate_controller_adjustments_total{direction=\"slower\"} %v\n", prefix, slowDowns)
+	return err
+}
@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addSamples(c *RoundRateController, latencyMs int64, n int) bool {
+	changed := false
+	for i := 0; i < n; i++ {
+		if c.AddSample(latencyMs) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func TestRoundRateController(t *testing.T) {
+
+	c := NewRoundRateController(100, 2, 4, 20)
+
+	// not enough samples yet
+	if c.AddSample(500) {
+		t.Error("the controller should wait for", RATE_CONTROLLER_ADJUST_EVERY, "samples")
+	}
+
+	// too slow: first the sleep is halved...
+	if !addSamples(c, 500, RATE_CONTROLLER_ADJUST_EVERY-1) {
+		t.Error("the controller should have sped up")
+	}
+	if c.SleepTime() != 10*time.Millisecond || c.Window() != 2 {
+		t.Error("the sleep should be halved first, got", c.SleepTime(), c.Window())
+	}
+	addSamples(c, 500, RATE_CONTROLLER_ADJUST_EVERY)
+	if c.SleepTime() != 0 || c.Window() != 2 {
+		t.Error("a small sleep should be removed, got", c.SleepTime(), c.Window())
+	}
+	addSamples(c, 500, RATE_CONTROLLER_ADJUST_EVERY)
+	if c.SleepTime() != 0 || c.Window() != 3 {
+		t.Error("the window should grow once there is no sleep, got", c.SleepTime(), c.Window())
+	}
+	addSamples(c, 500, 5*RATE_CONTROLLER_ADJUST_EVERY)
+	if c.Window() != 4 {
+		t.Error("the window should not exceed the maximum, got", c.Window())
+	}
+
+	// on target: nothing changes
+	c2 := NewRoundRateController(100, 2, 4, 0)
+	if addSamples(c2, 90, 5*RATE_CONTROLLER_ADJUST_EVERY) {
+		t.Error("the controller should not change anything when on target")
+	}
+
+	// headroom: the window shrinks to 1, then the rounds are paced
+	c2 = NewRoundRateController(100, 2, 4, 0)
+	addSamples(c2, 10, RATE_CONTROLLER_ADJUST_EVERY)
+	if c2.Window() != 1 || c2.SleepTime() != 0 {
+		t.Error("the window should shrink first, got", c2.Window(), c2.SleepTime())
+	}
+	addSamples(c2, 10, RATE_CONTROLLER_ADJUST_EVERY)
+	if c2.Window() != 1 || c2.SleepTime() != RATE_CONTROLLER_SLEEP_STEP_MS*time.Millisecond {
+		t.Error("the rounds should be paced once the window is 1, got", c2.Window(), c2.SleepTime())
+	}
+	addSamples(c2, 10, 1000*RATE_CONTROLLER_ADJUST_EVERY)
+	if c2.SleepTime() != RATE_CONTROLLER_MAX_SLEEP_MS*time.Millisecond {
+		t.Error("the sleep should not exceed the maximum, got", c2.SleepTime())
+	}
+
+	var buf bytes.Buffer
+	if err := c.WritePrometheus(&buf, METRICS_PREFIX); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(buf.String(), METRICS_PREFIX+"_rate_controller_window 4\n") {
+		t.Error("the metrics should contain the window, got", buf.String())
+	}
+}
+
+func TestPercentile95(t *testing.T) {
+	if percentile95(nil) != -1 {
+		t.Error("the p95 of nothing should be -1")
+	}
+	values := make([]int64, 100)
+	for i := range values {
+		values[99-i] = int64(i + 1)
+	}
+	if p := percentile95(values); p != 95 {
+		t.Error("the p95 of 1..100 should be 95, got", p)
+	}
+	if p := percentile95([]int64{7}); p != 7 {
+		t.Error("the p95 of one value should be the value, got", p)
+	}
+}
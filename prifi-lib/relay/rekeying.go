@@ -0,0 +1,273 @@
+package relay
+
+/*
+Clients may join during the session, once the relay is COMMUNICATING. They connect with the IDs following the ones of
+the group (nClients, nClients+1, ...), and the relay admits them with AdmitClient : it sends them the parameters of the
+group, and buffers the public keys they answer with. Once the next client has sent its keys, the relay stops opening
+rounds; when the open rounds are finished, the trustees shuffle again the ephemeral keys of all the clients, for a
+schedule starting at the next round. The trustees derive the secrets shared with the new clients, the other clients
+keep theirs and only learn their new slots. The round numbering continues : the pads of the DC-net are positioned by
+round, restarting at round 0 would reuse them.
+The clients leaving the session are removed the same way, see departure.go.
+The schedule has one slot per ephemeral key, the new clients may own several. The disruption and equivocation
+protections key their state by client ID, the new clients get theirs when they are admitted.
+With the SDA service, the roster of a protocol run is fixed : a client connecting during the session stops the protocol,
+and the next run starts a new epoch which includes it. AdmitClient serves the transports which accept clients on the
+fly, like the standalone one.
+*/
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// MAX_PENDING_CLIENTS is how many IDs after the ones of the group can be used by clients joining during the session
+const MAX_PENDING_CLIENTS = 64
+
+// pendingClient is a client which joined during the session, and waits for the next rekeying to be admitted
+type pendingClient struct {
+	invitedAt    time.Time
+	keys         *net.CLI_REL_TELL_PK_AND_EPH_PK // nil until the client sent its public keys
+	paramsDigest []byte                          // the digest of the parameters sent to the client
+}
+
+// rekeying is the shuffle in progress to admit the clients which joined during the session, and remove the ones which
+// left
+type rekeying struct {
+	startedAt     time.Time
+	joined        []int          // the IDs of the clients admitted by this shuffle
+	paramsDigests map[int][]byte // client ID -> the digest of the parameters sent to the clients admitted
+	left          []int          // the IDs of the clients removed before this shuffle
+	freshKeys     int            // the number of clients shuffled with fresh ephemeral keys
+}
+
+func (r *rekeying) hasJoined(clientID int) bool {
+	for _, id := range r.joined {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// AdmitClient lets the client which connected with clientID during the session join the group : the relay sends it
+// the parameters of the group, and shuffles again once it answered with its public keys. clientID must follow the IDs
+// of the group.
+func (p *PriFiLibRelayInstance) AdmitClient(clientID int) error {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	if p.stateMachine.State() != "COMMUNICATING" && p.relayState.rekeying == nil {
+		return errors.New("the relay is not communicating, cannot admit client " + strconv.Itoa(clientID))
+	}
+	if clientID < p.relayState.nClients {
+		return errors.New("client " + strconv.Itoa(clientID) + " is already in the group")
+	}
+	if clientID >= p.relayState.nClients+MAX_PENDING_CLIENTS {
+		return errors.New("client " + strconv.Itoa(clientID) + " is too far after the group, which has " +
+			strconv.Itoa(p.relayState.nClients) + " clients; the IDs of the clients joining must follow the ones of the group")
+	}
+
+	pending, found := p.relayState.pendingClients[clientID]
+	if !found {
+		pending = &pendingClient{invitedAt: time.Now()}
+		p.relayState.pendingClients[clientID] = pending
+	}
+	relayLog.Lvl1("Relay : client", clientID, "joins during the session, sending it the parameters of the group")
+
+	// the parameters of the group are shared by the clients of the epoch, the joining client gets its own copy, which
+	// counts it in the group
+	toSend := p.relayState.clientParams.Clone()
+	toSend.Add("NextFreeClientID", clientID)
+	toSend.Add("NClients", clientID+1)
+	pending.paramsDigest = toSend.ParamsDigest()
+	p.messageSender.SendToClientWithLog(clientID, toSend, "(client "+strconv.Itoa(clientID)+", joining)")
+	return nil
+}
+
+// bufferLateClient handles the public keys of a client received during the session : the keys of a client which
+// joined are kept until the next rekeying
+func (p *PriFiLibRelayInstance) bufferLateClient(msg net.CLI_REL_TELL_PK_AND_EPH_PK) error {
+	if p.relayState.clientsLeft[msg.ClientID] {
+		e := "Relay : refusing the public keys of client " + strconv.Itoa(msg.ClientID) + ", it left the session; it must join again with a new ID"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if msg.ClientID >= 0 && msg.ClientID < p.relayState.nClients {
+		if p.bufferFreshKeys(msg) {
+			return nil
+		}
+		// a client of the group sent its keys again, e.g. after a reconnection
+		return p.Received_CLI_REL_TELL_PK_AND_EPH_PK(msg)
+	}
+
+	pending, found := p.relayState.pendingClients[msg.ClientID]
+	if !found {
+		e := "Relay : refusing the public keys of client " + strconv.Itoa(msg.ClientID) + ", it was not admitted during the session"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if msg.Pk == nil || msg.EphPk == nil {
+		e := "Relay : refusing the public keys of client " + strconv.Itoa(msg.ClientID) + ", some are missing"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if pending.keys != nil {
+		if pending.keys.Pk.Equal(msg.Pk) && pending.keys.EphPk.Equal(msg.EphPk) {
+			relayLog.Lvl2("Relay : client", msg.ClientID, "sent its public keys again, ignoring them")
+			return nil
+		}
+		e := "Relay : two clients joining claim the ID " + strconv.Itoa(msg.ClientID) + " with different keys; refusing the second one"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if i := p.publicKeyOwner(msg.Pk); i != -1 {
+		e := "Relay : client " + strconv.Itoa(msg.ClientID) + " has the same public key as client " + strconv.Itoa(i) +
+			"; refusing it. Check that the same client is not started twice with different IDs"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	if len(msg.ExtraEphPks) > p.relayState.MaxSlotsPerClient-1 {
+		schedulerLog.Lvl2("Relay : client", msg.ClientID, "asked for", len(msg.ExtraEphPks)+1, "slots, granting", p.relayState.MaxSlotsPerClient)
+		msg.ExtraEphPks = msg.ExtraEphPks[:p.relayState.MaxSlotsPerClient-1]
+	}
+	pending.keys = &msg
+	relayLog.Lvl2("Relay : received the public keys of client", msg.ClientID, ", which joins at the next rekeying")
+	return nil
+}
+
+// handledWhileRekeying returns true if msg is part of the shuffle, or does not depend on the schedule. The other
+// messages, e.g. about the rounds of the previous schedule, are dropped until the new schedule starts.
+func (p *PriFiLibRelayInstance) handledWhileRekeying(msg interface{}) bool {
+	switch msg.(type) {
+	case net.ALL_ALL_PARAMETERS, net.ALL_ALL_SHUTDOWN, net.CLI_REL_TELL_PK_AND_EPH_PK, net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS,
+		net.TRU_REL_SHUFFLE_SIG, net.TRU_REL_SHUFFLE_REJECTED:
+		return true
+	case net.CLI_REL_GOODBYE:
+		// the client is removed at the next rekeying
+		return true
+	case net.TRU_REL_DC_CIPHER:
+		// a trustee sends the ciphers it computed for the previous schedule before its shuffle, and the ones of the
+		// new schedule after the transcript
+		return p.stateMachine.State() != "COLLECTING_SHUFFLES"
+	}
+	return false
+}
+
+// rekeyingPending returns true if the next client joining has sent its keys, a client said goodbye, or the clients sent
+// fresh ephemeral keys for the next epoch (see epoch_rotation.go), and no other change of the group is in progress
+func (p *PriFiLibRelayInstance) rekeyingPending() bool {
+	if p.relayState.rekeying != nil || p.relayState.pendingParameters != nil {
+		return false
+	}
+	if len(p.relayState.clientsLeaving) > 0 {
+		return true
+	}
+	if p.epochRotationReady() {
+		return true
+	}
+	next, found := p.relayState.pendingClients[p.relayState.nClients]
+	return found && next.keys != nil
+}
+
+// startRekeying admits the clients which joined, in the order of their IDs, removes the ones which said goodbye, and
+// starts the shuffle of the schedule starting at the next round. No round must be open.
+func (p *PriFiLibRelayInstance) startRekeying() error {
+	joined := make([]int, 0)
+	for id := p.relayState.nClients; ; id++ {
+		c, found := p.relayState.pendingClients[id]
+		if !found || c.keys == nil {
+			break
+		}
+		joined = append(joined, id)
+	}
+	firstRound := p.relayState.roundManager.NextRoundToOpen()
+	nClients := p.relayState.nClients + len(joined)
+	if err := p.relayState.roundManager.RestartAt(nClients, firstRound); err != nil {
+		return err
+	}
+	left, err := p.removeLeavingClients(firstRound - 1)
+	if err != nil {
+		return err
+	}
+
+	// the trustees stop computing ciphers for the current schedule
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		toSend := &net.REL_TRU_TELL_RATE_CHANGE{WindowCapacity: 0}
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "(trustee "+strconv.Itoa(j)+", rekeying)")
+	}
+
+	// the new schedule is a new epoch, with other clients
+	p.closeEpochRecord()
+	p.relayState.sessionSummary.NewEpoch(p.relayState.sessionSummary.Report().ConfigHash)
+	p.startEpochRecord()
+	p.relayState.contentStatistics.NewEpoch()
+	p.relayState.anonymityStatistics.NewEpoch(p.relayState.minAnonymitySet)
+
+	paramsDigests := make(map[int][]byte)
+	for _, id := range joined {
+		c := p.relayState.pendingClients[id]
+		paramsDigests[id] = c.paramsDigest
+		relayLog.Lvl1("Relay : admitting client", id, "at round", firstRound, ", it joined", time.Since(c.invitedAt), "ago")
+		p.relayState.clients = append(p.relayState.clients, NodeRepresentation{id, true, c.keys.Pk, c.keys.EphPk, c.keys.ExtraEphPks})
+		p.relayState.CiphertextsHistoryClients[int32(id)] = make(map[int32][]byte)
+		delete(p.relayState.pendingClients, id)
+	}
+	p.relayState.nClients = nClients
+	p.relayState.nClientsPkCollected = nClients
+	p.relayState.scheduleFirstRound = firstRound
+	for i := 0; i < nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			p.relayState.delivery.StartAt(i, firstRound)
+		}
+	}
+	if p.relayState.demoServer != nil {
+		p.relayState.demoServer.setGroup(p.nActiveClients(), p.relayState.nTrustees)
+	}
+
+	freshKeys := p.applyFreshKeys()
+	p.relayState.nSlots = p.scheduleSlots()
+	p.relayState.roundManager.SetNumberOfSlots(p.relayState.nSlots)
+
+	p.relayState.rekeying = &rekeying{startedAt: time.Now(), joined: joined, paramsDigests: paramsDigests, left: left, freshKeys: freshKeys}
+	return p.startShuffle()
+}
+
+// scheduleSlots returns the number of slots of the next schedule : one per ephemeral key of the clients in the group,
+// more than the number of clients if some of them own several slots
+func (p *PriFiLibRelayInstance) scheduleSlots() int {
+	nSlots := 0
+	for i := 0; i < p.relayState.nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			nSlots += 1 + len(p.relayState.clients[i].ExtraEphemeralPublicKeys)
+		}
+	}
+	return nSlots
+}
+
+// finishRekeying is called once the clients received the new schedule
+func (p *PriFiLibRelayInstance) finishRekeying() {
+	r := p.relayState.rekeying
+	p.relayState.rekeying = nil
+
+	duration := time.Since(r.startedAt)
+	relayLog.Lvl1("Relay : admitted clients", r.joined, "and removed clients", r.left, "in", duration, ", the group now has",
+		p.nActiveClients(), "clients,", r.freshKeys, "of them with fresh ephemeral keys")
+	if len(r.joined) > 0 {
+		p.collectExperimentResult("ClientsJoined: " + strconv.Itoa(len(r.joined)) + " clients at round " +
+			strconv.Itoa(int(p.relayState.scheduleFirstRound)) + " in " + strconv.FormatInt(duration.Nanoseconds()/1e6, 10) + "ms")
+	}
+	if r.freshKeys > 0 {
+		p.collectExperimentResult("EpochRotation: " + strconv.Itoa(r.freshKeys) + " fresh ephemeral keys at round " +
+			strconv.Itoa(int(p.relayState.scheduleFirstRound)) + " in " + strconv.FormatInt(duration.Nanoseconds()/1e6, 10) + "ms")
+	}
+	if len(r.left) > 0 {
+		p.collectExperimentResult("ClientsLeft: " + strconv.Itoa(len(r.left)) + " clients at round " +
+			strconv.Itoa(int(p.relayState.scheduleFirstRound)) + " in " + strconv.FormatInt(duration.Nanoseconds()/1e6, 10) + "ms")
+	}
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
+	"go.dedis.ch/kyber/v3"
+)
+
+func TestAdmitClientParameters(t *testing.T) {
+	sentToClient = make([]interface{}, 0)
+	// the protections do not prevent the clients from joining
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 2, DisruptionProtectionEnabled: true, EquivocationProtectionEnabled: true}}
+	p.messageSender = newTestMessageSenderWrapper(new(TestMessageSender))
+	p.stateMachine = new(utils.StateMachine)
+	p.stateMachine.Init([]string{"BEFORE_INIT", "COMMUNICATING"}, func(s interface{}) {}, func(s interface{}) {})
+	p.stateMachine.ChangeState("COMMUNICATING")
+	p.relayState.pendingClients = make(map[int]*pendingClient)
+	p.relayState.clientParams = new(net.ALL_ALL_PARAMETERS)
+	p.relayState.clientParams.Add("NClients", 2)
+	p.relayState.clientParams.Add("PayloadSize", 1000)
+	p.relayState.clientParamsDigest = p.relayState.clientParams.ParamsDigest()
+
+	for _, clientID := range []int{2, 3} {
+		if err := p.AdmitClient(clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sentToClient) != 2 {
+		t.Fatal("The parameters should be sent to the 2 clients joining, sent", len(sentToClient))
+	}
+	for i, msg := range sentToClient {
+		params := msg.(*net.ALL_ALL_PARAMETERS)
+		clientID := 2 + i
+		if params.IntValueOrElse("NextFreeClientID", -1) != clientID || params.IntValueOrElse("NClients", 0) != clientID+1 {
+			t.Error("Client", clientID, "should get its ID, and be counted in NClients")
+		}
+		if !bytes.Equal(p.relayState.pendingClients[clientID].paramsDigest, params.ParamsDigest()) {
+			t.Error("The digest of the parameters sent to client", clientID, "should be kept")
+		}
+	}
+
+	// the parameters of the group did not change
+	if p.relayState.clientParams.IntValueOrElse("NextFreeClientID", -1) != -1 || p.relayState.clientParams.IntValueOrElse("NClients", 0) != 2 ||
+		!bytes.Equal(p.relayState.clientParams.ParamsDigest(), p.relayState.clientParamsDigest) {
+		t.Error("Admitting clients should not change the parameters of the group")
+	}
+
+	if err := p.AdmitClient(1); err == nil {
+		t.Error("Client 1 is already in the group")
+	}
+}
+
+func TestScheduleSlots(t *testing.T) {
+	suite := config.CryptoSuite
+	key := suite.Point().Pick(suite.RandomStream())
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nClients: 3, clientsLeft: map[int]bool{1: true}}}
+	p.relayState.clients = []NodeRepresentation{
+		{0, true, key, key, []kyber.Point{key, key}},
+		{1, true, key, key, []kyber.Point{key}},
+		{2, true, key, key, nil},
+	}
+
+	// client 0 owns 3 slots, client 1 left
+	if n := p.scheduleSlots(); n != 4 {
+		t.Error("The schedule should have 4 slots, has", n)
+	}
+}
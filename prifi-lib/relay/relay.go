@@ -15,9 +15,14 @@ Then, this file simple handle the answer to the different message kind :
 - TRU_REL_TELL_NEW_BASE_AND_EPH_PKS - when we receive the result of one shuffle, we forward it to the next trustee
 - TRU_REL_SHUFFLE_SIG - when the shuffle has been done by all trustee, we send the transcript, and they answer with a signature, which we
 						   broadcast to the clients
+- TRU_REL_SHUFFLE_REJECTED - a trustee could not verify a shuffle of the transcript; we verify it again, and end the session
+						   blaming either the trustee which did this shuffle, or the one which rejected it
 - CLI_REL_UPSTREAM_DATA - data for the DC-net
 - REL_CLI_UDP_DOWNSTREAM_DATA - is NEVER received here, but casted to CLI_REL_UPSTREAM_DATA by messages.go
 - TRU_REL_DC_CIPHER - data for the DC-net
+- CLI_REL_DOWNSTREAM_COPY_REQUEST - a client verifying the UDP broadcasts asks for a copy of a round, which we send over TCP
+- CLI_REL_DOWNSTREAM_NACK - a client missed the downstream data of a round, which we retransmit to it over TCP
+- CLI_REL_HISTORY_DIGEST - the digest of the downstream history of a client at a round, which we asked while looking for where it diverged
 
 local functions :
 
@@ -37,18 +42,19 @@ import (
 	"strconv"
 	"time"
 
-	"bytes"
-	"crypto/hmac"
 	"crypto/sha256"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/transform"
 	"github.com/dedis/prifi/prifi-lib/utils"
 	"github.com/dedis/prifi/utils"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
+	"io/ioutil"
 	"os/exec"
 	"runtime"
 	"strings"
@@ -59,11 +65,48 @@ Received_ALL_REL_SHUTDOWN handles ALL_REL_SHUTDOWN messages.
 When we receive this message, we should warn other protocol participants and clean resources.
 */
 func (p *PriFiLibRelayInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUTDOWN) error {
-	log.Lvl1("Relay : Received a SHUTDOWN message. ")
+	relayLog.Lvl1("Relay : Received a SHUTDOWN message. ")
 
+	alreadyShutdown := p.stateMachine.State() == "SHUTDOWN"
 	p.stateMachine.ChangeState("SHUTDOWN")
 
-	msg2 := &net.ALL_ALL_SHUTDOWN{}
+	if msg.Reason != "" {
+		p.relayState.sessionSummary.SetShutdownReason(msg.Reason, msg.Abnormal)
+	}
+	report := p.relayState.sessionSummary.Report()
+	if !alreadyShutdown {
+		relayLog.Lvl1("Relay : shutdown report", report.String())
+		p.collectExperimentResult("ShutdownReport: " + report.String())
+		p.closeEpochRecord()
+		if report.Abnormal {
+			p.relayState.roundJournal.saveOnError("the session ended: "+report.Reason, time.Now())
+			p.logRoundJournal()
+		}
+	}
+
+	if p.relayState.flowCapture != nil {
+		p.relayState.flowCapture.Close()
+		p.relayState.flowCapture = nil
+	}
+	if p.relayState.mirrorSink != nil {
+		p.relayState.mirrorSink.Close()
+		p.relayState.mirrorSink = nil
+	}
+	if p.relayState.egressQueue != nil {
+		p.relayState.egressQueue.Close()
+		p.relayState.egressQueue = nil
+	}
+	if p.relayState.decodePipeline != nil {
+		p.relayState.decodePipeline.stop()
+		relayLog.Lvl2("Relay : decode pipeline stopped,", p.relayState.decodePipeline.ciphers, "ciphers decoded in the background,",
+			p.relayState.decodePipeline.redecoded, "rounds decoded again")
+		p.relayState.decodePipeline = nil
+	}
+	p.stopMetricsServer()
+	p.stopDemoServer()
+	p.closeCellPool()
+
+	msg2 := &net.ALL_ALL_SHUTDOWN{Abnormal: report.Abnormal, Reason: report.Reason}
 
 	var err error
 
@@ -74,7 +117,9 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUTDO
 
 	// Send this shutdown to all clients
 	for j := 0; j < p.relayState.nClients; j++ {
-		p.messageSender.SendToClientWithLog(j, msg2, "")
+		if !p.relayState.clientsLeft[j] {
+			p.messageSender.SendToClientWithLog(j, msg2, "")
+		}
 	}
 
 	// TODO : stop all go-routines we created
@@ -100,6 +145,7 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	useUDP := msg.BoolValueOrElse("UseUDP", p.relayState.UseUDP)
 	dcNetType := msg.StringValueOrElse("DCNetType", p.relayState.dcNetType)
 	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
+	macAlgorithm, macErr := dcnet.MACAlgorithmFromName(msg.StringValueOrElse("DisruptionProtectionMAC", dcnet.MACAlgorithmName(p.relayState.MACAlgorithm)))
 	openClosedSlotsMinDelayBetweenRequests := msg.IntValueOrElse("OpenClosedSlotsMinDelayBetweenRequests", p.relayState.OpenClosedSlotsMinDelayBetweenRequests)
 	maxNumberOfConsecutiveFailedRounds := msg.IntValueOrElse("RelayMaxNumberOfConsecutiveFailedRounds", p.relayState.MaxNumberOfConsecutiveFailedRounds)
 	processingLoopSleepTime := msg.IntValueOrElse("RelayProcessingLoopSleepTime", p.relayState.ProcessingLoopSleepTime)
@@ -108,24 +154,197 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	trusteeCacheHighBound := msg.IntValueOrElse("RelayTrusteeCacheHighBound", p.relayState.TrusteeCacheHighBound)
 	equivocationProtectionEnabled := msg.BoolValueOrElse("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
 	ForceDisruptionSinceRound3 := msg.BoolValueOrElse("ForceDisruptionSinceRound3", false)
+	transcriptExportPath := msg.StringValueOrElse("RelayTranscriptExportPath", p.relayState.TranscriptExportPath)
+	epochSummaryLogPath := msg.StringValueOrElse("RelayEpochSummaryLog", p.relayState.EpochSummaryLogPath)
+	blameEvidenceDir := msg.StringValueOrElse("RelayBlameEvidenceDir", p.relayState.BlameEvidenceDir)
+	flowCaptureFile := msg.StringValueOrElse("RelayFlowCaptureFile", "")
+	mirrorSinkTarget := msg.StringValueOrElse("RelayMirrorSink", "")
+	metricsAddress := msg.StringValueOrElse("RelayMetricsAddress", "")
+	demoAddress := msg.StringValueOrElse("RelayDemoAddress", "")
+	demoDelay := msg.IntValueOrElse("RelayDemoDelay", DEMO_DEFAULT_DELAY)
+	egressQueueMaxBytes := msg.IntValueOrElse("RelayEgressQueueMaxBytes", 0)
+	egressQueueSpillDir := msg.StringValueOrElse("RelayEgressQueueSpillDir", "")
+	egressQueueSpillMaxBytes := msg.IntValueOrElse("RelayEgressQueueSpillMaxBytes", 0)
+	egressQueueDropPolicy := msg.StringValueOrElse("RelayEgressQueueDropPolicy", EGRESS_DROP_NEWEST)
+	trusteeQuorum := msg.IntValueOrElse("TrusteeQuorum", p.relayState.TrusteeQuorum)
+	latencyTargetP95 := msg.IntValueOrElse("RelayLatencyTargetP95", 0)
+	maxWindowSize := msg.IntValueOrElse("RelayMaxWindowSize", 0)
+	maxSlotsPerClient := msg.IntValueOrElse("MaxSlotsPerClient", p.relayState.MaxSlotsPerClient)
+	cellsPerRound := msg.IntValueOrElse("CellsPerRound", 1)
+	minAnonymitySet := msg.IntValueOrElse("RelayMinAnonymitySet", 0)
+	groupBandwidthCap := msg.IntValueOrElse("RelayGroupBandwidthCap", 0)
+	epochRounds := msg.IntValueOrElse("RelayEpochRounds", 0)
+	epochDuration := msg.IntValueOrElse("RelayEpochDuration", 0)
+	warmupRounds := msg.IntValueOrElse("RelayWarmupRounds", 0)
+	minSlotSize := msg.IntValueOrElse("RelayMinSlotSize", 0)
+	decodeWorkers := msg.IntValueOrElse("RelayDecodeWorkers", 0)
+	targetRoundRate := msg.IntValueOrElse("RelayTargetRoundRate", 0)
+	historyDigestInterval := msg.IntValueOrElse("RelayHistoryDigestInterval", 0)
+	cryptoSuite := msg.StringValueOrElse("CryptoSuite", config.CryptoSuiteName())
+	experimentSchedule, err := parseExperimentSchedule(msg.StringValueOrElse("RelayExperimentSchedule", ""))
+	if err != nil {
+		log.Error("Relay : " + err.Error())
+		return err
+	}
+	featureFlags, err := config.ParseFeatureFlags(msg.StringValueOrElse("FeatureFlags", ""))
 
+	if err != nil {
+		log.Error("Relay : " + err.Error())
+		return err
+	}
+	randomBeacon, err := crypto.ParseRandomBeacon(msg.StringValueOrElse("RelayRandomBeacon", ""))
+	if err != nil {
+		log.Error("Relay : " + err.Error())
+		return err
+	}
+	transportOffers := msg.StringValueOrElse("RelayTransports", "")
+	offers, err := net.ParseTransportOffers(transportOffers)
+	if err != nil {
+		log.Error("Relay : RelayTransports : " + err.Error())
+		return err
+	}
+	for _, offer := range offers {
+		if _, err := net.NewTransport(offer.Name); err != nil {
+			log.Error("Relay : RelayTransports : " + err.Error())
+			return err
+		}
+	}
+	payloadTransform, err := transform.Parse(msg.StringValueOrElse("PayloadTransform", ""))
+	if err != nil {
+		log.Error("Relay : PayloadTransform : " + err.Error())
+		return err
+	}
+	socksCredentials := msg.StringValueOrElse("SocksCredentials", "")
+	if _, err := config.ParseSOCKSCredentials(socksCredentials); err != nil {
+		log.Error("Relay : SocksCredentials : " + err.Error())
+		return err
+	}
 	if payloadSize < 1 {
 		return errors.New("payloadSize cannot be 0")
 	}
+	if macErr != nil {
+		e := "Relay : DisruptionProtectionMAC : " + macErr.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	if err := config.CheckCryptoSuite(cryptoSuite); err != nil {
+		e := "Relay : CryptoSuite : " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	if cellsPerRound < 1 {
+		cellsPerRound = 1
+	}
+	if cellsPerRound > 1 && (featureFlags.ValueOrElse(config.FEATURE_DISRUPTION, disruptionProtection) ||
+		featureFlags.ValueOrElse(config.FEATURE_EQUIVOCATION, equivocationProtectionEnabled)) {
+		e := "Relay : CellsPerRound > 1 cannot be used with the disruption nor the equivocation protection"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if mirrorSinkTarget != "" && !featureFlags.Enabled(config.FEATURE_MIRROR) {
+		e := "Relay : RelayMirrorSink is set, but not the \"" + string(config.FEATURE_MIRROR) + "\" feature flag; refusing to mirror the decoded traffic"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if demoDelay < 0 {
+		e := "Relay : RelayDemoDelay cannot be negative, is " + strconv.Itoa(demoDelay)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if groupBandwidthCap < 0 {
+		e := "Relay : RelayGroupBandwidthCap cannot be negative, is " + strconv.Itoa(groupBandwidthCap)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if minSlotSize < 0 {
+		e := "Relay : RelayMinSlotSize cannot be negative, is " + strconv.Itoa(minSlotSize)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if decodeWorkers < 0 {
+		e := "Relay : RelayDecodeWorkers cannot be negative, is " + strconv.Itoa(decodeWorkers)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if targetRoundRate < 0 {
+		e := "Relay : RelayTargetRoundRate cannot be negative, is " + strconv.Itoa(targetRoundRate)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if historyDigestInterval < 0 || historyDigestInterval > dcnet.DEFAULT_HISTORY_DIGESTS_KEPT/2 {
+		e := "Relay : RelayHistoryDigestInterval must be between 0 and " + strconv.Itoa(dcnet.DEFAULT_HISTORY_DIGESTS_KEPT/2) + ", is " + strconv.Itoa(historyDigestInterval)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if minSlotSize > 0 && minSlotSize <= PAYLOAD_STREAM_HEADER_SIZE {
+		e := "Relay : RelayMinSlotSize must be larger than the frame header (" + strconv.Itoa(PAYLOAD_STREAM_HEADER_SIZE) + " bytes), is " + strconv.Itoa(minSlotSize)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if minSlotSize > 0 && (cellsPerRound > 1 || featureFlags.ValueOrElse(config.FEATURE_DISRUPTION, disruptionProtection) ||
+		featureFlags.ValueOrElse(config.FEATURE_EQUIVOCATION, equivocationProtectionEnabled)) {
+		e := "Relay : variable slot sizes (RelayMinSlotSize) cannot be used with CellsPerRound > 1, nor with the disruption or the equivocation protection"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if warmupRounds < 0 {
+		e := "Relay : RelayWarmupRounds cannot be negative, is " + strconv.Itoa(warmupRounds)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if payloadTransform.Enabled() && (cellsPerRound > 1 || minSlotSize > 0 || useOpenClosedSlots ||
+		featureFlags.ValueOrElse(config.FEATURE_DISRUPTION, disruptionProtection) ||
+		featureFlags.ValueOrElse(config.FEATURE_EQUIVOCATION, equivocationProtectionEnabled)) {
+		e := "Relay : PayloadTransform cannot be used with CellsPerRound > 1, RelayMinSlotSize, UseOpenClosedSlots, nor with the disruption or the equivocation protection"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if payloadSize <= payloadTransform.Overhead() {
+		e := "Relay : PayloadSize must be larger than the overhead of the payload transform (" + strconv.Itoa(payloadTransform.Overhead()) + " bytes), is " + strconv.Itoa(payloadSize)
+		log.Error(e)
+		return errors.New(e)
+	}
+	if trusteeQuorum > nTrustees {
+		e := "Relay : only " + strconv.Itoa(nTrustees) + " trustees for this epoch, but the quorum is " + strconv.Itoa(trusteeQuorum)
+		log.Error(e)
+		return errors.New(e)
+	}
 
+	p.closeEpochRecord()
+	p.relayState.sessionSummary.NewEpoch(msg.ConfigHash())
+	p.startEpochRecord()
+	p.relayState.contentStatistics.NewEpoch()
+	p.relayState.anonymityStatistics.NewEpoch(minAnonymitySet)
+	p.relayState.minAnonymitySet = minAnonymitySet
+	p.relayState.pendingClients = make(map[int]*pendingClient)
+	p.relayState.rekeying = nil
+	p.relayState.clientsLeaving = make(map[int]time.Time)
+	p.relayState.clientsLeft = make(map[int]bool)
+	p.relayState.scheduleFirstRound = 0
 	p.relayState.clients = make([]NodeRepresentation, nClients)
 	p.relayState.trustees = make([]NodeRepresentation, nTrustees)
+	p.relayState.trusteesKeyEndorsements = make([][]byte, nTrustees)
 	p.relayState.nClients = nClients
+	p.relayState.nSlots = nClients
 	p.relayState.nTrustees = nTrustees
 	p.relayState.nTrusteesPkCollected = 0
 	p.relayState.nClientsPkCollected = 0
 	p.relayState.ExperimentRoundLimit = reportingLimit
 	p.relayState.PayloadSize = payloadSize
+	p.relayState.CellsPerRound = cellsPerRound
 	p.relayState.DownstreamCellSize = downCellSize
-	p.relayState.bitrateStatistics = prifilog.NewBitRateStatistics(payloadSize)
+	p.relayState.bitrateStatistics = prifilog.NewBitRateStatistics(payloadSize * cellsPerRound)
 	p.relayState.UseDummyDataDown = useDummyDown
 	p.relayState.UseOpenClosedSlots = useOpenClosedSlots
 	p.relayState.UseUDP = useUDP
+	p.relayState.TransportOffers = transportOffers
+	p.relayState.SocksCredentials = socksCredentials
+	p.relayState.unreliableTransport = false
+	for _, offer := range offers {
+		if t, _ := net.NewTransport(offer.Name); !t.Reliable() {
+			p.relayState.unreliableTransport = true
+		}
+	}
 	p.relayState.WindowSize = windowSize
 	p.relayState.numberOfNonAckedDownstreamPackets = 0
 	p.relayState.OpenClosedSlotsMinDelayBetweenRequests = openClosedSlotsMinDelayBetweenRequests
@@ -134,20 +353,144 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	p.relayState.RoundTimeOut = roundTimeOut
 	p.relayState.TrusteeCacheLowBound = trusteeCacheLowBound
 	p.relayState.TrusteeCacheHighBound = trusteeCacheHighBound
-	p.relayState.EquivocationProtectionEnabled = equivocationProtectionEnabled
+	p.relayState.EquivocationProtectionEnabled = featureFlags.ValueOrElse(config.FEATURE_EQUIVOCATION, equivocationProtectionEnabled)
+	p.relayState.FeatureFlags = featureFlags
 	p.relayState.ForceDisruptionSinceRound3 = ForceDisruptionSinceRound3
-	p.relayState.MessageHistory = config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
+	p.relayState.TranscriptExportPath = transcriptExportPath
+	p.relayState.EpochSummaryLogPath = epochSummaryLogPath
+	p.relayState.BlameEvidenceDir = blameEvidenceDir
+	p.relayState.TrusteeQuorum = trusteeQuorum
+	if maxSlotsPerClient < 1 {
+		maxSlotsPerClient = 1
+	}
+	p.relayState.MaxSlotsPerClient = maxSlotsPerClient
+	p.relayState.RandomBeacon = randomBeacon
+	p.relayState.MessageHistory = crypto.NewMessageHistory(randomBeacon)
+	if randomBeacon != nil {
+		relayLog.Lvl2("Relay : using the random beacon of round", randomBeacon.Round, "for this epoch")
+	}
 	p.relayState.VerifiableDCNetKeys = make([][]byte, nTrustees)
 	p.relayState.nVkeysCollected = 0
 	p.relayState.roundManager = NewBufferableRoundManager(nClients, nTrustees, windowSize)
+	p.relayState.delivery = newDeliveryTracker(nClients)
+	p.relayState.historyCheck = newHistoryCheck(historyDigestInterval)
+	p.relayState.contributionSpreads = newContributionSpreads()
+	p.relayState.roundJournal.abandon(time.Now())
+	p.relayState.trusteeLoads = newTrusteeLoads()
+	p.relayState.roundTimers = make(map[int32]*timing.Timer)
+	p.relayState.parametersEpoch = 0
+	p.relayState.pendingParameters = nil
+	p.relayState.lastProposedParametersEpoch = 0
+	p.relayState.experimentSchedule = experimentSchedule
+	if len(experimentSchedule.steps) > 0 {
+		relayLog.Lvl1("Relay : running an experiment schedule of", len(experimentSchedule.steps), "steps over", experimentSchedule.scheduledParameters())
+	}
 	p.relayState.dcNetType = dcNetType
 	p.relayState.pcapLogger = utils.NewPCAPLog()
-	p.relayState.DisruptionProtectionEnabled = disruptionProtection
+	if p.relayState.flowCapture != nil {
+		p.relayState.flowCapture.Close()
+		p.relayState.flowCapture = nil
+	}
+	if flowCaptureFile != "" {
+		flowCapture, err := utils.NewPCAPNGFileWriter(flowCaptureFile)
+		if err != nil {
+			log.Error("Relay : could not create the flow capture file", flowCaptureFile, err)
+		} else {
+			relayLog.Lvl1("Relay : measurement mode, writing labelled decoded payloads to", flowCaptureFile)
+			p.relayState.flowCapture = flowCapture
+		}
+	}
+	if p.relayState.mirrorSink != nil {
+		p.relayState.mirrorSink.Close()
+		p.relayState.mirrorSink = nil
+	}
+	if mirrorSinkTarget != "" {
+		mirrorSink, err := newMirrorSink(mirrorSinkTarget)
+		if err != nil {
+			log.Error("Relay : could not open the mirror sink", mirrorSinkTarget, err)
+			return err
+		}
+		relayLog.Lvl1("Relay : experiment mode, mirroring the decoded upstream payloads to", mirrorSinkTarget)
+		p.relayState.mirrorSink = mirrorSink
+	}
+	if p.relayState.egressQueue != nil {
+		p.relayState.egressQueue.Close()
+		p.relayState.egressQueue = nil
+	}
+	if p.relayState.DataOutputEnabled && egressQueueMaxBytes > 0 {
+		egressQueue, err := NewEgressQueue(p.relayState.DataFromDCNet, egressQueueMaxBytes, egressQueueSpillDir, egressQueueSpillMaxBytes, egressQueueDropPolicy)
+		if err != nil {
+			log.Error("Relay : could not create the egress queue,", err)
+			return err
+		}
+		relayLog.Lvl2("Relay : queuing up to", egressQueueMaxBytes, "bytes of decoded payloads in memory, and", egressQueueSpillMaxBytes, "bytes on disk in \""+egressQueueSpillDir+"\", policy", egressQueueDropPolicy)
+		p.relayState.egressQueue = egressQueue
+	}
+	p.relayState.rateController = nil
+	p.relayState.latencyProbesReceivedAt = make([]time.Time, 0)
+	p.relayState.latencyProbesRounds = make(map[int32]time.Time)
+	if latencyTargetP95 > 0 {
+		relayLog.Lvl2("Relay : adjusting the window and the pacing for a p95 probe latency of", latencyTargetP95, "ms")
+		p.relayState.rateController = NewRoundRateController(latencyTargetP95, windowSize, maxWindowSize, processingLoopSleepTime)
+	}
+	p.relayState.pacer = newRoundPacer(targetRoundRate, time.Duration(processingLoopSleepTime)*time.Millisecond)
+	if targetRoundRate > 0 {
+		relayLog.Lvl2("Relay : pacing the rounds at", targetRoundRate, "rounds per second")
+	}
+	p.relayState.bandwidthCap = nil
+	if groupBandwidthCap > 0 {
+		relayLog.Lvl2("Relay : capping the egress of the group to", groupBandwidthCap, "bytes/s")
+		p.relayState.bandwidthCap = NewBandwidthCap(groupBandwidthCap)
+		if err := p.applyBandwidthCap(); err != nil {
+			log.Error("Relay : " + err.Error())
+			return err
+		}
+	}
+	p.relayState.payloadTransform = payloadTransform
+	p.relayState.payloadDecoders = make(map[int]transform.PayloadTransform)
+	p.relayState.payloadTransformStatistics = nil
+	if payloadTransform.Enabled() {
+		relayLog.Lvl2("Relay : the slot owners encode their payloads with the transform", payloadTransform.String())
+		p.relayState.payloadTransformStatistics = newPayloadTransformStatistics(payloadTransform)
+	}
+	p.startMetricsServer(metricsAddress)
+	p.startDemoServer(demoAddress, demoDelay)
+	p.relayState.DisruptionProtectionEnabled = featureFlags.ValueOrElse(config.FEATURE_DISRUPTION, disruptionProtection)
+	p.relayState.MACAlgorithm = macAlgorithm
+	p.relayState.warmup = newWarmup(warmupRounds)
+	p.relayState.slotSizes = newSlotSizer(minSlotSize, payloadSize)
+	if p.relayState.decodePipeline != nil {
+		p.relayState.decodePipeline.stop()
+		p.relayState.decodePipeline = nil
+	}
+	if decodeWorkers > 0 {
+		if p.relayState.EquivocationProtectionEnabled {
+			relayLog.Lvl1("Relay : the equivocation protection decodes the ciphers in order, ignoring RelayDecodeWorkers")
+		} else {
+			relayLog.Lvl2("Relay : decoding the rounds in a pipeline, with", decodeWorkers, "workers")
+			p.relayState.decodePipeline = newDecodePipeline(decodeWorkers)
+		}
+	}
+	p.relayState.epochRotation = nil
+	if epochRounds > 0 || epochDuration > 0 {
+		if p.relayState.DisruptionProtectionEnabled || p.relayState.EquivocationProtectionEnabled {
+			relayLog.Lvl1("Relay : the schedules cannot change during the session with the disruption or equivocation protection, ignoring RelayEpochRounds and RelayEpochDuration")
+		} else {
+			relayLog.Lvl2("Relay : rotating the schedule with fresh ephemeral keys every", epochRounds, "rounds or", epochDuration, "seconds")
+			p.relayState.epochRotation = newEpochRotation(epochRounds, epochDuration)
+		}
+	}
+	if unknown := featureFlags.Unknown(); len(unknown) > 0 {
+		relayLog.Lvl1("Relay : unknown feature flags", unknown, ", ignoring them")
+	}
+	p.collectExperimentResult("FeatureFlags: " + featureFlags.String())
 	p.relayState.clientBitMap = make(map[int]map[int]int)
 	p.relayState.trusteeBitMap = make(map[int]map[int]int)
 	p.relayState.OpenClosedSlotsRequestsRoundID = make(map[int32]bool)
 	p.relayState.LastMessageOfClients = make(map[int32][]byte)
 	p.relayState.BEchoFlags = make(map[int32]byte)
+	p.relayState.disruptedRounds = make(map[int32]*disruptedRound)
+	p.relayState.blame = nil
 	p.relayState.CiphertextsHistoryTrustees = make(map[int32]map[int32][]byte)
 	p.relayState.CiphertextsHistoryClients = make(map[int32]map[int32][]byte)
 	//CV->LB: Is this the proper way to initialize this?
@@ -178,14 +521,15 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	}
 
 	log.Lvlf3("Relay new state: %+v\n", p.relayState)
-	log.Lvl1("Relay has been initialized by message; StartNow is", startNow)
+	relayLog.Lvl1("Relay has been initialized by message; StartNow is", startNow)
 
 	// Broadcast those parameters to the other nodes, then tell the trustees which ID they are.
 	if startNow {
 		p.stateMachine.ChangeState("COLLECTING_TRUSTEES_PKS")
+		p.relayState.setupStatistics.StartSetup(prifilog.SETUP_KEY_COLLECTION, time.Now())
 		p.BroadcastParameters()
 	}
-	log.Lvl1("Relay setup done, and setup sent to the trustees.")
+	relayLog.Lvl1("Relay setup done, and setup sent to the trustees.")
 
 	timing.StopMeasureAndLogWithInfo("resync-boot", strconv.Itoa(p.relayState.nClients))
 	timing.StartMeasure("resync-shuffle")
@@ -204,9 +548,12 @@ func (p *PriFiLibRelayInstance) BroadcastParameters() error {
 	msg.Add("UseUDP", p.relayState.UseUDP)
 	msg.Add("StartNow", true)
 	msg.Add("PayloadSize", p.relayState.PayloadSize)
+	msg.Add("CellsPerRound", p.relayState.CellsPerRound)
 	msg.Add("DCNetType", p.relayState.dcNetType)
 	msg.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
 	msg.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
+	msg.Add("TrusteeQuorum", p.relayState.TrusteeQuorum)
+	msg.Add("CryptoSuite", config.CryptoSuiteName())
 	msg.ForceParams = true
 
 	// Send those parameters to all trustees
@@ -234,7 +581,17 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_UPSTREAM_DATA(msg net.CLI_REL_U
 		p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)] = make(map[int32][]byte)
 	}
 	p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)][msg.RoundID] = msg.Data
-	p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.Data)
+	p.relayState.availabilityStatistics.Seen(prifilog.CLIENT, msg.ClientID)
+	p.relayState.bitrateStatistics.AddClientBytes(msg.ClientID, int64(len(msg.Data)))
+	if !p.relayState.delivery.Ack(msg.ClientID, msg.AckedRoundID) {
+		relayLog.Lvl2("Relay : ignoring the ACK of round", msg.AckedRoundID, "from client", msg.ClientID, ", we did not send it")
+	}
+	p.checkHistoryDigest(msg)
+	if p.cipherAccepted(p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.Data)) {
+		p.relayState.contributionSpreads.received(msg.RoundID, true, time.Now())
+		p.relayState.roundJournal.received(msg.RoundID, true, msg.ClientID, len(msg.Data), time.Now())
+		p.pipelineCipher(msg.RoundID, true, msg.ClientID, msg.Data)
+	}
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(true)
 	}
@@ -246,13 +603,25 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_UPSTREAM_DATA(msg net.CLI_REL_U
 Received_TRU_REL_DC_CIPHER handles TRU_REL_DC_CIPHER messages. Those contain a DC-net cipher from a Trustee.
 If it's for this round, we call decode on it, and remember we received it.
 If for a future round we need to Buffer it.
+If it was computed for a previous schedule (e.g., it was sent before the trustee got the parameters of a resync), we drop it.
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_DC_CIPHER(msg net.TRU_REL_DC_CIPHER) error {
+	p.relayState.availabilityStatistics.Seen(prifilog.TRUSTEE, msg.TrusteeID)
+	p.relayState.bitrateStatistics.AddTrusteeBytes(msg.TrusteeID, int64(len(msg.Data)))
+	if msg.Epoch != p.relayState.scheduleEpoch {
+		relayLog.Lvl2("Relay : dropping the cipher of round", msg.RoundID, "from trustee", msg.TrusteeID, ", it is of epoch",
+			msg.Epoch, "but the schedule is of epoch", p.relayState.scheduleEpoch)
+		return nil
+	}
 	if p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)] == nil {
 		p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)] = make(map[int32][]byte)
 	}
 	p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)][msg.RoundID] = msg.Data
-	p.relayState.roundManager.AddTrusteeCipher(msg.RoundID, msg.TrusteeID, msg.Data)
+	if p.cipherAccepted(p.relayState.roundManager.AddTrusteeCipherOfEpoch(msg.Epoch, msg.RoundID, msg.TrusteeID, msg.Data)) {
+		p.relayState.contributionSpreads.received(msg.RoundID, false, time.Now())
+		p.relayState.roundJournal.received(msg.RoundID, false, msg.TrusteeID, len(msg.Data), time.Now())
+		p.pipelineCipher(msg.RoundID, false, msg.TrusteeID, msg.Data)
+	}
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(true)
 	}
@@ -263,7 +632,13 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_DC_CIPHER(msg net.TRU_REL_DC_CI
 // Received_CLI_REL_OPENCLOSED_DATA handles the reception of the OpenClosed map, which details which
 // pseudonymous clients want to transmit in a given round
 func (p *PriFiLibRelayInstance) Received_CLI_REL_OPENCLOSED_DATA(msg net.CLI_REL_OPENCLOSED_DATA) error {
-	p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.OpenClosedData)
+	p.relayState.availabilityStatistics.Seen(prifilog.CLIENT, msg.ClientID)
+	p.relayState.bitrateStatistics.AddClientBytes(msg.ClientID, int64(len(msg.OpenClosedData)))
+	if p.cipherAccepted(p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.OpenClosedData)) {
+		p.relayState.contributionSpreads.received(msg.RoundID, true, time.Now())
+		p.relayState.roundJournal.received(msg.RoundID, true, msg.ClientID, len(msg.OpenClosedData), time.Now())
+		p.pipelineCipher(msg.RoundID, true, msg.ClientID, msg.OpenClosedData)
+	}
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(false)
 	}
@@ -271,44 +646,127 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_OPENCLOSED_DATA(msg net.CLI_REL
 	return nil
 }
 
+// cipherAccepted returns true if the round manager accepted a cipher. A retransmitted cipher is ignored; two different
+// ciphers for the same round are a protocol violation : the client is excluded, and a trustee ends the session
+func (p *PriFiLibRelayInstance) cipherAccepted(err error) bool {
+	if err == nil {
+		return true
+	}
+	if err == ErrDuplicateCipher {
+		relayLog.Lvl3("Relay : ignoring a retransmitted cipher")
+		return false
+	}
+	conflict, ok := err.(*CipherConflictError)
+	if !ok {
+		return false
+	}
+	if conflict.IsClient {
+		log.Error("Relay : " + conflict.Error() + ", excluding the client")
+		p.excludeClient(conflict.EntityID)
+	} else {
+		log.Error("Relay : " + conflict.Error() + "; the trustees cannot be replaced during the session, ending it")
+		p.relayState.sessionSummary.SetShutdownReason("trustee "+strconv.Itoa(conflict.EntityID)+" sent two different ciphers for a round", true)
+		p.relayState.timeoutHandler(nil, []int{conflict.EntityID})
+	}
+	return false
+}
+
+// Received_CLI_REL_DOWNSTREAM_COPY_REQUEST sends to a client, over TCP, the downstream data of a round it received
+// over UDP, so that it can check that the relay broadcasts the same data to everyone
+func (p *PriFiLibRelayInstance) Received_CLI_REL_DOWNSTREAM_COPY_REQUEST(msg net.CLI_REL_DOWNSTREAM_COPY_REQUEST) error {
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients {
+		e := "Relay : received a copy request from unknown client " + strconv.Itoa(msg.ClientID)
+		log.Error(e)
+		return errors.New(e)
+	}
+	toSend := &net.REL_CLI_DOWNSTREAM_COPY{RoundID: msg.RoundID}
+	if data, found := p.relayState.roundManager.FindDataAlreadySent(msg.RoundID); found {
+		toSend.Found = true
+		toSend.Data = *data
+	} else {
+		relayLog.Lvl2("Relay : client", msg.ClientID, "asked for a copy of round", msg.RoundID, ", which is closed")
+	}
+	p.messageSender.SendToClientWithLog(msg.ClientID, toSend, "(client "+strconv.Itoa(msg.ClientID)+", copy of round "+strconv.Itoa(int(msg.RoundID))+")")
+	return nil
+}
+
+// Received_CLI_REL_DOWNSTREAM_NACK retransmits over TCP, to this client only, the downstream data of a round it
+// missed, e.g. a lost UDP broadcast. Each round is retransmitted at most once to a client, whether it NACKed it or
+// its round timed out; a round which is closed cannot be retransmitted anymore.
+func (p *PriFiLibRelayInstance) Received_CLI_REL_DOWNSTREAM_NACK(msg net.CLI_REL_DOWNSTREAM_NACK) error {
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients {
+		e := "Relay : received a NACK from unknown client " + strconv.Itoa(msg.ClientID)
+		log.Error(e)
+		return errors.New(e)
+	}
+	p.relayState.delivery.Nacked()
+	data, found := p.relayState.roundManager.FindDataAlreadySent(msg.RoundID)
+	if !found {
+		relayLog.Lvl2("Relay : client", msg.ClientID, "missed round", msg.RoundID, ", which is closed")
+		return nil
+	}
+	if !p.relayState.delivery.ShouldRetransmit(msg.ClientID, msg.RoundID) {
+		relayLog.Lvl3("Relay : ignoring the NACK of round", msg.RoundID, "from client", msg.ClientID, ", it is acknowledged or already retransmitted")
+		return nil
+	}
+	relayLog.Lvl2("Relay : client", msg.ClientID, "missed round", msg.RoundID, ", retransmitting it")
+	p.messageSender.SendToClientWithLog(msg.ClientID, data, "(retransmission to client "+strconv.Itoa(msg.ClientID)+", round "+strconv.Itoa(int(msg.RoundID))+")")
+	p.relayState.bitrateStatistics.AddDownstreamRetransmitCell(int64(len(data.Data)))
+	return nil
+}
+
 // upstreamPhase1_processCiphers collects all DC-net ciphers, and decides what to do with them (is it a OCMap message ?
 // a data message ?)
 // it then proceed accordingly, finalizes the round, and calls downstreamPhase_sendMany()
 func (p *PriFiLibRelayInstance) upstreamPhase1_processCiphers(finishedByTrustee bool) {
 
+	roundID := p.relayState.roundManager.CurrentRound()
+
 	// keep statistics on who finished the round, to check on who the system is waiting
-	if finishedByTrustee {
-		timeMs := timing.StopMeasure("waiting-on-someone").Nanoseconds() / 1e6
-		p.relayState.timeStatistics["waiting-on-trustees"].AddTime(timeMs)
-	} else {
-		timeMs := timing.StopMeasure("waiting-on-someone").Nanoseconds() / 1e6
-		p.relayState.timeStatistics["waiting-on-clients"].AddTime(timeMs)
+	if roundTimer, ok := p.relayState.roundTimers[roundID]; ok {
+		if waiting := roundTimer.Child("waiting-on-someone"); waiting != nil {
+			timeMs := waiting.Stop().Nanoseconds() / 1e6
+			if finishedByTrustee {
+				p.relayState.timeStatistics["waiting-on-trustees"].AddTime(timeMs)
+			} else {
+				p.relayState.timeStatistics["waiting-on-clients"].AddTime(timeMs)
+			}
+		}
+		roundTimer.Stop()
+		delete(p.relayState.roundTimers, roundID)
+	}
+	if clientSpread, trusteeSpread, ok := p.relayState.contributionSpreads.done(roundID); ok {
+		p.relayState.timeStatistics[CLIENT_SPREAD].AddTime(clientSpread.Nanoseconds() / 1e6)
+		p.relayState.timeStatistics[TRUSTEE_SPREAD].AddTime(trusteeSpread.Nanoseconds() / 1e6)
 	}
 
-	roundID := p.relayState.roundManager.CurrentRound()
 	_, isOCRound := p.relayState.OpenClosedSlotsRequestsRoundID[roundID]
 
-	log.Lvl3("Relay has collected all ciphers for round", roundID, "(isOCRound", isOCRound, "), decoding...")
+	relayLog.Lvl3("Relay has collected all ciphers for round", roundID, "(isOCRound", isOCRound, "), decoding...")
 
 	// most important switch of this method
 	if isOCRound {
 		err := p.upstreamPhase2a_extractOCMap(roundID)
 		if err != nil {
-			log.Lvl3("upstreamPhase2a_extractOCMap: error", err.Error())
+			schedulerLog.Lvl3("upstreamPhase2a_extractOCMap: error", err.Error())
 		}
 	} else {
 		err := p.upstreamPhase2b_extractPayload()
+		if err == errEquivocationAlarm {
+			// the rounds stop there, see equivocation_alarm.go
+			return
+		}
 		if err != nil {
-			log.Lvl3("upstreamPhase2b_extractPayload: error", err.Error())
+			schedulerLog.Lvl3("upstreamPhase2b_extractPayload: error", err.Error())
 		}
 	}
 
 	// one round has just passed ! Round start with downstream data, and end with upstream data, like here.
 	p.upstreamPhase3_finalizeRound(roundID)
 
-	// inter-round sleep
-	if p.relayState.ProcessingLoopSleepTime > 0 {
-		time.Sleep(time.Duration(p.relayState.ProcessingLoopSleepTime) * time.Millisecond)
+	// inter-round pacing
+	if wait := p.relayState.pacer.roundDone(time.Now()); wait > 0 {
+		time.Sleep(wait)
 	}
 
 	// downstream phase
@@ -318,9 +776,26 @@ func (p *PriFiLibRelayInstance) upstreamPhase1_processCiphers(finishedByTrustee
 // downstreamPhase_sendMany starts as many rounds (by opening the round and sending downstream data) as specified
 // by the window
 func (p *PriFiLibRelayInstance) downstreamPhase_sendMany() {
+	p.checkEpochRotation()
+	if p.rekeyingPending() {
+		// some clients wait to join or leave, or to use fresh keys : we let the open rounds finish, then shuffle again
+		// before the next one
+		if roundOpened, _ := p.relayState.roundManager.currentRound(); roundOpened {
+			return
+		}
+		err := p.startRekeying()
+		if err == nil {
+			return
+		}
+		log.Error("Relay : could not change the clients of the group during the session, continuing without changing it;", err)
+	}
+
 	// send the data down
 	for i := p.relayState.numberOfNonAckedDownstreamPackets; i < p.relayState.WindowSize; i++ {
-		log.Lvl3("Relay : Gonna send, non-acked packets is", p.relayState.numberOfNonAckedDownstreamPackets, "(window is", p.relayState.WindowSize, ")")
+		relayLog.Lvl3("Relay : Gonna send, non-acked packets is", p.relayState.numberOfNonAckedDownstreamPackets, "(window is", p.relayState.WindowSize, ")")
+		if p.relayState.bandwidthCap != nil {
+			p.relayState.bandwidthCap.Wait()
+		}
 		p.downstreamPhase1_openRoundAndSendData()
 	}
 }
@@ -333,20 +808,16 @@ func (p *PriFiLibRelayInstance) upstreamPhase2a_extractOCMap(roundID int32) erro
 	if err != nil {
 		return err
 	}
-	for _, s := range clientSlices {
-		p.relayState.DCNet.DecodeClient(roundID, s)
-	}
-	for _, s := range trusteesSlices {
-		p.relayState.DCNet.DecodeTrustee(roundID, s)
-	}
+	p.decodeCiphers(roundID, clientSlices, trusteesSlices)
 
 	//here we have the plaintext map
 	openClosedData, _ := p.relayState.DCNet.DecodeCell(true)
 
 	//compute the map
-	newSchedule := p.relayState.slotScheduler.Relay_ComputeFinalSchedule(openClosedData, p.relayState.nClients)
+	newSchedule := p.relayState.slotScheduler.Relay_ComputeFinalSchedule(openClosedData, p.relayState.nSlots)
 	p.relayState.roundManager.SetStoredRoundSchedule(newSchedule)
 	p.relayState.schedulesStatistics.AddSchedule(newSchedule)
+	p.releaseDecodedCell(openClosedData)
 
 	// if all slots are closed, do not immediately send the next downstream data (which will be a OCSlots schedule)
 	hasOpenSlot := false
@@ -357,7 +828,7 @@ func (p *PriFiLibRelayInstance) upstreamPhase2a_extractOCMap(roundID int32) erro
 		}
 	}
 	if !hasOpenSlot {
-		log.Lvl3("All slots closed, sleeping for", p.relayState.OpenClosedSlotsMinDelayBetweenRequests, "ms")
+		schedulerLog.Lvl3("All slots closed, sleeping for", p.relayState.OpenClosedSlotsMinDelayBetweenRequests, "ms")
 		d := time.Duration(p.relayState.OpenClosedSlotsMinDelayBetweenRequests) * time.Millisecond
 		time.Sleep(d)
 	}
@@ -378,22 +849,31 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 	if err != nil {
 		return err
 	}
+	p.relayState.roundParticipants = roundParticipants(clientSlices)
+	if p.relayState.EquivocationProtectionEnabled {
+		if err := p.checkEquivocationTags(clientSlices, trusteesSlices); err != nil {
+			return p.raiseEquivocationAlarm(roundID, err)
+		}
+	}
 
 	//decode all clients and trustees
-	for _, s := range clientSlices {
-		p.relayState.DCNet.DecodeClient(roundID, s)
-	}
-	for _, s := range trusteesSlices {
-		p.relayState.DCNet.DecodeTrustee(roundID, s)
-	}
+	p.decodeCiphers(roundID, clientSlices, trusteesSlices)
 
 	upstreamPlaintext, ciphertext := p.relayState.DCNet.DecodeCell(false)
+	if err := p.relayState.DCNet.EquivocationError(); err != nil {
+		return p.raiseEquivocationAlarm(roundID, err)
+	}
+	if size := p.allocatedUpstreamSize(roundID); size > 0 && size < len(upstreamPlaintext) {
+		// with variable slot sizes, the clients only sent the beginning of the cell
+		upstreamPlaintext = upstreamPlaintext[:size]
+	}
 	if p.relayState.EquivocationProtectionEnabled && p.relayState.DisruptionProtectionEnabled {
 		// Generating and storing the hash from the payload
 		p.relayState.HashOfLastUpstreamMessage = sha256.Sum256([]byte(ciphertext))
 		p.relayState.LastMessageOfClients[roundID] = ciphertext
 	}
 	p.relayState.bitrateStatistics.AddUpstreamCell(int64(len(upstreamPlaintext)))
+	p.relayState.roundJournal.decoded(roundID, len(upstreamPlaintext))
 
 	if p.relayState.DisruptionProtectionEnabled {
 
@@ -433,10 +913,16 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 				}
 
 			} else {
-				log.Lvl1("b_echo_last=", b_echo_last, "(current round:", roundID, ")")
+				relayLog.Lvl1("b_echo_last=", b_echo_last, "(current round:", roundID, ")")
 			}
 		}
-		upstreamPlaintext = upstreamPlaintext[1:]
+		content, intact := p.checkCellHmac(roundID, upstreamPlaintext)
+		if !intact {
+			// the content of a disrupted round goes neither to the history nor to the exit
+			relayLog.Lvl2("Relay : dropping the cell of the disrupted round", roundID)
+			return nil
+		}
+		upstreamPlaintext = content
 		if !p.relayState.EquivocationProtectionEnabled {
 			// Saving in history
 			p.relayState.LastMessageOfClients[roundID] = upstreamPlaintext
@@ -453,17 +939,38 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 		}
 
 	}
-	log.Lvl4("Decoded cell is", upstreamPlaintext)
+	relayLog.Lvl4("Decoded cell is", upstreamPlaintext)
+
+	// the payloads of the warm-up rounds are synthetic, they do not go to the exit
+	if p.relayState.warmup.covers(roundID) {
+		p.checkWarmupRound(roundID, upstreamPlaintext)
+		return nil
+	}
+
+	if p.relayState.payloadTransform.Enabled() {
+		return p.decodeTransformedPayload(roundID, upstreamPlaintext)
+	}
+
+	// with super-rounds, the decoded cell holds several payloads, processed one after the other
+	for _, payload := range splitSuperRound(upstreamPlaintext, p.relayState.CellsPerRound, p.relayState.PayloadSize) {
+		if err := p.processUpstreamPayload(roundID, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// processUpstreamPayload handles one decoded payload: latency-test and pcap messages, statistics, and the exit
+func (p *PriFiLibRelayInstance) processUpstreamPayload(roundID int32, upstreamPlaintext []byte) error {
 
 	// check if we have a latency test message, or a pcap meta message
 	if len(upstreamPlaintext) >= 2 {
 		pattern := int(binary.BigEndian.Uint16(upstreamPlaintext[0:2]))
-		if pattern == 43690 {
-			// 1010101010101010
+		if isLatencyProbe(upstreamPlaintext) {
 			// then, we simply have to send it down
-			// log.Info("Relay noticed a latency-test message on round", p.relayState.dcnetRoundManager.CurrentRound())
-			p.relayState.PriorityDataForClients <- upstreamPlaintext
-		} else if pattern == 21845 {
+			p.echoLatencyProbe(upstreamPlaintext)
+		} else if pattern == PAYLOAD_PATTERN_PCAP_META {
 			//0101010101010101
 			clientID := uint16(binary.BigEndian.Uint16(upstreamPlaintext[2:4]))
 			ID := uint32(binary.BigEndian.Uint32(upstreamPlaintext[4:8]))
@@ -475,7 +982,7 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 			now := prifilog.MsTimeStampNow() - int64(p.relayState.time0)
 			diff := now - timestamp
 
-			log.Lvl2("Got a PCAP meta-message (client", clientID, "id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
+			relayLog.Lvl2("Got a PCAP meta-message (client", clientID, "id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
 			p.relayState.timeStatistics["pcap-delay"].AddTime(diff)
 			p.relayState.pcapLogger.ReceivedPcap(ID, clientID, frag, uint64(timestamp), p.relayState.time0, uint32(len(upstreamPlaintext)))
 
@@ -497,7 +1004,7 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 				now := prifilog.MsTimeStampNow() - int64(p.relayState.time0)
 				diff := now - timestamp
 
-				log.Lvl2("Got a PCAP meta-message (client", clientID, "id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
+				relayLog.Lvl2("Got a PCAP meta-message (client", clientID, "id", ID, ",frag", frag, ") at", now, ", delay since original is", diff, "ms")
 				p.relayState.timeStatistics["pcap-delay"].AddTime(diff)
 				p.relayState.pcapLogger.ReceivedPcap(uint32(ID), clientID, frag, uint64(timestamp), p.relayState.time0, uint32(len(upstreamPlaintext)))
 
@@ -511,45 +1018,106 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 		// verify that the decoded payload has the correct size
 		expectedSize := p.relayState.PayloadSize
 		if p.relayState.DisruptionProtectionEnabled {
-			// One less because of the b_echo_last flag
-			expectedSize--
+			// One less because of the b_echo_last flag, and the MAC
+			expectedSize -= 1 + dcnet.MACSize(p.relayState.MACAlgorithm)
 		}
 		if p.relayState.EquivocationProtectionEnabled {
 			expectedSize -= 16
 		}
+		if size := p.allocatedUpstreamSize(roundID); size > 0 {
+			expectedSize = size
+		}
 		if len(upstreamPlaintext) != expectedSize {
 			e := "Relay : DecodeCell produced wrong-size payload, " + strconv.Itoa(len(upstreamPlaintext)) + "!=" + strconv.Itoa(p.relayState.PayloadSize)
 			log.Error(e)
 			return errors.New(e)
 		}
 
-		if p.relayState.DataOutputEnabled {
+		p.relayState.sessionSummary.AddBytes(int64(len(upstreamPlaintext)), 0)
+		contentType, usefulBytes := classifyPayload(upstreamPlaintext)
+		p.relayState.contentStatistics.AddPayload(contentType, usefulBytes, len(upstreamPlaintext))
+		p.relayState.roundJournal.payload(roundID, contentType, usefulBytes)
+		if p.relayState.slotSizes != nil {
+			p.recordSlotUse(roundID, upstreamPlaintext, usefulBytes)
+		}
+		if contentType == prifilog.CONTENT_DATA || contentType == prifilog.CONTENT_SOCKS_CONNECT {
+			p.recordSlotAnonymity(roundID)
+		}
+		if p.relayState.flowCapture != nil {
+			p.captureDecodedPayload(roundID, upstreamPlaintext)
+		}
+		if p.relayState.mirrorSink != nil {
+			p.relayState.mirrorSink.Mirror(roundID, upstreamPlaintext)
+		}
+
+		if p.relayState.bandwidthCap != nil && (p.relayState.egressQueue != nil || p.relayState.DataOutputEnabled) {
+			p.relayState.bandwidthCap.Sent(int64(usefulBytes))
+		}
+		if p.relayState.egressQueue != nil {
+			p.relayState.egressQueue.Push(upstreamPlaintext)
+		} else if p.relayState.DataOutputEnabled {
 			p.relayState.DataFromDCNet <- upstreamPlaintext
+		} else {
+			p.releaseDecodedCell(upstreamPlaintext)
 		}
 	}
 
 	return nil
 }
 
+// captureDecodedPayload labels the decoded payload with its round, slot and reception time, and writes it to the flow capture
+func (p *PriFiLibRelayInstance) captureDecodedPayload(roundID int32, payload []byte) {
+	slotIndex := -1 // unknown, e.g. round 0 has no downstream data
+	if sent := p.relayState.roundManager.GetDataAlreadySent(roundID); sent != nil {
+		slotIndex = sent.OwnershipID
+	}
+	label := utils.FlowLabel{
+		RoundID:    roundID,
+		SlotIndex:  slotIndex,
+		ReceivedAt: time.Now(),
+	}
+	relayLog.Lvl3("Relay : decoded payload", label.String())
+
+	if err := p.relayState.flowCapture.WritePacket(label, payload); err != nil {
+		log.Error("Relay : could not write to the flow capture, disabling it;", err)
+		p.relayState.flowCapture.Close()
+		p.relayState.flowCapture = nil
+	}
+}
+
 // upstreamPhase3_FinalizeRound happens when the data for the upstream round has been collected, and essentially
 // close the current round
 func (p *PriFiLibRelayInstance) upstreamPhase3_finalizeRound(roundID int32) error {
 
 	p.relayState.numberOfNonAckedDownstreamPackets--
 	p.relayState.numberOfConsecutiveFailedRounds = 0
-
-	// collects timing experiments
-	if roundID == 0 {
-		log.Lvl2("Relay finished round " + strconv.Itoa(int(roundID)) + " .")
+	p.relayState.sessionSummary.AddRound()
+	p.relayState.currentEpoch.rounds++
+	p.relayState.availabilityStatistics.RoundCompleted(p.relayState.nClients, p.relayState.nTrustees)
+	p.latencyProbeEchoed(roundID)
+
+	// collects timing experiments; the first round of a schedule, in which the clients receive it, counts in the setup
+	if roundID == p.relayState.scheduleFirstRound {
+		relayLog.Lvl2("Relay finished round " + strconv.Itoa(int(roundID)) + " .")
+		p.endSetup()
 	} else {
-		log.Lvl2("Relay finished round "+strconv.Itoa(int(roundID))+" (after", p.relayState.roundManager.TimeSpentInRound(roundID), ").")
-		p.collectExperimentResult(p.relayState.bitrateStatistics.Report())
-		p.collectExperimentResult(p.relayState.schedulesStatistics.Report())
+		relayLog.Lvl2("Relay finished round "+strconv.Itoa(int(roundID))+" (after", p.relayState.roundManager.TimeSpentInRound(roundID), ").")
+		p.collectExperimentResult(p.relayState.bitrateStatistics.ReportWithInfo(p.statisticsInfo("")))
+		p.collectExperimentResult(p.relayState.schedulesStatistics.ReportWithInfo(p.statisticsInfo("")))
+		p.collectExperimentResult(p.relayState.contentStatistics.ReportWithInfo(p.statisticsInfo("")))
+		if report := p.relayState.pacer.report(time.Now()); report != "" {
+			relayLog.Lvl1(report)
+			p.collectExperimentResult(report)
+		}
 		timeSpent := p.relayState.roundManager.TimeSpentInRound(roundID)
 		p.relayState.timeStatistics["round-duration"].AddTime(timeSpent.Nanoseconds() / 1e6) //ms
+		if p.relayState.warmup.covers(roundID) {
+			p.finishWarmupRound(roundID, timeSpent)
+		}
 		for k, v := range p.relayState.timeStatistics {
-			p.collectExperimentResult(v.ReportWithInfo(k))
+			p.collectExperimentResult(v.ReportWithInfo(p.statisticsInfo(k)))
 		}
+		p.relayState.messageStatistics.Report()
 		if false && roundID%1000 == 0 {
 			log.Info("Round", roundID, "Relay Memory\n", memoryUsage())
 			memoryUsage2()
@@ -565,15 +1133,17 @@ func (p *PriFiLibRelayInstance) upstreamPhase3_finalizeRound(roundID int32) erro
 	// Test if we are doing an experiment, and if we need to stop at some point.
 	newRound := p.relayState.roundManager.CurrentRound()
 	if newRound == int32(p.relayState.ExperimentRoundLimit) {
-		log.Lvl1("Relay : Experiment round limit (", newRound, ") reached")
-		p.relayState.ExperimentResultChannel <- p.relayState.ExperimentResultData
+		relayLog.Lvl1("Relay : Experiment round limit (", newRound, ") reached")
 
-		// shut down everybody
-		msg := net.ALL_ALL_SHUTDOWN{}
+		// shut down everybody, then give the results, which include the shutdown report
+		msg := net.ALL_ALL_SHUTDOWN{Reason: "experiment round limit reached"}
 		p.Received_ALL_ALL_SHUTDOWN(msg)
+		p.relayState.ExperimentResultChannel <- p.relayState.ExperimentResultData
 	}
 
 	p.relayState.roundManager.CloseRound()
+	p.relayState.roundJournal.closed(roundID, ROUND_DECODED, nil, nil, time.Now())
+	p.proposeExperimentStep(roundID)
 
 	// clean history
 	for _, m := range p.relayState.CiphertextsHistoryTrustees {
@@ -607,10 +1177,12 @@ have the data already (and we're not waiting on it). Clean the old data.
 func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 	var downstreamCellContent []byte
+	nextDownstreamRoundID := p.relayState.roundManager.NextRoundToOpen()
 
 	select {
 	case downstreamCellContent = <-p.relayState.PriorityDataForClients:
-		log.Lvl3("Relay : We have some priority data for the clients")
+		relayLog.Lvl3("Relay : We have some priority data for the clients")
+		p.latencyProbeSent(nextDownstreamRoundID, downstreamCellContent)
 	// TODO : maybe we can pack more than one message here ?
 
 	default:
@@ -635,8 +1207,8 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		if p.relayState.BEchoFlags[p.relayState.roundManager.lastRoundClosed] == 1 {
 			previousRound := p.relayState.roundManager.lastRoundClosed - int32(p.relayState.nClients)
 			downstreamCellContent = p.relayState.LastMessageOfClients[previousRound]
-			log.Lvl1("b_echo_last=1 on round", p.relayState.roundManager.lastRoundClosed, "retransmitting upstream of round", previousRound)
-			log.Lvl1(downstreamCellContent)
+			relayLog.Lvl1("b_echo_last=1 on round", p.relayState.roundManager.lastRoundClosed, "retransmitting upstream of round", previousRound)
+			relayLog.Lvl1(downstreamCellContent)
 		}
 	}
 
@@ -647,8 +1219,6 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		downstreamCellContent = data
 	}
 
-	nextDownstreamRoundID := p.relayState.roundManager.NextRoundToOpen()
-
 	// used if we're replaying a pcap. The first message we decode is "time0"
 	if nextDownstreamRoundID == 1 {
 		p.relayState.time0 = uint64(prifilog.MsTimeStampNow())
@@ -667,12 +1237,20 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 	//compute next owner
 	nextOwner := p.relayState.roundManager.UpdateAndGetNextOwnerID()
 
+	//with variable slot sizes, the upstream cell is as large as the slot needs
+	allocatedUpstreamSize := 0
+	if p.relayState.slotSizes != nil && !flagOpenClosedRequest {
+		allocatedUpstreamSize = p.relayState.slotSizes.size(nextOwner)
+	}
+
 	//sending data part
-	timing.StartMeasure("sending-data")
+	roundTimer := timing.NewTimer("round-" + strconv.Itoa(int(nextDownstreamRoundID)))
+	p.relayState.roundTimers[nextDownstreamRoundID] = roundTimer
+	sendingTimer := roundTimer.NewChild("sending-data")
 	if flagOpenClosedRequest {
-		log.Lvl2("Relay is gonna broadcast messages for round "+strconv.Itoa(int(nextDownstreamRoundID))+" (OCRequest=true), owner=", nextOwner, ", len", len(downstreamCellContent))
+		schedulerLog.Lvl2("Relay is gonna broadcast messages for round "+strconv.Itoa(int(nextDownstreamRoundID))+" (OCRequest=true), owner=", nextOwner, ", len", len(downstreamCellContent))
 	} else {
-		log.Lvl2("Relay is gonna broadcast messages for round "+strconv.Itoa(int(nextDownstreamRoundID))+" (OCRequest=false), owner=", nextOwner, ", len", len(downstreamCellContent))
+		schedulerLog.Lvl2("Relay is gonna broadcast messages for round "+strconv.Itoa(int(nextDownstreamRoundID))+" (OCRequest=false), owner=", nextOwner, ", len", len(downstreamCellContent))
 	}
 
 	toSend := &net.REL_CLI_DOWNSTREAM_DATA{
@@ -681,7 +1259,8 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		HashOfPreviousUpstreamData: p.relayState.HashOfLastUpstreamMessage[:],
 		Data:                       downstreamCellContent,
 		FlagResync:                 flagResync,
-		FlagOpenClosedRequest:      flagOpenClosedRequest}
+		FlagOpenClosedRequest:      flagOpenClosedRequest,
+		AllocatedUpstreamSize:      allocatedUpstreamSize}
 
 	if roundOpened, _ := p.relayState.roundManager.currentRound(); !roundOpened {
 		//prepare for the next round (this empties the dc-net buffer, making them ready for a new round)
@@ -690,32 +1269,48 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 	p.relayState.roundManager.OpenNextRound()
 	p.relayState.roundManager.SetDataAlreadySent(nextDownstreamRoundID, toSend)
+	p.recordDownstreamHistory(nextDownstreamRoundID, downstreamCellContent)
+	p.relayState.roundJournal.opened(nextDownstreamRoundID, p.relayState.scheduleEpoch, nextOwner, flagOpenClosedRequest,
+		len(downstreamCellContent), time.Now())
+	p.pipelineBufferedCiphers(nextDownstreamRoundID)
+	p.relayState.delivery.Sent(nextDownstreamRoundID)
 
 	if !p.relayState.UseUDP {
 		// broadcast to all clients
 		for i := 0; i < p.relayState.nClients; i++ {
+			if p.relayState.clientsLeft[i] {
+				continue
+			}
 			//send to the i-th client
 			p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", round "+strconv.Itoa(int(nextDownstreamRoundID))+")")
 		}
 
 		p.relayState.bitrateStatistics.AddDownstreamCell(int64(len(downstreamCellContent)))
+		p.relayState.sessionSummary.AddBytes(0, int64(len(downstreamCellContent)*p.nActiveClients()))
+		if p.relayState.bandwidthCap != nil {
+			p.relayState.bandwidthCap.Sent(int64(len(downstreamCellContent) * p.nActiveClients()))
+		}
 	} else {
 		toSend2 := &net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *toSend}
 		p.messageSender.BroadcastToAllClientsWithLog(toSend2, "(UDP broadcast, round "+strconv.Itoa(int(nextDownstreamRoundID))+")")
 
-		p.relayState.bitrateStatistics.AddDownstreamUDPCell(int64(len(downstreamCellContent)), p.relayState.nClients)
+		p.relayState.bitrateStatistics.AddDownstreamUDPCell(int64(len(downstreamCellContent)), p.nActiveClients())
+		p.relayState.sessionSummary.AddBytes(0, int64(len(downstreamCellContent)))
+		if p.relayState.bandwidthCap != nil {
+			p.relayState.bandwidthCap.Sent(int64(len(downstreamCellContent)))
+		}
 	}
 
-	timeMs := timing.StopMeasure("sending-data").Nanoseconds() / 1e6
+	timeMs := sendingTimer.Stop().Nanoseconds() / 1e6
 	p.relayState.timeStatistics["sending-data"].AddTime(timeMs)
 
-	log.Lvl3("Relay is done broadcasting messages for round " + strconv.Itoa(int(nextDownstreamRoundID)) + ".")
+	relayLog.Lvl3("Relay is done broadcasting messages for round " + strconv.Itoa(int(nextDownstreamRoundID)) + ".")
 
 	//we just sent the data down, initiating a round. Let's prevent being blocked by a dead client
 	go p.checkIfRoundHasEndedAfterTimeOut_Phase1(nextDownstreamRoundID)
 
 	//now relay enters a waiting state (collecting all ciphers from clients/trustees)
-	timing.StartMeasure("waiting-on-someone")
+	roundTimer.NewChild("waiting-on-someone")
 
 	p.relayState.numberOfNonAckedDownstreamPackets++
 
@@ -728,10 +1323,11 @@ We do nothing, until we have received one per trustee; Then, we pack them in one
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK) error {
 
-	p.relayState.trustees[msg.TrusteeID] = NodeRepresentation{msg.TrusteeID, true, msg.Pk, msg.Pk}
+	p.relayState.trustees[msg.TrusteeID] = NodeRepresentation{msg.TrusteeID, true, msg.Pk, msg.Pk, nil}
+	p.relayState.trusteesKeyEndorsements[msg.TrusteeID] = msg.Endorsement
 	p.relayState.nTrusteesPkCollected++
 
-	log.Lvl2("Relay : received TRU_REL_TELL_PK (" + strconv.Itoa(p.relayState.nTrusteesPkCollected) + "/" + strconv.Itoa(p.relayState.nTrustees) + ")")
+	relayLog.Lvl2("Relay : received TRU_REL_TELL_PK (" + strconv.Itoa(p.relayState.nTrusteesPkCollected) + "/" + strconv.Itoa(p.relayState.nTrustees) + ")")
 
 	// if we have them all...
 	if p.relayState.nTrusteesPkCollected == p.relayState.nTrustees {
@@ -749,11 +1345,34 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK
 		toSend.Add("UseUDP", p.relayState.UseUDP)
 		toSend.Add("StartNow", true)
 		toSend.Add("PayloadSize", p.relayState.PayloadSize)
+		toSend.Add("CellsPerRound", p.relayState.CellsPerRound)
 		toSend.Add("DCNetType", p.relayState.dcNetType)
 		toSend.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
+		toSend.Add("DisruptionProtectionMAC", dcnet.MACAlgorithmName(p.relayState.MACAlgorithm))
 		toSend.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
 		toSend.Add("ForceDisruptionSinceRound3", p.relayState.ForceDisruptionSinceRound3)
+		toSend.Add("TrusteeQuorum", p.relayState.TrusteeQuorum)
+		toSend.Add("MaxSlotsPerClient", p.relayState.MaxSlotsPerClient)
+		toSend.Add("CryptoSuite", config.CryptoSuiteName())
+		toSend.Add("RandomBeacon", p.relayState.RandomBeacon.String())
+		if p.relayState.warmup != nil {
+			toSend.Add("WarmupRounds", int(p.relayState.warmup.rounds))
+		}
+		if p.relayState.TransportOffers != "" {
+			toSend.Add("Transports", p.relayState.TransportOffers)
+		}
+		if p.relayState.payloadTransform.Enabled() {
+			toSend.Add("PayloadTransform", p.relayState.payloadTransform.String())
+		}
+		if p.relayState.SocksCredentials != "" {
+			toSend.Add("SocksCredentials", p.relayState.SocksCredentials)
+		}
+		if p.relayState.historyCheck != nil {
+			toSend.Add("HistoryDigestInterval", p.relayState.historyCheck.interval)
+		}
 		toSend.TrusteesPks = trusteesPk
+		p.relayState.clientParams = toSend
+		p.relayState.clientParamsDigest = toSend.ParamsDigest()
 
 		// Send those parameters to all clients
 		for j := 0; j < p.relayState.nClients; j++ {
@@ -771,14 +1390,29 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK
 Received_CLI_REL_TELL_PK_AND_EPH_PK handles CLI_REL_TELL_PK_AND_EPH_PK messages.
 Those are sent by the client to tell their identity.
 We do nothing until we have collected one per client; then, we pack them in one message
-and send them to the first trustee for it to Neff-Shuffle them.
+and send them to the first trustee for it to Neff-Shuffle them. A client asking for several slots
+gives one ephemeral key per slot, which are all shuffled; we grant at most MaxSlotsPerClient.
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg net.CLI_REL_TELL_PK_AND_EPH_PK) error {
 
-	p.relayState.clients[msg.ClientID] = NodeRepresentation{msg.ClientID, true, msg.Pk, msg.EphPk}
+	if err := p.checkClientIdentity(msg); err != nil {
+		return err
+	}
+	if p.relayState.clients[msg.ClientID].Connected {
+		// the same client sent its keys twice, e.g. after a reconnection
+		relayLog.Lvl2("Relay : client", msg.ClientID, "sent its public keys again, ignoring them")
+		return nil
+	}
+
+	extraEphPks := msg.ExtraEphPks
+	if len(extraEphPks) > p.relayState.MaxSlotsPerClient-1 {
+		schedulerLog.Lvl2("Relay : client", msg.ClientID, "asked for", len(extraEphPks)+1, "slots, granting", p.relayState.MaxSlotsPerClient)
+		extraEphPks = extraEphPks[:p.relayState.MaxSlotsPerClient-1]
+	}
+	p.relayState.clients[msg.ClientID] = NodeRepresentation{msg.ClientID, true, msg.Pk, msg.EphPk, extraEphPks}
 	p.relayState.nClientsPkCollected++
 
-	log.Lvl2("Relay : received CLI_REL_TELL_PK_AND_EPH_PK (" + strconv.Itoa(p.relayState.nClientsPkCollected) + "/" + strconv.Itoa(p.relayState.nClients) + ")")
+	relayLog.Lvl2("Relay : received CLI_REL_TELL_PK_AND_EPH_PK (" + strconv.Itoa(p.relayState.nClientsPkCollected) + "/" + strconv.Itoa(p.relayState.nClients) + ")")
 
 	// if we have collected all clients, continue
 	if p.relayState.nClientsPkCollected == p.relayState.nClients {
@@ -786,35 +1420,74 @@ func (p *PriFiLibRelayInstance) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg net.CLI_
 		timing.StopMeasureAndLogWithInfo("resync-shuffle-collect-client-pk", strconv.Itoa(p.relayState.nClients))
 		timing.StartMeasure("resync-shuffle-trustee-1step")
 
-		p.relayState.neffShuffle.Init(p.relayState.nTrustees)
+		return p.startShuffle()
+	}
 
-		for i := 0; i < p.relayState.nClients; i++ {
-			p.relayState.neffShuffle.AddClient(p.relayState.clients[i].EphemeralPublicKey)
-		}
+	return nil
+}
 
-		msg, trusteeID, err := p.relayState.neffShuffle.SendToNextTrustee()
-		if err != nil {
-			e := "Could not do p.relayState.neffShuffle.SendToNextTrustee, error is " + err.Error()
+// startShuffle sends the ephemeral keys of all clients to the first trustee, which starts the Neff-Shuffle of the
+// schedule whose first round is scheduleFirstRound. The schedule is a new epoch : the ciphers still buffered for the
+// previous ones are dropped, and so are the ones which arrive late, computed with the previous secrets.
+func (p *PriFiLibRelayInstance) startShuffle() error {
+	p.relayState.setupStatistics.StartPhase(prifilog.SETUP_SHUFFLE, time.Now())
+	p.relayState.scheduleEpoch++
+	if dropped := p.relayState.roundManager.Flush(p.relayState.scheduleEpoch); dropped > 0 {
+		relayLog.Lvl2("Relay : dropped", dropped, "buffered ciphers of the previous schedules")
+	}
+	p.relayState.roundJournal.abandon(time.Now())
+
+	p.relayState.nVkeysCollected = 0
+	p.relayState.neffShuffle.Init(p.relayState.nTrustees)
+	if p.relayState.RandomBeacon != nil {
+		if err := p.relayState.neffShuffle.SetBeacon(p.relayState.RandomBeacon); err != nil {
+			e := "Could not do p.relayState.neffShuffle.SetBeacon, error is " + err.Error()
 			log.Error(e)
 			return errors.New(e)
 		}
-		toSend := msg.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	}
 
-		//todo: fix this. The neff shuffle now stores twices the ephemeral public keys
-		toSend.Pks = make([]kyber.Point, p.relayState.nClients)
-		for i := 0; i < p.relayState.nClients; i++ {
-			toSend.Pks[i] = p.relayState.clients[i].PublicKey
+	for i := 0; i < p.relayState.nClients; i++ {
+		if p.relayState.clientsLeft[i] {
+			continue
 		}
+		p.relayState.neffShuffle.AddClient(p.relayState.clients[i].EphemeralPublicKey)
+		for _, extraEphPk := range p.relayState.clients[i].ExtraEphemeralPublicKeys {
+			p.relayState.neffShuffle.AddClient(extraEphPk)
+		}
+	}
 
-		// send to the 1st trustee
-		p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(0-th iteration)")
-
-		p.stateMachine.ChangeState("COLLECTING_SHUFFLES")
+	msg, trusteeID, err := p.relayState.neffShuffle.SendToNextTrustee()
+	if err != nil {
+		e := "Could not do p.relayState.neffShuffle.SendToNextTrustee, error is " + err.Error()
+		log.Error(e)
+		return errors.New(e)
 	}
+	toSend := msg.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	toSend.RoundID = p.relayState.scheduleFirstRound
+	toSend.Epoch = p.relayState.scheduleEpoch
 
+	//todo: fix this. The neff shuffle now stores twices the ephemeral public keys
+	toSend.Pks = p.clientPublicKeys()
+
+	// send to the 1st trustee
+	p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(0-th iteration)")
+
+	p.stateMachine.ChangeState("COLLECTING_SHUFFLES")
 	return nil
 }
 
+// clientPublicKeys returns the public keys of the clients in the group, without the ones which left the session
+func (p *PriFiLibRelayInstance) clientPublicKeys() []kyber.Point {
+	pks := make([]kyber.Point, 0, p.nActiveClients())
+	for i := 0; i < p.relayState.nClients; i++ {
+		if !p.relayState.clientsLeft[i] {
+			pks = append(pks, p.relayState.clients[i].PublicKey)
+		}
+	}
+	return pks
+}
+
 /*
 Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS handles TRU_REL_TELL_NEW_BASE_AND_EPH_PKS messages.
 Those are sent by the trustees once they finished a Neff-Shuffle.
@@ -827,6 +1500,7 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 	p.relayState.VerifiableDCNetKeys[p.relayState.nVkeysCollected] = msg.VerifiableDCNetKey
 	p.relayState.nVkeysCollected++
 	p.relayState.EphemeralPublicKeys = msg.NewEphPks
+	p.relayState.scheduleBase = msg.NewBase
 	done, err := p.relayState.neffShuffle.ReceivedShuffleFromTrustee(msg.NewBase, msg.NewEphPks, msg.Proof)
 	if err != nil {
 		e := "Relay : error in p.relayState.neffShuffle.ReceivedShuffleFromTrustee " + err.Error()
@@ -844,12 +1518,11 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 			return errors.New(e)
 		}
 		toSend := msg.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+		toSend.RoundID = p.relayState.scheduleFirstRound
+		toSend.Epoch = p.relayState.scheduleEpoch
 
 		//todo: fix this. The neff shuffle now stores twices the ephemeral public keys
-		toSend.Pks = make([]kyber.Point, p.relayState.nClients)
-		for i := 0; i < p.relayState.nClients; i++ {
-			toSend.Pks[i] = p.relayState.clients[i].PublicKey
-		}
+		toSend.Pks = p.clientPublicKeys()
 
 		// send to the i-th trustee
 		p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "("+strconv.Itoa(trusteeID)+"-th iteration)")
@@ -859,6 +1532,7 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 
 		timing.StopMeasureAndLogWithInfo("resync-shuffle-trustee-1step", strconv.Itoa(p.relayState.nClients))
 		timing.StartMeasure("resync-shuffle-trustee-2step")
+		p.relayState.setupStatistics.StartPhase(prifilog.SETUP_SIGNATURES, time.Now())
 
 		msg, err := p.relayState.neffShuffle.SendTranscript()
 		if err != nil {
@@ -875,11 +1549,13 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 			p.messageSender.SendToTrusteeWithLog(j, toSend, "(trustee "+strconv.Itoa(j+1)+")")
 		}
 
-		p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize,
+		p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize*p.relayState.CellsPerRound,
 			p.relayState.EquivocationProtectionEnabled, nil)
+		p.relayState.DCNet.MACAlgorithm = p.relayState.MACAlgorithm
+		p.setupCellPool()
 
 		// prepare to collect the ciphers
-		p.relayState.DCNet.DecodeStart(0)
+		p.relayState.DCNet.DecodeStart(p.relayState.scheduleFirstRound)
 
 		p.stateMachine.ChangeState("COLLECTING_SHUFFLE_SIGNATURES")
 
@@ -888,6 +1564,33 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 	return nil
 }
 
+/*
+Received_TRU_REL_SHUFFLE_REJECTED handles TRU_REL_SHUFFLE_REJECTED messages.
+A trustee could not verify the proof of one shuffle of the transcript. We verify this shuffle again : if it is
+invalid, the trustee which did it cheated, otherwise the trustee rejecting it lied (or its copy of the transcript
+was altered). The trustees cannot be replaced during the session, so we end it, blaming the cheater.
+*/
+func (p *PriFiLibRelayInstance) Received_TRU_REL_SHUFFLE_REJECTED(msg net.TRU_REL_SHUFFLE_REJECTED) error {
+
+	if msg.Shuffle < 0 || msg.Shuffle >= p.relayState.nTrustees {
+		e := "Relay : trustee " + strconv.Itoa(msg.TrusteeID) + " rejected shuffle " + strconv.Itoa(msg.Shuffle) + ", which does not exist"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	cheater := msg.TrusteeID
+	reason := "rejected the valid shuffle of trustee " + strconv.Itoa(msg.Shuffle) + " (" + msg.Reason + ")"
+	if err := p.relayState.neffShuffle.VerifyShuffle(msg.Shuffle); err != nil {
+		cheater = msg.Shuffle
+		reason = "did an invalid shuffle (" + err.Error() + "), rejected by trustee " + strconv.Itoa(msg.TrusteeID)
+	}
+
+	log.Error("Relay : trustee", cheater, reason, "; the trustees cannot be replaced during the session, ending it")
+	p.relayState.sessionSummary.SetShutdownReason("trustee "+strconv.Itoa(cheater)+" "+reason, true)
+	p.relayState.timeoutHandler(nil, []int{cheater})
+	return nil
+}
+
 /*
 Received_TRU_REL_SHUFFLE_SIG handles TRU_REL_SHUFFLE_SIG messages.
 Those contain the signature from the NeffShuffleS-transcript from one trustee.
@@ -919,20 +1622,59 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_SHUFFLE_SIG(msg net.TRU_REL_SHU
 			return errors.New(e)
 		}
 		msg := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+		msg.RoundID = p.relayState.scheduleFirstRound
+		msg.Epoch = p.relayState.scheduleEpoch
+		msg.RelayPk = config.CryptoSuite.Point().Mul(p.relayState.privateKey, msg.Base)
+		if err := p.rotateMACKeys(msg.Epoch, msg.EphPks); err != nil {
+			e := "Relay : could not derive the MAC keys of the slots, " + err.Error()
+			log.Error(e)
+			return errors.New(e)
+		}
+
+		// the slots change owners : what their decoders still hold comes from the previous ones
+		if err := p.flushPayloadDecoders(); err != nil {
+			return err
+		}
+
+		// there is one slot per shuffled ephemeral key, more than nClients if some clients own several slots
+		p.relayState.nSlots = len(msg.EphPks)
+		p.relayState.roundManager.SetNumberOfSlots(p.relayState.nSlots)
+
+		p.recordSetupTranscript(trusteesPks)
+		if p.relayState.epochRotation != nil {
+			p.relayState.epochRotation.scheduleStarted()
+		}
+
 		// changing state
-		p.relayState.roundManager.OpenNextRound()
-		log.Lvl2("Relay : ready to communicate.")
+		firstRoundID := p.relayState.roundManager.OpenNextRound()
+		p.pipelineBufferedCiphers(firstRoundID)
+		relayLog.Lvl2("Relay : ready to communicate.")
 		p.stateMachine.ChangeState("COMMUNICATING")
+		p.relayState.setupStatistics.StartPhase(prifilog.SETUP_FIRST_ROUND, time.Now())
 
 		timing.StopMeasureAndLogWithInfo("resync-shuffle-trustee-2step", strconv.Itoa(p.relayState.nClients))
 		timing.StopMeasureAndLogWithInfo("resync-shuffle", strconv.Itoa(p.relayState.nClients))
 		timing.StopMeasureAndLogWithInfo("resync", strconv.Itoa(p.relayState.nClients))
 
-		// broadcast to all clients
+		// broadcast to all clients, after the digest of their parameters, which they check before sending any data.
+		// When clients joined during the session, the others already checked it
+		digest := &net.REL_CLI_PARAMS_DIGEST{Digest: p.relayState.clientParamsDigest}
 		for i := 0; i < p.relayState.nClients; i++ {
-			// send to the i-th client
+			if p.relayState.clientsLeft[i] {
+				continue
+			}
+			// send to the i-th client; a client which joined got its own parameters
+			if p.relayState.rekeying == nil {
+				p.messageSender.SendToClientWithLog(i, digest, "(client "+strconv.Itoa(i+1)+")")
+			} else if p.relayState.rekeying.hasJoined(i) {
+				joinedDigest := &net.REL_CLI_PARAMS_DIGEST{Digest: p.relayState.rekeying.paramsDigests[i]}
+				p.messageSender.SendToClientWithLog(i, joinedDigest, "(client "+strconv.Itoa(i+1)+")")
+			}
 			p.messageSender.SendToClientWithLog(i, msg, "(client "+strconv.Itoa(i+1)+")")
 		}
+		if p.relayState.rekeying != nil {
+			p.finishRekeying()
+		}
 
 		//client will answer will CLI_REL_UPSTREAM_DATA. There is no data down on round 0. We set the following variable to 1 since the reception of CLI_REL_UPSTREAM_DATA decrements it.
 		p.relayState.numberOfNonAckedDownstreamPackets = 1
@@ -941,13 +1683,36 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_SHUFFLE_SIG(msg net.TRU_REL_SHU
 	return nil
 }
 
-// ValidateHmac256 returns true iff the recomputed HMAC is equal to the given one
-func ValidateHmac256(message, inputHmac []byte, clientID int) bool {
-	key := []byte("client-secret" + strconv.Itoa(clientID)) // quick hack, this should be a random shared secret
-	h := hmac.New(sha256.New, key)
-	h.Write(message)
-	computedHmac := h.Sum(nil)
-	return bytes.Equal(inputHmac, computedHmac)
+// endSetup ends the setup once the first round of its schedule is finished, and reports it apart from the rounds
+func (p *PriFiLibRelayInstance) endSetup() {
+	if report := p.relayState.setupStatistics.EndSetup(time.Now()); report != "" {
+		relayLog.Lvl1(report)
+		p.collectExperimentResult(report)
+	}
+}
+
+// recordSetupTranscript hashes the transcript of the shuffle we just finished for the epoch summary, and writes it to
+// TranscriptExportPath if set. Failing to do so is not fatal for the protocol
+func (p *PriFiLibRelayInstance) recordSetupTranscript(trusteesPks []kyber.Point) {
+	transcript, err := p.relayState.neffShuffle.ExportTranscript(trusteesPks, p.relayState.trusteesKeyEndorsements)
+	if err != nil {
+		log.Error("Relay : could not export the setup transcript,", err)
+		return
+	}
+	data, err := transcript.ToBytes()
+	if err != nil {
+		log.Error("Relay : could not encode the setup transcript,", err)
+		return
+	}
+	p.setTranscriptHash(data)
+	if p.relayState.TranscriptExportPath == "" {
+		return
+	}
+	if err := ioutil.WriteFile(p.relayState.TranscriptExportPath, data, 0644); err != nil {
+		log.Error("Relay : could not write the setup transcript to", p.relayState.TranscriptExportPath, err)
+		return
+	}
+	relayLog.Lvl2("Relay : setup transcript written to", p.relayState.TranscriptExportPath)
 }
 
 // updates p.relayState.ExperimentResultData
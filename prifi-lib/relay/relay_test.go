@@ -8,7 +8,9 @@ import (
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
@@ -402,7 +404,14 @@ func TestRelayRun1(t *testing.T) {
 		t.Error("In wrong state ! we should be in COMMUNICATING, but are in ", relay.stateMachine.State())
 	}
 
-	// should send REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG to clients
+	// should send REL_CLI_PARAMS_DIGEST, then REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG to clients
+	digest, err := getClientMessage("REL_CLI_PARAMS_DIGEST")
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(digest.(*net.REL_CLI_PARAMS_DIGEST).Digest, msg5.ParamsDigest()) {
+		t.Error("The digest should be the one of the parameters sent to the clients")
+	}
 	msg16, err := getClientMessage("REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG")
 	if err != nil {
 		t.Error(err)
@@ -588,7 +597,12 @@ func TestRelayRun2(t *testing.T) {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
 
-	// should send REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG to clients
+	// should send REL_CLI_PARAMS_DIGEST, then REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG to clients
+	digest, err := getClientMessage("REL_CLI_PARAMS_DIGEST")
+	if err != nil {
+		t.Error(err)
+	}
+	_ = digest.(*net.REL_CLI_PARAMS_DIGEST)
 	msg16, err := getClientMessage("REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG")
 	if err != nil {
 		t.Error(err)
@@ -822,7 +836,12 @@ func TestRelayRun3(t *testing.T) {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
 
-	// should send REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG to clients
+	// should send REL_CLI_PARAMS_DIGEST, then REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG to clients
+	digest, err := getClientMessage("REL_CLI_PARAMS_DIGEST")
+	if err != nil {
+		t.Error(err)
+	}
+	_ = digest.(*net.REL_CLI_PARAMS_DIGEST)
 	msg16, err := getClientMessage("REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG")
 	if err != nil {
 		t.Error(err)
@@ -1005,3 +1024,57 @@ func TestRelayRun4(t *testing.T) {
 		t.Error("Relay should output an error when DCNetType != {Simple, Verifiable}")
 	}
 }
+
+func TestShuffleRejected(t *testing.T) {
+
+	// two trustees shuffle two keys; the relay keeps the transcript
+	neff := new(scheduler.NeffShuffle)
+	neff.Init()
+	neff.RelayView.Init(2)
+	for i := 0; i < 2; i++ {
+		pub, _ := crypto.NewKeyPair()
+		neff.RelayView.AddClient(pub)
+	}
+	for i := 0; i < 2; i++ {
+		trustee := new(scheduler.NeffShuffle)
+		trustee.Init()
+		pub, priv := crypto.NewKeyPair()
+		trustee.TrusteeView.Init(i, priv, pub)
+		toSend, _, _ := neff.RelayView.SendToNextTrustee()
+		request := toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+		toSend2, err := trustee.TrusteeView.ReceivedShuffleFromRelay(request.Base, request.EphPks, true, make([]byte, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shuffle := toSend2.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+		neff.RelayView.ReceivedShuffleFromTrustee(shuffle.NewBase, shuffle.NewEphPks, shuffle.Proof)
+	}
+
+	blamed := func(msg net.TRU_REL_SHUFFLE_REJECTED) []int {
+		var missingTrustees []int
+		p := &PriFiLibRelayInstance{relayState: &RelayState{nTrustees: 2, neffShuffle: neff.RelayView}}
+		p.relayState.sessionSummary = prifilog.NewSessionSummary("Relay")
+		p.relayState.timeoutHandler = func(clients, trustees []int) { missingTrustees = trustees }
+		if err := p.Received_TRU_REL_SHUFFLE_REJECTED(msg); err != nil {
+			t.Error(err)
+		}
+		return missingTrustees
+	}
+
+	// the shuffle is valid, the trustee rejecting it lies
+	if ids := blamed(net.TRU_REL_SHUFFLE_REJECTED{TrusteeID: 0, Shuffle: 1}); len(ids) != 1 || ids[0] != 0 {
+		t.Error("The trustee rejecting a valid shuffle should be blamed, got", ids)
+	}
+
+	// the shuffle is invalid, the trustee which did it is blamed
+	neff.RelayView.Proofs[1].Bytes = make([]byte, 50)
+	if ids := blamed(net.TRU_REL_SHUFFLE_REJECTED{TrusteeID: 0, Shuffle: 1}); len(ids) != 1 || ids[0] != 1 {
+		t.Error("The trustee which did an invalid shuffle should be blamed, got", ids)
+	}
+
+	// a shuffle which does not exist
+	p := &PriFiLibRelayInstance{relayState: &RelayState{nTrustees: 2, neffShuffle: neff.RelayView}}
+	if p.Received_TRU_REL_SHUFFLE_REJECTED(net.TRU_REL_SHUFFLE_REJECTED{TrusteeID: 0, Shuffle: 2}) == nil {
+		t.Error("Should not accept the rejection of a shuffle which does not exist")
+	}
+}
@@ -0,0 +1,294 @@
+package relay
+
+/*
+The relay keeps a journal of its last rounds, so that questions like "why did round X stall" can be answered after the
+fact, without verbose logs : when each round was opened and closed, its slot owner and the size of its downstream
+data, when each cipher arrived (relative to the opening; the trustees often send theirs before), the size and content
+of the decoded payload, the entities still missing when it timed out, and how it ended. Each timeout saves a copy of
+the journal, which the later rounds do not overwrite. Both are served on the metrics endpoint (ROUND_JOURNAL_PATH,
+with ?round=<id> for a single round), and the last rounds are written to the logs when the session ends abnormally.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+// ROUND_JOURNAL_PATH is where the journal of the last rounds is exported, in JSON
+const ROUND_JOURNAL_PATH = "/rounds"
+
+// ROUND_JOURNAL_SIZE is the number of rounds the journal keeps
+const ROUND_JOURNAL_SIZE = 512
+
+// ROUND_JOURNAL_LOGGED is the number of rounds written to the logs when the session ends abnormally
+const ROUND_JOURNAL_LOGGED = 20
+
+// The outcomes of the rounds in the journal
+const (
+	ROUND_PENDING   = "pending"   // some ciphers arrived, but the round was not opened yet
+	ROUND_OPEN      = "open"      // the downstream data was sent, the relay waits for the ciphers
+	ROUND_DECODED   = "decoded"   // all the ciphers arrived, and the upstream cell was decoded
+	ROUND_TIMED_OUT = "timed-out" // the round was closed without all its ciphers
+	ROUND_ABANDONED = "abandoned" // the relay was re-configured before the round closed
+)
+
+// RoundJournalEntry is what the relay recorded about a round
+type RoundJournalEntry struct {
+	RoundID         int32
+	Epoch           int32     // of the schedule
+	OpenedAt        time.Time // zero if the round was not opened
+	ClosedAt        time.Time // zero while the round is open
+	DurationMs      float64   // from the opening to the closing, or to now if the round is open
+	Owner           int       // the slot owning the round, -1 if none
+	OpenClosed      bool      // true if the clients sent their open/closed bitmaps in this round
+	DownstreamBytes int
+	UpstreamBytes   int      // the size of the decoded upstream cell
+	UsefulBytes     int      // the bytes of stream data in the decoded payloads
+	Contents        []string // the content type of each decoded payload
+	Ciphers         []JournalCipher
+	MissingClients  []int // the entities whose cipher was missing when the round timed out
+	MissingTrustees []int
+	Outcome         string
+}
+
+// JournalCipher is a cipher the relay accepted for a round
+type JournalCipher struct {
+	Kind       string // prifilog.CLIENT or prifilog.TRUSTEE
+	ID         int
+	Bytes      int
+	AfterMs    float64 // since the round was opened; negative if the cipher came before
+	receivedAt time.Time
+}
+
+// RoundJournalDump is a copy of the journal, saved when a round timed out
+type RoundJournalDump struct {
+	Reason string
+	Time   time.Time
+	Rounds []RoundJournalEntry
+}
+
+// roundJournal keeps the last rounds for the metrics endpoint, which reads them from its own goroutine
+type roundJournal struct {
+	sync.Mutex
+	entries     map[int32]*RoundJournalEntry
+	order       []int32 // the rounds, in the order they entered the journal
+	lastEvicted int32   // the largest round which left the journal, so that a late cipher does not bring it back
+	lastError   *RoundJournalDump
+}
+
+func newRoundJournal() *roundJournal {
+	return &roundJournal{entries: make(map[int32]*RoundJournalEntry), lastEvicted: -1}
+}
+
+// entry returns the entry of roundID, creating it (and forgetting the oldest one) if needed; nil if the round left
+// the journal already. Must be called with the lock held.
+func (j *roundJournal) entry(roundID int32) *RoundJournalEntry {
+	if e, found := j.entries[roundID]; found {
+		return e
+	}
+	if roundID <= j.lastEvicted {
+		return nil
+	}
+	e := &RoundJournalEntry{RoundID: roundID, Owner: -1, Outcome: ROUND_PENDING}
+	j.entries[roundID] = e
+	j.order = append(j.order, roundID)
+	for len(j.order) > ROUND_JOURNAL_SIZE {
+		oldest := j.order[0]
+		j.order = j.order[1:]
+		delete(j.entries, oldest)
+		if oldest > j.lastEvicted {
+			j.lastEvicted = oldest
+		}
+	}
+	return e
+}
+
+// opened records that roundID was opened at now, by sending downstreamBytes to the clients
+func (j *roundJournal) opened(roundID, epoch int32, owner int, openClosed bool, downstreamBytes int, now time.Time) {
+	j.Lock()
+	defer j.Unlock()
+	if e := j.entry(roundID); e != nil {
+		e.Epoch = epoch
+		e.OpenedAt = now
+		e.Owner = owner
+		e.OpenClosed = openClosed
+		e.DownstreamBytes = downstreamBytes
+		e.Outcome = ROUND_OPEN
+	}
+}
+
+// received records that the cipher of a client (or of a trustee) for roundID was accepted at now
+func (j *roundJournal) received(roundID int32, isClient bool, entityID, bytes int, now time.Time) {
+	j.Lock()
+	defer j.Unlock()
+	kind := prifilog.TRUSTEE
+	if isClient {
+		kind = prifilog.CLIENT
+	}
+	if e := j.entry(roundID); e != nil {
+		e.Ciphers = append(e.Ciphers, JournalCipher{Kind: kind, ID: entityID, Bytes: bytes, receivedAt: now})
+	}
+}
+
+// decoded records the size of the upstream cell decoded in roundID
+func (j *roundJournal) decoded(roundID int32, cellBytes int) {
+	j.Lock()
+	defer j.Unlock()
+	if e, found := j.entries[roundID]; found {
+		e.UpstreamBytes = cellBytes
+	}
+}
+
+// payload records the content of a payload decoded in roundID
+func (j *roundJournal) payload(roundID int32, contentType prifilog.ContentType, usefulBytes int) {
+	j.Lock()
+	defer j.Unlock()
+	if e, found := j.entries[roundID]; found {
+		e.Contents = append(e.Contents, contentType.String())
+		e.UsefulBytes += usefulBytes
+	}
+}
+
+// closed records that roundID ended at now with outcome, and the entities whose cipher was missing
+func (j *roundJournal) closed(roundID int32, outcome string, missingClients, missingTrustees []int, now time.Time) {
+	j.Lock()
+	defer j.Unlock()
+	if e, found := j.entries[roundID]; found {
+		e.ClosedAt = now
+		e.Outcome = outcome
+		e.MissingClients = append([]int(nil), missingClients...)
+		e.MissingTrustees = append([]int(nil), missingTrustees...)
+	}
+}
+
+// abandon marks the open rounds as abandoned, and forgets the rounds which were not opened, whose ciphers were
+// computed for the previous configuration
+func (j *roundJournal) abandon(now time.Time) {
+	j.Lock()
+	defer j.Unlock()
+	order := j.order[:0]
+	for _, roundID := range j.order {
+		e := j.entries[roundID]
+		switch e.Outcome {
+		case ROUND_PENDING:
+			delete(j.entries, roundID)
+			continue
+		case ROUND_OPEN:
+			e.ClosedAt = now
+			e.Outcome = ROUND_ABANDONED
+		}
+		order = append(order, roundID)
+	}
+	j.order = order
+}
+
+// saveOnError keeps a copy of the journal, explained by reason, which the next rounds do not overwrite
+func (j *roundJournal) saveOnError(reason string, now time.Time) {
+	rounds := j.rounds(-1, now)
+	j.Lock()
+	defer j.Unlock()
+	j.lastError = &RoundJournalDump{Reason: reason, Time: now, Rounds: rounds}
+}
+
+// rounds returns a copy of the entries, oldest first, or only the one of roundID if it is >= 0
+func (j *roundJournal) rounds(roundID int32, now time.Time) []RoundJournalEntry {
+	j.Lock()
+	defer j.Unlock()
+	res := make([]RoundJournalEntry, 0)
+	for _, id := range j.order {
+		if roundID < 0 || id == roundID {
+			res = append(res, j.entries[id].snapshot(now))
+		}
+	}
+	return res
+}
+
+// lastErrorDump returns the copy saved at the last error, with only the entry of roundID if it is >= 0; nil if none
+func (j *roundJournal) lastErrorDump(roundID int32) *RoundJournalDump {
+	j.Lock()
+	defer j.Unlock()
+	if j.lastError == nil {
+		return nil
+	}
+	dump := *j.lastError
+	if roundID >= 0 {
+		dump.Rounds = make([]RoundJournalEntry, 0)
+		for _, e := range j.lastError.Rounds {
+			if e.RoundID == roundID {
+				dump.Rounds = append(dump.Rounds, e)
+			}
+		}
+	}
+	return &dump
+}
+
+// snapshot returns a copy of the entry, with the durations computed at now
+func (e *RoundJournalEntry) snapshot(now time.Time) RoundJournalEntry {
+	c := *e
+	c.Contents = append([]string(nil), e.Contents...)
+	c.Ciphers = append([]JournalCipher(nil), e.Ciphers...)
+	if !e.OpenedAt.IsZero() {
+		end := e.ClosedAt
+		if end.IsZero() {
+			end = now
+		}
+		c.DurationMs = milliseconds(end.Sub(e.OpenedAt))
+		for i := range c.Ciphers {
+			c.Ciphers[i].AfterMs = milliseconds(c.Ciphers[i].receivedAt.Sub(e.OpenedAt))
+		}
+	}
+	return c
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// String returns a one-line description of the entry, for the logs
+func (e RoundJournalEntry) String() string {
+	str := fmt.Sprintf("Round %v (epoch %v) %s after %vms; owner %v, %v bytes down, %v bytes up (%v useful);",
+		e.RoundID, e.Epoch, e.Outcome, e.DurationMs, e.Owner, e.DownstreamBytes, e.UpstreamBytes, e.UsefulBytes)
+	for _, c := range e.Ciphers {
+		str += fmt.Sprintf(" %s %v at %vms", c.Kind, c.ID, c.AfterMs)
+	}
+	if len(e.MissingClients)+len(e.MissingTrustees) > 0 {
+		str += fmt.Sprintf("; missing clients %v, trustees %v", e.MissingClients, e.MissingTrustees)
+	}
+	return str
+}
+
+// serve writes the journal, and the copy saved at the last error, in JSON; ?round=<id> selects a single round
+func (j *roundJournal) serve(w http.ResponseWriter, r *http.Request) {
+	roundID := int32(-1)
+	if s := r.URL.Query().Get("round"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil || id < 0 {
+			http.Error(w, "round should be a round ID, is \""+s+"\"", http.StatusBadRequest)
+			return
+		}
+		roundID = int32(id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rounds    []RoundJournalEntry
+		LastError *RoundJournalDump
+	}{j.rounds(roundID, time.Now()), j.lastErrorDump(roundID)})
+}
+
+// logRoundJournal writes the last rounds of the journal to the logs, e.g. when the session ends abnormally
+func (p *PriFiLibRelayInstance) logRoundJournal() {
+	rounds := p.relayState.roundJournal.rounds(-1, time.Now())
+	if len(rounds) > ROUND_JOURNAL_LOGGED {
+		rounds = rounds[len(rounds)-ROUND_JOURNAL_LOGGED:]
+	}
+	relayLog.Lvl1("Relay : the last", len(rounds), "rounds were :")
+	for _, e := range rounds {
+		relayLog.Lvl1(e.String())
+	}
+}
@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+func TestRoundJournal(t *testing.T) {
+	j := newRoundJournal()
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	// the trustee sends its cipher before the round is opened
+	j.received(1, false, 0, 100, at(0))
+	if rounds := j.rounds(1, at(0)); len(rounds) != 1 || rounds[0].Outcome != ROUND_PENDING {
+		t.Fatal("The round should be pending, got", rounds)
+	}
+	j.opened(1, 3, 1, true, 50, at(10))
+	j.received(1, true, 0, 100, at(30))
+	j.decoded(1, 100)
+	j.payload(1, prifilog.CONTENT_DATA, 40)
+	j.closed(1, ROUND_DECODED, nil, nil, at(40))
+
+	e := j.rounds(1, at(100))[0]
+	if e.Epoch != 3 || e.Owner != 1 || !e.OpenClosed || e.DownstreamBytes != 50 || e.UpstreamBytes != 100 ||
+		e.UsefulBytes != 40 || e.Outcome != ROUND_DECODED || e.DurationMs != 30 {
+		t.Error("Unexpected entry", e)
+	}
+	if len(e.Ciphers) != 2 || e.Ciphers[0].Kind != prifilog.TRUSTEE || e.Ciphers[0].AfterMs != -10 ||
+		e.Ciphers[1].Kind != prifilog.CLIENT || e.Ciphers[1].AfterMs != 20 {
+		t.Error("The ciphers should be timed from the opening, got", e.Ciphers)
+	}
+	if len(e.Contents) != 1 || e.Contents[0] != prifilog.CONTENT_DATA.String() {
+		t.Error("Expected the content of the payload, got", e.Contents)
+	}
+	if !strings.Contains(e.String(), "Round 1 (epoch 3) decoded after 30ms") {
+		t.Error("Unexpected description", e.String())
+	}
+
+	// a timeout saves a copy of the journal, which the later rounds do not change
+	j.opened(2, 3, 0, false, 50, at(50))
+	j.received(2, false, 0, 100, at(60))
+	j.closed(2, ROUND_TIMED_OUT, []int{0}, nil, at(150))
+	j.saveOnError("round 2 timed out", at(150))
+	j.opened(3, 3, 1, false, 50, at(160))
+	dump := j.lastErrorDump(2)
+	if dump == nil || dump.Reason != "round 2 timed out" || len(dump.Rounds) != 1 ||
+		dump.Rounds[0].Outcome != ROUND_TIMED_OUT || len(dump.Rounds[0].MissingClients) != 1 {
+		t.Fatal("Expected the saved timeout of round 2, got", dump)
+	}
+	if len(j.lastErrorDump(-1).Rounds) != 2 {
+		t.Error("The copy should not contain the rounds opened after the timeout")
+	}
+
+	// a new configuration forgets the pending rounds, and abandons the open ones
+	j.received(4, true, 1, 100, at(170))
+	j.abandon(at(200))
+	if len(j.rounds(4, at(200))) != 0 {
+		t.Error("The pending round should be forgotten")
+	}
+	if e := j.rounds(3, at(200))[0]; e.Outcome != ROUND_ABANDONED || e.DurationMs != 40 {
+		t.Error("The open round should be abandoned, got", e)
+	}
+
+	// the oldest rounds leave the journal, and a late cipher does not bring them back
+	for roundID := int32(5); roundID < 5+ROUND_JOURNAL_SIZE; roundID++ {
+		j.opened(roundID, 4, 0, false, 50, at(300))
+	}
+	if rounds := j.rounds(-1, at(300)); len(rounds) != ROUND_JOURNAL_SIZE || rounds[0].RoundID != 5 {
+		t.Error("The journal should keep its last", ROUND_JOURNAL_SIZE, "rounds, got", len(rounds))
+	}
+	j.received(1, true, 1, 100, at(300))
+	if len(j.rounds(1, at(300))) != 0 {
+		t.Error("A late cipher should not bring back a forgotten round")
+	}
+}
+
+func TestRoundJournalServe(t *testing.T) {
+	j := newRoundJournal()
+	j.opened(1, 0, 0, false, 50, time.Now())
+	j.opened(2, 0, 1, false, 50, time.Now())
+
+	rec := httptest.NewRecorder()
+	j.serve(rec, httptest.NewRequest("GET", ROUND_JOURNAL_PATH+"?round=2", nil))
+	var res struct {
+		Rounds    []RoundJournalEntry
+		LastError *RoundJournalDump
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Rounds) != 1 || res.Rounds[0].RoundID != 2 || res.Rounds[0].Outcome != ROUND_OPEN || res.LastError != nil {
+		t.Error("Expected the open round 2 only, got", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	j.serve(rec, httptest.NewRequest("GET", ROUND_JOURNAL_PATH+"?round=last", nil))
+	if rec.Code != 400 {
+		t.Error("An invalid round should be refused, got", rec.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package relay
+
+/*
+With variable slot sizes (RelayMinSlotSize > 0), the upstream cell of a round is only as large as the relay allocated
+to the slot of the round, between RelayMinSlotSize and PayloadSize. The relay tells the size to the clients with the
+downstream data of the round (AllocatedUpstreamSize), and all of them send ciphers of that size; the trustees send
+their complete ciphers, of which the relay only uses the beginning. The size of each slot follows the use of its
+previous rounds : it doubles when the owner filled the cell, and halves when it used less than a quarter of it. An
+idle client thus costs RelayMinSlotSize bytes per round and per client instead of PayloadSize, and the bandwidth
+scales with the demand instead of nClients x PayloadSize. A client with more data than the size of its slot cuts the
+frames of the stream multiplexer, and sends the rest in its next rounds.
+The size of a slot is seen by everybody, like whether it is open or closed : it tells how much its owner sends, not
+who it is. The disruption and equivocation protections work on whole cells, hence cannot be combined with variable
+slot sizes, nor can super-rounds.
+*/
+
+// slotSizer allocates the size of the upstream cell of each slot
+type slotSizer struct {
+	minSize int
+	maxSize int
+	sizes   map[int]int // by slot; minSize if absent
+}
+
+// newSlotSizer returns an allocator of sizes between minSize and maxSize; nil if minSize is not positive
+func newSlotSizer(minSize int, maxSize int) *slotSizer {
+	if minSize <= 0 {
+		return nil
+	}
+	if minSize > maxSize {
+		minSize = maxSize
+	}
+	return &slotSizer{
+		minSize: minSize,
+		maxSize: maxSize,
+		sizes:   make(map[int]int),
+	}
+}
+
+// size returns the size allocated to slot
+func (s *slotSizer) size(slot int) int {
+	if size, found := s.sizes[slot]; found {
+		return size
+	}
+	return s.minSize
+}
+
+// used records that the owner of slot used usedBytes of the allocated bytes, and adjusts the size of its next cells
+func (s *slotSizer) used(slot int, allocated int, usedBytes int) {
+	size := allocated
+	if usedBytes >= allocated {
+		size = 2 * allocated
+	} else if 4*usedBytes < allocated {
+		size = allocated / 2
+	}
+	if size < s.minSize {
+		size = s.minSize
+	}
+	if size > s.maxSize {
+		size = s.maxSize
+	}
+	s.sizes[slot] = size
+}
+
+// allocatedUpstreamSize returns the size of the upstream cell of roundID, 0 if it is the whole cell
+func (p *PriFiLibRelayInstance) allocatedUpstreamSize(roundID int32) int {
+	if p.relayState.slotSizes == nil {
+		return 0
+	}
+	if sent := p.relayState.roundManager.GetDataAlreadySent(roundID); sent != nil {
+		return sent.AllocatedUpstreamSize
+	}
+	return 0
+}
+
+// recordSlotUse adjusts the size of the slot of roundID to the use of its decoded payload
+func (p *PriFiLibRelayInstance) recordSlotUse(roundID int32, payload []byte, usefulBytes int) {
+	sent := p.relayState.roundManager.GetDataAlreadySent(roundID)
+	if sent == nil || sent.OwnershipID < 0 || sent.AllocatedUpstreamSize <= 0 {
+		return
+	}
+	if usefulBytes > 0 && usefulBytes < len(payload) {
+		usefulBytes += PAYLOAD_STREAM_HEADER_SIZE // the frame of the stream multiplexer
+	}
+	p.relayState.slotSizes.used(sent.OwnershipID, sent.AllocatedUpstreamSize, usefulBytes)
+}
@@ -0,0 +1,42 @@
+package relay
+
+import "testing"
+
+func TestSlotSizer(t *testing.T) {
+	if newSlotSizer(0, 1000) != nil {
+		t.Error("Without a minimum size, the slots should have the same size in all rounds")
+	}
+
+	s := newSlotSizer(100, 1000)
+	if s.size(3) != 100 {
+		t.Error("A slot should start at the minimum size")
+	}
+
+	s.used(3, 100, 100)
+	if s.size(3) != 200 {
+		t.Error("A full slot should double, got", s.size(3))
+	}
+	s.used(3, 800, 800)
+	if s.size(3) != 1000 {
+		t.Error("A slot should not grow over the maximum size, got", s.size(3))
+	}
+	s.used(3, 1000, 300)
+	if s.size(3) != 1000 {
+		t.Error("A slot used over a quarter should keep its size, got", s.size(3))
+	}
+	s.used(3, 1000, 10)
+	if s.size(3) != 500 {
+		t.Error("A slot used under a quarter should halve, got", s.size(3))
+	}
+	s.used(3, 150, 0)
+	if s.size(3) != 100 {
+		t.Error("A slot should not shrink under the minimum size, got", s.size(3))
+	}
+	if s.size(4) != 100 {
+		t.Error("The slots should be sized independently")
+	}
+
+	if s := newSlotSizer(2000, 1000); s.size(0) != 1000 {
+		t.Error("The minimum size should not exceed the maximum size")
+	}
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+// STATUS_PATH is where the status of the relay is exported, in JSON, for the operators of a live deployment
+const STATUS_PATH = "/status"
+
+// RelayStatus is the status of the relay : the state of its state machine, its rounds, the group, and the time
+// statistics of the rounds
+type RelayStatus struct {
+	Time  time.Time
+	State string // the state of the relay's state machine, e.g. COMMUNICATING
+	WindowStatus
+	Entities   []prifilog.EntityAvailability   // the clients and trustees, with the last time we got a cipher from them
+	TimesMs    map[string]prifilog.TimeSummary // per measure, e.g. round-duration, since the relay started
+	SetupTimes map[string]prifilog.TimeSummary // per phase of the setups, and for the whole setups ("total")
+}
+
+// statusHandler returns the handler of STATUS_PATH. Like the other handlers of the metrics endpoint, it captures the
+// statistics of the current parameters, since the endpoint is restarted with them.
+func (p *PriFiLibRelayInstance) statusHandler() http.HandlerFunc {
+	stateMachine := p.stateMachine
+	roundManager := p.relayState.roundManager
+	availability := p.relayState.availabilityStatistics
+	timeStatistics := p.relayState.timeStatistics
+	setupStatistics := p.relayState.setupStatistics
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := RelayStatus{
+			Time:       time.Now(),
+			State:      stateMachine.State(),
+			Entities:   availability.Snapshot(),
+			TimesMs:    make(map[string]prifilog.TimeSummary, len(timeStatistics)),
+			SetupTimes: setupStatistics.Summaries(),
+		}
+		if roundManager != nil {
+			status.WindowStatus = roundManager.WindowStatus()
+		}
+		for measure, stats := range timeStatistics {
+			status.TimesMs[measure] = stats.Summary()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,22 @@
+package relay
+
+/*
+With CellsPerRound = m > 1, each round carries m back-to-back cells of PayloadSize ("super-rounds"): the DC-net is set up
+for m*PayloadSize bytes, so the ciphers of the clients and trustees, the downstream data, the headers and the waiting
+for the slowest participant are paid once for m cells. The slot owner fills the cells in order; the relay cuts the
+decoded cell back into m payloads, each handled as the payload of a normal round. The disruption and equivocation
+protections work on whole cells, hence cannot be combined with super-rounds.
+*/
+
+// splitSuperRound cuts the decoded cell of a super-round into its cellsPerRound payloads of payloadSize. If the cell
+// is not a super-round, or has an unexpected size, it is returned as the only payload.
+func splitSuperRound(plaintext []byte, cellsPerRound int, payloadSize int) [][]byte {
+	if cellsPerRound <= 1 || payloadSize <= 0 || len(plaintext) != cellsPerRound*payloadSize {
+		return [][]byte{plaintext}
+	}
+	payloads := make([][]byte, cellsPerRound)
+	for i := range payloads {
+		payloads[i] = plaintext[i*payloadSize : (i+1)*payloadSize : (i+1)*payloadSize]
+	}
+	return payloads
+}
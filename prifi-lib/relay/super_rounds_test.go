@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestSplitSuperRound(t *testing.T) {
+	cell := []byte{1, 1, 1, 2, 2, 2, 3, 3, 3}
+
+	payloads := splitSuperRound(cell, 3, 3)
+	if len(payloads) != 3 {
+		t.Fatal("should have 3 payloads, got", len(payloads))
+	}
+	for i, payload := range payloads {
+		if !bytes.Equal(payload, bytes.Repeat([]byte{byte(i + 1)}, 3)) {
+			t.Error("wrong payload", i, payload)
+		}
+	}
+
+	// appending to a payload must not overwrite the next one
+	_ = append(payloads[0], 9)
+	if payloads[1][0] != 2 {
+		t.Error("payloads should not share their capacity")
+	}
+
+	for _, m := range []int{0, 1, 2} {
+		payloads := splitSuperRound(cell, m, 3)
+		if len(payloads) != 1 || !bytes.Equal(payloads[0], cell) {
+			t.Error("with CellsPerRound =", m, "the cell should be the only payload")
+		}
+	}
+}
+
+func TestSuperRoundParameters(t *testing.T) {
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 10), timeoutHandler,
+		newTestMessageSenderWrapper(new(TestMessageSender)))
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.ForceParams = true
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("PayloadSize", 1000)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("CellsPerRound", 4)
+	if err := relay.ReceivedMessage(*msg); err != nil {
+		t.Fatal("Relay should be able to receive this message, but", err)
+	}
+	if relay.relayState.CellsPerRound != 4 {
+		t.Error("CellsPerRound should be 4, is", relay.relayState.CellsPerRound)
+	}
+	if config := relay.experimentConfig(); config != "CellsPerRound=4" {
+		t.Error("the statistics should be tagged with CellsPerRound, got", config)
+	}
+
+	msg.Add("DisruptionProtectionEnabled", true)
+	if err := relay.ReceivedMessage(*msg); err == nil {
+		t.Error("super-rounds should be refused with the disruption protection")
+	}
+}
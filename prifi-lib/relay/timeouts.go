@@ -1,19 +1,26 @@
 package relay
 
 import (
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"go.dedis.ch/onet/v3/log"
+	"strconv"
 	"time"
 )
 
+// MAX_STALLED_ROUND_DIAGNOSTICS is the number of stalled-round diagnostics kept for the operator
+const MAX_STALLED_ROUND_DIAGNOSTICS = 100
+
 /*
-This first timeout happens after a short delay. Clients will not be considered disconnected yet,
+This first timeout happens after a short delay, which depends on who we are waiting for : the relay waits the whole
+RoundTimeOut for the ciphers of reliable clients and trustees, and less for the entities which are often late (see
+prifilog.Deadline). Clients will not be considered disconnected yet,
 but if we use UDP, it can mean that a client missed a broadcast, and we re-sent the message.
 If the round was *not* done, we do another timeout (Phase 2), and then, clients/trustees will be considered
 online if they didn't answer by that time.
 */
 func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID int32) {
 
-	time.Sleep(time.Duration(p.relayState.RoundTimeOut) * time.Millisecond)
+	p.waitForRoundDeadline(roundID)
 
 	// never start treating two timeout concurrently (or receiving a message)
 	p.relayState.processingLock.Lock()
@@ -27,31 +34,48 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 		return //nothing to ensure in that case
 	}
 
-	// new policy : just kill that round, do not retransmit, let SOCKS take care of the loss
+	// new policy : just kill that round, do not retransmit the upstream, let SOCKS take care of the loss. The
+	// downstream data is retransmitted to the clients which did not acknowledge it.
 
 	p.relayState.numberOfConsecutiveFailedRounds++
-	log.Lvl1("WARNING: Timeout for round", roundID, ", force closing. Already", p.relayState.numberOfConsecutiveFailedRounds,
+	relayLog.Lvl1("WARNING: Timeout for round", roundID, ", force closing. Already", p.relayState.numberOfConsecutiveFailedRounds,
 		"consecutive missed rounds (killing when =>", p.relayState.MaxNumberOfConsecutiveFailedRounds, ")")
 
 	// if we missed too many rounds, kill the experiment
 	missingClientCiphers, missingTrusteeCiphers := p.relayState.roundManager.MissingCiphersForCurrentRound()
-	log.Lvl1("missing clients", missingClientCiphers, "and trustees", missingTrusteeCiphers)
+	diagnostic := p.relayState.availabilityStatistics.RoundStalled(roundID, p.relayState.numberOfConsecutiveFailedRounds,
+		p.relayState.nClients, p.relayState.nTrustees, missingClientCiphers, missingTrusteeCiphers)
+	relayLog.Lvl1(diagnostic.String())
+	p.relayState.roundJournal.closed(roundID, ROUND_TIMED_OUT, missingClientCiphers, missingTrusteeCiphers, time.Now())
+	p.relayState.roundJournal.saveOnError("round "+strconv.Itoa(int(roundID))+" timed out", time.Now())
+	for _, trusteeID := range missingTrusteeCiphers {
+		if report, overloaded := p.relayState.trusteeLoads.overloaded(trusteeID); overloaded {
+			relayLog.Lvl1("Relay : missing trustee", trusteeID, "reported being overloaded (", report.Load, "% of a core, budget", report.Budget, "%)")
+		}
+	}
 
 	if p.relayState.numberOfConsecutiveFailedRounds >= p.relayState.MaxNumberOfConsecutiveFailedRounds {
 		log.Error("MAX_NUMBER_OF_CONSECUTIVE_FAILED_ROUNDS (", p.relayState.MaxNumberOfConsecutiveFailedRounds,
 			") reached, killing protocol.")
+		p.relayState.sessionSummary.SetShutdownReason("too many consecutive failed rounds", true)
 
-		log.Lvl3("Stopping experiment, if any.")
+		relayLog.Lvl3("Stopping experiment, if any.")
 		missingClientCiphers, missingTrusteesCiphers := p.relayState.roundManager.MissingCiphersForCurrentRound()
 		p.relayState.timeoutHandler(missingClientCiphers, missingTrusteesCiphers)
 	} else {
+		p.retransmitUnacknowledged(roundID, missingClientCiphers)
+
 		// cleanup, start the transition to next round
-		log.Lvl1("Gonna Force close...")
+		relayLog.Lvl1("Gonna Force close...")
 		p.relayState.roundManager.Dump()
 		p.relayState.roundManager.ForceCloseRound()
+		delete(p.relayState.roundTimers, roundID)
 		p.relayState.roundManager.Dump()
 
 		p.relayState.numberOfNonAckedDownstreamPackets-- // packet is not "in-flight" because it is lost
+		if roundID == p.relayState.scheduleFirstRound {
+			p.endSetup()
+		}
 
 		// if we still have open rounds (after closing this one), we need to tell the DC-net to move to this new round
 		if roundOpened, roundID := p.relayState.roundManager.currentRound(); roundOpened {
@@ -64,8 +88,47 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 
 		// we should also try to finalize the next round
 		if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
-			log.Lvl1("Timeouts: Following round was ready, calling hasAllCiphersForUpstream(true)")
+			relayLog.Lvl1("Timeouts: Following round was ready, calling hasAllCiphersForUpstream(true)")
 			p.upstreamPhase1_processCiphers(true)
 		}
 	}
 }
+
+// waitForRoundDeadline returns when the round is closed, or when the deadline of every entity whose cipher is missing
+// has passed
+func (p *PriFiLibRelayInstance) waitForRoundDeadline(roundID int32) {
+	start := time.Now()
+	roundTimeout := time.Duration(p.relayState.RoundTimeOut) * time.Millisecond
+	time.Sleep(prifilog.Deadline(roundTimeout, 0))
+
+	for p.relayState.roundManager.IsRoundOpenend(roundID) {
+		missingClients, missingTrustees := p.relayState.roundManager.MissingCiphersForCurrentRound()
+		deadline := p.relayState.availabilityStatistics.RoundDeadline(roundTimeout, missingClients, missingTrustees)
+		remaining := deadline - time.Since(start)
+		if remaining <= 0 {
+			return
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// retransmitUnacknowledged sends again, over TCP, the downstream data of roundID to the missing clients whose ACKs
+// show they did not apply it, e.g. because they missed the UDP broadcast, or it was lost on an unreliable transport.
+// With TCP, the data was already sent reliably, and a missing client is just slow.
+func (p *PriFiLibRelayInstance) retransmitUnacknowledged(roundID int32, missingClients []int) {
+	if !p.relayState.UseUDP && !p.relayState.unreliableTransport {
+		return
+	}
+	data := p.relayState.roundManager.GetDataAlreadySent(roundID)
+	if data == nil {
+		return
+	}
+	for _, clientID := range missingClients {
+		if !p.relayState.delivery.ShouldRetransmit(clientID, roundID) {
+			continue
+		}
+		relayLog.Lvl2("Relay : client", clientID, "acknowledged up to round", p.relayState.delivery.Acked(clientID), ", retransmitting round", roundID)
+		p.messageSender.SendToClientWithLog(clientID, data, "(retransmission to client "+strconv.Itoa(clientID)+", round "+strconv.Itoa(int(roundID))+")")
+		p.relayState.bitrateStatistics.AddDownstreamRetransmitCell(int64(len(data.Data)))
+	}
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+// TRUSTEE_LOAD_RECOVERY is the share of its budget (in %) below which a trustee gets a larger window again
+const TRUSTEE_LOAD_RECOVERY = 75
+
+// trusteeLoads keeps the last load reported by each trustee, and the window the relay granted to it
+type trusteeLoads struct {
+	sync.Mutex
+	reports map[int]net.TRU_REL_LOAD_REPORT
+	windows map[int]int
+}
+
+func newTrusteeLoads() *trusteeLoads {
+	return &trusteeLoads{
+		reports: make(map[int]net.TRU_REL_LOAD_REPORT),
+		windows: make(map[int]int),
+	}
+}
+
+func (l *trusteeLoads) report(msg net.TRU_REL_LOAD_REPORT, window int) {
+	l.Lock()
+	defer l.Unlock()
+	l.reports[msg.TrusteeID] = msg
+	l.windows[msg.TrusteeID] = window
+}
+
+// overloaded returns the last report of the trustee, and whether it said it was overloaded
+func (l *trusteeLoads) overloaded(trusteeID int) (net.TRU_REL_LOAD_REPORT, bool) {
+	l.Lock()
+	defer l.Unlock()
+	r, found := l.reports[trusteeID]
+	return r, found && r.Overloaded
+}
+
+// WritePrometheus writes the load and the window of each trustee which reported its load, in the Prometheus text format
+func (l *trusteeLoads) WritePrometheus(w io.Writer, prefix string) error {
+	l.Lock()
+	defer l.Unlock()
+	ids := make([]int, 0, len(l.reports))
+	for id := range l.reports {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	_, err := fmt.Fprintf(w, "# TYPE %s_trustee_load_percent gauge\n", prefix)
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s_trustee_load_percent{id=\"%v\"} %v\n", prefix, id, l.reports[id].Load)
+	}
+	fmt.Fprintf(w, "# TYPE %s_trustee_cpu_budget_percent gauge\n", prefix)
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s_trustee_cpu_budget_percent{id=\"%v\"} %v\n", prefix, id, l.reports[id].Budget)
+	}
+	fmt.Fprintf(w, "# TYPE %s_trustee_window gauge\n", prefix)
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s_trustee_window{id=\"%v\"} %v\n", prefix, id, l.windows[id])
+	}
+	return err
+}
+
+/*
+Received_TRU_REL_LOAD_REPORT handles TRU_REL_LOAD_REPORT messages. A trustee above its CPU budget asks for a smaller
+window : we halve the number of its ciphers we buffer before telling it to stop, so that it computes them at the pace
+of the rounds instead of racing ahead. Once it is well below its budget again, we double the window, up to
+RelayTrusteeCacheHighBound. The new window is sent with REL_TRU_TELL_RATE_CHANGE.
+*/
+func (p *PriFiLibRelayInstance) Received_TRU_REL_LOAD_REPORT(msg net.TRU_REL_LOAD_REPORT) error {
+	if msg.TrusteeID < 0 || msg.TrusteeID >= p.relayState.nTrustees {
+		e := "Relay : load report from unknown trustee " + strconv.Itoa(msg.TrusteeID)
+		relayLog.Lvl1(e)
+		return errors.New(e)
+	}
+
+	roundManager := p.relayState.roundManager
+	current := roundManager.TrusteeHighBound(msg.TrusteeID)
+	window := current
+	if msg.Overloaded {
+		window = roundManager.SetTrusteeHighBound(msg.TrusteeID, current/2)
+	} else if 100*msg.Load < TRUSTEE_LOAD_RECOVERY*msg.Budget {
+		window = roundManager.SetTrusteeHighBound(msg.TrusteeID, current*2)
+	}
+	p.relayState.trusteeLoads.report(msg, window)
+
+	if window == current {
+		relayLog.Lvl3("Relay : trustee", msg.TrusteeID, "uses", msg.Load, "% of a core (budget", msg.Budget, "%), window", window)
+		return nil
+	}
+	if msg.Overloaded {
+		relayLog.Lvl1("Relay : trustee", msg.TrusteeID, "is overloaded (", msg.Load, "% of a core, budget", msg.Budget, "%), lowering its window to", window)
+	} else {
+		relayLog.Lvl2("Relay : trustee", msg.TrusteeID, "is below its CPU budget (", msg.Load, "%), raising its window to", window)
+	}
+
+	capacity := 1
+	if roundManager.IsTrusteeStopped(msg.TrusteeID) {
+		capacity = 0
+	}
+	toSend := &net.REL_TRU_TELL_RATE_CHANGE{WindowCapacity: capacity, Window: window}
+	p.messageSender.SendToTrusteeWithLog(msg.TrusteeID, toSend, "(trustee "+strconv.Itoa(msg.TrusteeID)+", window "+strconv.Itoa(window)+")")
+	return nil
+}
@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestTrusteeLoadReports(t *testing.T) {
+	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
+	relay := NewRelay(true, make(chan []byte, 6), make(chan []byte, 3), make(chan interface{}, 10), timeoutHandler,
+		newTestMessageSenderWrapper(new(TestMessageSender)))
+	relay.relayState.nTrustees = 2
+	relay.relayState.roundManager = NewBufferableRoundManager(1, 2, 1)
+	relay.relayState.roundManager.AddRateLimiter(2, 16, func(int) {}, func(int) {})
+	relay.relayState.trusteeLoads = newTrusteeLoads()
+	trusteeLock.Lock()
+	sentToTrustee = make([]interface{}, 0)
+	trusteeLock.Unlock()
+
+	expectWindow := func(window int) {
+		msg, err := getTrusteeMessage("REL_TRU_TELL_RATE_CHANGE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := msg.(*net.REL_TRU_TELL_RATE_CHANGE); m.Window != window || m.WindowCapacity != 1 {
+			t.Error("the trustee should get the window", window, "got", m.Window, m.WindowCapacity)
+		}
+	}
+
+	overloaded := net.TRU_REL_LOAD_REPORT{TrusteeID: 1, Load: 90, Budget: 50, Overloaded: true}
+	for _, window := range []int{8, 4, 3} {
+		if err := relay.Received_TRU_REL_LOAD_REPORT(overloaded); err != nil {
+			t.Fatal(err)
+		}
+		expectWindow(window)
+	}
+	// the window stays above the low bound
+	relay.Received_TRU_REL_LOAD_REPORT(overloaded)
+	if _, err := getTrusteeMessage("REL_TRU_TELL_RATE_CHANGE"); err == nil {
+		t.Error("the window did not change, nothing should be sent")
+	}
+	if relay.relayState.roundManager.TrusteeHighBound(0) != 16 {
+		t.Error("the other trustee should keep its window")
+	}
+	if _, isOverloaded := relay.relayState.trusteeLoads.overloaded(1); !isOverloaded {
+		t.Error("trustee 1 should be marked as overloaded")
+	}
+
+	// just below the budget : the window stays the same
+	relay.Received_TRU_REL_LOAD_REPORT(net.TRU_REL_LOAD_REPORT{TrusteeID: 1, Load: 45, Budget: 50})
+	if relay.relayState.roundManager.TrusteeHighBound(1) != 3 {
+		t.Error("the window should not change within the budget")
+	}
+
+	// well below the budget : the window doubles, up to the high bound
+	for _, window := range []int{6, 12, 16} {
+		relay.Received_TRU_REL_LOAD_REPORT(net.TRU_REL_LOAD_REPORT{TrusteeID: 1, Load: 10, Budget: 50})
+		expectWindow(window)
+	}
+
+	if err := relay.Received_TRU_REL_LOAD_REPORT(net.TRU_REL_LOAD_REPORT{TrusteeID: 2, Load: 10, Budget: 50}); err == nil {
+		t.Error("the load report of an unknown trustee should be refused")
+	}
+
+	var buf bytes.Buffer
+	if err := relay.relayState.trusteeLoads.WritePrometheus(&buf, "prifi_relay"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"prifi_relay_trustee_load_percent{id=\"1\"} 10",
+		"prifi_relay_trustee_cpu_budget_percent{id=\"1\"} 50",
+		"prifi_relay_trustee_window{id=\"1\"} 16",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Error("missing metric", line, "in", buf.String())
+		}
+	}
+}
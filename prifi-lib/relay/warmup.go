@@ -0,0 +1,115 @@
+package relay
+
+/*
+The warm-up runs the first RelayWarmupRounds rounds of an epoch (after round 0) with synthetic data : the owner of
+each slot sends net.NewWarmupPayload, which only depends on the round, instead of its SOCKS data. The relay checks
+each decoded payload against it, which tests the whole DC-net (the shared secrets, the schedule, the decoding) with a
+known plaintext, and measures the baseline round time while the caches fill up. Nothing reaches the exit during the
+warm-up. If a warm-up round does not decode correctly, the group is restarted; otherwise, the data goes to the exit
+from the next round on.
+*/
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// warmup is the state of the warm-up rounds of the epoch
+type warmup struct {
+	rounds     int32 // rounds 1 to rounds are warm-up rounds
+	verified   int
+	wrong      []int32 // the rounds which did not decode to their warm-up payload
+	roundTimes []time.Duration
+}
+
+// newWarmup returns nil if there are no warm-up rounds
+func newWarmup(rounds int) *warmup {
+	if rounds <= 0 {
+		return nil
+	}
+	return &warmup{rounds: int32(rounds)}
+}
+
+// covers returns true if roundID is a warm-up round
+func (w *warmup) covers(roundID int32) bool {
+	return w != nil && roundID >= 1 && roundID <= w.rounds
+}
+
+// checkPayloads checks the decoded cell of a warm-up round : its first payload is the warm-up payload of the round,
+// and the other ones (with super-rounds) are empty
+func (w *warmup) checkPayloads(roundID int32, payloads [][]byte) bool {
+	if len(payloads) == 0 || !net.CheckWarmupPayload(roundID, payloads[0]) {
+		w.wrong = append(w.wrong, roundID)
+		return false
+	}
+	for _, payload := range payloads[1:] {
+		if !isZero(payload) {
+			w.wrong = append(w.wrong, roundID)
+			return false
+		}
+	}
+	w.verified++
+	return true
+}
+
+// report summarizes the warm-up
+func (w *warmup) report() string {
+	var total, max time.Duration
+	for _, d := range w.roundTimes {
+		total += d
+		if d > max {
+			max = d
+		}
+	}
+	mean := time.Duration(0)
+	if len(w.roundTimes) > 0 {
+		mean = total / time.Duration(len(w.roundTimes))
+	}
+	return "Warmup: " + strconv.Itoa(int(w.rounds)) + " rounds, " + strconv.Itoa(w.verified) + " verified, " +
+		strconv.Itoa(len(w.wrong)) + " wrong, round time mean " + strconv.FormatInt(mean.Nanoseconds()/1e6, 10) +
+		" ms, max " + strconv.FormatInt(max.Nanoseconds()/1e6, 10) + " ms"
+}
+
+// checkWarmupRound verifies the decoded cell of a warm-up round, which does not go to the exit
+func (p *PriFiLibRelayInstance) checkWarmupRound(roundID int32, upstreamPlaintext []byte) {
+	payloads := splitSuperRound(upstreamPlaintext, p.relayState.CellsPerRound, p.relayState.PayloadSize)
+	if !p.relayState.warmup.checkPayloads(roundID, payloads) {
+		relayLog.Lvl1("Relay : warm-up round", roundID, "did not decode to its synthetic payload")
+	}
+	p.releaseDecodedCell(upstreamPlaintext)
+}
+
+// finishWarmupRound records the time of a warm-up round; after the last one, the data goes to the exit if all the
+// rounds decoded correctly, and the group is restarted otherwise
+func (p *PriFiLibRelayInstance) finishWarmupRound(roundID int32, timeSpent time.Duration) {
+	w := p.relayState.warmup
+	w.roundTimes = append(w.roundTimes, timeSpent)
+	if roundID != w.rounds {
+		return
+	}
+
+	report := w.report()
+	p.collectExperimentResult(report)
+	if len(w.wrong) > 0 {
+		log.Error("Relay : warm-up rounds " + roundsString(w.wrong) + " did not decode correctly, restarting the group (" + report + ")")
+		p.relayState.sessionSummary.SetShutdownReason("the warm-up rounds did not decode correctly", true)
+		p.relayState.timeoutHandler(nil, nil)
+		return
+	}
+	relayLog.Lvl1("Relay : warm-up done,", report, "; the data now goes to the exit")
+}
+
+// roundsString lists round IDs, e.g. "1, 4, 5"
+func roundsString(rounds []int32) string {
+	s := ""
+	for i, r := range rounds {
+		if i > 0 {
+			s += ", "
+		}
+		s += strconv.Itoa(int(r))
+	}
+	return s
+}
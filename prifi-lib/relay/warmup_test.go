@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestWarmup(t *testing.T) {
+	var none *warmup
+	if newWarmup(0) != nil || none.covers(1) {
+		t.Error("Without warm-up rounds, no round is a warm-up round")
+	}
+
+	w := newWarmup(3)
+	if w.covers(0) || !w.covers(1) || !w.covers(3) || w.covers(4) {
+		t.Error("Rounds 1 to 3 should be the warm-up rounds")
+	}
+
+	if !w.checkPayloads(1, [][]byte{net.NewWarmupPayload(1, 100)}) {
+		t.Error("The warm-up payload of the round should be accepted")
+	}
+	if w.checkPayloads(2, [][]byte{net.NewWarmupPayload(1, 100)}) {
+		t.Error("The warm-up payload of another round should be refused")
+	}
+	if w.checkPayloads(3, [][]byte{net.NewWarmupPayload(3, 100), net.NewWarmupPayload(3, 100)}) {
+		t.Error("The other payloads of a super-round should be empty")
+	}
+	if !w.checkPayloads(3, [][]byte{net.NewWarmupPayload(3, 100), make([]byte, 100)}) {
+		t.Error("A super-round with the warm-up payload first should be accepted")
+	}
+	if w.verified != 2 || len(w.wrong) != 2 || roundsString(w.wrong) != "2, 3" {
+		t.Error("Wrong count of rounds verified", w.verified, "and wrong", w.wrong)
+	}
+
+	w.roundTimes = []time.Duration{10 * time.Millisecond, 30 * time.Millisecond}
+	if r := w.report(); !strings.Contains(r, "mean 20 ms, max 30 ms") {
+		t.Error("Wrong report", r)
+	}
+}
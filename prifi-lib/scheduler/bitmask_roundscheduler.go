@@ -24,11 +24,12 @@ type SlotScheduler interface {
 	Relay_ComputeFinalSchedule() map[int]bool
 }
 
-// BitMaskScheduler_Client holds the info necessary for a client to compute his "contribution", or part of the bitmask
+// BitMaskScheduler_Client holds the info necessary for a client to compute his "contribution", or part of the bitmask.
+// NClients is the number of slots in the schedule, which exceeds the number of clients if some clients own several slots.
 type BitMaskSlotScheduler_Client struct {
 	NClients          int
 	ClientWantsToSend bool
-	MySlotID          int
+	MySlotIDs         []int // the slots to reserve; a client may own several slots
 }
 
 // BitMaskScheduler_Relay
@@ -39,17 +40,18 @@ type BitMaskSlotScheduler_Relay struct {
 func (bmc *BitMaskSlotScheduler_Client) Client_ReceivedScheduleRequest(nClients int) {
 	bmc.NClients = nClients
 	bmc.ClientWantsToSend = false
+	bmc.MySlotIDs = nil
 }
 
-// Client_ReserveRound indicates to reserve a slot in the next round
+// Client_ReserveRound indicates to reserve a slot in the next round; it can be called once per owned slot
 func (bmc *BitMaskSlotScheduler_Client) Client_ReserveRound(slotID int) {
-	bmc.MySlotID = slotID
+	bmc.MySlotIDs = append(bmc.MySlotIDs, slotID)
 	bmc.ClientWantsToSend = true
 }
 
 // Client_GetOpenScheduleContribution computes their contribution as a bit array
 func (bmc *BitMaskSlotScheduler_Client) Client_GetOpenScheduleContribution() []byte {
-	//length of the contribution is nClients/8 bytes
+	//length of the contribution is nSlots/8 bytes
 	nBytes := int(math.Ceil(float64(bmc.NClients) / 8))
 	payload := make([]byte, nBytes)
 
@@ -57,10 +59,15 @@ func (bmc *BitMaskSlotScheduler_Client) Client_GetOpenScheduleContribution() []b
 		return payload //all zeros
 	}
 
-	//set a bit to 1 at the correct position
-	whichByte := int(math.Floor(float64(bmc.MySlotID) / 8))
-	whichBit := uint(bmc.MySlotID % 8)
-	payload[whichByte] = 1 << whichBit
+	//set a bit to 1 at the correct positions
+	for _, slotID := range bmc.MySlotIDs {
+		if slotID < 0 || slotID >= bmc.NClients {
+			continue
+		}
+		whichByte := int(math.Floor(float64(slotID) / 8))
+		whichBit := uint(slotID % 8)
+		payload[whichByte] |= 1 << whichBit
+	}
 	return payload
 }
 
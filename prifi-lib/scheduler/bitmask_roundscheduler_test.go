@@ -92,3 +92,44 @@ func Test2Client(t *testing.T) {
 
 	fmt.Println(finalSched)
 }
+
+func TestClientWithSeveralSlots(t *testing.T) {
+
+	bmc := new(BitMaskSlotScheduler_Client)
+
+	//one client owning the slots 1, 8 and 9, out of 10 slots
+	nSlots := 10
+	mySlots := []int{1, 8, 9}
+
+	bmc.Client_ReceivedScheduleRequest(nSlots)
+	for _, s := range mySlots {
+		bmc.Client_ReserveRound(s)
+	}
+
+	contribution := bmc.Client_GetOpenScheduleContribution()
+	if len(contribution) != 2 {
+		t.Error("Contribution should have length 2, has length", len(contribution))
+	}
+
+	bmr := new(BitMaskSlotScheduler_Relay)
+	finalSched := bmr.Relay_ComputeFinalSchedule(contribution, nSlots)
+
+	if len(finalSched) != nSlots {
+		t.Error("finalSched should have length", nSlots, ", has length", len(finalSched))
+	}
+	for slot, open := range finalSched {
+		owned := slot == 1 || slot == 8 || slot == 9
+		if open != owned {
+			t.Error("slot", slot, "should be open:", owned, "but is", open)
+		}
+	}
+
+	//a new request forgets the previous reservations
+	bmc.Client_ReceivedScheduleRequest(nSlots)
+	contribution = bmc.Client_GetOpenScheduleContribution()
+	for _, b := range contribution {
+		if b != 0 {
+			t.Error("Contribution should be all zeros after a new request")
+		}
+	}
+}
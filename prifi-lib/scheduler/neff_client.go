@@ -57,3 +57,31 @@ func (n *NeffShuffle) ClientVerifySigAndRecognizeSlot(privateKey kyber.Scalar, t
 	}
 	return mySlot, nil
 }
+
+/**
+ * Locates the slots of additional ephemeral keys of a client (one per additional slot it asked for) in a shuffle whose
+ * signatures were already verified with ClientVerifySigAndRecognizeSlot.
+ */
+func (n *NeffShuffle) ClientRecognizeExtraSlots(privateKeys []kyber.Scalar, lastBase kyber.Point, shuffledPublicKeys []kyber.Point) ([]int, error) {
+
+	if lastBase == nil {
+		return nil, errors.New("Can't recognize slots without last base")
+	}
+
+	slots := make([]int, 0)
+	for _, privateKey := range privateKeys {
+		publicKeyInNewBase := config.CryptoSuite.Point().Mul(privateKey, lastBase)
+
+		slot := -1
+		for j := 0; j < len(shuffledPublicKeys); j++ {
+			if shuffledPublicKeys[j].Equal(publicKeyInNewBase) {
+				slot = j
+			}
+		}
+		if slot == -1 {
+			return nil, errors.New("Could not locate one of my extra slots")
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
@@ -15,8 +16,11 @@ import (
 type NeffShuffleRelay struct {
 	NTrustees   int
 	InitialBase kyber.Point
+	Beacon      *crypto.RandomBeacon // if non-nil, the initial base and keys are multiplied by the beacon's ShuffleSeed()
+	beaconSeed  kyber.Scalar
 
 	//this is the transcript, i.e. we keep everything
+	InitialPublicKeys  []kyber.Point
 	Bases              []kyber.Point
 	ShuffledPublicKeys []net.PublicKeyArray
 	Proofs             []net.ByteArray
@@ -44,11 +48,17 @@ func (r *NeffShuffleRelay) Init(nTrustees int) error {
 	r.ShuffledPublicKeys = make([]net.PublicKeyArray, nTrustees)
 	r.Proofs = make([]net.ByteArray, nTrustees)
 	r.Signatures = make([]net.ByteArray, nTrustees)
+	r.InitialPublicKeys = make([]kyber.Point, 0)
+	r.PublicKeyBeingShuffled = nil
+	r.SignatureCount = 0
+	r.CannotAddNewKeys = false
 	r.currentTrusteeShuffling = 0
 	r.NTrustees = nTrustees
 
 	//the relay picks c0
 	r.InitialBase = config.CryptoSuite.Point().Base()
+	r.Beacon = nil
+	r.beaconSeed = nil
 
 	//the share of products is c0 (will become c1*c0, c2*c1*c0, ...)
 	r.LastBase = r.InitialBase
@@ -56,6 +66,28 @@ func (r *NeffShuffleRelay) Init(nTrustees int) error {
 	return nil
 }
 
+/**
+ * Derives c0 from an external random beacon instead of using the fixed base, so that the relay does not choose it.
+ * The client's keys are multiplied by the same public seed when added, so the clients still recognize their slot in
+ * the final base. Must be called after Init, and before adding any key.
+ */
+func (r *NeffShuffleRelay) SetBeacon(beacon *crypto.RandomBeacon) error {
+
+	if beacon == nil {
+		return errors.New("Cannot use a nil beacon")
+	}
+	if r.CannotAddNewKeys || len(r.InitialPublicKeys) > 0 {
+		return errors.New("Cannot set the beacon, keys were already added to the shuffle.")
+	}
+
+	r.Beacon = beacon
+	r.beaconSeed = beacon.ShuffleSeed()
+	r.InitialBase = config.CryptoSuite.Point().Mul(r.beaconSeed, nil)
+	r.LastBase = r.InitialBase
+
+	return nil
+}
+
 /**
  * Adds a (ephemeral if possible) public key to the shuffle pool.
  */
@@ -71,6 +103,10 @@ func (r *NeffShuffleRelay) AddClient(publicKey kyber.Point) error {
 	if r.PublicKeyBeingShuffled == nil {
 		r.PublicKeyBeingShuffled = make([]kyber.Point, 0)
 	}
+	r.InitialPublicKeys = append(r.InitialPublicKeys, publicKey)
+	if r.beaconSeed != nil {
+		publicKey = config.CryptoSuite.Point().Mul(r.beaconSeed, publicKey)
+	}
 	r.PublicKeyBeingShuffled = append(r.PublicKeyBeingShuffled, publicKey)
 
 	return nil
@@ -143,13 +179,46 @@ func (r *NeffShuffleRelay) SendTranscript() (interface{}, error) {
 		return nil, errors.New("Cannot send a transcript of empty array of public keys")
 	}
 
+	initialBase, initialKeys := r.shuffleInput(0)
 	msg := &net.REL_TRU_TELL_TRANSCRIPT{
-		Bases:  r.Bases,
-		EphPks: r.ShuffledPublicKeys,
-		Proofs: r.Proofs}
+		InitialBase:   initialBase,
+		InitialEphPks: initialKeys,
+		Bases:         r.Bases,
+		EphPks:        r.ShuffledPublicKeys,
+		Proofs:        r.Proofs}
 	return msg, nil
 }
 
+/**
+ * Returns the base and the keys given to the j-th trustee : the initial ones for the first trustee (multiplied by
+ * the seed of the beacon, if any), the result of the previous shuffle for the others
+ */
+func (r *NeffShuffleRelay) shuffleInput(j int) (kyber.Point, []kyber.Point) {
+	if j > 0 {
+		return r.Bases[j-1], r.ShuffledPublicKeys[j-1].Keys
+	}
+	keys := make([]kyber.Point, len(r.InitialPublicKeys))
+	for i, pk := range r.InitialPublicKeys {
+		keys[i] = pk
+		if r.beaconSeed != nil {
+			keys[i] = config.CryptoSuite.Point().Mul(r.beaconSeed, pk)
+		}
+	}
+	return r.InitialBase, keys
+}
+
+/**
+ * Verifies the proof of the j-th shuffle of the transcript, e.g. when a trustee rejected it
+ */
+func (r *NeffShuffleRelay) VerifyShuffle(j int) error {
+
+	if j < 0 || j >= r.currentTrusteeShuffling {
+		return errors.New("Cannot verify shuffle " + strconv.Itoa(j) + ", only " + strconv.Itoa(r.currentTrusteeShuffling) + " shuffles were received")
+	}
+	base, keys := r.shuffleInput(j)
+	return crypto.VerifyNeffShuffle(base, keys, r.Bases[j], r.ShuffledPublicKeys[j].Keys, r.Proofs[j].Bytes)
+}
+
 /**
  * Simply stores the signatures
  */
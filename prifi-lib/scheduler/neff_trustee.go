@@ -94,9 +94,10 @@ func (t *NeffShuffleTrustee) ReceivedShuffleFromRelay(lastBase kyber.Point, clie
 }
 
 /**
- * We received a transcript of the whole shuffle from the relay. Check that we are included, and sign
+ * We received a transcript of the whole shuffle from the relay. Verify every shuffle, check that we are included, and sign.
+ * If a shuffle does not verify, returns a TRU_REL_SHUFFLE_REJECTED for the relay along with the error
  */
-func (t *NeffShuffleTrustee) ReceivedTranscriptFromRelay(bases []kyber.Point, shuffledPublicKeys [][]kyber.Point, proofs [][]byte) (interface{}, error) {
+func (t *NeffShuffleTrustee) ReceivedTranscriptFromRelay(initialBase kyber.Point, initialPublicKeys []kyber.Point, bases []kyber.Point, shuffledPublicKeys [][]kyber.Point, proofs [][]byte) (interface{}, error) {
 
 	if t.NewBase == nil {
 		return nil, errors.New("Cannot verify the shuffle, we didn't store the base")
@@ -107,47 +108,36 @@ func (t *NeffShuffleTrustee) ReceivedTranscriptFromRelay(bases []kyber.Point, sh
 	if t.Proof == nil {
 		return nil, errors.New("Cannot verify the shuffle, we didn't store the proof")
 	}
+	if initialBase == nil || len(initialPublicKeys) == 0 {
+		return nil, errors.New("Cannot verify the shuffle, the transcript does not contain the initial base and keys")
+	}
 	if len(bases) != len(shuffledPublicKeys) || len(bases) != len(proofs) {
 		return nil, errors.New("Size not matching, bases is " + strconv.Itoa(len(bases)) + ", shuffledPublicKeys_s is " + strconv.Itoa(len(shuffledPublicKeys)) + ", proof_s is " + strconv.Itoa(len(proofs)) + ".")
 	}
 
 	nTrustees := len(bases)
-	nClients := len(shuffledPublicKeys[0])
+	nClients := len(initialPublicKeys)
 
-	//Todo : verify each individual permutations. No verification is done yet
-	var err error
+	//verify each permutation, against the output of the previous one
+	base, keys := initialBase, initialPublicKeys
 	for j := 0; j < nTrustees; j++ {
-
-		verify := true
-		if j > 0 {
-			X := shuffledPublicKeys[j-1]
-			Y := shuffledPublicKeys[j-1]
-			Xbar := shuffledPublicKeys[j]
-			Ybar := shuffledPublicKeys[j]
-			if len(X) > 1 {
-				//verifier := shuffle.Verifier(config.CryptoSuite, nil, X[0], X, Y, Xbar, Ybar)
-				//err = crypto_proof.HashVerify(config.CryptoSuite, "PairShuffle", verifier, proofs[j])
-				_ = Y
-				_ = Xbar
-				_ = Ybar
-			}
-			if err != nil {
-				verify = false
-			}
-		}
-		verify = true // TODO: This shuffle needs to be fixed
-
-		if !verify {
-			return nil, errors.New("Could not verify the " + strconv.Itoa(j) + "th neff shuffle, error is " + err.Error())
+		if err := crypto.VerifyNeffShuffle(base, keys, bases[j], shuffledPublicKeys[j], proofs[j]); err != nil {
+			e := "Could not verify the " + strconv.Itoa(j) + "th neff shuffle, error is " + err.Error()
+			msg := &net.TRU_REL_SHUFFLE_REJECTED{
+				TrusteeID: t.TrusteeID,
+				Shuffle:   j,
+				Reason:    err.Error()}
+			return msg, errors.New(e)
 		}
+		base, keys = bases[j], shuffledPublicKeys[j]
 	}
 
 	//we verify that our shuffle was included
 	ownPermutationFound := false
 	for j := 0; j < nTrustees; j++ {
 		if bases[j].Equal(t.NewBase) && bytes.Equal(t.Proof, proofs[j]) {
-			allKeyEqual := true
-			for k := 0; k < nClients; k++ {
+			allKeyEqual := len(t.EphemeralKeys) == nClients
+			for k := 0; allKeyEqual && k < nClients; k++ {
 				if !t.EphemeralKeys[k].Equal(shuffledPublicKeys[j][k]) {
 					allKeyEqual = false
 					break
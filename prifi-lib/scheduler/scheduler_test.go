@@ -6,6 +6,7 @@ import (
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"strconv"
 	"testing"
 )
@@ -189,7 +190,7 @@ func NeffShuffleTestHelper(t *testing.T, nClients int, nTrustees int, shuffleKey
 	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
 
 	for j := 0; j < nTrustees; j++ {
-		toSend4, err := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
+		toSend4, err := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.InitialBase, parsed3.InitialEphPks, parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
 		if err != nil {
 			t.Error(err)
 		}
@@ -219,6 +220,54 @@ func NeffShuffleTestHelper(t *testing.T, nClients int, nTrustees int, shuffleKey
 	}
 	parsed5 := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
 
+	//the exported transcript should survive encoding, and verify against the long-term keys of the trustees, in any order
+	groupKeys, endorsements := endorseTrusteesKeys(t, trusteesPks)
+	transcript, err := n.RelayView.ExportTranscript(trusteesPks, endorsements)
+	if err != nil {
+		t.Error(err)
+	}
+	data, err := transcript.ToBytes()
+	if err != nil {
+		t.Error(err)
+	}
+	transcript2, err := SetupTranscriptFromBytes(data)
+	if err != nil {
+		t.Error(err)
+	}
+	reversed := make([]kyber.Point, nTrustees)
+	for j := range groupKeys {
+		reversed[nTrustees-1-j] = groupKeys[j]
+	}
+	verdict := VerifySetupTranscript(transcript2, reversed)
+	if !verdict.Valid || verdict.ShuffleProofs != verdictOK || verdict.TrusteesKeys != verdictOK {
+		t.Error("Transcript should verify, errors are", verdict.Errors)
+	}
+	if VerifySetupTranscript(transcript2, append(groupKeys, config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream()))).Valid {
+		t.Error("Transcript should not verify with the wrong number of trustees")
+	}
+
+	//keys made up by the relay, or endorsed by another key than the group's, are refused before the signatures
+	otherKeys, _ := endorseTrusteesKeys(t, trusteesPks)
+	if v := VerifySetupTranscript(transcript2, otherKeys); v.TrusteesKeys != verdictFailed || v.Signatures != verdictSkipped {
+		t.Error("Transcript should not verify with the keys of another group")
+	}
+	if nTrustees > 1 {
+		twice := append([]kyber.Point{}, groupKeys...)
+		twice[nTrustees-1] = groupKeys[0]
+		if VerifySetupTranscript(transcript2, twice).TrusteesKeys != verdictFailed {
+			t.Error("Transcript should not verify with a key of the group endorsing two trustees")
+		}
+	}
+
+	transcript2.Signatures[0][0] ^= 0xFF
+	if VerifySetupTranscript(transcript2, groupKeys).Signatures != verdictFailed {
+		t.Error("Transcript should not verify with a tampered signature")
+	}
+	transcript2.Proofs[nTrustees-1][len(transcript2.Proofs[nTrustees-1])-1] ^= 0xFF
+	if VerifySetupTranscript(transcript2, groupKeys).ShuffleProofs != verdictFailed {
+		t.Error("Transcript should not verify with a tampered proof")
+	}
+
 	mapping := make([]int, nClients)
 
 	//client verify the sig and recognize their slot
@@ -310,6 +359,34 @@ func TestWholeNeffShuffleClientErrors(t *testing.T) {
 	}
 }
 
+func TestClientRecognizeExtraSlots(t *testing.T) {
+
+	n := new(NeffShuffle)
+	base := config.CryptoSuite.Point().Base()
+
+	//a client owning 2 of 3 slots; the shuffle is the identity here, only the lookup is tested
+	pub0, priv0 := crypto.NewKeyPair()
+	pub1, _ := crypto.NewKeyPair()
+	pub2, priv2 := crypto.NewKeyPair()
+	shuffled := []kyber.Point{pub1, pub2, pub0}
+
+	slots, err := n.ClientRecognizeExtraSlots([]kyber.Scalar{priv0, priv2}, base, shuffled)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(slots) != 2 || slots[0] != 2 || slots[1] != 1 {
+		t.Error("slots should be [2 1], but are", slots)
+	}
+
+	_, unknown := crypto.NewKeyPair()
+	if _, err := n.ClientRecognizeExtraSlots([]kyber.Scalar{unknown}, base, shuffled); err == nil {
+		t.Error("ClientRecognizeExtraSlots should fail with a key not in the shuffle")
+	}
+	if _, err := n.ClientRecognizeExtraSlots([]kyber.Scalar{priv0}, nil, shuffled); err == nil {
+		t.Error("ClientRecognizeExtraSlots should fail without base")
+	}
+}
+
 func TestWholeNeffShuffleRelayErrors(t *testing.T) {
 
 	pub, _ := crypto.NewKeyPair()
@@ -413,6 +490,103 @@ func TestWholeNeffShuffleRelayErrors(t *testing.T) {
 	}
 }
 
+func TestNeffShuffleTamperedProof(t *testing.T) {
+
+	nClients, nTrustees := 3, 2
+	n := new(NeffShuffle)
+	n.Init()
+	n.RelayView.Init(nTrustees)
+	for i := 0; i < nClients; i++ {
+		pub, _ := crypto.NewKeyPair()
+		n.RelayView.AddClient(pub)
+	}
+
+	trustees := make([]*NeffShuffle, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trustees[i] = new(NeffShuffle)
+		trustees[i].Init()
+		pub, priv := crypto.NewKeyPair()
+		trustees[i].TrusteeView.Init(i, priv, pub)
+
+		toSend, _, _ := n.RelayView.SendToNextTrustee()
+		parsed := toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+		toSend2, err := trustees[i].TrusteeView.ReceivedShuffleFromRelay(parsed.Base, parsed.EphPks, true, make([]byte, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed2 := toSend2.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+		n.RelayView.ReceivedShuffleFromTrustee(parsed2.NewBase, parsed2.NewEphPks, parsed2.Proof)
+	}
+	for j := 0; j < nTrustees; j++ {
+		if err := n.RelayView.VerifyShuffle(j); err != nil {
+			t.Error("Shuffle", j, "should verify,", err)
+		}
+	}
+	if n.RelayView.VerifyShuffle(nTrustees) == nil {
+		t.Error("Should not verify a shuffle which was not received")
+	}
+
+	//the second proof is altered on its way to the trustees
+	toSend3, _ := n.RelayView.SendTranscript()
+	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
+	proofs := parsed3.GetProofs()
+	tampered := make([]byte, len(proofs[1]))
+	copy(tampered, proofs[1])
+	tampered[len(tampered)-1] ^= 0xFF
+	proofs[1] = tampered
+
+	toSend4, err := trustees[0].TrusteeView.ReceivedTranscriptFromRelay(parsed3.InitialBase, parsed3.InitialEphPks, parsed3.Bases, parsed3.GetKeys(), proofs)
+	if err == nil {
+		t.Error("Trustee should not accept a transcript with a tampered proof")
+	}
+	rejected, ok := toSend4.(*net.TRU_REL_SHUFFLE_REJECTED)
+	if !ok {
+		t.Fatal("Trustee should reject the transcript, but answered", toSend4)
+	}
+	if rejected.TrusteeID != 0 || rejected.Shuffle != 1 {
+		t.Error("Trustee 0 should reject shuffle 1, got", rejected.TrusteeID, rejected.Shuffle)
+	}
+
+	//the shuffles of the relay's transcript are fine, so the rejection is not the fault of trustee 1
+	if err := n.RelayView.VerifyShuffle(rejected.Shuffle); err != nil {
+		t.Error("The relay's copy of the shuffle should verify,", err)
+	}
+	n.RelayView.Proofs[1].Bytes = tampered
+	if n.RelayView.VerifyShuffle(rejected.Shuffle) == nil {
+		t.Error("A tampered shuffle should not verify at the relay")
+	}
+}
+
+func TestNeffShuffleRelayInitAgain(t *testing.T) {
+
+	n := new(NeffShuffle)
+	n.Init()
+	n.RelayView.Init(1)
+	pub, _ := crypto.NewKeyPair()
+	n.RelayView.AddClient(pub)
+	n.RelayView.SendToNextTrustee()
+	n.RelayView.ReceivedSignatureFromTrustee(0, make([]byte, 10))
+
+	// a second shuffle, e.g. when clients join during the session
+	n.RelayView.Init(1)
+	pub2, _ := crypto.NewKeyPair()
+	if err := n.RelayView.AddClient(pub); err != nil {
+		t.Error("Should be able to add keys after Init, even if the previous shuffle started", err)
+	}
+	n.RelayView.AddClient(pub2)
+	msg, _, err := n.RelayView.SendToNextTrustee()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE).EphPks) != 2 {
+		t.Error("The keys of the previous shuffle should be forgotten")
+	}
+	done, _ := n.RelayView.ReceivedSignatureFromTrustee(0, make([]byte, 10))
+	if !done {
+		t.Error("The signatures of the previous shuffle should be forgotten")
+	}
+}
+
 func TestWholeNeffShuffleTrusteeErrors(t *testing.T) {
 
 	pub, priv := crypto.NewKeyPair()
@@ -458,22 +632,26 @@ func TestWholeNeffShuffleTrusteeErrors(t *testing.T) {
 	bases := make([]kyber.Point, 2)
 	shuffledPublicKeys := make([][]kyber.Point, 3)
 	proofs := make([][]byte, 4)
-	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(nil, shuffledPublicKeys, proofs)
+	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(base, ephPks, nil, shuffledPublicKeys, proofs)
 	if err == nil {
 		t.Error("Shouldn't accept a transcript with nil instead of bases")
 	}
-	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(bases, nil, proofs)
+	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(base, ephPks, bases, nil, proofs)
 	if err == nil {
 		t.Error("Shouldn't accept a transcript with nil instead of bases")
 	}
-	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(bases, shuffledPublicKeys, nil)
+	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(base, ephPks, bases, shuffledPublicKeys, nil)
 	if err == nil {
 		t.Error("Shouldn't accept a transcript with nil instead of bases")
 	}
-	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(bases, shuffledPublicKeys, proofs)
+	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(base, ephPks, bases, shuffledPublicKeys, proofs)
 	if err == nil {
 		t.Error("Shouldn't accept a transcript when elements mismatch in sizes")
 	}
+	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(nil, ephPks, bases, shuffledPublicKeys, proofs)
+	if err == nil {
+		t.Error("Shouldn't accept a transcript without the initial base")
+	}
 
 	//more in-depth checks
 	bases = make([]kyber.Point, 1)
@@ -496,8 +674,128 @@ func TestWholeNeffShuffleTrusteeErrors(t *testing.T) {
 	}
 	ephPks_s[0][0] = newPub
 
-	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(bases, ephPks_s, proofs)
+	_, err = n.TrusteeView.ReceivedTranscriptFromRelay(base, ephPks, bases, ephPks_s, proofs)
 	if err == nil {
 		t.Error("Shouldn't accept a transcript when one key has been changed !")
 	}
 }
+
+func TestNeffShuffleWithBeacon(t *testing.T) {
+
+	nClients, nTrustees := 3, 2
+	beacon := &crypto.RandomBeacon{Round: 7, Value: []byte{1, 2, 3, 4}}
+
+	n := new(NeffShuffle)
+	n.Init()
+	n.RelayView.Init(nTrustees)
+	if err := n.RelayView.SetBeacon(nil); err == nil {
+		t.Error("Should not be able to set a nil beacon")
+	}
+	if err := n.RelayView.SetBeacon(beacon); err != nil {
+		t.Error(err)
+	}
+	if n.RelayView.InitialBase.Equal(config.CryptoSuite.Point().Base()) {
+		t.Error("The initial base should derive from the beacon")
+	}
+
+	clients := make([]*PrivatePublicPair, nClients)
+	for i := 0; i < nClients; i++ {
+		pub, priv := crypto.NewKeyPair()
+		clients[i] = &PrivatePublicPair{Public: pub, Private: priv}
+		n.RelayView.AddClient(pub)
+	}
+	if err := n.RelayView.SetBeacon(beacon); err == nil {
+		t.Error("Should not be able to set the beacon once keys were added")
+	}
+
+	trusteesPks := make([]kyber.Point, nTrustees)
+	trustees := make([]*NeffShuffle, nTrustees)
+	for i := 0; i < nTrustees; i++ {
+		trustees[i] = new(NeffShuffle)
+		trustees[i].Init()
+		pub, priv := crypto.NewKeyPair()
+		trustees[i].TrusteeView.Init(i, priv, pub)
+		trusteesPks[i] = pub
+
+		toSend, _, err := n.RelayView.SendToNextTrustee()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+		toSend2, err := trustees[i].TrusteeView.ReceivedShuffleFromRelay(parsed.Base, parsed.EphPks, true, make([]byte, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed2 := toSend2.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+		n.RelayView.ReceivedShuffleFromTrustee(parsed2.NewBase, parsed2.NewEphPks, parsed2.Proof)
+	}
+
+	toSend3, _ := n.RelayView.SendTranscript()
+	parsed3 := toSend3.(*net.REL_TRU_TELL_TRANSCRIPT)
+	for j := 0; j < nTrustees; j++ {
+		toSend4, err := trustees[j].TrusteeView.ReceivedTranscriptFromRelay(parsed3.InitialBase, parsed3.InitialEphPks, parsed3.Bases, parsed3.GetKeys(), parsed3.GetProofs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed4 := toSend4.(*net.TRU_REL_SHUFFLE_SIG)
+		n.RelayView.ReceivedSignatureFromTrustee(parsed4.TrusteeID, parsed4.Sig)
+	}
+	toSend5, err := n.RelayView.VerifySigsAndSendToClients(trusteesPks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed5 := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+
+	//the clients still find their slots in the final base
+	slots := make(map[int]bool)
+	for j := 0; j < nClients; j++ {
+		slot, err := n.ClientVerifySigAndRecognizeSlot(clients[j].Private, trusteesPks, parsed5.Base, parsed5.EphPks, parsed5.GetSignatures())
+		if err != nil {
+			t.Error(err)
+		}
+		slots[slot] = true
+	}
+	if len(slots) != nClients {
+		t.Error("Each client should have its own slot, slots are", slots)
+	}
+
+	//the beacon is recorded in the transcript, and the base is checked against it
+	transcript, err := n.RelayView.ExportTranscript(trusteesPks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := transcript.ToBytes()
+	transcript2, err := SetupTranscriptFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transcript2.Beacon == nil || transcript2.Beacon.String() != beacon.String() {
+		t.Error("The transcript should record the beacon")
+	}
+	verdict := VerifySetupTranscript(transcript2, nil)
+	if !verdict.Valid || verdict.Beacon != verdictOK {
+		t.Error("Transcript should verify, errors are", verdict.Errors)
+	}
+	transcript2.Beacon = &crypto.RandomBeacon{Round: 8, Value: []byte{1, 2, 3, 4}}
+	if VerifySetupTranscript(transcript2, nil).Beacon != verdictFailed {
+		t.Error("Transcript should not verify with another beacon")
+	}
+}
+
+// endorseTrusteesKeys picks a long-term key per trustee, and endorses with it the trustee's key of the session
+func endorseTrusteesKeys(t *testing.T, trusteesPks []kyber.Point) ([]kyber.Point, [][]byte) {
+	groupKeys := make([]kyber.Point, len(trusteesPks))
+	endorsements := make([][]byte, len(trusteesPks))
+	for j, pk := range trusteesPks {
+		var private kyber.Scalar
+		groupKeys[j], private = crypto.NewKeyPair()
+		msg, err := crypto.TrusteeKeyEndorsementMessage(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endorsements[j], err = schnorr.Sign(config.CryptoSuite, private, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return groupKeys, endorsements
+}
@@ -0,0 +1,383 @@
+package scheduler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"strconv"
+)
+
+/**
+ * The full record of one setup phase (Neff shuffle of the client's ephemeral keys + the trustees' signatures).
+ * It is exported by the relay, and can be re-verified offline by anyone holding it.
+ */
+type SetupTranscript struct {
+	Beacon               *crypto.RandomBeacon // nil if the relay did not use an external random beacon
+	InitialBase          kyber.Point
+	ClientsEphPks        []kyber.Point
+	TrusteesPublicKeys   []kyber.Point
+	TrusteesEndorsements [][]byte // the signatures of TrusteesPublicKeys by the trustees' long-term keys; empty for a trustee without one
+	Bases                []kyber.Point
+	ShuffledPublicKeys   [][]kyber.Point
+	Proofs               [][]byte
+	Signatures           [][]byte
+}
+
+// TranscriptVerdict is the (JSON-serializable) result of VerifySetupTranscript
+type TranscriptVerdict struct {
+	Valid         bool
+	Sizes         string
+	Beacon        string
+	TrusteesKeys  string
+	KeySets       string
+	ShuffleProofs string
+	Signatures    string
+	Errors        []string
+}
+
+const (
+	verdictOK      = "ok"
+	verdictFailed  = "failed"
+	verdictSkipped = "skipped"
+)
+
+// the on-disk format of the transcript; points are hex-encoded
+type setupTranscriptFile struct {
+	Beacon               string `json:",omitempty"`
+	InitialBase          string
+	ClientsEphPks        []string
+	TrusteesPublicKeys   []string
+	TrusteesEndorsements []string `json:",omitempty"`
+	Bases                []string
+	ShuffledPublicKeys   [][]string
+	Proofs               []string
+	Signatures           []string
+}
+
+/**
+ * Packages everything the relay kept during the shuffle into a SetupTranscript. Must be called once all signatures
+ * have been collected. trusteesEndorsements are the signatures of the trustees' keys by their long-term keys, nil if
+ * they have none.
+ */
+func (r *NeffShuffleRelay) ExportTranscript(trusteesPublicKeys []kyber.Point, trusteesEndorsements [][]byte) (*SetupTranscript, error) {
+
+	if r.SignatureCount != r.NTrustees {
+		return nil, errors.New("Cannot export the transcript, only " + strconv.Itoa(r.SignatureCount) + " signatures out of " + strconv.Itoa(r.NTrustees))
+	}
+	if len(trusteesPublicKeys) != r.NTrustees {
+		return nil, errors.New("Cannot export the transcript, got " + strconv.Itoa(len(trusteesPublicKeys)) + " trustees public keys for " + strconv.Itoa(r.NTrustees) + " trustees")
+	}
+	if trusteesEndorsements == nil {
+		trusteesEndorsements = make([][]byte, r.NTrustees)
+	}
+	if len(trusteesEndorsements) != r.NTrustees {
+		return nil, errors.New("Cannot export the transcript, got " + strconv.Itoa(len(trusteesEndorsements)) + " endorsements for " + strconv.Itoa(r.NTrustees) + " trustees")
+	}
+
+	t := &SetupTranscript{
+		Beacon:               r.Beacon,
+		InitialBase:          r.InitialBase,
+		ClientsEphPks:        r.InitialPublicKeys,
+		TrusteesPublicKeys:   trusteesPublicKeys,
+		TrusteesEndorsements: trusteesEndorsements,
+		Bases:                r.Bases,
+		ShuffledPublicKeys:   make([][]kyber.Point, r.NTrustees),
+		Proofs:               make([][]byte, r.NTrustees),
+		Signatures:           make([][]byte, r.NTrustees),
+	}
+	for j := 0; j < r.NTrustees; j++ {
+		t.ShuffledPublicKeys[j] = r.ShuffledPublicKeys[j].Keys
+		t.Proofs[j] = r.Proofs[j].Bytes
+		t.Signatures[j] = r.Signatures[j].Bytes
+	}
+
+	return t, nil
+}
+
+/**
+ * Re-runs all the verifications on a transcript : sizes, the trustees' keys, key sets (each shuffle outputs as many
+ * distinct keys as there are clients), shuffle proofs, and the trustees' signatures on the last shuffle.
+ * If groupKeys is not nil, the transcript must contain exactly one trustee per key (e.g., the long-term keys of the
+ * trustees of the group file), and the key of each trustee must be endorsed by a distinct one of them; otherwise,
+ * the signatures could come from any key, and are not checked
+ */
+func VerifySetupTranscript(t *SetupTranscript, groupKeys []kyber.Point) *TranscriptVerdict {
+
+	v := &TranscriptVerdict{
+		Sizes:         verdictSkipped,
+		Beacon:        verdictSkipped,
+		TrusteesKeys:  verdictSkipped,
+		KeySets:       verdictSkipped,
+		ShuffleProofs: verdictSkipped,
+		Signatures:    verdictSkipped,
+		Errors:        make([]string, 0),
+	}
+	fail := func(e string) {
+		v.Errors = append(v.Errors, e)
+	}
+
+	if t == nil {
+		fail("transcript is nil")
+		return v
+	}
+
+	//sizes
+	n := len(t.TrusteesPublicKeys)
+	nClients := len(t.ClientsEphPks)
+	v.Sizes = verdictOK
+	if n == 0 || nClients == 0 {
+		v.Sizes = verdictFailed
+		fail("transcript has " + strconv.Itoa(n) + " trustees and " + strconv.Itoa(nClients) + " clients")
+	}
+	if groupKeys != nil && (n != len(groupKeys) || len(t.TrusteesEndorsements) != n) {
+		v.Sizes = verdictFailed
+		fail("transcript has " + strconv.Itoa(n) + " trustees and " + strconv.Itoa(len(t.TrusteesEndorsements)) +
+			" endorsements, expected " + strconv.Itoa(len(groupKeys)))
+	}
+	if len(t.Bases) != n || len(t.ShuffledPublicKeys) != n || len(t.Proofs) != n || len(t.Signatures) != n {
+		v.Sizes = verdictFailed
+		fail("Size not matching, Bases is " + strconv.Itoa(len(t.Bases)) + ", ShuffledPublicKeys is " + strconv.Itoa(len(t.ShuffledPublicKeys)) +
+			", Proofs is " + strconv.Itoa(len(t.Proofs)) + ", Signatures is " + strconv.Itoa(len(t.Signatures)) + ".")
+	}
+	if v.Sizes == verdictFailed {
+		return v
+	}
+
+	//the initial base must derive from the beacon, if one was used
+	if t.Beacon != nil {
+		v.Beacon = verdictOK
+		if t.InitialBase == nil || !t.InitialBase.Equal(config.CryptoSuite.Point().Mul(t.Beacon.ShuffleSeed(), nil)) {
+			v.Beacon = verdictFailed
+			fail("the initial base does not derive from the random beacon of round " + strconv.FormatUint(t.Beacon.Round, 10))
+		}
+	}
+
+	//the keys of the trustees must be endorsed by the ones of the group, each by a distinct one
+	if groupKeys != nil {
+		v.TrusteesKeys = verdictOK
+		endorsedBy := make(map[int]int)
+		for j := 0; j < n; j++ {
+			found := false
+			for g, key := range groupKeys {
+				if _, used := endorsedBy[g]; used {
+					continue
+				}
+				if crypto.VerifyTrusteeKeyEndorsement(key, t.TrusteesPublicKeys[j], t.TrusteesEndorsements[j]) == nil {
+					endorsedBy[g] = j
+					found = true
+					break
+				}
+			}
+			if !found {
+				v.TrusteesKeys = verdictFailed
+				fail("the key of trustee " + strconv.Itoa(j) + " is not endorsed by a trustee of the group")
+			}
+		}
+	}
+
+	//key sets
+	v.KeySets = verdictOK
+	if !distinctPoints(t.ClientsEphPks) {
+		v.KeySets = verdictFailed
+		fail("the clients' ephemeral public keys contain nil or duplicate keys")
+	}
+	for j := 0; j < n; j++ {
+		if t.Bases[j] == nil {
+			v.KeySets = verdictFailed
+			fail("base " + strconv.Itoa(j) + " is nil")
+		}
+		if len(t.ShuffledPublicKeys[j]) != nClients {
+			v.KeySets = verdictFailed
+			fail("shuffle " + strconv.Itoa(j) + " has " + strconv.Itoa(len(t.ShuffledPublicKeys[j])) + " keys, expected " + strconv.Itoa(nClients))
+		} else if !distinctPoints(t.ShuffledPublicKeys[j]) {
+			v.KeySets = verdictFailed
+			fail("shuffle " + strconv.Itoa(j) + " contains nil or duplicate keys")
+		}
+	}
+
+	//shuffle proofs, each against the output of the previous shuffle. The first shuffle takes the clients' keys,
+	//multiplied by the seed of the beacon if one was used
+	if v.KeySets == verdictOK && t.InitialBase != nil {
+		v.ShuffleProofs = verdictOK
+		base, keys := t.InitialBase, t.ClientsEphPks
+		if t.Beacon != nil {
+			seed := t.Beacon.ShuffleSeed()
+			keys = make([]kyber.Point, nClients)
+			for i, pk := range t.ClientsEphPks {
+				keys[i] = config.CryptoSuite.Point().Mul(seed, pk)
+			}
+		}
+		for j := 0; j < n; j++ {
+			if err := crypto.VerifyNeffShuffle(base, keys, t.Bases[j], t.ShuffledPublicKeys[j], t.Proofs[j]); err != nil {
+				v.ShuffleProofs = verdictFailed
+				fail("proof " + strconv.Itoa(j) + " does not verify, " + err.Error())
+			}
+			base, keys = t.Bases[j], t.ShuffledPublicKeys[j]
+		}
+	}
+
+	//signatures on the last shuffle, once the keys which made them are known to be the group's
+	if v.KeySets == verdictOK && v.TrusteesKeys == verdictOK {
+		last := n - 1
+		if _, err := multiSigVerify(t.TrusteesPublicKeys, t.Bases[last], t.ShuffledPublicKeys[last], t.Signatures); err != nil {
+			v.Signatures = verdictFailed
+			fail(err.Error())
+		} else {
+			v.Signatures = verdictOK
+		}
+	}
+
+	v.Valid = len(v.Errors) == 0
+	return v
+}
+
+// true iff no point is nil, and no point appears twice
+func distinctPoints(points []kyber.Point) bool {
+	for i := range points {
+		if points[i] == nil {
+			return false
+		}
+		for j := 0; j < i; j++ {
+			if points[i].Equal(points[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ToBytes encodes the transcript to JSON
+func (t *SetupTranscript) ToBytes() ([]byte, error) {
+	f := new(setupTranscriptFile)
+	var err error
+
+	f.Beacon = t.Beacon.String()
+	if f.InitialBase, err = pointToHex(t.InitialBase); err != nil {
+		return nil, err
+	}
+	if f.ClientsEphPks, err = pointsToHex(t.ClientsEphPks); err != nil {
+		return nil, err
+	}
+	if f.TrusteesPublicKeys, err = pointsToHex(t.TrusteesPublicKeys); err != nil {
+		return nil, err
+	}
+	if len(t.TrusteesEndorsements) > 0 {
+		f.TrusteesEndorsements = bytesToHex(t.TrusteesEndorsements)
+	}
+	if f.Bases, err = pointsToHex(t.Bases); err != nil {
+		return nil, err
+	}
+	f.ShuffledPublicKeys = make([][]string, len(t.ShuffledPublicKeys))
+	for j := range t.ShuffledPublicKeys {
+		if f.ShuffledPublicKeys[j], err = pointsToHex(t.ShuffledPublicKeys[j]); err != nil {
+			return nil, err
+		}
+	}
+	f.Proofs = bytesToHex(t.Proofs)
+	f.Signatures = bytesToHex(t.Signatures)
+
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// SetupTranscriptFromBytes decodes a transcript encoded with ToBytes
+func SetupTranscriptFromBytes(data []byte) (*SetupTranscript, error) {
+	f := new(setupTranscriptFile)
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+
+	t := new(SetupTranscript)
+	var err error
+
+	if t.Beacon, err = crypto.ParseRandomBeacon(f.Beacon); err != nil {
+		return nil, err
+	}
+	if t.InitialBase, err = hexToPoint(f.InitialBase); err != nil {
+		return nil, err
+	}
+	if t.ClientsEphPks, err = hexToPoints(f.ClientsEphPks); err != nil {
+		return nil, err
+	}
+	if t.TrusteesPublicKeys, err = hexToPoints(f.TrusteesPublicKeys); err != nil {
+		return nil, err
+	}
+	if t.TrusteesEndorsements, err = hexToBytes(f.TrusteesEndorsements); err != nil {
+		return nil, err
+	}
+	if t.Bases, err = hexToPoints(f.Bases); err != nil {
+		return nil, err
+	}
+	t.ShuffledPublicKeys = make([][]kyber.Point, len(f.ShuffledPublicKeys))
+	for j := range f.ShuffledPublicKeys {
+		if t.ShuffledPublicKeys[j], err = hexToPoints(f.ShuffledPublicKeys[j]); err != nil {
+			return nil, err
+		}
+	}
+	if t.Proofs, err = hexToBytes(f.Proofs); err != nil {
+		return nil, err
+	}
+	if t.Signatures, err = hexToBytes(f.Signatures); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func pointToHex(p kyber.Point) (string, error) {
+	if p == nil {
+		return "", errors.New("Cannot encode a nil point")
+	}
+	return encoding.PointToStringHex(config.CryptoSuite, p)
+}
+
+func pointsToHex(points []kyber.Point) ([]string, error) {
+	out := make([]string, len(points))
+	for i, p := range points {
+		s, err := pointToHex(p)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func hexToPoint(s string) (kyber.Point, error) {
+	return encoding.StringHexToPoint(config.CryptoSuite, s)
+}
+
+func hexToPoints(strs []string) ([]kyber.Point, error) {
+	out := make([]kyber.Point, len(strs))
+	for i, s := range strs {
+		p, err := hexToPoint(s)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = p
+	}
+	return out, nil
+}
+
+func bytesToHex(arrays [][]byte) []string {
+	out := make([]string, len(arrays))
+	for i, b := range arrays {
+		out[i] = hex.EncodeToString(b)
+	}
+	return out
+}
+
+func hexToBytes(strs []string) ([][]byte, error) {
+	out := make([][]byte, len(strs))
+	for i, s := range strs {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = b
+	}
+	return out, nil
+}
@@ -0,0 +1,222 @@
+package transform
+
+import (
+	"encoding/binary"
+)
+
+/*
+With the FEC, the rounds of a slot are cut into blocks of interleave * (data + parity) rounds. Position p of a block
+goes to group p % interleave, of which it is the shard p / interleave : the data shards come first, then the parity
+shards, computed once all the data shards of the group are sent.
+
+Each payload starts with the block number (4 bytes) and the position in the block (1 byte), then the shard. A data
+shard starts with the length of its content (2 bytes), then the content, padded with zeros. All the shards of a block
+have the same size, the payload size minus the header.
+*/
+
+// FEC_HEADER_SIZE is the size of the header of each payload : the block number and the position in the block
+const FEC_HEADER_SIZE = 5
+
+// FEC_OVERHEAD is how many bytes of each payload the FEC takes : its header, and the length of the content
+const FEC_OVERHEAD = FEC_HEADER_SIZE + 2
+
+// MAX_BLOCK_ROUNDS is the largest number of rounds in a block, whose positions fit in a byte
+const MAX_BLOCK_ROUNDS = 255
+
+// fec is the FEC of one slot; a client uses it to encode, the relay to decode
+type fec struct {
+	k, m, d int
+	rs      *reedSolomon
+
+	// the block being encoded or decoded
+	started   bool
+	block     uint32
+	shardSize int
+	shards    [][][]byte // per group, the k data shards then the m parity shards; nil if not known (yet)
+
+	// encoding
+	position int // of the next payload
+
+	// decoding
+	dataOrder []int // the positions of the data shards, in order
+	next      int   // the index in dataOrder of the next content to deliver
+	lastSeen  int   // the largest position received in the block, -1 if none
+	lastRound int32 // the round of the last payload received
+	stats     Statistics
+}
+
+func newFEC(k, m, d int) *fec {
+	rs, err := newReedSolomon(k, m)
+	if err != nil {
+		panic(err) // Parse checked the parameters
+	}
+	f := &fec{k: k, m: m, d: d, rs: rs}
+	for p := 0; p < f.blockRounds(); p++ {
+		if p/d < k {
+			f.dataOrder = append(f.dataOrder, p)
+		}
+	}
+	return f
+}
+
+func (f *fec) blockRounds() int {
+	return f.d * (f.k + f.m)
+}
+
+// lastPosition returns the position of the last shard of group g in a block
+func (f *fec) lastPosition(g int) int {
+	return (f.k+f.m-1)*f.d + g
+}
+
+// startBlock forgets the shards of the current block, and starts block
+func (f *fec) startBlock(block uint32, shardSize int) {
+	f.started = true
+	f.block = block
+	f.shardSize = shardSize
+	f.shards = make([][][]byte, f.d)
+	for g := range f.shards {
+		f.shards[g] = make([][]byte, f.k+f.m)
+	}
+	f.position = 0
+	f.next = 0
+	f.lastSeen = -1
+}
+
+func (f *fec) Overhead() int {
+	return FEC_OVERHEAD
+}
+
+func (f *fec) TakesContent() bool {
+	return f.position/f.d < f.k
+}
+
+func (f *fec) Encode(content []byte, size int) []byte {
+	shardSize := size - FEC_HEADER_SIZE
+	if !f.started {
+		f.startBlock(0, shardSize)
+	} else if shardSize != f.shardSize {
+		// the shards of a group must have the same size : the relay gives up on the rest of the block
+		f.startBlock(f.block+1, shardSize)
+	}
+
+	g, i := f.position%f.d, f.position/f.d
+	shard := make([]byte, shardSize)
+	if i < f.k {
+		if len(content) > shardSize-2 {
+			content = content[:shardSize-2]
+		}
+		binary.BigEndian.PutUint16(shard[0:2], uint16(len(content)))
+		copy(shard[2:], content)
+		f.shards[g][i] = shard
+	} else {
+		if f.shards[g][f.k] == nil {
+			copy(f.shards[g][f.k:], f.rs.encode(f.shards[g][:f.k]))
+		}
+		copy(shard, f.shards[g][i])
+	}
+
+	payload := make([]byte, FEC_HEADER_SIZE, size)
+	binary.BigEndian.PutUint32(payload[0:4], f.block)
+	payload[4] = byte(f.position)
+	payload = append(payload, shard...)
+
+	f.position++
+	if f.position == f.blockRounds() {
+		f.startBlock(f.block+1, shardSize)
+	}
+	return payload
+}
+
+func (f *fec) Decode(roundID int32, payload []byte) []Content {
+	if len(payload) < FEC_OVERHEAD {
+		return nil
+	}
+	block := binary.BigEndian.Uint32(payload[0:4])
+	position := int(payload[4])
+	shardSize := len(payload) - FEC_HEADER_SIZE
+	if position >= f.blockRounds() {
+		return nil
+	}
+
+	var contents []Content
+	if !f.started || block != f.block || shardSize != f.shardSize {
+		if f.started {
+			contents = f.deliver(true)
+		}
+		f.startBlock(block, shardSize)
+	}
+
+	// the decoded payload may be reused by the relay once processed
+	g, i := position%f.d, position/f.d
+	f.shards[g][i] = append([]byte(nil), payload[FEC_HEADER_SIZE:]...)
+	if position > f.lastSeen {
+		f.lastSeen = position
+	}
+	f.lastRound = roundID
+
+	contents = append(contents, f.deliver(false)...)
+	if f.lastSeen == f.blockRounds()-1 {
+		contents = append(contents, f.deliver(true)...)
+		f.started = false
+	}
+	return contents
+}
+
+func (f *fec) Flush() []Content {
+	if !f.started {
+		return nil
+	}
+	contents := f.deliver(true)
+	f.started = false
+	return contents
+}
+
+// deliver returns the contents of the data shards known or rebuilt, in order, up to the first one still missing.
+// A missing shard is given up (lost) if force is true, or if every shard of its group was sent already.
+func (f *fec) deliver(force bool) []Content {
+	var contents []Content
+	for ; f.next < len(f.dataOrder); f.next++ {
+		p := f.dataOrder[f.next]
+		g, i := p%f.d, p/f.d
+		if f.shards[g][i] == nil {
+			f.rebuild(g)
+		}
+		shard := f.shards[g][i]
+		if shard == nil {
+			if !force && f.lastSeen < f.lastPosition(g) {
+				break
+			}
+			f.stats.Lost++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(shard[0:2]))
+		if length > len(shard)-2 {
+			f.stats.Lost++
+			continue
+		}
+		contents = append(contents, Content{RoundID: f.lastRound, Data: shard[2 : 2+length]})
+	}
+	return contents
+}
+
+// rebuild fills the missing data shards of group g, if enough shards of the group arrived
+func (f *fec) rebuild(g int) {
+	missing, present := 0, 0
+	for i, shard := range f.shards[g] {
+		if shard != nil {
+			present++
+		} else if i < f.k {
+			missing++
+		}
+	}
+	if missing == 0 || present < f.k {
+		return
+	}
+	if f.rs.reconstruct(f.shards[g]) == nil {
+		f.stats.Rebuilt += int64(missing)
+	}
+}
+
+func (f *fec) Statistics() Statistics {
+	return f.stats
+}
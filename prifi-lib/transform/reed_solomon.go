@@ -0,0 +1,175 @@
+package transform
+
+import "errors"
+
+/*
+A systematic Reed-Solomon code over GF(2^8) : k data shards and m parity shards of the same size, any k of which
+give back the data shards. Parity shard i is the sum, over the data shards j, of c(i,j) * data_j, where c is the
+Cauchy matrix 1 / (x_i + y_j), with x_i = k + i and y_j = j; every square submatrix of [identity; c] is invertible.
+*/
+
+// MAX_SHARDS is the largest number of shards (data and parity) of a code
+const MAX_SHARDS = 256
+
+// the polynomial of GF(2^8), x^8 + x^4 + x^3 + x^2 + 1
+const gfPolynomial = 0x11d
+
+var gfExp [2 * MAX_SHARDS]byte
+var gfLog [MAX_SHARDS]int
+
+func init() {
+	x := 1
+	for i := 0; i < MAX_SHARDS-1; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x >= MAX_SHARDS {
+			x ^= gfPolynomial
+		}
+	}
+	for i := MAX_SHARDS - 1; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-(MAX_SHARDS-1)]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[MAX_SHARDS-1-gfLog[a]]
+}
+
+// reedSolomon is a code of k data shards and m parity shards
+type reedSolomon struct {
+	k, m   int
+	cauchy [][]byte // m rows of k coefficients
+}
+
+func newReedSolomon(k, m int) (*reedSolomon, error) {
+	if k < 1 || m < 0 || k+m > MAX_SHARDS {
+		return nil, errors.New("a Reed-Solomon code needs at least 1 data shard, and at most 256 shards")
+	}
+	rs := &reedSolomon{k: k, m: m, cauchy: make([][]byte, m)}
+	for i := 0; i < m; i++ {
+		rs.cauchy[i] = make([]byte, k)
+		for j := 0; j < k; j++ {
+			rs.cauchy[i][j] = gfInv(byte(k+i) ^ byte(j))
+		}
+	}
+	return rs, nil
+}
+
+// row returns the coefficients of shard i (data or parity) over the data shards
+func (rs *reedSolomon) row(i int) []byte {
+	if i < rs.k {
+		row := make([]byte, rs.k)
+		row[i] = 1
+		return row
+	}
+	return rs.cauchy[i-rs.k]
+}
+
+// encode returns the m parity shards of the k data shards, which have the same size
+func (rs *reedSolomon) encode(data [][]byte) [][]byte {
+	parity := make([][]byte, rs.m)
+	for i := range parity {
+		parity[i] = make([]byte, len(data[0]))
+		for j, shard := range data {
+			mulAdd(parity[i], shard, rs.cauchy[i][j])
+		}
+	}
+	return parity
+}
+
+// reconstruct fills the missing (nil) data shards of shards (k data shards, then m parity shards), if at least k
+// shards are there
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	present := make([]int, 0, rs.k)
+	missing := false
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.k {
+			present = append(present, i)
+		}
+		if shard == nil && i < rs.k {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	if len(present) < rs.k {
+		return errors.New("not enough shards to reconstruct the data")
+	}
+
+	// the data shards are the inverse of the rows of the present shards, applied to them
+	matrix := make([][]byte, rs.k)
+	for r, i := range present {
+		matrix[r] = append([]byte(nil), rs.row(i)...)
+	}
+	inverse, err := invert(matrix)
+	if err != nil {
+		return err
+	}
+	size := len(shards[present[0]])
+	for j := 0; j < rs.k; j++ {
+		if shards[j] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for r, i := range present {
+			mulAdd(shard, shards[i], inverse[j][r])
+		}
+		shards[j] = shard
+	}
+	return nil
+}
+
+// mulAdd adds c * in to out
+func mulAdd(out, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, b := range in {
+		out[i] ^= gfMul(c, b)
+	}
+}
+
+// invert returns the inverse of the square matrix, by Gauss-Jordan elimination
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && matrix[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		c := gfInv(matrix[col][col])
+		for j := 0; j < n; j++ {
+			matrix[col][j] = gfMul(matrix[col][j], c)
+			inverse[col][j] = gfMul(inverse[col][j], c)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || matrix[row][col] == 0 {
+				continue
+			}
+			c := matrix[row][col]
+			mulAdd(matrix[row], matrix[col], c)
+			mulAdd(inverse[row], inverse[col], c)
+		}
+	}
+	return inverse, nil
+}
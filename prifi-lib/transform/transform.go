@@ -0,0 +1,169 @@
+/*
+Package transform applies a PayloadTransform to the payloads of a slot : its owner encodes what it sends in each round
+of the slot, and the relay decodes the payloads of the slot it decodes from the DC-net. The transform is the same for
+all the slots, and given by the PayloadTransform parameter :
+  - "" or "identity" : the payloads are sent as they are;
+  - "fec:data=<k>,parity=<m>,interleave=<d>" : a Reed-Solomon forward error correction across the rounds of the slot.
+    After k rounds of data, the owner sends m rounds of parity, and the relay can rebuild the data of up to m rounds of
+    the k+m which it lost (e.g., closed after a timeout because a cipher was lost on UDP), without retransmission. With
+    an interleave d > 1, d such groups are sent interleaved (the rounds of the slot go to the groups in turn), so that a
+    burst of up to d*m consecutive lost rounds can be rebuilt.
+
+The relay delivers the decoded data in the order it was sent : data behind a lost round is held until it is rebuilt,
+or until it cannot be anymore.
+*/
+package transform
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The names of the transforms
+const (
+	IDENTITY = "identity"
+	FEC      = "fec"
+)
+
+// PayloadTransform encodes the payloads of a slot at its owner, and decodes them at the relay. There is one
+// PayloadTransform per slot, on each side.
+type PayloadTransform interface {
+	// Overhead is how many bytes of each payload the transform takes
+	Overhead() int
+
+	// TakesContent returns false if the next payload of the slot only carries redundancy, e.g. a parity shard; its
+	// owner then keeps its data for the next round, and encodes nil
+	TakesContent() bool
+
+	// Encode returns the payload of size bytes sent in the next round of the slot, carrying content (at most
+	// size-Overhead() bytes, nil if there is none)
+	Encode(content []byte, size int) []byte
+
+	// Decode is given the payloads of the slot decoded by the relay, in the order of their rounds, the lost rounds
+	// missing; it returns the contents it can deliver now, in the order they were sent
+	Decode(roundID int32, payload []byte) []Content
+
+	// Flush returns the contents still held, e.g. behind a lost round which was not rebuilt yet, and forgets them
+	Flush() []Content
+
+	// Statistics returns the contents the relay rebuilt and lost so far
+	Statistics() Statistics
+}
+
+// Content is some data decoded by a PayloadTransform, and the round of the payload which delivered it (a rebuilt
+// content is delivered with a later round than the one it was sent in)
+type Content struct {
+	RoundID int32
+	Data    []byte
+}
+
+// Statistics are the contents (data shards) a PayloadTransform rebuilt, and those it lost
+type Statistics struct {
+	Rebuilt int64
+	Lost    int64
+}
+
+// Spec is a PayloadTransform and its parameters, as given in the PayloadTransform parameter
+type Spec struct {
+	Name       string
+	Data       int // with FEC, the number of data rounds in a group
+	Parity     int // with FEC, the number of parity rounds in a group
+	Interleave int // with FEC, the number of groups interleaved
+}
+
+// Parse returns the Spec described by spec, e.g. "fec:data=4,parity=1"; "" is the identity
+func Parse(spec string) (Spec, error) {
+	name, options := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, options = spec[:i], spec[i+1:]
+	}
+	switch strings.TrimSpace(name) {
+	case "", IDENTITY:
+		if options != "" {
+			return Spec{}, errors.New("the identity transform has no options")
+		}
+		return Spec{Name: IDENTITY}, nil
+	case FEC:
+	default:
+		return Spec{}, errors.New("unknown payload transform \"" + name + "\", valid are identity and fec")
+	}
+
+	s := Spec{Name: FEC, Data: 4, Parity: 1, Interleave: 1}
+	for _, option := range strings.Split(options, ",") {
+		if strings.TrimSpace(option) == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return Spec{}, errors.New("invalid option \"" + option + "\" of the fec transform, expected key=value")
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || value < 0 {
+			return Spec{}, errors.New("invalid value of \"" + kv[0] + "\" in the fec transform, expected a positive integer")
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "data":
+			s.Data = value
+		case "parity":
+			s.Parity = value
+		case "interleave":
+			s.Interleave = value
+		default:
+			return Spec{}, errors.New("unknown option \"" + kv[0] + "\" of the fec transform, valid are data, parity and interleave")
+		}
+	}
+	if s.Data < 1 || s.Interleave < 1 {
+		return Spec{}, errors.New("the fec transform needs at least 1 data round and an interleave of at least 1")
+	}
+	if s.Interleave*(s.Data+s.Parity) > MAX_BLOCK_ROUNDS {
+		return Spec{}, errors.New("the fec transform cannot span more than " + strconv.Itoa(MAX_BLOCK_ROUNDS) + " rounds (interleave * (data + parity))")
+	}
+	return s, nil
+}
+
+// String returns the spec as given in the PayloadTransform parameter
+func (s Spec) String() string {
+	if s.Name != FEC {
+		return IDENTITY
+	}
+	return FEC + ":data=" + strconv.Itoa(s.Data) + ",parity=" + strconv.Itoa(s.Parity) + ",interleave=" + strconv.Itoa(s.Interleave)
+}
+
+// Enabled returns false for the identity, which the relay and the clients skip
+func (s Spec) Enabled() bool {
+	return s.Name == FEC
+}
+
+// Overhead is how many bytes of each payload the transform takes
+func (s Spec) Overhead() int {
+	if s.Name == FEC {
+		return FEC_OVERHEAD
+	}
+	return 0
+}
+
+// New returns a new PayloadTransform of the spec, for one slot
+func (s Spec) New() PayloadTransform {
+	if s.Name == FEC {
+		return newFEC(s.Data, s.Parity, s.Interleave)
+	}
+	return identity{}
+}
+
+// identity sends the payloads as they are
+type identity struct{}
+
+func (identity) Overhead() int { return 0 }
+
+func (identity) TakesContent() bool { return true }
+
+func (identity) Encode(content []byte, size int) []byte { return content }
+
+func (identity) Decode(roundID int32, payload []byte) []Content {
+	return []Content{{RoundID: roundID, Data: payload}}
+}
+
+func (identity) Flush() []Content { return nil }
+
+func (identity) Statistics() Statistics { return Statistics{} }
@@ -0,0 +1,218 @@
+package transform
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"":                                    IDENTITY,
+		"identity":                            IDENTITY,
+		"fec":                                 "fec:data=4,parity=1,interleave=1",
+		"fec:data=8,parity=2":                 "fec:data=8,parity=2,interleave=1",
+		"fec: data=3, parity=1, interleave=4": "fec:data=3,parity=1,interleave=4",
+	} {
+		s, err := Parse(spec)
+		if err != nil || s.String() != expected {
+			t.Error("Parse(", spec, ") should give", expected, "got", s, err)
+		}
+	}
+	for _, spec := range []string{"rot13", "identity:data=1", "fec:data=0", "fec:parity=-1", "fec:data=x", "fec:level=2",
+		"fec:data", "fec:data=200,parity=100", "fec:interleave=0"} {
+		if _, err := Parse(spec); err == nil {
+			t.Error("Parse(", spec, ") should fail")
+		}
+	}
+
+	s, _ := Parse("")
+	if s.Enabled() || s.Overhead() != 0 {
+		t.Error("The identity should not be enabled, nor take any byte")
+	}
+	s, _ = Parse("fec")
+	if !s.Enabled() || s.Overhead() != FEC_OVERHEAD || s.New().Overhead() != FEC_OVERHEAD {
+		t.Error("The FEC should take", FEC_OVERHEAD, "bytes")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	s, _ := Parse("identity")
+	tr := s.New()
+	if !tr.TakesContent() || !bytes.Equal(tr.Encode([]byte("abc"), 10), []byte("abc")) {
+		t.Error("The identity should send the content as it is")
+	}
+	contents := tr.Decode(3, []byte("abc"))
+	if len(contents) != 1 || contents[0].RoundID != 3 || string(contents[0].Data) != "abc" || tr.Flush() != nil {
+		t.Error("The identity should decode the payload as it is, got", contents)
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, km := range [][2]int{{1, 1}, {4, 1}, {4, 2}, {10, 4}, {3, 0}} {
+		k, m := km[0], km[1]
+		rs, err := newReedSolomon(k, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([][]byte, k)
+		for i := range data {
+			data[i] = make([]byte, 50)
+			rng.Read(data[i])
+		}
+		shards := append(append([][]byte(nil), data...), rs.encode(data)...)
+
+		// any m erasures can be rebuilt
+		for trial := 0; trial < 20; trial++ {
+			received := append([][]byte(nil), shards...)
+			for _, i := range rng.Perm(k + m)[:m] {
+				received[i] = nil
+			}
+			if err := rs.reconstruct(received); err != nil {
+				t.Fatal(k, m, err)
+			}
+			for i := 0; i < k; i++ {
+				if !bytes.Equal(received[i], data[i]) {
+					t.Fatal("Data shard", i, "was not rebuilt, with k =", k, "and m =", m)
+				}
+			}
+		}
+
+		// but not m+1
+		if k > 1 {
+			received := append([][]byte(nil), shards...)
+			for i := 0; i <= m; i++ {
+				received[i] = nil
+			}
+			if err := rs.reconstruct(received); err == nil {
+				t.Error("m+1 erasures cannot be rebuilt")
+			}
+		}
+	}
+	if _, err := newReedSolomon(200, 100); err == nil {
+		t.Error("A code of more than 256 shards should be refused")
+	}
+}
+
+// sendThroughFEC encodes n contents (or parity) with spec, loses the rounds in lost, and returns what the relay decoded
+func sendThroughFEC(t *testing.T, spec string, n int, lost map[int]bool) ([]string, Statistics) {
+	s, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, relay := s.New(), s.New()
+	var decoded []string
+	sent := 0
+	for round := 0; sent < n || !client.TakesContent(); round++ {
+		var content []byte
+		if client.TakesContent() {
+			content = []byte("content " + strconv.Itoa(sent))
+			sent++
+		}
+		payload := client.Encode(content, 40)
+		if len(payload) != 40 {
+			t.Fatal("The payloads should have the size of the slot, got", len(payload))
+		}
+		if lost[round] {
+			continue
+		}
+		for _, c := range relay.Decode(int32(round), payload) {
+			decoded = append(decoded, string(c.Data))
+		}
+	}
+	for _, c := range relay.Flush() {
+		decoded = append(decoded, string(c.Data))
+	}
+	return decoded, relay.Statistics()
+}
+
+func TestFEC(t *testing.T) {
+	expected := func(n int, skipped ...int) []string {
+		var contents []string
+		for i := 0; i < n; i++ {
+			if len(skipped) > 0 && skipped[0] == i {
+				skipped = skipped[1:]
+				continue
+			}
+			contents = append(contents, "content "+strconv.Itoa(i))
+		}
+		return contents
+	}
+	check := func(name string, decoded, expected []string, stats Statistics, rebuilt, lost int64) {
+		if len(decoded) != len(expected) {
+			t.Error(name, ": decoded", decoded, "expected", expected)
+			return
+		}
+		for i := range decoded {
+			if decoded[i] != expected[i] {
+				t.Error(name, ": decoded", decoded, "expected", expected)
+				return
+			}
+		}
+		if stats.Rebuilt != rebuilt || stats.Lost != lost {
+			t.Error(name, ": rebuilt", stats.Rebuilt, "and lost", stats.Lost, "expected", rebuilt, lost)
+		}
+	}
+
+	// 4 data rounds, then 1 parity round
+	decoded, stats := sendThroughFEC(t, "fec:data=4,parity=1", 8, nil)
+	check("no loss", decoded, expected(8), stats, 0, 0)
+	decoded, stats = sendThroughFEC(t, "fec:data=4,parity=1", 8, map[int]bool{1: true, 7: true})
+	check("one loss per group", decoded, expected(8), stats, 2, 0)
+	decoded, stats = sendThroughFEC(t, "fec:data=4,parity=1", 8, map[int]bool{1: true, 2: true})
+	check("two losses in a group", decoded, expected(8, 1, 2), stats, 0, 2)
+	decoded, stats = sendThroughFEC(t, "fec:data=4,parity=2", 8, map[int]bool{0: true, 3: true, 10: true})
+	check("two parity rounds", decoded, expected(8), stats, 2, 0)
+
+	// with 2 groups interleaved, 2 consecutive losses hit different groups
+	decoded, stats = sendThroughFEC(t, "fec:data=3,parity=1,interleave=2", 6, map[int]bool{2: true, 3: true})
+	check("interleaved burst", decoded, expected(6), stats, 2, 0)
+	decoded, stats = sendThroughFEC(t, "fec:data=3,parity=1", 6, map[int]bool{2: true, 3: true})
+	check("burst without interleaving", decoded, expected(6, 2), stats, 0, 1)
+
+	// the parity of a block lost with its data : the relay gives up once the next block starts
+	decoded, stats = sendThroughFEC(t, "fec:data=2,parity=1", 4, map[int]bool{0: true, 2: true})
+	check("data and parity lost", decoded, expected(4, 0), stats, 0, 1)
+}
+
+func TestFECInOrder(t *testing.T) {
+	s, _ := Parse("fec:data=3,parity=1")
+	client, relay := s.New(), s.New()
+	payloads := make([][]byte, 4)
+	for i := range payloads {
+		var content []byte
+		if client.TakesContent() {
+			content = []byte{byte('a' + i)}
+		}
+		payloads[i] = client.Encode(content, 20)
+	}
+	if client.TakesContent() != true {
+		t.Error("A new block should start after the parity")
+	}
+
+	// round 0 is lost : the content of round 1 waits for the parity
+	if contents := relay.Decode(1, payloads[1]); len(contents) != 0 {
+		t.Error("The content of round 1 should wait for the one of round 0, got", contents)
+	}
+	relay.Decode(2, payloads[2])
+	contents := relay.Decode(3, payloads[3])
+	if len(contents) != 3 || string(contents[0].Data) != "a" || string(contents[1].Data) != "b" || string(contents[2].Data) != "c" {
+		t.Error("The parity should deliver a, b and c in order, got", contents)
+	}
+	if contents[0].RoundID != 3 {
+		t.Error("The rebuilt content should come with the round of the parity, got", contents[0].RoundID)
+	}
+
+	// the decoded payload is reused by the relay
+	payload := client.Encode([]byte("d"), 20)
+	contents = relay.Decode(4, payload)
+	payload[FEC_OVERHEAD] = 'x'
+	if len(contents) != 1 || string(contents[0].Data) != "d" {
+		t.Error("The content should be kept apart from the payload, got", contents)
+	}
+	if contents := relay.Decode(5, []byte{1, 2}); contents != nil {
+		t.Error("A payload shorter than the header should be ignored")
+	}
+}
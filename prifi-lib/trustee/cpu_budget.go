@@ -0,0 +1,61 @@
+package trustee
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// TRUSTEE_LOAD_PERIOD is how often the trustee measures its load, and reports it to the relay
+const TRUSTEE_LOAD_PERIOD = time.Second
+
+// loadMonitor measures the share of a core the trustee spends computing and sending its ciphers. It measures the time
+// spent in the sending goroutine rather than the CPU time of the process, so that it works on every platform, and is
+// not affected by the other programs of the machine.
+type loadMonitor struct {
+	budget      int // in percent of one core
+	busy        time.Duration
+	periodStart time.Time
+	load        int // in percent of one core, over the last period
+}
+
+func newLoadMonitor(budget int, now time.Time) *loadMonitor {
+	return &loadMonitor{budget: budget, periodStart: now}
+}
+
+// add records that the trustee was busy for this long, and returns true when a period ended, and the load should be reported
+func (m *loadMonitor) add(busy time.Duration, now time.Time) bool {
+	m.busy += busy
+	elapsed := now.Sub(m.periodStart)
+	if elapsed < TRUSTEE_LOAD_PERIOD {
+		return false
+	}
+	m.load = int(100 * m.busy / elapsed)
+	m.busy = 0
+	m.periodStart = now
+	return true
+}
+
+// overloaded returns true if the trustee used more than its budget over the last period
+func (m *loadMonitor) overloaded() bool {
+	return m.load > m.budget
+}
+
+// sendLoadReport tells the relay how loaded we are; if we are above our budget, the relay lowers our window
+func (p *PriFiLibTrusteeInstance) sendLoadReport(m *loadMonitor) {
+	if m.overloaded() {
+		log.Lvl2("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : using " + strconv.Itoa(m.load) + "% of a core, above the budget of " +
+			strconv.Itoa(m.budget) + "%, asking the relay for a smaller window")
+	} else {
+		log.Lvl3("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : using " + strconv.Itoa(m.load) + "% of a core")
+	}
+	toSend := &net.TRU_REL_LOAD_REPORT{
+		TrusteeID:  p.trusteeState.ID,
+		Load:       m.load,
+		Budget:     m.budget,
+		Overloaded: m.overloaded(),
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(load "+strconv.Itoa(m.load)+"%)")
+}
@@ -0,0 +1,28 @@
+package trustee
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadMonitor(t *testing.T) {
+	start := time.Now()
+	m := newLoadMonitor(50, start)
+
+	if m.add(300*time.Millisecond, start.Add(500*time.Millisecond)) {
+		t.Error("the load should only be reported once per period")
+	}
+	if !m.add(300*time.Millisecond, start.Add(TRUSTEE_LOAD_PERIOD)) {
+		t.Fatal("the load should be reported at the end of the period")
+	}
+	if m.load != 60 || !m.overloaded() {
+		t.Error("the trustee was busy 60% of the time, above its budget, got", m.load)
+	}
+
+	if !m.add(400*time.Millisecond, start.Add(2*TRUSTEE_LOAD_PERIOD)) {
+		t.Fatal("the load should be reported at the end of the period")
+	}
+	if m.load != 40 || m.overloaded() {
+		t.Error("the trustee was busy 40% of the time, within its budget, got", m.load)
+	}
+}
@@ -10,6 +10,30 @@ import (
 	"strconv"
 )
 
+/*
+* Received_REL_ALL_DISRUPTION_DETECTED handles REL_ALL_DISRUPTION_DETECTED messages.
+* The relay found a wrong HMAC in the cell of a slot; the trustee answers once the relay asks for the bits of the round.
+ */
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_DISRUPTION_DETECTED(msg net.REL_ALL_DISRUPTION_DETECTED) error {
+	log.Lvl1("Disruption: the relay detected a disruption in round", msg.RoundID, "slot", msg.SlotID)
+	return nil
+}
+
+/*
+* Received_REL_ALL_REVEAL_REQUEST handles REL_ALL_REVEAL_REQUEST messages.
+* We reveal the bit at BitPos of the pad we share with each client for the round blamed, in the order of the clients.
+ */
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_REVEAL_REQUEST(msg net.REL_ALL_REVEAL_REQUEST) error {
+	log.Lvl1("Disruption: the relay blames round", msg.RoundID, "at bit", msg.BitPos, ", revealing our pads")
+	toSend := &net.TRU_REL_REVEAL_BITS{
+		TrusteeID: p.trusteeState.ID,
+		RoundID:   msg.RoundID,
+		Bits:      p.trusteeState.DCNet.PadBitsOfRound(msg.RoundID, msg.BitPos),
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(msg.RoundID))+")")
+	return nil
+}
+
 /*
 * Received_REL_ALL_DISRUPTION_REVEAL handles REL_ALL_DISRUPTION_REVEAL messages.
 * The method calls a function from the DCNet to regenerate the bits from roundID in position BitPos
@@ -108,3 +132,16 @@ func (p *PriFiLibTrusteeInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net
 	log.Lvl1("Reveling secret with client", msg.EntityID)
 	return nil
 }
+
+/*
+* Received_REL_ALL_EQUIVOCATION_ALARM handles REL_ALL_EQUIVOCATION_ALARM messages.
+* The equivocation contributions of a round were inconsistent; we stop sending ciphers until the relay restarts the
+* group.
+ */
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_EQUIVOCATION_ALARM(msg net.REL_ALL_EQUIVOCATION_ALARM) error {
+	log.Error("Trustee "+strconv.Itoa(p.trusteeState.ID)+" : the relay raised an equivocation alarm in round", msg.RoundID, ":", msg.Reason)
+	p.stopSendingCiphers()
+	p.trusteeState.sessionSummary.SetShutdownReason("the relay raised an equivocation alarm, "+msg.Reason, true)
+	p.stateMachine.ChangeState("BLAMING")
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"github.com/dedis/prifi/prifi-lib/utils"
@@ -20,20 +21,25 @@ const (
 	TRUSTEE_RATE_HALVED
 )
 
+// TRUSTEE_CELL_POOL_MAX_LEASED bounds the large ciphers being sent at once; each one is released once sent
+const TRUSTEE_CELL_POOL_MAX_LEASED = 4
+
 // PriFiLibTrusteeInstance contains the mutable state of a PriFi entity.
 type PriFiLibTrusteeInstance struct {
-	messageSender *net.MessageSenderWrapper
-	trusteeState  *TrusteeState
-	stateMachine  *utils.StateMachine
+	messageSender  *net.MessageSenderWrapper
+	trusteeState   *TrusteeState
+	stateMachine   *utils.StateMachine
+	incomingFaults *net.FaultInjector // drops, delays or corrupts the messages received, in the tests; nil otherwise
 }
 
 // NewPriFiClientWithState creates a new PriFi client entity state.
-func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgSender *net.MessageSenderWrapper) *PriFiLibTrusteeInstance {
+func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, cpuBudget int, msgSender *net.MessageSenderWrapper) *PriFiLibTrusteeInstance {
 
 	trusteeState := new(TrusteeState)
 
 	//init the static stuff
 	trusteeState.sendingRate = make(chan int16, 10)
+	trusteeState.sessionSummary = prifilog.NewSessionSummary("Trustee")
 	trusteeState.PublicKey, trusteeState.privateKey = crypto.NewKeyPair()
 	neffShuffle := new(scheduler.NeffShuffle)
 	neffShuffle.Init()
@@ -46,6 +52,7 @@ func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgS
 	}
 
 	trusteeState.BaseSleepTime = baseSleepTime
+	trusteeState.CPUBudget = cpuBudget
 
 	//init the state machine
 	states := []string{"BEFORE_INIT", "INITIALIZING", "SHUFFLE_DONE", "READY", "BLAMING", "SHUTDOWN"}
@@ -81,15 +88,25 @@ type TrusteeState struct {
 	neffShuffle                   *scheduler.NeffShuffleTrustee
 	nTrustees                     int
 	PayloadSize                   int
+	CellsPerRound                 int // number of cells of PayloadSize in each round
 	privateKey                    kyber.Scalar
 	PublicKey                     kyber.Point
+	endorseKey                    func(msg []byte) ([]byte, error) // signs msg with our long-term key; nil if we have none
 	sendingRate                   chan int16
+	sendingStopped                chan bool // closed when the goroutine sending the ciphers stops, nil if none runs
+	firstRoundID                  int32     // the first round of the schedule; 0, unless clients joined during the session
+	scheduleEpoch                 int32     // the epoch of the schedule, told by the relay; it tags our ciphers
 	sharedSecrets                 []kyber.Point
 	TrusteeID                     int
 	BaseSleepTime                 int
 	AlwaysSlowDown                bool //enforce the sleep in the sending function even if rate is FULL
 	NeverSlowDown                 bool //ignore the sleep in the sending function if rate is STOPPED
+	CPUBudget                     int  //percentage of a core we may spend computing ciphers; 0 means no budget
+	Window                        int  //the number of our ciphers the relay buffers before stopping us; 0 if the relay did not tell us
 	EquivocationProtectionEnabled bool
+	ParametersEpoch               int32                    // the last parameters epoch activated by the relay
+	sessionSummary                *prifilog.SessionSummary // totals since the trustee started, for the shutdown report
+	cellPool                      *utils.CellPool          // if non-nil, our large ciphers are taken from it
 }
 
 // NeffShuffleResult holds the result of the NeffShuffle,
@@ -103,6 +120,29 @@ type NeffShuffleResult struct {
 // ReceivedMessage must be called when a PriFi host receives a message.
 // It takes care to call the correct message handler function.
 func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
+	faulted, handleNow := p.incomingFaults.Filter(msg, p.receivedMessage)
+	if !handleNow {
+		log.Lvl3("Trustee : fault injection, not handling a", reflect.TypeOf(msg), "now")
+		return nil
+	}
+	return p.receivedMessage(faulted)
+}
+
+// SetFaultInjectors makes the trustee drop, delay or corrupt some of the messages it receives (incoming) and sends
+// (outgoing), for the tests; nil delivers everything. It must be called before the messages it should apply to.
+func (p *PriFiLibTrusteeInstance) SetFaultInjectors(incoming *net.FaultInjector, outgoing *net.FaultInjector) {
+	p.incomingFaults = incoming
+	p.messageSender.SetFaultInjector(outgoing)
+}
+
+// SetKeyEndorser makes the trustee endorse its key of the session with endorse, which signs with its long-term key
+// (the one of the group description). The endorsement goes in the setup transcripts, so that they can be checked
+// against the group. It must be called before the trustee sends its key.
+func (p *PriFiLibTrusteeInstance) SetKeyEndorser(endorse func(msg []byte) ([]byte, error)) {
+	p.trusteeState.endorseKey = endorse
+}
+
+func (p *PriFiLibTrusteeInstance) receivedMessage(msg interface{}) error {
 
 	var err error
 
@@ -114,7 +154,7 @@ func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
 	case net.ALL_ALL_SHUTDOWN:
 		err = p.Received_ALL_ALL_SHUTDOWN(typedMsg)
 	case net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE:
-		if p.stateMachine.AssertState("INITIALIZING") {
+		if p.stateMachine.AssertStateOrState("INITIALIZING", "READY") {
 			err = p.Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE(typedMsg)
 		}
 	case net.REL_TRU_TELL_TRANSCRIPT:
@@ -125,6 +165,18 @@ func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_TRU_TELL_RATE_CHANGE(typedMsg)
 		}
+	case net.REL_ALL_DISRUPTION_DETECTED:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_DISRUPTION_DETECTED(typedMsg)
+		}
+	case net.REL_ALL_EQUIVOCATION_ALARM:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_EQUIVOCATION_ALARM(typedMsg)
+		}
+	case net.REL_ALL_REVEAL_REQUEST:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_REVEAL_REQUEST(typedMsg)
+		}
 	case net.REL_ALL_DISRUPTION_REVEAL:
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_ALL_DISRUPTION_REVEAL(typedMsg)
@@ -133,9 +185,31 @@ func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_ALL_REVEAL_SHARED_SECRETS(typedMsg)
 		}
+	case net.REL_ALL_PARAMETERS_PROPOSAL:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_PARAMETERS_PROPOSAL(typedMsg)
+		}
+	case net.REL_ALL_PARAMETERS_ACTIVATE:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_PARAMETERS_ACTIVATE(typedMsg)
+		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
 
+	if err != nil {
+		p.trusteeState.sessionSummary.AddError()
+	}
+
 	return err
 }
+
+// ShutdownReport returns the summary of the trustee's session, as of now
+func (p *PriFiLibTrusteeInstance) ShutdownReport() *prifilog.ShutdownReport {
+	return p.trusteeState.sessionSummary.Report()
+}
+
+// State returns the current state of the trustee, e.g. "READY"
+func (p *PriFiLibTrusteeInstance) State() string {
+	return p.stateMachine.State()
+}
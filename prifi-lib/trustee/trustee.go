@@ -9,15 +9,22 @@ Then, this file simple handle the answer to the different message kind :
 
 - ALL_ALL_PARAMETERS - (specialized into ALL_TRU_PARAMETERS) - used to initialize the relay over the network / overwrite its configuration
 - REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE - the client's identities (and ephemeral ones), and a base. We react by Neff-Shuffling and sending the result
-- REL_TRU_TELL_TRANSCRIPT - the Neff-Shuffle's results. We perform some checks, sign the last one, send it to the relay, and follow by continuously sending ciphers.
+- REL_TRU_TELL_TRANSCRIPT - the Neff-Shuffle's results. We verify the proof of each shuffle, sign the last one, send it to the relay, and follow by continuously sending ciphers.
+  If a proof does not verify, we send TRU_REL_SHUFFLE_REJECTED to the relay instead
 - REL_TRU_TELL_RATE_CHANGE - Received when the relay requests a sending rate change, the message contains the necessary information needed to perform this change
+  (and our new window, when we reported being above our CPU budget with TRU_REL_LOAD_REPORT)
+- REL_ALL_PARAMETERS_PROPOSAL - the relay proposes to change some parameters during the session. We answer whether we accept them
+- REL_ALL_PARAMETERS_ACTIVATE - everybody accepted the proposed parameters, which are now in use
+- REL_ALL_EQUIVOCATION_ALARM - the relay found the equivocation contributions of a round inconsistent. We stop sending ciphers until the group restarts
 */
 
 import (
 	"errors"
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
@@ -34,8 +41,16 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_SHUTDOWN(msg net.ALL_ALL_SHUT
 	//stop the sending process
 	p.trusteeState.sendingRate <- TRUSTEE_KILL_SEND_PROCESS
 
+	alreadyShutdown := p.stateMachine.State() == "SHUTDOWN"
 	p.stateMachine.ChangeState("SHUTDOWN")
 
+	if msg.Reason != "" {
+		p.trusteeState.sessionSummary.SetShutdownReason(msg.Reason, msg.Abnormal)
+	}
+	if !alreadyShutdown {
+		log.Lvl1("Trustee "+strconv.Itoa(p.trusteeState.ID)+" : shutdown report", p.trusteeState.sessionSummary.Report().String())
+	}
+
 	return nil
 }
 
@@ -50,11 +65,15 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	e := "Trustee " + strconv.Itoa(trusteeID)
 	p.stateMachine.SetEntity(e)
 	p.messageSender.SetEntity(e)
+	p.trusteeState.sessionSummary.SetEntity(e)
+	p.trusteeState.sessionSummary.NewEpoch(msg.ConfigHash())
 	nTrustees := msg.IntValueOrElse("NTrustees", p.trusteeState.nTrustees)
 	nClients := msg.IntValueOrElse("NClients", p.trusteeState.nClients)
 	payloadSize := msg.IntValueOrElse("PayloadSize", p.trusteeState.PayloadSize)
+	cellsPerRound := msg.IntValueOrElse("CellsPerRound", 1)
 	dcNetType := msg.StringValueOrElse("DCNetType", "not initilaized")
 	equivProtection := msg.BoolValueOrElse("EquivocationProtectionEnabled", false)
+	cryptoSuite := msg.StringValueOrElse("CryptoSuite", config.CryptoSuiteName())
 
 	//sanity checks
 	if trusteeID < -1 {
@@ -69,19 +88,30 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	if payloadSize < 1 {
 		return errors.New("payloadSize cannot be 0")
 	}
+	if cellsPerRound < 1 {
+		cellsPerRound = 1
+	}
+	if err := config.CheckCryptoSuite(cryptoSuite); err != nil {
+		return err
+	}
 
 	switch dcNetType {
 	case "Verifiable":
 		panic("not supported yet")
 	}
 
+	// on a resync, the ciphers of the previous schedule would only be dropped by the relay
+	p.stopSendingCiphers()
+
 	p.trusteeState.ID = trusteeID
 	p.trusteeState.Name = "Trustee-" + strconv.Itoa(trusteeID)
 	p.trusteeState.nClients = nClients
 	p.trusteeState.nTrustees = nTrustees
 	p.trusteeState.PayloadSize = payloadSize
+	p.trusteeState.CellsPerRound = cellsPerRound
 	p.trusteeState.TrusteeID = trusteeID
 	p.trusteeState.EquivocationProtectionEnabled = equivProtection
+	p.trusteeState.ParametersEpoch = 0
 	p.trusteeState.neffShuffle.Init(trusteeID, p.trusteeState.privateKey, p.trusteeState.PublicKey)
 
 	//placeholders for pubkeys and secrets
@@ -90,7 +120,9 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 
 	if startNow {
 		// send our public key to the relay
-		p.Send_TRU_REL_PK()
+		if err := p.Send_TRU_REL_PK(); err != nil {
+			return err
+		}
 	}
 
 	p.stateMachine.ChangeState("INITIALIZING")
@@ -103,10 +135,22 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 /*
 Send_TRU_REL_PK tells the relay's public key to the relay
 (this, of course, provides no security, but this is an early version of the protocol).
+The key is endorsed by our long-term key, if we have one.
 This is the first action of the trustee.
 */
 func (p *PriFiLibTrusteeInstance) Send_TRU_REL_PK() error {
 	toSend := &net.TRU_REL_TELL_PK{TrusteeID: p.trusteeState.ID, Pk: p.trusteeState.PublicKey}
+	if p.trusteeState.endorseKey != nil {
+		msg, err := crypto.TrusteeKeyEndorsementMessage(p.trusteeState.PublicKey)
+		if err == nil {
+			toSend.Endorsement, err = p.trusteeState.endorseKey(msg)
+		}
+		if err != nil {
+			e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : could not endorse its key, " + err.Error()
+			log.Error(e)
+			return errors.New(e)
+		}
+	}
 	p.messageSender.SendToRelayWithLog(toSend, "")
 	return nil
 }
@@ -119,7 +163,15 @@ func (p *PriFiLibTrusteeInstance) Send_TRU_REL_DC_CIPHER(rateChan chan int16) {
 
 	stop := false
 	currentRate := TRUSTEE_RATE_ACTIVE
-	roundID := int32(0)
+	roundID := p.trusteeState.firstRoundID
+	epoch := p.trusteeState.scheduleEpoch
+	if stopped := p.trusteeState.sendingStopped; stopped != nil {
+		defer close(stopped)
+	}
+	var load *loadMonitor
+	if p.trusteeState.CPUBudget > 0 {
+		load = newLoadMonitor(p.trusteeState.CPUBudget, time.Now())
+	}
 
 	for !stop {
 		select {
@@ -144,11 +196,15 @@ func (p *PriFiLibTrusteeInstance) Send_TRU_REL_DC_CIPHER(rateChan chan int16) {
 					log.Lvl4("Trustee " + strconv.Itoa(p.trusteeState.ID) + " rate FULL, sleeping for " + strconv.Itoa(p.trusteeState.BaseSleepTime))
 					time.Sleep(time.Duration(p.trusteeState.BaseSleepTime) * time.Millisecond)
 				}
-				newRoundID, err := sendData(p, roundID)
+				start := time.Now()
+				newRoundID, err := sendData(p, epoch, roundID)
 				if err != nil {
 					stop = true
 				}
 				roundID = newRoundID
+				if now := time.Now(); load != nil && load.add(now.Sub(start), now) {
+					p.sendLoadReport(load)
+				}
 
 			} else if currentRate == TRUSTEE_RATE_HALVED {
 				if !p.trusteeState.NeverSlowDown {
@@ -156,6 +212,9 @@ func (p *PriFiLibTrusteeInstance) Send_TRU_REL_DC_CIPHER(rateChan chan int16) {
 					log.Lvl4("Trustee " + strconv.Itoa(p.trusteeState.ID) + " rate HALVED, sleeping for " + strconv.Itoa(p.trusteeState.BaseSleepTime))
 					time.Sleep(time.Duration(p.trusteeState.BaseSleepTime) * time.Millisecond)
 				}
+				if load != nil && load.add(0, time.Now()) {
+					p.sendLoadReport(load)
+				}
 				//newRoundID, err := sendData(p, roundID)
 				//if err != nil {
 				//	stop = true
@@ -176,9 +235,15 @@ Received_REL_TRU_TELL_RATE_CHANGE handles REL_TRU_TELL_RATE_CHANGE messages
 by changing the cipher sending rate.
 Either the trustee must stop sending because the relay is at full capacity
 or the trustee sends normally because the relay has emptied up enough capacity.
+It also carries the new window of the trustee, when the relay changed it after a TRU_REL_LOAD_REPORT.
 */
 func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_RATE_CHANGE(msg net.REL_TRU_TELL_RATE_CHANGE) error {
 
+	if msg.Window > 0 && msg.Window != p.trusteeState.Window {
+		log.Lvl2("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : the relay now buffers up to " + strconv.Itoa(msg.Window) + " of our ciphers")
+		p.trusteeState.Window = msg.Window
+	}
+
 	if msg.WindowCapacity == 0 {
 		p.trusteeState.sendingRate <- TRUSTEE_RATE_HALVED
 	} else {
@@ -189,19 +254,27 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_RATE_CHANGE(msg net.REL_
 }
 
 /*
-sendData is an auxiliary function used by Send_TRU_REL_DC_CIPHER. It computes the DC-net's cipher and sends it.
+sendData is an auxiliary function used by Send_TRU_REL_DC_CIPHER. It computes the DC-net's cipher and sends it,
+tagged with the epoch of the schedule.
 It returns the new round number (previous + 1).
 */
-func sendData(p *PriFiLibTrusteeInstance, roundID int32) (int32, error) {
+func sendData(p *PriFiLibTrusteeInstance, epoch, roundID int32) (int32, error) {
 	data := p.trusteeState.DCNet.TrusteeEncodeForRound(roundID)
 	//send the data
 	toSend := &net.TRU_REL_DC_CIPHER{
 		RoundID:   roundID,
 		TrusteeID: p.trusteeState.ID,
-		Data:      data}
+		Data:      data,
+		Epoch:     epoch}
 	if !p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(roundID))+")") {
 		return -1, errors.New("Could not send")
 	}
+	p.trusteeState.sessionSummary.AddRound()
+	p.trusteeState.sessionSummary.AddBytes(int64(len(data)), 0)
+	if p.trusteeState.cellPool != nil {
+		// the message sender encoded the cipher, we can reuse its cell for the next round
+		p.trusteeState.cellPool.Release(data)
+	}
 
 	return roundID + 1, nil
 }
@@ -231,12 +304,25 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_
 		log.Error(e)
 		return errors.New(e)
 	}
-	if len(clientsPks) != len(clientsEphemeralPks) {
-		e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : len(clientsPks) must be == len(clientsEphemeralPks)"
+	// each client has at least one ephemeral key, and one more per additional slot it owns
+	if len(clientsPks) > len(clientsEphemeralPks) {
+		e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : len(clientsPks) must be <= len(clientsEphemeralPks)"
 		log.Error(e)
 		return errors.New(e)
 	}
 
+	if p.stateMachine.State() == "READY" {
+		// clients joined during the session : we stop sending the ciphers of the previous schedule, and derive the
+		// secrets shared with the new clients
+		p.stopSendingCiphers()
+		log.Lvl1("Trustee "+strconv.Itoa(p.trusteeState.ID)+" : the group now has", len(clientsPks), "clients, starting at round", msg.RoundID)
+		p.trusteeState.nClients = len(clientsPks)
+		p.trusteeState.ClientPublicKeys = make([]kyber.Point, len(clientsPks))
+		p.trusteeState.sharedSecrets = make([]kyber.Point, len(clientsPks))
+	}
+	p.trusteeState.firstRoundID = msg.RoundID
+	p.trusteeState.scheduleEpoch = msg.Epoch
+
 	//fill in the clients keys
 	for i := 0; i < len(clientsPks); i++ {
 		p.trusteeState.ClientPublicKeys[i] = clientsPks[i]
@@ -244,7 +330,13 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_
 	}
 
 	p.trusteeState.DCNet = dcnet.NewDCNetEntity(p.trusteeState.ID, dcnet.DCNET_TRUSTEE,
-		p.trusteeState.PayloadSize, p.trusteeState.EquivocationProtectionEnabled, p.trusteeState.sharedSecrets)
+		p.trusteeState.PayloadSize*p.trusteeState.CellsPerRound, p.trusteeState.EquivocationProtectionEnabled, p.trusteeState.sharedSecrets)
+	p.trusteeState.cellPool = nil
+	if p.trusteeState.PayloadSize*p.trusteeState.CellsPerRound >= utils.LARGE_CELL_SIZE && !p.trusteeState.EquivocationProtectionEnabled {
+		// large cells : the pads are XORed in place into pooled ciphers, instead of allocating one buffer per client
+		p.trusteeState.cellPool = utils.NewCellPool(p.trusteeState.DCNet.CipherSize(), TRUSTEE_CELL_POOL_MAX_LEASED)
+		p.trusteeState.DCNet.UseCellPool(p.trusteeState.cellPool)
+	}
 
 	//In case we use the simple dcnet, vkey isn't needed
 	vkey := make([]byte, 1)
@@ -271,7 +363,11 @@ If everything succeed, starts the goroutine for sending DC-net ciphers to the re
 */
 func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_TRANSCRIPT(msg net.REL_TRU_TELL_TRANSCRIPT) error {
 
-	toSend, err := p.trusteeState.neffShuffle.ReceivedTranscriptFromRelay(msg.Bases, msg.GetKeys(), msg.GetProofs())
+	toSend, err := p.trusteeState.neffShuffle.ReceivedTranscriptFromRelay(msg.InitialBase, msg.InitialEphPks, msg.Bases, msg.GetKeys(), msg.GetProofs())
+	if rejected, ok := toSend.(*net.TRU_REL_SHUFFLE_REJECTED); ok {
+		// tell the relay which shuffle is invalid, and do not sign
+		p.messageSender.SendToRelayWithLog(rejected, "")
+	}
 	if err != nil {
 		return errors.New("Could not do ReceivedTranscriptFromRelay, error is " + err.Error())
 	}
@@ -285,7 +381,61 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_TRANSCRIPT(msg net.REL_T
 	p.stateMachine.ChangeState("READY")
 
 	//everything is ready, we start sending
+	p.trusteeState.sendingStopped = make(chan bool)
 	go p.Send_TRU_REL_DC_CIPHER(p.trusteeState.sendingRate)
 
 	return nil
 }
+
+// stopSendingCiphers stops the goroutine sending the ciphers, if any, and waits until it stopped
+func (p *PriFiLibTrusteeInstance) stopSendingCiphers() {
+	stopped := p.trusteeState.sendingStopped
+	if stopped == nil {
+		return
+	}
+	select {
+	case p.trusteeState.sendingRate <- TRUSTEE_KILL_SEND_PROCESS:
+	case <-stopped:
+	}
+	<-stopped
+
+	// the rate changes not read by the goroutine were for the previous schedule
+	for len(p.trusteeState.sendingRate) > 0 {
+		<-p.trusteeState.sendingRate
+	}
+	p.trusteeState.sendingStopped = nil
+}
+
+/*
+Received_REL_ALL_PARAMETERS_PROPOSAL handles REL_ALL_PARAMETERS_PROPOSAL messages.
+The relay proposes to change some parameters during the session; we accept if they can all be changed without
+restarting the protocol. The rate limits are enforced by the relay with REL_TRU_TELL_RATE_CHANGE, so the trustee
+does not use those parameters itself.
+*/
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_PARAMETERS_PROPOSAL(msg net.REL_ALL_PARAMETERS_PROPOSAL) error {
+	accepted := true
+	for k := range msg.ParamsInt {
+		if !net.IsMigratableParameter(k) {
+			log.Error("Trustee", p.trusteeState.ID, ": parameter", k, "cannot be changed during a session, refusing epoch", msg.Epoch)
+			accepted = false
+		}
+	}
+
+	toSend := &net.TRU_REL_PARAMETERS_ACK{
+		TrusteeID: p.trusteeState.ID,
+		Epoch:     msg.Epoch,
+		Accepted:  accepted,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(parameters epoch "+strconv.Itoa(int(msg.Epoch))+")")
+	return nil
+}
+
+/*
+Received_REL_ALL_PARAMETERS_ACTIVATE handles REL_ALL_PARAMETERS_ACTIVATE messages.
+Everybody accepted the parameters of this epoch, and the relay now uses them.
+*/
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_PARAMETERS_ACTIVATE(msg net.REL_ALL_PARAMETERS_ACTIVATE) error {
+	log.Lvl2("Trustee", p.trusteeState.ID, ": parameters epoch", msg.Epoch, "is now active")
+	p.trusteeState.ParametersEpoch = msg.Epoch
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/onet/v3/log"
 	"time"
 )
@@ -63,7 +64,11 @@ func TestTrustee(t *testing.T) {
 	neverSlowDown := false
 	alwaysSlowDown := false
 	baseSleepTime := 1000
-	trustee := NewTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, msw)
+	trustee := NewTrustee(neverSlowDown, alwaysSlowDown, baseSleepTime, 0, msw)
+	longTermPk, longTermKey := crypto.NewKeyPair()
+	trustee.SetKeyEndorser(func(msg []byte) ([]byte, error) {
+		return schnorr.Sign(config.CryptoSuite, longTermKey, msg)
+	})
 
 	ts := trustee.trusteeState
 	if ts.sendingRate == nil {
@@ -100,6 +105,11 @@ func TestTrustee(t *testing.T) {
 	if err := trustee.ReceivedMessage(*weird); err == nil {
 		t.Error("Trustee should not accept this message")
 	}
+	weird.Add("PayloadSize", 10)
+	weird.Add("CryptoSuite", "P256")
+	if err := trustee.ReceivedMessage(*weird); err == nil {
+		t.Error("Trustee should not accept another crypto suite than its own")
+	}
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
 	msg := new(net.ALL_ALL_PARAMETERS)
@@ -152,6 +162,9 @@ func TestTrustee(t *testing.T) {
 		if !msg3_parsed.Pk.Equal(ts.PublicKey) {
 			t.Error("Trustee did not send his public key")
 		}
+		if err := crypto.VerifyTrusteeKeyEndorsement(longTermPk, ts.PublicKey, msg3_parsed.Endorsement); err != nil {
+			t.Error("Trustee should endorse its public key with its long-term key,", err)
+		}
 	default:
 		t.Error("Trustee should have sent a TRU_REL_TELL_PK to the relay")
 	}
@@ -172,6 +185,7 @@ func TestTrustee(t *testing.T) {
 		t.Error(err)
 	}
 	msg4 := toSend.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	msg4.Epoch = 2
 
 	//we inject the public keys
 	msg4.Pks = make([]kyber.Point, nClients)
@@ -254,6 +268,9 @@ func TestTrustee(t *testing.T) {
 		if msg8_parsed.RoundID != 0 {
 			t.Error("TRU_REL_DC_CIPHER has the wrong round ID")
 		}
+		if msg8_parsed.Epoch != 2 {
+			t.Error("TRU_REL_DC_CIPHER should be tagged with the epoch of the schedule, is", msg8_parsed.Epoch)
+		}
 		if len(msg8_parsed.Data) != upCellSize+8 {
 			t.Error("TRU_REL_DC_CIPHER sent a payload with wrong size")
 		}
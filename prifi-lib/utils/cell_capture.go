@@ -0,0 +1,311 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A cell capture is a compact log of the cell-level activity of a client : which rounds it saw, the size of the cells,
+// when they were received and sent. It never contains the content of the cells, so a user can share it to diagnose a
+// performance issue without exposing their traffic.
+//
+// The file starts with CELL_CAPTURE_MAGIC and a version byte, followed by entries. Each entry starts with its kind :
+//   - CELL_CAPTURE_SESSION : [kind, start time in ns since the epoch (8 bytes)]; one per protocol run
+//   - any other kind : [kind, flags, round ID (4 bytes), cell size (4 bytes), time since the session start in µs (8 bytes)]
+//
+// All integers are big-endian.
+const (
+	CELL_CAPTURE_MAGIC   = "PRIFICAP"
+	CELL_CAPTURE_VERSION = 1
+
+	CELL_CAPTURE_SESSION    uint8 = 0 // a new protocol run starts
+	CELL_CAPTURE_DOWNSTREAM uint8 = 1 // a downstream cell was received
+	CELL_CAPTURE_UPSTREAM   uint8 = 2 // an upstream cell was sent
+	CELL_CAPTURE_SCHEDULE   uint8 = 3 // an open/closed schedule contribution was sent
+
+	CELL_CAPTURE_FLAG_OWNED_SLOT uint8 = 1 // the upstream cell was in one of our slots
+	CELL_CAPTURE_FLAG_DATA       uint8 = 2 // the upstream cell carried some of our data (not only padding)
+
+	cellCaptureSessionLength = 9
+	cellCaptureRecordLength  = 18
+	cellCaptureFlushEvery    = 64 // records are buffered, and written every cellCaptureFlushEvery records
+)
+
+// CellCaptureRecord is one cell sent or received by the client
+type CellCaptureRecord struct {
+	Kind    uint8
+	Flags   uint8
+	RoundID int32
+	Size    uint32
+	Time    time.Time
+}
+
+// CellCaptureSession is the list of cells of one protocol run
+type CellCaptureSession struct {
+	Start   time.Time
+	Records []CellCaptureRecord
+}
+
+// CellCaptureWriter appends the cell-level activity of a client to a cell capture
+type CellCaptureWriter struct {
+	w          *bufio.Writer
+	f          *os.File
+	start      time.Time
+	unFlushed  int
+	closed     bool
+	recordData []byte
+}
+
+// NewCellCaptureFileWriter opens (or creates) the cell capture at path, and starts a new session at the end of it
+func NewCellCaptureFileWriter(path string) (*CellCaptureWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cw, err := NewCellCaptureWriter(f, info.Size() == 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cw.f = f
+	return cw, nil
+}
+
+// NewCellCaptureWriter starts a new session in w; the file header is written first if withHeader is true
+func NewCellCaptureWriter(w io.Writer, withHeader bool) (*CellCaptureWriter, error) {
+	cw := &CellCaptureWriter{
+		w:          bufio.NewWriter(w),
+		start:      time.Now(),
+		recordData: make([]byte, cellCaptureRecordLength),
+	}
+	if withHeader {
+		cw.w.WriteString(CELL_CAPTURE_MAGIC)
+		cw.w.WriteByte(CELL_CAPTURE_VERSION)
+	}
+	session := make([]byte, cellCaptureSessionLength)
+	session[0] = CELL_CAPTURE_SESSION
+	binary.BigEndian.PutUint64(session[1:9], uint64(cw.start.UnixNano()))
+	cw.w.Write(session)
+	return cw, cw.w.Flush()
+}
+
+// Record logs one cell of roundID, of the given size, now
+func (cw *CellCaptureWriter) Record(kind uint8, flags uint8, roundID int32, size int) error {
+	if cw.closed {
+		return errors.New("cell capture is closed")
+	}
+	b := cw.recordData
+	b[0] = kind
+	b[1] = flags
+	binary.BigEndian.PutUint32(b[2:6], uint32(roundID))
+	binary.BigEndian.PutUint32(b[6:10], uint32(size))
+	binary.BigEndian.PutUint64(b[10:18], uint64(time.Since(cw.start)/time.Microsecond))
+	if _, err := cw.w.Write(b); err != nil {
+		return err
+	}
+
+	cw.unFlushed++
+	if cw.unFlushed >= cellCaptureFlushEvery {
+		cw.unFlushed = 0
+		return cw.w.Flush()
+	}
+	return nil
+}
+
+// Close writes the buffered records, and closes the underlying file if this writer created it
+func (cw *CellCaptureWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	err := cw.w.Flush()
+	if cw.f != nil {
+		if err2 := cw.f.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// ReadCellCaptureFile reads all the sessions of the cell capture at path
+func ReadCellCaptureFile(path string) ([]*CellCaptureSession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCellCapture(f)
+}
+
+// ReadCellCapture reads all the sessions of a cell capture. A truncated last record (e.g., the client crashed while
+// writing it) is ignored.
+func ReadCellCapture(r io.Reader) ([]*CellCaptureSession, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(CELL_CAPTURE_MAGIC)+1)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(CELL_CAPTURE_MAGIC)]) != CELL_CAPTURE_MAGIC {
+		return nil, errors.New("not a cell capture")
+	}
+	if header[len(CELL_CAPTURE_MAGIC)] != CELL_CAPTURE_VERSION {
+		return nil, errors.New("unsupported cell capture version " + strconv.Itoa(int(header[len(CELL_CAPTURE_MAGIC)])))
+	}
+
+	sessions := make([]*CellCaptureSession, 0)
+	var current *CellCaptureSession
+	for {
+		kind, err := br.ReadByte()
+		if err == io.EOF {
+			return sessions, nil
+		} else if err != nil {
+			return sessions, err
+		}
+
+		if kind == CELL_CAPTURE_SESSION {
+			b := make([]byte, cellCaptureSessionLength-1)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return sessions, nil
+			}
+			current = &CellCaptureSession{
+				Start:   time.Unix(0, int64(binary.BigEndian.Uint64(b))),
+				Records: make([]CellCaptureRecord, 0),
+			}
+			sessions = append(sessions, current)
+			continue
+		}
+
+		if current == nil {
+			return sessions, errors.New("cell capture record before the first session")
+		}
+		b := make([]byte, cellCaptureRecordLength-1)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return sessions, nil
+		}
+		current.Records = append(current.Records, CellCaptureRecord{
+			Kind:    kind,
+			Flags:   b[0],
+			RoundID: int32(binary.BigEndian.Uint32(b[1:5])),
+			Size:    binary.BigEndian.Uint32(b[5:9]),
+			Time:    current.Start.Add(time.Duration(binary.BigEndian.Uint64(b[9:17])) * time.Microsecond),
+		})
+	}
+}
+
+// CellCaptureSummary sums up one session of a cell capture
+type CellCaptureSummary struct {
+	Duration        time.Duration
+	Rounds          int // number of downstream cells received
+	UpstreamCells   int
+	ScheduleCells   int
+	OwnedSlots      int // number of upstream cells in our slots
+	DataCells       int // number of upstream cells carrying our data
+	BytesUp         int64
+	BytesDown       int64
+	RoundsSkipped   int // rounds we never saw a downstream cell for
+	RoundTimeMedian time.Duration
+	RoundTimeP95    time.Duration
+	RoundTimeMax    time.Duration
+	ProcessingP95   time.Duration // from receiving the downstream cell to sending the upstream cell of the same round
+}
+
+// Summarize computes the summary of a session
+func (s *CellCaptureSession) Summarize() *CellCaptureSummary {
+	sum := new(CellCaptureSummary)
+	if len(s.Records) > 0 {
+		sum.Duration = s.Records[len(s.Records)-1].Time.Sub(s.Start)
+	}
+
+	roundTimes := make([]time.Duration, 0)
+	processingTimes := make([]time.Duration, 0)
+	downstreamReceivedAt := make(map[int32]time.Time)
+	var lastDownstream *CellCaptureRecord
+
+	for i := range s.Records {
+		r := &s.Records[i]
+		switch r.Kind {
+		case CELL_CAPTURE_DOWNSTREAM:
+			sum.Rounds++
+			sum.BytesDown += int64(r.Size)
+			if lastDownstream != nil {
+				roundTimes = append(roundTimes, r.Time.Sub(lastDownstream.Time))
+				if r.RoundID > lastDownstream.RoundID+1 {
+					sum.RoundsSkipped += int(r.RoundID - lastDownstream.RoundID - 1)
+				}
+			}
+			lastDownstream = r
+			downstreamReceivedAt[r.RoundID] = r.Time
+		case CELL_CAPTURE_UPSTREAM, CELL_CAPTURE_SCHEDULE:
+			if r.Kind == CELL_CAPTURE_UPSTREAM {
+				sum.UpstreamCells++
+			} else {
+				sum.ScheduleCells++
+			}
+			sum.BytesUp += int64(r.Size)
+			if r.Flags&CELL_CAPTURE_FLAG_OWNED_SLOT != 0 {
+				sum.OwnedSlots++
+			}
+			if r.Flags&CELL_CAPTURE_FLAG_DATA != 0 {
+				sum.DataCells++
+			}
+			if received, ok := downstreamReceivedAt[r.RoundID]; ok {
+				processingTimes = append(processingTimes, r.Time.Sub(received))
+				delete(downstreamReceivedAt, r.RoundID)
+			}
+		}
+	}
+
+	sum.RoundTimeMedian = durationPercentile(roundTimes, 50)
+	sum.RoundTimeP95 = durationPercentile(roundTimes, 95)
+	sum.RoundTimeMax = durationPercentile(roundTimes, 100)
+	sum.ProcessingP95 = durationPercentile(processingTimes, 95)
+	return sum
+}
+
+// String returns a human-readable summary
+func (sum *CellCaptureSummary) String() string {
+	return "duration " + sum.Duration.String() +
+		", rounds " + strconv.Itoa(sum.Rounds) + " (" + strconv.Itoa(sum.RoundsSkipped) + " skipped)" +
+		", upstream cells " + strconv.Itoa(sum.UpstreamCells) + " (" + strconv.Itoa(sum.OwnedSlots) + " in our slots, " + strconv.Itoa(sum.DataCells) + " with data)" +
+		", schedule cells " + strconv.Itoa(sum.ScheduleCells) +
+		", bytes up " + strconv.FormatInt(sum.BytesUp, 10) + ", bytes down " + strconv.FormatInt(sum.BytesDown, 10) +
+		", round time median " + sum.RoundTimeMedian.String() + ", p95 " + sum.RoundTimeP95.String() + ", max " + sum.RoundTimeMax.String() +
+		", processing p95 " + sum.ProcessingP95.String()
+}
+
+// CellCaptureKindName returns the name of a record kind, as printed by the reader
+func CellCaptureKindName(kind uint8) string {
+	switch kind {
+	case CELL_CAPTURE_DOWNSTREAM:
+		return "down"
+	case CELL_CAPTURE_UPSTREAM:
+		return "up"
+	case CELL_CAPTURE_SCHEDULE:
+		return "schedule"
+	}
+	return "unknown(" + strconv.Itoa(int(kind)) + ")"
+}
+
+// returns the p-th percentile of the durations (p in [0;100]), or 0 if there are none
+func durationPercentile(values []time.Duration, p int) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := (len(sorted)*p+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCellCapture(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	w, err := NewCellCaptureWriter(buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(CELL_CAPTURE_DOWNSTREAM, 0, 0, 100)
+	w.Record(CELL_CAPTURE_UPSTREAM, CELL_CAPTURE_FLAG_OWNED_SLOT|CELL_CAPTURE_FLAG_DATA, 0, 120)
+	time.Sleep(2 * time.Millisecond)
+	w.Record(CELL_CAPTURE_DOWNSTREAM, 0, 2, 100)
+	w.Record(CELL_CAPTURE_SCHEDULE, 0, 2, 12)
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := w.Record(CELL_CAPTURE_DOWNSTREAM, 0, 3, 100); err == nil {
+		t.Error("Should not record in a closed cell capture")
+	}
+
+	// the payloads are never in the capture, only the metadata
+	if buf.Len() != len(CELL_CAPTURE_MAGIC)+1+cellCaptureSessionLength+4*cellCaptureRecordLength {
+		t.Error("Wrong cell capture length", buf.Len())
+	}
+
+	sessions, err := ReadCellCapture(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || len(sessions[0].Records) != 4 {
+		t.Fatal("Should read 1 session with 4 records")
+	}
+	r := sessions[0].Records[1]
+	if r.Kind != CELL_CAPTURE_UPSTREAM || r.Flags != CELL_CAPTURE_FLAG_OWNED_SLOT|CELL_CAPTURE_FLAG_DATA || r.RoundID != 0 || r.Size != 120 {
+		t.Error("Wrong record", r)
+	}
+	if sessions[0].Records[2].Time.Sub(sessions[0].Start) < 2*time.Millisecond {
+		t.Error("Wrong record time", sessions[0].Records[2].Time)
+	}
+
+	sum := sessions[0].Summarize()
+	if sum.Rounds != 2 || sum.RoundsSkipped != 1 || sum.UpstreamCells != 1 || sum.ScheduleCells != 1 ||
+		sum.OwnedSlots != 1 || sum.DataCells != 1 || sum.BytesUp != 132 || sum.BytesDown != 200 {
+		t.Error("Wrong summary", sum.String())
+	}
+	if sum.RoundTimeMax < 2*time.Millisecond {
+		t.Error("Wrong round time", sum.RoundTimeMax)
+	}
+
+	// a truncated record is ignored
+	sessions, err = ReadCellCapture(bytes.NewReader(buf.Bytes()[:buf.Len()-5]))
+	if err != nil || len(sessions[0].Records) != 3 {
+		t.Error("A truncated record should be ignored", err)
+	}
+
+	if _, err := ReadCellCapture(bytes.NewReader([]byte("not a capture"))); err == nil {
+		t.Error("Should not read something that is not a cell capture")
+	}
+}
+
+func TestCellCaptureFileSessions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "prifi-cell-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "capture")
+
+	// two protocol runs append two sessions to the same file
+	for i := 0; i < 2; i++ {
+		w, err := NewCellCaptureFileWriter(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= i; j++ {
+			w.Record(CELL_CAPTURE_DOWNSTREAM, 0, int32(j), 10)
+		}
+		w.Close()
+	}
+
+	sessions, err := ReadCellCaptureFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || len(sessions[0].Records) != 1 || len(sessions[1].Records) != 2 {
+		t.Error("Should read 2 sessions with 1 and 2 records")
+	}
+}
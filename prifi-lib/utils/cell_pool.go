@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// For cells in the hundreds of KB (e.g., file-transfer experiments), allocating and copying each cell at every step
+// dominates the cost of a round. Such cells are instead taken from a CellPool : page-aligned buffers, reused from round
+// to round, and passed by reference through the pipeline (encoding, round manager, decoding, exit). Whoever is last to
+// use a cell gives it back with Release, or with ReleaseCell if it does not know the pool (e.g., the exit, which only
+// sees the payloads).
+
+// PAGE_SIZE is the alignment of the buffers of a CellPool
+const PAGE_SIZE = 4096
+
+// LARGE_CELL_SIZE is the size from which the cells are taken from a CellPool instead of being allocated for each round
+const LARGE_CELL_SIZE = 64 * 1024
+
+// CellPool reuses page-aligned buffers of a fixed size. It only recycles buffers it leased, and at most maxLeased
+// are leased at once : past that, Get returns a buffer which is not tracked, so that a user which forgets to release
+// its cells cannot make the pool hold on to them without bound.
+type CellPool struct {
+	sync.Mutex
+	size      int
+	maxLeased int
+	free      [][]byte
+	leased    map[*byte]bool // keyed by the first byte of the buffer, hence only the whole buffer is released
+
+	// statistics
+	allocations int64
+	reuses      int64
+}
+
+// NewCellPool creates a pool of buffers of size bytes, of which at most maxLeased are in use at once
+func NewCellPool(size int, maxLeased int) *CellPool {
+	return &CellPool{
+		size:      size,
+		maxLeased: maxLeased,
+		free:      make([][]byte, 0),
+		leased:    make(map[*byte]bool),
+	}
+}
+
+// Size returns the size of the buffers of the pool
+func (c *CellPool) Size() int {
+	return c.size
+}
+
+// Get returns a buffer of Size bytes, starting on a page boundary. A reused buffer is not zeroed.
+func (c *CellPool) Get() []byte {
+	c.Lock()
+	defer c.Unlock()
+
+	if n := len(c.free); n > 0 {
+		b := c.free[n-1]
+		c.free[n-1] = nil
+		c.free = c.free[:n-1]
+		c.leased[&b[0]] = true
+		c.reuses++
+		return b
+	}
+
+	b := alignedBuffer(c.size)
+	c.allocations++
+	if len(c.leased) < c.maxLeased {
+		c.leased[&b[0]] = true
+	}
+	return b
+}
+
+// Release gives back a buffer obtained from Get, once its last user is done with it. It returns false, and does
+// nothing, if b was not leased by this pool (e.g., a part of a buffer, or a buffer already released).
+func (c *CellPool) Release(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.leased[&b[0]] {
+		return false
+	}
+	delete(c.leased, &b[0])
+	c.free = append(c.free, b[:c.size:c.size])
+	return true
+}
+
+// Leased returns the number of buffers in use
+func (c *CellPool) Leased() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.leased)
+}
+
+// Stats returns how many buffers were allocated, and how many times a buffer was reused
+func (c *CellPool) Stats() (int64, int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.allocations, c.reuses
+}
+
+// alignedBuffer allocates size bytes starting on a page boundary
+func alignedBuffer(size int) []byte {
+	raw := make([]byte, size+PAGE_SIZE)
+	offset := 0
+	if misalignment := int(uintptr(unsafe.Pointer(&raw[0])) & (PAGE_SIZE - 1)); misalignment != 0 {
+		offset = PAGE_SIZE - misalignment
+	}
+	return raw[offset : offset+size : offset+size]
+}
+
+// the pools whose cells may reach a user which does not know them
+var registeredCellPools = struct {
+	sync.RWMutex
+	pools []*CellPool
+}{}
+
+// RegisterCellPool lets ReleaseCell give back the cells of pool
+func RegisterCellPool(pool *CellPool) {
+	registeredCellPools.Lock()
+	defer registeredCellPools.Unlock()
+	registeredCellPools.pools = append(registeredCellPools.pools, pool)
+}
+
+// UnregisterCellPool undoes RegisterCellPool; the cells of pool released afterwards are ignored
+func UnregisterCellPool(pool *CellPool) {
+	registeredCellPools.Lock()
+	defer registeredCellPools.Unlock()
+	for i, p := range registeredCellPools.pools {
+		if p == pool {
+			registeredCellPools.pools = append(registeredCellPools.pools[:i], registeredCellPools.pools[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReleaseCell gives back b to the registered pool which leased it, if any. Consumers of cells call it once they are
+// done with a payload; it does nothing for buffers which do not come from a pool, so it is always safe to call.
+func ReleaseCell(b []byte) {
+	if len(b) < LARGE_CELL_SIZE {
+		return
+	}
+	registeredCellPools.RLock()
+	defer registeredCellPools.RUnlock()
+	for _, p := range registeredCellPools.pools {
+		if p.Release(b) {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestCellPool(t *testing.T) {
+	pool := NewCellPool(LARGE_CELL_SIZE, 2)
+
+	a := pool.Get()
+	if len(a) != LARGE_CELL_SIZE || uintptr(unsafe.Pointer(&a[0]))%PAGE_SIZE != 0 {
+		t.Error("The cells should have the size of the pool, and start on a page boundary", len(a))
+	}
+	b := pool.Get()
+	c := pool.Get() // past maxLeased, not tracked
+	if pool.Leased() != 2 {
+		t.Error("Only maxLeased cells should be tracked", pool.Leased())
+	}
+
+	if pool.Release(c) || pool.Release(a[1:]) || pool.Release(nil) {
+		t.Error("Only the leased cells should be released")
+	}
+	if !pool.Release(a[:10]) || pool.Release(a) {
+		t.Error("A leased cell should be released once")
+	}
+
+	// the released cell is reused, with its full size
+	a[0] = 42
+	d := pool.Get()
+	if &d[0] != &a[0] || len(d) != LARGE_CELL_SIZE {
+		t.Error("The released cell should be reused")
+	}
+	if allocations, reuses := pool.Stats(); allocations != 3 || reuses != 1 {
+		t.Error("Wrong statistics", allocations, reuses)
+	}
+	pool.Release(b)
+	pool.Release(d)
+	if pool.Leased() != 0 {
+		t.Error("All the cells should be released", pool.Leased())
+	}
+}
+
+func TestReleaseCell(t *testing.T) {
+	pool := NewCellPool(LARGE_CELL_SIZE, 2)
+	cell := pool.Get()
+
+	// unknown to ReleaseCell until registered
+	ReleaseCell(cell)
+	if pool.Leased() != 1 {
+		t.Error("An unregistered pool should not be released to")
+	}
+
+	RegisterCellPool(pool)
+	ReleaseCell(make([]byte, LARGE_CELL_SIZE)) // not from a pool
+	ReleaseCell([]byte{1, 2, 3})
+	ReleaseCell(cell)
+	if pool.Leased() != 0 {
+		t.Error("The cell should be back in its pool")
+	}
+
+	cell = pool.Get()
+	UnregisterCellPool(pool)
+	ReleaseCell(cell)
+	if pool.Leased() != 1 {
+		t.Error("An unregistered pool should not be released to")
+	}
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pcapng block types and constants, see https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html
+const (
+	pcapngSectionHeaderBlock        uint32 = 0x0A0D0D0A
+	pcapngInterfaceDescriptionBlock uint32 = 0x00000001
+	pcapngEnhancedPacketBlock       uint32 = 0x00000006
+	pcapngByteOrderMagic            uint32 = 0x1A2B3C4D
+	pcapngOptionEnd                 uint16 = 0
+	pcapngOptionComment             uint16 = 1
+
+	// PCAPNG_LINKTYPE_USER0 is the link type we use : the packets are raw DC-net payloads
+	PCAPNG_LINKTYPE_USER0 uint16 = 147
+)
+
+// FlowLabel identifies where a decoded upstream payload comes from, so it can be correlated with the input traces
+type FlowLabel struct {
+	RoundID    int32
+	SlotIndex  int
+	ReceivedAt time.Time
+}
+
+// String returns the label as stored in the packet comment, e.g. "round=12;slot=3;received=1500000000000"
+func (l FlowLabel) String() string {
+	return "round=" + strconv.Itoa(int(l.RoundID)) + ";slot=" + strconv.Itoa(l.SlotIndex) +
+		";received=" + strconv.FormatInt(l.ReceivedAt.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// PCAPNGWriter writes labelled payloads as a pcapng capture (one interface, one packet per payload)
+type PCAPNGWriter struct {
+	sync.Mutex
+	w io.Writer
+	f *os.File
+}
+
+// NewPCAPNGFileWriter creates (or truncates) the file at path, and writes the pcapng headers in it
+func NewPCAPNGFileWriter(path string) (*PCAPNGWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := NewPCAPNGWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pw.f = f
+	return pw, nil
+}
+
+// NewPCAPNGWriter writes the pcapng headers to w, and returns a writer ready to accept packets
+func NewPCAPNGWriter(w io.Writer) (*PCAPNGWriter, error) {
+	pw := &PCAPNGWriter{w: w}
+
+	// section header : byte-order magic, version 1.0, unknown section length
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	if err := pw.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		return nil, err
+	}
+
+	// interface description : link type, reserved, no snap length. Timestamps are in microseconds (the default)
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], PCAPNG_LINKTYPE_USER0)
+	if err := pw.writeBlock(pcapngInterfaceDescriptionBlock, idb); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// WritePacket writes one payload, with its label stored in the packet comment
+func (pw *PCAPNGWriter) WritePacket(label FlowLabel, data []byte) error {
+	pw.Lock()
+	defer pw.Unlock()
+
+	ts := uint64(label.ReceivedAt.UnixNano() / int64(time.Microsecond))
+	comment := []byte(label.String())
+
+	body := make([]byte, 20, 20+pad4(len(data))+4+pad4(len(comment))+4)
+	binary.LittleEndian.PutUint32(body[0:4], 0) // interface ID
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad4(len(data))-len(data))...)
+	body = appendOption(body, pcapngOptionComment, comment)
+	body = appendOption(body, pcapngOptionEnd, nil)
+
+	return pw.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+// Close closes the underlying file, if this writer created it
+func (pw *PCAPNGWriter) Close() error {
+	pw.Lock()
+	defer pw.Unlock()
+	if pw.f != nil {
+		return pw.f.Close()
+	}
+	return nil
+}
+
+// writes [type, total length, body, total length]; body must already be padded to 32 bits
+func (pw *PCAPNGWriter) writeBlock(blockType uint32, body []byte) error {
+	totalLength := uint32(12 + len(body))
+	block := make([]byte, 8, totalLength)
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], totalLength)
+	block = append(block, body...)
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[totalLength-4:], totalLength)
+
+	_, err := pw.w.Write(block)
+	return err
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:2], code)
+	binary.LittleEndian.PutUint16(header[2:4], uint16(len(value)))
+	buf = append(buf, header...)
+	buf = append(buf, value...)
+	return append(buf, make([]byte, pad4(len(value))-len(value))...)
+}
+
+// rounds n up to the next multiple of 4
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPCAPNGWriter(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	w, err := NewPCAPNGWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SHB (28 bytes) + IDB (20 bytes)
+	if buf.Len() != 48 {
+		t.Error("Headers should be 48 bytes, are", buf.Len())
+	}
+	if binary.LittleEndian.Uint32(buf.Bytes()[0:4]) != pcapngSectionHeaderBlock {
+		t.Error("Capture should start with a section header block")
+	}
+
+	label := FlowLabel{RoundID: 12, SlotIndex: 3, ReceivedAt: time.Unix(1500000000, 0)}
+	if label.String() != "round=12;slot=3;received=1500000000000" {
+		t.Error("Wrong label string", label.String())
+	}
+
+	data := []byte{1, 2, 3, 4, 5}
+	if err := w.WritePacket(label, data); err != nil {
+		t.Error(err)
+	}
+
+	epb := buf.Bytes()[48:]
+	totalLength := int(binary.LittleEndian.Uint32(epb[4:8]))
+	if totalLength != len(epb) || totalLength%4 != 0 {
+		t.Error("Wrong enhanced packet block length", totalLength, len(epb))
+	}
+	if binary.LittleEndian.Uint32(epb[totalLength-4:]) != uint32(totalLength) {
+		t.Error("Block should end with its length")
+	}
+	if binary.LittleEndian.Uint32(epb[20:24]) != uint32(len(data)) {
+		t.Error("Wrong captured length")
+	}
+	if !bytes.Equal(epb[28:33], data) {
+		t.Error("Packet data not found at the right place")
+	}
+	if !bytes.Contains(epb, []byte(label.String())) {
+		t.Error("Label should be stored in the packet comment")
+	}
+	if w.Close() != nil {
+		t.Error("Close should not fail without file")
+	}
+}
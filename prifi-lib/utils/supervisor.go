@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// SUPERVISOR_RESTART_DELAY is how long a supervisor waits before restarting a subsystem, times the number of restarts
+const SUPERVISOR_RESTART_DELAY = 100 * time.Millisecond
+
+// CrashReport describes a panic recovered by a Supervisor. It is logged as one JSON line, so that the crashes can be
+// collected from the logs.
+type CrashReport struct {
+	Entity    string
+	Subsystem string
+	Time      time.Time
+	Panic     string
+	Stack     []string // one line per frame, innermost first
+	Restarts  int      // how many times the subsystem was restarted, this one included
+	GaveUp    bool     // the subsystem crashed too often, and was not restarted
+}
+
+// String returns the report as one JSON line
+func (r CrashReport) String() string {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return r.Subsystem + " : " + r.Panic
+	}
+	return string(b)
+}
+
+// RecoveredPanic is the error returned by Protect when the function panicked
+type RecoveredPanic struct {
+	Report CrashReport
+}
+
+func (e *RecoveredPanic) Error() string {
+	return e.Report.Entity + " : recovered from a panic in " + e.Report.Subsystem + " : " + e.Report.Panic
+}
+
+// Supervisor recovers the panics of the goroutines and message handlers it runs, so that a bug in one subsystem does
+// not kill the whole process. A goroutine started with Go() is restarted after a panic, up to maxRestarts times;
+// a function called with Protect() returns the panic as an error, and the caller decides how to recover.
+type Supervisor struct {
+	sync.Mutex
+	entity      string
+	maxRestarts int
+	restarts    map[string]int
+	reports     []CrashReport
+	onCrash     func(CrashReport)
+}
+
+// NewSupervisor creates a Supervisor for entity (e.g. "Client 3"), which restarts each subsystem at most maxRestarts times
+func NewSupervisor(entity string, maxRestarts int) *Supervisor {
+	return &Supervisor{
+		entity:      entity,
+		maxRestarts: maxRestarts,
+		restarts:    make(map[string]int),
+	}
+}
+
+// SetEntity sets the entity written in the crash reports
+func (s *Supervisor) SetEntity(entity string) {
+	s.Lock()
+	defer s.Unlock()
+	s.entity = entity
+}
+
+// OnCrash registers a function called (in the crashed goroutine) with each crash report
+func (s *Supervisor) OnCrash(f func(CrashReport)) {
+	s.Lock()
+	defer s.Unlock()
+	s.onCrash = f
+}
+
+// Go runs f in a new goroutine. If f panics, the panic is reported, and f is started again after a short delay,
+// unless the subsystem already crashed maxRestarts times. f returning normally ends the subsystem.
+func (s *Supervisor) Go(subsystem string, f func()) {
+	go func() {
+		for {
+			report := s.run(subsystem, f)
+			if report == nil || report.GaveUp {
+				return
+			}
+			time.Sleep(time.Duration(report.Restarts) * SUPERVISOR_RESTART_DELAY)
+		}
+	}()
+}
+
+// Protect calls f, and returns the panic as a *RecoveredPanic instead of crashing. The subsystem is not restarted,
+// but the panic counts towards its maxRestarts.
+func (s *Supervisor) Protect(subsystem string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &RecoveredPanic{Report: *s.recovered(subsystem, r)}
+		}
+	}()
+	return f()
+}
+
+// Reports returns the crash reports so far
+func (s *Supervisor) Reports() []CrashReport {
+	s.Lock()
+	defer s.Unlock()
+	return append([]CrashReport{}, s.reports...)
+}
+
+// run calls f, and returns the crash report if it panicked
+func (s *Supervisor) run(subsystem string, f func()) (report *CrashReport) {
+	defer func() {
+		if r := recover(); r != nil {
+			report = s.recovered(subsystem, r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// recovered records and logs the panic r of subsystem; it must be called in the deferred function which recovered it
+func (s *Supervisor) recovered(subsystem string, r interface{}) *CrashReport {
+	s.Lock()
+	s.restarts[subsystem]++
+	report := CrashReport{
+		Entity:    s.entity,
+		Subsystem: subsystem,
+		Time:      time.Now(),
+		Panic:     fmt.Sprint(r),
+		Stack:     strings.Split(strings.TrimSpace(string(debug.Stack())), "\n"),
+		Restarts:  s.restarts[subsystem],
+		GaveUp:    s.restarts[subsystem] > s.maxRestarts,
+	}
+	s.reports = append(s.reports, report)
+	onCrash := s.onCrash
+	s.Unlock()
+
+	log.Error(report.Entity, ": panic in", subsystem, "; crash report:", report.String())
+	if report.GaveUp {
+		log.Error(report.Entity, ":", subsystem, "crashed", report.Restarts, "times, giving up on it")
+	}
+	if onCrash != nil {
+		onCrash(report)
+	}
+	return &report
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSupervisorProtect(t *testing.T) {
+	s := NewSupervisor("Client 0", 1)
+
+	if err := s.Protect("messages", func() error { return errors.New("normal error") }); err == nil || err.Error() != "normal error" {
+		t.Error("the errors should be returned as is,", err)
+	}
+
+	err := s.Protect("messages", func() error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	})
+	if _, ok := err.(*RecoveredPanic); !ok || !strings.Contains(err.Error(), "recovered from a panic in messages") {
+		t.Error("the panic should be returned as an error,", err)
+	}
+
+	reports := s.Reports()
+	if len(reports) != 1 || reports[0].Subsystem != "messages" || reports[0].Entity != "Client 0" || reports[0].Restarts != 1 {
+		t.Fatal("wrong crash reports", reports)
+	}
+	if !strings.Contains(reports[0].Panic, "nil map") || len(reports[0].Stack) == 0 {
+		t.Error("the report should have the panic and the stack", reports[0].Panic)
+	}
+	if !strings.HasPrefix(reports[0].String(), "{\"Entity\":\"Client 0\"") {
+		t.Error("the report should be logged as JSON", reports[0].String())
+	}
+}
+
+func TestSupervisorGo(t *testing.T) {
+	s := NewSupervisor("Client 0", 2)
+	crashes := make(chan CrashReport, 10)
+	s.OnCrash(func(r CrashReport) { crashes <- r })
+
+	runs := make(chan int, 10)
+	n := 0
+	s.Go("socks", func() {
+		n++
+		runs <- n
+		panic("socks crashed")
+	})
+
+	// the first run, then 2 restarts, then it gives up
+	for i := 1; i <= 3; i++ {
+		select {
+		case run := <-runs:
+			if run != i {
+				t.Error("wrong run", run)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the subsystem should have been restarted")
+		}
+		r := <-crashes
+		if r.Restarts != i || r.GaveUp != (i == 3) {
+			t.Error("wrong crash report", r.Restarts, r.GaveUp)
+		}
+	}
+	select {
+	case <-runs:
+		t.Error("the subsystem should not be restarted after maxRestarts")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// a subsystem which returns normally is not restarted
+	done := make(chan bool, 2)
+	s.Go("listener", func() { done <- true })
+	<-done
+	select {
+	case <-done:
+		t.Error("the subsystem should not be restarted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
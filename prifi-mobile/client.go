@@ -0,0 +1,238 @@
+package prifimobile
+
+// A PriFi client that an app can embed, with gomobile-friendly types only
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	prifi_service "github.com/dedis/prifi/sda/services"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The statuses of a Client, given to StatusListener.OnStatusChanged
+const (
+	STATUS_STOPPED    = "stopped"    // not started, or stopped by Stop()
+	STATUS_CONNECTING = "connecting" // started, waiting for the relay to include us in an epoch
+	STATUS_RUNNING    = "running"    // in an epoch, the SOCKS server is anonymized
+	STATUS_ERROR      = "error"      // stopped because of an error; the detail says which
+)
+
+// How often the Client checks whether it is in an epoch
+const STATUS_POLL_INTERVAL = 500 * time.Millisecond
+
+// StatusListener is implemented by the app to follow a Client. OnStatusChanged is called from a goroutine of the
+// Client, and must return quickly.
+type StatusListener interface {
+	OnStatusChanged(status string, detail string)
+}
+
+// Client is a PriFi client. Unlike StartClient, it holds all of its state, so an app can stop and restart it, or
+// run it with another configuration, without restarting the process.
+type Client struct {
+	mutex           sync.Mutex
+	prifiConfig     *prifi_protocol.PrifiTomlConfig
+	cothorityConfig *app.CothorityConfig
+	group           *app.Group
+	listener        StatusListener
+	status          string
+	lastNotified    chan bool //closed once the listener got the last status, so it gets them in order
+
+	//set while started
+	host     *onet.Server
+	service  *prifi_service.ServiceState
+	stopChan chan bool
+}
+
+// NewClient creates a Client from the contents of its prifi.toml, identity.toml (its keys and address) and
+// group.toml (the relay and trustees)
+func NewClient(prifiToml string, identityToml string, groupToml string) (*Client, error) {
+	prifiConfig, err := parsePrifiConfig(prifiToml)
+	if err != nil {
+		return nil, err
+	}
+	cothorityConfig, err := parseCothorityConfig(identityToml)
+	if err != nil {
+		return nil, err
+	}
+	group, err := parseGroupConfig(groupToml)
+	if err != nil {
+		return nil, err
+	}
+	prifiConfig.ProtocolVersion = "v1" // standard string for all nodes
+
+	return &Client{
+		prifiConfig:     prifiConfig,
+		cothorityConfig: cothorityConfig,
+		group:           group,
+		status:          STATUS_STOPPED,
+	}, nil
+}
+
+// SetStatusListener sets the listener of the status changes; nil removes it
+func (c *Client) SetStatusListener(listener StatusListener) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.listener = listener
+}
+
+// Status returns the current status, one of the STATUS_* constants
+func (c *Client) Status() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status
+}
+
+// SocksPort returns the port of the SOCKS server the apps' traffic should go through, or 0 if the Client is not
+// started. If SocksServerPort is 0 in prifi.toml, it is a free port chosen at Start().
+func (c *Client) SocksPort() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.service == nil {
+		return 0
+	}
+	return c.service.SocksPort()
+}
+
+// Start starts the SOCKS server and connects to the relay. It returns once the SOCKS server listens; the status
+// then goes to STATUS_RUNNING when the relay includes the client in an epoch.
+func (c *Client) Start() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.status == STATUS_CONNECTING || c.status == STATUS_RUNNING {
+		return errors.New("the client is already started")
+	}
+	if c.prifiConfig.OverrideLogLevel > 0 {
+		log.SetDebugVisible(c.prifiConfig.OverrideLogLevel)
+	}
+
+	host, err := newCothorityServer(c.cothorityConfig)
+	if err != nil {
+		log.Error("Could not start the cothority node:", err)
+		return err
+	}
+	service, ok := host.Service(prifi_service.ServiceName).(*prifi_service.ServiceState)
+	if !ok {
+		host.Close()
+		return errors.New("the PriFi service is not registered")
+	}
+	service.SetConfigFromToml(c.prifiConfig)
+	if err := service.StartClient(c.group, time.Duration(0)); err != nil {
+		log.Error("Could not start the PriFi service:", err)
+		service.ShutdownSocks()
+		host.Close()
+		return err
+	}
+	host.Router.AddErrorHandler(service.NetworkErrorHappened)
+
+	c.host = host
+	c.service = service
+	c.stopChan = make(chan bool)
+	go c.serve(host, c.stopChan)
+	go c.watchProtocol(service, c.stopChan)
+	c.setStatus(STATUS_CONNECTING, "")
+	return nil
+}
+
+// Stop disconnects from the relay and stops the SOCKS server
+func (c *Client) Stop() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.host == nil {
+		return nil
+	}
+	c.shutdown()
+	c.setStatus(STATUS_STOPPED, "")
+	return nil
+}
+
+// shutdown stops the goroutines and the cothority node. The lock must be held.
+func (c *Client) shutdown() {
+	close(c.stopChan)
+	c.service.ShutdownConnectionToRelay()
+	c.service.StopPriFiCommunicateProtocol()
+	c.service.ShutdownSocks()
+	if err := c.host.Close(); err != nil {
+		log.Lvl2("Could not close the cothority node:", err)
+	}
+	c.host = nil
+	c.service = nil
+	c.stopChan = nil
+}
+
+// serve runs the cothority node. A panic stops the Client with STATUS_ERROR, instead of crashing the app.
+func (c *Client) serve(host *onet.Server, stopChan chan bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.failed(stopChan, fmt.Sprint("PriFi stopped unexpectedly: ", r))
+		}
+	}()
+	host.Start()
+}
+
+// watchProtocol follows whether the client is in an epoch, until stopChan is closed
+func (c *Client) watchProtocol(service *prifi_service.ServiceState, stopChan chan bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.failed(stopChan, fmt.Sprint("PriFi stopped unexpectedly: ", r))
+		}
+	}()
+
+	tick := time.NewTicker(STATUS_POLL_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-tick.C:
+		}
+
+		running := service.IsPriFiProtocolRunning()
+		c.mutex.Lock()
+		if c.stopChan == stopChan {
+			if running && c.status == STATUS_CONNECTING {
+				c.setStatus(STATUS_RUNNING, "")
+			} else if !running && c.status == STATUS_RUNNING {
+				c.setStatus(STATUS_CONNECTING, "the epoch ended, waiting for the next one")
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// failed stops the Client started with stopChan (unless it was already stopped), with STATUS_ERROR
+func (c *Client) failed(stopChan chan bool, detail string) {
+	log.Error(detail)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopChan != stopChan {
+		return
+	}
+	c.shutdown()
+	c.setStatus(STATUS_ERROR, detail)
+}
+
+// setStatus changes the status, and tells the listener (without holding the lock, so it can call the Client). The
+// lock must be held.
+func (c *Client) setStatus(status string, detail string) {
+	c.status = status
+	if c.listener == nil {
+		return
+	}
+	listener, previous, notified := c.listener, c.lastNotified, make(chan bool)
+	c.lastNotified = notified
+	go func() {
+		if previous != nil {
+			<-previous
+		}
+		listener.OnStatusChanged(status, detail)
+		close(notified)
+	}()
+}
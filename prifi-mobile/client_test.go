@@ -0,0 +1,105 @@
+package prifimobile
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.dedis.ch/kyber/v3/suites"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"go.dedis.ch/kyber/v3/util/key"
+)
+
+type testStatusListener struct {
+	statuses chan string
+}
+
+func (l *testStatusListener) OnStatusChanged(status string, detail string) {
+	l.statuses <- status
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func testIdentityToml(t *testing.T) string {
+	suite := suites.MustFind("Ed25519")
+	kp := key.NewKeyPair(suite)
+	pub, _ := encoding.PointToStringHex(suite, kp.Public)
+	priv, _ := encoding.ScalarToStringHex(suite, kp.Private)
+	return "Public = \"" + pub + "\"\nPrivate = \"" + priv + "\"\nAddress = \"tcp://127.0.0.1:" + strconv.Itoa(freePort(t)) + "\"\nDescription = \"Prifi\"\n"
+}
+
+func testGroupToml(t *testing.T) string {
+	suite := suites.MustFind("Ed25519")
+	pub, _ := encoding.PointToStringHex(suite, key.NewKeyPair(suite).Public)
+	return "[[servers]]\n  Address = \"tcp://127.0.0.1:" + strconv.Itoa(freePort(t)) + "\"\n  Public = \"" + pub + "\"\n  Description = \"relay\"\n"
+}
+
+const testPrifiToml = "SocksServerPort = 0\nClientSocksListenAddress = \"127.0.0.1\"\nPayloadSize = 1000\n"
+
+func expectStatus(t *testing.T, l *testStatusListener, expected string) {
+	select {
+	case s := <-l.statuses:
+		if s != expected {
+			t.Error("Status should be", expected, "but is", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Did not get the status", expected)
+	}
+}
+
+func TestClientInvalidConfig(t *testing.T) {
+	if _, err := NewClient("PayloadSize = \"not a number\"", testIdentityToml(t), testGroupToml(t)); err == nil {
+		t.Error("Should not create a client with an invalid prifi.toml")
+	}
+	if _, err := NewClient(testPrifiToml, testIdentityToml(t), ""); err == nil {
+		t.Error("Should not create a client without a relay")
+	}
+}
+
+func TestClientStartStop(t *testing.T) {
+	c, err := NewClient(testPrifiToml, testIdentityToml(t), testGroupToml(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &testStatusListener{statuses: make(chan string, 10)}
+	c.SetStatusListener(listener)
+	if c.Status() != STATUS_STOPPED || c.SocksPort() != 0 {
+		t.Error("A new client should be stopped, without a SOCKS port")
+	}
+
+	// the relay is not there, the client waits for it
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, listener, STATUS_CONNECTING)
+	if c.SocksPort() == 0 {
+		t.Error("A started client should have a SOCKS port")
+	}
+	if err := c.Start(); err == nil {
+		t.Error("Should not start a client twice")
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Error(err)
+	}
+	expectStatus(t, listener, STATUS_STOPPED)
+	if c.SocksPort() != 0 {
+		t.Error("A stopped client should not have a SOCKS port")
+	}
+
+	// it can be restarted
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, listener, STATUS_CONNECTING)
+	c.Stop()
+	expectStatus(t, listener, STATUS_STOPPED)
+}
@@ -4,11 +4,13 @@ package prifimobile
 
 import (
 	"bytes"
+	"errors"
 	"github.com/BurntSushi/toml"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
 	"golang.org/x/mobile/asset"
+	"strings"
 	"sync"
 )
 
@@ -52,8 +54,13 @@ func initPrifiConfig() (*prifi_protocol.PrifiTomlConfig, error) {
 		return nil, err
 	}
 
+	return parsePrifiConfig(tomlRawDataString)
+}
+
+// parsePrifiConfig decodes the content of a prifi.toml
+func parsePrifiConfig(tomlRawDataString string) (*prifi_protocol.PrifiTomlConfig, error) {
 	config := &prifi_protocol.PrifiTomlConfig{}
-	_, err = toml.Decode(tomlRawDataString, config)
+	_, err := toml.Decode(tomlRawDataString, config)
 	if err != nil {
 		log.Error("Could not parse toml file ", prifiConfigFilename)
 		return nil, err
@@ -69,8 +76,13 @@ func initCothorityConfig() (*app.CothorityConfig, error) {
 		return nil, err
 	}
 
+	return parseCothorityConfig(tomlRawDataString)
+}
+
+// parseCothorityConfig decodes the content of an identity.toml
+func parseCothorityConfig(tomlRawDataString string) (*app.CothorityConfig, error) {
 	config := &app.CothorityConfig{}
-	_, err = toml.Decode(tomlRawDataString, config)
+	_, err := toml.Decode(tomlRawDataString, config)
 	if err != nil {
 		log.Error("Could not parse toml file ", cothorityConfigFilename)
 		return nil, err
@@ -79,6 +91,24 @@ func initCothorityConfig() (*app.CothorityConfig, error) {
 	return config, nil
 }
 
+// parseGroupConfig decodes the content of a group.toml
+func parseGroupConfig(tomlRawDataString string) (*app.Group, error) {
+	group, err := app.ReadGroupDescToml(strings.NewReader(tomlRawDataString))
+
+	if err != nil {
+		log.Error("Could not parse toml file ", cothorityGroupConfigFilename)
+		return nil, err
+	}
+
+	if group == nil || group.Roster == nil || len(group.Roster.List) == 0 {
+		e := "No servers found in roster from " + cothorityGroupConfigFilename
+		log.Error(e)
+		return nil, errors.New(e)
+	}
+
+	return group, nil
+}
+
 // TODO: less code duplication?
 func initCothorityGroupConfig() (*app.Group, error) {
 	file, err := asset.Open(cothorityGroupConfigFilename)
@@ -12,7 +12,9 @@ var errorChan chan error
 var globalHost *onet.Server
 var globalService *prifi_service.ServiceState
 
-// The "main" function that is called by Mobile OS in order to launch a client server
+// The "main" function that is called by Mobile OS in order to launch a client server.
+// It reads its configuration from the assets and blocks until StopClient(); see Client for a client without
+// package-level state.
 func StartClient() {
 	stopChan = make(chan bool, 1)
 	errorChan = make(chan error, 1)
@@ -27,7 +29,7 @@ func StartClient() {
 	case <-stopChan:
 		globalHost.Close()
 		globalService.ShutdownSocks()
-		//TODO: re-enable globalService.ShutdownConnexionToRelay()
+		globalService.ShutdownConnectionToRelay()
 		log.Info("PriFi Shutdown")
 	}
 }
@@ -61,6 +61,11 @@ func parseCothority() (*onet.Server, error) {
 		return nil, err
 	}
 
+	return newCothorityServer(c)
+}
+
+// newCothorityServer creates the cothority server described by an identity.toml
+func newCothorityServer(c *app.CothorityConfig) (*onet.Server, error) {
 	if c.Suite == "" {
 		c.Suite = "Ed25519"
 	}
@@ -23,6 +23,8 @@ socksServer2Port=8090           # the port to attempt connect to (from the PriFi
 
 all_localhost_n_clients=3      # number of clients to start in the "all-localhost" script
 
+preset=""                       # if set, e.g. to "web-browsing", every node applies this parameter preset on top of prifi.toml
+
 # default file names :
 
 prifi_file="prifi.toml"                     # default name for the prifi config file (contains prifi-specific settings)
@@ -43,6 +45,11 @@ sleeptime_between_spawns=1                  # time in second between entities la
 
 source "helpers.lib.sh"
 
+preset_flag=()
+if [ -n "$preset" ]; then
+	preset_flag=(--preset "$preset")
+fi
+
 # ------------------------
 #     HELPER FUNCTIONS
 # ------------------------
@@ -138,7 +145,7 @@ case $1 in
 		test_files
 
 		#run PriFi in relay mode
-		DEBUG_COLOR="$colors" go run "$bin_file" --cothority_config "$identity_file2" --group "$group_file2" -d "$dbg_lvl" --prifi_config "$prifi_file2" --port "$socksServer1Port" --port_client "$socksServer2Port" relay
+		DEBUG_COLOR="$colors" go run "$bin_file" --cothority_config "$identity_file2" --group "$group_file2" -d "$dbg_lvl" --prifi_config "$prifi_file2" --port "$socksServer1Port" --port_client "$socksServer2Port" "${preset_flag[@]}" relay
 		;;
 
 	trustee|Trustee|TRUSTEE)
@@ -176,7 +183,7 @@ case $1 in
 		test_files
 
 		#run PriFi in relay mode
-		DEBUG_COLOR="$colors" go run "$bin_file" --cothority_config "$identity_file2" --group "$group_file2" -d "$dbg_lvl" --prifi_config "$prifi_file2" --port "$socksServer1Port" --port_client "$socksServer2Port" trustee
+		DEBUG_COLOR="$colors" go run "$bin_file" --cothority_config "$identity_file2" --group "$group_file2" -d "$dbg_lvl" --prifi_config "$prifi_file2" --port "$socksServer1Port" --port_client "$socksServer2Port" "${preset_flag[@]}" trustee
 		;;
 
 	client|Client|CLIENT)
@@ -220,7 +227,7 @@ case $1 in
 		test_files
 
 		#run PriFi in relay mode
-		DEBUG_COLOR="$colors" go run "$bin_file" --cothority_config "$identity_file2" --group "$group_file2" -d "$dbg_lvl" --prifi_config "$prifi_file2" --port "$socksServer1Port" --port_client "$socksServer2Port" client
+		DEBUG_COLOR="$colors" go run "$bin_file" --cothority_config "$identity_file2" --group "$group_file2" -d "$dbg_lvl" --prifi_config "$prifi_file2" --port "$socksServer1Port" --port_client "$socksServer2Port" "${preset_flag[@]}" client
 		;;
 
 	localhost|Localhost|LOCALHOST|all-localhost|All-Localhost|ALL-LOCALHOST)
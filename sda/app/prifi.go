@@ -4,18 +4,31 @@ Prifi-app starts a cothority node in either trustee, relay or client mode.
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"io/ioutil"
 	"os/user"
 	"path"
 	"runtime"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/dedis/prifi/prifi-lib/config"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	prifi_service "github.com/dedis/prifi/sda/services"
+	"github.com/dedis/prifi/utils/cellsize"
+	"github.com/dedis/prifi/utils/doctor"
+	"github.com/dedis/prifi/utils/groupdist"
 	"github.com/urfave/cli"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/kyber/v3/util/encoding"
 	"go.dedis.ch/kyber/v3/util/key"
@@ -24,6 +37,7 @@ import (
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 	"net"
+	"net/http"
 	"os/exec"
 	"strconv"
 	"time"
@@ -78,6 +92,84 @@ func main() {
 			Aliases: []string{"c"},
 			Action:  startClient,
 		},
+		{
+			Name:      "verify-transcript",
+			Usage:     "re-verifies an exported setup transcript against the group, and prints a JSON verdict",
+			ArgsUsage: "transcript-file",
+			Aliases:   []string{"verify"},
+			Action:    verifyTranscript,
+		},
+		{
+			Name:      "cellsize",
+			Usage:     "recommends cell sizes and window size for a .pcap or .pkts workload, as JSON",
+			ArgsUsage: "upstream-workload [downstream-workload]",
+			Action:    recommendCellSize,
+		},
+		{
+			Name:      "read-cell-capture",
+			Usage:     "summarizes a client's cell capture (see ClientCellCaptureFile)",
+			ArgsUsage: "capture-file",
+			Action:    readCellCapture,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "records",
+					Usage: "also print every cell",
+				},
+			},
+		},
+		{
+			Name:      "sign-group",
+			Usage:     "signs the group and prifi config files with the cothority identity, for serve-group",
+			ArgsUsage: "version [output-file]",
+			Action:    signGroupDescription,
+		},
+		{
+			Name:      "serve-group",
+			Usage:     "serves a signed group description at " + groupdist.WELL_KNOWN_PATH,
+			ArgsUsage: "signed-group-file",
+			Action:    serveGroupDescription,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen, l",
+					Value: ":8080",
+					Usage: "address the group description server listens on",
+				},
+			},
+		},
+		{
+			Name:      "drain",
+			Usage:     "asks a running relay to stop admitting clients, let the SOCKS streams finish, and shut down",
+			ArgsUsage: "relay-pid",
+			Action:    drainRelay,
+		},
+		{
+			Name:      "clientctl",
+			Usage:     "controls a running client through its ClientControlSocket : pause, resume, rotate-socks-port [port], stats or leave",
+			ArgsUsage: "command [port]",
+			Action:    controlClient,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Usage: "the control socket of the client, instead of ClientControlSocket in the prifi config",
+				},
+			},
+		},
+		{
+			Name:   "doctor",
+			Usage:  "checks this node's prifi and cothority configuration for insecure settings",
+			Action: runDoctor,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "default_identities",
+					Value: "config/identities_default",
+					Usage: "folder of the sample identities shipped with PriFi, whose keys must not be used",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the findings as JSON",
+				},
+			},
+		},
 		{
 			Name:    "sockstest",
 			Usage:   "only starts the socks server and the socks clients without prifi",
@@ -111,11 +203,28 @@ func main() {
 			Value: 8081,
 			Usage: "port for the socks client (that will connect to a remote socks server)",
 		},
+		cli.StringFlag{
+			Name:  "shaping",
+			Value: "none",
+			Usage: "client traffic shaping profile: none, constant, web or video",
+		},
+		cli.StringFlag{
+			Name:  "preset",
+			Usage: "parameter preset applied on top of the prifi config: " + strings.Join(prifi_protocol.ParameterPresetNames(), ", "),
+		},
 		cli.StringFlag{
 			Name:  "group, g",
 			Value: getDefaultFilePathForName(DefaultCothorityGroupConfigFile),
 			Usage: "Group file",
 		},
+		cli.StringFlag{
+			Name:  "group_url",
+			Usage: "if set, the signed group description is fetched from this URL, and written to the group and prifi config files",
+		},
+		cli.StringFlag{
+			Name:  "group_signer",
+			Usage: "hex-encoded public key that must have signed the group description fetched from group_url",
+		},
 		cli.StringFlag{
 			Name:  "default_path",
 			Value: ".",
@@ -137,6 +246,14 @@ func main() {
  * Every "app" require reading config files and starting cothority beforehand
  */
 func readConfigAndStartCothority(c *cli.Context) (*onet.Server, *app.Group, *prifi_service.ServiceState) {
+	//if requested, fetch the signed group description first
+	if c.GlobalIsSet("group_url") {
+		if err := fetchGroupDescription(c); err != nil {
+			log.Error("Could not fetch the group description:", err)
+			os.Exit(1)
+		}
+	}
+
 	//parse PriFi parameters
 	prifiTomlConfig, err := readPriFiConfigFile(c)
 
@@ -145,6 +262,10 @@ func readConfigAndStartCothority(c *cli.Context) (*onet.Server, *app.Group, *pri
 		log.Lvl3("Overriding log level (from .toml) to", prifiTomlConfig.OverrideLogLevel)
 		log.SetDebugVisible(prifiTomlConfig.OverrideLogLevel)
 	}
+	if err := prifilog.SetModuleLevels(prifiTomlConfig.LogLevels); err != nil {
+		log.Error("Could not set the log levels of the modules (LogLevels):", err)
+		os.Exit(1)
+	}
 	if prifiTomlConfig.ForceConsoleColor {
 		log.Lvl3("Forcing the console output to be colored (from .toml)")
 		log.SetUseColors(true)
@@ -213,6 +334,7 @@ func startTrustee(c *cli.Context) error {
 		log.Error("Could not start the prifi service:", err)
 		os.Exit(1)
 	}
+	shutdownOnSignal(service)
 
 	host.Router.AddErrorHandler(service.NetworkErrorHappened)
 	host.Start()
@@ -230,6 +352,9 @@ func startRelay(c *cli.Context) error {
 		log.Error("Could not start the prifi service:", err)
 		os.Exit(1)
 	}
+	shutdownOnSignal(service)
+	drainOnSignal(service)
+	reloadTrusteesOnSignal(c, service)
 
 	host.Router.AddErrorHandler(service.NetworkErrorHappened)
 	host.Start()
@@ -246,12 +371,112 @@ func startClient(c *cli.Context) error {
 		log.Error("Could not start the prifi service:", err)
 		os.Exit(1)
 	}
+	shutdownOnSignal(service)
 
 	host.Router.AddErrorHandler(service.NetworkErrorHappened)
 	host.Start()
 	return nil
 }
 
+// shutdownOnSignal stops the PriFi protocol on Ctrl-C or SIGTERM, prints the shutdown report of this node, and exits
+// with a nonzero status if the last session ended abnormally
+func shutdownOnSignal(service *prifi_service.ServiceState) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Lvl1("Received", sig, ", shutting down")
+		service.StopClientControl()
+		service.StopLeakDetector()
+		service.StopPriFiCommunicateProtocol()
+		report := service.ShutdownReport()
+		if report == nil {
+			os.Exit(0)
+		}
+		log.Lvl1("Shutdown report", report.String())
+		os.Exit(report.ExitCode())
+	}()
+}
+
+// drainOnSignal drains the relay on SIGUSR1 (see "prifi drain"), prints its shutdown report, and exits
+func drainOnSignal(service *prifi_service.ServiceState) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		<-signals
+		timeout := time.Duration(service.DrainTimeout()) * time.Second
+		if err := service.Drain(timeout); err != nil {
+			log.Error("Could not drain the relay,", err)
+		}
+		report := service.ShutdownReport()
+		if report == nil {
+			os.Exit(0)
+		}
+		log.Lvl1("Shutdown report", report.String())
+		os.Exit(report.ExitCode())
+	}()
+}
+
+// reloadTrusteesOnSignal re-reads the group file on SIGHUP, and gives the relay its new trustees
+func reloadTrusteesOnSignal(c *cli.Context, service *prifi_service.ServiceState) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Lvl1("Received SIGHUP, reloading the trustees from the group file")
+			group := readCothorityGroupConfig(c)
+			if group == nil {
+				log.Error("Could not read the group file, keeping the current trustees")
+				continue
+			}
+			if err := service.UpdateTrustees(group); err != nil {
+				log.Error("Could not update the trustees,", err)
+			}
+		}
+	}()
+}
+
+// drainRelay asks the relay running as the given process to drain, and shut down
+func drainRelay(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return errors.New("usage: prifi drain relay-pid")
+	}
+	pid, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		return errors.New("invalid relay pid \"" + c.Args().First() + "\"")
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+		return err
+	}
+	log.Info("Asked the relay", pid, "to drain; it shuts down once the SOCKS streams are finished, or at the deadline")
+	return nil
+}
+
+// controlClient sends a command to the control socket of a running client, and prints its answer
+func controlClient(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return errors.New("usage: prifi clientctl pause|resume|rotate-socks-port [port]|stats|leave")
+	}
+	socket := c.String("socket")
+	if socket == "" {
+		prifiTomlConfig, err := readPriFiConfigFile(c)
+		if err != nil {
+			return err
+		}
+		socket = prifiTomlConfig.ClientControlSocket
+	}
+	if socket == "" {
+		return errors.New("no control socket, set ClientControlSocket in the prifi config or use --socket")
+	}
+
+	answer, err := prifi_service.SendClientControl(socket, strings.Join(c.Args(), " "))
+	if err != nil {
+		return err
+	}
+	fmt.Println(answer)
+	return nil
+}
+
 // this is used to test the socks server and clients integrated to PriFi, without using DC-nets.
 func startSocksTunnelOnly(c *cli.Context) error {
 	log.Info("Starting socks tunnel (bypassing PriFi)")
@@ -267,6 +492,258 @@ func startSocksTunnelOnly(c *cli.Context) error {
 	return nil
 }
 
+// verifyTranscript re-runs all verifications on an exported setup transcript and prints the verdict
+// on stdout. It does not start a cothority node.
+func verifyTranscript(c *cli.Context) error {
+	tfile := c.Args().First()
+	if tfile == "" {
+		log.Error("Usage: prifi verify-transcript transcript-file")
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(tfile)
+	if err != nil {
+		log.Error("Could not read transcript file \"", tfile, "\"", err)
+		os.Exit(1)
+	}
+
+	transcript, err := scheduler.SetupTranscriptFromBytes(data)
+	if err != nil {
+		log.Error("Could not parse transcript file \"", tfile, "\"", err)
+		os.Exit(1)
+	}
+
+	//the trustees' keys are per-session, they must be endorsed by the long-term keys of the trustees of the group
+	group := readCothorityGroupConfig(c)
+	if group == nil {
+		os.Exit(1)
+	}
+	groupKeys := make([]kyber.Point, 0)
+	for _, si := range group.Roster.List {
+		if group.GetDescription(si) == "trustee" {
+			groupKeys = append(groupKeys, si.Public)
+		}
+	}
+
+	verdict := scheduler.VerifySetupTranscript(transcript, groupKeys)
+	out, err := json.Marshal(verdict)
+	if err != nil {
+		log.Error("Could not encode the verdict:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+
+	if !verdict.Valid {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// recommendCellSize analyses the given workloads and prints the recommended parameters on stdout
+func recommendCellSize(c *cli.Context) error {
+	if c.NArg() < 1 {
+		log.Error("Usage: prifi cellsize upstream-workload [downstream-workload]")
+		os.Exit(1)
+	}
+
+	upstream, err := cellsize.LoadWorkload(c.Args().Get(0))
+	if err != nil {
+		log.Error("Could not load the upstream workload:", err)
+		os.Exit(1)
+	}
+	var downstream []cellsize.Sample
+	if c.NArg() > 1 {
+		downstream, err = cellsize.LoadWorkload(c.Args().Get(1))
+		if err != nil {
+			log.Error("Could not load the downstream workload:", err)
+			os.Exit(1)
+		}
+	}
+
+	recommendation, err := cellsize.Recommend(upstream, downstream, cellsize.DEFAULT_CELL_OVERHEAD)
+	if err != nil {
+		log.Error("Could not compute a recommendation:", err)
+		os.Exit(1)
+	}
+	out, err := json.Marshal(recommendation)
+	if err != nil {
+		log.Error("Could not encode the recommendation:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// readCellCapture prints the summary of each session of a client's cell capture, and optionally all its cells
+func readCellCapture(c *cli.Context) error {
+	if c.NArg() < 1 {
+		log.Error("Usage: prifi read-cell-capture capture-file")
+		os.Exit(1)
+	}
+
+	sessions, err := utils.ReadCellCaptureFile(c.Args().First())
+	if err != nil {
+		log.Error("Could not read the cell capture:", err)
+		os.Exit(1)
+	}
+	for i, session := range sessions {
+		fmt.Println("Session", i, "started at", session.Start.Format(time.RFC3339)+":", session.Summarize().String())
+		if !c.Bool("records") {
+			continue
+		}
+		for _, r := range session.Records {
+			fmt.Printf("%12.3f ms\t%-8s\tround %d\t%d bytes", float64(r.Time.Sub(session.Start))/float64(time.Millisecond), utils.CellCaptureKindName(r.Kind), r.RoundID, r.Size)
+			if r.Flags&utils.CELL_CAPTURE_FLAG_OWNED_SLOT != 0 {
+				fmt.Print("\tour slot")
+			}
+			if r.Flags&utils.CELL_CAPTURE_FLAG_DATA != 0 {
+				fmt.Print("\twith data")
+			}
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+// runDoctor audits the prifi.toml and identity.toml of this node, prints the findings, and exits with a nonzero status
+// if one of them is HIGH or CRITICAL
+func runDoctor(c *cli.Context) error {
+	prifiTomlConfig, err := readPriFiConfigFile(c)
+	if err != nil {
+		log.Error("Could not read prifi config:", err)
+		os.Exit(1)
+	}
+
+	var identity *doctor.Identity
+	cfile := c.GlobalString("cothority_config")
+	if identity, err = doctor.LoadIdentity(cfile); err != nil {
+		log.Lvl1("Could not read the identity", cfile, ", skipping the identity checks;", err)
+		identity = nil
+	}
+	defaultKeys, err := doctor.LoadDefaultKeys(c.String("default_identities"))
+	if err != nil {
+		log.Lvl1("Could not read the sample identities, skipping the default keys check;", err)
+	}
+
+	findings := doctor.Audit(prifiTomlConfig, identity, defaultKeys)
+	if c.Bool("json") {
+		out, err := json.Marshal(findings)
+		if err != nil {
+			log.Error("Could not encode the findings:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	} else {
+		for _, f := range findings {
+			fmt.Println(f.String())
+		}
+		fmt.Println(len(findings), "finding(s)")
+	}
+
+	if worst, ok := doctor.WorstSeverity(findings); ok && worst >= doctor.HIGH {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// signGroupDescription signs the group and prifi config files with the private key of the cothority identity
+func signGroupDescription(c *cli.Context) error {
+	version, err := strconv.ParseUint(c.Args().First(), 10, 64)
+	if err != nil {
+		log.Error("Usage: prifi sign-group version [output-file]")
+		os.Exit(1)
+	}
+
+	groupToml, err := ioutil.ReadFile(c.GlobalString("group"))
+	if err != nil {
+		log.Error("Could not read the group file:", err)
+		os.Exit(1)
+	}
+	prifiToml, err := ioutil.ReadFile(c.GlobalString("prifi_config"))
+	if err != nil {
+		log.Error("Could not read the prifi config file:", err)
+		os.Exit(1)
+	}
+	identity, err := app.LoadCothority(c.GlobalString("cothority_config"))
+	if err != nil {
+		log.Error("Could not read the cothority config:", err)
+		os.Exit(1)
+	}
+	private, err := encoding.StringHexToScalar(config.CryptoSuite, identity.Private)
+	if err != nil {
+		log.Error("Could not decode the private key:", err)
+		os.Exit(1)
+	}
+
+	sg, err := groupdist.Sign(groupToml, prifiToml, version, private)
+	if err != nil {
+		log.Error("Could not sign the group description:", err)
+		os.Exit(1)
+	}
+	out, err := sg.ToBytes()
+	if err != nil {
+		log.Error("Could not encode the group description:", err)
+		os.Exit(1)
+	}
+
+	if c.NArg() > 1 {
+		if err := ioutil.WriteFile(c.Args().Get(1), out, 0644); err != nil {
+			log.Error("Could not write the group description:", err)
+			os.Exit(1)
+		}
+		log.Info("Signed group description version", version, "written; signer is", sg.Signer)
+		return nil
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// serveGroupDescription serves a signed group description over HTTP, until killed
+func serveGroupDescription(c *cli.Context) error {
+	data, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		log.Error("Usage: prifi serve-group signed-group-file;", err)
+		os.Exit(1)
+	}
+	sg, err := groupdist.SignedGroupFromBytes(data)
+	if err != nil {
+		log.Error("Could not parse the signed group description:", err)
+		os.Exit(1)
+	}
+	server, err := groupdist.NewServer(sg)
+	if err != nil {
+		log.Error("Could not serve the group description:", err)
+		os.Exit(1)
+	}
+
+	log.Info("Serving group description version", sg.Version, "on", c.String("listen")+groupdist.WELL_KNOWN_PATH)
+	return http.ListenAndServe(c.String("listen"), server)
+}
+
+// fetchGroupDescription fetches and verifies the signed group description, and writes it to the group and prifi
+// config files. The last accepted version is stored next to the group file, to refuse rollbacks.
+func fetchGroupDescription(c *cli.Context) error {
+	signer, err := encoding.StringHexToPoint(config.CryptoSuite, c.GlobalString("group_signer"))
+	if err != nil {
+		return errors.New("group_url requires a valid group_signer: " + err.Error())
+	}
+
+	gfile := c.GlobalString("group")
+	sg, err := groupdist.Fetch(c.GlobalString("group_url"), signer, gfile+".version")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(gfile, []byte(sg.GroupToml), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.GlobalString("prifi_config"), []byte(sg.PriFiToml), 0644); err != nil {
+		return err
+	}
+
+	log.Lvl1("Fetched group description version", sg.Version, "from", c.GlobalString("group_url"))
+	return nil
+}
+
 /**
  * COTHORITY
  */
@@ -407,6 +884,20 @@ func readPriFiConfigFile(c *cli.Context) (*prifi_protocol.PrifiTomlConfig, error
 		return nil, err
 	}
 
+	// the preset replaces the values of the file, and the command line params can override it
+	var preset *prifi_protocol.ParameterPreset
+	if c.GlobalIsSet("preset") {
+		preset, err = prifi_protocol.GetParameterPreset(c.GlobalString("preset"))
+		if err == nil {
+			err = preset.Apply(tomlConfig)
+		}
+		if err != nil {
+			log.Error("Could not apply the preset:", err)
+			return nil, err
+		}
+		log.Lvl1("Using the parameter preset", preset.Name, "("+preset.Description+")")
+	}
+
 	//ports can be overridden by the command line params
 	if c.GlobalIsSet("port") {
 		tomlConfig.SocksServerPort = c.GlobalInt("port")
@@ -414,6 +905,22 @@ func readPriFiConfigFile(c *cli.Context) (*prifi_protocol.PrifiTomlConfig, error
 	if c.GlobalIsSet("port_client") {
 		tomlConfig.SocksClientPort = c.GlobalInt("port_client")
 	}
+	if c.GlobalIsSet("shaping") {
+		tomlConfig.ClientTrafficShapingProfile = c.GlobalString("shaping")
+	}
+	if preset != nil {
+		if err := preset.Validate(tomlConfig); err != nil {
+			log.Error("Incompatible override of the preset:", err)
+			return nil, err
+		}
+	}
+
+	// the conodes exchange the keys with their own suite, so the SDA version cannot use another one
+	if suite, err := config.CanonicalCryptoSuiteName(tomlConfig.CryptoSuite); err != nil || suite != config.DEFAULT_CRYPTO_SUITE {
+		e := "CryptoSuite \"" + tomlConfig.CryptoSuite + "\" cannot be used with the SDA, which only supports " + config.DEFAULT_CRYPTO_SUITE + "; use the standalone version"
+		log.Error(e)
+		return nil, errors.New(e)
+	}
 
 	return tomlConfig, nil
 }
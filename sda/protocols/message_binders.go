@@ -1,5 +1,7 @@
 package protocols
 
+import "go.dedis.ch/onet/v3/log"
+
 //Received_ALL_ALL_SHUTDOWN shuts down the PriFi-lib if it is running
 func (p *PriFiSDAProtocol) Received_ALL_ALL_SHUTDOWN(msg Struct_ALL_ALL_SHUTDOWN) error {
 	p.Stop()
@@ -29,6 +31,16 @@ func (p *PriFiSDAProtocol) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg Struct_CLI_RE
 
 //Received_CLI_REL_UPSTREAM_DATA forwards an CLI_REL_UPSTREAM_DATA message to PriFi's lib
 func (p *PriFiSDAProtocol) Received_CLI_REL_UPSTREAM_DATA(msg Struct_CLI_REL_UPSTREAM_DATA) error {
+	//the ClientID is not authenticated : it must be the one of the sender, else a client could suppress the
+	//ciphers of another one
+	if client, found := p.ms.clients[msg.ClientID]; !found || !client.ID.Equal(msg.TreeNode.ID) {
+		log.Error("Relay : dropping a cipher from", msg.TreeNode.ServerIdentity, "which claims to come from client", msg.ClientID)
+		return nil
+	}
+	//with the UDP uplink, this cipher might already have arrived over UDP
+	if p.upstreamDedup != nil && !p.upstreamDedup.firstTime(msg.ClientID, msg.RoundID) {
+		return nil
+	}
 	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_UPSTREAM_DATA)
 }
 
@@ -47,6 +59,11 @@ func (p *PriFiSDAProtocol) Received_TRU_REL_SHUFFLE_SIG(msg Struct_TRU_REL_SHUFF
 	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_SHUFFLE_SIG)
 }
 
+//Received_TRU_REL_SHUFFLE_REJECTED forwards an TRU_REL_SHUFFLE_REJECTED message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_TRU_REL_SHUFFLE_REJECTED(msg Struct_TRU_REL_SHUFFLE_REJECTED) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_SHUFFLE_REJECTED)
+}
+
 //Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS forwards an TRU_REL_TELL_NEW_BASE_AND_EPH_PKS message to PriFi's lib
 func (p *PriFiSDAProtocol) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg Struct_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS) error {
 	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
@@ -77,6 +94,31 @@ func (p *PriFiSDAProtocol) Received_REL_CLI_DISRUPTED_ROUND(msg Struct_REL_CLI_D
 	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_DISRUPTED_ROUND)
 }
 
+// Received_REL_ALL_DISRUPTION_DETECTED forward an REL_ALL_DISRUPTION_DETECTED message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_ALL_DISRUPTION_DETECTED(msg Struct_REL_ALL_DISRUPTION_DETECTED) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_DISRUPTION_DETECTED)
+}
+
+// Received_REL_ALL_EQUIVOCATION_ALARM forward an REL_ALL_EQUIVOCATION_ALARM message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_ALL_EQUIVOCATION_ALARM(msg Struct_REL_ALL_EQUIVOCATION_ALARM) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_EQUIVOCATION_ALARM)
+}
+
+// Received_REL_ALL_REVEAL_REQUEST forward an REL_ALL_REVEAL_REQUEST message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_ALL_REVEAL_REQUEST(msg Struct_REL_ALL_REVEAL_REQUEST) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_REVEAL_REQUEST)
+}
+
+// Received_CLI_REL_REVEAL_BITS forward an CLI_REL_REVEAL_BITS message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_REVEAL_BITS(msg Struct_CLI_REL_REVEAL_BITS) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_REVEAL_BITS)
+}
+
+// Received_TRU_REL_REVEAL_BITS forward an TRU_REL_REVEAL_BITS message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_TRU_REL_REVEAL_BITS(msg Struct_TRU_REL_REVEAL_BITS) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_REVEAL_BITS)
+}
+
 // Received_CLI_REL_DISRUPTION_BLAME forward an CLI_REL_DISRUPTION_BLAME message to PriFi's lib
 func (p *PriFiSDAProtocol) Received_CLI_REL_DISRUPTION_BLAME(msg Struct_CLI_REL_DISRUPTION_BLAME) error {
 	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DISRUPTION_BLAME)
@@ -111,3 +153,78 @@ func (p *PriFiSDAProtocol) Received_CLI_REL_DISRUPTION_SECRET(msg Struct_CLI_REL
 func (p *PriFiSDAProtocol) Received_TRU_REL_DISRUPTION_SECRET(msg Struct_TRU_REL_DISRUPTION_SECRET) error {
 	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_SHARED_SECRET)
 }
+
+// Received_REL_ALL_PARAMETERS_PROPOSAL forward an REL_ALL_PARAMETERS_PROPOSAL message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_ALL_PARAMETERS_PROPOSAL(msg Struct_REL_ALL_PARAMETERS_PROPOSAL) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_PARAMETERS_PROPOSAL)
+}
+
+// Received_CLI_REL_PARAMETERS_ACK forward an CLI_REL_PARAMETERS_ACK message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_PARAMETERS_ACK(msg Struct_CLI_REL_PARAMETERS_ACK) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_PARAMETERS_ACK)
+}
+
+// Received_TRU_REL_PARAMETERS_ACK forward an TRU_REL_PARAMETERS_ACK message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_TRU_REL_PARAMETERS_ACK(msg Struct_TRU_REL_PARAMETERS_ACK) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_PARAMETERS_ACK)
+}
+
+// Received_REL_ALL_PARAMETERS_ACTIVATE forward an REL_ALL_PARAMETERS_ACTIVATE message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_ALL_PARAMETERS_ACTIVATE(msg Struct_REL_ALL_PARAMETERS_ACTIVATE) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_PARAMETERS_ACTIVATE)
+}
+
+// Received_CLI_REL_DOWNSTREAM_COPY_REQUEST forward an CLI_REL_DOWNSTREAM_COPY_REQUEST message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_DOWNSTREAM_COPY_REQUEST(msg Struct_CLI_REL_DOWNSTREAM_COPY_REQUEST) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DOWNSTREAM_COPY_REQUEST)
+}
+
+// Received_REL_CLI_DOWNSTREAM_COPY forward an REL_CLI_DOWNSTREAM_COPY message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_DOWNSTREAM_COPY(msg Struct_REL_CLI_DOWNSTREAM_COPY) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_DOWNSTREAM_COPY)
+}
+
+// Received_REL_CLI_PARAMS_DIGEST forward an REL_CLI_PARAMS_DIGEST message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_PARAMS_DIGEST(msg Struct_REL_CLI_PARAMS_DIGEST) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_PARAMS_DIGEST)
+}
+
+// Received_TRU_REL_LOAD_REPORT forward an TRU_REL_LOAD_REPORT message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_TRU_REL_LOAD_REPORT(msg Struct_TRU_REL_LOAD_REPORT) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_LOAD_REPORT)
+}
+
+// Received_CLI_REL_GOODBYE forward an CLI_REL_GOODBYE message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_GOODBYE(msg Struct_CLI_REL_GOODBYE) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_GOODBYE)
+}
+
+// Received_REL_CLI_GOODBYE forward an REL_CLI_GOODBYE message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_GOODBYE(msg Struct_REL_CLI_GOODBYE) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_GOODBYE)
+}
+
+// Received_REL_CLI_REFRESH_EPH_PKS forward an REL_CLI_REFRESH_EPH_PKS message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_REFRESH_EPH_PKS(msg Struct_REL_CLI_REFRESH_EPH_PKS) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_REFRESH_EPH_PKS)
+}
+
+// Received_CLI_REL_DOWNSTREAM_NACK forward an CLI_REL_DOWNSTREAM_NACK message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_DOWNSTREAM_NACK(msg Struct_CLI_REL_DOWNSTREAM_NACK) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DOWNSTREAM_NACK)
+}
+
+// Received_REL_CLI_HISTORY_REQUEST forward an REL_CLI_HISTORY_REQUEST message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_HISTORY_REQUEST(msg Struct_REL_CLI_HISTORY_REQUEST) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_HISTORY_REQUEST)
+}
+
+// Received_CLI_REL_HISTORY_DIGEST forward an CLI_REL_HISTORY_DIGEST message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_HISTORY_DIGEST(msg Struct_CLI_REL_HISTORY_DIGEST) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_HISTORY_DIGEST)
+}
+
+// Received_REL_CLI_HISTORY_RESYNC forward an REL_CLI_HISTORY_RESYNC message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_HISTORY_RESYNC(msg Struct_REL_CLI_HISTORY_RESYNC) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_HISTORY_RESYNC)
+}
@@ -3,12 +3,17 @@ package protocols
 import (
 	"errors"
 	"strconv"
+	"time"
 
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 )
 
+// netLog logs at the level of the "net" module
+var netLog = prifilog.NewModuleLogger(prifilog.MODULE_NET)
+
 //MessageSender is the struct we need to give PriFi-Lib so it can send messages.
 //It needs to implement the "MessageSender interface" defined in prifi_lib/prifi.go
 type MessageSender struct {
@@ -17,6 +22,7 @@ type MessageSender struct {
 	clients    map[int]*onet.TreeNode
 	trustees   map[int]*onet.TreeNode
 	udpChannel UDPChannel
+	udpUplink  *UDPUplinkClient //if non-nil, the upstream ciphers are sent over UDP first
 }
 
 // buildMessageSender creates a MessageSender struct
@@ -35,10 +41,10 @@ func (p *PriFiSDAProtocol) buildMessageSender(identities map[string]PriFiIdentit
 		port, _ := strconv.Atoi(nodes[i].ServerIdentity.Address.Port())
 		portForFastChannel := port + 3
 
-		log.Lvl3("Found identity", identifier, " -> ", port, portForFastChannel)
+		netLog.Lvl3("Found identity", identifier, " -> ", port, portForFastChannel)
 
 		if !ok {
-			log.Lvl3("Skipping unknow node with address", identifier)
+			netLog.Lvl3("Skipping unknow node with address", identifier)
 			continue
 		}
 		switch id.Role {
@@ -57,14 +63,19 @@ func (p *PriFiSDAProtocol) buildMessageSender(identities map[string]PriFiIdentit
 		}
 	}
 
-	return MessageSender{p.TreeNodeInstance, relay, clients, trustees, newRealUDPChannel()}
+	mtu, broadcastAddress := 0, ""
+	if p.config.Toml != nil {
+		mtu = p.config.Toml.UDPMTU
+		broadcastAddress = p.config.Toml.UDPBroadcastAddress
+	}
+	return MessageSender{p.TreeNodeInstance, relay, clients, trustees, newRealUDPChannel(mtu, broadcastAddress), nil}
 }
 
 //SendToClient sends a message to client i, or fails if it is unknown
 func (ms MessageSender) FastSendToClient(i int, msg *net.REL_CLI_DOWNSTREAM_DATA) error {
 
 	if client, ok := ms.clients[i]; ok {
-		log.Lvl5("Sending a message to client ", i, " (", client.Name(), ") - ", msg)
+		netLog.Lvl5("Sending a message to client ", i, " (", client.Name(), ") - ", msg)
 		return ms.tree.SendTo(client, msg)
 	}
 
@@ -75,7 +86,7 @@ func (ms MessageSender) FastSendToClient(i int, msg *net.REL_CLI_DOWNSTREAM_DATA
 
 //SendToRelay sends a message to the unique relay
 func (ms MessageSender) FastSendToRelay(msg *net.CLI_REL_UPSTREAM_DATA) error {
-	log.Lvl5("Sending a message to relay ", " - ", msg)
+	netLog.Lvl5("Sending a message to relay ", " - ", msg)
 	return ms.tree.SendTo(ms.relay, msg)
 }
 
@@ -83,7 +94,7 @@ func (ms MessageSender) FastSendToRelay(msg *net.CLI_REL_UPSTREAM_DATA) error {
 func (ms MessageSender) SendToClient(i int, msg interface{}) error {
 
 	if client, ok := ms.clients[i]; ok {
-		log.Lvl5("Sending a message to client ", i, " (", client.Name(), ") - ", msg)
+		netLog.Lvl5("Sending a message to client ", i, " (", client.Name(), ") - ", msg)
 		return ms.tree.SendTo(client, msg)
 	}
 
@@ -96,7 +107,7 @@ func (ms MessageSender) SendToClient(i int, msg interface{}) error {
 func (ms MessageSender) SendToTrustee(i int, msg interface{}) error {
 
 	if trustee, ok := ms.trustees[i]; ok {
-		log.Lvl5("Sending a message to trustee ", i, " (", trustee.Name(), ") - ", msg)
+		netLog.Lvl5("Sending a message to trustee ", i, " (", trustee.Name(), ") - ", msg)
 		return ms.tree.SendTo(trustee, msg)
 	}
 
@@ -105,9 +116,17 @@ func (ms MessageSender) SendToTrustee(i int, msg interface{}) error {
 	return errors.New(e)
 }
 
-//SendToRelay sends a message to the unique relay
+//SendToRelay sends a message to the unique relay. Upstream ciphers go through the UDP uplink if enabled, and
+//fall back to TCP if they cannot be sent, or later if they are not acked.
 func (ms MessageSender) SendToRelay(msg interface{}) error {
-	log.Lvl5("Sending a message to relay ", " - ", msg)
+	netLog.Lvl5("Sending a message to relay ", " - ", msg)
+	if upstream, ok := msg.(*net.CLI_REL_UPSTREAM_DATA); ok && ms.udpUplink != nil {
+		err := ms.udpUplink.Send(upstream)
+		if err == nil {
+			return nil
+		}
+		netLog.Lvl2("Could not send round", upstream.RoundID, "over the UDP uplink, sending it over TCP;", err)
+	}
 	return ms.tree.SendTo(ms.relay, msg)
 }
 
@@ -127,18 +146,20 @@ func (ms MessageSender) BroadcastToAllClients(msg interface{}) error {
 func (ms MessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
 
 	clientName := "client-" + strconv.Itoa(clientID)
-	log.Lvl3(clientName, " started UDP-listener helper.")
+	netLog.Lvl3(clientName, " started UDP-listener helper.")
 	listening := false
 	lastSeenMessage := 0 //the first real message has ID 1; this means that we saw the empty struct.
+	consecutiveErrors := 0
+	backoff := UDP_LISTEN_ERROR_BACKOFF
 
 	for {
 		select {
 		case val := <-startStopChan:
 			if val {
 				listening = true //either we listen or we stop
-				log.Lvl3("client", clientName, " switched on broadcast-listening")
+				netLog.Lvl3("client", clientName, " switched on broadcast-listening")
 			} else {
-				log.Lvl3("client", clientName, " killed broadcast-listening.")
+				netLog.Lvl3("client", clientName, " killed broadcast-listening.")
 				return nil
 			}
 		default:
@@ -147,19 +168,30 @@ func (ms MessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived
 		if listening {
 			emptyMessage := net.REL_CLI_DOWNSTREAM_DATA_UDP{}
 			//listen and decode
-			log.Lvl4("client", clientName, " calling listen and block...")
+			netLog.Lvl4("client", clientName, " calling listen and block...")
 			filledMessage, err := ms.udpChannel.ListenAndBlock(&emptyMessage, lastSeenMessage, clientName)
 			lastSeenMessage++
 
 			if err != nil {
 				log.Error(clientName, " an error occurred : ", err)
+				consecutiveErrors++
+				if consecutiveErrors >= UDP_LISTEN_MAX_CONSECUTIVE_ERRORS {
+					e := clientName + " stopped broadcast-listening after " + strconv.Itoa(consecutiveErrors) + " errors in a row, last is " + err.Error()
+					log.Error(e)
+					return errors.New(e)
+				}
+				//a persistent error would otherwise make us spin
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > UDP_LISTEN_MAX_ERROR_BACKOFF {
+					backoff = UDP_LISTEN_MAX_ERROR_BACKOFF
+				}
+				continue
 			}
+			consecutiveErrors = 0
+			backoff = UDP_LISTEN_ERROR_BACKOFF
 
-			log.Lvl4(clientName, " Received an UDP message n°"+strconv.Itoa(lastSeenMessage))
-
-			if err != nil {
-				log.Error(clientName, " an error occurred : ", err)
-			}
+			netLog.Lvl4(clientName, " Received an UDP message n°"+strconv.Itoa(lastSeenMessage))
 
 			messageReceived(filledMessage)
 
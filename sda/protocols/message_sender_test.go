@@ -0,0 +1,39 @@
+package protocols
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingUDPChannel fails every read, like a closed socket
+type failingUDPChannel struct {
+	reads int
+}
+
+func (c *failingUDPChannel) Broadcast(msg MarshallableMessage) error {
+	return nil
+}
+
+func (c *failingUDPChannel) ListenAndBlock(msg MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error) {
+	c.reads++
+	return nil, errors.New("use of closed network connection")
+}
+
+func TestClientSubscribeToBroadcastPersistentError(t *testing.T) {
+	channel := &failingUDPChannel{}
+	ms := MessageSender{udpChannel: channel}
+
+	startStopChan := make(chan bool, 1)
+	startStopChan <- true
+	received := func(interface{}) error {
+		t.Error("No message should be received")
+		return nil
+	}
+
+	if err := ms.ClientSubscribeToBroadcast(0, received, startStopChan); err == nil {
+		t.Error("A persistent error should stop the broadcast-listening")
+	}
+	if channel.reads != UDP_LISTEN_MAX_CONSECUTIVE_ERRORS {
+		t.Error("Should give up after", UDP_LISTEN_MAX_CONSECUTIVE_ERRORS, "failed reads, not", channel.reads)
+	}
+}
@@ -71,6 +71,12 @@ type Struct_TRU_REL_SHUFFLE_SIG struct {
 	net.TRU_REL_SHUFFLE_SIG
 }
 
+//Struct_TRU_REL_SHUFFLE_REJECTED is a wrapper for TRU_REL_SHUFFLE_REJECTED (but also contains a *onet.TreeNode)
+type Struct_TRU_REL_SHUFFLE_REJECTED struct {
+	*onet.TreeNode
+	net.TRU_REL_SHUFFLE_REJECTED
+}
+
 //Struct_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS is a wrapper for TRU_REL_TELL_NEW_BASE_AND_EPH_PKS (but also contains a *onet.TreeNode)
 type Struct_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS struct {
 	*onet.TreeNode
@@ -95,6 +101,36 @@ type Struct_REL_CLI_DISRUPTED_ROUND struct {
 	net.REL_CLI_DISRUPTED_ROUND
 }
 
+//Struct_REL_ALL_DISRUPTION_DETECTED is a wrapper for REL_ALL_DISRUPTION_DETECTED (but also contains a *onet.TreeNode)
+type Struct_REL_ALL_DISRUPTION_DETECTED struct {
+	*onet.TreeNode
+	net.REL_ALL_DISRUPTION_DETECTED
+}
+
+//Struct_REL_ALL_EQUIVOCATION_ALARM is a wrapper for REL_ALL_EQUIVOCATION_ALARM (but also contains a *onet.TreeNode)
+type Struct_REL_ALL_EQUIVOCATION_ALARM struct {
+	*onet.TreeNode
+	net.REL_ALL_EQUIVOCATION_ALARM
+}
+
+//Struct_REL_ALL_REVEAL_REQUEST is a wrapper for REL_ALL_REVEAL_REQUEST (but also contains a *onet.TreeNode)
+type Struct_REL_ALL_REVEAL_REQUEST struct {
+	*onet.TreeNode
+	net.REL_ALL_REVEAL_REQUEST
+}
+
+//Struct_CLI_REL_REVEAL_BITS is a wrapper for CLI_REL_REVEAL_BITS (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_REVEAL_BITS struct {
+	*onet.TreeNode
+	net.CLI_REL_REVEAL_BITS
+}
+
+//Struct_TRU_REL_REVEAL_BITS is a wrapper for TRU_REL_REVEAL_BITS (but also contains a *onet.TreeNode)
+type Struct_TRU_REL_REVEAL_BITS struct {
+	*onet.TreeNode
+	net.TRU_REL_REVEAL_BITS
+}
+
 //Struct_CLI_REL_DISRUPTION_BLAME is a wrapper for CLI_REL_DISRUPTION_BLAME (but also contains a *onet.TreeNode)
 type Struct_CLI_REL_DISRUPTION_BLAME struct {
 	*onet.TreeNode
@@ -136,3 +172,93 @@ type Struct_TRU_REL_DISRUPTION_SECRET struct {
 	*onet.TreeNode
 	net.TRU_REL_SHARED_SECRET
 }
+
+//Struct_REL_ALL_PARAMETERS_PROPOSAL is a wrapper for REL_ALL_PARAMETERS_PROPOSAL (but also contains a *onet.TreeNode)
+type Struct_REL_ALL_PARAMETERS_PROPOSAL struct {
+	*onet.TreeNode
+	net.REL_ALL_PARAMETERS_PROPOSAL
+}
+
+//Struct_CLI_REL_PARAMETERS_ACK is a wrapper for CLI_REL_PARAMETERS_ACK (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_PARAMETERS_ACK struct {
+	*onet.TreeNode
+	net.CLI_REL_PARAMETERS_ACK
+}
+
+//Struct_TRU_REL_PARAMETERS_ACK is a wrapper for TRU_REL_PARAMETERS_ACK (but also contains a *onet.TreeNode)
+type Struct_TRU_REL_PARAMETERS_ACK struct {
+	*onet.TreeNode
+	net.TRU_REL_PARAMETERS_ACK
+}
+
+//Struct_REL_ALL_PARAMETERS_ACTIVATE is a wrapper for REL_ALL_PARAMETERS_ACTIVATE (but also contains a *onet.TreeNode)
+type Struct_REL_ALL_PARAMETERS_ACTIVATE struct {
+	*onet.TreeNode
+	net.REL_ALL_PARAMETERS_ACTIVATE
+}
+
+//Struct_CLI_REL_DOWNSTREAM_COPY_REQUEST is a wrapper for CLI_REL_DOWNSTREAM_COPY_REQUEST (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_DOWNSTREAM_COPY_REQUEST struct {
+	*onet.TreeNode
+	net.CLI_REL_DOWNSTREAM_COPY_REQUEST
+}
+
+//Struct_REL_CLI_DOWNSTREAM_COPY is a wrapper for REL_CLI_DOWNSTREAM_COPY (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_DOWNSTREAM_COPY struct {
+	*onet.TreeNode
+	net.REL_CLI_DOWNSTREAM_COPY
+}
+
+//Struct_REL_CLI_PARAMS_DIGEST is a wrapper for REL_CLI_PARAMS_DIGEST (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_PARAMS_DIGEST struct {
+	*onet.TreeNode
+	net.REL_CLI_PARAMS_DIGEST
+}
+
+//Struct_TRU_REL_LOAD_REPORT is a wrapper for TRU_REL_LOAD_REPORT (but also contains a *onet.TreeNode)
+type Struct_TRU_REL_LOAD_REPORT struct {
+	*onet.TreeNode
+	net.TRU_REL_LOAD_REPORT
+}
+
+//Struct_CLI_REL_GOODBYE is a wrapper for CLI_REL_GOODBYE (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_GOODBYE struct {
+	*onet.TreeNode
+	net.CLI_REL_GOODBYE
+}
+
+//Struct_REL_CLI_GOODBYE is a wrapper for REL_CLI_GOODBYE (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_GOODBYE struct {
+	*onet.TreeNode
+	net.REL_CLI_GOODBYE
+}
+
+//Struct_REL_CLI_REFRESH_EPH_PKS is a wrapper for REL_CLI_REFRESH_EPH_PKS (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_REFRESH_EPH_PKS struct {
+	*onet.TreeNode
+	net.REL_CLI_REFRESH_EPH_PKS
+}
+
+//Struct_CLI_REL_DOWNSTREAM_NACK is a wrapper for CLI_REL_DOWNSTREAM_NACK (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_DOWNSTREAM_NACK struct {
+	*onet.TreeNode
+	net.CLI_REL_DOWNSTREAM_NACK
+}
+
+//Struct_REL_CLI_HISTORY_REQUEST is a wrapper for REL_CLI_HISTORY_REQUEST (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_HISTORY_REQUEST struct {
+	*onet.TreeNode
+	net.REL_CLI_HISTORY_REQUEST
+}
+
+//Struct_CLI_REL_HISTORY_DIGEST is a wrapper for CLI_REL_HISTORY_DIGEST (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_HISTORY_DIGEST struct {
+	*onet.TreeNode
+	net.CLI_REL_HISTORY_DIGEST
+}
+
+//Struct_REL_CLI_HISTORY_RESYNC is a wrapper for REL_CLI_HISTORY_RESYNC (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_HISTORY_RESYNC struct {
+	*onet.TreeNode
+	net.REL_CLI_HISTORY_RESYNC
+}
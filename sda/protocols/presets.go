@@ -0,0 +1,154 @@
+package protocols
+
+/*
+A parameter preset is a named set of values of prifi.toml, tuned for one use of PriFi, so that an operator does not
+have to find a consistent combination of the window, cell sizes, pacing and protections by hand. Every node applies the
+same preset (with the -preset flag), on top of its prifi.toml; the relay's values end up in ALL_ALL_PARAMETERS as usual,
+and the local values of the clients and trustees are set the same way everywhere.
+
+The settings given on the command line still override the preset, but some values are pinned by the preset (e.g.,
+"measurement" needs the latency tests and a static pacing); an override of a pinned value, or a combination of
+values PriFi refuses anyway, is rejected before the node starts.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// ParameterPreset is a named set of values of prifi.toml
+type ParameterPreset struct {
+	Name        string
+	Description string
+	Values      map[string]interface{} // prifi.toml key -> value
+	Pinned      []string               // keys of Values which cannot be overridden
+}
+
+// PARAMETER_PRESETS are the presets which can be given to -preset
+var PARAMETER_PRESETS = []ParameterPreset{
+	{
+		Name:        "low-latency-chat",
+		Description: "small cells sent as soon as possible, with the pacing adjusted for a p95 latency of 200ms",
+		Values: map[string]interface{}{
+			"PayloadSize":                  500,
+			"CellSizeDown":                 2000,
+			"RelayWindowSize":              2,
+			"RelayUseOpenClosedSlots":      false,
+			"RelayProcessingLoopSleepTime": 0,
+			"CellsPerRound":                1,
+			"DoLatencyTests":               true,
+			"RelayLatencyTargetP95":        200,
+			"ClientTrafficShapingProfile":  "none",
+		},
+		Pinned: []string{"CellsPerRound", "ClientTrafficShapingProfile"},
+	},
+	{
+		Name:        "web-browsing",
+		Description: "medium cells, a few rounds in flight, and slots opened on demand",
+		Values: map[string]interface{}{
+			"PayloadSize":             5000,
+			"CellSizeDown":            17500,
+			"RelayWindowSize":         4,
+			"RelayUseOpenClosedSlots": true,
+			"CellsPerRound":           1,
+			"RelayLatencyTargetP95":   0,
+		},
+	},
+	{
+		Name:        "bulk-transfer",
+		Description: "large super-rounds and a wide window, for throughput; without the disruption and equivocation protections",
+		Values: map[string]interface{}{
+			"PayloadSize":                   10000,
+			"CellSizeDown":                  30000,
+			"RelayWindowSize":               10,
+			"RelayUseOpenClosedSlots":       false,
+			"CellsPerRound":                 4,
+			"DisruptionProtectionEnabled":   false,
+			"EquivocationProtectionEnabled": false,
+			"DoLatencyTests":                false,
+			"RelayLatencyTargetP95":         0,
+		},
+	},
+	{
+		Name:        "measurement",
+		Description: "fixed cell sizes, static pacing and latency tests, for reproducible experiments",
+		Values: map[string]interface{}{
+			"RelayWindowSize":             1,
+			"RelayUseDummyDataDown":       true,
+			"RelayUseOpenClosedSlots":     false,
+			"CellsPerRound":               1,
+			"DoLatencyTests":              true,
+			"RelayLatencyTargetP95":       0,
+			"ClientTrafficShapingProfile": "none",
+		},
+		Pinned: []string{"RelayLatencyTargetP95", "DoLatencyTests", "ClientTrafficShapingProfile"},
+	},
+}
+
+// ParameterPresetNames returns the names of the presets, e.g. for the usage of the -preset flag
+func ParameterPresetNames() []string {
+	names := make([]string, len(PARAMETER_PRESETS))
+	for i, p := range PARAMETER_PRESETS {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// GetParameterPreset returns the preset of this name, or an error listing the valid ones
+func GetParameterPreset(name string) (*ParameterPreset, error) {
+	for i := range PARAMETER_PRESETS {
+		if PARAMETER_PRESETS[i].Name == name {
+			return &PARAMETER_PRESETS[i], nil
+		}
+	}
+	return nil, errors.New("unknown preset \"" + name + "\", valid are " + strings.Join(ParameterPresetNames(), ", "))
+}
+
+// Apply sets the values of the preset in cfg, which holds the values of the prifi.toml
+func (p *ParameterPreset) Apply(cfg *PrifiTomlConfig) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, key := range p.sortedKeys() {
+		field := v.FieldByName(key)
+		value := reflect.ValueOf(p.Values[key])
+		if !field.IsValid() || field.Type() != value.Type() {
+			return errors.New("preset " + p.Name + " : invalid value for " + key)
+		}
+		if field.Interface() != value.Interface() {
+			log.Lvl2("Preset", p.Name, ": setting", key, "to", value.Interface(), "instead of", field.Interface())
+		}
+		field.Set(value)
+	}
+	return nil
+}
+
+// Validate checks cfg after the command-line overrides : the pinned values must still be those of the preset, and
+// the values must be compatible with each other
+func (p *ParameterPreset) Validate(cfg *PrifiTomlConfig) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, key := range p.Pinned {
+		if actual := v.FieldByName(key).Interface(); actual != p.Values[key] {
+			return fmt.Errorf("preset %s requires %s = %v, it was overridden with %v", p.Name, key, p.Values[key], actual)
+		}
+	}
+	if cfg.CellsPerRound > 1 && (cfg.DisruptionProtectionEnabled || cfg.EquivocationProtectionEnabled) {
+		return errors.New("preset " + p.Name + " : CellsPerRound > 1 cannot be used with the disruption nor the equivocation protection")
+	}
+	if cfg.RelayLatencyTargetP95 > 0 && !cfg.DoLatencyTests {
+		return errors.New("preset " + p.Name + " : RelayLatencyTargetP95 requires DoLatencyTests")
+	}
+	return nil
+}
+
+func (p *ParameterPreset) sortedKeys() []string {
+	keys := make([]string, 0, len(p.Values))
+	for k := range p.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
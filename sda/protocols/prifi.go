@@ -1,7 +1,14 @@
 package protocols
 
 import (
+	"errors"
+	"time"
+
 	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 )
@@ -47,6 +54,7 @@ type PrifiTomlConfig struct {
 	RelayReportingLimit                     int
 	UseUDP                                  bool
 	DoLatencyTests                          bool
+	EncryptLatencyTests                     bool
 	SocksServerPort                         int
 	SocksClientPort                         int
 	ProtocolVersion                         string
@@ -67,6 +75,74 @@ type PrifiTomlConfig struct {
 	RelayTrusteeCacheHighBound              int
 	VerboseIngressEgressServers             bool
 	ForceDisruptionSinceRound3              bool
+	RelayTranscriptExportPath               string
+	ClientTrafficShapingProfile             string
+	RelayFlowCaptureFile                    string
+	TrusteeQuorum                           int
+	RelayMetricsAddress                     string
+	RelayEgressQueueMaxBytes                int    // 0 means the relay blocks on the SOCKS exit, as before
+	RelayEgressQueueSpillDir                string // "" means the egress queue never spills to disk
+	RelayEgressQueueSpillMaxBytes           int
+	RelayEgressQueueDropPolicy              string // "drop-newest" or "drop-oldest"
+	ClientSocksUpstreamCredits              int
+	UseUDPUplink                            bool
+	FeatureFlags                            string // comma-separated experimental features, e.g. "equivocation,-disruption"
+	ClientSocksListenAddress                string // address the client's SOCKS server binds to, e.g. "127.0.0.1"; empty means all interfaces
+	ClientSocksAuthToken                    string // if non-empty, applications must give it as SOCKS5 password to use the client's SOCKS server
+	ClientSocksFailureMode                  string // while the DC-net is down, the client's SOCKS server refuses the connections (fail-closed, default) or sends them directly (fail-open)
+	ClientSlotsPerSchedule                  int    // number of slots this client asks for in each schedule, 0 means 1
+	ClientCellCaptureFile                   string // if set, the client logs its cell-level activity (no payloads) there
+	MaxSlotsPerClient                       int    // maximum number of slots the relay grants to one client, 0 means 1
+	RelayLatencyTargetP95                   int    // if > 0, the relay adjusts its window and pacing for this p95 probe latency, in ms
+	RelayMaxWindowSize                      int    // the largest window the latency controller may use
+	RelayDrainTimeout                       int    // when draining, how long (in seconds) the relay lets the SOCKS streams finish
+	RelayRandomBeaconURL                    string // if set, each epoch folds in the latest beacon of this drand chain
+	RelayAccessLog                          string // "off", "full" (one line per SOCKS stream) or "aggregate"
+	RelayAccessLogFile                      string // the file of the relay's exit access log
+	RelayAccessLogMaxSize                   int    // the access log is rotated above this size, in MB; 0 means never
+	RelayAccessLogMaxFiles                  int    // number of rotated access logs kept
+	RelayAccessLogAggregatePeriod           int    // in the aggregate mode, how often (in seconds) a line is written
+	RelayExperimentSchedule                 string // parameters to change at given rounds, e.g. "1000:WindowSize=2;2000:WindowSize=4"
+	ClientSocksKeepaliveInterval            int    // a client stream idle for that long (in seconds) sends a keepalive; 0 means never
+	RelaySocksIdleTimeout                   int    // the relay closes the SOCKS streams idle for that long (in seconds); 0 means never
+	UDPMTU                                  int    // the MTU the UDP broadcasts are fragmented for; 0 means the MTU of the interface
+	LogLevels                               string // log levels of some modules, e.g. "scheduler=4,dcnet=1"; the others use the global level
+	RelayEpochSummaryLog                    string // if set, the relay appends the signed summary of each epoch there
+	RelayBlameEvidenceDir                   string // if set, the relay writes the signed evidence of each blame there, one file per blame
+	ClientUDPVerificationRate               int    // percentage of the UDP broadcasts the client compares with a TCP copy; 0 means none
+	ClientUDPVerificationMaxDivergences     int    // the client refuses to continue after this many divergences; 0 means it only reports them
+	CellsPerRound                           int    // number of upstream cells of PayloadSize in each round ("super-rounds"); 0 means 1
+	RelayMirrorSink                         string // with the "mirror" feature flag and build tag, the relay copies the decoded payloads there
+	TrusteeCPUBudget                        int    // percentage of a core the trustee may spend computing ciphers; 0 means no budget
+	RelayDemoAddress                        string // if non-empty, spectators get delayed aggregated statistics there
+	RelayDemoDelay                          int    // in seconds, how old the statistics shown to the spectators are
+	RelayMinAnonymitySet                    int    // the relay warns when the data of a slot comes from fewer candidate clients; 0 never warns
+	RelayGroupBandwidthCap                  int    // the relay paces the rounds to send at most this many bytes/s, across all slots; 0 means no cap
+	RelayEpochRounds                        int    // the relay shuffles fresh ephemeral keys of the clients every this many rounds; 0 means never
+	RelayEpochDuration                      int    // in seconds, the relay shuffles fresh ephemeral keys of the clients this often; 0 means never
+	RelayWarmupRounds                       int    // the first rounds of an epoch carry synthetic data, checked by the relay, before the SOCKS data; 0 means none
+	RelayMinSlotSize                        int    // with variable slot sizes, the smallest upstream cell of a slot; 0 means all cells are PayloadSize
+	DisruptionProtectionMAC                 string // the MAC ending the cells with the disruption protection : hmac-sha256 (default), blake2b or poly1305
+	RelayDecodeWorkers                      int    // if > 0, the relay XORs the ciphers of the open rounds on that many goroutines, as they arrive
+	RelayTargetRoundRate                    int    // if > 0, the relay starts at most that many rounds per second; 0 means as fast as possible
+	RelayHistoryDigestInterval              int    // if > 0, the clients report the digest of their downstream history every that many rounds; 0 means no check
+	CryptoSuite                             string // the suite of the keys, the DC-nets, the shuffles and the signatures : Ed25519 (default), P256 or Curve25519
+	RelayTransports                         string // standalone only, the transports offered to the clients for the data of the rounds, e.g. "udp=relay.example.org:7001"
+	ClientTransport                         string // standalone only, the transport of the client for the data of the rounds, if the relay offers it
+	ClientControlSocket                     string // if set, the client listens on this UNIX socket for the commands of "prifi clientctl"
+	ClientLeakDetectorApps                  string // comma-separated names of processes whose connections bypassing the SOCKS server are reported
+	ClientLeakDetectorBlock                 bool   // if true, the leak detector also blocks the leaking processes with firewall rules
+	TrusteeAuditSinkAddress                 string // standalone only, if set, the trustee also runs an audit client probing the sink there through the DC-net
+	TrusteeAuditClientID                    int    // standalone only, the client ID of the audit client of the trustee
+	TrusteeAuditKey                         string // the secret shared by the audit client and the sink, from which the probes are derived
+	TrusteeAuditInterval                    int    // in seconds, the time between two probes of the audit client
+	TrusteeAuditProbeSize                   int    // the size of the probes of the audit client, in bytes
+	PayloadTransform                        string // the transform of the payloads of the slots, e.g. "fec:data=4,parity=1"; empty means none
+	SocksCredentials                        string // the username:password pairs, comma-separated, the applications must give to the SOCKS server of the clients
+	UDPBroadcastAddress                     string // with UseUDP, the multicast group and port of the broadcasts; empty means "224.0.0.1:10101"
+	RelayUDPUplinkAddress                   string // with UseUDPUplink, where the relay receives the ciphers over UDP; empty means its SDA port + 4, on all interfaces
+	RelayListenAddress                      string // standalone only, where the relay listens for the clients and trustees; empty means the --relay address
+	ClientLatencyTestInterval               int    // in ms, the time between two latency probes of client 0; 0 means 2000
 }
 
 //PriFiSDAWrapperConfig is all the information the SDA-Protocols needs. It contains the network map of identities, our role, and the socks parameters if we are the corresponding role
@@ -76,6 +152,7 @@ type PriFiSDAWrapperConfig struct {
 	Role                  PriFiRole
 	ClientSideSocksConfig *SOCKSConfig
 	RelaySideSocksConfig  *SOCKSConfig
+	RandomBeacon          *crypto.RandomBeacon // relay only: the external randomness for this epoch, nil if none
 	udpChan               UDPChannel
 }
 
@@ -86,6 +163,9 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 	p.role = config.Role
 
 	ms := p.buildMessageSender(config.Identities)
+	if config.Role == Client && config.Toml.UseUDPUplink && ms.relay != nil {
+		ms.udpUplink = p.startUDPUplinkClient(ms.relay)
+	}
 	p.ms = ms
 
 	//sanity check
@@ -119,21 +199,39 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 			p.handleTimeout,
 			ms)
 	case Trustee:
-		p.prifiLibInstance = prifi_lib.NewPriFiTrustee(config.Toml.TrusteeNeverSlowDown,
+		trustee := prifi_lib.NewPriFiTrustee(config.Toml.TrusteeNeverSlowDown,
 			config.Toml.TrusteeAlwaysSlowDown,
 			config.Toml.TrusteeSleepTimeBetweenMessages,
+			config.Toml.TrusteeCPUBudget,
 			ms)
+		// our key of the session is endorsed by the one of our server identity, which the group file lists
+		trustee.SetTrusteeKeyEndorser(func(msg []byte) ([]byte, error) {
+			return schnorr.Sign(p.Suite(), p.Private(), msg)
+		})
+		p.prifiLibInstance = trustee
 
 	case Client:
 		doLatencyTests := config.Toml.DoLatencyTests
 		clientDataOutputEnabled := config.Toml.ClientDataOutputEnabled
-		p.prifiLibInstance = prifi_lib.NewPriFiClient(doLatencyTests,
+		client := prifi_lib.NewPriFiClient(doLatencyTests,
+			config.Toml.EncryptLatencyTests,
 			clientDataOutputEnabled,
 			config.ClientSideSocksConfig.UpstreamChannel,
 			config.ClientSideSocksConfig.DownstreamChannel,
 			config.Toml.ReplayPCAP,
 			config.Toml.PCAPFolder,
+			config.Toml.ClientTrafficShapingProfile,
+			config.Toml.ClientSlotsPerSchedule,
+			config.Toml.ClientCellCaptureFile,
+			config.Toml.ClientUDPVerificationRate,
+			config.Toml.ClientUDPVerificationMaxDivergences,
 			ms)
+		client.SetLatencyTestInterval(time.Duration(config.Toml.ClientLatencyTestInterval) * time.Millisecond)
+		p.prifiLibInstance = client
+	}
+
+	if config.Role == Relay && config.Toml.UseUDPUplink {
+		p.startUDPUplinkServer()
 	}
 
 	p.registerHandlers()
@@ -146,3 +244,65 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 func (p *PriFiSDAProtocol) SetTimeoutHandler(handler func([]string, []string)) {
 	p.toHandler = handler
 }
+
+// ProposeParameterChange asks the relay to change some parameters (see net.MIGRATABLE_PARAMETERS) during the session.
+// They are used once all clients and trustees accepted them, until the protocol restarts.
+// It can only be called if the protocol runs as the relay.
+func (p *PriFiSDAProtocol) ProposeParameterChange(params map[string]int) error {
+	if p.role != Relay || p.prifiLibInstance == nil {
+		return errors.New("only a running relay can propose a parameter change")
+	}
+	return p.prifiLibInstance.ReceivedMessage(net.REL_REL_PROPOSE_PARAMETERS{ParamsInt: params})
+}
+
+// AnnounceDrain makes the relay announce to the clients, via the downstream control cells, that it shuts down at
+// deadline. It can only be called if the protocol runs as the relay.
+func (p *PriFiSDAProtocol) AnnounceDrain(deadline time.Time) error {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	if p.role != Relay || !ok {
+		return errors.New("only a running relay can announce a drain")
+	}
+	return lib.AnnounceDrain(deadline)
+}
+
+// SetUpstreamPaused makes the client send only cover traffic (paused = true), or its data again (paused = false).
+// It can only be called if the protocol runs as a client.
+func (p *PriFiSDAProtocol) SetUpstreamPaused(paused bool) error {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	if p.role != Client || !ok {
+		return errors.New("only a running client can pause its upstream")
+	}
+	return lib.SetUpstreamPaused(paused)
+}
+
+// LeaveSession makes the client leave the session; the returned channel is closed once the relay removed it.
+// It can only be called if the protocol runs as a client.
+func (p *PriFiSDAProtocol) LeaveSession() (chan bool, error) {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	if p.role != Client || !ok {
+		return nil, errors.New("only a running client can leave the session")
+	}
+	return lib.LeaveSession()
+}
+
+// DCNetUp returns true if the protocol runs as a client which takes part in the rounds
+func (p *PriFiSDAProtocol) DCNetUp() bool {
+	lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance)
+	return p.role == Client && ok && lib.DCNetUp()
+}
+
+// SOCKSCredentials returns the username/password pairs the relay gave to the client for its SOCKS server
+func (p *PriFiSDAProtocol) SOCKSCredentials() map[string]string {
+	if lib, ok := p.prifiLibInstance.(*prifi_lib.PriFiLibInstance); ok && p.role == Client {
+		return lib.SOCKSCredentials()
+	}
+	return nil
+}
+
+// ShutdownReport returns the summary of this protocol run, or nil if the PriFi library was not started
+func (p *PriFiSDAProtocol) ShutdownReport() *prifilog.ShutdownReport {
+	if p.prifiLibInstance == nil {
+		return nil
+	}
+	return p.prifiLibInstance.ShutdownReport()
+}
@@ -48,6 +48,10 @@ type PriFiSDAProtocol struct {
 	//this is the actual "PriFi" (DC-net) protocol/library, defined in prifi-lib/prifi.go
 	prifiLibInstance prifi_lib.SpecializedLibInstance
 	HasStopped       bool //when set to true, the protocol has been stopped by PriFi-lib and should be destroyed
+
+	//only used when the clients send their upstream ciphers over UDP
+	udpUplinkServer *UDPUplinkServer
+	upstreamDedup   *upstreamDeduplicator
 }
 
 //Start is called on the Relay by the service when ChurnHandler decides so
@@ -83,6 +87,39 @@ func (p *PriFiSDAProtocol) Start() error {
 	msg.Add("RelayTrusteeCacheHighBound", p.config.Toml.RelayTrusteeCacheHighBound)
 	msg.Add("EquivocationProtectionEnabled", p.config.Toml.EquivocationProtectionEnabled)
 	msg.Add("ForceDisruptionSinceRound3", p.config.Toml.ForceDisruptionSinceRound3)
+	msg.Add("RelayTranscriptExportPath", p.config.Toml.RelayTranscriptExportPath)
+	msg.Add("RelayFlowCaptureFile", p.config.Toml.RelayFlowCaptureFile)
+	msg.Add("TrusteeQuorum", p.config.Toml.TrusteeQuorum)
+	msg.Add("RelayMetricsAddress", p.config.Toml.RelayMetricsAddress)
+	msg.Add("RelayDemoAddress", p.config.Toml.RelayDemoAddress)
+	msg.Add("RelayDemoDelay", p.config.Toml.RelayDemoDelay)
+	msg.Add("RelayMinAnonymitySet", p.config.Toml.RelayMinAnonymitySet)
+	msg.Add("RelayGroupBandwidthCap", p.config.Toml.RelayGroupBandwidthCap)
+	msg.Add("RelayEpochRounds", p.config.Toml.RelayEpochRounds)
+	msg.Add("RelayEpochDuration", p.config.Toml.RelayEpochDuration)
+	msg.Add("RelayWarmupRounds", p.config.Toml.RelayWarmupRounds)
+	msg.Add("RelayMinSlotSize", p.config.Toml.RelayMinSlotSize)
+	msg.Add("DisruptionProtectionMAC", p.config.Toml.DisruptionProtectionMAC)
+	msg.Add("RelayDecodeWorkers", p.config.Toml.RelayDecodeWorkers)
+	msg.Add("RelayTargetRoundRate", p.config.Toml.RelayTargetRoundRate)
+	msg.Add("RelayHistoryDigestInterval", p.config.Toml.RelayHistoryDigestInterval)
+	msg.Add("CryptoSuite", p.config.Toml.CryptoSuite)
+	msg.Add("RelayEgressQueueMaxBytes", p.config.Toml.RelayEgressQueueMaxBytes)
+	msg.Add("RelayEgressQueueSpillDir", p.config.Toml.RelayEgressQueueSpillDir)
+	msg.Add("RelayEgressQueueSpillMaxBytes", p.config.Toml.RelayEgressQueueSpillMaxBytes)
+	msg.Add("RelayEgressQueueDropPolicy", p.config.Toml.RelayEgressQueueDropPolicy)
+	msg.Add("FeatureFlags", p.config.Toml.FeatureFlags)
+	msg.Add("MaxSlotsPerClient", p.config.Toml.MaxSlotsPerClient)
+	msg.Add("RelayLatencyTargetP95", p.config.Toml.RelayLatencyTargetP95)
+	msg.Add("RelayMaxWindowSize", p.config.Toml.RelayMaxWindowSize)
+	msg.Add("RelayExperimentSchedule", p.config.Toml.RelayExperimentSchedule)
+	msg.Add("RelayEpochSummaryLog", p.config.Toml.RelayEpochSummaryLog)
+	msg.Add("RelayBlameEvidenceDir", p.config.Toml.RelayBlameEvidenceDir)
+	msg.Add("RelayMirrorSink", p.config.Toml.RelayMirrorSink)
+	msg.Add("CellsPerRound", p.config.Toml.CellsPerRound)
+	msg.Add("PayloadTransform", p.config.Toml.PayloadTransform)
+	msg.Add("SocksCredentials", p.config.Toml.SocksCredentials)
+	msg.Add("RelayRandomBeacon", p.config.RandomBeacon.String())
 	msg.ForceParams = true
 
 	p.SendTo(p.TreeNode(), msg)
@@ -106,38 +143,28 @@ func (p *PriFiSDAProtocol) Stop() {
 
 	p.HasStopped = true
 
+	if p.udpUplinkServer != nil {
+		p.udpUplinkServer.Close()
+		p.udpUplinkServer = nil
+	}
+	if p.ms.udpUplink != nil {
+		p.ms.udpUplink.Close()
+	}
+
 	p.Shutdown()
 	//TODO : sureley we're missing some allocated resources here...
 }
 
 /**
  * On initialization of the PriFi-SDA-Wrapper protocol, it need to register the PriFi-Lib messages to be able to marshall them.
- * If we forget some messages there, it will crash when PriFi-Lib will call SendToXXX() with this message !
+ * The list is in net.NetworkMessages(), shared with the standalone transport.
  */
 func init() {
 
 	//register the prifi_lib's message with the network lib here
-	network.RegisterMessage(net.ALL_ALL_PARAMETERS{})
-	network.RegisterMessage(net.CLI_REL_TELL_PK_AND_EPH_PK{})
-	network.RegisterMessage(net.CLI_REL_UPSTREAM_DATA{})
-	network.RegisterMessage(net.REL_CLI_DOWNSTREAM_DATA{})
-	network.RegisterMessage(net.CLI_REL_OPENCLOSED_DATA{})
-	network.RegisterMessage(net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG{})
-	network.RegisterMessage(net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE{})
-	network.RegisterMessage(net.REL_TRU_TELL_TRANSCRIPT{})
-	network.RegisterMessage(net.TRU_REL_DC_CIPHER{})
-	network.RegisterMessage(net.REL_TRU_TELL_RATE_CHANGE{})
-	network.RegisterMessage(net.TRU_REL_SHUFFLE_SIG{})
-	network.RegisterMessage(net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS{})
-	network.RegisterMessage(net.TRU_REL_TELL_PK{})
-	network.RegisterMessage(net.REL_CLI_DISRUPTED_ROUND{})
-	network.RegisterMessage(net.CLI_REL_DISRUPTION_BLAME{})
-	network.RegisterMessage(net.REL_ALL_DISRUPTION_REVEAL{})
-	network.RegisterMessage(net.CLI_REL_DISRUPTION_REVEAL{})
-	network.RegisterMessage(net.TRU_REL_DISRUPTION_REVEAL{})
-	network.RegisterMessage(net.REL_ALL_REVEAL_SHARED_SECRETS{})
-	network.RegisterMessage(net.CLI_REL_SHARED_SECRET{})
-	network.RegisterMessage(net.TRU_REL_SHARED_SECRET{})
+	for _, msg := range net.NetworkMessages() {
+		network.RegisterMessage(msg)
+	}
 
 	onet.GlobalProtocolRegister(ProtocolName, NewPriFiSDAWrapperProtocol)
 }
@@ -211,6 +238,10 @@ func (p *PriFiSDAProtocol) registerHandlers() error {
 	if err != nil {
 		return errors.New("couldn't register handler: " + err.Error())
 	}
+	err = p.RegisterHandler(p.Received_TRU_REL_SHUFFLE_REJECTED)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
 	err = p.RegisterHandler(p.Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
 	if err != nil {
 		return errors.New("couldn't register handler: " + err.Error())
@@ -243,6 +274,26 @@ func (p *PriFiSDAProtocol) registerHandlers() error {
 	if err != nil {
 		return errors.New("couldn't register handler: " + err.Error())
 	}
+	err = p.RegisterHandler(p.Received_REL_ALL_DISRUPTION_DETECTED)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_ALL_EQUIVOCATION_ALARM)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_ALL_REVEAL_REQUEST)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_REVEAL_BITS)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_TRU_REL_REVEAL_BITS)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
 	err = p.RegisterHandler(p.Received_CLI_REL_DISRUPTION_BLAME)
 	if err != nil {
 		return errors.New("couldn't register handler: " + err.Error())
@@ -271,6 +322,66 @@ func (p *PriFiSDAProtocol) registerHandlers() error {
 	if err != nil {
 		return errors.New("couldn't register handler: " + err.Error())
 	}
+	err = p.RegisterHandler(p.Received_REL_ALL_PARAMETERS_PROPOSAL)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_PARAMETERS_ACK)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_TRU_REL_PARAMETERS_ACK)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_ALL_PARAMETERS_ACTIVATE)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_DOWNSTREAM_COPY_REQUEST)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_CLI_DOWNSTREAM_COPY)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_CLI_PARAMS_DIGEST)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_TRU_REL_LOAD_REPORT)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_GOODBYE)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_CLI_GOODBYE)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_CLI_REFRESH_EPH_PKS)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_DOWNSTREAM_NACK)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_CLI_HISTORY_REQUEST)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_HISTORY_DIGEST)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_CLI_HISTORY_RESYNC)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
 
 	return nil
 }
@@ -7,8 +7,15 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"time"
 )
 
+// FAST_CHANNEL_MAX_MESSAGE_SIZE is the largest body we accept on the fast-channel; anything bigger is treated as a corrupted or malicious header
+const FAST_CHANNEL_MAX_MESSAGE_SIZE int = 10 * 1024 * 1024
+
+// FAST_CHANNEL_READ_TIMEOUT is the time given to the remote end to send the rest of a message once its header started arriving
+const FAST_CHANNEL_READ_TIMEOUT = 10 * time.Second
+
 //RealUDPChannel is the real UDP channel
 type TCPChannel struct {
 	conn           net.Conn
@@ -30,6 +37,7 @@ func (t *TCPChannel) StartListener(port int) error {
 
 	// accept exactly connection
 	conn, err := ln.Accept()
+	ln.Close()
 	if err != nil {
 		return err
 	}
@@ -39,9 +47,12 @@ func (t *TCPChannel) StartListener(port int) error {
 
 	//loop over exactly one connection
 	for !t.stop {
-		message, err := readMessage(t.conn)
+		message, err := readMessage(t.conn, FAST_CHANNEL_READ_TIMEOUT)
 		if err != nil {
-			log.Error("Could not read message on the fast-channel, err is", err)
+			log.Error("Could not read message on the fast-channel, closing it, err is", err)
+			t.ready = false
+			t.conn.Close()
+			return err
 		}
 
 		t.MessageHandler(message)
@@ -66,9 +77,12 @@ func (t *TCPChannel) ConnectToServer(addr string) error {
 
 	//loop over exactly one connection
 	for !t.stop {
-		message, err := readMessage(t.conn)
+		message, err := readMessage(t.conn, FAST_CHANNEL_READ_TIMEOUT)
 		if err != nil {
-			log.Error("Could not read message on the fast-channel, err is", err)
+			log.Error("Could not read message on the fast-channel, closing it, err is", err)
+			t.ready = false
+			t.conn.Close()
+			return err
 		}
 
 		t.MessageHandler(message)
@@ -91,8 +105,12 @@ func writeMessage(conn net.Conn, message []byte) error {
 
 	length := len(message)
 
+	if length > FAST_CHANNEL_MAX_MESSAGE_SIZE {
+		return errors.New("Message of " + strconv.Itoa(length) + " bytes exceeds the maximum of " + strconv.Itoa(FAST_CHANNEL_MAX_MESSAGE_SIZE))
+	}
+
 	//compose new message
-	buffer := make([]byte, length)
+	buffer := make([]byte, length+4)
 	binary.BigEndian.PutUint32(buffer[0:4], uint32(length))
 	copy(buffer[4:], message)
 
@@ -109,13 +127,24 @@ func writeMessage(conn net.Conn, message []byte) error {
 	return nil
 }
 
-func readMessage(conn net.Conn) ([]byte, error) {
+// readMessage reads one length-prefixed message. We can wait indefinitely for the header (the channel might be idle),
+// but once it started arriving, the header and the body must be received within timeout
+func readMessage(conn net.Conn, timeout time.Duration) ([]byte, error) {
 
 	header := make([]byte, 4)
 	emptyMessage := make([]byte, 0)
 
-	//read header
-	n, err := io.ReadFull(conn, header)
+	//wait for the first byte of the header
+	conn.SetReadDeadline(time.Time{})
+	n, err := io.ReadFull(conn, header[0:1])
+	if err != nil {
+		return emptyMessage, err
+	}
+
+	//read the rest of the header
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n2, err := io.ReadFull(conn, header[1:])
+	n += n2
 
 	if err != nil {
 		return emptyMessage, err
@@ -128,16 +157,20 @@ func readMessage(conn net.Conn) ([]byte, error) {
 	//parse header
 	bodySize := int(binary.BigEndian.Uint32(header[0:4]))
 
+	if bodySize > FAST_CHANNEL_MAX_MESSAGE_SIZE {
+		return emptyMessage, errors.New("Advertised body size " + strconv.Itoa(bodySize) + " exceeds the maximum of " + strconv.Itoa(FAST_CHANNEL_MAX_MESSAGE_SIZE))
+	}
+
 	//read body
 	body := make([]byte, bodySize)
-	n2, err2 := io.ReadFull(conn, body)
+	n3, err3 := io.ReadFull(conn, body)
 
-	if err2 != nil {
-		return emptyMessage, err2
+	if err3 != nil {
+		return emptyMessage, err3
 	}
 
-	if n2 != bodySize {
-		return emptyMessage, errors.New("Couldn't read the full" + strconv.Itoa(bodySize) + " body bytes, only read " + strconv.Itoa(n2))
+	if n3 != bodySize {
+		return emptyMessage, errors.New("Couldn't read the full" + strconv.Itoa(bodySize) + " body bytes, only read " + strconv.Itoa(n3))
 	}
 
 	return body, nil
@@ -0,0 +1,95 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFastChannelMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		writeMessage(remote, []byte("first"))
+		writeMessage(remote, []byte{})
+	}()
+	for _, expected := range [][]byte{[]byte("first"), {}} {
+		message, err := readMessage(local, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Error("Expected", expected, "got", message)
+		}
+	}
+
+	if err := writeMessage(remote, make([]byte, FAST_CHANNEL_MAX_MESSAGE_SIZE+1)); err == nil {
+		t.Error("A message above the maximum size should not be written")
+	}
+}
+
+func TestFastChannelMaxSize(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// the header advertises a body above the maximum; it is refused before reading (or allocating) the body
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(FAST_CHANNEL_MAX_MESSAGE_SIZE+1))
+	go remote.Write(header)
+	if _, err := readMessage(local, time.Second); err == nil {
+		t.Error("A body above the maximum size should be refused")
+	}
+}
+
+func TestFastChannelTruncatedHeader(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	go func() {
+		remote.Write([]byte{0, 0})
+		remote.Close()
+	}()
+	if _, err := readMessage(local, time.Second); err == nil {
+		t.Error("A header of 2 bytes should be refused")
+	}
+}
+
+func TestFastChannelReadDeadline(t *testing.T) {
+	timeout := 50 * time.Millisecond
+
+	// the remote end goes silent in the middle of the header, then of the body
+	for _, partial := range [][]byte{{0, 0}, {0, 0, 0, 10, 1, 2, 3}} {
+		local, remote := net.Pipe()
+		go remote.Write(partial)
+
+		start := time.Now()
+		_, err := readMessage(local, timeout)
+		if err == nil {
+			t.Error("A message not completed within the timeout should be refused")
+		} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Error("Expected a timeout, got", err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Error("The read should time out after", timeout, ", took", elapsed)
+		}
+		local.Close()
+		remote.Close()
+	}
+
+	// an idle channel, before any header, does not time out
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		time.Sleep(2 * timeout)
+		writeMessage(remote, []byte("late"))
+	}()
+	if message, err := readMessage(local, timeout); err != nil || string(message) != "late" {
+		t.Error("An idle channel should not time out", err)
+	}
+}
@@ -14,7 +14,6 @@ import (
 	"sync"
 	"time"
 
-	"encoding/binary"
 	"go.dedis.ch/onet/v3/log"
 )
 
@@ -24,9 +23,23 @@ const MULTICAST_ADDR string = "224.0.0.1"
 // UPD_PORT is the port used for UDP broadcast
 const UDP_PORT int = 10101
 
+// DEFAULT_UDP_BROADCAST_ADDRESS is the multicast group and port of the broadcasts, unless UDPBroadcastAddress is set
+const DEFAULT_UDP_BROADCAST_ADDRESS = MULTICAST_ADDR + ":10101"
+
 // MAX_UDP_SIZE is the max size of one broadcasted packet
 const MAX_UDP_SIZE int = 65507
 
+// UDP_LISTEN_ERROR_BACKOFF is how long a client waits after a failed read of the broadcasts; it doubles at each
+// consecutive failure, up to UDP_LISTEN_MAX_ERROR_BACKOFF
+const UDP_LISTEN_ERROR_BACKOFF = 10 * time.Millisecond
+
+// UDP_LISTEN_MAX_ERROR_BACKOFF is the longest wait between two failed reads of the broadcasts
+const UDP_LISTEN_MAX_ERROR_BACKOFF = 500 * time.Millisecond
+
+// UDP_LISTEN_MAX_CONSECUTIVE_ERRORS is the number of failed reads in a row after which a client stops listening to
+// the broadcasts (e.g., its socket is closed)
+const UDP_LISTEN_MAX_CONSECUTIVE_ERRORS = 10
+
 // FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE is the simulated loss percentage when we use a non-lossy local chanel
 const FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE = 0
 
@@ -59,9 +72,14 @@ func newLocalhostUDPChannel() UDPChannel {
 
 /**
  * The real UDP thing. IT DOES NOT WORK IN LOCAL, as network interfaces usually ignore self-sent broadcasted messages.
+ * The messages are fragmented to fit the MTU; if mtu is 0, the MTU of the interface used for the broadcast is taken.
+ * They are sent to the multicast group and port of addr, DEFAULT_UDP_BROADCAST_ADDRESS if empty.
  */
-func newRealUDPChannel() UDPChannel {
-	return &RealUDPChannel{}
+func newRealUDPChannel(mtu int, addr string) UDPChannel {
+	if addr == "" {
+		addr = DEFAULT_UDP_BROADCAST_ADDRESS
+	}
+	return &RealUDPChannel{mtu: mtu, addr: addr}
 }
 
 //LocalhostChannel is the fake, local UDP channel that uses channels
@@ -75,6 +93,11 @@ type LocalhostChannel struct {
 type RealUDPChannel struct {
 	relayConn *net.UDPConn
 	localConn *net.UDPConn
+
+	addr          string // the multicast group and port of the broadcasts
+	mtu           int    // the MTU the broadcasted datagrams fit in
+	lastMessageID uint32 // the ID of the last broadcasted message
+	reassembler   *udpReassembler
 }
 
 //Broadcast of LocalhostChannel is the implementation of broadcast for the fake localhost channel
@@ -85,7 +108,7 @@ func (lc *LocalhostChannel) Broadcast(msg MarshallableMessage) error {
 
 	if lc.lastMessage == nil {
 
-		log.Lvl4("Broadcast - setting msg # to 0")
+		netLog.Lvl4("Broadcast - setting msg # to 0")
 		lc.lastMessageID = 0
 		lc.lastMessage = make([]byte, 0)
 	}
@@ -98,7 +121,7 @@ func (lc *LocalhostChannel) Broadcast(msg MarshallableMessage) error {
 	//append message to the buffer bool
 	lc.lastMessage = data
 	lc.lastMessageID++
-	log.Lvl4("Broadcast - added message, new message has Id ", lc.lastMessageID, ".")
+	netLog.Lvl4("Broadcast - added message, new message has Id ", lc.lastMessageID, ".")
 
 	return nil
 }
@@ -118,22 +141,22 @@ func (lc *LocalhostChannel) ListenAndBlock(emptyMessage MarshallableMessage, las
 	}
 
 	if willIgnoreNextMessage {
-		log.Lvl4("ListenAndBlock : Lossy UDP (loss", FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE, "%), we will ignore message coming after", lastSeenMessage, "and wait for message after", (lastSeenMessage + 1))
+		netLog.Lvl4("ListenAndBlock : Lossy UDP (loss", FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE, "%), we will ignore message coming after", lastSeenMessage, "and wait for message after", (lastSeenMessage + 1))
 		lastSeenMessage++
 	}
 
-	log.Lvl4("ListenAndBlock - waiting on message ", (lastSeenMessage + 1), ".")
+	netLog.Lvl4("ListenAndBlock - waiting on message ", (lastSeenMessage + 1), ".")
 
 	for lc.lastMessageID == lastSeenMessage {
 		//unlock before wait !
 		lc.RUnlock()
 
-		log.Lvl5("ListenAndBlock - last message is ", (lc.lastMessageID + 1), ", waiting.")
+		netLog.Lvl5("ListenAndBlock - last message is ", (lc.lastMessageID + 1), ", waiting.")
 		time.Sleep(5 * time.Millisecond)
 		lc.RLock()
 	}
 
-	log.Lvl4("ListenAndBlock - returning message n°" + strconv.Itoa(lastSeenMessage+1) + ".")
+	netLog.Lvl4("ListenAndBlock - returning message n°" + strconv.Itoa(lastSeenMessage+1) + ".")
 	//there's one
 	lastMsg := lc.lastMessage
 
@@ -147,7 +170,7 @@ func (c *RealUDPChannel) Broadcast(msg MarshallableMessage) error {
 
 	//if we're not ready with the connnection yet
 	if c.relayConn == nil {
-		ServerAddr, err := net.ResolveUDPAddr("udp", MULTICAST_ADDR+":"+strconv.Itoa(UDP_PORT))
+		ServerAddr, err := net.ResolveUDPAddr("udp", c.addr)
 		if err != nil {
 			log.Error("Broadcast: could not resolve multicast address, error is", err.Error())
 		}
@@ -155,8 +178,14 @@ func (c *RealUDPChannel) Broadcast(msg MarshallableMessage) error {
 		c.relayConn, err = net.DialUDP("udp", nil, ServerAddr)
 		if err != nil {
 			log.Error("Broadcast: could not UDP Dial, error is", err.Error())
+			return err
 		}
 
+		if c.mtu == 0 {
+			c.mtu = detectMTU(c.relayConn.LocalAddr())
+		}
+		netLog.Lvl2("Broadcast: fragmenting the messages for an MTU of", c.mtu)
+
 		//TODO : connection is never closed
 	}
 
@@ -165,16 +194,20 @@ func (c *RealUDPChannel) Broadcast(msg MarshallableMessage) error {
 		log.Error("Broadcast: could not marshal message, error is", err.Error())
 	}
 
-	message := make([]byte, 4+len(data))
-	binary.BigEndian.PutUint32(message[0:4], uint32(len(data)))
-	copy(message[4:], data)
-
-	_, err = c.relayConn.Write(message)
+	c.lastMessageID++
+	datagrams, err := fragmentMessage(c.lastMessageID, data, c.mtu)
 	if err != nil {
-		log.Error("Broadcast: could not write message, error is", err.Error())
-	} else {
-		log.Lvl4("Broadcast: broadcasted one message of length", len(message))
+		return err
+	}
+
+	for _, datagram := range datagrams {
+		_, err = c.relayConn.Write(datagram)
+		if err != nil {
+			log.Error("Broadcast: could not write message, error is", err.Error())
+			return nil
+		}
 	}
+	netLog.Lvl4("Broadcast: broadcasted one message of length", len(data), "in", len(datagrams), "datagrams")
 
 	return nil
 }
@@ -185,40 +218,53 @@ func (c *RealUDPChannel) ListenAndBlock(emptyMessage MarshallableMessage, lastSe
 	//if we're not ready with the connection yet
 	if c.localConn == nil {
 
-		mcastAddr, err := net.ResolveUDPAddr("udp", MULTICAST_ADDR+":"+strconv.Itoa(UDP_PORT))
+		mcastAddr, err := net.ResolveUDPAddr("udp", c.addr)
 		if err != nil {
 			log.Error("ListenAndBlock(", identityListening, "): could not resolve BCast address, error is", err.Error())
+			return nil, err
 		}
 
-		c.localConn, err = net.ListenMulticastUDP("udp", nil, mcastAddr)
+		localConn, err := net.ListenMulticastUDP("udp", nil, mcastAddr)
 		if err != nil {
 			log.Error("ListenAndBlock(", identityListening, "): could not UDP Dial, error is", err.Error())
+			return nil, err
 		}
+		c.localConn = localConn
 
-		log.Lvl4("ListenAndBlock(", identityListening, "): listening on", mcastAddr)
+		netLog.Lvl4("ListenAndBlock(", identityListening, "): listening on", mcastAddr)
 		c.localConn.SetReadBuffer(MAX_UDP_SIZE)
 	}
 
+	if c.reassembler == nil {
+		c.reassembler = newUDPReassembler()
+	}
+
+	//we read fragments until one message is complete
 	buf := make([]byte, MAX_UDP_SIZE)
-	n, addr, err := c.localConn.ReadFromUDP(buf)
+	for {
+		n, addr, err := c.localConn.ReadFromUDP(buf)
 
-	log.Lvl4("ListenAndBlock(", identityListening, "): Received a UDP message of length", n, "from", addr)
-	sizeAdvertised := int(binary.BigEndian.Uint32(buf[0:4]))
+		if err != nil {
+			log.Error("ListenAndBlock(", identityListening, "): could not receive message, error is", err.Error())
+			return nil, err
+		}
 
-	if sizeAdvertised+4 != n {
-		log.Error("ListenAndBlock(", identityListening, "): could not receive read the ", string(sizeAdvertised+4), ", only", n, ", error is", err.Error())
-	}
-	message := make([]byte, sizeAdvertised)
-	copy(message[:], buf[4:sizeAdvertised+4])
+		netLog.Lvl4("ListenAndBlock(", identityListening, "): Received a UDP datagram of length", n, "from", addr)
+		message, err := c.reassembler.add(buf[:n])
+		if err != nil {
+			//anyone can send to the multicast group; a malformed datagram is dropped, and we keep listening
+			log.Error("ListenAndBlock(", identityListening, "): dropping a datagram from", addr, ", error is", err.Error())
+			continue
+		}
+		if message == nil {
+			continue
+		}
 
-	if err != nil {
-		log.Error("ListenAndBlock(", identityListening, "): could not receive message, error is", err.Error())
-	}
+		newMessage, err3 := emptyMessage.FromBytes(message)
+		if err3 != nil {
+			log.Error("ListenAndBlock(", identityListening, "): could not unmarshall message, error3 is", err3.Error())
+		}
 
-	newMessage, err3 := emptyMessage.FromBytes(message)
-	if err3 != nil {
-		log.Error("ListenAndBlock(", identityListening, "): could not unmarshall message, error3 is", err3.Error())
+		return newMessage, nil
 	}
-
-	return newMessage, nil
 }
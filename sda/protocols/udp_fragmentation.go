@@ -0,0 +1,187 @@
+package protocols
+
+/*
+ * The downstream UDP broadcasts (REL_CLI_DOWNSTREAM_DATA_UDP) are usually larger than the MTU. Instead of relying on
+ * IP fragmentation, which many networks drop, the relay cuts each message into datagrams fitting the MTU of the
+ * interface it broadcasts on, and the clients reassemble them. If one fragment is lost, the whole message is lost, as
+ * it would be with IP fragmentation; the relay's retransmission over TCP handles it.
+ *
+ * Each datagram is : message ID (4 bytes), fragment index (2 bytes), number of fragments (2 bytes), message length
+ * (4 bytes), then the data of the fragment.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// UDP_FRAGMENT_HEADER_SIZE is the size of the header of each datagram
+const UDP_FRAGMENT_HEADER_SIZE = 12
+
+// UDP_IP_HEADERS_SIZE is the size of the IPv4 and UDP headers, which count in the MTU
+const UDP_IP_HEADERS_SIZE = 28
+
+// UDP_DEFAULT_MTU is used when the MTU of the interface cannot be found
+const UDP_DEFAULT_MTU = 1500
+
+// UDP_MIN_MTU is the smallest MTU we accept; every IPv4 host handles datagrams of this size
+const UDP_MIN_MTU = 576
+
+// UDP_REASSEMBLY_MAX_PENDING is the number of incomplete messages a client keeps; older ones are dropped
+const UDP_REASSEMBLY_MAX_PENDING = 16
+
+// detectMTU returns the MTU of the interface having the IP of localAddr, or UDP_DEFAULT_MTU if there is none
+func detectMTU(localAddr net.Addr) int {
+	udpAddr, ok := localAddr.(*net.UDPAddr)
+	if !ok {
+		return UDP_DEFAULT_MTU
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		netLog.Lvl2("Could not list the network interfaces, using an MTU of", UDP_DEFAULT_MTU, ":", err)
+		return UDP_DEFAULT_MTU
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(udpAddr.IP) {
+				netLog.Lvl3("Broadcasting on", iface.Name, "with an MTU of", iface.MTU)
+				return iface.MTU
+			}
+		}
+	}
+	return UDP_DEFAULT_MTU
+}
+
+// fragmentPayloadSize is the number of bytes of a message carried by each datagram, for this MTU
+func fragmentPayloadSize(mtu int) int {
+	if mtu < UDP_MIN_MTU {
+		mtu = UDP_MIN_MTU
+	}
+	return mtu - UDP_IP_HEADERS_SIZE - UDP_FRAGMENT_HEADER_SIZE
+}
+
+// fragmentMessage cuts data into datagrams of at most mtu bytes (with the IP and UDP headers)
+func fragmentMessage(messageID uint32, data []byte, mtu int) ([][]byte, error) {
+	chunkSize := fragmentPayloadSize(mtu)
+	count := (len(data) + chunkSize - 1) / chunkSize
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xFFFF {
+		e := "message of " + strconv.Itoa(len(data)) + " bytes needs too many fragments for an MTU of " + strconv.Itoa(mtu)
+		log.Error(e)
+		return nil, errors.New(e)
+	}
+
+	datagrams := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		datagram := make([]byte, UDP_FRAGMENT_HEADER_SIZE+end-start)
+		binary.BigEndian.PutUint32(datagram[0:4], messageID)
+		binary.BigEndian.PutUint16(datagram[4:6], uint16(i))
+		binary.BigEndian.PutUint16(datagram[6:8], uint16(count))
+		binary.BigEndian.PutUint32(datagram[8:12], uint32(len(data)))
+		copy(datagram[UDP_FRAGMENT_HEADER_SIZE:], data[start:end])
+		datagrams[i] = datagram
+	}
+	return datagrams, nil
+}
+
+// partialMessage is a message of which some fragments were received
+type partialMessage struct {
+	data     []byte
+	received []bool
+	missing  int
+}
+
+// udpReassembler puts the fragments back together, on the client
+type udpReassembler struct {
+	pending       map[uint32]*partialMessage
+	order         []uint32 // the IDs of the pending messages, oldest first
+	lastDelivered uint32
+	delivered     bool
+}
+
+func newUDPReassembler() *udpReassembler {
+	return &udpReassembler{pending: make(map[uint32]*partialMessage)}
+}
+
+// add stores the fragment in datagram, and returns the whole message once all its fragments were received (nil
+// otherwise)
+func (r *udpReassembler) add(datagram []byte) ([]byte, error) {
+	if len(datagram) < UDP_FRAGMENT_HEADER_SIZE {
+		return nil, errors.New("datagram of length " + strconv.Itoa(len(datagram)) + " is too short to contain a header")
+	}
+	messageID := binary.BigEndian.Uint32(datagram[0:4])
+	index := int(binary.BigEndian.Uint16(datagram[4:6]))
+	count := int(binary.BigEndian.Uint16(datagram[6:8]))
+	length := int(binary.BigEndian.Uint32(datagram[8:12]))
+	chunk := datagram[UDP_FRAGMENT_HEADER_SIZE:]
+
+	if r.delivered && int32(messageID-r.lastDelivered) <= 0 {
+		netLog.Lvl3("Dropping a fragment of message", messageID, ", which is too old")
+		return nil, nil
+	}
+	if count == 0 || index >= count || length > count*(MAX_UDP_SIZE-UDP_FRAGMENT_HEADER_SIZE) {
+		return nil, errors.New("invalid fragment " + strconv.Itoa(index) + "/" + strconv.Itoa(count) + " of a message of " + strconv.Itoa(length) + " bytes")
+	}
+
+	msg, ok := r.pending[messageID]
+	if !ok {
+		msg = &partialMessage{data: make([]byte, length), received: make([]bool, count), missing: count}
+		r.pending[messageID] = msg
+		r.order = append(r.order, messageID)
+		if len(r.order) > UDP_REASSEMBLY_MAX_PENDING {
+			netLog.Lvl2("Dropping the incomplete message", r.order[0])
+			delete(r.pending, r.order[0])
+			r.order = r.order[1:]
+		}
+	}
+	if len(msg.data) != length || len(msg.received) != count {
+		return nil, errors.New("fragment " + strconv.Itoa(index) + " does not match the other fragments of message " + strconv.Itoa(int(messageID)))
+	}
+
+	// every fragment but the last one is full, so the last one ends the message
+	chunkSize := len(chunk)
+	offset := index * chunkSize
+	if index == count-1 {
+		offset = length - chunkSize
+	}
+	if offset < 0 || offset+chunkSize > length {
+		return nil, errors.New("fragment " + strconv.Itoa(index) + " of message " + strconv.Itoa(int(messageID)) + " is out of bounds")
+	}
+	if !msg.received[index] {
+		copy(msg.data[offset:], chunk)
+		msg.received[index] = true
+		msg.missing--
+	}
+	if msg.missing > 0 {
+		return nil, nil
+	}
+
+	// complete : the older messages still pending will not be delivered
+	for len(r.order) > 0 {
+		id := r.order[0]
+		r.order = r.order[1:]
+		delete(r.pending, id)
+		if id == messageID {
+			break
+		}
+		netLog.Lvl2("Dropping the incomplete message", id, ", message", messageID, "is complete")
+	}
+	r.lastDelivered = messageID
+	r.delivered = true
+	return msg.data, nil
+}
@@ -0,0 +1,70 @@
+package protocols
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUDPReassemblerTruncatedHeader(t *testing.T) {
+	r := newUDPReassembler()
+	datagrams, err := fragmentMessage(1, []byte("message"), UDP_DEFAULT_MTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, truncated := range [][]byte{nil, datagrams[0][:UDP_FRAGMENT_HEADER_SIZE-1]} {
+		if _, err := r.add(truncated); err == nil {
+			t.Error("A datagram of", len(truncated), "bytes is too short to contain a header")
+		}
+	}
+
+	// the truncated datagrams did not prevent the next message
+	message, err := r.add(datagrams[0])
+	if err != nil || !bytes.Equal(message, []byte("message")) {
+		t.Error("The message should be reassembled", err)
+	}
+}
+
+func TestUDPFragmentation(t *testing.T) {
+	message := make([]byte, 5000)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	datagrams, err := fragmentMessage(7, message, UDP_MIN_MTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) < 2 {
+		t.Fatal("A message of 5000 bytes should be cut in several datagrams, got", len(datagrams))
+	}
+	for _, d := range datagrams {
+		if len(d)+UDP_IP_HEADERS_SIZE > UDP_MIN_MTU {
+			t.Error("A datagram of", len(d), "bytes does not fit in the MTU")
+		}
+	}
+
+	// the fragments arrive out of order, one of them twice
+	r := newUDPReassembler()
+	order := []int{0, len(datagrams) - 1, 0}
+	for i := 1; i < len(datagrams)-1; i++ {
+		order = append(order, i)
+	}
+	for n, i := range order {
+		reassembled, err := r.add(datagrams[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < len(order)-1 && reassembled != nil {
+			t.Fatal("The message should not be complete before its last fragment")
+		}
+		if n == len(order)-1 && !bytes.Equal(reassembled, message) {
+			t.Error("The message should be reassembled")
+		}
+	}
+
+	// a fragment of a message older than the one delivered is dropped
+	old, _ := fragmentMessage(6, []byte("old"), UDP_DEFAULT_MTU)
+	if reassembled, err := r.add(old[0]); err != nil || reassembled != nil {
+		t.Error("A message older than the last one delivered should be dropped", err)
+	}
+}
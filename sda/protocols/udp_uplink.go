@@ -0,0 +1,458 @@
+package protocols
+
+/*
+ * The UDP uplink lets clients send their upstream ciphers (CLI_REL_UPSTREAM_DATA) over UDP, while every other message
+ * stays on the SDA's TCP connections. Each cipher is acknowledged by the relay; the client retransmits it a few times,
+ * in the background, then falls back to TCP. The relay accepts the ciphers from both transports, and drops the
+ * duplicates.
+ *
+ * The UDP packets, and their acks, end with an HMAC keyed from the Diffie-Hellman of the client's and the relay's
+ * server keys. The relay drops the packets which do not verify before deduplicating, so a forged packet cannot
+ * suppress the client's cipher, and a forged ack cannot stop the client from retransmitting it.
+ */
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	prifi_net "github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+)
+
+// UDP_UPLINK_PORT_OFFSET is added to the relay's SDA port to get the port of the UDP uplink, unless
+// RelayUDPUplinkAddress is set
+const UDP_UPLINK_PORT_OFFSET = 4
+
+// UDP_UPLINK_ACK_TIMEOUT is how long a client waits for an ack before retransmitting
+const UDP_UPLINK_ACK_TIMEOUT = 50 * time.Millisecond
+
+// UDP_UPLINK_MAX_TRANSMISSIONS is the number of times a cipher is sent over UDP before falling back to TCP
+const UDP_UPLINK_MAX_TRANSMISSIONS = 3
+
+// UDP_UPLINK_HEADER_SIZE is the size of the header (ClientID, RoundID) of the data packets and of the acks
+const UDP_UPLINK_HEADER_SIZE = 8
+
+// UDP_UPLINK_MAC_SIZE is the size of the HMAC ending the data packets and the acks
+const UDP_UPLINK_MAC_SIZE = sha256.Size
+
+// UDP_UPLINK_DEDUP_WINDOW is the number of past rounds for which we remember which ciphers we delivered
+const UDP_UPLINK_DEDUP_WINDOW = 1000
+
+// the first byte of the HMACs, so an ack cannot pass for a data packet
+const (
+	udpUplinkData byte = iota
+	udpUplinkAck
+)
+
+// udpUplinkKey derives the key of the HMACs between a client and the relay, from one's private key and the other's
+// public key
+func udpUplinkKey(suite network.Suite, private kyber.Scalar, public kyber.Point) ([]byte, error) {
+	shared, err := suite.Point().Mul(private, public).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(append([]byte("prifi-udp-uplink"), shared...))
+	return key[:], nil
+}
+
+// udpUplinkMAC returns the HMAC of a data packet or an ack (kind), without its HMAC
+func udpUplinkMAC(key []byte, kind byte, packet []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{kind})
+	mac.Write(packet)
+	return mac.Sum(nil)
+}
+
+// encodeUDPUplinkPacket returns the data packet of a cipher
+func encodeUDPUplinkPacket(key []byte, msg *prifi_net.CLI_REL_UPSTREAM_DATA) []byte {
+	packet := make([]byte, UDP_UPLINK_HEADER_SIZE+len(msg.Data), UDP_UPLINK_HEADER_SIZE+len(msg.Data)+UDP_UPLINK_MAC_SIZE)
+	binary.BigEndian.PutUint32(packet[0:4], uint32(msg.ClientID))
+	binary.BigEndian.PutUint32(packet[4:8], uint32(msg.RoundID))
+	copy(packet[UDP_UPLINK_HEADER_SIZE:], msg.Data)
+	return append(packet, udpUplinkMAC(key, udpUplinkData, packet)...)
+}
+
+// decodeUDPUplinkHeader returns the ClientID and RoundID of a data packet or an ack, or an error if it is too short
+func decodeUDPUplinkHeader(packet []byte) (int, int32, error) {
+	if len(packet) < UDP_UPLINK_HEADER_SIZE+UDP_UPLINK_MAC_SIZE {
+		return 0, 0, errors.New("packet of " + strconv.Itoa(len(packet)) + " bytes is too short")
+	}
+	return int(binary.BigEndian.Uint32(packet[0:4])), int32(binary.BigEndian.Uint32(packet[4:8])), nil
+}
+
+// udpUplinkKeys returns the key of the HMACs of a client, nil if the client is unknown
+type udpUplinkKeys func(clientID int) []byte
+
+// decodeUDPUplinkPacket checks the HMAC of a data packet with the key of the client it claims to come from, and
+// returns its cipher
+func decodeUDPUplinkPacket(keys udpUplinkKeys, packet []byte) (*prifi_net.CLI_REL_UPSTREAM_DATA, error) {
+	clientID, roundID, err := decodeUDPUplinkHeader(packet)
+	if err != nil {
+		return nil, err
+	}
+	key := keys(clientID)
+	if key == nil {
+		return nil, errors.New("unknown client " + strconv.Itoa(clientID))
+	}
+	body := packet[:len(packet)-UDP_UPLINK_MAC_SIZE]
+	if !hmac.Equal(packet[len(body):], udpUplinkMAC(key, udpUplinkData, body)) {
+		return nil, errors.New("wrong HMAC for client " + strconv.Itoa(clientID) + ", round " + strconv.Itoa(int(roundID)))
+	}
+	msg := &prifi_net.CLI_REL_UPSTREAM_DATA{
+		ClientID: clientID,
+		RoundID:  roundID,
+		Data:     make([]byte, len(body)-UDP_UPLINK_HEADER_SIZE),
+	}
+	copy(msg.Data, body[UDP_UPLINK_HEADER_SIZE:])
+	return msg, nil
+}
+
+// encodeUDPUplinkAck returns the ack of a data packet
+func encodeUDPUplinkAck(key []byte, packet []byte) []byte {
+	ack := make([]byte, UDP_UPLINK_HEADER_SIZE, UDP_UPLINK_HEADER_SIZE+UDP_UPLINK_MAC_SIZE)
+	copy(ack, packet[:UDP_UPLINK_HEADER_SIZE])
+	return append(ack, udpUplinkMAC(key, udpUplinkAck, ack)...)
+}
+
+// UDPUplinkClient sends upstream ciphers to the relay over UDP
+type UDPUplinkClient struct {
+	sync.Mutex
+	conn       *net.UDPConn
+	key        []byte
+	fallback   func(*prifi_net.CLI_REL_UPSTREAM_DATA) // sends a cipher over TCP
+	ackTimeout time.Duration
+	pending    map[int32]chan bool // round -> closed once acked
+	closed     bool
+}
+
+// NewUDPUplinkClient creates a client sending to the given relay address (host:port of the UDP uplink). The ciphers
+// which are not acked are given to fallback, which should send them over TCP.
+func NewUDPUplinkClient(relayAddr string, key []byte, fallback func(*prifi_net.CLI_REL_UPSTREAM_DATA)) (*UDPUplinkClient, error) {
+	addr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &UDPUplinkClient{
+		conn:       conn,
+		key:        key,
+		fallback:   fallback,
+		ackTimeout: UDP_UPLINK_ACK_TIMEOUT,
+		pending:    make(map[int32]chan bool),
+	}
+	go c.receiveAcks()
+	return c, nil
+}
+
+// Send sends the cipher once, and returns; it is retransmitted in the background until acked, up to
+// UDP_UPLINK_MAX_TRANSMISSIONS times, then given to the fallback. If Send returns an error, the cipher was not sent,
+// and the caller should use TCP.
+func (c *UDPUplinkClient) Send(msg *prifi_net.CLI_REL_UPSTREAM_DATA) error {
+	if UDP_UPLINK_HEADER_SIZE+len(msg.Data)+UDP_UPLINK_MAC_SIZE > MAX_UDP_SIZE {
+		return errors.New("Cipher of " + strconv.Itoa(len(msg.Data)) + " bytes is too large for UDP")
+	}
+
+	packet := encodeUDPUplinkPacket(c.key, msg)
+	acked := make(chan bool)
+	c.Lock()
+	c.pending[msg.RoundID] = acked
+	c.Unlock()
+
+	if _, err := c.conn.Write(packet); err != nil {
+		c.forget(msg.RoundID)
+		return err
+	}
+	go c.retransmit(msg, packet, acked)
+	return nil
+}
+
+// retransmit sends the packet again until it is acked, then gives up and falls back to TCP
+func (c *UDPUplinkClient) retransmit(msg *prifi_net.CLI_REL_UPSTREAM_DATA, packet []byte, acked chan bool) {
+	for i := 1; ; i++ {
+		select {
+		case <-acked:
+			return
+		case <-time.After(c.ackTimeout):
+		}
+		netLog.Lvl3("Client", msg.ClientID, ": no UDP ack for round", msg.RoundID, ", transmission", i)
+		if i == UDP_UPLINK_MAX_TRANSMISSIONS {
+			break
+		}
+		if _, err := c.conn.Write(packet); err != nil {
+			netLog.Lvl2("Client", msg.ClientID, ": could not retransmit round", msg.RoundID, "over UDP;", err)
+			break
+		}
+	}
+
+	c.forget(msg.RoundID)
+	netLog.Lvl2("Could not send round", msg.RoundID, "over the UDP uplink, falling back to TCP")
+	c.fallback(msg)
+}
+
+func (c *UDPUplinkClient) forget(roundID int32) {
+	c.Lock()
+	delete(c.pending, roundID)
+	c.Unlock()
+}
+
+// receiveAcks stops the retransmissions of the ciphers acked by the relay, until Close is called
+func (c *UDPUplinkClient) receiveAcks() {
+	buffer := make([]byte, UDP_UPLINK_HEADER_SIZE+UDP_UPLINK_MAC_SIZE+1)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			c.Lock()
+			closed := c.closed
+			c.Unlock()
+			if closed {
+				netLog.Lvl3("UDP uplink acks stopped:", err)
+				return
+			}
+			continue // e.g., ICMP port unreachable while the relay starts
+		}
+		ack := buffer[:n]
+		_, roundID, err := decodeUDPUplinkHeader(ack)
+		if err != nil || n != UDP_UPLINK_HEADER_SIZE+UDP_UPLINK_MAC_SIZE ||
+			!hmac.Equal(ack[UDP_UPLINK_HEADER_SIZE:], udpUplinkMAC(c.key, udpUplinkAck, ack[:UDP_UPLINK_HEADER_SIZE])) {
+			netLog.Lvl2("UDP uplink: dropping an invalid ack of", n, "bytes")
+			continue
+		}
+
+		// the late acks of retransmitted ciphers find nothing pending
+		c.Lock()
+		if acked, found := c.pending[roundID]; found {
+			close(acked)
+			delete(c.pending, roundID)
+		}
+		c.Unlock()
+	}
+}
+
+// Close closes the socket; the ciphers not acked yet fall back to TCP
+func (c *UDPUplinkClient) Close() error {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	return c.conn.Close()
+}
+
+// UDPUplinkServer receives upstream ciphers over UDP on the relay, and acks them
+type UDPUplinkServer struct {
+	conn    *net.UDPConn
+	keys    udpUplinkKeys
+	dedup   *upstreamDeduplicator
+	handler func(prifi_net.CLI_REL_UPSTREAM_DATA)
+}
+
+// upstreamDeduplicator remembers which (client, round) ciphers were delivered, whatever the transport
+type upstreamDeduplicator struct {
+	sync.Mutex
+	delivered map[int]map[int32]bool
+	order     map[int]*roundHeap // client ID -> the rounds of delivered, oldest first
+	newest    map[int]int32      // client ID -> the newest round delivered
+}
+
+func newUpstreamDeduplicator() *upstreamDeduplicator {
+	return &upstreamDeduplicator{
+		delivered: make(map[int]map[int32]bool),
+		order:     make(map[int]*roundHeap),
+		newest:    make(map[int]int32),
+	}
+}
+
+// firstTime returns true (and remembers it) if this cipher was never delivered. The rounds UDP_UPLINK_DEDUP_WINDOW
+// or more before the newest one of the client are forgotten; the relay does not handle their ciphers anymore.
+func (d *upstreamDeduplicator) firstTime(clientID int, roundID int32) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	rounds, ok := d.delivered[clientID]
+	if !ok {
+		rounds = make(map[int32]bool)
+		d.delivered[clientID] = rounds
+		d.order[clientID] = new(roundHeap)
+		d.newest[clientID] = roundID
+	}
+	if rounds[roundID] {
+		return false
+	}
+	rounds[roundID] = true
+	order := d.order[clientID]
+	heap.Push(order, roundID)
+
+	if roundID > d.newest[clientID] {
+		d.newest[clientID] = roundID
+	}
+	for order.Len() > 0 && (*order)[0] <= d.newest[clientID]-UDP_UPLINK_DEDUP_WINDOW {
+		delete(rounds, heap.Pop(order).(int32))
+	}
+	return true
+}
+
+// roundHeap is a min-heap of round IDs, for container/heap
+type roundHeap []int32
+
+func (h roundHeap) Len() int            { return len(h) }
+func (h roundHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h roundHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *roundHeap) Push(x interface{}) { *h = append(*h, x.(int32)) }
+func (h *roundHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// NewUDPUplinkServer listens on the given address, e.g. ":7006". keys gives the keys of the HMACs of the clients.
+// handler is called once per (client, round) cipher, for the ciphers received over UDP; the ciphers received over TCP
+// should go through dedup, so they are not delivered twice.
+func NewUDPUplinkServer(addr string, keys udpUplinkKeys, dedup *upstreamDeduplicator, handler func(prifi_net.CLI_REL_UPSTREAM_DATA)) (*UDPUplinkServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPUplinkServer{conn: conn, keys: keys, dedup: dedup, handler: handler}, nil
+}
+
+// ListenAndServe receives and acks the ciphers, until Close is called. The handler is called from this goroutine,
+// concurrently with the handlers of the SDA messages.
+func (s *UDPUplinkServer) ListenAndServe() {
+	buffer := make([]byte, MAX_UDP_SIZE)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			netLog.Lvl3("UDP uplink stopped:", err)
+			return
+		}
+		msg, err := decodeUDPUplinkPacket(s.keys, buffer[:n])
+		if err != nil {
+			netLog.Lvl2("UDP uplink: dropping a packet of", n, "bytes from", addr, ";", err)
+			continue
+		}
+
+		// always ack, our previous ack might have been lost
+		if _, err := s.conn.WriteToUDP(encodeUDPUplinkAck(s.keys(msg.ClientID), buffer[:n]), addr); err != nil {
+			netLog.Lvl2("UDP uplink: could not ack to", addr, err)
+		}
+
+		if s.dedup.firstTime(msg.ClientID, msg.RoundID) {
+			s.handler(*msg)
+		}
+	}
+}
+
+// Close stops ListenAndServe
+func (s *UDPUplinkServer) Close() error {
+	return s.conn.Close()
+}
+
+// UDPUplinkAddress returns the address the relay's UDP uplink listens on : uplinkAddress (RelayUDPUplinkAddress) if
+// set, else the port UDP_UPLINK_PORT_OFFSET after the relay's SDA port, on all interfaces
+func UDPUplinkAddress(uplinkAddress string, relayAddress network.Address) (string, error) {
+	if uplinkAddress != "" {
+		return uplinkAddress, nil
+	}
+	port, err := strconv.Atoi(relayAddress.Port())
+	if err != nil {
+		return "", errors.New("could not parse the relay's port in " + relayAddress.String())
+	}
+	return ":" + strconv.Itoa(port+UDP_UPLINK_PORT_OFFSET), nil
+}
+
+// startUDPUplinkClient connects to the relay's UDP uplink. On error, we log and use TCP only.
+func (p *PriFiSDAProtocol) startUDPUplinkClient(relay *onet.TreeNode) *UDPUplinkClient {
+	uplinkAddress, err := UDPUplinkAddress(p.config.Toml.RelayUDPUplinkAddress, relay.ServerIdentity.Address)
+	if err != nil {
+		log.Error("Could not find the relay's UDP uplink, not using it;", err)
+		return nil
+	}
+	_, port, err := net.SplitHostPort(uplinkAddress)
+	if err != nil {
+		log.Error("Invalid RelayUDPUplinkAddress, not using the UDP uplink;", err)
+		return nil
+	}
+	key, err := udpUplinkKey(p.Suite(), p.Private(), relay.ServerIdentity.Public)
+	if err != nil {
+		log.Error("Could not derive the key of the UDP uplink, not using it;", err)
+		return nil
+	}
+	addr := net.JoinHostPort(relay.ServerIdentity.Address.Host(), port)
+	uplink, err := NewUDPUplinkClient(addr, key, func(msg *prifi_net.CLI_REL_UPSTREAM_DATA) {
+		if err := p.SendTo(relay, msg); err != nil {
+			log.Error("Could not send round", msg.RoundID, "over TCP either;", err)
+		}
+	})
+	if err != nil {
+		log.Error("Could not open the UDP uplink to", addr, ", not using it;", err)
+		return nil
+	}
+	netLog.Lvl2("Sending the upstream ciphers over UDP to", addr)
+	return uplink
+}
+
+// startUDPUplinkServer accepts the clients' upstream ciphers over UDP, in addition to TCP. The relay's lib handles one
+// message at a time (ReceivedMessage takes its processingLock), so the ciphers received over UDP can be given to it
+// from the goroutine of the uplink.
+func (p *PriFiSDAProtocol) startUDPUplinkServer() {
+	addr, err := UDPUplinkAddress(p.config.Toml.RelayUDPUplinkAddress, p.ServerIdentity().Address)
+	if err != nil {
+		log.Error("Not starting the UDP uplink;", err)
+		return
+	}
+	dedup := newUpstreamDeduplicator()
+	server, err := NewUDPUplinkServer(addr, p.udpUplinkKeys(), dedup, func(msg prifi_net.CLI_REL_UPSTREAM_DATA) {
+		if err := p.prifiLibInstance.ReceivedMessage(msg); err != nil {
+			log.Error("Relay : could not handle an upstream cipher received over UDP;", err)
+		}
+	})
+	if err != nil {
+		log.Error("Could not start the UDP uplink, clients will use TCP;", err)
+		return
+	}
+	p.upstreamDedup = dedup
+	p.udpUplinkServer = server
+	netLog.Lvl1("Relay accepts upstream ciphers over UDP on", addr)
+	go server.ListenAndServe()
+}
+
+// udpUplinkKeys returns the keys of the HMACs of the clients of the roster. The relay sends to client i through
+// p.ms.clients[i], which is thus the key of the ciphers of client i. The keys are derived when first needed, and again
+// when the roster gives the ID to another node, so they follow the changes of the roster. They are only used from the
+// goroutine of the uplink.
+func (p *PriFiSDAProtocol) udpUplinkKeys() udpUplinkKeys {
+	keys := make(map[string][]byte) // public key of the client -> key of the HMACs
+	return func(clientID int) []byte {
+		client, found := p.ms.clients[clientID]
+		if !found {
+			return nil
+		}
+		public := client.ServerIdentity.Public.String()
+		if key, found := keys[public]; found {
+			return key
+		}
+		key, err := udpUplinkKey(p.Suite(), p.Private(), client.ServerIdentity.Public)
+		if err != nil {
+			log.Error("Could not derive the key of the UDP uplink of client", clientID, ";", err)
+			return nil
+		}
+		keys[public] = key
+		return key
+	}
+}
@@ -0,0 +1,270 @@
+package protocols
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	prifi_net "github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3/suites"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+)
+
+func TestUDPUplinkKey(t *testing.T) {
+	suite := suites.MustFind("Ed25519")
+	client, relay := suite.Scalar().Pick(suite.RandomStream()), suite.Scalar().Pick(suite.RandomStream())
+	k1, err := udpUplinkKey(suite, client, suite.Point().Mul(relay, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := udpUplinkKey(suite, relay, suite.Point().Mul(client, nil))
+	if !bytes.Equal(k1, k2) {
+		t.Error("The client and the relay should derive the same key")
+	}
+}
+
+// keysOf returns the keys of the HMACs of the clients in keys
+func keysOf(keys map[int][]byte) udpUplinkKeys {
+	return func(clientID int) []byte {
+		return keys[clientID]
+	}
+}
+
+func TestUDPUplinkPacket(t *testing.T) {
+	keys := map[int][]byte{3: bytes.Repeat([]byte{1}, 32), 4: bytes.Repeat([]byte{2}, 32)}
+	msg := &prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 3, RoundID: 70000, Data: []byte("cipher")}
+	packet := encodeUDPUplinkPacket(keys[3], msg)
+	if len(packet) != UDP_UPLINK_HEADER_SIZE+len(msg.Data)+UDP_UPLINK_MAC_SIZE {
+		t.Error("Wrong packet size", len(packet))
+	}
+
+	decoded, err := decodeUDPUplinkPacket(keysOf(keys), packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ClientID != 3 || decoded.RoundID != 70000 || !bytes.Equal(decoded.Data, msg.Data) {
+		t.Error("Wrong decoded cipher", decoded)
+	}
+	empty := encodeUDPUplinkPacket(keys[3], &prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 3, RoundID: 1})
+	if decoded, err := decodeUDPUplinkPacket(keysOf(keys), empty); err != nil || len(decoded.Data) != 0 {
+		t.Error("An empty cipher should be accepted", err)
+	}
+
+	// short, tampered, unknown or forged packets are rejected
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), packet[:UDP_UPLINK_HEADER_SIZE+UDP_UPLINK_MAC_SIZE-1]); err == nil {
+		t.Error("A packet shorter than the header and the HMAC should be rejected")
+	}
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), nil); err == nil {
+		t.Error("An empty packet should be rejected")
+	}
+	tampered := append([]byte{}, packet...)
+	tampered[UDP_UPLINK_HEADER_SIZE] ^= 1
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), tampered); err == nil {
+		t.Error("A tampered cipher should be rejected")
+	}
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), packet[:len(packet)-1]); err == nil {
+		t.Error("A truncated packet should be rejected")
+	}
+	spoofed := encodeUDPUplinkPacket(keys[4], msg) // client 4 claims to be client 3
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), spoofed); err == nil {
+		t.Error("A cipher with the key of another client should be rejected")
+	}
+	unknown := encodeUDPUplinkPacket(keys[3], &prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 5, RoundID: 1})
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), unknown); err == nil {
+		t.Error("A cipher from an unknown client should be rejected")
+	}
+
+	// an ack is not a valid data packet
+	ack := encodeUDPUplinkAck(keys[3], packet)
+	if _, err := decodeUDPUplinkPacket(keysOf(keys), ack); err == nil {
+		t.Error("An ack should not pass for a data packet")
+	}
+}
+
+func TestUpstreamDeduplicator(t *testing.T) {
+	dedup := newUpstreamDeduplicator()
+	if !dedup.firstTime(0, 1) || dedup.firstTime(0, 1) {
+		t.Error("The second copy of a cipher should be dropped")
+	}
+	if !dedup.firstTime(1, 1) {
+		t.Error("The ciphers of two clients are not duplicates")
+	}
+
+	// rounds skipped and out of order : all the rounds before the window are forgotten
+	for r := int32(0); r < 20*UDP_UPLINK_DEDUP_WINDOW; r += 7 {
+		dedup.firstTime(2, r)
+		dedup.firstTime(2, r-3)
+	}
+	newest := dedup.newest[2]
+	if len(dedup.delivered[2]) > UDP_UPLINK_DEDUP_WINDOW+1 {
+		t.Error("The deduplicator should remember at most", UDP_UPLINK_DEDUP_WINDOW, "rounds, remembers", len(dedup.delivered[2]))
+	}
+	for r := range dedup.delivered[2] {
+		if r <= newest-UDP_UPLINK_DEDUP_WINDOW {
+			t.Error("Round", r, "is out of the window, it should be forgotten")
+		}
+	}
+	if dedup.firstTime(2, newest) {
+		t.Error("The newest round should be remembered")
+	}
+}
+
+func TestUpstreamDataOverTCPFromAnotherClient(t *testing.T) {
+	suite := suites.MustFind("Ed25519")
+	node := func(address string) *onet.TreeNode {
+		si := network.NewServerIdentity(suite.Point().Pick(suite.RandomStream()), network.NewAddress(network.PlainTCP, address))
+		return onet.NewTreeNode(0, si)
+	}
+	client0, client1 := node("127.0.0.1:2000"), node("127.0.0.1:2001")
+	p := &PriFiSDAProtocol{upstreamDedup: newUpstreamDeduplicator()}
+	p.ms.clients = map[int]*onet.TreeNode{0: client0, 1: client1}
+
+	// client 1 claims the cipher of client 0 : it is dropped, and does not suppress the genuine one
+	msg := Struct_CLI_REL_UPSTREAM_DATA{client1, prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 1}}
+	if err := p.Received_CLI_REL_UPSTREAM_DATA(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.ClientID = 2
+	if err := p.Received_CLI_REL_UPSTREAM_DATA(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !p.upstreamDedup.firstTime(0, 1) {
+		t.Error("The cipher of client 0 should still be delivered")
+	}
+}
+
+// udpUplinkTestServer starts a relay's uplink on localhost, which hands the ciphers to received
+func udpUplinkTestServer(t *testing.T, keys map[int][]byte, dedup *upstreamDeduplicator) (*UDPUplinkServer, chan prifi_net.CLI_REL_UPSTREAM_DATA) {
+	received := make(chan prifi_net.CLI_REL_UPSTREAM_DATA, 10)
+	server, err := NewUDPUplinkServer("127.0.0.1:0", keysOf(keys), dedup, func(msg prifi_net.CLI_REL_UPSTREAM_DATA) {
+		received <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	return server, received
+}
+
+func TestUDPUplinkDedupWithTCP(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	dedup := newUpstreamDeduplicator()
+	server, received := udpUplinkTestServer(t, map[int][]byte{0: key}, dedup)
+	defer server.Close()
+
+	// a forged cipher for round 1 does not suppress the client's copy over TCP
+	forger, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forger.Close()
+	forged := encodeUDPUplinkPacket(bytes.Repeat([]byte{9}, 32), &prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 1, Data: []byte("forged")})
+	forger.Write(forged)
+	forger.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := forger.Read(make([]byte, 100)); err == nil {
+		t.Error("A forged cipher should not be acked")
+	}
+	if !dedup.firstTime(0, 1) {
+		t.Error("The copy over TCP should be delivered after a forged copy over UDP")
+	}
+
+	// the genuine copy over UDP suppresses the copy over TCP
+	client, err := NewUDPUplinkClient(server.conn.LocalAddr().String(), key, func(msg *prifi_net.CLI_REL_UPSTREAM_DATA) {
+		t.Error("Round", msg.RoundID, "should not fall back to TCP")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Send(&prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 2, Data: []byte("cipher")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg.RoundID != 2 || !bytes.Equal(msg.Data, []byte("cipher")) {
+			t.Error("Wrong cipher received", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The cipher should be received over UDP")
+	}
+	if dedup.firstTime(0, 2) {
+		t.Error("The copy over TCP should be dropped after the copy over UDP")
+	}
+
+	// the ack stops the retransmissions
+	for deadline := time.Now().Add(time.Second); udpUplinkPending(client) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The cipher should be acked")
+		}
+	}
+}
+
+func udpUplinkPending(c *UDPUplinkClient) int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.pending)
+}
+
+func TestUDPUplinkFallback(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	// the relay forges its acks
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	transmissions := make(chan []byte, 10)
+	go func() {
+		buffer := make([]byte, MAX_UDP_SIZE)
+		for {
+			n, addr, err := relay.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			transmissions <- append([]byte{}, buffer[:n]...)
+			relay.WriteToUDP(encodeUDPUplinkAck(bytes.Repeat([]byte{9}, 32), buffer[:n]), addr)
+		}
+	}()
+
+	fallback := make(chan *prifi_net.CLI_REL_UPSTREAM_DATA, 1)
+	client, err := NewUDPUplinkClient(relay.LocalAddr().String(), key, func(msg *prifi_net.CLI_REL_UPSTREAM_DATA) {
+		fallback <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.ackTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	msg := &prifi_net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 7, Data: []byte("cipher")}
+	if err := client.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) >= client.ackTimeout {
+		t.Error("Send should not wait for the ack")
+	}
+
+	select {
+	case m := <-fallback:
+		if m != msg {
+			t.Error("The cipher of round 7 should fall back to TCP")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The cipher should fall back to TCP")
+	}
+	if len(transmissions) != UDP_UPLINK_MAX_TRANSMISSIONS {
+		t.Error("The cipher should be sent", UDP_UPLINK_MAX_TRANSMISSIONS, "times over UDP, sent", len(transmissions))
+	}
+	if udpUplinkPending(client) != 0 {
+		t.Error("The cipher should not be pending anymore")
+	}
+
+	// a cipher too large for UDP is not sent
+	if err := client.Send(&prifi_net.CLI_REL_UPSTREAM_DATA{RoundID: 8, Data: make([]byte, MAX_UDP_SIZE)}); err == nil {
+		t.Error("A cipher too large for UDP should be refused")
+	}
+}
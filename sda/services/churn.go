@@ -20,6 +20,10 @@ import (
  * he adds it to the list of nodes
  * if PriFi was running, he kills it, and rerun it if > threshold
  *
+ * When a client leaves the session :
+ * the relay already removed it from the running protocol, at a round boundary
+ * he removes it from the list of nodes, without restarting the protocol of the others
+ *
  * When a node disconnect :
  * He sends STOP messages to every other node
  * He kills his local instance of PriFi protocol
@@ -28,6 +32,12 @@ import (
  * Every X seconds :
  * if the protocol is not running
  * count the number of participants, if > threshold, start prifi
+ *
+ * When the operator changes the trustees (group.toml reloaded) :
+ * the changes are queued, and applied at the next epoch boundary (i.e., the next time the protocol starts)
+ * a removed trustee is dropped from the list of nodes, and the epoch restarts without it
+ * an added trustee is welcomed with a HELLO, and the epoch restarts when it connects
+ * the clients learn the new trustees' keys with the parameters of the new epoch, and re-derive their shared secrets
  */
 
 type waitQueueEntry struct {
@@ -59,6 +69,20 @@ type churnHandler struct {
 	nextFreeTrusteeID int
 	relayIdentity     *network.ServerIdentity //necessary to call createRoster
 	trusteesIDs       []*network.ServerIdentity
+	trusteeQuorum     int //minimum number of trustees needed to start an epoch
+	configuredQuorum  int //the quorum asked for, before capping it to the number of trustees
+
+	//changes of the trustee set, applied at the next epoch boundary
+	trusteesToAdd    []*network.ServerIdentity
+	trusteesToRemove []*network.ServerIdentity
+	removedTrustees  map[string]bool //their connection requests are refused
+
+	//when draining, only the clients admitted before the drain can (re-)connect
+	draining      bool
+	drainAdmitted map[string]bool
+
+	//closed (and replaced) each time a node joins or leaves the wait queue
+	participantsChanged chan bool
 
 	//to be specified when instantiated
 	startProtocol     func()
@@ -83,6 +107,24 @@ func (c *churnHandler) init(relayID *network.ServerIdentity, trusteesIDs []*netw
 	c.nextFreeTrusteeID = 0
 	c.relayIdentity = relayID
 	c.trusteesIDs = trusteesIDs
+	c.participantsChanged = make(chan bool)
+}
+
+/**
+ * Returns a channel which is closed the next time a node joins or leaves the wait queue
+ */
+func (c *churnHandler) participantsChangedChan() <-chan bool {
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+	return c.participantsChanged
+}
+
+/**
+ * Wakes up the goroutines waiting on participantsChangedChan(). The lock must be held
+ */
+func (c *churnHandler) notifyParticipantsChanged() {
+	close(c.participantsChanged)
+	c.participantsChanged = make(chan bool)
 }
 
 /**
@@ -128,13 +170,13 @@ func (c *churnHandler) createRoster() *onet.Roster {
 	return roster
 }
 
-// CountParticipants returns nTrustees, nClients already connected
+// CountParticipants returns nClients, nTrustees already connected
 func (c *churnHandler) CountParticipants() (int, int) {
 	return c.waitQueue.count()
 }
 
 /**
- * Tests if the given serverIdentity represents a trustee
+ * Tests if the given serverIdentity represents a trustee (including the trustees added at the next epoch boundary)
  */
 func (c *churnHandler) isATrustee(ID *network.ServerIdentity) bool {
 	for _, v := range c.trusteesIDs {
@@ -142,6 +184,11 @@ func (c *churnHandler) isATrustee(ID *network.ServerIdentity) bool {
 			return true
 		}
 	}
+	for _, v := range c.trusteesToAdd {
+		if v.Equal(ID) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -190,6 +237,19 @@ func (c *churnHandler) getClientsIdentities() []*network.ServerIdentity {
 	return clients
 }
 
+/**
+ * Returns all the trustees, connected or not (including the trustees added at the next epoch boundary)
+ */
+func (c *churnHandler) getTrustees() []*network.ServerIdentity {
+
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+
+	trustees := make([]*network.ServerIdentity, 0, len(c.trusteesIDs)+len(c.trusteesToAdd))
+	trustees = append(trustees, c.trusteesIDs...)
+	return append(trustees, c.trusteesToAdd...)
+}
+
 func (c *churnHandler) getTrusteesIdentities() []*network.ServerIdentity {
 	nTrustees := len(c.waitQueue.trustees)
 	trustees := make([]*network.ServerIdentity, nTrustees)
@@ -220,6 +280,14 @@ func (c *churnHandler) handleConnection(msg *network.Envelope) {
 		log.Lvl4("Ignored new connection request from", node, ID, "already in the list")
 		return
 	}
+	if c.removedTrustees[ID] {
+		log.Lvl2("Refused connection request from", ID, ", it was removed from the trustees")
+		return
+	}
+	if c.draining && !isTrustee && !c.drainAdmitted[ID] {
+		log.Lvl2("Refused connection request from", node, ID, ", the relay is draining")
+		return
+	}
 
 	log.Lvl2("Received new connection request from", node, ID)
 
@@ -240,10 +308,27 @@ func (c *churnHandler) handleConnection(msg *network.Envelope) {
 		log.Lvl3("ID ", ID, " assigned to client #", c.nextFreeClientID)
 		c.nextFreeClientID++
 	}
+	c.notifyParticipantsChanged()
 
 	c.tryStartProtocol()
 }
 
+/**
+ * Stops admitting new clients; the clients currently admitted can still reconnect (e.g., after a restart of the
+ * protocol) until the shutdown
+ */
+func (c *churnHandler) startDraining() {
+
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+
+	c.draining = true
+	c.drainAdmitted = make(map[string]bool)
+	for ID := range c.waitQueue.clients {
+		c.drainAdmitted[ID] = true
+	}
+}
+
 func (c *churnHandler) handleUnknownDisconnection() {
 
 	c.waitQueue.writeMutex.Lock()
@@ -253,11 +338,33 @@ func (c *churnHandler) handleUnknownDisconnection() {
 	c.waitQueue.trustees = make(map[string]*waitQueueEntry)
 	c.nextFreeClientID = 0
 	c.nextFreeTrusteeID = 0
+	c.notifyParticipantsChanged()
 
 	c.stopProtocol()
 	c.tryStartProtocol()
 }
 
+/**
+ * Handles a "ClientLeft" message. The client is forgotten, but the protocol is not restarted : the relay removed it
+ * from the session when it said goodbye. Its ID is not reused, the next clients get theirs from the tree anyway
+ */
+func (c *churnHandler) handleClientLeft(msg *network.Envelope) {
+
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+
+	ID := idFromMsg(msg)
+	if c.isATrustee(msg.ServerIdentity) || !c.waitQueue.contains(ID, false) {
+		log.Lvl2("Ignored ClientLeft message from", ID, ", not a client in the list")
+		return
+	}
+
+	log.Lvl2("Client", ID, "left the session")
+	delete(c.waitQueue.clients, ID)
+	delete(c.drainAdmitted, ID)
+	c.notifyParticipantsChanged()
+}
+
 /**
  * Handles a "Disconnection" message
  */
@@ -296,12 +403,133 @@ func (c *churnHandler) handleDisconnection(msg *network.Envelope) {
 }
 
 /**
- * restarts the protocol (stop + start) if nClients waiting & nTrustees waiting both > 1
+ * Sets the number of trustees needed to start an epoch. The trustees that are not connected
+ * are left out of the epoch (and their pads omitted), so the quorum is the trust/availability trade-off
+ */
+func (c *churnHandler) setTrusteeQuorum(quorum int) {
+	c.configuredQuorum = quorum
+	if quorum > len(c.trusteesIDs) {
+		log.Error("Trustee quorum", quorum, "is larger than the number of trustees", len(c.trusteesIDs), ", requiring all trustees.")
+		quorum = len(c.trusteesIDs)
+	}
+	c.trusteeQuorum = quorum
+}
+
+/**
+ * Returns the number of trustees needed to start an epoch (at least 1)
+ */
+func (c *churnHandler) minTrustees() int {
+	if c.trusteeQuorum < 1 {
+		return 1
+	}
+	return c.trusteeQuorum
+}
+
+/**
+ * Compares the trustees with the new list, and queues the differences for the next epoch boundary.
+ * Returns the trustees which will be added, and removed
+ */
+func (c *churnHandler) updateTrustees(newTrusteesIDs []*network.ServerIdentity) ([]*network.ServerIdentity, []*network.ServerIdentity) {
+
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+
+	c.trusteesToAdd = make([]*network.ServerIdentity, 0)
+	c.trusteesToRemove = make([]*network.ServerIdentity, 0)
+	for _, si := range newTrusteesIDs {
+		if !c.isATrustee(si) {
+			c.trusteesToAdd = append(c.trusteesToAdd, si)
+		}
+	}
+	for _, si := range c.trusteesIDs {
+		found := false
+		for _, newSi := range newTrusteesIDs {
+			if newSi.Equal(si) {
+				found = true
+			}
+		}
+		if !found {
+			c.trusteesToRemove = append(c.trusteesToRemove, si)
+		}
+	}
+
+	return c.trusteesToAdd, c.trusteesToRemove
+}
+
+/**
+ * Applies the queued changes of the trustee set. The remaining trustees are renumbered, since PriFi-lib expects
+ * the trustees IDs to be 0..nTrustees-1. Returns true if the trustee set changed
+ */
+func (c *churnHandler) applyTrusteeChanges() bool {
+	if len(c.trusteesToAdd) == 0 && len(c.trusteesToRemove) == 0 {
+		return false
+	}
+	if len(c.trusteesIDs)+len(c.trusteesToAdd)-len(c.trusteesToRemove) < 1 {
+		log.Error("Refusing to remove all trustees, keeping the trustee set unchanged.")
+		c.trusteesToAdd = nil
+		c.trusteesToRemove = nil
+		return false
+	}
+
+	if c.removedTrustees == nil {
+		c.removedTrustees = make(map[string]bool)
+	}
+	for _, si := range c.trusteesToRemove {
+		ID := idFromServerIdentity(si)
+		c.removedTrustees[ID] = true
+		delete(c.waitQueue.trustees, ID)
+	}
+	//a new slice, the old one might be shared with the caller of init()
+	trusteesIDs := make([]*network.ServerIdentity, 0, len(c.trusteesIDs)+len(c.trusteesToAdd))
+	for _, si := range c.trusteesIDs {
+		if !c.removedTrustees[idFromServerIdentity(si)] {
+			trusteesIDs = append(trusteesIDs, si)
+		}
+	}
+	for _, si := range c.trusteesToAdd {
+		delete(c.removedTrustees, idFromServerIdentity(si))
+		trusteesIDs = append(trusteesIDs, si)
+	}
+	c.trusteesIDs = trusteesIDs
+	log.Lvl1("Trustee set changed at the epoch boundary:", len(c.trusteesToAdd), "added,", len(c.trusteesToRemove), "removed, now", len(c.trusteesIDs), "trustees")
+	c.trusteesToAdd = nil
+	c.trusteesToRemove = nil
+
+	c.nextFreeTrusteeID = 0
+	for _, v := range c.waitQueue.trustees {
+		v.numericID = c.nextFreeTrusteeID
+		c.nextFreeTrusteeID++
+	}
+	c.setTrusteeQuorum(c.configuredQuorum)
+	return true
+}
+
+/**
+ * Ends the current epoch if the trustee set changed, and starts a new one with the new trustees if possible
+ */
+func (c *churnHandler) startEpochWithNewTrustees() {
+
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+
+	if c.applyTrusteeChanges() {
+		if c.isProtocolRunning() {
+			c.stopProtocol()
+		}
+		c.tryStartProtocol()
+	}
+}
+
+/**
+ * restarts the protocol (stop + start) if nClients waiting >= 1 & nTrustees waiting >= quorum
  */
 func (c *churnHandler) tryStartProtocol() {
+	//this is an epoch boundary
+	c.applyTrusteeChanges()
+
 	nClients, nTrustees := c.waitQueue.count()
 
-	if nClients >= 1 && nTrustees >= 1 {
+	if nClients >= 1 && nTrustees >= c.minTrustees() {
 		if c.isProtocolRunning() {
 			c.stopProtocol()
 		}
@@ -311,6 +539,6 @@ func (c *churnHandler) tryStartProtocol() {
 		}
 		c.startProtocol()
 	} else {
-		log.Lvl1("Too few participants (", nClients, "clients and", nTrustees, "trustees), waiting...")
+		log.Lvl1("Too few participants (", nClients, "clients and", nTrustees, "trustees, quorum", c.minTrustees(), "), waiting...")
 	}
 }
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/sda/protocols"
 	"go.dedis.ch/onet/v3"
@@ -8,6 +9,7 @@ import (
 	"go.dedis.ch/onet/v3/network"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func genSI(addrPort string) *network.ServerIdentity {
@@ -633,3 +635,252 @@ func TestChurn(t *testing.T) {
 		t.Error("Protocol should have restarted")
 	}
 }
+
+func TestChurnTrusteeQuorum(t *testing.T) {
+
+	relayID := genSI("127.0.0.0:1")
+	trustees := make([]*network.ServerIdentity, 3)
+	for i := 0; i < len(trustees); i++ {
+		trustees[i] = genSI("0.127.0.0:" + strconv.Itoa(i))
+	}
+	client := genSI("0.0.127.0:0")
+
+	c := new(churnHandler)
+	c.init(relayID, trustees)
+	c.stopProtocol = stopProtocol
+	c.startProtocol = startProtocol
+	c.isProtocolRunning = func() bool { return false }
+
+	if c.minTrustees() != 1 {
+		t.Error("Without quorum, one trustee should be enough, minTrustees is", c.minTrustees())
+	}
+	c.setTrusteeQuorum(5)
+	if c.minTrustees() != 3 {
+		t.Error("A quorum larger than the number of trustees should require all of them, minTrustees is", c.minTrustees())
+	}
+	c.setTrusteeQuorum(2)
+
+	// one trustee is down : the protocol should not start
+	startProtocolCalled = false
+	c.handleConnection(genPacketFromSource(client))
+	c.handleConnection(genPacketFromSource(trustees[0]))
+	if startProtocolCalled {
+		t.Error("Protocol should not start with 1 trustee when the quorum is 2")
+	}
+
+	// the quorum is reached, the epoch starts without the third trustee
+	c.handleConnection(genPacketFromSource(trustees[1]))
+	if !startProtocolCalled {
+		t.Error("Protocol should start when the quorum of trustees is reached")
+	}
+	roster := c.createRoster()
+	if testIfInRoster(roster, trustees[2]) {
+		t.Error("The absent trustee should not be in the roster")
+	}
+}
+
+func TestChurnDraining(t *testing.T) {
+
+	relayID := genSI("127.0.0.0:1")
+	trustees := []*network.ServerIdentity{genSI("0.127.0.0:0")}
+	clients := make([]*network.ServerIdentity, 2)
+	for i := 0; i < len(clients); i++ {
+		clients[i] = genSI("0.0.127.0:" + strconv.Itoa(i))
+	}
+
+	c := new(churnHandler)
+	c.init(relayID, trustees)
+	c.stopProtocol = stopProtocol
+	c.startProtocol = startProtocol
+	c.isProtocolRunning = func() bool { return false }
+
+	c.handleConnection(genPacketFromSource(clients[0]))
+	c.startDraining()
+
+	// a new client is refused
+	c.handleConnection(genPacketFromSource(clients[1]))
+	nClients, _ := c.waitQueue.count()
+	if nClients != 1 {
+		t.Error("A draining relay should not admit new clients, nClients is", nClients)
+	}
+
+	// trustees are still admitted
+	c.handleConnection(genPacketFromSource(trustees[0]))
+	_, nTrustees := c.waitQueue.count()
+	if nTrustees != 1 {
+		t.Error("A draining relay should still admit trustees, nTrustees is", nTrustees)
+	}
+
+	// a client admitted before the drain can reconnect
+	c.handleDisconnection(genPacketFromSource(clients[0]))
+	c.handleConnection(genPacketFromSource(clients[0]))
+	nClients, _ = c.waitQueue.count()
+	if nClients != 1 {
+		t.Error("A draining relay should re-admit a known client, nClients is", nClients)
+	}
+}
+
+func TestChurnTrusteeResize(t *testing.T) {
+
+	relayID := genSI("127.0.0.0:1")
+	trustees := make([]*network.ServerIdentity, 3)
+	for i := 0; i < len(trustees); i++ {
+		trustees[i] = genSI("0.127.0.0:" + strconv.Itoa(i))
+	}
+	client := genSI("0.0.127.0:0")
+
+	running := false
+	c := new(churnHandler)
+	c.init(relayID, trustees[0:2])
+	c.stopProtocol = func() { running = false }
+	c.startProtocol = func() { running = true }
+	c.isProtocolRunning = func() bool { return running }
+	c.setTrusteeQuorum(2)
+
+	c.handleConnection(genPacketFromSource(client))
+	c.handleConnection(genPacketFromSource(trustees[0]))
+	c.handleConnection(genPacketFromSource(trustees[1]))
+	if !running {
+		t.Error("Protocol should start with 2 trustees")
+	}
+
+	// grow : trustee 2 is added; it is a trustee (not a client) as soon as the change is queued
+	added, removed := c.updateTrustees(trustees)
+	if len(added) != 1 || !added[0].Equal(trustees[2]) || len(removed) != 0 {
+		t.Error("Should add trustee 2 and remove none, added", added, "removed", removed)
+	}
+	if !c.isATrustee(trustees[2]) {
+		t.Error("An added trustee should be recognized as a trustee")
+	}
+	c.handleConnection(genPacketFromSource(trustees[2]))
+	_, nTrustees := c.waitQueue.count()
+	if nTrustees != 3 || len(c.trusteesIDs) != 3 || c.minTrustees() != 2 {
+		t.Error("Should have 3 trustees with a quorum of 2, has", nTrustees, len(c.trusteesIDs), c.minTrustees())
+	}
+
+	// shrink : trustee 0 is removed, the epoch restarts without it
+	added, removed = c.updateTrustees(trustees[1:3])
+	if len(added) != 0 || len(removed) != 1 || !removed[0].Equal(trustees[0]) {
+		t.Error("Should remove trustee 0 and add none, added", added, "removed", removed)
+	}
+	c.startEpochWithNewTrustees()
+	if !running {
+		t.Error("Protocol should restart with the 2 remaining trustees")
+	}
+	if testIfInRoster(c.createRoster(), trustees[0]) {
+		t.Error("The removed trustee should not be in the roster")
+	}
+	ids := make(map[int]bool)
+	for _, v := range c.waitQueue.trustees {
+		ids[v.numericID] = true
+	}
+	if len(ids) != 2 || !ids[0] || !ids[1] {
+		t.Error("The remaining trustees should be renumbered 0 and 1, are", ids)
+	}
+
+	// the removed trustee is refused, and not taken for a client
+	c.handleConnection(genPacketFromSource(trustees[0]))
+	nClients, nTrustees := c.waitQueue.count()
+	if nClients != 1 || nTrustees != 2 {
+		t.Error("A removed trustee should be refused, have", nClients, "clients and", nTrustees, "trustees")
+	}
+
+	// removing all the trustees is refused
+	c.updateTrustees(make([]*network.ServerIdentity, 0))
+	c.startEpochWithNewTrustees()
+	if len(c.trusteesIDs) != 2 {
+		t.Error("Should keep the trustees rather than removing all of them, has", len(c.trusteesIDs))
+	}
+}
+
+func TestChurnWaitForParticipants(t *testing.T) {
+
+	relayID := genSI("127.0.0.0:1")
+	trustee := genSI("0.127.0.0:0")
+	client := genSI("0.0.127.0:0")
+
+	c := new(churnHandler)
+	c.init(relayID, []*network.ServerIdentity{trustee})
+	c.stopProtocol = stopProtocol
+	c.startProtocol = nil
+	c.isProtocolRunning = func() bool { return false }
+	s := &ServiceState{churnHandler: c}
+
+	// the wait gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForEnoughParticipants(ctx); err != context.DeadlineExceeded {
+		t.Error("The wait should have timed out, but returned", err)
+	}
+
+	// the changes wake the waiting goroutines up
+	changed := c.participantsChangedChan()
+	c.handleConnection(genPacketFromSource(trustee))
+	select {
+	case <-changed:
+	default:
+		t.Error("A connection should be notified")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WaitForEnoughParticipants(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("There is no client yet")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.handleConnection(genPacketFromSource(client))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The wait should end when the client connects")
+	}
+
+	changed = c.participantsChangedChan()
+	c.handleDisconnection(genPacketFromSource(client))
+	select {
+	case <-changed:
+	default:
+		t.Error("A disconnection should be notified")
+	}
+}
+
+func TestChurnClientLeft(t *testing.T) {
+
+	relayID := genSI("127.0.0.0:1")
+	trustees := []*network.ServerIdentity{genSI("0.127.0.0:0")}
+	clients := []*network.ServerIdentity{genSI("0.0.127.0:0"), genSI("0.0.127.0:1")}
+
+	c := new(churnHandler)
+	c.init(relayID, trustees)
+	starts, stops := 0, 0
+	c.startProtocol = func() { starts++ }
+	c.stopProtocol = func() { stops++ }
+	c.isProtocolRunning = func() bool { return starts > stops }
+
+	c.handleConnection(genPacketFromSource(trustees[0]))
+	c.handleConnection(genPacketFromSource(clients[0]))
+	c.handleConnection(genPacketFromSource(clients[1]))
+	starts, stops = 1, 0
+
+	// the client is forgotten, the protocol of the other one goes on
+	c.handleClientLeft(genPacketFromSource(clients[0]))
+	nClients, nTrustees := c.waitQueue.count()
+	if nClients != 1 || nTrustees != 1 || c.waitQueue.contains(idFromServerIdentity(clients[0]), false) {
+		t.Error("The client which left should be removed, and only it;", nClients, "clients and", nTrustees, "trustees")
+	}
+	if stops != 0 || starts != 1 {
+		t.Error("A client leaving should not restart the protocol")
+	}
+
+	// a trustee cannot leave this way
+	c.handleClientLeft(genPacketFromSource(trustees[0]))
+	if _, nTrustees := c.waitQueue.count(); nTrustees != 1 {
+		t.Error("A trustee should not be removed by a ClientLeft message")
+	}
+}
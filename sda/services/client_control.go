@@ -0,0 +1,276 @@
+package services
+
+/*
+The control socket of the client lets "prifi clientctl" act on a running client, without restarting it. It is a UNIX
+socket, only accessible to the user running the client. A command is one line; the client answers with one or more
+lines, the first one starting with "ok" or "error:", and closes the connection.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The commands of the control socket
+const (
+	CLIENT_CONTROL_PAUSE       = "pause"             // send only cover traffic, the SOCKS data waits
+	CLIENT_CONTROL_RESUME      = "resume"            // send the SOCKS data again
+	CLIENT_CONTROL_ROTATE_PORT = "rotate-socks-port" // move the SOCKS server to another port, given or free
+	CLIENT_CONTROL_STATS       = "stats"             // dump the state and the statistics of the client
+	CLIENT_CONTROL_LEAVE       = "leave"             // leave the session, and stop connecting to the relay
+)
+
+// CLIENT_CONTROL_TIMEOUT is how long the control socket waits for a command, and "prifi clientctl" for the answer
+const CLIENT_CONTROL_TIMEOUT = 5 * time.Second
+
+// clientControl is the state set through the control socket
+type clientControl struct {
+	sync.Mutex
+	listener       net.Listener
+	upstreamPaused bool // kept across the protocol runs
+	leakDetector   *leakDetector
+}
+
+// StartClientControl listens for the commands of "prifi clientctl" on the UNIX socket at path
+func (s *ServiceState) StartClientControl(path string) error {
+	if s.role != prifi_protocol.Client {
+		return errors.New("only a client has a control socket")
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("the control socket " + path + " is used by another client")
+	}
+	// a socket left by a client which crashed
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	s.clientControl.Lock()
+	s.clientControl.listener = l
+	s.clientControl.Unlock()
+	log.Lvl1("Client control socket listening on", path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Lvl2("Client control socket closed:", err)
+				return
+			}
+			go s.serveClientControl(conn)
+		}
+	}()
+	return nil
+}
+
+// StopClientControl closes the control socket, if any
+func (s *ServiceState) StopClientControl() {
+	s.clientControl.Lock()
+	defer s.clientControl.Unlock()
+	if s.clientControl.listener != nil {
+		s.clientControl.listener.Close()
+		s.clientControl.listener = nil
+	}
+}
+
+// serveClientControl answers the command sent on conn
+func (s *ServiceState) serveClientControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CLIENT_CONTROL_TIMEOUT))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		log.Lvl2("Client control socket : could not read the command,", err)
+		return
+	}
+	answer, err := s.handleClientControl(strings.TrimSpace(line))
+	if err != nil {
+		answer = "error: " + err.Error()
+	}
+	conn.Write([]byte(answer + "\n"))
+}
+
+// handleClientControl runs a command of the control socket, and returns the answer
+func (s *ServiceState) handleClientControl(command string) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", errors.New("empty command")
+	}
+	log.Lvl2("Client control socket : received", command)
+
+	switch fields[0] {
+	case CLIENT_CONTROL_PAUSE:
+		return "ok, upstream paused", s.SetUpstreamPaused(true)
+	case CLIENT_CONTROL_RESUME:
+		return "ok, upstream resumed", s.SetUpstreamPaused(false)
+	case CLIENT_CONTROL_ROTATE_PORT:
+		port := 0
+		if len(fields) > 1 {
+			p, err := strconv.Atoi(fields[1])
+			if err != nil || p < 0 || p > 65535 {
+				return "", errors.New("invalid port \"" + fields[1] + "\"")
+			}
+			port = p
+		}
+		newPort, err := s.RotateSocksPort(port)
+		if err != nil {
+			return "", err
+		}
+		return "ok, SOCKS server on port " + strconv.Itoa(newPort), nil
+	case CLIENT_CONTROL_STATS:
+		return "ok\n" + s.ClientStatus(), nil
+	case CLIENT_CONTROL_LEAVE:
+		return "ok, leaving the session", s.LeaveSession()
+	}
+	return "", errors.New("unknown command \"" + fields[0] + "\", valid are " + CLIENT_CONTROL_PAUSE + ", " +
+		CLIENT_CONTROL_RESUME + ", " + CLIENT_CONTROL_ROTATE_PORT + " [port], " + CLIENT_CONTROL_STATS + ", " + CLIENT_CONTROL_LEAVE)
+}
+
+// LeaveSession makes the client leave the session : it stops connecting to the relay, and asks the relay to remove
+// it at the next round boundary. It does not wait for the relay; once removed, the client tells the relay to forget
+// it, which does not restart the protocol of the other clients, and stops its protocol.
+func (s *ServiceState) LeaveSession() error {
+	if s.role != prifi_protocol.Client {
+		return errors.New("only a client can leave the session")
+	}
+	if !s.IsPriFiProtocolRunning() {
+		return errors.New("the client is not in a session")
+	}
+	left, err := s.PriFiSDAProtocol.LeaveSession()
+	if err != nil {
+		return err
+	}
+	s.ShutdownConnectionToRelay()
+
+	go func() {
+		select {
+		case <-left:
+		case <-time.After(CLIENT_LEAVE_TIMEOUT):
+			log.Error("The relay did not remove us from the session after", CLIENT_LEAVE_TIMEOUT, ", stopping anyway")
+		}
+		if err := s.SendRaw(s.relayIdentity, &ClientLeft{}); err != nil {
+			log.Error("Could not tell the relay that we left the session:", err)
+		}
+		s.StopPriFiCommunicateProtocol()
+	}()
+	return nil
+}
+
+// SetUpstreamPaused makes the client send only cover traffic (paused = true), or its SOCKS data again. The SOCKS
+// connections stay open; while paused, their data waits, and the applications are slowed down by TCP. It holds for
+// the next protocol runs too.
+func (s *ServiceState) SetUpstreamPaused(paused bool) error {
+	if s.role != prifi_protocol.Client {
+		return errors.New("only a client can pause its upstream")
+	}
+	s.clientControl.Lock()
+	s.clientControl.upstreamPaused = paused
+	s.clientControl.Unlock()
+
+	if s.IsPriFiProtocolRunning() {
+		return s.PriFiSDAProtocol.SetUpstreamPaused(paused)
+	}
+	return nil
+}
+
+// UpstreamPaused returns true if the client sends only cover traffic
+func (s *ServiceState) UpstreamPaused() bool {
+	s.clientControl.Lock()
+	defer s.clientControl.Unlock()
+	return s.clientControl.upstreamPaused
+}
+
+// RotateSocksPort moves the client's SOCKS server to port (0 picks a free one), and returns the new port. The SOCKS
+// connections open on the previous port are closed.
+func (s *ServiceState) RotateSocksPort(port int) (int, error) {
+	s.clientControl.Lock()
+	defer s.clientControl.Unlock()
+
+	if s.role != prifi_protocol.Client || s.socksIngress == nil {
+		return 0, errors.New("the SOCKS server of the client is not running")
+	}
+	old, oldStop := s.socksIngress, s.socksIngressStop
+	oldPort := s.socksPort
+
+	// the previous server releases the channels before the new one uses them
+	old.Stop()
+	for i, c := range s.socksStopChan {
+		if c == oldStop {
+			s.socksStopChan = append(s.socksStopChan[:i], s.socksStopChan[i+1:]...)
+			break
+		}
+	}
+	if err := s.startClientSocksServer(port); err != nil {
+		log.Error("Could not move the SOCKS server to port", port, ", restarting it on port", oldPort)
+		if err2 := s.startClientSocksServer(oldPort); err2 != nil {
+			s.socksIngress, s.socksIngressStop, s.socksPort = nil, nil, 0
+			return 0, errors.New(err.Error() + ", and it could not restart on port " + strconv.Itoa(oldPort))
+		}
+		return 0, err
+	}
+	log.Lvl1("The SOCKS server moved from port", oldPort, "to port", s.socksPort)
+	return s.socksPort, nil
+}
+
+// ClientStatus describes the state of the client, and its statistics since it started
+func (s *ServiceState) ClientStatus() string {
+	lines := []string{
+		"protocol running: " + strconv.FormatBool(s.IsPriFiProtocolRunning()),
+		"upstream paused: " + strconv.FormatBool(s.UpstreamPaused()),
+		"SOCKS port: " + strconv.Itoa(s.SocksPort()),
+	}
+	s.clientControl.Lock()
+	d := s.clientControl.leakDetector
+	ingress := s.socksIngress
+	s.clientControl.Unlock()
+	if ingress != nil {
+		lines = append(lines, ingress.FailureStatus()...)
+	}
+	if d != nil {
+		lines = append(lines, "leaks detected: "+strconv.Itoa(d.Leaks()))
+	}
+	if report := s.ShutdownReport(); report != nil {
+		lines = append(lines, report.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SendClientControl sends command to the control socket of the client at path, and returns its answer
+func SendClientControl(path string, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, CLIENT_CONTROL_TIMEOUT)
+	if err != nil {
+		return "", errors.New("cannot reach the client at " + path + ", is ClientControlSocket set ? " + err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CLIENT_CONTROL_TIMEOUT))
+
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", err
+	}
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(answer))
+	if strings.HasPrefix(text, "error: ") {
+		return "", errors.New(strings.TrimPrefix(text, "error: "))
+	}
+	return text, nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/sda/protocols"
+)
+
+func TestClientControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-clientctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "client.sock")
+
+	s := &ServiceState{
+		role:            protocols.Client,
+		prifiTomlConfig: &protocols.PrifiTomlConfig{PayloadSize: 1000, ClientSocksListenAddress: "127.0.0.1"},
+		socksClientConfig: &protocols.SOCKSConfig{
+			PayloadSize:       1000,
+			UpstreamChannel:   make(chan []byte),
+			DownstreamChannel: make(chan []byte),
+		},
+	}
+	if err := s.startClientSocksServer(0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.socksIngress.Stop() }()
+	if err := s.StartClientControl(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopClientControl()
+
+	// a second client cannot take the socket
+	other := &ServiceState{role: protocols.Client}
+	if err := other.StartClientControl(path); err == nil {
+		t.Error("the control socket should be in use")
+	}
+
+	if _, err := SendClientControl(path, "pause"); err != nil || !s.UpstreamPaused() {
+		t.Error("the upstream should be paused,", err)
+	}
+	answer, err := SendClientControl(path, "stats")
+	if err != nil || !strings.Contains(answer, "upstream paused: true") {
+		t.Error("wrong stats", answer, err)
+	}
+	if !strings.Contains(answer, "SOCKS failure mode: fail-closed") || !strings.Contains(answer, "DC-net up: false") {
+		t.Error("the stats should show the SOCKS failure mode,", answer)
+	}
+	if _, err := SendClientControl(path, "resume"); err != nil || s.UpstreamPaused() {
+		t.Error("the upstream should be resumed,", err)
+	}
+
+	// the SOCKS server moves to a free port, and the previous one is closed
+	oldPort := s.SocksPort()
+	answer, err = SendClientControl(path, "rotate-socks-port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPort := s.SocksPort()
+	if newPort == oldPort || !strings.HasSuffix(answer, strconv.Itoa(newPort)) {
+		t.Error("the SOCKS server should have moved from port", oldPort, ", answer is", answer)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(newPort)); err != nil {
+		t.Error("the SOCKS server should listen on its new port,", err)
+	} else {
+		conn.Close()
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(oldPort)); err == nil {
+		conn.Close()
+		t.Error("the SOCKS server should not listen on its previous port anymore")
+	}
+	if len(s.socksStopChan) != 1 {
+		t.Error("the stopper of the previous SOCKS server should be forgotten, there are", len(s.socksStopChan))
+	}
+
+	if _, err := SendClientControl(path, "rotate-socks-port notaport"); err == nil {
+		t.Error("an invalid port should be refused")
+	}
+	if _, err := SendClientControl(path, "reboot"); err == nil {
+		t.Error("an unknown command should be refused")
+	}
+}
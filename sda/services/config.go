@@ -1,19 +1,19 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 
+	prifi_config "github.com/dedis/prifi/prifi-lib/config"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 )
 
-var socksClientConfig *prifi_protocol.SOCKSConfig
-var socksServerConfig *prifi_protocol.SOCKSConfig
-
 //Set the config, from the prifi.toml. Is called by sda/app.
 func (s *ServiceState) SetConfigFromToml(config *prifi_protocol.PrifiTomlConfig) {
 	log.Lvl3("Setting PriFi configuration...")
@@ -21,6 +21,49 @@ func (s *ServiceState) SetConfigFromToml(config *prifi_protocol.PrifiTomlConfig)
 	s.prifiTomlConfig = config
 }
 
+// listenAddresses returns the addresses a node of the given role listens on : the SDA server at sdaAddress (and its
+// websocket, on the next port), and the listeners configured in prifi.toml
+func listenAddresses(config *prifi_protocol.PrifiTomlConfig, role prifi_protocol.PriFiRole, sdaAddress network.Address) []prifi_config.ListenAddress {
+	addresses := make([]prifi_config.ListenAddress, 0)
+	if port, err := strconv.Atoi(sdaAddress.Port()); err == nil {
+		addresses = append(addresses,
+			prifi_config.ListenAddress{Setting: "the SDA address", Network: "tcp", Address: ":" + strconv.Itoa(port)},
+			prifi_config.ListenAddress{Setting: "the SDA websocket", Network: "tcp", Address: ":" + strconv.Itoa(port+1)})
+	}
+
+	switch role {
+	case prifi_protocol.Relay:
+		addresses = append(addresses,
+			prifi_config.ListenAddress{Setting: "RelayMetricsAddress", Network: "tcp", Address: config.RelayMetricsAddress},
+			prifi_config.ListenAddress{Setting: "RelayDemoAddress", Network: "tcp", Address: config.RelayDemoAddress})
+		if config.UseUDPUplink {
+			uplinkAddress, _ := prifi_protocol.UDPUplinkAddress(config.RelayUDPUplinkAddress, sdaAddress)
+			addresses = append(addresses, prifi_config.ListenAddress{Setting: "RelayUDPUplinkAddress", Network: "udp", Address: uplinkAddress})
+		}
+	case prifi_protocol.Client:
+		socksAddress := config.ClientSocksListenAddress + ":" + strconv.Itoa(config.SocksServerPort)
+		addresses = append(addresses, prifi_config.ListenAddress{Setting: "SocksServerPort", Network: "tcp", Address: socksAddress})
+		if config.UseUDP {
+			broadcastAddress := config.UDPBroadcastAddress
+			if broadcastAddress == "" {
+				broadcastAddress = prifi_protocol.DEFAULT_UDP_BROADCAST_ADDRESS
+			}
+			addresses = append(addresses, prifi_config.ListenAddress{Setting: "UDPBroadcastAddress", Network: "udp", Address: broadcastAddress})
+		}
+	}
+	return addresses
+}
+
+// checkListenAddresses checks the addresses this node listens on in its role, before it starts any listener
+func (s *ServiceState) checkListenAddresses() error {
+	if err := prifi_config.CheckListenAddresses(listenAddresses(s.prifiTomlConfig, s.role, s.ServerIdentity().Address)); err != nil {
+		e := "Invalid listen addresses in prifi.toml, " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	return nil
+}
+
 // tryLoad tries to load the configuration and updates if a configuration
 // is found, else it returns an error.
 func (s *ServiceState) tryLoad() error {
@@ -80,12 +123,28 @@ func (s *ServiceState) setConfigToPriFiProtocol(wrapper *prifi_protocol.PriFiSDA
 		Toml:                  s.prifiTomlConfig,
 		Identities:            identitiesMap,
 		Role:                  s.role,
-		ClientSideSocksConfig: socksClientConfig,
-		RelaySideSocksConfig:  socksServerConfig,
+		ClientSideSocksConfig: s.socksClientConfig,
+		RelaySideSocksConfig:  s.socksServerConfig,
+	}
+	if s.role == prifi_protocol.Relay && s.randomBeaconSource != nil {
+		beacon, err := s.randomBeaconSource()
+		if err != nil {
+			log.Error("Could not get the random beacon, this epoch uses the relay's randomness only:", err)
+		} else {
+			log.Lvl2("Using the random beacon of round", beacon.Round, "for this epoch")
+			configMsg.RandomBeacon = beacon
+		}
 	}
 
 	wrapper.SetConfigFromPriFiService(configMsg)
 
+	//the upstream stays paused across the protocol runs, see "prifi clientctl"
+	if s.role == prifi_protocol.Client && s.UpstreamPaused() {
+		if err := wrapper.SetUpstreamPaused(true); err != nil {
+			log.Error("Could not pause the upstream of the client:", err)
+		}
+	}
+
 	//when PriFi-protocol (via PriFi-lib) detects a slow client, call "handleTimeout"
 	wrapper.SetTimeoutHandler(s.handleTimeout)
 }
@@ -0,0 +1,193 @@
+package services
+
+/*
+The leak detector watches the connections of some applications of the user (e.g., the browser), which should only
+reach the network through the SOCKS server of the client. A connection of such an application to a remote host, or a
+name resolution over DNS (UDP or TCP port 53, even to a local resolver), bypasses PriFi : it is reported once, as a
+warning. Optionally, the detector also blocks the traffic of the leaking application with firewall rules, until the
+client stops.
+
+The connections are read from the operating system, see leak_detector_linux.go; on the other platforms, the detector
+is not available. Only the connected sockets are seen : a datagram sent from an unconnected UDP socket is not.
+*/
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// LEAK_DETECTOR_INTERVAL is how often the leak detector lists the connections of the watched applications
+const LEAK_DETECTOR_INTERVAL = 2 * time.Second
+
+// The kinds of leaks
+const (
+	LEAK_DNS     = "DNS"     // the application resolves names itself, instead of letting the SOCKS server do it
+	LEAK_TRAFFIC = "traffic" // the application connects to a remote host directly
+)
+
+// appConnection is a connection opened by a process
+type appConnection struct {
+	App        string // the name of the process
+	PID        int
+	UID        int // the user running the process
+	Proto      string
+	Remote     net.IP
+	RemotePort int
+}
+
+// leakFirewall blocks the traffic of the processes of a user, except to the loopback interface (i.e., to the SOCKS
+// server of the client)
+type leakFirewall interface {
+	Block(uid int) error
+	Unblock() error // removes all the rules added by Block
+}
+
+// leakDetector is the state of the leak detector of the client
+type leakDetector struct {
+	sync.Mutex
+	apps        map[string]bool // the names of the watched processes
+	block       bool
+	list        func() ([]appConnection, error)
+	firewall    leakFirewall
+	reported    map[string]bool // the leaks already reported
+	blockedUIDs map[int]bool    // the users whose leaks were blocked, or could not be
+	leaks       int
+	stop        chan bool
+}
+
+// newLeakDetector returns a detector of the connections of apps (comma-separated names of processes)
+func newLeakDetector(apps string, block bool, list func() ([]appConnection, error), firewall leakFirewall) *leakDetector {
+	d := &leakDetector{
+		apps:        make(map[string]bool),
+		block:       block,
+		list:        list,
+		firewall:    firewall,
+		reported:    make(map[string]bool),
+		blockedUIDs: make(map[int]bool),
+	}
+	for _, app := range strings.Split(apps, ",") {
+		if app = strings.TrimSpace(app); app != "" {
+			d.apps[app] = true
+		}
+	}
+	return d
+}
+
+// leakKind returns the kind of leak c is, or "" if it goes to the SOCKS server (or elsewhere on this machine)
+func leakKind(c appConnection) string {
+	if c.RemotePort == 53 {
+		return LEAK_DNS
+	}
+	if c.Remote == nil || c.Remote.IsUnspecified() || c.Remote.IsLoopback() {
+		return ""
+	}
+	return LEAK_TRAFFIC
+}
+
+// scan lists the connections once, reports the new leaks, and blocks the leaking applications if enabled
+func (d *leakDetector) scan() {
+	connections, err := d.list()
+	if err != nil {
+		log.Error("Leak detector : could not list the connections,", err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for _, c := range connections {
+		if !d.apps[c.App] {
+			continue
+		}
+		kind := leakKind(c)
+		if kind == "" {
+			continue
+		}
+		remote := net.JoinHostPort(c.Remote.String(), strconv.Itoa(c.RemotePort))
+		key := c.App + "/" + kind + "/" + c.Proto + "/" + remote
+		if d.reported[key] {
+			continue
+		}
+		d.reported[key] = true
+		d.leaks++
+		log.Warn("Leak detector :", kind, "leak,", c.App, "(pid", c.PID, ") connects to", remote, "over", c.Proto,
+			"without going through PriFi")
+
+		if d.block && !d.blockedUIDs[c.UID] {
+			d.blockedUIDs[c.UID] = true
+			if c.UID == os.Getuid() {
+				log.Error("Leak detector : cannot block", c.App, ", it runs as the same user as the PriFi client;",
+					"run it as another user to block its leaks")
+			} else if err := d.firewall.Block(c.UID); err != nil {
+				log.Error("Leak detector : could not block the traffic of user", c.UID, ",", err)
+			} else {
+				log.Lvl1("Leak detector : blocking the traffic of user", c.UID, "(", c.App, ") outside this machine")
+			}
+		}
+	}
+}
+
+// Leaks returns the number of leaks reported
+func (d *leakDetector) Leaks() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.leaks
+}
+
+// StartLeakDetector watches the connections of apps (comma-separated names of processes), and blocks their leaks if
+// block is true. It fails on the platforms where the connections cannot be listed.
+func (s *ServiceState) StartLeakDetector(apps string, block bool) error {
+	if !LEAK_DETECTOR_AVAILABLE {
+		return errors.New("the leak detector is not available on this platform")
+	}
+	d := newLeakDetector(apps, block, listAppConnections, newLeakFirewall())
+	if len(d.apps) == 0 {
+		return errors.New("no application to watch")
+	}
+	d.stop = make(chan bool, 1)
+
+	s.clientControl.Lock()
+	s.clientControl.leakDetector = d
+	s.clientControl.Unlock()
+	log.Lvl1("Leak detector watching", apps, ", blocking the leaks :", block)
+
+	go func() {
+		ticker := time.NewTicker(LEAK_DETECTOR_INTERVAL)
+		defer ticker.Stop()
+		for {
+			d.scan()
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// StopLeakDetector stops the leak detector, if any, and removes its firewall rules
+func (s *ServiceState) StopLeakDetector() {
+	s.clientControl.Lock()
+	d := s.clientControl.leakDetector
+	s.clientControl.leakDetector = nil
+	s.clientControl.Unlock()
+	if d == nil {
+		return
+	}
+	d.stop <- true
+
+	d.Lock()
+	defer d.Unlock()
+	if d.block {
+		if err := d.firewall.Unblock(); err != nil {
+			log.Error("Leak detector : could not remove the firewall rules,", err)
+		}
+	}
+}
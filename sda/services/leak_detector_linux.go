@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+package services
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// LEAK_DETECTOR_AVAILABLE is true if the connections of the applications can be listed on this platform
+const LEAK_DETECTOR_AVAILABLE = true
+
+// LEAK_FIREWALL_CHAIN is the iptables chain holding the rules of the leak detector
+const LEAK_FIREWALL_CHAIN = "PRIFI_LEAKS"
+
+// TCP_LISTEN is the state of a listening socket in /proc/net/tcp
+const TCP_LISTEN = "0A"
+
+// the addresses in /proc/net are words in the byte order of the host
+var hostLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// listAppConnections returns the connected sockets of the processes this user can see, from /proc
+func listAppConnections() ([]appConnection, error) {
+	owners := socketOwners()
+	connections := make([]appConnection, 0)
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open("/proc/net/" + proto)
+		if err != nil {
+			if os.IsNotExist(err) { // e.g., no IPv6
+				continue
+			}
+			return nil, err
+		}
+		sockets, err := parseProcNet(proto, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for inode, c := range sockets {
+			owner, found := owners[inode]
+			if !found {
+				continue
+			}
+			c.App, c.PID, c.UID = owner.App, owner.PID, owner.UID
+			connections = append(connections, c)
+		}
+	}
+	return connections, nil
+}
+
+// parseProcNet reads a table of /proc/net (tcp, tcp6, udp or udp6), and returns its connected sockets by inode
+func parseProcNet(proto string, f io.Reader) (map[string]appConnection, error) {
+	sockets := make(map[string]appConnection)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // the header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if strings.HasPrefix(proto, "tcp") && fields[3] == TCP_LISTEN {
+			continue
+		}
+		ip, port, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			return nil, errors.New("invalid address \"" + fields[2] + "\" in /proc/net/" + proto + ", " + err.Error())
+		}
+		if port == 0 {
+			continue
+		}
+		sockets[fields[9]] = appConnection{Proto: proto, Remote: ip, RemotePort: port}
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcNetAddress parses an address of /proc/net, e.g. "0100007F:0035" for 127.0.0.1:53
+func parseProcNetAddress(address string) (net.IP, int, error) {
+	parts := strings.Split(address, ":")
+	if len(parts) != 2 {
+		return nil, 0, errors.New("no port")
+	}
+	ip, err := hex.DecodeString(parts[0])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, 0, errors.New("invalid IP")
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, errors.New("invalid port")
+	}
+	if hostLittleEndian {
+		for w := 0; w < len(ip); w += 4 {
+			ip[w], ip[w+1], ip[w+2], ip[w+3] = ip[w+3], ip[w+2], ip[w+1], ip[w]
+		}
+	}
+	return net.IP(ip), int(port), nil
+}
+
+// socketOwner is a process holding a socket
+type socketOwner struct {
+	App string
+	PID int
+	UID int
+}
+
+// socketOwners returns the processes holding each socket, by inode; the processes of other users are only seen when
+// running as root
+func socketOwners() map[string]socketOwner {
+	owners := make(map[string]socketOwner)
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		if _, found := owners[inode]; found {
+			continue
+		}
+		dir := filepath.Dir(filepath.Dir(fd))
+		pid, _ := strconv.Atoi(filepath.Base(dir))
+		comm, err := ioutil.ReadFile(dir + "/comm")
+		if err != nil {
+			continue
+		}
+		owners[inode] = socketOwner{App: strings.TrimSpace(string(comm)), PID: pid, UID: processUID(dir)}
+	}
+	return owners
+}
+
+// processUID returns the real user ID of the process at dir in /proc, or -1
+func processUID(dir string) int {
+	status, err := ioutil.ReadFile(dir + "/status")
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			uid, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return -1
+			}
+			return uid
+		}
+	}
+	return -1
+}
+
+// iptablesFirewall blocks the leaks with iptables and ip6tables, in the chain LEAK_FIREWALL_CHAIN; it needs root
+type iptablesFirewall struct {
+	chainAdded bool
+}
+
+func newLeakFirewall() leakFirewall {
+	return new(iptablesFirewall)
+}
+
+// iptables runs iptables, then ip6tables, with args
+func iptables(args ...string) error {
+	for _, command := range []string{"iptables", "ip6tables"} {
+		if out, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+			return errors.New(command + " " + strings.Join(args, " ") + " : " + strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// Block rejects the packets of the processes of uid, except to the loopback interface and to a DNS resolver
+func (f *iptablesFirewall) Block(uid int) error {
+	if !f.chainAdded {
+		if err := iptables("-N", LEAK_FIREWALL_CHAIN); err != nil {
+			return err
+		}
+		if err := iptables("-I", "OUTPUT", "-j", LEAK_FIREWALL_CHAIN); err != nil {
+			return err
+		}
+		f.chainAdded = true
+	}
+	owner := []string{"-A", LEAK_FIREWALL_CHAIN, "-m", "owner", "--uid-owner", strconv.Itoa(uid)}
+	rules := [][]string{
+		{"!", "-o", "lo", "-j", "REJECT"},
+		{"-p", "udp", "--dport", "53", "-j", "REJECT"},
+		{"-p", "tcp", "--dport", "53", "-j", "REJECT"},
+	}
+	for _, rule := range rules {
+		if err := iptables(append(owner, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unblock removes the chain LEAK_FIREWALL_CHAIN
+func (f *iptablesFirewall) Unblock() error {
+	if !f.chainAdded {
+		return nil
+	}
+	f.chainAdded = false
+	if err := iptables("-D", "OUTPUT", "-j", LEAK_FIREWALL_CHAIN); err != nil {
+		return err
+	}
+	if err := iptables("-F", LEAK_FIREWALL_CHAIN); err != nil {
+		return err
+	}
+	return iptables("-X", LEAK_FIREWALL_CHAIN)
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNet(t *testing.T) {
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:BC8F 00000000:0000 0A 00000000:00000000 00:00000000 00000000 65534        0 924 1 0000000074e82a3f 100 0 0 10 0
+   1: 0100007F:D2A0 0100007F:1F90 01 00000000:00000000 00:00000000 00000000  1000        0 1234 1 0000000074e82a3f 20 4 30 10 -1
+   2: 0F02000A:A1B2 22D8B85D:01BB 01 00000000:00000000 00:00000000 00000000  1000        0 5678 1 0000000074e82a3f 20 4 30 10 -1
+`
+	if !hostLittleEndian {
+		t.Skip("the addresses of the table are little-endian")
+	}
+	sockets, err := parseProcNet("tcp", strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 2 {
+		t.Fatal("The listening socket should be skipped", sockets)
+	}
+	if c := sockets["1234"]; !c.Remote.Equal(net.ParseIP("127.0.0.1")) || c.RemotePort != 8080 || c.Proto != "tcp" {
+		t.Error("Wrong connection", c)
+	}
+	if c := sockets["5678"]; !c.Remote.Equal(net.ParseIP("93.184.216.34")) || c.RemotePort != 443 {
+		t.Error("Wrong connection", c)
+	}
+
+	ip, port, err := parseProcNetAddress("00000000000000000000000001000000:0035")
+	if err != nil || !ip.Equal(net.ParseIP("::1")) || port != 53 {
+		t.Error("Wrong IPv6 address", ip, port, err)
+	}
+	if _, _, err := parseProcNetAddress("0100007F"); err == nil {
+		t.Error("An address without port is invalid")
+	}
+}
+
+func TestListAppConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	connections, err := listAppConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range connections {
+		if c.PID == os.Getpid() && c.RemotePort == port {
+			if !c.Remote.IsLoopback() || c.UID != os.Getuid() || c.App == "" || leakKind(c) != "" {
+				t.Error("Wrong connection", c)
+			}
+			return
+		}
+	}
+	t.Error("The connection of this process should be listed")
+}
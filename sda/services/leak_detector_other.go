@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package services
+
+import "errors"
+
+// LEAK_DETECTOR_AVAILABLE is true if the connections of the applications can be listed on this platform
+const LEAK_DETECTOR_AVAILABLE = false
+
+func listAppConnections() ([]appConnection, error) {
+	return nil, errors.New("the leak detector is not available on this platform")
+}
+
+// noFirewall cannot block anything, the leaks are only reported
+type noFirewall struct{}
+
+func newLeakFirewall() leakFirewall {
+	return noFirewall{}
+}
+
+func (noFirewall) Block(uid int) error {
+	return errors.New("the leak detector cannot block the leaks on this platform")
+}
+
+func (noFirewall) Unblock() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+type fakeLeakFirewall struct {
+	blocked   []int
+	unblocked bool
+}
+
+func (f *fakeLeakFirewall) Block(uid int) error {
+	f.blocked = append(f.blocked, uid)
+	return nil
+}
+
+func (f *fakeLeakFirewall) Unblock() error {
+	f.unblocked = true
+	return nil
+}
+
+func TestLeakKind(t *testing.T) {
+	cases := []struct {
+		c    appConnection
+		kind string
+	}{
+		{appConnection{Remote: net.ParseIP("127.0.0.1"), RemotePort: 8080}, ""},
+		{appConnection{Remote: net.ParseIP("::1"), RemotePort: 8080}, ""},
+		{appConnection{Remote: net.ParseIP("127.0.0.53"), RemotePort: 53}, LEAK_DNS},
+		{appConnection{Remote: net.ParseIP("8.8.8.8"), RemotePort: 53}, LEAK_DNS},
+		{appConnection{Remote: net.ParseIP("93.184.216.34"), RemotePort: 443}, LEAK_TRAFFIC},
+		{appConnection{Remote: net.ParseIP("2001:db8::1"), RemotePort: 80}, LEAK_TRAFFIC},
+	}
+	for _, c := range cases {
+		if kind := leakKind(c.c); kind != c.kind {
+			t.Error("Connection to", c.c.Remote, c.c.RemotePort, "should be", c.kind, ", not", kind)
+		}
+	}
+}
+
+func TestLeakDetector(t *testing.T) {
+	connections := []appConnection{
+		{App: "firefox", PID: 10, UID: os.Getuid() + 1, Proto: "tcp", Remote: net.ParseIP("127.0.0.1"), RemotePort: 8080},
+		{App: "firefox", PID: 10, UID: os.Getuid() + 1, Proto: "udp", Remote: net.ParseIP("127.0.0.53"), RemotePort: 53},
+		{App: "curl", PID: 11, UID: os.Getuid(), Proto: "tcp", Remote: net.ParseIP("93.184.216.34"), RemotePort: 443},
+		{App: "sshd", PID: 12, UID: 0, Proto: "tcp", Remote: net.ParseIP("10.0.0.1"), RemotePort: 22},
+	}
+	firewall := new(fakeLeakFirewall)
+	d := newLeakDetector("firefox, curl,", true, func() ([]appConnection, error) { return connections, nil }, firewall)
+
+	d.scan()
+	if d.Leaks() != 2 {
+		t.Error("The DNS query of firefox and the connection of curl are leaks, not", d.Leaks())
+	}
+	// the leak of curl cannot be blocked, it runs as the user of the client
+	if len(firewall.blocked) != 1 || firewall.blocked[0] != os.Getuid()+1 {
+		t.Error("Only the user running firefox should be blocked", firewall.blocked)
+	}
+
+	// the leaks are reported once
+	d.scan()
+	if d.Leaks() != 2 || len(firewall.blocked) != 1 {
+		t.Error("The same leaks should not be reported again", d.Leaks(), firewall.blocked)
+	}
+	connections = append(connections, appConnection{App: "firefox", PID: 10, UID: os.Getuid() + 1, Proto: "tcp",
+		Remote: net.ParseIP("93.184.216.34"), RemotePort: 80})
+	d.scan()
+	if d.Leaks() != 3 || len(firewall.blocked) != 1 {
+		t.Error("A new leak should be reported, but its user is blocked already", d.Leaks(), firewall.blocked)
+	}
+
+	// an error listing the connections is not a leak
+	d.list = func() ([]appConnection, error) { return nil, errors.New("no /proc") }
+	d.scan()
+	if d.Leaks() != 3 {
+		t.Error("No leak should be reported", d.Leaks())
+	}
+
+	s := &ServiceState{}
+	d.stop = make(chan bool, 1)
+	s.clientControl.leakDetector = d
+	s.StopLeakDetector()
+	if !firewall.unblocked || s.clientControl.leakDetector != nil {
+		t.Error("Stopping the detector should remove its firewall rules")
+	}
+
+	// without blocking, the leaks are only reported
+	firewall = new(fakeLeakFirewall)
+	d = newLeakDetector("firefox", false, func() ([]appConnection, error) { return connections, nil }, firewall)
+	d.scan()
+	if d.Leaks() != 2 || len(firewall.blocked) != 0 {
+		t.Error("The leaks of firefox should be reported, without blocking it", d.Leaks(), firewall.blocked)
+	}
+}
@@ -1,7 +1,12 @@
 package services
 
 import (
+	"context"
+	"errors"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+	"github.com/dedis/prifi/stream-multiplexer"
 	"github.com/dedis/prifi/utils"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
@@ -31,12 +36,29 @@ type HelloMsg struct{}
 // by nodes that want to leave the protocol.
 type DisconnectionRequest struct{}
 
+// TrusteeRemoved messages are sent by the relay to the trustees
+// removed from the group; they stop connecting to the relay.
+type TrusteeRemoved struct{}
+
+// ClientLeft messages are sent to the relay by the clients which
+// left the session; the relay forgets them without restarting.
+type ClientLeft struct{}
+
 //Delay before each host re-tried to connect to the relay
 const DELAY_BEFORE_CONNECT_TO_RELAY = 5 * time.Second
 
 //Delay before the relay re-tried to connect to the trustees
 const DELAY_BEFORE_CONNECT_TO_TRUSTEES = 30 * time.Second
 
+//How long a client leaving the session waits for the relay to remove it, before stopping anyway
+const CLIENT_LEAVE_TIMEOUT = 60 * time.Second
+
+//How often the draining relay checks if the SOCKS streams are finished
+const DRAIN_POLL_INTERVAL = 500 * time.Millisecond
+
+//How long, in seconds, a draining relay waits for the SOCKS streams if RelayDrainTimeout is not set
+const DRAIN_DEFAULT_TIMEOUT = 60
+
 // returns true if the PriFi SDA protocol is running (in any state : init, communicate, etc)
 func (s *ServiceState) IsPriFiProtocolRunning() bool {
 	if s.PriFiSDAProtocol != nil {
@@ -69,6 +91,24 @@ func (s *ServiceState) HandleHelloMsg(msg *network.Envelope) error {
 	return nil
 }
 
+// Packet send by relay to the trustees removed from the group
+func (s *ServiceState) HandleTrusteeRemoved(msg *network.Envelope) error {
+	if s.role != prifi_protocol.Trustee {
+		log.Error("Received a TrusteeRemoved message, but we're not a trustee ! ignoring.")
+		return nil
+	}
+	if s.relayIdentity != nil && !msg.ServerIdentity.Equal(s.relayIdentity) {
+		log.Error("Received a TrusteeRemoved message from", msg.ServerIdentity, ", which is not the relay ! ignoring.")
+		return nil
+	}
+
+	log.Lvl1("The relay removed us from the trustees, stopping.")
+	s.ShutdownConnectionToRelay()
+	s.receivedHello = false
+	s.StopPriFiCommunicateProtocol()
+	return nil
+}
+
 // Packet received by relay when some node connects
 func (s *ServiceState) HandleConnection(msg *network.Envelope) error {
 	if s.churnHandler == nil {
@@ -92,6 +132,16 @@ func (s *ServiceState) HandleDisconnection(msg *network.Envelope) error {
 	return nil
 }
 
+// Packet received by relay when a client left the session
+func (s *ServiceState) HandleClientLeft(msg *network.Envelope) error {
+	if s.churnHandler == nil {
+		log.Error("Received a ClientLeft message, but we're not the relay ! ignoring.")
+		return nil
+	}
+	s.churnHandler.handleClientLeft(msg)
+	return nil
+}
+
 // Packet send by relay when some node disconnected
 func (s *ServiceState) HandleStopSOCKS(msg *network.Envelope) error {
 	s.ShutdownSocks()
@@ -116,7 +166,7 @@ func (s *ServiceState) NetworkErrorHappened(si *network.ServerIdentity) {
 
 	if s.role != prifi_protocol.Relay {
 		log.Lvl3("A network error occurred with node", si, ", but we're not the relay, nothing to do.")
-		s.connectToRelayStopChan <- true //"nothing" except stop this goroutine
+		stopGoroutine(s.connectToRelayStopChan) //"nothing" except stop this goroutine
 		return
 	}
 	if s.churnHandler == nil {
@@ -128,17 +178,38 @@ func (s *ServiceState) NetworkErrorHappened(si *network.ServerIdentity) {
 }
 
 // HasEnoughParticipants returns true iff
-// nTrustees >= 1 & nClients >= 1
+// nTrustees >= quorum (at least 1) & nClients >= 1
 func (s *ServiceState) HasEnoughParticipants() bool {
-	t, c := s.churnHandler.CountParticipants()
-	return (t >= 1) && (c >= 1)
+	c, t := s.churnHandler.CountParticipants()
+	return (t >= s.churnHandler.minTrustees()) && (c >= 1)
 }
 
-// CountParticipants returns ntrustees, nclients already connected
+// CountParticipants returns nclients, ntrustees already connected
 func (s *ServiceState) CountParticipants() (int, int) {
 	return s.churnHandler.CountParticipants()
 }
 
+// WaitForEnoughParticipants blocks until HasEnoughParticipants() is true, or ctx is done. It wakes up when a node
+// joins or leaves, instead of polling.
+func (s *ServiceState) WaitForEnoughParticipants(ctx context.Context) error {
+	if s.churnHandler == nil {
+		return errors.New("only a started relay has participants")
+	}
+	for {
+		changed := s.churnHandler.participantsChangedChan()
+		if s.HasEnoughParticipants() {
+			return nil
+		}
+		c, t := s.CountParticipants()
+		log.Lvl2("Not enough participants (", t, "trustees,", c, "clients), waiting...")
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 // startPriFi starts a PriFi protocol. It is called
 // by the relay as soon as enough participants are
 // ready (one trustee and two clients).
@@ -176,6 +247,9 @@ func (s *ServiceState) StartPriFiCommunicateProtocol() {
 	wrapper = pi.(*prifi_protocol.PriFiSDAProtocol)
 
 	//assign and start the protocol
+	if s.PriFiSDAProtocol != nil {
+		s.pastRunsReport = prifilog.MergeShutdownReports(s.pastRunsReport, s.PriFiSDAProtocol.ShutdownReport())
+	}
 	s.PriFiSDAProtocol = wrapper
 
 	s.setConfigToPriFiProtocol(wrapper)
@@ -194,23 +268,84 @@ func (s *ServiceState) StopPriFiCommunicateProtocol() {
 
 	if s.PriFiSDAProtocol != nil {
 		s.PriFiSDAProtocol.Stop()
+		s.pastRunsReport = prifilog.MergeShutdownReports(s.pastRunsReport, s.PriFiSDAProtocol.ShutdownReport())
 	}
 	s.PriFiSDAProtocol = nil
 }
 
+// DrainTimeout returns how long, in seconds, Drain should let the SOCKS streams finish
+func (s *ServiceState) DrainTimeout() int {
+	if s.prifiTomlConfig == nil || s.prifiTomlConfig.RelayDrainTimeout <= 0 {
+		return DRAIN_DEFAULT_TIMEOUT
+	}
+	return s.prifiTomlConfig.RelayDrainTimeout
+}
+
+// accessLogOptions returns the settings of the relay's exit access log
+func accessLogOptions(config *prifi_protocol.PrifiTomlConfig) stream_multiplexer.EgressAccessLogOptions {
+	return stream_multiplexer.EgressAccessLogOptions{
+		Mode:            config.RelayAccessLog,
+		Path:            config.RelayAccessLogFile,
+		MaxBytes:        int64(config.RelayAccessLogMaxSize) * 1024 * 1024,
+		MaxFiles:        config.RelayAccessLogMaxFiles,
+		AggregatePeriod: time.Duration(config.RelayAccessLogAggregatePeriod) * time.Second,
+	}
+}
+
+// Drain shuts the relay down without surprising the users: it stops admitting new clients, announces the shutdown to
+// the clients in the downstream control cells, lets the current SOCKS streams finish (but opens no new one) until
+// timeout, then stops the protocol and the SOCKS servers on all nodes.
+func (s *ServiceState) Drain(timeout time.Duration) error {
+	if s.role != prifi_protocol.Relay || s.churnHandler == nil {
+		return errors.New("only a relay can be drained")
+	}
+	deadline := time.Now().Add(timeout)
+	log.Lvl1("Draining the relay; shutting down at the latest at", deadline)
+
+	s.churnHandler.startDraining()
+	if s.egressDrain != nil {
+		s.egressDrain.StartDraining()
+	}
+	if s.IsPriFiProtocolRunning() {
+		if err := s.PriFiSDAProtocol.AnnounceDrain(deadline); err != nil {
+			log.Error("Could not announce the drain to the clients,", err)
+		}
+	}
+
+	if s.egressDrain != nil {
+		if remaining := s.egressDrain.WaitForStreams(deadline, DRAIN_POLL_INTERVAL); remaining > 0 {
+			log.Lvl1("Drain deadline reached,", remaining, "SOCKS streams still open, closing them")
+		} else {
+			log.Lvl1("All SOCKS streams are finished")
+		}
+	}
+
+	s.StopPriFiCommunicateProtocol()
+	return s.GlobalShutDownSocks()
+}
+
+// ShutdownReport returns the summary of all the protocol runs of this node, the running one included; nil if the
+// protocol never ran
+func (s *ServiceState) ShutdownReport() *prifilog.ShutdownReport {
+	if s.PriFiSDAProtocol == nil {
+		return s.pastRunsReport
+	}
+	return prifilog.MergeShutdownReports(s.pastRunsReport, s.PriFiSDAProtocol.ShutdownReport())
+}
+
 // TODO : change function comment
 // autoConnect sends a connection request to the relay
 // every 10 seconds if the node is not participating to
 // a PriFi protocol.
-func (s *ServiceState) connectToTrustees(trusteesIDs []*network.ServerIdentity, stopChan chan bool) {
-	for _, v := range trusteesIDs {
+func (s *ServiceState) connectToTrustees(stopChan chan bool) {
+	for _, v := range s.churnHandler.getTrustees() {
 		s.sendHelloMessage(v)
 	}
 
 	tick := time.Tick(DELAY_BEFORE_CONNECT_TO_TRUSTEES)
 	for range tick {
 		if !s.IsPriFiProtocolRunning() {
-			for _, v := range trusteesIDs {
+			for _, v := range s.churnHandler.getTrustees() {
 				s.sendHelloMessage(v)
 			}
 		}
@@ -224,6 +359,20 @@ func (s *ServiceState) connectToTrustees(trusteesIDs []*network.ServerIdentity,
 	}
 }
 
+// ShutdownConnectionToRelay stops sending connection requests to the relay
+func (s *ServiceState) ShutdownConnectionToRelay() {
+	stopGoroutine(s.connectToRelayStopChan)
+	stopGoroutine(s.connectToRelay2StopChan)
+}
+
+// stopGoroutine asks the goroutine watching stopChan (buffered) to stop, without blocking
+func stopGoroutine(stopChan chan bool) {
+	select {
+	case stopChan <- true:
+	default:
+	}
+}
+
 // connectToRelay sends a connection request to the relay
 // every 10 seconds if the node is not participating to
 // a PriFi protocol.
@@ -232,17 +381,18 @@ func (s *ServiceState) connectToRelay(relayID *network.ServerIdentity, stopChan
 
 	tick := time.Tick(DELAY_BEFORE_CONNECT_TO_RELAY)
 	for range tick {
-		//log.Info("Service", s, ": Still pinging relay", !s.IsPriFiProtocolRunning())
-		if !s.IsPriFiProtocolRunning() {
-			s.sendConnectionRequest(relayID)
-		}
-
+		// checked first, so that a client which left the session does not connect again
 		select {
 		case <-stopChan:
 			log.Lvl3("Stopping connectToRelay subroutine.")
 			return
 		default:
 		}
+
+		//log.Info("Service", s, ": Still pinging relay", !s.IsPriFiProtocolRunning())
+		if !s.IsPriFiProtocolRunning() {
+			s.sendConnectionRequest(relayID)
+		}
 	}
 }
 
@@ -9,11 +9,15 @@ package services
  */
 
 import (
+	"errors"
 	"io/ioutil"
 	"strconv"
 
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"github.com/dedis/prifi/stream-multiplexer"
+	"github.com/dedis/prifi/utils/drand"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
@@ -57,11 +61,42 @@ type ServiceState struct {
 	//this hold the running protocol (when it runs)
 	PriFiSDAProtocol *prifi_protocol.PriFiSDAProtocol
 
+	//the totals of the protocol runs which ended, for the shutdown report
+	pastRunsReport *prifilog.ShutdownReport
+
 	//used to hold "stoppers" for go-routines; send "true" to kill
 	socksStopChan []chan bool
 
+	//the SOCKS servers of this node, given to the protocol
+	socksClientConfig *prifi_protocol.SOCKSConfig
+	socksServerConfig *prifi_protocol.SOCKSConfig
+	socksPort         int //the port the client's SOCKS server actually listens on
+
+	//the client's SOCKS server, and its stopper
+	socksIngress     *stream_multiplexer.IngressServer
+	socksIngressStop chan bool
+
+	//the state set with "prifi clientctl", see client_control.go
+	clientControl clientControl
+
 	hasSocksClientGoRoutine bool
 	hasSocksServerGoRoutine bool
+
+	//tracks the relay's SOCKS streams, to drain them before a shutdown
+	egressDrain *stream_multiplexer.EgressDrain
+
+	//the relay's exit access log, nil if it is off
+	egressAccessLog *stream_multiplexer.EgressAccessLog
+
+	//if non-nil, the relay folds the value it returns into the setup of each epoch
+	randomBeaconSource func() (*crypto.RandomBeacon, error)
+}
+
+// SetRandomBeaconSource makes the relay fold the value returned by source, e.g. a public random beacon, into the
+// setup of each epoch (it replaces the drand chain set by RelayRandomBeaconURL). It must be called before the
+// protocol starts.
+func (s *ServiceState) SetRandomBeaconSource(source func() (*crypto.RandomBeacon, error)) {
+	s.randomBeaconSource = source
 }
 
 // Storage will be saved, on the contrary of the 'Service'-structure
@@ -82,12 +117,16 @@ func newService(c *onet.Context) (onet.Service, error) {
 	stopMsg := network.RegisterMessage(StopProtocol{})
 	connMsg := network.RegisterMessage(ConnectionRequest{})
 	disconnectMsg := network.RegisterMessage(DisconnectionRequest{})
+	trusteeRemovedMsg := network.RegisterMessage(TrusteeRemoved{})
+	clientLeftMsg := network.RegisterMessage(ClientLeft{})
 
 	c.RegisterProcessorFunc(helloMsg, s.HandleHelloMsg)
 	c.RegisterProcessorFunc(stopMsg, s.HandleStop)
 	c.RegisterProcessorFunc(stopSOCKSMsg, s.HandleStopSOCKS)
 	c.RegisterProcessorFunc(connMsg, s.HandleConnection)
 	c.RegisterProcessorFunc(disconnectMsg, s.HandleDisconnection)
+	c.RegisterProcessorFunc(trusteeRemovedMsg, s.HandleTrusteeRemoved)
+	c.RegisterProcessorFunc(clientLeftMsg, s.HandleClientLeft)
 
 	if err := s.tryLoad(); err != nil {
 		log.Fatal(err)
@@ -111,6 +150,9 @@ func (s *ServiceState) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.Generic
 	}
 
 	wrapper := pi.(*prifi_protocol.PriFiSDAProtocol)
+	if s.PriFiSDAProtocol != nil {
+		s.pastRunsReport = prifilog.MergeShutdownReports(s.pastRunsReport, s.PriFiSDAProtocol.ShutdownReport())
+	}
 	s.PriFiSDAProtocol = wrapper
 	s.setConfigToPriFiProtocol(wrapper)
 
@@ -134,6 +176,9 @@ func (s *ServiceState) StartRelay(group *app.Group) error {
 
 	//set state to the correct info, parse .toml
 	s.role = prifi_protocol.Relay
+	if err := s.checkListenAddresses(); err != nil {
+		return err
+	}
 	relayID, trusteesIDs := mapIdentities(group)
 	s.relayIdentity = relayID //should not be used in the case of the relay
 
@@ -147,8 +192,12 @@ func (s *ServiceState) StartRelay(group *app.Group) error {
 		s.churnHandler.startProtocol = nil
 	}
 	s.churnHandler.stopProtocol = s.StopPriFiCommunicateProtocol
+	s.churnHandler.setTrusteeQuorum(s.prifiTomlConfig.TrusteeQuorum)
+	if s.prifiTomlConfig.RelayRandomBeaconURL != "" && s.randomBeaconSource == nil {
+		s.randomBeaconSource = drand.NewSource(s.prifiTomlConfig.RelayRandomBeaconURL)
+	}
 
-	socksServerConfig = &prifi_protocol.SOCKSConfig{
+	s.socksServerConfig = &prifi_protocol.SOCKSConfig{
 		ListeningAddr:     "127.0.0.1:" + strconv.Itoa(s.prifiTomlConfig.SocksClientPort),
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
 		UpstreamChannel:   make(chan []byte),
@@ -159,28 +208,89 @@ func (s *ServiceState) StartRelay(group *app.Group) error {
 	if !s.hasSocksClientGoRoutine {
 		stopChan := make(chan bool, 1)
 		log.Lvl1("Starting EGRESS", s.prifiTomlConfig.VerboseIngressEgressServers)
-		go stream_multiplexer.StartEgressHandler(socksServerConfig.ListeningAddr, socksServerConfig.PayloadSize,
-			socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
+		accessLog, err := stream_multiplexer.NewEgressAccessLog(accessLogOptions(s.prifiTomlConfig))
+		if err != nil {
+			e := "Could not open the access log: " + err.Error()
+			log.Error(e)
+			return errors.New(e)
+		}
+		s.egressAccessLog = accessLog
+		s.egressDrain = stream_multiplexer.NewEgressDrain()
+		options := stream_multiplexer.EgressOptions{
+			Drain:       s.egressDrain,
+			AccessLog:   s.egressAccessLog,
+			IdleTimeout: time.Duration(s.prifiTomlConfig.RelaySocksIdleTimeout) * time.Second,
+		}
+		go stream_multiplexer.StartEgressHandlerWithOptions(s.socksServerConfig.ListeningAddr, s.socksServerConfig.PayloadSize, options,
+			s.socksServerConfig.UpstreamChannel, s.socksServerConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
 		s.socksStopChan = append(s.socksStopChan, stopChan)
 		s.hasSocksClientGoRoutine = true
 	}
 
 	s.connectToTrusteesStopChan = make(chan bool)
-	go s.connectToTrustees(trusteesIDs, s.connectToTrusteesStopChan)
+	go s.connectToTrustees(s.connectToTrusteesStopChan)
 
 	return nil
 }
 
+// UpdateTrustees changes the trustees of the relay to the ones of the given group. The change is applied at the
+// next epoch boundary : the current epoch ends, and the next one starts with the new trustees (as soon as enough
+// of them are connected). The clients get the new trustees' keys with the parameters of the epoch.
+func (s *ServiceState) UpdateTrustees(group *app.Group) error {
+	if s.role != prifi_protocol.Relay || s.churnHandler == nil {
+		e := "Only a started relay can update its trustees"
+		log.Error(e)
+		return errors.New(e)
+	}
+	relayID, trusteesIDs := mapIdentities(group)
+	if relayID == nil || !relayID.Equal(s.churnHandler.relayIdentity) {
+		e := "The new group does not have the same relay"
+		log.Error(e)
+		return errors.New(e)
+	}
+	if len(trusteesIDs) == 0 {
+		e := "The new group has no trustee"
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	added, removed := s.churnHandler.updateTrustees(trusteesIDs)
+	if len(added) == 0 && len(removed) == 0 {
+		log.Lvl1("The trustees did not change.")
+		return nil
+	}
+	log.Lvl1("Updating the trustees :", len(added), "added,", len(removed), "removed")
+
+	for _, v := range removed {
+		if err := s.SendRaw(v, &TrusteeRemoved{}); err != nil {
+			log.Lvl2("Could not tell", v, "that it was removed from the trustees:", err)
+		}
+	}
+	s.churnHandler.startEpochWithNewTrustees()
+	for _, v := range added {
+		s.sendHelloMessage(v)
+	}
+	return nil
+}
+
 // StartClient starts the necessary
 // protocols to enable the client-mode.
 func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error {
 	log.Info("Service", s, "running in client mode")
 	s.role = prifi_protocol.Client
+	if err := s.checkListenAddresses(); err != nil {
+		return err
+	}
 
 	relayID, trusteeIDs := mapIdentities(group)
+	if relayID == nil {
+		e := "The group has no relay"
+		log.Error(e)
+		return errors.New(e)
+	}
 	s.relayIdentity = relayID
 
-	socksClientConfig = &prifi_protocol.SOCKSConfig{
+	s.socksClientConfig = &prifi_protocol.SOCKSConfig{
 		Port:              s.prifiTomlConfig.SocksServerPort,
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
 		UpstreamChannel:   make(chan []byte),
@@ -189,15 +299,25 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 
 	//the client has a socks server
 	if !s.hasSocksServerGoRoutine {
-		log.Lvl1("Starting SOCKS server on port", socksClientConfig.Port)
-		stopChan := make(chan bool, 1)
-		go stream_multiplexer.StartIngressServer(socksClientConfig.Port, socksClientConfig.PayloadSize,
-			socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
-		s.socksStopChan = append(s.socksStopChan, stopChan)
+		log.Lvl1("Starting SOCKS server on port", s.socksClientConfig.Port)
+		if err := s.startClientSocksServer(s.socksClientConfig.Port); err != nil {
+			return err
+		}
 		s.hasSocksServerGoRoutine = true
 	}
 
-	s.connectToRelayStopChan = make(chan bool)
+	if s.prifiTomlConfig.ClientControlSocket != "" {
+		if err := s.StartClientControl(s.prifiTomlConfig.ClientControlSocket); err != nil {
+			log.Error("Could not start the control socket, \"prifi clientctl\" will not work:", err)
+		}
+	}
+	if s.prifiTomlConfig.ClientLeakDetectorApps != "" {
+		if err := s.StartLeakDetector(s.prifiTomlConfig.ClientLeakDetectorApps, s.prifiTomlConfig.ClientLeakDetectorBlock); err != nil {
+			log.Error("Could not start the leak detector:", err)
+		}
+	}
+
+	s.connectToRelayStopChan = make(chan bool, 1)
 	s.trusteeIDs = trusteeIDs
 
 	go func() {
@@ -212,45 +332,117 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 	return nil
 }
 
+// startClientSocksServer starts the client's SOCKS server on port (0 picks a free one), on the channels of
+// socksClientConfig
+func (s *ServiceState) startClientSocksServer(port int) error {
+	options, err := s.ingressOptions()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	stopChan := make(chan bool, 1)
+	ingress, err := stream_multiplexer.ListenIngressServer(port, s.socksClientConfig.PayloadSize, options,
+		s.socksClientConfig.UpstreamChannel, s.socksClientConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
+	if err != nil {
+		e := "Could not start the SOCKS server on port " + strconv.Itoa(port) + ", " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	s.socksPort = ingress.Port()
+	s.socksIngress = ingress
+	s.socksIngressStop = stopChan
+	go ingress.Serve()
+	s.socksStopChan = append(s.socksStopChan, stopChan)
+	return nil
+}
+
+// SocksPort returns the port the client's SOCKS server listens on (useful if SocksServerPort is 0), or 0 if it
+// is not started
+func (s *ServiceState) SocksPort() int {
+	return s.socksPort
+}
+
 // StartClient starts the necessary
 // protocols to enable the client-mode.
 func (s *ServiceState) StartSocksTunnelOnly() error {
 	log.Info("Service", s, "running in socks-tunnel-only mode")
 
-	socksClientConfig = &prifi_protocol.SOCKSConfig{
+	s.socksClientConfig = &prifi_protocol.SOCKSConfig{
 		Port:              s.prifiTomlConfig.SocksServerPort,
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
 		UpstreamChannel:   make(chan []byte),
 		DownstreamChannel: make(chan []byte),
 	}
 
-	socksServerConfig = &prifi_protocol.SOCKSConfig{
+	s.socksServerConfig = &prifi_protocol.SOCKSConfig{
 		ListeningAddr:     "127.0.0.1:" + strconv.Itoa(s.prifiTomlConfig.SocksClientPort),
 		PayloadSize:       s.prifiTomlConfig.PayloadSize,
-		UpstreamChannel:   socksClientConfig.UpstreamChannel,
-		DownstreamChannel: socksClientConfig.DownstreamChannel,
+		UpstreamChannel:   s.socksClientConfig.UpstreamChannel,
+		DownstreamChannel: s.socksClientConfig.DownstreamChannel,
 	}
 	stopChan1 := make(chan bool, 1)
 	stopChan2 := make(chan bool, 1)
-	go stream_multiplexer.StartIngressServer(socksClientConfig.Port, socksClientConfig.PayloadSize, socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan1, s.prifiTomlConfig.VerboseIngressEgressServers)
-	go stream_multiplexer.StartEgressHandler(socksServerConfig.ListeningAddr, socksClientConfig.PayloadSize, socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan2, s.prifiTomlConfig.VerboseIngressEgressServers)
+	go stream_multiplexer.StartIngressServerWithOptions(s.socksClientConfig.Port, s.socksClientConfig.PayloadSize, stream_multiplexer.IngressOptions{
+		ListenAddress: s.prifiTomlConfig.ClientSocksListenAddress,
+		AuthToken:     s.prifiTomlConfig.ClientSocksAuthToken,
+	}, s.socksClientConfig.UpstreamChannel, s.socksClientConfig.DownstreamChannel, stopChan1, s.prifiTomlConfig.VerboseIngressEgressServers)
+	go stream_multiplexer.StartEgressHandler(s.socksServerConfig.ListeningAddr, s.socksClientConfig.PayloadSize, s.socksServerConfig.UpstreamChannel, s.socksServerConfig.DownstreamChannel, stopChan2, s.prifiTomlConfig.VerboseIngressEgressServers)
 	s.socksStopChan = append(s.socksStopChan, stopChan1)
 	s.socksStopChan = append(s.socksStopChan, stopChan2)
 
 	return nil
 }
 
+// ingressOptions returns the options of the client's SOCKS server
+func (s *ServiceState) ingressOptions() (stream_multiplexer.IngressOptions, error) {
+	if s.prifiTomlConfig.ClientSocksListenAddress == "" {
+		log.Lvl1("The SOCKS server listens on all interfaces; set ClientSocksListenAddress to restrict it")
+	}
+	failureMode, err := stream_multiplexer.ParseFailureMode(s.prifiTomlConfig.ClientSocksFailureMode)
+	if err != nil {
+		return stream_multiplexer.IngressOptions{}, errors.New("ClientSocksFailureMode : " + err.Error())
+	}
+	if failureMode == stream_multiplexer.INGRESS_FAIL_OPEN {
+		log.Warn("ClientSocksFailureMode is " + string(failureMode) + " : while the DC-net is down, the SOCKS connections go directly to their destination, without anonymity")
+	}
+	return stream_multiplexer.IngressOptions{
+		ListenAddress:     s.prifiTomlConfig.ClientSocksListenAddress,
+		UpstreamCredits:   s.prifiTomlConfig.ClientSocksUpstreamCredits,
+		AuthToken:         s.prifiTomlConfig.ClientSocksAuthToken,
+		KeepaliveInterval: time.Duration(s.prifiTomlConfig.ClientSocksKeepaliveInterval) * time.Second,
+		FailureMode:       failureMode,
+		DCNetUp:           s.dcNetUp,
+		Credentials:       s.socksCredentials,
+	}, nil
+}
+
+// dcNetUp returns true if the client takes part in the rounds of a running protocol
+func (s *ServiceState) dcNetUp() bool {
+	return s.IsPriFiProtocolRunning() && s.PriFiSDAProtocol.DCNetUp()
+}
+
+// socksCredentials returns the username/password pairs the relay gave to the client of the running protocol
+func (s *ServiceState) socksCredentials() map[string]string {
+	if !s.IsPriFiProtocolRunning() {
+		return nil
+	}
+	return s.PriFiSDAProtocol.SOCKSCredentials()
+}
+
 // StartTrustee starts the necessary
 // protocols to enable the trustee-mode.
 func (s *ServiceState) StartTrustee(group *app.Group) error {
 	log.Info("Service", s, "running in trustee mode")
 	s.role = prifi_protocol.Trustee
+	if err := s.checkListenAddresses(); err != nil {
+		return err
+	}
 
 	//the this might fail if the relay is behind a firewall. The HelloMsg is to fix this
 	relayID, _ := mapIdentities(group)
 	s.relayIdentity = relayID
 
-	s.connectToRelayStopChan = make(chan bool)
+	s.connectToRelayStopChan = make(chan bool, 1)
 	go s.connectToRelay(relayID, s.connectToRelayStopChan)
 
 	return nil
@@ -259,10 +451,22 @@ func (s *ServiceState) StartTrustee(group *app.Group) error {
 // CleanResources kill all goroutines related to SOCKS on this service
 func (s *ServiceState) ShutdownSocks() error {
 	log.Lvl2("Stopping service's SOCKS goroutines.")
+	s.clientControl.Lock()
+	defer s.clientControl.Unlock()
 
 	for _, v := range s.socksStopChan {
 		v <- true
 	}
+	s.socksStopChan = nil
+	if s.egressAccessLog != nil {
+		s.egressAccessLog.Close()
+		s.egressAccessLog = nil
+	}
+	s.hasSocksClientGoRoutine = false
+	s.hasSocksServerGoRoutine = false
+	s.socksPort = 0
+	s.socksIngress = nil
+	s.socksIngressStop = nil
 
 	return nil
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	prifi_service "github.com/dedis/prifi/sda/services"
 	"go.dedis.ch/onet/v3"
@@ -125,6 +128,9 @@ func (s *SimulationService) Node(config *onet.SimulationConfig) error {
 		log.Lvl3("Overriding log level (from .toml) to", s.OverrideLogLevel)
 		log.SetDebugVisible(s.OverrideLogLevel)
 	}
+	if err := prifilog.SetModuleLevels(s.LogLevels); err != nil {
+		log.Error("Could not set the log levels of the modules (LogLevels):", err)
+	}
 	if s.ForceConsoleColor {
 		log.Lvl3("Forcing the console output to be colored (from .toml)")
 		log.SetUseColors(true)
@@ -188,22 +194,20 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	log.Info("Starting experiment", simulationID)
 	startTime := time.Now()
 
-	//Give more time to the nodes to initialize (specifically, to
-	for !service.HasEnoughParticipants() {
-		t, c := service.CountParticipants()
-		log.Info("Not enough participants (", t, "trustees,", c, "clients), sleeping 10 seconds...")
-		time.Sleep(10 * time.Second)
+	//Give more time to the nodes to initialize (specifically, to connect to the relay)
+	if err := service.WaitForEnoughParticipants(context.Background()); err != nil {
+		log.Error("Could not wait for the participants:", err)
+		return err
 	}
 
 	service.RelayAllowAutoStart()
 	service.StartPriFiCommunicateProtocol()
 
-	//the art of programming : waiting for the channel to be created (not even thread safe!)
-	for service.PriFiSDAProtocol == nil {
-		time.Sleep(10 * time.Millisecond)
-	}
-	for service.PriFiSDAProtocol.ResultChannel == nil {
-		time.Sleep(10 * time.Millisecond)
+	//the protocol and its result channel are created by StartPriFiCommunicateProtocol
+	if service.PriFiSDAProtocol == nil || service.PriFiSDAProtocol.ResultChannel == nil {
+		e := "The PriFi protocol did not start"
+		log.Error(e)
+		return errors.New(e)
 	}
 
 	//block and get the result from the channel
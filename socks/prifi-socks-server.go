@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"github.com/armon/go-socks5"
+	"github.com/dedis/prifi/prifi-lib/config"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
 )
@@ -18,6 +19,7 @@ func main() {
 	// Command-line flags
 	var debugFlag = flag.Int("debug", defaultBugLevel, "debug-level")
 	var portFlag = flag.Int("port", defaultPort, "port")
+	var credentialsFlag = flag.String("credentials", "", "if set, the username:password pairs (comma-separated) the SOCKS5 clients must give")
 	flag.Parse()
 	log.SetDebugVisible(*debugFlag)
 
@@ -35,8 +37,16 @@ func main() {
 
 	log.Lvl2("Starting a SOCKS5 server...")
 
-	// Create a SOCKS5 server
+	// Create a SOCKS5 server, with the username/password authentication (RFC 1929) if credentials are given
 	conf := &socks5.Config{}
+	credentials, err := config.ParseSOCKSCredentials(*credentialsFlag)
+	if err != nil {
+		log.Fatal("Invalid credentials,", err)
+	}
+	if len(credentials) > 0 {
+		log.Lvl2("The SOCKS5 clients must give one of", len(credentials), "username/password pairs")
+		conf.Credentials = socks5.StaticCredentials(credentials)
+	}
 	server, err := socks5.New(conf)
 	if err != nil {
 		panic(err)
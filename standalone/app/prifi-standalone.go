@@ -0,0 +1,520 @@
+/*
+Prifi-standalone runs a PriFi relay, client or trustee without the cothority stack: the nodes connect directly to
+the relay over TCP (see the standalone package), and the clients may send the data of the rounds over another
+transport (RelayTransports, ClientTransport). There is no group file; the relay waits for the given number of clients
+and trustees, then starts the protocol once. Clients started later with the next IDs join during the session. UDP
+broadcast is not supported.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/config"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/standalone"
+	"github.com/dedis/prifi/standalone/conformance"
+	stream_multiplexer "github.com/dedis/prifi/stream-multiplexer"
+	"github.com/dedis/prifi/utils/audit"
+	"github.com/dedis/prifi/utils/drand"
+	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DefaultRelayAddress is where the relay listens, and where the nodes connect by default
+const DefaultRelayAddress = "127.0.0.1:7000"
+
+// LeaveTimeout is how long a client interrupted waits for the relay to remove it from the session, before shutting
+// down anyway
+const LeaveTimeout = 10 * time.Second
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "prifi-standalone"
+	app.Usage = "Starts PriFi in either Trustee, Relay or Client mode, without the cothority."
+	app.Version = "0.1"
+	app.Commands = []cli.Command{
+		{
+			Name:    "relay",
+			Usage:   "start in relay mode",
+			Aliases: []string{"r"},
+			Action:  startRelay,
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "clients", Value: 1, Usage: "number of clients to wait for"},
+				cli.IntFlag{Name: "trustees", Value: 1, Usage: "number of trustees to wait for"},
+			},
+		},
+		{
+			Name:    "client",
+			Usage:   "start in client mode",
+			Aliases: []string{"c"},
+			Action:  startClient,
+			Flags:   []cli.Flag{cli.IntFlag{Name: "id", Usage: "ID of this client, from 0 to clients-1"}},
+		},
+		{
+			Name:    "trustee",
+			Usage:   "start in trustee mode",
+			Aliases: []string{"t"},
+			Action:  startTrustee,
+			Flags:   []cli.Flag{cli.IntFlag{Name: "id", Usage: "ID of this trustee, from 0 to trustees-1"}},
+		},
+		{
+			Name:   "audit-sink",
+			Usage:  "receive and check the probes of the audit clients of the trustees",
+			Action: runAuditSink,
+			Flags:  []cli.Flag{cli.StringFlag{Name: "listen", Value: ":7100", Usage: "address to listen on"}},
+		},
+		{
+			Name:   "conformance",
+			Usage:  "check that an implementation of a role follows the protocol",
+			Action: runConformance,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "role", Value: "all", Usage: "role to check : relay, client, trustee or all"},
+				cli.StringFlag{Name: "exec", Usage: "command running the implementation, with {role}, {id} and {relay}; prifi-lib if empty"},
+			},
+		},
+	}
+	app.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+		cli.StringFlag{
+			Name:  "prifi_config, pc",
+			Value: "config/prifi.toml",
+			Usage: "PriFi's configuration file",
+		},
+		cli.StringFlag{
+			Name:  "relay",
+			Value: DefaultRelayAddress,
+			Usage: "address the nodes connect to, and the relay listens on unless RelayListenAddress is set",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.GlobalInt("debug"))
+		return nil
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readPriFiConfig reads the prifi.toml file given by the flag prifi_config
+func readPriFiConfig(c *cli.Context) (map[string]interface{}, error) {
+	cfile := c.GlobalString("prifi_config")
+	tomlRawData, err := ioutil.ReadFile(cfile)
+	if err != nil {
+		log.Error("Could not read file \"", cfile, "\" (specified by flag prifi_config)")
+		return nil, err
+	}
+	tomlConfig, err := standalone.ParseToml(string(tomlRawData))
+	if err != nil {
+		return nil, err
+	}
+	if err := prifilog.SetModuleLevels(standalone.StringOrElse(tomlConfig, "LogLevels", "")); err != nil {
+		log.Error("Could not set the log levels of the modules (LogLevels):", err)
+		return nil, err
+	}
+	if err := standalone.ApplyCryptoSuite(tomlConfig); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return tomlConfig, nil
+}
+
+// shutdownOnInterrupt stops the PriFi instance on Ctrl-C or SIGTERM, and exits with a nonzero status if the shutdown
+// report says the session ended abnormally. A client first leaves the session, so that the others do not wait for it.
+func shutdownOnInterrupt(instance *prifi_lib.PriFiLibInstance, closeFn func() error) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupt
+		log.Lvl1("Received", sig, ", shutting down")
+		if left, err := instance.LeaveSession(); err == nil {
+			select {
+			case <-left:
+			case <-interrupt:
+				log.Lvl1("Interrupted again, not waiting for the relay to remove us from the session")
+			case <-time.After(LeaveTimeout):
+				log.Error("The relay did not remove us from the session after", LeaveTimeout, ", shutting down anyway")
+			}
+		}
+		instance.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+		closeFn()
+		os.Exit(instance.ShutdownReport().ExitCode())
+	}()
+}
+
+func startRelay(c *cli.Context) error {
+	tomlConfig, err := readPriFiConfig(c)
+	if err != nil {
+		return err
+	}
+	nClients, nTrustees := c.Int("clients"), c.Int("trustees")
+	params, err := standalone.RelayParameters(tomlConfig, nClients, nTrustees)
+	if err != nil {
+		return err
+	}
+	if beaconURL := standalone.StringOrElse(tomlConfig, "RelayRandomBeaconURL", ""); beaconURL != "" {
+		beacon, err := drand.FetchLatest(beaconURL)
+		if err != nil {
+			log.Error("Standalone : could not get the random beacon, using the relay's randomness only:", err)
+		} else {
+			params.Add("RelayRandomBeacon", beacon.String())
+		}
+	}
+
+	listenAddress := standalone.StringOrElse(tomlConfig, "RelayListenAddress", "")
+	if listenAddress == "" {
+		listenAddress = c.GlobalString("relay")
+	}
+	listenAddresses, err := standalone.RelayListenAddresses(tomlConfig, listenAddress)
+	if err == nil {
+		err = config.CheckListenAddresses(listenAddresses)
+	}
+	if err != nil {
+		log.Error("Standalone : invalid listen addresses in prifi.toml,", err)
+		return err
+	}
+
+	transport, err := standalone.NewRelayTransport(listenAddress)
+	if err != nil {
+		return err
+	}
+
+	// the relay has a socks client
+	payloadSize := standalone.IntOrElse(tomlConfig, "PayloadSize", 1000)
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte)
+	socksAddress := "127.0.0.1:" + strconv.Itoa(standalone.IntOrElse(tomlConfig, "SocksClientPort", 8090))
+	verbose := standalone.BoolOrElse(tomlConfig, "VerboseIngressEgressServers", false)
+	accessLog, err := stream_multiplexer.NewEgressAccessLog(stream_multiplexer.EgressAccessLogOptions{
+		Mode:            standalone.StringOrElse(tomlConfig, "RelayAccessLog", stream_multiplexer.ACCESS_LOG_OFF),
+		Path:            standalone.StringOrElse(tomlConfig, "RelayAccessLogFile", ""),
+		MaxBytes:        int64(standalone.IntOrElse(tomlConfig, "RelayAccessLogMaxSize", 10)) * 1024 * 1024,
+		MaxFiles:        standalone.IntOrElse(tomlConfig, "RelayAccessLogMaxFiles", 5),
+		AggregatePeriod: time.Duration(standalone.IntOrElse(tomlConfig, "RelayAccessLogAggregatePeriod", 3600)) * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	egressOptions := stream_multiplexer.EgressOptions{
+		AccessLog:   accessLog,
+		IdleTimeout: time.Duration(standalone.IntOrElse(tomlConfig, "RelaySocksIdleTimeout", 0)) * time.Second,
+	}
+	go stream_multiplexer.StartEgressHandlerWithOptions(socksAddress, payloadSize, egressOptions, upstreamChan, downstreamChan, make(chan bool, 1), verbose)
+
+	resultChan := make(chan interface{}, 100)
+	go func() {
+		for res := range resultChan {
+			log.Lvl1("Experiment result:", res)
+		}
+	}()
+	timeoutHandler := func(clients, trustees []int) {
+		log.Error("Relay : round timed out, missing clients", clients, "and trustees", trustees)
+	}
+	relay := prifi_lib.NewPriFiRelay(standalone.BoolOrElse(tomlConfig, "RelayDataOutputEnabled", true),
+		downstreamChan, upstreamChan, resultChan, timeoutHandler, transport)
+	shutdownOnInterrupt(relay, func() error {
+		accessLog.Close()
+		return transport.Close()
+	})
+
+	// the clients after the first nClients join during the session
+	transport.ClientJoined = func(clientID int) {
+		if clientID < nClients {
+			return
+		}
+		if err := relay.AdmitClient(clientID); err != nil {
+			log.Error("Relay : could not admit client", clientID, ";", err)
+		}
+	}
+	go transport.Serve(relay.ReceivedMessage)
+	if err := serveDataTransports(transport, standalone.StringOrElse(tomlConfig, "RelayTransports", ""), relay.ReceivedMessage); err != nil {
+		transport.Close()
+		return err
+	}
+	log.Lvl1("Relay listening on", transport.Addr(), ", waiting for", nClients, "clients and", nTrustees, "trustees")
+	transport.WaitForNodes(nClients, nTrustees)
+
+	log.Lvl1("All nodes connected, starting the protocol")
+	if err := relay.ReceivedMessage(*params); err != nil {
+		return err
+	}
+	select {}
+}
+
+// serveDataTransports listens on the port of each transport offered to the clients in RelayTransports
+func serveDataTransports(transport *standalone.RelayTransport, transportOffers string, received func(interface{}) error) error {
+	offers, err := net.ParseTransportOffers(transportOffers)
+	if err != nil {
+		log.Error("Standalone : invalid RelayTransports:", err)
+		return err
+	}
+	for _, offer := range offers {
+		t, err := net.NewTransport(offer.Name)
+		if err != nil {
+			log.Error("Standalone : invalid RelayTransports:", err)
+			return err
+		}
+		_, port, err := gonet.SplitHostPort(offer.Address)
+		if err != nil {
+			log.Error("Standalone : invalid address of the", offer.Name, "transport in RelayTransports:", err)
+			return err
+		}
+		listener, err := t.Listen(":" + port)
+		if err != nil {
+			log.Error("Standalone : could not listen on the", offer.Name, "transport:", err)
+			return err
+		}
+		log.Lvl1("Relay offers the", offer.Name, "transport on", listener.Addr(), ", reached at", offer.Address)
+		go transport.ServeData(t, listener, received)
+	}
+	return nil
+}
+
+// dialRelay connects to the relay given by the flag relay, waiting at most a minute for it
+func dialRelay(c *cli.Context, role standalone.Role) (*standalone.NodeTransport, error) {
+	if c.Int("id") < 0 {
+		return nil, errors.New("the id must be positive")
+	}
+	return standalone.DialRelay(c.GlobalString("relay"), role, c.Int("id"), time.Minute)
+}
+
+func startClient(c *cli.Context) error {
+	tomlConfig, err := readPriFiConfig(c)
+	if err != nil {
+		return err
+	}
+	if err := config.CheckListenAddresses(standalone.ClientListenAddresses(tomlConfig)); err != nil {
+		log.Error("Standalone : invalid listen addresses in prifi.toml,", err)
+		return err
+	}
+	clientTransport := standalone.StringOrElse(tomlConfig, "ClientTransport", "")
+	if clientTransport != "" {
+		if _, err := net.NewTransport(clientTransport); err != nil {
+			log.Error("Standalone : invalid ClientTransport,", err)
+			return err
+		}
+	}
+	transport, err := dialRelay(c, standalone.CLIENT)
+	if err != nil {
+		return err
+	}
+	transport.PreferTransport(clientTransport)
+
+	// the client has a socks server
+	payloadSize := standalone.IntOrElse(tomlConfig, "PayloadSize", 1000)
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte)
+	failureMode, err := stream_multiplexer.ParseFailureMode(standalone.StringOrElse(tomlConfig, "ClientSocksFailureMode", ""))
+	if err != nil {
+		log.Error("ClientSocksFailureMode :", err)
+		return err
+	}
+	client := prifi_lib.NewPriFiClient(standalone.BoolOrElse(tomlConfig, "DoLatencyTests", false),
+		standalone.BoolOrElse(tomlConfig, "EncryptLatencyTests", false),
+		standalone.BoolOrElse(tomlConfig, "ClientDataOutputEnabled", true),
+		upstreamChan, downstreamChan,
+		standalone.BoolOrElse(tomlConfig, "ReplayPCAP", false),
+		standalone.StringOrElse(tomlConfig, "PCAPFolder", ""),
+		standalone.StringOrElse(tomlConfig, "ClientTrafficShapingProfile", ""),
+		standalone.IntOrElse(tomlConfig, "ClientSlotsPerSchedule", 1),
+		standalone.StringOrElse(tomlConfig, "ClientCellCaptureFile", ""),
+		standalone.IntOrElse(tomlConfig, "ClientUDPVerificationRate", 0),
+		standalone.IntOrElse(tomlConfig, "ClientUDPVerificationMaxDivergences", 0),
+		transport)
+	client.SetLatencyTestInterval(time.Duration(standalone.IntOrElse(tomlConfig, "ClientLatencyTestInterval", 0)) * time.Millisecond)
+
+	// the SOCKS server only uses the DC-net once the client takes part in the rounds
+	options := stream_multiplexer.IngressOptions{
+		ListenAddress:     standalone.StringOrElse(tomlConfig, "ClientSocksListenAddress", ""),
+		UpstreamCredits:   standalone.IntOrElse(tomlConfig, "ClientSocksUpstreamCredits", 0),
+		AuthToken:         standalone.StringOrElse(tomlConfig, "ClientSocksAuthToken", ""),
+		KeepaliveInterval: time.Duration(standalone.IntOrElse(tomlConfig, "ClientSocksKeepaliveInterval", 60)) * time.Second,
+		FailureMode:       failureMode,
+		DCNetUp:           client.DCNetUp,
+		Credentials:       client.SOCKSCredentials,
+	}
+	if failureMode == stream_multiplexer.INGRESS_FAIL_OPEN {
+		log.Warn("ClientSocksFailureMode is " + string(failureMode) + " : while the DC-net is down, the SOCKS connections go directly to their destination, without anonymity")
+	}
+	port := standalone.IntOrElse(tomlConfig, "SocksServerPort", 8080)
+	verbose := standalone.BoolOrElse(tomlConfig, "VerboseIngressEgressServers", false)
+	go stream_multiplexer.StartIngressServerWithOptions(port, payloadSize, options, upstreamChan, downstreamChan, make(chan bool, 1), verbose)
+	shutdownOnInterrupt(client, transport.Close)
+
+	log.Lvl1("Client", c.Int("id"), "connected to the relay, SOCKS server on port", port)
+	return transport.Serve(client.ReceivedMessage)
+}
+
+func startTrustee(c *cli.Context) error {
+	tomlConfig, err := readPriFiConfig(c)
+	if err != nil {
+		return err
+	}
+	transport, err := dialRelay(c, standalone.TRUSTEE)
+	if err != nil {
+		return err
+	}
+
+	trustee := prifi_lib.NewPriFiTrustee(standalone.BoolOrElse(tomlConfig, "TrusteeNeverSlowDown", false),
+		standalone.BoolOrElse(tomlConfig, "TrusteeAlwaysSlowDown", false),
+		standalone.IntOrElse(tomlConfig, "TrusteeSleepTimeBetweenMessages", 0),
+		standalone.IntOrElse(tomlConfig, "TrusteeCPUBudget", 0),
+		transport)
+	closeFn := transport.Close
+	if sinkAddress := standalone.StringOrElse(tomlConfig, "TrusteeAuditSinkAddress", ""); sinkAddress != "" {
+		stopAudit, err := startAuditClient(c, tomlConfig, sinkAddress)
+		if err != nil {
+			transport.Close()
+			return err
+		}
+		closeFn = func() error {
+			stopAudit()
+			return transport.Close()
+		}
+	}
+	shutdownOnInterrupt(trustee, closeFn)
+
+	log.Lvl1("Trustee", c.Int("id"), "connected to the relay")
+	return transport.Serve(trustee.ReceivedMessage)
+}
+
+// startAuditClient starts the hidden audit client of a trustee : a client of the group, with the ID
+// TrusteeAuditClientID, whose SOCKS server only listens for the prober sending known-plaintext probes to the sink. It
+// returns the function stopping it.
+func startAuditClient(c *cli.Context, tomlConfig map[string]interface{}, sinkAddress string) (func(), error) {
+	clientID := standalone.IntOrElse(tomlConfig, "TrusteeAuditClientID", -1)
+	if clientID < 0 {
+		return nil, errors.New("TrusteeAuditSinkAddress needs the ID of the audit client, TrusteeAuditClientID")
+	}
+	secret := standalone.StringOrElse(tomlConfig, "TrusteeAuditKey", "")
+	if secret == "" {
+		return nil, errors.New("TrusteeAuditSinkAddress needs the key shared with the sink, TrusteeAuditKey")
+	}
+	transport, err := standalone.DialRelay(c.GlobalString("relay"), standalone.CLIENT, clientID, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	// an ordinary client, so that the relay cannot tell it from the others
+	payloadSize := standalone.IntOrElse(tomlConfig, "PayloadSize", 1000)
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte)
+	client := prifi_lib.NewPriFiClient(false, false, true, upstreamChan, downstreamChan, false, "",
+		standalone.StringOrElse(tomlConfig, "ClientTrafficShapingProfile", ""),
+		standalone.IntOrElse(tomlConfig, "ClientSlotsPerSchedule", 1),
+		"", 0, 0, transport)
+
+	// the probes must never leave without the DC-net, whatever ClientSocksFailureMode is
+	options := stream_multiplexer.IngressOptions{
+		ListenAddress: "127.0.0.1",
+		FailureMode:   stream_multiplexer.INGRESS_FAIL_CLOSED,
+		DCNetUp:       client.DCNetUp,
+	}
+	socksServer, err := stream_multiplexer.ListenIngressServer(0, payloadSize, options, upstreamChan, downstreamChan, make(chan bool, 1), false)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	go socksServer.Serve()
+	go func() {
+		if err := transport.Serve(client.ReceivedMessage); err != nil {
+			log.Error("Audit client : connection to the relay lost;", err)
+		}
+	}()
+
+	prober := audit.NewProber(audit.ProberConfig{
+		SocksAddress: "127.0.0.1:" + strconv.Itoa(socksServer.Port()),
+		SinkAddress:  sinkAddress,
+		Key:          audit.DeriveKey(secret),
+		Interval:     time.Duration(standalone.IntOrElse(tomlConfig, "TrusteeAuditInterval", 60)) * time.Second,
+		Size:         standalone.IntOrElse(tomlConfig, "TrusteeAuditProbeSize", audit.DEFAULT_PROBE_SIZE),
+	})
+	stopProber := make(chan bool, 1)
+	go prober.Run(stopProber)
+	log.Lvl1("Audit client", clientID, "connected to the relay, probing", sinkAddress)
+
+	return func() {
+		stopProber <- true
+		if left, err := client.LeaveSession(); err == nil {
+			select {
+			case <-left:
+			case <-time.After(LeaveTimeout):
+			}
+		}
+		client.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+		socksServer.Stop()
+		transport.Close()
+		stats := prober.Statistics()
+		log.Lvl1("Audit client :", stats.Sent, "probes sent,", stats.Intact, "intact,", stats.Corrupted, "corrupted,", stats.Failed, "failed")
+	}, nil
+}
+
+// runAuditSink receives the probes of the audit clients of the trustees, and checks them
+func runAuditSink(c *cli.Context) error {
+	tomlConfig, err := readPriFiConfig(c)
+	if err != nil {
+		return err
+	}
+	secret := standalone.StringOrElse(tomlConfig, "TrusteeAuditKey", "")
+	if secret == "" {
+		return errors.New("the sink needs the key shared with the audit clients, TrusteeAuditKey")
+	}
+	sink, err := audit.ListenSink(c.String("listen"), audit.DeriveKey(secret))
+	if err != nil {
+		return err
+	}
+	log.Lvl1("Audit sink listening on", sink.Addr())
+	return sink.Serve()
+}
+
+// runConformance plays the scenarios of the conformance package against the implementation given by the flag exec,
+// or against prifi-lib, and fails if any scenario fails
+func runConformance(c *cli.Context) error {
+	roles := []string{conformance.RELAY, conformance.CLIENT, conformance.TRUSTEE}
+	if role := c.String("role"); role != "all" {
+		if conformance.Scenarios(role) == nil {
+			return errors.New("unknown role \"" + role + "\", valid are relay, client, trustee and all")
+		}
+		roles = []string{role}
+	}
+
+	failed := 0
+	for _, role := range roles {
+		for _, scenario := range conformance.Scenarios(role) {
+			var node conformance.Node = new(conformance.LibNode)
+			if commandLine := c.String("exec"); commandLine != "" {
+				commandNode, err := conformance.NewCommandNode(commandLine)
+				if err != nil {
+					return err
+				}
+				if log.DebugVisible() > 0 {
+					commandNode.Output = os.Stderr
+				}
+				node = commandNode
+			}
+			result := conformance.Run(node, scenario)
+			fmt.Println(result)
+			if !result.Passed() {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return errors.New(strconv.Itoa(failed) + " scenarios failed")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package standalone
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/protobuf"
+)
+
+// MAX_FRAME_SIZE is the maximum size of an encoded message; larger frames are refused
+const MAX_FRAME_SIZE = 64 * 1024 * 1024
+
+// the types of net.NetworkMessages(), by name
+var messageTypes = make(map[string]reflect.Type)
+
+// the constructors of the interfaces found in the messages, for the decoding
+var constructors = make(protobuf.Constructors)
+
+func init() {
+	for _, msg := range net.NetworkMessages() {
+		t := reflect.TypeOf(msg)
+		messageTypes[t.Name()] = t
+	}
+
+	var point kyber.Point
+	var scalar kyber.Scalar
+	constructors[reflect.TypeOf(&point).Elem()] = func() interface{} { return config.CryptoSuite.Point() }
+	constructors[reflect.TypeOf(&scalar).Elem()] = func() interface{} { return config.CryptoSuite.Scalar() }
+}
+
+// encodeMessage encodes one of net.NetworkMessages() (or a pointer to it) as its type name, followed by the message
+// in protobuf
+func encodeMessage(msg interface{}) ([]byte, error) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	name := v.Type().Name()
+	if _, ok := messageTypes[name]; !ok {
+		return nil, errors.New("Cannot encode message of unknown type " + v.Type().String())
+	}
+
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	body, err := protobuf.Encode(ptr.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2+len(name)+len(body))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(name)))
+	copy(buf[2:], name)
+	copy(buf[2+len(name):], body)
+	return buf, nil
+}
+
+// decodeMessage decodes a message encoded by encodeMessage, and returns it by value, as the prifi-lib expects
+func decodeMessage(buf []byte) (interface{}, error) {
+	if len(buf) < 2 || len(buf) < 2+int(binary.BigEndian.Uint16(buf[0:2])) {
+		return nil, errors.New("Message too short")
+	}
+	nameLength := int(binary.BigEndian.Uint16(buf[0:2]))
+	name := string(buf[2 : 2+nameLength])
+	t, ok := messageTypes[name]
+	if !ok {
+		return nil, errors.New("Cannot decode message of unknown type " + name)
+	}
+
+	ptr := reflect.New(t)
+	if err := protobuf.DecodeWithConstructors(buf[2+nameLength:], ptr.Interface(), constructors); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// writeFrame writes data prefixed by its length
+func writeFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	copy(buf[4:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads data written by writeFrame
+func readFrame(r io.Reader) ([]byte, error) {
+	return readFrameWithLimit(r, MAX_FRAME_SIZE)
+}
+
+// readFrameWithLimit reads data written by writeFrame, and refuses frames larger than maxSize before reading them
+func readFrameWithLimit(r io.Reader, maxSize uint32) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Truncated frame header")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxSize {
+		return nil, errors.New("Frame too large, " + strconv.FormatUint(uint64(length), 10) + " bytes, at most " +
+			strconv.FormatUint(uint64(maxSize), 10) + " expected")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, errors.New("Truncated frame, expected " + strconv.FormatUint(uint64(length), 10) + " bytes")
+		}
+		return nil, err
+	}
+	return data, nil
+}
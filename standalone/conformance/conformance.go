@@ -0,0 +1,380 @@
+/*
+Package conformance checks that an implementation of a PriFi role follows the protocol. The harness plays the other
+entities of a small group (one relay, one client, one trustee) over the standalone transport, sends the node under
+test scripted messages, and checks the messages it answers with : their type, their content, and the cryptography
+(the shuffle, its signature, and the DC-net cells, which must decode to the expected plaintext). If the node reports
+its state, the harness checks its state transitions too.
+
+A scenario is a list of steps; each step optionally sends a message from one of the entities played by the harness,
+then optionally expects the next message the node sends to it. The scenarios of Scenarios(role) follow the setup of
+the protocol until the first rounds; they run against the prifi-lib implementation (LibNode), or against any other
+implementation started as a command (CommandNode), e.g. with "prifi-standalone conformance".
+*/
+package conformance
+
+import (
+	"errors"
+	gonet "net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dedis/prifi/standalone"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The roles of a node under test
+const (
+	RELAY   = "relay"
+	CLIENT  = "client"
+	TRUSTEE = "trustee"
+)
+
+// STEP_TIMEOUT is how long the harness waits for the message, or the state, expected by a step
+const STEP_TIMEOUT = 10 * time.Second
+
+// Node is an implementation of a PriFi role under test
+type Node interface {
+	// Start starts the node with the given role and ID. A client or a trustee connects to the relay at relayAddr; a
+	// relay listens on relayAddr, and starts the protocol once one client and one trustee are connected.
+	Start(role string, id int, relayAddr string) error
+
+	// Stop stops the node, and frees its resources
+	Stop() error
+}
+
+// StateReporter is implemented by the nodes whose state can be observed, e.g. the ones running in this process
+type StateReporter interface {
+	// State returns the current state of the node, e.g. "READY"
+	State() string
+}
+
+// Peer is an entity played by the harness
+type Peer struct {
+	Role string
+	ID   int
+}
+
+// RelayPeer is the relay played by the harness, when a client or a trustee is tested
+var RelayPeer = Peer{Role: RELAY}
+
+func (p Peer) String() string {
+	if p.Role == RELAY {
+		return RELAY
+	}
+	return p.Role + " " + strconv.Itoa(p.ID)
+}
+
+// Step is one exchange with the node under test
+type Step struct {
+	Name string
+
+	// the entity played by the harness which sends the message, and to which the node answers; for a client or a
+	// trustee under test, always RelayPeer
+	Peer Peer
+
+	// builds the message Peer sends to the node, if any
+	Send func(s *Session) (interface{}, error)
+
+	// the type of the next message the node must send to Peer, e.g. "CLI_REL_TELL_PK_AND_EPH_PK", if any
+	Expect string
+
+	// checks the message expected, if any
+	Check func(s *Session, msg interface{}) error
+
+	// the state the node must be in after this step, if it reports its state
+	State string
+}
+
+// Scenario is a scripted sequence of steps, for a node with the given role
+type Scenario struct {
+	Name string
+	Role string
+
+	// for a relay under test, the entities the harness connects as; the relay must wait for exactly those
+	Peers []Peer
+
+	// the types of the messages the node may send at any time, e.g. the load reports of a trustee; they are skipped
+	// when a step expects a message
+	Ignore []string
+
+	Steps []Step
+
+	// how long each step waits, STEP_TIMEOUT if 0
+	Timeout time.Duration
+}
+
+// StepResult is the outcome of one step
+type StepResult struct {
+	Name         string
+	Err          error  // nil if the node behaved as expected
+	State        string // the state expected after the step, if any
+	StateChecked bool   // true if the node reported its state, and it was checked
+}
+
+// Result is the outcome of a scenario
+type Result struct {
+	Scenario string
+	Role     string
+	Steps    []StepResult // the steps run, until the first failure
+	Err      error        // the first failure, nil if the node conforms
+}
+
+// Passed returns true if the node behaved as expected in every step
+func (r *Result) Passed() bool {
+	return r.Err == nil
+}
+
+func (r *Result) String() string {
+	lines := []string{r.Role + " / " + r.Scenario + " :"}
+	for _, s := range r.Steps {
+		status := "ok"
+		if s.Err != nil {
+			status = "FAILED, " + s.Err.Error()
+		} else if s.State != "" && !s.StateChecked {
+			status = "ok (state " + s.State + " not checked)"
+		}
+		lines = append(lines, "  "+s.Name+" : "+status)
+	}
+	if r.Err != nil && len(r.Steps) == 0 {
+		lines = append(lines, "  FAILED, "+r.Err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// received is a message the node sent to one of the entities played by the harness
+type received struct {
+	to  Peer
+	msg interface{}
+}
+
+// harness holds the connections of the entities played by the harness with the node under test
+type harness struct {
+	inbox   chan received
+	pending []received
+	done    chan bool
+	send    func(to Peer, msg interface{}) error
+	closers []func() error
+}
+
+func newHarness() *harness {
+	return &harness{
+		inbox: make(chan received, 64),
+		done:  make(chan bool),
+	}
+}
+
+// receiver returns the function handling the messages the node sends to peer
+func (h *harness) receiver(peer Peer) func(interface{}) error {
+	return func(msg interface{}) error {
+		select {
+		case h.inbox <- received{to: peer, msg: msg}:
+		case <-h.done:
+		}
+		return nil
+	}
+}
+
+func (h *harness) close() {
+	close(h.done)
+	for _, c := range h.closers {
+		c()
+	}
+}
+
+// expect returns the next message the node sends to peer, skipping the ignored types. The messages to the other
+// peers are kept for the next steps.
+func (h *harness) expect(peer Peer, ignore map[string]bool, timeout time.Duration) (interface{}, error) {
+	deadline := time.After(timeout)
+	for {
+		for i, r := range h.pending {
+			if r.to != peer {
+				continue
+			}
+			h.pending = append(h.pending[:i], h.pending[i+1:]...)
+			return r.msg, nil
+		}
+		select {
+		case r := <-h.inbox:
+			if !ignore[TypeName(r.msg)] {
+				h.pending = append(h.pending, r)
+			}
+		case <-deadline:
+			return nil, errors.New("the node sent nothing to the " + peer.String() + " within " + timeout.String())
+		}
+	}
+}
+
+// TypeName returns the name of the type of a message, e.g. "CLI_REL_UPSTREAM_DATA"
+func TypeName(msg interface{}) string {
+	t := reflect.TypeOf(msg)
+	if t == nil {
+		return "nil"
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// connect starts the node, and connects the entities played by the harness with it
+func (h *harness) connect(node Node, scenario Scenario, timeout time.Duration) error {
+	switch scenario.Role {
+	case CLIENT, TRUSTEE:
+		transport, err := standalone.NewRelayTransport("127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		h.closers = append(h.closers, transport.Close)
+		go transport.Serve(h.receiver(RelayPeer))
+		h.send = func(to Peer, msg interface{}) error {
+			if scenario.Role == CLIENT {
+				return transport.SendToClient(0, msg)
+			}
+			return transport.SendToTrustee(0, msg)
+		}
+		if err := node.Start(scenario.Role, 0, transport.Addr().String()); err != nil {
+			return err
+		}
+		connected := make(chan bool)
+		go func() {
+			if scenario.Role == CLIENT {
+				transport.WaitForNodes(1, 0)
+			} else {
+				transport.WaitForNodes(0, 1)
+			}
+			close(connected)
+		}()
+		select {
+		case <-connected:
+		case <-time.After(timeout):
+			return errors.New("the " + scenario.Role + " did not connect to the relay within " + timeout.String())
+		}
+		return nil
+
+	case RELAY:
+		addr, err := freeAddress()
+		if err != nil {
+			return err
+		}
+		if err := node.Start(RELAY, 0, addr); err != nil {
+			return err
+		}
+		transports := make(map[Peer]*standalone.NodeTransport)
+		for _, peer := range scenario.Peers {
+			role := standalone.CLIENT
+			if peer.Role == TRUSTEE {
+				role = standalone.TRUSTEE
+			}
+			t, err := standalone.DialRelay(addr, role, peer.ID, timeout)
+			if err != nil {
+				return err
+			}
+			h.closers = append(h.closers, t.Close)
+			transports[peer] = t
+			go t.Serve(h.receiver(peer))
+		}
+		h.send = func(from Peer, msg interface{}) error {
+			t, ok := transports[from]
+			if !ok {
+				return errors.New("the harness does not play the " + from.String())
+			}
+			return t.SendToRelay(msg)
+		}
+		return nil
+	}
+	return errors.New("unknown role \"" + scenario.Role + "\"")
+}
+
+// freeAddress returns a local address where nothing listens
+func freeAddress() (string, error) {
+	l, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// Run starts node, plays scenario against it, and stops it. It stops at the first step which fails.
+func Run(node Node, scenario Scenario) *Result {
+	result := &Result{Scenario: scenario.Name, Role: scenario.Role}
+	timeout := scenario.Timeout
+	if timeout == 0 {
+		timeout = STEP_TIMEOUT
+	}
+	ignore := make(map[string]bool)
+	for _, t := range scenario.Ignore {
+		ignore[t] = true
+	}
+
+	h := newHarness()
+	defer h.close()
+	err := h.connect(node, scenario, timeout)
+	defer node.Stop()
+	if err != nil {
+		result.Err = errors.New("could not start the " + scenario.Role + ", " + err.Error())
+		return result
+	}
+
+	s := newSession()
+	for _, step := range scenario.Steps {
+		stepResult := runStep(h, node, s, step, ignore, timeout)
+		result.Steps = append(result.Steps, stepResult)
+		if stepResult.Err != nil {
+			result.Err = errors.New(step.Name + " : " + stepResult.Err.Error())
+			break
+		}
+		log.Lvl2("Conformance :", scenario.Role, "/", scenario.Name, ":", step.Name, "ok")
+	}
+	return result
+}
+
+func runStep(h *harness, node Node, s *Session, step Step, ignore map[string]bool, timeout time.Duration) StepResult {
+	result := StepResult{Name: step.Name, State: step.State}
+
+	if step.Send != nil {
+		msg, err := step.Send(s)
+		if err != nil {
+			result.Err = errors.New("the harness could not build its message, " + err.Error())
+			return result
+		}
+		if err := h.send(step.Peer, msg); err != nil {
+			result.Err = errors.New("could not send " + TypeName(msg) + " to the node, " + err.Error())
+			return result
+		}
+	}
+
+	if step.Expect != "" {
+		msg, err := h.expect(step.Peer, ignore, timeout)
+		if err != nil {
+			result.Err = errors.New("expected " + step.Expect + ", but " + err.Error())
+			return result
+		}
+		if TypeName(msg) != step.Expect {
+			result.Err = errors.New("expected " + step.Expect + ", got " + TypeName(msg))
+			return result
+		}
+		s.Received[step.Expect] = msg
+		if step.Check != nil {
+			if err := step.Check(s, msg); err != nil {
+				result.Err = errors.New("wrong " + step.Expect + ", " + err.Error())
+				return result
+			}
+		}
+	}
+
+	if reporter, ok := node.(StateReporter); ok && step.State != "" {
+		result.StateChecked = true
+		deadline := time.Now().Add(timeout)
+		for reporter.State() != step.State {
+			if time.Now().After(deadline) {
+				result.Err = errors.New("the node should be in state " + step.State + ", it is in state " + reporter.State())
+				return result
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return result
+}
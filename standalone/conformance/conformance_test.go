@@ -0,0 +1,70 @@
+package conformance
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/standalone"
+)
+
+func TestLibConforms(t *testing.T) {
+	for _, role := range []string{RELAY, CLIENT, TRUSTEE} {
+		for _, scenario := range Scenarios(role) {
+			result := Run(new(LibNode), scenario)
+			if !result.Passed() {
+				t.Error(result)
+			}
+			for _, step := range result.Steps {
+				if step.State != "" && !step.StateChecked {
+					t.Error(role, "/", scenario.Name, ": the state was not checked at step", step.Name)
+				}
+			}
+		}
+	}
+}
+
+// silentNode connects to the relay like a client, but never answers
+type silentNode struct {
+	transport *standalone.NodeTransport
+}
+
+func (n *silentNode) Start(role string, id int, relayAddr string) error {
+	transport, err := standalone.DialRelay(relayAddr, standalone.CLIENT, id, time.Second)
+	if err != nil {
+		return err
+	}
+	n.transport = transport
+	go transport.Serve(func(interface{}) error { return nil })
+	return nil
+}
+
+func (n *silentNode) Stop() error {
+	return n.transport.Close()
+}
+
+func TestSilentNodeFails(t *testing.T) {
+	scenario := Scenarios(CLIENT)[0]
+	scenario.Timeout = 200 * time.Millisecond
+
+	result := Run(new(silentNode), scenario)
+	if result.Passed() {
+		t.Fatal("a node which never answers should not conform")
+	}
+	if len(result.Steps) != 1 || !strings.Contains(result.Err.Error(), "CLI_REL_TELL_PK_AND_EPH_PK") {
+		t.Error("the first step should fail, waiting for the keys of the client;", result)
+	}
+	if result.Steps[0].StateChecked {
+		t.Error("the silent node does not report its state")
+	}
+}
+
+func TestUnknownRole(t *testing.T) {
+	if Scenarios("exit") != nil {
+		t.Error("there are no scenarios for an unknown role")
+	}
+	result := Run(new(LibNode), Scenario{Name: "nothing", Role: "exit"})
+	if result.Passed() {
+		t.Error("an unknown role should fail")
+	}
+}
@@ -0,0 +1,181 @@
+package conformance
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/standalone"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DefaultRelayConfig is the prifi.toml of a relay run by LibNode : a DC-net without UDP nor protections, which the
+// scenarios expect
+const DefaultRelayConfig = `
+PayloadSize = 1000
+CellSizeDown = 1000
+RelayWindowSize = 1
+RelayReportingLimit = -1
+DCNetType = "Simple"
+RelayUseDummyDataDown = false
+DisruptionProtectionEnabled = false
+EquivocationProtectionEnabled = false
+RelayRoundTimeOut = 5000
+RelayTrusteeCacheLowBound = 10
+RelayTrusteeCacheHighBound = 20
+`
+
+// LibNode runs the prifi-lib implementation of a role in this process, over the standalone transport
+type LibNode struct {
+	// the prifi.toml of a relay, DefaultRelayConfig if nil
+	RelayConfig map[string]interface{}
+
+	sync.Mutex
+	instance       *prifi_lib.PriFiLibInstance
+	closeTransport func() error
+}
+
+// Start starts the prifi-lib instance; a relay starts the protocol once one client and one trustee are connected
+func (n *LibNode) Start(role string, id int, relayAddr string) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.instance != nil {
+		return errors.New("the node is already started")
+	}
+
+	switch role {
+	case RELAY:
+		tomlConfig := n.RelayConfig
+		if tomlConfig == nil {
+			var err error
+			if tomlConfig, err = standalone.ParseToml(DefaultRelayConfig); err != nil {
+				return err
+			}
+		}
+		params, err := standalone.RelayParameters(tomlConfig, 1, 1)
+		if err != nil {
+			return err
+		}
+		transport, err := standalone.NewRelayTransport(relayAddr)
+		if err != nil {
+			return err
+		}
+		relay := prifi_lib.NewPriFiRelay(false, make(chan []byte, 10), make(chan []byte, 10), make(chan interface{}, 10),
+			func(clients, trustees []int) {}, transport)
+		go transport.Serve(relay.ReceivedMessage)
+		go func() {
+			transport.WaitForNodes(1, 1)
+			if err := relay.ReceivedMessage(*params); err != nil {
+				log.Error("Conformance : the relay refused its parameters,", err)
+			}
+		}()
+		n.instance, n.closeTransport = relay, transport.Close
+
+	case CLIENT, TRUSTEE:
+		nodeRole := standalone.CLIENT
+		if role == TRUSTEE {
+			nodeRole = standalone.TRUSTEE
+		}
+		transport, err := standalone.DialRelay(relayAddr, nodeRole, id, STEP_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		if role == CLIENT {
+			n.instance = prifi_lib.NewPriFiClient(false, false, false, make(chan []byte), make(chan []byte), false, "",
+				"none", 1, "", 0, 0, transport)
+		} else {
+			n.instance = prifi_lib.NewPriFiTrustee(true, false, 0, 0, transport)
+		}
+		n.closeTransport = transport.Close
+		go transport.Serve(n.instance.ReceivedMessage)
+
+	default:
+		return errors.New("unknown role \"" + role + "\"")
+	}
+	return nil
+}
+
+// Stop shuts the prifi-lib instance down, and closes its connections
+func (n *LibNode) Stop() error {
+	n.Lock()
+	defer n.Unlock()
+	if n.instance == nil {
+		return nil
+	}
+	n.instance.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	err := n.closeTransport()
+	n.instance, n.closeTransport = nil, nil
+	return err
+}
+
+// State returns the state of the prifi-lib instance, or "" if it is not started
+func (n *LibNode) State() string {
+	n.Lock()
+	defer n.Unlock()
+	if n.instance == nil {
+		return ""
+	}
+	return n.instance.State()
+}
+
+// CommandNode runs an implementation of a role as a command, e.g. another build of prifi-standalone
+type CommandNode struct {
+	Path string
+
+	// the arguments of the command; "{role}", "{id}" and "{relay}" are replaced by the role, the ID, and the address
+	// of the relay
+	Args []string
+
+	// where the output of the command goes, discarded if nil
+	Output io.Writer
+
+	cmd *exec.Cmd
+}
+
+// NewCommandNode returns the node run by a command line, e.g. "prifi-standalone --relay {relay} {role} --id {id}"
+func NewCommandNode(commandLine string) (*CommandNode, error) {
+	fields := strings.Fields(commandLine)
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return &CommandNode{Path: fields[0], Args: fields[1:]}, nil
+}
+
+// Start runs the command
+func (n *CommandNode) Start(role string, id int, relayAddr string) error {
+	if n.cmd != nil {
+		return errors.New("the node is already started")
+	}
+	replacer := strings.NewReplacer("{role}", role, "{id}", strconv.Itoa(id), "{relay}", relayAddr)
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	cmd := exec.Command(n.Path, args...)
+	cmd.Stdout, cmd.Stderr = n.Output, n.Output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	n.cmd = cmd
+	return nil
+}
+
+// Stop kills the command, and waits for it to exit
+func (n *CommandNode) Stop() error {
+	if n.cmd == nil {
+		return nil
+	}
+	cmd := n.cmd
+	n.cmd = nil
+	if err := cmd.Process.Kill(); err != nil {
+		return err
+	}
+	cmd.Wait() // the command was killed, it exits with an error
+	return nil
+}
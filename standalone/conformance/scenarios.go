@@ -0,0 +1,423 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+)
+
+// Scenarios returns the scenarios for a node with the given role, or nil if the role is unknown
+func Scenarios(role string) []Scenario {
+	switch role {
+	case RELAY:
+		return []Scenario{relaySetup()}
+	case CLIENT:
+		return []Scenario{clientSetup(), clientWrongDigest()}
+	case TRUSTEE:
+		return []Scenario{trusteeSetup()}
+	}
+	return nil
+}
+
+// The peers of a relay under test
+var (
+	client0  = Peer{Role: CLIENT, ID: 0}
+	trustee0 = Peer{Role: TRUSTEE, ID: 0}
+)
+
+// clientParameters sends the parameters of the group to the client under test, and checks the keys it answers with
+func clientParameters() Step {
+	return Step{
+		Name: "parameters",
+		Peer: RelayPeer,
+		Send: func(s *Session) (interface{}, error) {
+			params := s.groupParameters()
+			params.Add("NextFreeClientID", 0)
+			params.Add("MaxSlotsPerClient", 1)
+			params.TrusteesPks = []kyber.Point{s.trusteePk}
+			s.clientParams = params
+			return params, nil
+		},
+		Expect: "CLI_REL_TELL_PK_AND_EPH_PK",
+		Check: func(s *Session, msg interface{}) error {
+			keys := msg.(net.CLI_REL_TELL_PK_AND_EPH_PK)
+			if keys.ClientID != 0 {
+				return errors.New("the client took ID " + strconv.Itoa(keys.ClientID) + ", the relay gave it 0")
+			}
+			if keys.Pk == nil || keys.EphPk == nil {
+				return errors.New("a public key is missing")
+			}
+			if len(keys.ExtraEphPks) != 0 {
+				return errors.New("the client asked for " + strconv.Itoa(len(keys.ExtraEphPks)+1) + " slots, the relay allows 1")
+			}
+			s.clientPk, s.clientEphPk = keys.Pk, keys.EphPk
+			return nil
+		},
+		State: "EPH_KEYS_SENT",
+	}
+}
+
+// clientSetup plays the relay (and a trustee) for a client : the parameters, the schedule, and the first two rounds
+func clientSetup() Scenario {
+	return Scenario{
+		Name: "setup and first rounds",
+		Role: CLIENT,
+		Steps: []Step{
+			clientParameters(),
+			{
+				Name: "parameters digest",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					return &net.REL_CLI_PARAMS_DIGEST{Digest: s.clientParams.ParamsDigest()}, nil
+				},
+				State: "EPH_KEYS_SENT",
+			},
+			{
+				Name: "schedule",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					return s.schedule()
+				},
+				Expect: "CLI_REL_UPSTREAM_DATA",
+				Check: func(s *Session, msg interface{}) error {
+					data := msg.(net.CLI_REL_UPSTREAM_DATA)
+					if data.ClientID != 0 || data.RoundID != 0 {
+						return errors.New("expected the cipher of client 0 for round 0, got client " +
+							strconv.Itoa(data.ClientID) + " round " + strconv.Itoa(int(data.RoundID)))
+					}
+					if err := s.checkCellSize(data.Data); err != nil {
+						return err
+					}
+					return checkDecodesToZeros(0, s.PayloadSize, data.Data, s.trusteeCell(0))
+				},
+				State: "READY",
+			},
+			{
+				Name: "round 1",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					return &net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, OwnershipID: -1, Data: make([]byte, 1)}, nil
+				},
+				Expect: "CLI_REL_UPSTREAM_DATA",
+				Check: func(s *Session, msg interface{}) error {
+					data := msg.(net.CLI_REL_UPSTREAM_DATA)
+					if data.RoundID != 1 {
+						return errors.New("expected the cipher of round 1, got round " + strconv.Itoa(int(data.RoundID)))
+					}
+					if data.AckedRoundID != 1 {
+						return errors.New("the client should ack round 1, it acks round " + strconv.Itoa(int(data.AckedRoundID)))
+					}
+					// nobody owns the slot, the client sends a cover cell
+					return checkDecodesToZeros(1, s.PayloadSize, data.Data, s.trusteeCell(1))
+				},
+				State: "READY",
+			},
+		},
+	}
+}
+
+// clientWrongDigest checks that a client configured unlike the rest of the group stops before sending any data
+func clientWrongDigest() Scenario {
+	return Scenario{
+		Name: "parameters digest mismatch",
+		Role: CLIENT,
+		Steps: []Step{
+			clientParameters(),
+			{
+				Name: "wrong parameters digest",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					other := s.groupParameters()
+					other.Add("PayloadSize", s.PayloadSize+1)
+					return &net.REL_CLI_PARAMS_DIGEST{Digest: other.ParamsDigest()}, nil
+				},
+				State: "SHUTDOWN",
+			},
+		},
+	}
+}
+
+// trusteeSetup plays the relay (and a client) for a trustee : the parameters, the shuffle, and its first cipher
+func trusteeSetup() Scenario {
+	return Scenario{
+		Name:   "setup and first cipher",
+		Role:   TRUSTEE,
+		Ignore: []string{"TRU_REL_LOAD_REPORT"},
+		Steps: []Step{
+			{
+				Name: "parameters",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					params := s.groupParameters()
+					params.Add("NextFreeTrusteeID", 0)
+					return params, nil
+				},
+				Expect: "TRU_REL_TELL_PK",
+				Check: func(s *Session, msg interface{}) error {
+					pk := msg.(net.TRU_REL_TELL_PK)
+					if pk.TrusteeID != 0 {
+						return errors.New("the trustee took ID " + strconv.Itoa(pk.TrusteeID) + ", the relay gave it 0")
+					}
+					if pk.Pk == nil {
+						return errors.New("the public key is missing")
+					}
+					s.trusteePk = pk.Pk
+					return nil
+				},
+				State: "INITIALIZING",
+			},
+			{
+				Name: "shuffle",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					return s.shuffleRequest()
+				},
+				Expect: "TRU_REL_TELL_NEW_BASE_AND_EPH_PKS",
+				Check: func(s *Session, msg interface{}) error {
+					shuffle := msg.(net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+					if len(shuffle.NewEphPks) != 1 {
+						return errors.New("the shuffle has " + strconv.Itoa(len(shuffle.NewEphPks)) + " keys, expected 1")
+					}
+					if len(shuffle.Proof) == 0 {
+						return errors.New("the proof of the shuffle is missing")
+					}
+					done, err := s.neffRelay.ReceivedShuffleFromTrustee(shuffle.NewBase, shuffle.NewEphPks, shuffle.Proof)
+					if err != nil {
+						return err
+					}
+					if !done {
+						return errors.New("the shuffle should be done after the only trustee")
+					}
+					return nil
+				},
+				State: "SHUFFLE_DONE",
+			},
+			{
+				Name: "transcript",
+				Peer: RelayPeer,
+				Send: func(s *Session) (interface{}, error) {
+					return s.neffRelay.SendTranscript()
+				},
+				Expect: "TRU_REL_SHUFFLE_SIG",
+				Check: func(s *Session, msg interface{}) error {
+					sig := msg.(net.TRU_REL_SHUFFLE_SIG)
+					if sig.TrusteeID != 0 {
+						return errors.New("signed by trustee " + strconv.Itoa(sig.TrusteeID) + ", expected 0")
+					}
+					if _, err := s.neffRelay.ReceivedSignatureFromTrustee(0, sig.Sig); err != nil {
+						return err
+					}
+					schedule, err := s.neffRelay.VerifySigsAndSendToClients([]kyber.Point{s.trusteePk})
+					if err != nil {
+						return err
+					}
+					// the client recognizes its key in the shuffle the trustee signed
+					slot, err := s.recognizeSlot(*schedule.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG))
+					if err != nil {
+						return err
+					}
+					if slot != 0 {
+						return errors.New("the client owns slot " + strconv.Itoa(slot) + " of 1")
+					}
+					return nil
+				},
+				State: "READY",
+			},
+			{
+				Name:   "first cipher",
+				Peer:   RelayPeer,
+				Expect: "TRU_REL_DC_CIPHER",
+				Check: func(s *Session, msg interface{}) error {
+					cipher := msg.(net.TRU_REL_DC_CIPHER)
+					if cipher.TrusteeID != 0 || cipher.RoundID != 0 {
+						return errors.New("expected the cipher of trustee 0 for round 0, got trustee " +
+							strconv.Itoa(cipher.TrusteeID) + " round " + strconv.Itoa(int(cipher.RoundID)))
+					}
+					if cipher.Epoch != s.epoch {
+						return errors.New("the cipher is of epoch " + strconv.Itoa(int(cipher.Epoch)) + ", expected " +
+							strconv.Itoa(int(s.epoch)) + ", the epoch of the schedule")
+					}
+					if err := s.checkCellSize(cipher.Data); err != nil {
+						return err
+					}
+					return checkDecodesToZeros(0, s.PayloadSize, s.clientCell(0, false), cipher.Data)
+				},
+			},
+		},
+	}
+}
+
+// relaySetup plays one client and one trustee for a relay : the parameters, the shuffle, and the first round
+func relaySetup() Scenario {
+	return Scenario{
+		Name:   "setup and first round",
+		Role:   RELAY,
+		Peers:  []Peer{client0, trustee0},
+		Ignore: []string{"REL_TRU_TELL_RATE_CHANGE"},
+		Steps: []Step{
+			{
+				Name:   "trustee parameters",
+				Peer:   trustee0,
+				Expect: "ALL_ALL_PARAMETERS",
+				Check: func(s *Session, msg interface{}) error {
+					params := msg.(net.ALL_ALL_PARAMETERS)
+					if id := params.IntValueOrElse("NextFreeTrusteeID", -1); id != 0 {
+						return errors.New("the trustee got ID " + strconv.Itoa(id) + ", expected 0")
+					}
+					if n := params.IntValueOrElse("NClients", 0); n != 1 {
+						return errors.New("the group has " + strconv.Itoa(n) + " clients, expected 1")
+					}
+					if !params.BoolValueOrElse("StartNow", false) {
+						return errors.New("StartNow should be set")
+					}
+					return nil
+				},
+				State: "COLLECTING_TRUSTEES_PKS",
+			},
+			{
+				Name: "trustee key",
+				Peer: trustee0,
+				Send: func(s *Session) (interface{}, error) {
+					return &net.TRU_REL_TELL_PK{TrusteeID: 0, Pk: s.trusteePk}, nil
+				},
+				State: "COLLECTING_CLIENT_PKS",
+			},
+			{
+				Name:   "client parameters",
+				Peer:   client0,
+				Expect: "ALL_ALL_PARAMETERS",
+				Check: func(s *Session, msg interface{}) error {
+					params := msg.(net.ALL_ALL_PARAMETERS)
+					if id := params.IntValueOrElse("NextFreeClientID", -1); id != 0 {
+						return errors.New("the client got ID " + strconv.Itoa(id) + ", expected 0")
+					}
+					if len(params.TrusteesPks) != 1 || !params.TrusteesPks[0].Equal(s.trusteePk) {
+						return errors.New("the parameters should carry the public key of the trustee")
+					}
+					payloadSize := params.IntValueOrElse("PayloadSize", 0)
+					if payloadSize < 1 {
+						return errors.New("invalid PayloadSize " + strconv.Itoa(payloadSize))
+					}
+					// the DC-net cells hold all the cells of a round
+					s.PayloadSize = payloadSize * params.IntValueOrElse("CellsPerRound", 1)
+					s.clientParams = &params
+					return nil
+				},
+			},
+			{
+				Name: "client keys",
+				Peer: client0,
+				Send: func(s *Session) (interface{}, error) {
+					return &net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 0, Pk: s.clientPk, EphPk: s.clientEphPk}, nil
+				},
+				State: "COLLECTING_SHUFFLES",
+			},
+			{
+				Name:   "shuffle request",
+				Peer:   trustee0,
+				Expect: "REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE",
+				Check: func(s *Session, msg interface{}) error {
+					request := msg.(net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+					if len(request.Pks) != 1 || !request.Pks[0].Equal(s.clientPk) {
+						return errors.New("the request should carry the public key of the client")
+					}
+					if len(request.EphPks) != 1 || request.Base == nil {
+						return errors.New("the request should carry one ephemeral key, and a base")
+					}
+					if request.RoundID != 0 {
+						return errors.New("the first schedule starts at round " + strconv.Itoa(int(request.RoundID)) + ", expected 0")
+					}
+					s.epoch = request.Epoch
+					return nil
+				},
+			},
+			{
+				Name: "shuffle",
+				Peer: trustee0,
+				Send: func(s *Session) (interface{}, error) {
+					request := s.Received["REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE"].(net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+					return s.neffTrustee.ReceivedShuffleFromRelay(request.Base, request.EphPks, true, make([]byte, 1))
+				},
+				Expect: "REL_TRU_TELL_TRANSCRIPT",
+				Check: func(s *Session, msg interface{}) error {
+					transcript := msg.(net.REL_TRU_TELL_TRANSCRIPT)
+					if len(transcript.Bases) != 1 || len(transcript.EphPks) != 1 || len(transcript.Proofs) != 1 {
+						return errors.New("the transcript should hold the shuffle of the only trustee")
+					}
+					if !transcript.Bases[0].Equal(s.neffTrustee.NewBase) || !bytes.Equal(transcript.Proofs[0].Bytes, s.neffTrustee.Proof) {
+						return errors.New("the transcript does not hold the shuffle of the trustee")
+					}
+					return nil
+				},
+				State: "COLLECTING_SHUFFLE_SIGNATURES",
+			},
+			{
+				Name: "shuffle signature",
+				Peer: trustee0,
+				Send: func(s *Session) (interface{}, error) {
+					transcript := s.Received["REL_TRU_TELL_TRANSCRIPT"].(net.REL_TRU_TELL_TRANSCRIPT)
+					return s.neffTrustee.ReceivedTranscriptFromRelay(transcript.InitialBase, transcript.InitialEphPks, transcript.Bases, transcript.GetKeys(), transcript.GetProofs())
+				},
+				State: "COMMUNICATING",
+			},
+			{
+				Name:   "parameters digest",
+				Peer:   client0,
+				Expect: "REL_CLI_PARAMS_DIGEST",
+				Check: func(s *Session, msg interface{}) error {
+					digest := msg.(net.REL_CLI_PARAMS_DIGEST)
+					if !bytes.Equal(digest.Digest, s.clientParams.ParamsDigest()) {
+						return errors.New("the digest does not match the parameters sent to the client")
+					}
+					return nil
+				},
+			},
+			{
+				Name:   "schedule",
+				Peer:   client0,
+				Expect: "REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG",
+				Check: func(s *Session, msg interface{}) error {
+					schedule := msg.(net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+					slot, err := s.recognizeSlot(schedule)
+					if err != nil {
+						return err
+					}
+					if slot != 0 || schedule.RoundID != 0 {
+						return errors.New("the client owns slot " + strconv.Itoa(slot) + " from round " +
+							strconv.Itoa(int(schedule.RoundID)) + ", expected slot 0 from round 0")
+					}
+					return nil
+				},
+			},
+			{
+				Name: "trustee cipher of round 0",
+				Peer: trustee0,
+				Send: func(s *Session) (interface{}, error) {
+					return &net.TRU_REL_DC_CIPHER{RoundID: 0, TrusteeID: 0, Data: s.trusteeCell(0), Epoch: s.epoch}, nil
+				},
+			},
+			{
+				Name: "round 0",
+				Peer: client0,
+				Send: func(s *Session) (interface{}, error) {
+					return &net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 0, Data: s.clientCell(0, true)}, nil
+				},
+				Expect: "REL_CLI_DOWNSTREAM_DATA",
+				Check: func(s *Session, msg interface{}) error {
+					data := msg.(net.REL_CLI_DOWNSTREAM_DATA)
+					if data.RoundID != 1 {
+						return errors.New("expected the downstream data of round 1, got round " + strconv.Itoa(int(data.RoundID)))
+					}
+					if data.OwnershipID != 0 && data.OwnershipID != -1 {
+						return errors.New("round 1 is owned by slot " + strconv.Itoa(data.OwnershipID) + ", the schedule has one slot")
+					}
+					return nil
+				},
+				State: "COMMUNICATING",
+			},
+		},
+	}
+}
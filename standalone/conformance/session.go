@@ -0,0 +1,189 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"go.dedis.ch/kyber/v3"
+)
+
+// PAYLOAD_SIZE is the size of the upstream cells, when the harness plays the relay
+const PAYLOAD_SIZE = 1000
+
+// SCHEDULE_EPOCH is the epoch of the schedule, when the harness plays the relay; not 0, so that a trustee which does
+// not tag its ciphers with it is noticed
+const SCHEDULE_EPOCH = 1
+
+// Session is the state of the entities played by the harness during a scenario : their keys, and what the node sent
+type Session struct {
+	// the last message of each type the node sent, by type name
+	Received map[string]interface{}
+
+	// the size of the upstream cells; chosen by the harness, or by the relay under test
+	PayloadSize int
+
+	// the parameters the relay (played by the harness, or under test) sent to the client
+	clientParams *net.ALL_ALL_PARAMETERS
+
+	// the epoch of the schedule, which tags the ciphers of the trustee; chosen by the harness, or by the relay under test
+	epoch int32
+
+	// the client played by the harness, or the keys the client under test announced
+	clientPk     kyber.Point
+	clientPriv   kyber.Scalar
+	clientEphPk  kyber.Point
+	clientEphPri kyber.Scalar
+	clientDCNet  *dcnet.DCNetEntity
+
+	// the trustee played by the harness, or the key the trustee under test announced
+	trusteePk    kyber.Point
+	trusteePriv  kyber.Scalar
+	trusteeDCNet *dcnet.DCNetEntity
+	neffTrustee  *scheduler.NeffShuffleTrustee
+
+	// the shuffle, when the harness plays the relay
+	neffRelay *scheduler.NeffShuffleRelay
+}
+
+func newSession() *Session {
+	s := &Session{
+		Received:    make(map[string]interface{}),
+		PayloadSize: PAYLOAD_SIZE,
+		epoch:       SCHEDULE_EPOCH,
+		neffTrustee: new(scheduler.NeffShuffleTrustee),
+		neffRelay:   new(scheduler.NeffShuffleRelay),
+	}
+	s.clientPk, s.clientPriv = crypto.NewKeyPair()
+	s.clientEphPk, s.clientEphPri = crypto.NewKeyPair()
+	s.trusteePk, s.trusteePriv = crypto.NewKeyPair()
+	s.neffTrustee.Init(0, s.trusteePriv, s.trusteePk)
+	return s
+}
+
+// groupParameters returns the parameters the relay played by the harness sends : a group of one client and one
+// trustee, without UDP nor protections
+func (s *Session) groupParameters() *net.ALL_ALL_PARAMETERS {
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("NClients", 1)
+	msg.Add("NTrustees", 1)
+	msg.Add("UseUDP", false)
+	msg.Add("StartNow", true)
+	msg.Add("PayloadSize", s.PayloadSize)
+	msg.Add("CellsPerRound", 1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("DisruptionProtectionEnabled", false)
+	msg.Add("EquivocationProtectionEnabled", false)
+	msg.Add("TrusteeQuorum", 0)
+	msg.ForceParams = true
+	return msg
+}
+
+// shuffleRequest starts the shuffle of the ephemeral key of the client, played by the harness or under test
+func (s *Session) shuffleRequest() (*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE, error) {
+	if err := s.neffRelay.Init(1); err != nil {
+		return nil, err
+	}
+	if err := s.neffRelay.AddClient(s.clientEphPk); err != nil {
+		return nil, err
+	}
+	msg, _, err := s.neffRelay.SendToNextTrustee()
+	if err != nil {
+		return nil, err
+	}
+	toSend := msg.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+	toSend.Pks = []kyber.Point{s.clientPk}
+	toSend.Epoch = s.epoch
+	return toSend, nil
+}
+
+// schedule shuffles the ephemeral key of the client under test with the trustee played by the harness, and returns
+// the signed result the relay sends to the clients
+func (s *Session) schedule() (*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG, error) {
+	request, err := s.shuffleRequest()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.neffTrustee.ReceivedShuffleFromRelay(request.Base, request.EphPks, true, make([]byte, 1))
+	if err != nil {
+		return nil, err
+	}
+	shuffle := msg.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+	if _, err := s.neffRelay.ReceivedShuffleFromTrustee(shuffle.NewBase, shuffle.NewEphPks, shuffle.Proof); err != nil {
+		return nil, err
+	}
+	msg, err = s.neffRelay.SendTranscript()
+	if err != nil {
+		return nil, err
+	}
+	transcript := msg.(*net.REL_TRU_TELL_TRANSCRIPT)
+	msg, err = s.neffTrustee.ReceivedTranscriptFromRelay(transcript.InitialBase, transcript.InitialEphPks, transcript.Bases, transcript.GetKeys(), transcript.GetProofs())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.neffRelay.ReceivedSignatureFromTrustee(0, msg.(*net.TRU_REL_SHUFFLE_SIG).Sig); err != nil {
+		return nil, err
+	}
+	msg, err = s.neffRelay.VerifySigsAndSendToClients([]kyber.Point{s.trusteePk})
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG), nil
+}
+
+// recognizeSlot checks the signatures of a schedule, and returns the slot of the client played by the harness
+func (s *Session) recognizeSlot(msg net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG) (int, error) {
+	return new(scheduler.NeffShuffle).ClientVerifySigAndRecognizeSlot(s.clientEphPri, []kyber.Point{s.trusteePk},
+		msg.Base, msg.EphPks, msg.GetSignatures())
+}
+
+// clientCell returns the cell of the client played by the harness for roundID; the slot owner sends zeros
+func (s *Session) clientCell(roundID int32, slotOwner bool) []byte {
+	if s.clientDCNet == nil {
+		secret := config.CryptoSuite.Point().Mul(s.clientPriv, s.trusteePk)
+		s.clientDCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_CLIENT, s.PayloadSize, false, []kyber.Point{secret})
+	}
+	cell, _ := s.clientDCNet.EncodeForRound(roundID, slotOwner, make([]byte, s.PayloadSize))
+	return cell
+}
+
+// trusteeCell returns the cell of the trustee played by the harness for roundID
+func (s *Session) trusteeCell(roundID int32) []byte {
+	if s.trusteeDCNet == nil {
+		secret := config.CryptoSuite.Point().Mul(s.trusteePriv, s.clientPk)
+		s.trusteeDCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_TRUSTEE, s.PayloadSize, false, []kyber.Point{secret})
+	}
+	return s.trusteeDCNet.TrusteeEncodeForRound(roundID)
+}
+
+// checkDecodesToZeros decodes a round like the relay, from the cell of the client and the one of the trustee, and
+// checks that its plaintext is all zeros, i.e. that the pads of the client and of the trustee cancel out
+func checkDecodesToZeros(roundID int32, payloadSize int, clientCell, trusteeCell []byte) error {
+	relay := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, payloadSize, false, nil)
+	relay.DecodeStart(roundID)
+	relay.DecodeClient(roundID, clientCell)
+	relay.DecodeTrustee(roundID, trusteeCell)
+	plaintext, _ := relay.DecodeCell(false)
+	if len(plaintext) != payloadSize {
+		return errors.New("round " + strconv.Itoa(int(roundID)) + " decodes to " + strconv.Itoa(len(plaintext)) +
+			" bytes, expected " + strconv.Itoa(payloadSize))
+	}
+	if !bytes.Equal(plaintext, make([]byte, payloadSize)) {
+		return errors.New("round " + strconv.Itoa(int(roundID)) + " does not decode to zeros, the pads do not cancel out")
+	}
+	return nil
+}
+
+// checkCellSize checks that a cell has the size of a DC-net cipher of the session
+func (s *Session) checkCellSize(cell []byte) error {
+	expected := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, s.PayloadSize, false, nil).CipherSize()
+	if len(cell) != expected {
+		return errors.New("the cell has " + strconv.Itoa(len(cell)) + " bytes, expected " + strconv.Itoa(expected))
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package standalone
+
+import (
+	"bytes"
+	"errors"
+	gonet "net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// The data of the rounds can go through another transport than the control connection (see net.Transport) : the
+// relay listens on the transports given in RelayTransports, and offers them to the clients in ALL_ALL_PARAMETERS; a
+// client with a ClientTransport connects to the one it prefers, and sends its hello on it. Only the upstream ciphers
+// and the downstream cells use it, and only when they fit in one frame; everything else, and any frame the transport
+// fails to send, goes through the control connection.
+
+// DATA_HELLO_ATTEMPTS is the number of hellos a client sends on its data transport before giving up on it
+const DATA_HELLO_ATTEMPTS = 3
+
+// DATA_HELLO_TIMEOUT is how long a client waits for the relay to acknowledge each hello
+const DATA_HELLO_TIMEOUT = 2 * time.Second
+
+// dataHelloAck is the relay's answer to a valid hello on a data transport
+var dataHelloAck = []byte("PRIFI-DATA-OK")
+
+// dataConnection is the connection of a client over the transport it picked for the data of the rounds
+type dataConnection struct {
+	sync.Mutex
+	conn                net.TransportConn
+	transport           net.Transport
+	lastDownstreamRound int32 // on the relay, the last round whose downstream cell went through this connection
+}
+
+func newDataConnection(conn net.TransportConn, transport net.Transport) *dataConnection {
+	return &dataConnection{conn: conn, transport: transport, lastDownstreamRound: -1}
+}
+
+// firstDownstream returns false if the downstream cell of this round already went through this connection : the
+// relay retransmits it because the client missed it, so it goes through the control connection instead
+func (d *dataConnection) firstDownstream(msg interface{}) bool {
+	var roundID int32
+	switch m := msg.(type) {
+	case *net.REL_CLI_DOWNSTREAM_DATA:
+		roundID = m.RoundID
+	case net.REL_CLI_DOWNSTREAM_DATA:
+		roundID = m.RoundID
+	default:
+		return true
+	}
+	d.Lock()
+	defer d.Unlock()
+	if roundID <= d.lastDownstreamRound {
+		return false
+	}
+	d.lastDownstreamRound = roundID
+	return true
+}
+
+// sendIfFits sends msg on the data connection, and returns false if the caller should use the control connection
+func (d *dataConnection) sendIfFits(msg interface{}) bool {
+	data, err := encodeMessage(msg)
+	if err != nil || len(data) > d.transport.MaxFrameSize() {
+		return false
+	}
+	if err := d.conn.Send(data); err != nil {
+		log.Lvl3("Standalone : could not send on the", d.transport.Name(), "transport, using the control connection;", err)
+		return false
+	}
+	return true
+}
+
+// isDataMessage tells if msg may go through a data transport
+func isDataMessage(msg interface{}) bool {
+	switch msg.(type) {
+	case *net.CLI_REL_UPSTREAM_DATA, net.CLI_REL_UPSTREAM_DATA, *net.REL_CLI_DOWNSTREAM_DATA, net.REL_CLI_DOWNSTREAM_DATA:
+		return true
+	}
+	return false
+}
+
+func typeName(msg interface{}) string {
+	return reflect.TypeOf(msg).String()
+}
+
+// hostOf returns the host of a "host:port" address
+func hostOf(addr string) string {
+	host, _, err := gonet.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ServeData accepts the clients on listener, a transport for the data of the rounds, and gives their upstream ciphers
+// to received. It blocks until the listener is closed.
+func (t *RelayTransport) ServeData(transport net.Transport, listener net.TransportListener, received func(interface{}) error) error {
+	t.Lock()
+	t.dataListeners = append(t.dataListeners, listener)
+	t.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go t.handleDataConnection(transport, conn, received)
+	}
+}
+
+func (t *RelayTransport) handleDataConnection(transport net.Transport, conn net.TransportConn, received func(interface{}) error) {
+	// the hello must arrive in time
+	timer := time.AfterFunc(t.HandshakeTimeout, func() { conn.Close() })
+	hello, err := conn.Receive()
+	timer.Stop()
+	if err != nil {
+		log.Lvl2("Standalone : no hello on the", transport.Name(), "transport from", conn.RemoteAddr(), ";", err)
+		conn.Close()
+		return
+	}
+	role, id, err := parseHelloFrame(hello)
+	if err == nil && role != CLIENT {
+		err = errors.New("only the clients use a data transport")
+	}
+	if err != nil {
+		log.Error("Standalone : refusing the", transport.Name(), "transport of", conn.RemoteAddr(), ";", err)
+		conn.Close()
+		return
+	}
+
+	// the data transport must come from the host of the control connection, so that it cannot be taken over
+	if control, err := t.node(CLIENT, id); err != nil || hostOf(conn.RemoteAddr()) != remoteHost(control.conn) {
+		log.Error("Standalone : refusing the", transport.Name(), "transport of client", id, "from", conn.RemoteAddr(),
+			", it is not the host of its control connection")
+		conn.Close()
+		return
+	}
+
+	d := newDataConnection(conn, transport)
+	t.Lock()
+	if previous, ok := t.dataConns[id]; ok {
+		previous.conn.Close()
+	}
+	t.dataConns[id] = d
+	t.Unlock()
+	log.Lvl2("Standalone : client", id, "sends its data over the", transport.Name(), "transport from", conn.RemoteAddr())
+	conn.Send(dataHelloAck)
+
+	for {
+		frame, err := conn.Receive()
+		if err != nil {
+			break
+		}
+		if bytes.Equal(frame, hello) {
+			conn.Send(dataHelloAck) // our previous ack was lost
+			continue
+		}
+		msg, err := decodeMessage(frame)
+		if err != nil {
+			log.Lvl2("Standalone : could not decode a frame of client", id, "on the", transport.Name(), "transport;", err)
+			continue
+		}
+		// only its own upstream data; a data transport cannot be used to forge other messages
+		upstream, ok := msg.(net.CLI_REL_UPSTREAM_DATA)
+		if !ok || upstream.ClientID != id {
+			log.Lvl2("Standalone : refusing a", typeName(msg), "of client", id, "on the", transport.Name(), "transport")
+			continue
+		}
+		if err := received(msg); err != nil {
+			log.Error("Standalone : error while handling a message from client", id, ";", err)
+		}
+	}
+
+	t.Lock()
+	if t.dataConns[id] == d {
+		delete(t.dataConns, id)
+	}
+	t.Unlock()
+	conn.Close()
+	log.Lvl2("Standalone : the", transport.Name(), "transport of client", id, "closed")
+}
+
+// dataConnection returns the data connection of client i, or nil if it has none
+func (t *RelayTransport) dataConnection(i int) *dataConnection {
+	t.Lock()
+	defer t.Unlock()
+	return t.dataConns[i]
+}
+
+// PreferTransport makes the client send its data over the transport named name, if the relay offers it. An empty name
+// keeps everything on the control connection.
+func (t *NodeTransport) PreferTransport(name string) {
+	t.preferredTransport = name
+}
+
+// useOfferedTransport connects to the preferred transport, if the parameters of the relay offer it
+func (t *NodeTransport) useOfferedTransport(params net.ALL_ALL_PARAMETERS, received func(interface{}) error) {
+	if t.preferredTransport == "" {
+		return
+	}
+	offers, err := net.ParseTransportOffers(params.StringValueOrElse("Transports", ""))
+	if err != nil {
+		log.Error("Standalone : the relay offers invalid transports, using the control connection;", err)
+		return
+	}
+	offer, ok := net.PickTransportOffer(offers, t.preferredTransport)
+	if !ok {
+		log.Lvl1("Standalone : the relay does not offer the", t.preferredTransport, "transport, using the control connection")
+		return
+	}
+	if current := t.currentData(); current != nil && current.transport.Name() == offer.Name {
+		return // already connected, e.g. the parameters of a new epoch
+	}
+	go func() {
+		d, err := t.dialData(offer)
+		if err != nil {
+			log.Error("Standalone : could not use the", offer.Name, "transport at", offer.Address, ", using the control connection;", err)
+			return
+		}
+		t.Lock()
+		previous := t.data
+		t.data = d
+		t.Unlock()
+		if previous != nil {
+			previous.conn.Close()
+		}
+		log.Lvl1("Standalone :", t.name, "sends its data over the", offer.Name, "transport to", offer.Address)
+		t.receiveData(d, received)
+	}()
+}
+
+// dialData connects to the offered transport, and sends our hello until the relay acknowledges it
+func (t *NodeTransport) dialData(offer net.TransportOffer) (*dataConnection, error) {
+	transport, err := net.NewTransport(offer.Name)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := transport.Dial(offer.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	acked := make(chan bool, 1)
+	go func() {
+		for {
+			frame, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			if bytes.Equal(frame, dataHelloAck) {
+				acked <- true
+				return
+			}
+		}
+	}()
+	for attempt := 0; attempt < DATA_HELLO_ATTEMPTS; attempt++ {
+		if err := conn.Send(helloFrame(t.role, t.id)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		select {
+		case <-acked:
+			return newDataConnection(conn, transport), nil
+		case <-time.After(DATA_HELLO_TIMEOUT):
+		}
+	}
+	conn.Close()
+	return nil, errors.New("no answer to " + strconv.Itoa(DATA_HELLO_ATTEMPTS) + " hellos")
+}
+
+// receiveData gives the downstream cells received on the data transport to received, until it closes
+func (t *NodeTransport) receiveData(d *dataConnection, received func(interface{}) error) {
+	for {
+		frame, err := d.conn.Receive()
+		if err != nil {
+			break
+		}
+		if bytes.Equal(frame, dataHelloAck) {
+			continue
+		}
+		msg, err := decodeMessage(frame)
+		if err != nil {
+			log.Lvl2("Standalone : could not decode a frame of the", d.transport.Name(), "transport;", err)
+			continue
+		}
+		if _, ok := msg.(net.REL_CLI_DOWNSTREAM_DATA); !ok {
+			log.Lvl2("Standalone : refusing a", typeName(msg), "on the", d.transport.Name(), "transport")
+			continue
+		}
+		if err := received(msg); err != nil {
+			log.Error("Standalone : error while handling a message from the relay;", err)
+		}
+	}
+
+	t.Lock()
+	if t.data == d {
+		t.data = nil
+	}
+	t.Unlock()
+	log.Lvl2("Standalone : the", d.transport.Name(), "transport closed, using the control connection")
+}
+
+func (t *NodeTransport) currentData() *dataConnection {
+	t.Lock()
+	defer t.Unlock()
+	return t.data
+}
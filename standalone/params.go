@@ -0,0 +1,176 @@
+package standalone
+
+import (
+	"errors"
+	gonet "net"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// relayParameters maps the keys of prifi.toml to the keys of ALL_ALL_PARAMETERS, for the parameters the relay uses;
+// it follows PriFiSDAProtocol.Start() in sda/protocols
+var relayParameters = map[string]string{
+	"PayloadSize":                             "PayloadSize",
+	"CellSizeDown":                            "DownstreamCellSize",
+	"RelayWindowSize":                         "WindowSize",
+	"RelayUseOpenClosedSlots":                 "UseOpenClosedSlots",
+	"RelayUseDummyDataDown":                   "UseDummyDataDown",
+	"RelayReportingLimit":                     "ExperimentRoundLimit",
+	"DCNetType":                               "DCNetType",
+	"DisruptionProtectionEnabled":             "DisruptionProtectionEnabled",
+	"OpenClosedSlotsMinDelayBetweenRequests":  "OpenClosedSlotsMinDelayBetweenRequests",
+	"RelayMaxNumberOfConsecutiveFailedRounds": "RelayMaxNumberOfConsecutiveFailedRounds",
+	"RelayProcessingLoopSleepTime":            "RelayProcessingLoopSleepTime",
+	"RelayRoundTimeOut":                       "RelayRoundTimeOut",
+	"RelayTrusteeCacheLowBound":               "RelayTrusteeCacheLowBound",
+	"RelayTrusteeCacheHighBound":              "RelayTrusteeCacheHighBound",
+	"EquivocationProtectionEnabled":           "EquivocationProtectionEnabled",
+	"ForceDisruptionSinceRound3":              "ForceDisruptionSinceRound3",
+	"RelayTranscriptExportPath":               "RelayTranscriptExportPath",
+	"RelayFlowCaptureFile":                    "RelayFlowCaptureFile",
+	"TrusteeQuorum":                           "TrusteeQuorum",
+	"RelayMetricsAddress":                     "RelayMetricsAddress",
+	"RelayDemoAddress":                        "RelayDemoAddress",
+	"RelayDemoDelay":                          "RelayDemoDelay",
+	"RelayMinAnonymitySet":                    "RelayMinAnonymitySet",
+	"RelayGroupBandwidthCap":                  "RelayGroupBandwidthCap",
+	"RelayEpochRounds":                        "RelayEpochRounds",
+	"RelayEpochDuration":                      "RelayEpochDuration",
+	"RelayWarmupRounds":                       "RelayWarmupRounds",
+	"RelayMinSlotSize":                        "RelayMinSlotSize",
+	"DisruptionProtectionMAC":                 "DisruptionProtectionMAC",
+	"RelayDecodeWorkers":                      "RelayDecodeWorkers",
+	"RelayTargetRoundRate":                    "RelayTargetRoundRate",
+	"RelayHistoryDigestInterval":              "RelayHistoryDigestInterval",
+	"RelayTransports":                         "RelayTransports",
+	"RelayEgressQueueMaxBytes":                "RelayEgressQueueMaxBytes",
+	"RelayEgressQueueSpillDir":                "RelayEgressQueueSpillDir",
+	"RelayEgressQueueSpillMaxBytes":           "RelayEgressQueueSpillMaxBytes",
+	"RelayEgressQueueDropPolicy":              "RelayEgressQueueDropPolicy",
+	"FeatureFlags":                            "FeatureFlags",
+	"MaxSlotsPerClient":                       "MaxSlotsPerClient",
+	"RelayLatencyTargetP95":                   "RelayLatencyTargetP95",
+	"RelayMaxWindowSize":                      "RelayMaxWindowSize",
+	"RelayExperimentSchedule":                 "RelayExperimentSchedule",
+	"RelayEpochSummaryLog":                    "RelayEpochSummaryLog",
+	"RelayBlameEvidenceDir":                   "RelayBlameEvidenceDir",
+	"RelayMirrorSink":                         "RelayMirrorSink",
+	"CellsPerRound":                           "CellsPerRound",
+	"PayloadTransform":                        "PayloadTransform",
+	"SocksCredentials":                        "SocksCredentials",
+	"CryptoSuite":                             "CryptoSuite",
+}
+
+// ParseToml decodes a prifi.toml file into a map
+func ParseToml(data string) (map[string]interface{}, error) {
+	tomlConfig := make(map[string]interface{})
+	if _, err := toml.Decode(data, &tomlConfig); err != nil {
+		return nil, err
+	}
+	return tomlConfig, nil
+}
+
+// RelayParameters builds the ALL_ALL_PARAMETERS which starts the relay, from the prifi.toml config and the number
+// of nodes. UDP is always disabled, since the standalone transport has no broadcast.
+func RelayParameters(tomlConfig map[string]interface{}, nClients, nTrustees int) (*net.ALL_ALL_PARAMETERS, error) {
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.ForceParams = true
+
+	for tomlKey, paramKey := range relayParameters {
+		val, ok := tomlConfig[tomlKey]
+		if !ok {
+			continue
+		}
+		switch typedVal := val.(type) {
+		case int64:
+			msg.Add(paramKey, int(typedVal))
+		case bool, string:
+			msg.Add(paramKey, typedVal)
+		default:
+			return nil, errors.New("Invalid value for " + tomlKey + " in prifi.toml")
+		}
+	}
+
+	if udp, ok := tomlConfig["UseUDP"].(bool); ok && udp {
+		log.Lvl1("Standalone : ignoring UseUDP = true, the standalone transport has no broadcast")
+	}
+	msg.Add("UseUDP", false)
+	return msg, nil
+}
+
+// ApplyCryptoSuite chooses the crypto suite of this process from the CryptoSuite of the prifi.toml config (the default
+// suite if it is not set); it must be called before creating the PriFi instance, and before decoding any message
+func ApplyCryptoSuite(tomlConfig map[string]interface{}) error {
+	name := StringOrElse(tomlConfig, "CryptoSuite", "")
+	if err := config.SetCryptoSuite(name); err != nil {
+		return errors.New("Invalid CryptoSuite in prifi.toml : " + err.Error())
+	}
+	log.Lvl2("Standalone : using the crypto suite", config.CryptoSuiteName())
+	return nil
+}
+
+// RelayListenAddresses returns the addresses the relay listens on : listenAddress for the clients and the trustees,
+// the port of each transport of RelayTransports (on all interfaces), and the metrics and demo endpoints
+func RelayListenAddresses(tomlConfig map[string]interface{}, listenAddress string) ([]config.ListenAddress, error) {
+	addresses := []config.ListenAddress{
+		{Setting: "RelayListenAddress", Network: "tcp", Address: listenAddress},
+		{Setting: "RelayMetricsAddress", Network: "tcp", Address: StringOrElse(tomlConfig, "RelayMetricsAddress", "")},
+		{Setting: "RelayDemoAddress", Network: "tcp", Address: StringOrElse(tomlConfig, "RelayDemoAddress", "")},
+	}
+	offers, err := net.ParseTransportOffers(StringOrElse(tomlConfig, "RelayTransports", ""))
+	if err != nil {
+		return nil, errors.New("Invalid RelayTransports : " + err.Error())
+	}
+	for _, offer := range offers {
+		if _, err := net.NewTransport(offer.Name); err != nil {
+			return nil, errors.New("Invalid RelayTransports : " + err.Error())
+		}
+		_, port, err := gonet.SplitHostPort(offer.Address)
+		if err != nil {
+			return nil, errors.New("Invalid address of the " + offer.Name + " transport in RelayTransports : " + err.Error())
+		}
+		network := "tcp"
+		if offer.Name == net.TRANSPORT_UDP {
+			network = "udp"
+		}
+		addresses = append(addresses, config.ListenAddress{Setting: "RelayTransports (" + offer.Name + ")", Network: network, Address: ":" + port})
+	}
+	return addresses, nil
+}
+
+// ClientListenAddresses returns the addresses a client listens on : its SOCKS server
+func ClientListenAddresses(tomlConfig map[string]interface{}) []config.ListenAddress {
+	socksAddress := StringOrElse(tomlConfig, "ClientSocksListenAddress", "") + ":" + strconv.Itoa(IntOrElse(tomlConfig, "SocksServerPort", 8080))
+	return []config.ListenAddress{{Setting: "SocksServerPort", Network: "tcp", Address: socksAddress}}
+}
+
+// IntOrElse returns the integer tomlConfig[key], or elseVal if it is not set
+func IntOrElse(tomlConfig map[string]interface{}, key string, elseVal int) int {
+	if val, ok := tomlConfig[key].(int64); ok {
+		return int(val)
+	}
+	return elseVal
+}
+
+// BoolOrElse returns the boolean tomlConfig[key], or elseVal if it is not set
+func BoolOrElse(tomlConfig map[string]interface{}, key string, elseVal bool) bool {
+	if val, ok := tomlConfig[key].(bool); ok {
+		return val
+	}
+	return elseVal
+}
+
+// StringOrElse returns the string tomlConfig[key], or elseVal if it is not set
+func StringOrElse(tomlConfig map[string]interface{}, key string, elseVal string) string {
+	if val, ok := tomlConfig[key].(string); ok {
+		return val
+	}
+	return elseVal
+}
@@ -0,0 +1,540 @@
+package standalone
+
+import (
+	"bytes"
+	gonet "net"
+	"strconv"
+	"testing"
+	"time"
+
+	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+)
+
+func TestCodec(t *testing.T) {
+	suite := config.CryptoSuite
+	pk := suite.Point().Mul(suite.Scalar().Pick(suite.RandomStream()), nil)
+
+	messages := []interface{}{
+		&net.CLI_REL_UPSTREAM_DATA{ClientID: 2, RoundID: 7, Data: []byte{1, 2, 3}},
+		net.CLI_REL_TELL_PK_AND_EPH_PK{ClientID: 1, Pk: pk, EphPk: pk},
+		&net.TRU_REL_SHARED_SECRET{TrusteeID: 3, ClientID: 1, Secret: pk, NIZK: []byte{4}, Pub: map[string]kyber.Point{"B": pk}},
+	}
+	for _, msg := range messages {
+		data, err := encodeMessage(msg)
+		if err != nil {
+			t.Fatal("Could not encode", msg, err)
+		}
+		decoded, err := decodeMessage(data)
+		if err != nil {
+			t.Fatal("Could not decode", msg, err)
+		}
+
+		switch typed := decoded.(type) {
+		case net.CLI_REL_UPSTREAM_DATA:
+			if typed.ClientID != 2 || typed.RoundID != 7 || !bytes.Equal(typed.Data, []byte{1, 2, 3}) {
+				t.Error("Wrong decoded message", typed)
+			}
+		case net.CLI_REL_TELL_PK_AND_EPH_PK:
+			if typed.ClientID != 1 || !typed.Pk.Equal(pk) || !typed.EphPk.Equal(pk) {
+				t.Error("Wrong decoded message", typed)
+			}
+		case net.TRU_REL_SHARED_SECRET:
+			if typed.TrusteeID != 3 || !typed.Secret.Equal(pk) || !typed.Pub["B"].Equal(pk) {
+				t.Error("Wrong decoded message", typed)
+			}
+		default:
+			t.Errorf("Decoded a %T instead of %T", decoded, msg)
+		}
+	}
+
+	if _, err := encodeMessage(net.ALL_ALL_SHUTDOWN{}); err == nil {
+		t.Error("Local messages should not be encoded")
+	}
+	if _, err := decodeMessage([]byte{0, 3, 'f', 'o', 'o'}); err == nil {
+		t.Error("Unknown messages should not be decoded")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	if role, id, err := parseHelloFrame(helloFrame(TRUSTEE, 3)); err != nil || role != TRUSTEE || id != 3 {
+		t.Error("Could not parse a valid hello", role, id, err)
+	}
+	invalid := [][]byte{
+		{},
+		{1, 0, 0, 0},
+		{1, 0, 0, 0, 1, 0},
+		{3, 0, 0, 0, 1},
+		{1, 255, 255, 255, 255},
+	}
+	for _, hello := range invalid {
+		if _, _, err := parseHelloFrame(hello); err == nil {
+			t.Error("Hello", hello, "should be refused")
+		}
+	}
+
+	// frames are refused before being read if they are too large, and truncated frames are errors
+	if _, err := readFrameWithLimit(bytes.NewReader([]byte{0, 0, 0, 6, 1, 0, 0, 0, 0, 1}), HELLO_FRAME_SIZE); err == nil {
+		t.Error("A frame larger than the limit should be refused")
+	}
+	if _, err := readFrameWithLimit(bytes.NewReader([]byte{0, 0, 0, 5, 1, 0}), HELLO_FRAME_SIZE); err == nil {
+		t.Error("A truncated frame should be refused")
+	}
+	if _, err := readFrameWithLimit(bytes.NewReader([]byte{0, 0}), HELLO_FRAME_SIZE); err == nil {
+		t.Error("A truncated header should be refused")
+	}
+
+	// the relay closes the connections which do not say hello in time
+	transport, err := NewRelayTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	transport.HandshakeTimeout = 100 * time.Millisecond
+	go transport.Serve(func(interface{}) error { return nil })
+
+	conn, err := gonet.Dial("tcp", transport.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("The relay should have closed the connection")
+	} else if netErr, ok := err.(gonet.Error); ok && netErr.Timeout() {
+		t.Error("The relay did not close a silent connection")
+	}
+}
+
+func TestDataTransport(t *testing.T) {
+	transport, err := NewRelayTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	upstream := make(chan interface{}, 10)
+	go transport.Serve(func(msg interface{}) error { upstream <- msg; return nil })
+
+	udp, err := net.NewTransport(net.TRANSPORT_UDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := udp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go transport.ServeData(udp, listener, func(msg interface{}) error { upstream <- msg; return nil })
+
+	client, err := DialRelay(transport.Addr().String(), CLIENT, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.PreferTransport(net.TRANSPORT_UDP)
+	downstream := make(chan interface{}, 10)
+	go client.Serve(func(msg interface{}) error { downstream <- msg; return nil })
+	transport.WaitForNodes(1, 0)
+
+	// the relay offers the transport in the parameters, and the client connects to it
+	params := net.ALL_ALL_PARAMETERS{}
+	params.Add("Transports", net.FormatTransportOffers([]net.TransportOffer{{Name: net.TRANSPORT_UDP, Address: listener.Addr()}}))
+	if err := transport.SendToClient(0, params); err != nil {
+		t.Fatal(err)
+	}
+	<-downstream
+	deadline := time.Now().Add(5 * time.Second)
+	for transport.dataConnection(0) == nil || client.currentData() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("The client did not connect to the udp transport")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the data of the rounds goes both ways
+	if err := client.SendToRelay(&net.CLI_REL_UPSTREAM_DATA{ClientID: 0, RoundID: 1, Data: []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-upstream:
+		if m, ok := msg.(net.CLI_REL_UPSTREAM_DATA); !ok || m.RoundID != 1 || !bytes.Equal(m.Data, []byte{1, 2, 3}) {
+			t.Error("Wrong upstream message", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The relay did not receive the upstream data")
+	}
+	if err := transport.SendToClient(0, &net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, Data: []byte{4, 5}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-downstream:
+		if m, ok := msg.(net.REL_CLI_DOWNSTREAM_DATA); !ok || m.RoundID != 1 || !bytes.Equal(m.Data, []byte{4, 5}) {
+			t.Error("Wrong downstream message", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The client did not receive the downstream data")
+	}
+
+	// a retransmission goes through the control connection, which is reliable
+	d := transport.dataConnection(0)
+	if d.firstDownstream(&net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1}) {
+		t.Error("The second downstream message of round 1 should use the control connection")
+	}
+
+	// the client cannot send the data of another client
+	if !client.currentData().sendIfFits(&net.CLI_REL_UPSTREAM_DATA{ClientID: 1, RoundID: 3}) {
+		t.Fatal("Could not send on the data transport")
+	}
+	select {
+	case msg := <-upstream:
+		t.Error("The relay should refuse the data of another client", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDuplicateIDRefused(t *testing.T) {
+	transport, err := NewRelayTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	go transport.Serve(func(interface{}) error { return nil })
+
+	first, err := DialRelay(transport.Addr().String(), CLIENT, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	transport.WaitForNodes(1, 0)
+
+	// a client on another host, with the same ID
+	dialer := gonet.Dialer{LocalAddr: &gonet.TCPAddr{IP: gonet.ParseIP("127.0.0.2")}}
+	conn, err := dialer.Dial("tcp", transport.Addr().String())
+	if err != nil {
+		t.Skip("cannot connect from 127.0.0.2,", err)
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, helloFrame(CLIENT, 0)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("The relay should have closed the connection")
+	} else if netErr, ok := err.(gonet.Error); ok && netErr.Timeout() {
+		t.Error("The relay did not refuse a client with a duplicate ID")
+	}
+
+	// the first client keeps its connection
+	if c, err := transport.node(CLIENT, 0); err != nil || remoteHost(c.conn) != "127.0.0.1" {
+		t.Error("the first client should keep its connection")
+	}
+
+	// once it is gone, the ID can be used from elsewhere
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn2, err := dialer.Dial("tcp", transport.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	writeFrame(conn2, helloFrame(CLIENT, 0))
+	time.Sleep(100 * time.Millisecond)
+	if c, err := transport.node(CLIENT, 0); err != nil || remoteHost(c.conn) != "127.0.0.2" {
+		t.Error("the ID should be free once its client disconnected")
+	}
+}
+
+// Runs a relay, a client and a trustee in-process over the standalone transport, until the experiment round limit
+func TestStandaloneRun(t *testing.T) {
+	transport, err := NewRelayTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	tomlConfig, err := ParseToml(`
+PayloadSize = 1000
+CellSizeDown = 1000
+RelayWindowSize = 1
+RelayReportingLimit = 5
+DCNetType = "Simple"
+UseUDP = true
+RelayUseDummyDataDown = true
+DisruptionProtectionEnabled = false
+EquivocationProtectionEnabled = false
+RelayRoundTimeOut = 5000
+RelayTrusteeCacheLowBound = 10
+RelayTrusteeCacheHighBound = 20
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := RelayParameters(tomlConfig, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.BoolValueOrElse("UseUDP", true) || params.IntValueOrElse("WindowSize", 0) != 1 {
+		t.Error("Wrong parameters", params)
+	}
+
+	resultChan := make(chan interface{}, 1)
+	relay := prifi_lib.NewPriFiRelay(false, make(chan []byte, 10), make(chan []byte, 10), resultChan,
+		func(clients, trustees []int) {}, transport)
+	go transport.Serve(relay.ReceivedMessage)
+
+	trusteeTransport, err := DialRelay(transport.Addr().String(), TRUSTEE, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trusteeTransport.Close()
+	trustee := prifi_lib.NewPriFiTrustee(true, false, 0, 0, trusteeTransport)
+	go trusteeTransport.Serve(trustee.ReceivedMessage)
+
+	clientTransport, err := DialRelay(transport.Addr().String(), CLIENT, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientTransport.Close()
+	client := prifi_lib.NewPriFiClient(false, false, false, make(chan []byte), make(chan []byte), false, "", "none", 1, "", 0, 0, clientTransport)
+	go clientTransport.Serve(client.ReceivedMessage)
+
+	transport.WaitForNodes(1, 1)
+	if err := relay.ReceivedMessage(*params); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-resultChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("The relay did not reach the experiment round limit")
+	}
+}
+
+func TestClientJoinsDuringSession(t *testing.T) {
+	for _, equivocation := range []bool{false, true} {
+		t.Run("equivocation="+strconv.FormatBool(equivocation), func(t *testing.T) {
+			testClientJoinsDuringSession(t, equivocation)
+		})
+	}
+}
+
+// testClientJoinsDuringSession runs a session which a second client joins, with or without the equivocation protection
+func testClientJoinsDuringSession(t *testing.T, equivocation bool) {
+	transport, err := NewRelayTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	tomlConfig, err := ParseToml(`
+PayloadSize = 1000
+CellSizeDown = 1000
+RelayWindowSize = 2
+RelayReportingLimit = -1
+DCNetType = "Simple"
+RelayUseDummyDataDown = true
+DisruptionProtectionEnabled = false
+EquivocationProtectionEnabled = ` + strconv.FormatBool(equivocation) + `
+RelayRoundTimeOut = 5000
+RelayTrusteeCacheLowBound = 10
+RelayTrusteeCacheHighBound = 20
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := RelayParameters(tomlConfig, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := prifi_lib.NewPriFiRelay(false, make(chan []byte, 10), make(chan []byte, 10), make(chan interface{}, 1),
+		func(clients, trustees []int) {}, transport)
+	transport.ClientJoined = func(clientID int) {
+		if clientID > 0 {
+			if err := relay.AdmitClient(clientID); err != nil {
+				t.Error("The relay did not admit client", clientID, err)
+			}
+		}
+	}
+	go transport.Serve(relay.ReceivedMessage)
+
+	trusteeTransport, err := DialRelay(transport.Addr().String(), TRUSTEE, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trusteeTransport.Close()
+	trustee := prifi_lib.NewPriFiTrustee(true, false, 0, 0, trusteeTransport)
+	go trusteeTransport.Serve(trustee.ReceivedMessage)
+
+	newClient := func(id int) *prifi_lib.PriFiLibInstance {
+		clientTransport, err := DialRelay(transport.Addr().String(), CLIENT, id, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := prifi_lib.NewPriFiClient(false, false, false, make(chan []byte), make(chan []byte), false, "", "none", 1, "", 0, 0, clientTransport)
+		go clientTransport.Serve(client.ReceivedMessage)
+		return client
+	}
+	waitForRounds := func(client *prifi_lib.PriFiLibInstance, rounds int64) {
+		deadline := time.Now().Add(30 * time.Second)
+		for client.ShutdownReport().Rounds < rounds {
+			if time.Now().After(deadline) {
+				t.Fatal("The client did only", client.ShutdownReport().Rounds, "rounds")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first := newClient(0)
+	transport.WaitForNodes(1, 1)
+	if err := relay.ReceivedMessage(*params); err != nil {
+		t.Fatal(err)
+	}
+	waitForRounds(first, 10)
+
+	// the second client joins the running session, and both go on with the rounds
+	second := newClient(1)
+	waitForRounds(second, 10)
+	rounds := first.ShutdownReport().Rounds
+	waitForRounds(first, rounds+10)
+}
+
+func TestClientLeavesDuringSession(t *testing.T) {
+	for _, equivocation := range []bool{false, true} {
+		t.Run("equivocation="+strconv.FormatBool(equivocation), func(t *testing.T) {
+			testClientLeavesDuringSession(t, equivocation)
+		})
+	}
+}
+
+// testClientLeavesDuringSession runs a session which a client leaves, with or without the equivocation protection
+func testClientLeavesDuringSession(t *testing.T, equivocation bool) {
+	transport, err := NewRelayTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	tomlConfig, err := ParseToml(`
+PayloadSize = 1000
+CellSizeDown = 1000
+RelayWindowSize = 2
+RelayReportingLimit = -1
+DCNetType = "Simple"
+RelayUseDummyDataDown = true
+DisruptionProtectionEnabled = false
+EquivocationProtectionEnabled = ` + strconv.FormatBool(equivocation) + `
+RelayRoundTimeOut = 5000
+RelayTrusteeCacheLowBound = 10
+RelayTrusteeCacheHighBound = 20
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := RelayParameters(tomlConfig, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := prifi_lib.NewPriFiRelay(false, make(chan []byte, 10), make(chan []byte, 10), make(chan interface{}, 1),
+		func(clients, trustees []int) {}, transport)
+	go transport.Serve(relay.ReceivedMessage)
+
+	trusteeTransport, err := DialRelay(transport.Addr().String(), TRUSTEE, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trusteeTransport.Close()
+	trustee := prifi_lib.NewPriFiTrustee(true, false, 0, 0, trusteeTransport)
+	go trusteeTransport.Serve(trustee.ReceivedMessage)
+
+	newClient := func(id int) *prifi_lib.PriFiLibInstance {
+		clientTransport, err := DialRelay(transport.Addr().String(), CLIENT, id, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := prifi_lib.NewPriFiClient(false, false, false, make(chan []byte), make(chan []byte), false, "", "none", 1, "", 0, 0, clientTransport)
+		go clientTransport.Serve(client.ReceivedMessage)
+		return client
+	}
+	waitForRounds := func(client *prifi_lib.PriFiLibInstance, rounds int64) {
+		deadline := time.Now().Add(30 * time.Second)
+		for client.ShutdownReport().Rounds < rounds {
+			if time.Now().After(deadline) {
+				t.Fatal("The client did only", client.ShutdownReport().Rounds, "rounds")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	staying, leaving := newClient(0), newClient(1)
+	transport.WaitForNodes(2, 1)
+	if err := relay.ReceivedMessage(*params); err != nil {
+		t.Fatal(err)
+	}
+	waitForRounds(leaving, 10)
+
+	// the second client leaves, and the first one goes on with the rounds without waiting for its ciphers
+	left, err := leaving.LeaveSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-left:
+	case <-time.After(30 * time.Second):
+		t.Fatal("The relay did not remove the client which left")
+	}
+	if reason := leaving.ShutdownReport().Reason; reason != "left the session" {
+		t.Error("The client which left should be shut down, the reason is", reason)
+	}
+	rounds := staying.ShutdownReport().Rounds
+	waitForRounds(staying, rounds+10)
+
+	// the last client cannot leave, the group would be empty
+	if _, err := staying.LeaveSession(); err != nil {
+		t.Fatal(err)
+	}
+	rounds = staying.ShutdownReport().Rounds
+	waitForRounds(staying, rounds+10)
+}
+
+func TestListenAddresses(t *testing.T) {
+	tomlConfig, err := ParseToml(`
+RelayMetricsAddress = ":9100"
+RelayTransports = "udp=relay.example.org:7000,tcp=relay.example.org:7001"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err := RelayListenAddresses(tomlConfig, "127.0.0.1:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.CheckListenAddresses(addresses); err != nil {
+		t.Error("A UDP transport may use the port of the relay,", err)
+	}
+
+	tomlConfig["RelayDemoAddress"] = "127.0.0.1:7001"
+	addresses, _ = RelayListenAddresses(tomlConfig, "127.0.0.1:7000")
+	if err := config.CheckListenAddresses(addresses); err == nil {
+		t.Error("The demo endpoint should conflict with the TCP transport")
+	}
+
+	tomlConfig["RelayTransports"] = "udp=relay.example.org"
+	if _, err := RelayListenAddresses(tomlConfig, ":7000"); err == nil {
+		t.Error("A transport without port should be refused")
+	}
+	tomlConfig["RelayTransports"] = "quic=relay.example.org:7002"
+	if _, err := RelayListenAddresses(tomlConfig, ":7000"); err == nil {
+		t.Error("A transport which is not registered should be refused")
+	}
+
+	tomlConfig, _ = ParseToml(`
+SocksServerPort = 8080
+ClientSocksListenAddress = "127.0.0.1"
+`)
+	if addresses := ClientListenAddresses(tomlConfig); len(addresses) != 1 || addresses[0].Address != "127.0.0.1:8080" {
+		t.Error("Expected the SOCKS server of the client, got", addresses)
+	}
+}
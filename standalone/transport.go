@@ -0,0 +1,407 @@
+package standalone
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	gonet "net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Role is the role of a node connecting to the relay
+type Role byte
+
+// The roles of the nodes connecting to the relay
+const (
+	CLIENT  Role = 1
+	TRUSTEE Role = 2
+)
+
+func (r Role) String() string {
+	switch r {
+	case CLIENT:
+		return "client"
+	case TRUSTEE:
+		return "trustee"
+	}
+	return "unknown-role-" + strconv.Itoa(int(r))
+}
+
+// DIAL_RETRY_DELAY is the delay between two attempts to connect to the relay
+const DIAL_RETRY_DELAY = time.Second
+
+// HANDSHAKE_TIMEOUT is how long the relay waits for the hello frame of a new connection, and a node for sending it
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// HELLO_FRAME_SIZE is the size of the hello frame: the role (1 byte), then the ID (4 bytes)
+const HELLO_FRAME_SIZE = 5
+
+// connection is a TCP connection carrying framed messages, safe for concurrent writers
+type connection struct {
+	sync.Mutex
+	conn   gonet.Conn
+	closed bool // set by the RelayTransport, under its lock, once the connection closed
+}
+
+func (c *connection) send(msg interface{}) error {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	return writeFrame(c.conn, data)
+}
+
+// receiveLoop decodes the messages of the connection and gives them to received, until the connection closes
+func (c *connection) receiveLoop(name string, received func(interface{}) error) error {
+	for {
+		data, err := readFrame(c.conn)
+		if err != nil {
+			return err
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			log.Error("Standalone : could not decode a message from", name, ";", err)
+			continue
+		}
+		if err := received(msg); err != nil {
+			log.Error("Standalone : error while handling a message from", name, ";", err)
+		}
+	}
+}
+
+// the hello frame is the first frame sent by a node on its connection: its role, then its ID
+func helloFrame(role Role, id int) []byte {
+	buf := make([]byte, HELLO_FRAME_SIZE)
+	buf[0] = byte(role)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(id))
+	return buf
+}
+
+func parseHelloFrame(buf []byte) (Role, int, error) {
+	if len(buf) != HELLO_FRAME_SIZE {
+		return 0, 0, errors.New("Invalid hello, " + strconv.Itoa(len(buf)) + " bytes instead of " + strconv.Itoa(HELLO_FRAME_SIZE))
+	}
+	role := Role(buf[0])
+	if role != CLIENT && role != TRUSTEE {
+		return 0, 0, errors.New("Invalid hello, unknown role " + strconv.Itoa(int(buf[0])))
+	}
+	id := binary.BigEndian.Uint32(buf[1:5])
+	if id > math.MaxInt32 {
+		return 0, 0, errors.New("Invalid hello, " + role.String() + " ID " + strconv.FormatUint(uint64(id), 10) + " is too large")
+	}
+	return role, int(id), nil
+}
+
+// readHello reads the hello frame of a new connection, which must arrive within timeout
+func readHello(conn gonet.Conn, timeout time.Duration) (Role, int, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, 0, err
+	}
+	hello, err := readFrameWithLimit(conn, HELLO_FRAME_SIZE)
+	if err != nil {
+		if netErr, ok := err.(gonet.Error); ok && netErr.Timeout() {
+			return 0, 0, errors.New("No hello within " + timeout.String())
+		}
+		return 0, 0, errors.New("Could not read the hello, " + err.Error())
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return 0, 0, err
+	}
+	return parseHelloFrame(hello)
+}
+
+// RelayTransport accepts the connections of the clients and trustees, and implements net.MessageSender for the relay.
+// A node that connects again with the same role and ID replaces its previous connection, unless the previous
+// connection is still open and comes from another host : then two nodes are configured with the same ID, and the
+// second one is refused.
+type RelayTransport struct {
+	sync.Mutex
+	listener  gonet.Listener
+	clients   map[int]*connection
+	trustees  map[int]*connection
+	connected *sync.Cond
+
+	dataListeners []net.TransportListener
+	dataConns     map[int]*dataConnection // the clients which send their data over another transport
+
+	// how long a new connection has to send its hello frame
+	HandshakeTimeout time.Duration
+
+	// if non-nil, called when a client connects with an ID never seen before, e.g. to admit it during the session
+	ClientJoined func(clientID int)
+}
+
+// NewRelayTransport listens on addr, e.g. ":7000"
+func NewRelayTransport(addr string) (*RelayTransport, error) {
+	listener, err := gonet.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &RelayTransport{
+		listener:         listener,
+		clients:          make(map[int]*connection),
+		trustees:         make(map[int]*connection),
+		dataConns:        make(map[int]*dataConnection),
+		HandshakeTimeout: HANDSHAKE_TIMEOUT,
+	}
+	t.connected = sync.NewCond(&t.Mutex)
+	return t, nil
+}
+
+// Addr returns the address the relay listens on
+func (t *RelayTransport) Addr() gonet.Addr {
+	return t.listener.Addr()
+}
+
+// Serve accepts the connections of the nodes, and gives their messages to received. It blocks until Close() is called.
+func (t *RelayTransport) Serve(received func(interface{}) error) error {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go t.handleConnection(conn, received)
+	}
+}
+
+func (t *RelayTransport) handleConnection(conn gonet.Conn, received func(interface{}) error) {
+	role, id, err := readHello(conn, t.HandshakeTimeout)
+	if err != nil {
+		log.Error("Standalone : refusing connection from", conn.RemoteAddr(), ";", err)
+		conn.Close()
+		return
+	}
+
+	c := &connection{conn: conn}
+	name := role.String() + "-" + strconv.Itoa(id)
+	isNew, err := t.register(role, id, c)
+	if err != nil {
+		log.Error(err.Error())
+		conn.Close()
+		return
+	}
+	log.Lvl2("Standalone : relay accepted", name, "from", conn.RemoteAddr())
+	if isNew && role == CLIENT && t.ClientJoined != nil {
+		t.ClientJoined(id)
+	}
+	err = c.receiveLoop(name, received)
+	t.Lock()
+	c.closed = true
+	t.Unlock()
+	log.Lvl2("Standalone : connection with", name, "closed;", err)
+}
+
+// register records the connection of a node, and returns true if no node connected with this role and ID before
+func (t *RelayTransport) register(role Role, id int, c *connection) (bool, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	nodes := t.clients
+	if role == TRUSTEE {
+		nodes = t.trustees
+	}
+	previous, known := nodes[id]
+	if known {
+		previousHost, newHost := remoteHost(previous.conn), remoteHost(c.conn)
+		if !previous.closed && previousHost != newHost {
+			return false, errors.New("Standalone : refusing " + role.String() + " " + strconv.Itoa(id) + " from " + newHost + ", this ID is used by a " +
+				role.String() + " connected from " + previousHost + ". Check that each " + role.String() + " is configured with its own ID")
+		}
+		log.Lvl1("Standalone :", role, id, "connected again, replacing its previous connection")
+		previous.conn.Close()
+	}
+	nodes[id] = c
+	t.connected.Broadcast()
+	return !known, nil
+}
+
+// remoteHost returns the IP address of the other end of the connection
+func remoteHost(conn gonet.Conn) string {
+	return hostOf(conn.RemoteAddr().String())
+}
+
+// WaitForNodes blocks until clients 0..nClients-1 and trustees 0..nTrustees-1 are connected
+func (t *RelayTransport) WaitForNodes(nClients, nTrustees int) {
+	t.Lock()
+	defer t.Unlock()
+
+	allConnected := func() bool {
+		for i := 0; i < nClients; i++ {
+			if _, ok := t.clients[i]; !ok {
+				return false
+			}
+		}
+		for j := 0; j < nTrustees; j++ {
+			if _, ok := t.trustees[j]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	for !allConnected() {
+		t.connected.Wait()
+	}
+}
+
+// Close stops accepting connections, and closes the connections of the nodes
+func (t *RelayTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, c := range t.clients {
+		c.conn.Close()
+	}
+	for _, c := range t.trustees {
+		c.conn.Close()
+	}
+	for _, l := range t.dataListeners {
+		l.Close()
+	}
+	for _, d := range t.dataConns {
+		d.conn.Close()
+	}
+	return t.listener.Close()
+}
+
+func (t *RelayTransport) node(role Role, i int) (*connection, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	nodes := t.clients
+	if role == TRUSTEE {
+		nodes = t.trustees
+	}
+	if c, ok := nodes[i]; ok {
+		return c, nil
+	}
+	e := "Standalone : " + role.String() + " " + strconv.Itoa(i) + " is unknown !"
+	log.Error(e)
+	return nil, errors.New(e)
+}
+
+// SendToClient sends a message to client i, or fails if it is not connected. The downstream cells go through the data
+// transport of the client, if it has one.
+func (t *RelayTransport) SendToClient(i int, msg interface{}) error {
+	c, err := t.node(CLIENT, i)
+	if err != nil {
+		return err
+	}
+	if isDataMessage(msg) {
+		if d := t.dataConnection(i); d != nil && d.firstDownstream(msg) && d.sendIfFits(msg) {
+			return nil
+		}
+	}
+	return c.send(msg)
+}
+
+// SendToTrustee sends a message to trustee i, or fails if it is not connected
+func (t *RelayTransport) SendToTrustee(i int, msg interface{}) error {
+	c, err := t.node(TRUSTEE, i)
+	if err != nil {
+		return err
+	}
+	return c.send(msg)
+}
+
+// SendToRelay fails, the relay does not send to itself
+func (t *RelayTransport) SendToRelay(msg interface{}) error {
+	return errors.New("Standalone : the relay cannot send to the relay")
+}
+
+// BroadcastToAllClients fails, the standalone transport has no UDP broadcast (UseUDP must be false)
+func (t *RelayTransport) BroadcastToAllClients(msg interface{}) error {
+	return errors.New("Standalone : UDP broadcast is not supported")
+}
+
+// ClientSubscribeToBroadcast fails, it is not for the relay
+func (t *RelayTransport) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	return errors.New("Standalone : the relay cannot subscribe to the broadcast")
+}
+
+// NodeTransport is the connection of a client or trustee to the relay, and implements net.MessageSender for them
+type NodeTransport struct {
+	sync.Mutex
+	relay *connection
+	name  string
+	role  Role
+	id    int
+
+	preferredTransport string          // the transport for the data of the rounds, if the relay offers it
+	data               *dataConnection // nil if the data goes through the control connection
+}
+
+// DialRelay connects to the relay at addr as the given role and ID, retrying until it succeeds or retryFor elapsed
+func DialRelay(addr string, role Role, id int, retryFor time.Duration) (*NodeTransport, error) {
+	deadline := time.Now().Add(retryFor)
+	for {
+		conn, err := gonet.Dial("tcp", addr)
+		if err == nil {
+			conn.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+			if err = writeFrame(conn, helloFrame(role, id)); err == nil {
+				conn.SetWriteDeadline(time.Time{})
+				return &NodeTransport{relay: &connection{conn: conn}, name: role.String() + "-" + strconv.Itoa(id), role: role, id: id}, nil
+			}
+			conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("Standalone : could not connect to the relay at " + addr + ", " + err.Error())
+		}
+		log.Lvl2("Standalone : could not connect to the relay at", addr, ", retrying;", err)
+		time.Sleep(DIAL_RETRY_DELAY)
+	}
+}
+
+// Serve gives the messages of the relay to received. It blocks until the connection closes.
+func (t *NodeTransport) Serve(received func(interface{}) error) error {
+	return t.relay.receiveLoop("the relay", func(msg interface{}) error {
+		if params, ok := msg.(net.ALL_ALL_PARAMETERS); ok {
+			t.useOfferedTransport(params, received)
+		}
+		return received(msg)
+	})
+}
+
+// Close closes the connection to the relay
+func (t *NodeTransport) Close() error {
+	if d := t.currentData(); d != nil {
+		d.conn.Close()
+	}
+	return t.relay.conn.Close()
+}
+
+// SendToClient fails, the nodes only talk to the relay
+func (t *NodeTransport) SendToClient(i int, msg interface{}) error {
+	return errors.New("Standalone : " + t.name + " cannot send to a client")
+}
+
+// SendToTrustee fails, the nodes only talk to the relay
+func (t *NodeTransport) SendToTrustee(i int, msg interface{}) error {
+	return errors.New("Standalone : " + t.name + " cannot send to a trustee")
+}
+
+// SendToRelay sends a message to the relay. The upstream ciphers go through the data transport, if there is one.
+func (t *NodeTransport) SendToRelay(msg interface{}) error {
+	if isDataMessage(msg) {
+		if d := t.currentData(); d != nil && d.sendIfFits(msg) {
+			return nil
+		}
+	}
+	return t.relay.send(msg)
+}
+
+// BroadcastToAllClients fails, the nodes only talk to the relay
+func (t *NodeTransport) BroadcastToAllClients(msg interface{}) error {
+	return errors.New("Standalone : " + t.name + " cannot broadcast")
+}
+
+// ClientSubscribeToBroadcast fails, the standalone transport has no UDP broadcast (UseUDP must be false)
+func (t *NodeTransport) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	return errors.New("Standalone : UDP broadcast is not supported")
+}
@@ -2,11 +2,12 @@ package stream_multiplexer
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/hex"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"go.dedis.ch/onet/v3/log"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,10 +20,40 @@ type EgressServer struct {
 	downstreamChan    chan []byte
 	stopChan          chan bool
 	verbose           bool
+	drain             *EgressDrain     // nil if the server cannot be drained
+	accessLog         *EgressAccessLog // nil if there is no access log
+	idleTimeout       time.Duration    // 0 if the streams are never closed for being idle
+}
+
+// EGRESS_IDLE_CHECK_INTERVAL is how often a connection reader checks whether its stream is idle, when there is an
+// idle timeout
+const EGRESS_IDLE_CHECK_INTERVAL = time.Second
+
+// EgressOptions are the optional settings of an Egress Server
+type EgressOptions struct {
+	// Drain counts the streams, and makes the server stop opening new ones once draining. Can be nil
+	Drain *EgressDrain
+
+	// AccessLog logs the destination, bytes and duration of each stream. Can be nil
+	AccessLog *EgressAccessLog
+
+	// IdleTimeout, if > 0, closes the streams without data (in either direction) nor keepalive for that long
+	IdleTimeout time.Duration
 }
 
 // StartEgressHandler creates (and block) an Egress Server
 func StartEgressHandler(serverAddress string, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	StartDrainableEgressHandler(serverAddress, maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose, nil)
+}
+
+// StartDrainableEgressHandler creates (and block) an Egress Server, which counts its streams in drain and stops
+// opening new ones once drain is draining. drain can be nil.
+func StartDrainableEgressHandler(serverAddress string, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool, drain *EgressDrain) {
+	StartEgressHandlerWithOptions(serverAddress, maxMessageSize, EgressOptions{Drain: drain}, upstreamChan, downstreamChan, stopChan, verbose)
+}
+
+// StartEgressHandlerWithOptions creates (and block) an Egress Server, with the given options
+func StartEgressHandlerWithOptions(serverAddress string, maxMessageSize int, options EgressOptions, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
 	eg := new(EgressServer)
 	eg.maxMessageSize = maxMessageSize
 	eg.maxPayloadSize = maxMessageSize - MULTIPLEXER_HEADER_SIZE //we use 8 bytes for the multiplexing
@@ -31,33 +62,63 @@ func StartEgressHandler(serverAddress string, maxMessageSize int, upstreamChan c
 	eg.stopChan = stopChan
 	eg.activeConnections = make(map[string]*MultiplexedConnection)
 	eg.verbose = verbose
+	eg.drain = options.Drain
+	eg.accessLog = options.AccessLog
+	eg.idleTimeout = options.IdleTimeout
 
 	if verbose {
 		log.Lvl1("Egress Server in verbose mode")
 	}
 
+	var previous []byte
 	for {
+		// we are done with the previous frame; if it was a pooled cell of the relay, it is reused
+		utils.ReleaseCell(previous)
 		dataRead := <-upstreamChan
+		previous = dataRead
 
 		// if too short or all bytes are zero, there was no data usptream, discard the frame
 		if len(dataRead) < 4 || bytes.Equal(dataRead[0:4], make([]byte, 4)) {
-			log.Lvl3("Egress Server: no upstream Data, continuing")
+			socksLog.Lvl3("Egress Server: no upstream Data, continuing")
 			continue
 		}
 
 		if len(dataRead) < MULTIPLEXER_HEADER_SIZE {
 			// we cannot demultiplex, skip
-			log.Lvl3("Egress Server: frame too short, continuing")
+			socksLog.Lvl3("Egress Server: frame too short, continuing")
 			continue
 		}
 
-		ID := string(dataRead[0:4])
-		size := int(binary.BigEndian.Uint32(dataRead[4:8]))
-		data := dataRead[8:]
+		IDBytes, frameType, data := parseFrame(dataRead)
+		ID := string(IDBytes)
+
+		switch frameType {
+		case MUX_FRAME_DATA:
+		case MUX_FRAME_WINDOW_UPDATE:
+			if mc, ok := eg.activeConnections[ID]; ok && mc != nil {
+				mc.window.add(windowUpdate(data))
+				mc.touch()
+			}
+			continue
+		case MUX_FRAME_RST:
+			if mc, ok := eg.activeConnections[ID]; ok && mc != nil {
+				socksLog.Lvl2("Egress server: stream", hex.EncodeToString(mc.ID_bytes), "was reset by the client, closing it")
+				mc.markReset()
+				mc.writer.close()
+			}
+			continue
+		default:
+			socksLog.Lvl2("Egress server: unknown frame type", frameType, ", discarding")
+			continue
+		}
 
-		// trim the data if needed
-		if len(data) > size {
-			data = data[:size]
+		// a frame without data is a keepalive from the client; it never opens a stream
+		if len(data) == 0 {
+			if mc, ok := eg.activeConnections[ID]; ok && mc != nil {
+				socksLog.Lvl3("Egress server: keepalive for stream", hex.EncodeToString([]byte(ID)))
+				mc.touch()
+			}
+			continue
 		}
 
 		if eg.verbose {
@@ -66,10 +127,16 @@ func StartEgressHandler(serverAddress string, maxMessageSize int, upstreamChan c
 
 		// if this a new connection, dial it first
 		if mc, ok := eg.activeConnections[ID]; !ok || mc == nil || mc.conn == nil {
+			if eg.drain != nil && eg.drain.IsDraining() {
+				socksLog.Lvl2("Egress server: draining, refusing the new stream", hex.EncodeToString([]byte(ID)))
+				go eg.sendDownstream(newFrame(IDBytes, MUX_FRAME_RST, nil))
+				continue
+			}
 			c, err := net.Dial("tcp", serverAddress)
 			if err != nil {
 				log.Error("Egress server: Could not connect to server, discarding data. Do you have a SOCKS server running on",
 					serverAddress, "? You need one!", err)
+				go eg.sendDownstream(newFrame(IDBytes, MUX_FRAME_RST, nil))
 				continue
 			} else {
 
@@ -79,28 +146,54 @@ func StartEgressHandler(serverAddress string, maxMessageSize int, upstreamChan c
 				mc.ID_bytes = []byte(ID)
 				mc.stopChan = make(chan bool, 1)
 				mc.maxMessageLength = eg.maxMessageSize
+				mc.window = newSendWindow(MUX_INITIAL_WINDOW)
+				mc.writer = newStreamWriter(c, MUX_INITIAL_WINDOW, func(n int) {
+					eg.sendDownstream(newWindowUpdateFrame(mc.ID_bytes, n))
+				}, func() {
+					eg.resetStream(mc)
+				})
+				mc.touch()
 
 				eg.activeConnections[ID] = mc
+				if eg.drain != nil {
+					eg.drain.streamOpened()
+				}
+				eg.accessLog.streamOpened(ID)
+				go mc.writer.run()
 				go eg.egressConnectionReader(mc)
 			}
 		}
 
 		mc, _ := eg.activeConnections[ID]
+		if atomic.LoadInt32(&mc.closedAsIdle) == 1 {
+			// we keep it, so that its late data does not open a new stream
+			socksLog.Lvl2("Egress server: stream", hex.EncodeToString([]byte(ID)), "was closed as idle, dropping its data")
+			continue
+		}
+		if mc.isReset() {
+			socksLog.Lvl2("Egress server: stream", hex.EncodeToString([]byte(ID)), "was reset, dropping its data")
+			continue
+		}
 
-		// Try to write to it; if it fails, clean it
-		mc.conn.SetWriteDeadline(time.Now().Add(time.Second))
-		n, err := mc.conn.Write(data)
-
-		if err != nil || n != len(data) {
-			log.Error("Egress server: could not write the whole", len(data), "bytes, only", n, "error", err)
-			mc.conn.Close()
-			mc.stopChan <- true
-			eg.activeConnections[ID] = nil
+		// the writer of the stream queues the data, so that a destination which does not read only stalls its own
+		// stream, and not this loop
+		if !mc.writer.push(data) {
+			log.Error("Egress server: stream", hex.EncodeToString([]byte(ID)), "sent more than its window, resetting it")
+			go eg.resetStream(mc)
+			mc.writer.close()
+			continue
 		}
+		mc.touch()
+
+		eg.accessLog.upstreamData(ID, data)
 	}
 }
 
 func (eg *EgressServer) egressConnectionReader(mc *MultiplexedConnection) {
+	if eg.drain != nil {
+		defer eg.drain.streamClosed()
+	}
+	defer eg.accessLog.streamClosed(mc.ID)
 	for {
 		// Check if we need to stop
 		select {
@@ -109,32 +202,57 @@ func (eg *EgressServer) egressConnectionReader(mc *MultiplexedConnection) {
 			return
 		default:
 		}
+		if mc.isReset() {
+			// the writer closes the connection once it wrote what it holds
+			return
+		}
+
+		// Wait until the client can take more data of this stream
+		window := mc.window.take(eg.maxPayloadSize, EGRESS_IDLE_CHECK_INTERVAL)
+		if window == 0 {
+			if eg.idleTimeout > 0 && mc.idleFor() >= eg.idleTimeout {
+				eg.closeIdleStream(mc)
+				return
+			}
+			continue
+		}
 
 		// Read data from the connection
-		buffer := make([]byte, eg.maxPayloadSize)
+		buffer := make([]byte, window)
+		if eg.idleTimeout > 0 {
+			mc.conn.SetReadDeadline(time.Now().Add(EGRESS_IDLE_CHECK_INTERVAL))
+		}
 		n, err := mc.conn.Read(buffer)
+		mc.window.add(window - n)
 
 		if err != nil {
 			if err, ok := err.(*net.OpError); ok && err.Timeout() {
 				// it was a timeout
+				if eg.idleTimeout > 0 && mc.idleFor() >= eg.idleTimeout {
+					eg.closeIdleStream(mc)
+					return
+				}
 				continue
 			}
-
-			if err == io.EOF {
-				// Connection closed indicator
+			if mc.isReset() {
 				return
 			}
 
-			log.Error("Egress server: connectionReader error (reading will stop),", err)
+			if err != io.EOF {
+				log.Error("Egress server: connectionReader error (reading will stop),", err)
+			}
+			// Connection closed : the client closes the stream on its side
+			eg.resetStream(mc)
+			mc.writer.close()
 			return
 		}
 
+		mc.touch()
+
 		// Trim the data and send it through the data channel
-		slice := make([]byte, n+MULTIPLEXER_HEADER_SIZE)
-		copy(slice[0:4], mc.ID_bytes[:])
-		binary.BigEndian.PutUint32(slice[4:8], uint32(n))
-		copy(slice[MULTIPLEXER_HEADER_SIZE:], buffer[:n])
+		slice := newFrame(mc.ID_bytes, MUX_FRAME_DATA, buffer[:n])
 		eg.downstreamChan <- slice
+		eg.accessLog.downstreamData(mc.ID, n)
 
 		if eg.verbose {
 			log.Lvl1("Egress Server -> Clients:\n", hex.Dump(slice))
@@ -142,3 +260,26 @@ func (eg *EgressServer) egressConnectionReader(mc *MultiplexedConnection) {
 
 	}
 }
+
+// closeIdleStream closes the stream of mc for being idle, and tells the client
+func (eg *EgressServer) closeIdleStream(mc *MultiplexedConnection) {
+	socksLog.Lvl2("Egress server: stream", hex.EncodeToString(mc.ID_bytes), "idle for", mc.idleFor(), ", closing it")
+	atomic.StoreInt32(&mc.closedAsIdle, 1)
+	eg.resetStream(mc)
+	mc.writer.close()
+	mc.conn.Close()
+}
+
+// resetStream sends a RST downstream for mc, unless its stream was already reset
+func (eg *EgressServer) resetStream(mc *MultiplexedConnection) {
+	if mc.markReset() {
+		socksLog.Lvl2("Egress server: resetting stream", hex.EncodeToString(mc.ID_bytes))
+		eg.sendDownstream(newFrame(mc.ID_bytes, MUX_FRAME_RST, nil))
+	}
+}
+
+// sendDownstream sends a control frame to the clients. The main loop calls it in a goroutine, so as not to wait on
+// the downstream channel while the relay waits on the upstream one
+func (eg *EgressServer) sendDownstream(slice []byte) {
+	eg.downstreamChan <- slice
+}
@@ -0,0 +1,399 @@
+package stream_multiplexer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+/*
+The egress access log lets the operator of a relay answer abuse complaints ("who connected to this server at this
+time?") with what the relay sees at the exit, and nothing more : for each stream, the destination (parsed from the
+SOCKS request at the start of the stream), the bytes in each direction and the duration. The egress server never
+knows which client or slot a stream comes from, and the log does not even contain the stream IDs, so the lines
+cannot be linked to each other.
+
+In the aggregate mode, no line is written per stream; every period, the log gets the number of streams, the bytes,
+and the number of streams per destination port.
+*/
+
+// The modes of the access log
+const (
+	ACCESS_LOG_OFF       = "off"
+	ACCESS_LOG_FULL      = "full"
+	ACCESS_LOG_AGGREGATE = "aggregate"
+)
+
+// ACCESS_LOG_UNKNOWN_DESTINATION is logged when the start of the stream is not a SOCKS4/5 CONNECT request
+const ACCESS_LOG_UNKNOWN_DESTINATION = "unknown"
+
+// we stop looking for the SOCKS request after this many bytes
+const accessLogMaxRequestBytes = 512
+
+// EgressAccessLogOptions are the settings of an EgressAccessLog
+type EgressAccessLogOptions struct {
+	Mode            string        // one of ACCESS_LOG_*; "" means ACCESS_LOG_OFF
+	Path            string        // the log file
+	MaxBytes        int64         // the file is rotated when it exceeds this size; <= 0 means never
+	MaxFiles        int           // number of rotated files kept (Path.1, Path.2, ...)
+	AggregatePeriod time.Duration // in the aggregate mode, how often a line is written
+}
+
+// EgressAccessLog is the access log of an egress server
+type EgressAccessLog struct {
+	sync.Mutex
+	mode    string
+	file    *rotatingFile
+	streams map[string]*accessLogStream
+	closed  bool
+
+	//aggregate mode
+	period      time.Duration
+	periodStart time.Time
+	aggregate   accessLogAggregate
+	stopChan    chan bool
+}
+
+// the state of one open stream; it is only kept in memory
+type accessLogStream struct {
+	start       time.Time
+	request     []byte // the first upstream bytes, until the destination is found
+	destination string
+	bytesUp     int64
+	bytesDown   int64
+}
+
+type accessLogAggregate struct {
+	streams   int
+	bytesUp   int64
+	bytesDown int64
+	ports     map[string]int
+}
+
+// NewEgressAccessLog opens the access log described by options. It returns nil (and no error) if the mode is
+// ACCESS_LOG_OFF; a nil *EgressAccessLog logs nothing.
+func NewEgressAccessLog(options EgressAccessLogOptions) (*EgressAccessLog, error) {
+	switch options.Mode {
+	case "", ACCESS_LOG_OFF:
+		return nil, nil
+	case ACCESS_LOG_FULL, ACCESS_LOG_AGGREGATE:
+	default:
+		return nil, errors.New("unknown access log mode \"" + options.Mode + "\", expected " + ACCESS_LOG_OFF + ", " + ACCESS_LOG_FULL + " or " + ACCESS_LOG_AGGREGATE)
+	}
+	if options.Path == "" {
+		return nil, errors.New("the access log needs a file")
+	}
+	if options.Mode == ACCESS_LOG_AGGREGATE && options.AggregatePeriod <= 0 {
+		return nil, errors.New("the aggregate access log needs a period > 0")
+	}
+
+	file, err := openRotatingFile(options.Path, options.MaxBytes, options.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	al := &EgressAccessLog{
+		mode:        options.Mode,
+		file:        file,
+		streams:     make(map[string]*accessLogStream),
+		period:      options.AggregatePeriod,
+		periodStart: time.Now(),
+	}
+	al.aggregate.ports = make(map[string]int)
+	if al.mode == ACCESS_LOG_AGGREGATE {
+		al.stopChan = make(chan bool)
+		go al.writeAggregates()
+	}
+	return al, nil
+}
+
+// Close writes the last aggregate (in the aggregate mode), and closes the file
+func (al *EgressAccessLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.Lock()
+	defer al.Unlock()
+	if al.closed {
+		return nil
+	}
+	al.closed = true
+	if al.mode == ACCESS_LOG_AGGREGATE {
+		close(al.stopChan)
+		al.writeAggregate(time.Now())
+	}
+	return al.file.close()
+}
+
+func (al *EgressAccessLog) streamOpened(ID string) {
+	if al == nil {
+		return
+	}
+	al.Lock()
+	defer al.Unlock()
+	al.streams[ID] = &accessLogStream{start: time.Now(), request: make([]byte, 0)}
+}
+
+func (al *EgressAccessLog) upstreamData(ID string, data []byte) {
+	if al == nil {
+		return
+	}
+	al.Lock()
+	defer al.Unlock()
+	s, ok := al.streams[ID]
+	if !ok {
+		return
+	}
+	s.bytesUp += int64(len(data))
+	if s.destination == "" {
+		s.request = append(s.request, data...)
+		destination, complete := parseSOCKSDestination(s.request)
+		if complete || len(s.request) >= accessLogMaxRequestBytes {
+			s.destination = destination
+			s.request = nil
+		}
+	}
+}
+
+func (al *EgressAccessLog) downstreamData(ID string, n int) {
+	if al == nil {
+		return
+	}
+	al.Lock()
+	defer al.Unlock()
+	if s, ok := al.streams[ID]; ok {
+		s.bytesDown += int64(n)
+	}
+}
+
+func (al *EgressAccessLog) streamClosed(ID string) {
+	if al == nil {
+		return
+	}
+	al.Lock()
+	defer al.Unlock()
+	s, ok := al.streams[ID]
+	if !ok {
+		return
+	}
+	delete(al.streams, ID)
+	if s.destination == "" {
+		s.destination = ACCESS_LOG_UNKNOWN_DESTINATION
+	}
+	if al.closed {
+		return
+	}
+
+	switch al.mode {
+	case ACCESS_LOG_FULL:
+		al.write(s.start.UTC().Truncate(time.Second).Format(time.RFC3339) +
+			" destination=" + s.destination +
+			" bytes_up=" + strconv.FormatInt(s.bytesUp, 10) +
+			" bytes_down=" + strconv.FormatInt(s.bytesDown, 10) +
+			" duration=" + time.Since(s.start).Truncate(time.Millisecond).String())
+	case ACCESS_LOG_AGGREGATE:
+		al.aggregate.streams++
+		al.aggregate.bytesUp += s.bytesUp
+		al.aggregate.bytesDown += s.bytesDown
+		port := ACCESS_LOG_UNKNOWN_DESTINATION
+		if _, p, err := net.SplitHostPort(s.destination); err == nil {
+			port = p
+		}
+		al.aggregate.ports[port]++
+	}
+}
+
+// writeAggregates writes the aggregate of each period, until Close()
+func (al *EgressAccessLog) writeAggregates() {
+	tick := time.NewTicker(al.period)
+	defer tick.Stop()
+	for {
+		select {
+		case <-al.stopChan:
+			return
+		case now := <-tick.C:
+			al.Lock()
+			if !al.closed {
+				al.writeAggregate(now)
+			}
+			al.Unlock()
+		}
+	}
+}
+
+// writeAggregate writes the aggregate of the period ending now, and starts a new one. The lock must be held.
+func (al *EgressAccessLog) writeAggregate(now time.Time) {
+	ports := make([]string, 0, len(al.aggregate.ports))
+	for p := range al.aggregate.ports {
+		ports = append(ports, p)
+	}
+	sort.Strings(ports)
+	for i, p := range ports {
+		ports[i] = p + ":" + strconv.Itoa(al.aggregate.ports[p])
+	}
+
+	al.write(al.periodStart.UTC().Truncate(time.Second).Format(time.RFC3339) +
+		" period=" + now.Sub(al.periodStart).Truncate(time.Second).String() +
+		" streams=" + strconv.Itoa(al.aggregate.streams) +
+		" bytes_up=" + strconv.FormatInt(al.aggregate.bytesUp, 10) +
+		" bytes_down=" + strconv.FormatInt(al.aggregate.bytesDown, 10) +
+		" ports=" + strings.Join(ports, ","))
+
+	al.periodStart = now
+	al.aggregate = accessLogAggregate{ports: make(map[string]int)}
+}
+
+// write appends a line to the log. The lock must be held.
+func (al *EgressAccessLog) write(line string) {
+	if err := al.file.writeLine(line); err != nil {
+		log.Error("Egress access log: could not write to", al.file.path, err)
+	}
+}
+
+// parseSOCKSDestination finds the destination "host:port" of a SOCKS5 (greeting, then CONNECT request) or SOCKS4
+// CONNECT request at the start of a stream. complete is false if more bytes are needed; once complete, an unknown
+// protocol or command gives ACCESS_LOG_UNKNOWN_DESTINATION.
+func parseSOCKSDestination(b []byte) (destination string, complete bool) {
+	if len(b) < 1 {
+		return "", false
+	}
+	switch b[0] {
+	case 5:
+		// greeting: VER NMETHODS METHODS
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return "", false
+		}
+		r := b[2+int(b[1]):]
+		// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+		if len(r) < 5 {
+			return "", false
+		}
+		if r[0] != 5 || r[1] != 1 {
+			return ACCESS_LOG_UNKNOWN_DESTINATION, true
+		}
+		var host string
+		var rest []byte
+		switch r[3] {
+		case 1:
+			if len(r) < 4+4+2 {
+				return "", false
+			}
+			host, rest = net.IP(r[4:8]).String(), r[8:]
+		case 3:
+			if len(r) < 5+int(r[4])+2 {
+				return "", false
+			}
+			host, rest = string(r[5:5+int(r[4])]), r[5+int(r[4]):]
+		case 4:
+			if len(r) < 4+16+2 {
+				return "", false
+			}
+			host, rest = net.IP(r[4:20]).String(), r[20:]
+		default:
+			return ACCESS_LOG_UNKNOWN_DESTINATION, true
+		}
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(rest[0:2])))), true
+	case 4:
+		// VER CMD DSTPORT DSTIP USERID NUL [DOMAIN NUL] (SOCKS4a if DSTIP is 0.0.0.x, x != 0)
+		if len(b) < 8 {
+			return "", false
+		}
+		if b[1] != 1 {
+			return ACCESS_LOG_UNKNOWN_DESTINATION, true
+		}
+		port := strconv.Itoa(int(binary.BigEndian.Uint16(b[2:4])))
+		host := net.IP(b[4:8]).String()
+		if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+			userEnd := indexOfZero(b[8:])
+			if userEnd < 0 {
+				return "", false
+			}
+			domain := b[8+userEnd+1:]
+			domainEnd := indexOfZero(domain)
+			if domainEnd < 0 {
+				return "", false
+			}
+			host = string(domain[:domainEnd])
+		}
+		return net.JoinHostPort(host, port), true
+	}
+	return ACCESS_LOG_UNKNOWN_DESTINATION, true
+}
+
+func indexOfZero(b []byte) int {
+	for i, v := range b {
+		if v == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// rotatingFile is a log file, which is renamed to path.1 (and path.1 to path.2, etc.) once it exceeds maxBytes
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) writeLine(line string) error {
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(line))+1 > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := rf.f.WriteString(line + "\n")
+	rf.size += int64(n)
+	return err
+}
+
+// rotate shifts path.i to path.i+1 (dropping the oldest), path to path.1, and opens a new path
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	if rf.maxFiles < 1 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(rf.path + "." + strconv.Itoa(rf.maxFiles))
+		for i := rf.maxFiles - 1; i >= 1; i-- {
+			os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) close() error {
+	return rf.f.Close()
+}
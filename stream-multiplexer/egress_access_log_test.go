@@ -0,0 +1,159 @@
+package stream_multiplexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSOCKSDestination(t *testing.T) {
+	greeting := []byte{5, 1, 0}
+	domainRequest := append([]byte{5, 1, 0, 3, 11}, []byte("example.com")...)
+	domainRequest = append(domainRequest, 1, 187) // port 443
+
+	cases := []struct {
+		request     []byte
+		destination string
+		complete    bool
+	}{
+		{append(append([]byte{}, greeting...), domainRequest...), "example.com:443", true},
+		{append(append([]byte{}, greeting...), 5, 1, 0, 1, 10, 0, 0, 1, 0, 80), "10.0.0.1:80", true},
+		{append(append([]byte{}, greeting...), 5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22), "[::1]:22", true},
+		{greeting, "", false},        // the request is not there yet
+		{[]byte{5, 2, 0}, "", false}, // the greeting is not complete
+		{append(append([]byte{}, greeting...), domainRequest[:8]...), "", false},
+		{append(append([]byte{}, greeting...), 5, 2, 0, 1, 10, 0, 0, 1, 0, 80), ACCESS_LOG_UNKNOWN_DESTINATION, true}, // BIND
+		{[]byte{4, 1, 0, 80, 10, 0, 0, 1, 0}, "10.0.0.1:80", true},
+		{append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 'u', 0}, append([]byte("example.com"), 0)...), "example.com:80", true},
+		{[]byte("GET / HTTP/1.1\r\n"), ACCESS_LOG_UNKNOWN_DESTINATION, true},
+	}
+	for i, c := range cases {
+		destination, complete := parseSOCKSDestination(c.request)
+		if destination != c.destination || complete != c.complete {
+			t.Error("Case", i, ": expected", c.destination, c.complete, "got", destination, complete)
+		}
+	}
+}
+
+func readAccessLog(t *testing.T, path string) []string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(raw)), "\n")
+}
+
+func TestEgressAccessLogFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	if al, err := NewEgressAccessLog(EgressAccessLogOptions{Mode: ACCESS_LOG_OFF, Path: path}); al != nil || err != nil {
+		t.Error("The access log should be nil when off")
+	}
+	if _, err := NewEgressAccessLog(EgressAccessLogOptions{Mode: "everything", Path: path}); err == nil {
+		t.Error("Should refuse an unknown mode")
+	}
+
+	al, err := NewEgressAccessLog(EgressAccessLogOptions{Mode: ACCESS_LOG_FULL, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the greeting and the request arrive in different frames
+	al.streamOpened("ab12")
+	al.upstreamData("ab12", []byte{5, 1, 0})
+	al.upstreamData("ab12", []byte{5, 1, 0, 1, 10, 0, 0, 1, 1, 187})
+	al.downstreamData("ab12", 100)
+	al.streamClosed("ab12")
+	al.streamOpened("cd34")
+	al.upstreamData("cd34", []byte("not socks"))
+	al.streamClosed("cd34")
+	al.Close()
+
+	lines := readAccessLog(t, path)
+	if len(lines) != 2 {
+		t.Fatal("Should have 2 lines, has", lines)
+	}
+	if !strings.Contains(lines[0], "destination=10.0.0.1:443 bytes_up=13 bytes_down=100 duration=") {
+		t.Error("Unexpected line", lines[0])
+	}
+	if !strings.Contains(lines[1], "destination="+ACCESS_LOG_UNKNOWN_DESTINATION) {
+		t.Error("Unexpected line", lines[1])
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "ab12") || strings.Contains(l, "cd34") {
+			t.Error("The stream IDs should not be logged:", l)
+		}
+	}
+}
+
+func TestEgressAccessLogAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	al, err := NewEgressAccessLog(EgressAccessLogOptions{Mode: ACCESS_LOG_AGGREGATE, Path: path, AggregatePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ID := range []string{"s1", "s2"} {
+		al.streamOpened(ID)
+		al.upstreamData(ID, append([]byte{5, 1, 0, 5, 1, 0, 3, 3}, 'a', '.', 'b', 1, 187))
+		al.streamClosed(ID)
+	}
+	al.streamOpened("s3")
+	al.upstreamData("s3", []byte{4, 1, 0, 80, 10, 0, 0, 1, 0})
+	al.streamClosed("s3")
+	al.Close()
+
+	lines := readAccessLog(t, path)
+	if len(lines) != 1 {
+		t.Fatal("Should have 1 aggregate line, has", lines)
+	}
+	if !strings.Contains(lines[0], "streams=3 bytes_up=35 bytes_down=0 ports=443:2,80:1") {
+		t.Error("Unexpected aggregate", lines[0])
+	}
+	if strings.Contains(lines[0], "a.b") || strings.Contains(lines[0], "10.0.0.1") {
+		t.Error("The aggregate should not contain destinations:", lines[0])
+	}
+}
+
+func TestEgressAccessLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	rf, err := openRotatingFile(path, 25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line-1-xxxxxx", "line-2-xxxxxx", "line-3-xxxxxx", "line-4-xxxxxx"} {
+		if err := rf.writeLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.close()
+
+	// each file holds one line; the oldest one was dropped
+	expected := map[string]string{path: "line-4-xxxxxx", path + ".1": "line-3-xxxxxx", path + ".2": "line-2-xxxxxx"}
+	for p, line := range expected {
+		if lines := readAccessLog(t, p); len(lines) != 1 || lines[0] != line {
+			t.Error(p, "should contain", line, "but contains", lines)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Only 2 rotated files should be kept")
+	}
+}
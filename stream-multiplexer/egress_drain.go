@@ -0,0 +1,63 @@
+package stream_multiplexer
+
+import (
+	"sync"
+	"time"
+)
+
+// EgressDrain lets an operator drain an egress server before shutting it down: once draining, the server opens no
+// new stream, but keeps forwarding the data of the streams already open, until they close.
+type EgressDrain struct {
+	sync.Mutex
+	draining      bool
+	activeStreams int
+}
+
+// NewEgressDrain creates an EgressDrain, not draining
+func NewEgressDrain() *EgressDrain {
+	return new(EgressDrain)
+}
+
+// StartDraining makes the egress server refuse new streams
+func (d *EgressDrain) StartDraining() {
+	d.Lock()
+	defer d.Unlock()
+	d.draining = true
+}
+
+// IsDraining returns true if the egress server refuses new streams
+func (d *EgressDrain) IsDraining() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.draining
+}
+
+// ActiveStreams returns the number of streams currently open
+func (d *EgressDrain) ActiveStreams() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.activeStreams
+}
+
+// WaitForStreams blocks until no stream is open, or until the deadline; it returns the number of streams still open
+func (d *EgressDrain) WaitForStreams(deadline time.Time, pollInterval time.Duration) int {
+	for {
+		n := d.ActiveStreams()
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (d *EgressDrain) streamOpened() {
+	d.Lock()
+	defer d.Unlock()
+	d.activeStreams++
+}
+
+func (d *EgressDrain) streamClosed() {
+	d.Lock()
+	defer d.Unlock()
+	d.activeStreams--
+}
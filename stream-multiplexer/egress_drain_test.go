@@ -0,0 +1,47 @@
+package stream_multiplexer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEgressDrain(t *testing.T) {
+	d := NewEgressDrain()
+	if d.IsDraining() {
+		t.Error("A new EgressDrain should not be draining")
+	}
+
+	d.streamOpened()
+	d.streamOpened()
+	d.streamClosed()
+	if d.ActiveStreams() != 1 {
+		t.Error("Should have 1 active stream, has", d.ActiveStreams())
+	}
+
+	d.StartDraining()
+	if !d.IsDraining() {
+		t.Error("Should be draining")
+	}
+
+	// the stream stays open: we wait until the deadline
+	start := time.Now()
+	if n := d.WaitForStreams(start.Add(50*time.Millisecond), 10*time.Millisecond); n != 1 {
+		t.Error("WaitForStreams should return 1 stream still open, returned", n)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("WaitForStreams returned before the deadline")
+	}
+
+	// the stream closes before the deadline: we return early
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		d.streamClosed()
+	}()
+	start = time.Now()
+	if n := d.WaitForStreams(start.Add(5*time.Second), 10*time.Millisecond); n != 0 {
+		t.Error("WaitForStreams should return 0 stream still open, returned", n)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("WaitForStreams should return as soon as the streams are closed")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"go.dedis.ch/onet/v3/log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -344,3 +345,46 @@ func TestEgressMultiplexLong(t *testing.T) {
 		t.Error("Echoed message data is wrong", doubleHello2, data2[:size2])
 	}
 }
+
+// Tests that with an idle timeout, a stream without traffic is closed, and its late data is dropped
+func TestEgressIdleTimeout(t *testing.T) {
+
+	eg := new(EgressServer)
+	eg.maxPayloadSize = 20 - MULTIPLEXER_HEADER_SIZE
+	eg.downstreamChan = make(chan []byte, 10)
+	eg.idleTimeout = 500 * time.Millisecond
+
+	serverSide, egressSide := tcpConnectionPair(t)
+	defer serverSide.Close()
+	mc := &MultiplexedConnection{conn: egressSide, ID: "1234", ID_bytes: []byte("1234"), stopChan: make(chan bool, 1)}
+	mc.touch()
+
+	done := make(chan bool)
+	go func() {
+		eg.egressConnectionReader(mc)
+		done <- true
+	}()
+
+	// traffic keeps the stream open
+	time.Sleep(300 * time.Millisecond)
+	serverSide.Write([]byte{1})
+	<-eg.downstreamChan
+	time.Sleep(300 * time.Millisecond)
+	mc.touch() // as a keepalive would
+
+	select {
+	case <-done:
+		if mc.idleFor() < eg.idleTimeout {
+			t.Error("The stream was closed after being idle for only", mc.idleFor())
+		}
+	case <-time.After(eg.idleTimeout + 3*EGRESS_IDLE_CHECK_INTERVAL):
+		t.Fatal("The idle stream should have been closed")
+	}
+	if atomic.LoadInt32(&mc.closedAsIdle) != 1 {
+		t.Error("The stream should be marked as closed for being idle")
+	}
+	serverSide.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := serverSide.Read(make([]byte, 1)); err == nil {
+		t.Error("The connection to the server should be closed")
+	}
+}
@@ -9,16 +9,65 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"github.com/dedis/prifi/prifi-lib/utils"
 	"go.dedis.ch/onet/v3/log"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// socksLog logs at the level of the "socks" module
+var socksLog = prifilog.NewModuleLogger(prifilog.MODULE_SOCKS)
+
 // MULTIPLEXER_HEADER_SIZE is the size of the header for the multiplexed data,
-// currently 4 byte for StreamID and 4 byte for length
+// currently 4 byte for StreamID and 4 byte for the type and length (see mux.go)
 const MULTIPLEXER_HEADER_SIZE = 8
 
+// INGRESS_MAX_RESTARTS is how many times the downstream dispatcher is restarted after a panic before giving up on it
+const INGRESS_MAX_RESTARTS = 5
+
+// INGRESS_READ_TIMEOUT is how long a connection reader blocks on its socket before checking if it should stop
+const INGRESS_READ_TIMEOUT = time.Second
+
+// INGRESS_CREDIT_READ_TIMEOUT is how long a connection reader holds a credit while waiting for data, so that idle
+// connections do not starve the others
+const INGRESS_CREDIT_READ_TIMEOUT = 100 * time.Millisecond
+
+// INGRESS_AUTH_TIMEOUT is how long a new connection has to authenticate, when an auth token or credentials are set
+const INGRESS_AUTH_TIMEOUT = 10 * time.Second
+
+// IngressOptions are the optional settings of an Ingress Server
+type IngressOptions struct {
+	// ListenAddress is the address the server binds to, e.g. "127.0.0.1". Empty means all interfaces
+	ListenAddress string
+
+	// UpstreamCredits is the maximum number of messages read from the connections but not yet consumed from
+	// upstreamChan. If <= 0, there is no such limit
+	UpstreamCredits int
+
+	// AuthToken, if non-empty, must be given as the password of the SOCKS5 username/password authentication by
+	// the applications connecting to the server (see ingress_auth.go)
+	AuthToken string
+
+	// Credentials, if non-nil, returns the username/password pairs the applications may give instead of the auth
+	// token, e.g. those the relay gave in the parameters; none means that the applications do not authenticate,
+	// unless AuthToken is set
+	Credentials func() map[string]string
+
+	// KeepaliveInterval, if > 0, is how long a connection can be idle (no data in either direction) before a
+	// keepalive frame is sent upstream for it, so that the relay does not close the stream as idle
+	KeepaliveInterval time.Duration
+
+	// FailureMode is what the server does with the new connections while the DC-net is down (see ingress_failure.go);
+	// empty means INGRESS_FAIL_CLOSED
+	FailureMode FailureMode
+
+	// DCNetUp, if non-nil, tells whether the DC-net of the client is up; if nil, it is considered always up
+	DCNetUp func() bool
+}
+
 // MultiplexedConnection represents a TCP connections to which we assigned
 // a stream ID
 type MultiplexedConnection struct {
@@ -27,6 +76,37 @@ type MultiplexedConnection struct {
 	conn             net.Conn
 	stopChan         chan bool
 	maxMessageLength int
+
+	// true if the application must authenticate, as the credentials required when it connected
+	authenticate bool
+
+	// number of bytes still to drop from the downstream data, i.e. the SOCKS server's answer to the negotiation we
+	// replayed after authenticating the connection. Guarded by activeConnectionsLock
+	downstreamToDrop int
+
+	// the last time data went through the stream, in either direction, in ns since the epoch (atomic)
+	lastActivity int64
+
+	// on the egress side, 1 once the stream was closed for being idle (atomic)
+	closedAsIdle int32
+
+	// the window for the data we send on the stream, and the writer of the data we receive on it (see mux.go);
+	// nil without flow control
+	window *sendWindow
+	writer *streamWriter
+
+	// 1 once the stream was reset, by either side (atomic)
+	reset int32
+}
+
+// touch records that data went through the stream now
+func (mc *MultiplexedConnection) touch() {
+	atomic.StoreInt64(&mc.lastActivity, time.Now().UnixNano())
+}
+
+// idleFor returns how long the stream has been idle
+func (mc *MultiplexedConnection) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&mc.lastActivity)))
 }
 
 // IngressServer accepts TCPs connections and multiplexes them (read- and write-)
@@ -40,39 +120,121 @@ type IngressServer struct {
 	upstreamChan          chan []byte
 	downstreamChan        chan []byte
 	stopChan              chan bool
+	stopped               chan bool // closed once the server stopped, so that another one can take over the channels
 	verbose               bool
+	credentials           *ingressCredentials
+	keepaliveInterval     time.Duration
+	supervisor            *utils.Supervisor // recovers the panics of the dispatcher and of the connection readers
+	failover              *ingressFailover  // handles the new connections while the DC-net is down
+
+	// if non-nil, a connection reader needs to take a credit before reading from its socket, and gives it back once
+	// the data has been consumed from upstreamChan (i.e., put in a DC-net slot). When no credit is available, we do
+	// not read, and TCP's flow control throttles the applications.
+	upstreamCredits chan bool
 }
 
-// StartIngressServer creates (and block) an Ingress Server
+// StartIngressServer creates (and block) an Ingress Server, which reads from the connections as fast as upstreamChan is consumed
 func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	StartIngressServerWithCredits(port, maxMessageSize, 0, upstreamChan, downstreamChan, stopChan, verbose)
+}
+
+// StartIngressServerWithCredits creates (and block) an Ingress Server, which holds at most upstreamCredits messages read
+// from the connections but not yet consumed from upstreamChan. If upstreamCredits <= 0, there is no such limit.
+func StartIngressServerWithCredits(port int, maxMessageSize int, upstreamCredits int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	StartIngressServerWithOptions(port, maxMessageSize, IngressOptions{UpstreamCredits: upstreamCredits}, upstreamChan, downstreamChan, stopChan, verbose)
+}
 
+// StartIngressServerWithOptions creates (and block) an Ingress Server, with the given options
+func StartIngressServerWithOptions(port int, maxMessageSize int, options IngressOptions, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	ig, err := ListenIngressServer(port, maxMessageSize, options, upstreamChan, downstreamChan, stopChan, verbose)
+	if err != nil {
+		log.Error("Ingress server cannot start listening, shutting down :", err.Error())
+		return
+	}
+	ig.Serve()
+}
+
+// ListenIngressServer creates an Ingress Server and binds its socket, but does not accept connections until Serve()
+// is called. If port is 0, a free port is chosen, see Addr()
+func ListenIngressServer(port int, maxMessageSize int, options IngressOptions, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) (*IngressServer, error) {
+
+	upstreamCredits := options.UpstreamCredits
 	ig := new(IngressServer)
 	ig.maxMessageSize = maxMessageSize
 	ig.upstreamChan = upstreamChan
 	ig.downstreamChan = downstreamChan
 	ig.stopChan = stopChan
+	ig.stopped = make(chan bool)
 	ig.maxPayloadSize = maxMessageSize - MULTIPLEXER_HEADER_SIZE //we use 8 bytes for the multiplexing
 	ig.activeConnectionsLock = new(sync.Mutex)
 	ig.activeConnections = make([]*MultiplexedConnection, 0)
 	ig.verbose = verbose
+	ig.credentials = &ingressCredentials{token: options.AuthToken, credentials: options.Credentials}
+	ig.keepaliveInterval = options.KeepaliveInterval
+	ig.failover = newIngressFailover(options)
+	ig.supervisor = utils.NewSupervisor("Ingress server", INGRESS_MAX_RESTARTS)
+	if upstreamCredits > 0 {
+		ig.upstreamCredits = make(chan bool, upstreamCredits)
+		for i := 0; i < upstreamCredits; i++ {
+			ig.upstreamCredits <- true
+		}
+	}
 	if verbose {
 		log.Lvl1("Ingress Server in verbose mode")
 	}
 
-	var err error
-	s, err := net.Listen("tcp", ":"+strconv.Itoa(port))
-
+	s, err := net.Listen("tcp", net.JoinHostPort(options.ListenAddress, strconv.Itoa(port)))
 	if err != nil {
-		log.Error("Ingress server cannot start listening, shutting down :", err.Error())
-		return
+		return nil, err
 	}
-	log.Lvl2("Ingress server is listening for connections on port ", port)
+	socksLog.Lvl2("Ingress server is listening for connections on", s.Addr().String(), "(authentication required:", ig.credentials.required(), ")")
 
 	// cast as TCPListener to get the SetDeadline method
 	ig.socketListener = s.(*net.TCPListener)
+	return ig, nil
+}
+
+// Addr returns the address the Ingress Server listens on
+func (ig *IngressServer) Addr() net.Addr {
+	return ig.socketListener.Addr()
+}
+
+// Port returns the port the Ingress Server listens on
+func (ig *IngressServer) Port() int {
+	return ig.socketListener.Addr().(*net.TCPAddr).Port
+}
+
+// FailureStatus describes the failure mode of the server, whether the DC-net is up, and how many connections were
+// refused or sent without anonymity while it was down
+func (ig *IngressServer) FailureStatus() []string {
+	return ig.failover.status()
+}
+
+// ConnectionsRefused returns how many connections were refused while the DC-net was down (fail-closed)
+func (ig *IngressServer) ConnectionsRefused() int {
+	return int(atomic.LoadInt64(&ig.failover.refused))
+}
+
+// ConnectionsWithoutAnonymity returns how many connections went directly to their destination while the DC-net was
+// down (fail-open)
+func (ig *IngressServer) ConnectionsWithoutAnonymity() int {
+	return int(atomic.LoadInt64(&ig.failover.passedThrough))
+}
+
+// Stop stops the server as sending on stopChan does, and returns once it released the upstream and downstream
+// channels, e.g. for another server to take over
+func (ig *IngressServer) Stop() {
+	ig.stopChan <- true
+	<-ig.stopped
+}
+
+// Serve accepts the connections, and blocks until something is sent on stopChan
+func (ig *IngressServer) Serve() {
+	stopChan := ig.stopChan
 
 	// starts a handler that dispatches the data from "downstreamChan" into the correct connection
-	go ig.multiplexedChannelReader()
+	ig.supervisor.Go("socks-downstream", ig.multiplexedChannelReader)
+	defer close(ig.stopped)
 
 	for {
 		ig.socketListener.SetDeadline(time.Now().Add(time.Second))
@@ -80,7 +242,7 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 
 		select {
 		case <-stopChan:
-			log.Lvl2("Ingress server stopped.")
+			socksLog.Lvl2("Ingress server stopped.")
 
 			//stops all subroutines
 			for _, mc := range ig.activeConnections {
@@ -96,11 +258,11 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 				// it was a timeout
 				continue
 			}
-			log.Lvl3("Ingress server error:", err)
+			socksLog.Lvl3("Ingress server error:", err)
 		}
 
 		id := generateRandomID()
-		log.Lvl2("Ingress server just accepted a connection, assigning ID", id)
+		socksLog.Lvl2("Ingress server just accepted a connection, assigning ID", id)
 
 		if err != nil {
 			log.Error("Ingress server got an error with this new connection, shutting down :", err.Error())
@@ -108,6 +270,11 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 			return
 		}
 
+		if !ig.failover.isUp() {
+			ig.failover.handle(conn, ig.credentials)
+			continue
+		}
+
 		mc := new(MultiplexedConnection)
 		mc.conn = conn
 		mc.ID = id
@@ -115,6 +282,18 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 		mc.ID_bytes = ID_bytes[0:4]
 		mc.stopChan = make(chan bool, 1)
 		mc.maxMessageLength = ig.maxMessageSize
+		mc.touch()
+		if ig.credentials.required() {
+			mc.authenticate = true
+			mc.downstreamToDrop = socks5NoAuthReplyLength
+		}
+		mc.window = newSendWindow(MUX_INITIAL_WINDOW)
+		mc.writer = newStreamWriter(conn, MUX_INITIAL_WINDOW, func(n int) {
+			ig.sendUpstream(newWindowUpdateFrame(mc.ID_bytes, n))
+		}, func() {
+			ig.resetStream(mc)
+		})
+		go mc.writer.run()
 
 		// lock the list before editing it
 		ig.activeConnectionsLock.Lock()
@@ -122,7 +301,7 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 		ig.activeConnectionsLock.Unlock()
 
 		// starts a handler that pours "mc.connection" into upstreamChan
-		go ig.ingressConnectionReader(mc)
+		go ig.supervisedConnectionReader(mc)
 	}
 }
 
@@ -130,7 +309,12 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 func (ig *IngressServer) multiplexedChannelReader() {
 	for {
 		// poll the downstream chanel
-		slice := <-ig.downstreamChan
+		var slice []byte
+		select {
+		case slice = <-ig.downstreamChan:
+		case <-ig.stopped:
+			return
+		}
 
 		if len(slice) < MULTIPLEXER_HEADER_SIZE {
 			// we cannot de-multiplex data without the header, just ignore
@@ -141,68 +325,224 @@ func (ig *IngressServer) multiplexedChannelReader() {
 			log.Lvl1("Ingress Server <- DCNet: \n", hex.Dump(slice))
 		}
 
-		ID := slice[0:4]
-		length := int(binary.BigEndian.Uint32(slice[4:MULTIPLEXER_HEADER_SIZE]))
-		data := slice[MULTIPLEXER_HEADER_SIZE:]
+		ig.dispatchDownstream(parseFrame(slice))
+	}
+}
 
-		// trim the data if needed
-		if len(data) > length {
-			data = data[0:length]
+// dispatchDownstream handles a frame for the connection ID. The lock is released with a defer, so that the dispatcher
+// can be restarted if it panics
+func (ig *IngressServer) dispatchDownstream(ID []byte, frameType byte, data []byte) {
+	ig.activeConnectionsLock.Lock()
+	defer ig.activeConnectionsLock.Unlock()
+
+	var mc *MultiplexedConnection
+	for _, v := range ig.activeConnections {
+		if bytes.Equal(v.ID_bytes, ID) {
+			mc = v
+			break
 		}
+	}
+	if mc == nil {
+		return
+	}
 
-		ig.activeConnectionsLock.Lock()
-		for _, v := range ig.activeConnections {
-			if bytes.Equal(v.ID_bytes, ID) {
-				v.conn.Write(data)
-				break
+	switch frameType {
+	case MUX_FRAME_DATA:
+		if mc.downstreamToDrop > 0 {
+			n := mc.downstreamToDrop
+			if n > len(data) {
+				n = len(data)
 			}
+			data = data[n:]
+			mc.downstreamToDrop -= n
+			mc.writer.credit(n)
 		}
-		ig.activeConnectionsLock.Unlock()
+		if len(data) > 0 {
+			// the writer of the connection queues the data, so that an application which does not read only stalls
+			// its own stream
+			if !mc.writer.push(data) {
+				log.Error("Ingress server: stream", mc.ID, "received more than its window, resetting it")
+				go ig.resetStream(mc)
+				mc.writer.close()
+			}
+			mc.touch()
+		}
+	case MUX_FRAME_WINDOW_UPDATE:
+		mc.window.add(windowUpdate(data))
+	case MUX_FRAME_RST:
+		socksLog.Lvl2("Ingress server: stream", mc.ID, "was reset by the relay, closing it")
+		mc.markReset()
+		mc.writer.close()
+	default:
+		socksLog.Lvl2("Ingress server: unknown frame type", frameType, "for stream", mc.ID, ", discarding")
+	}
+}
 
+// supervisedConnectionReader runs ingressConnectionReader, and closes the connection if it panics; the other
+// connections are not affected. The reader is not restarted, since its stream is in an unknown state.
+func (ig *IngressServer) supervisedConnectionReader(mc *MultiplexedConnection) {
+	err := ig.supervisor.Protect("socks-connection", func() error {
+		ig.ingressConnectionReader(mc)
+		return nil
+	})
+	if err != nil {
+		socksLog.Lvl2("Ingress server: closing connection", mc.ID, "after a crash of its reader")
+		mc.writer.close()
+		mc.conn.Close()
 	}
 }
 
 func (ig *IngressServer) ingressConnectionReader(mc *MultiplexedConnection) {
+	readTimeout := INGRESS_READ_TIMEOUT
+	if ig.upstreamCredits != nil {
+		readTimeout = INGRESS_CREDIT_READ_TIMEOUT
+	}
+
+	if mc.authenticate {
+		mc.conn.SetDeadline(time.Now().Add(INGRESS_AUTH_TIMEOUT))
+		if err := authenticateSOCKS5(mc.conn, ig.credentials); err != nil {
+			socksLog.Lvl2("Ingress server: refusing connection", mc.ID, "from", mc.conn.RemoteAddr(), ",", err)
+			mc.writer.close()
+			mc.conn.Close()
+			return
+		}
+		mc.conn.SetDeadline(time.Time{})
+
+		// the SOCKS server behind the relay does not know about the token nor the credentials; the window of the
+		// stream is whole before its first frame
+		mc.window.take(len(socks5NoAuthGreeting), readTimeout)
+		if ig.upstreamCredits != nil {
+			<-ig.upstreamCredits
+		}
+		ig.upstreamChan <- ig.multiplex(mc, socks5NoAuthGreeting)
+		ig.releaseUpstreamCredit()
+	}
+
 	for {
 		// Check if we need to stop
 		select {
 		case _ = <-mc.stopChan:
+			mc.writer.close()
 			mc.conn.Close()
 			return
 		default:
 		}
+		if mc.isReset() {
+			// the writer closes the connection once it wrote what it holds
+			return
+		}
+
+		// Wait until the relay can take more data of this stream
+		window := mc.window.take(ig.maxPayloadSize, readTimeout)
+		if window == 0 {
+			if ig.keepaliveInterval > 0 && mc.idleFor() >= ig.keepaliveInterval {
+				ig.sendKeepalive(mc)
+			}
+			continue
+		}
+
+		// Wait until there is upstream capacity before touching the socket
+		if ig.upstreamCredits != nil {
+			select {
+			case _ = <-mc.stopChan:
+				mc.writer.close()
+				mc.conn.Close()
+				return
+			case <-ig.upstreamCredits:
+			}
+		}
 
 		// Read data from the connection
-		buffer := make([]byte, ig.maxPayloadSize)
-		mc.conn.SetReadDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, window)
+		mc.conn.SetReadDeadline(time.Now().Add(readTimeout))
 		n, err := mc.conn.Read(buffer)
+		mc.window.add(window - n)
 
 		if err != nil {
+			ig.releaseUpstreamCredit()
+
 			if err, ok := err.(*net.OpError); ok && err.Timeout() {
 				// it was a timeout
+				if ig.keepaliveInterval > 0 && mc.idleFor() >= ig.keepaliveInterval {
+					ig.sendKeepalive(mc)
+				}
 				continue
 			}
-
-			if err == io.EOF {
-				// Connection closed indicator
+			if mc.isReset() {
 				return
 			}
 
-			log.Error("Ingress server: connectionReader error,", err)
+			if err != io.EOF {
+				log.Error("Ingress server: connectionReader error,", err)
+			}
+			// Connection closed : the relay closes the stream on its side
+			ig.resetStream(mc)
+			mc.writer.close()
 			return
 		}
 
 		// Trim the data and send it through the data channel
-		slice := make([]byte, n+MULTIPLEXER_HEADER_SIZE)
-		copy(slice[0:4], mc.ID_bytes[:])
-		binary.BigEndian.PutUint32(slice[4:8], uint32(n))
-		copy(slice[MULTIPLEXER_HEADER_SIZE:], buffer[:n])
+		slice := ig.multiplex(mc, buffer[:n])
 
 		if ig.verbose {
 			log.Lvl1("Ingress Server -> DCNet:\n", hex.Dump(slice))
 		}
 
+		mc.touch()
 		ig.upstreamChan <- slice
+		ig.releaseUpstreamCredit()
+	}
+}
+
+// sendKeepalive sends upstream a frame without data for mc, which tells the relay that the stream is still in use
+func (ig *IngressServer) sendKeepalive(mc *MultiplexedConnection) {
+	socksLog.Lvl3("Ingress server: stream", mc.ID, "idle for", mc.idleFor(), ", sending a keepalive")
+	if ig.upstreamCredits != nil {
+		select {
+		case <-mc.stopChan:
+			mc.stopChan <- true // the reader loop stops at its next iteration
+			return
+		case <-ig.upstreamCredits:
+		}
+	}
+	mc.touch()
+	ig.upstreamChan <- ig.multiplex(mc, nil)
+	ig.releaseUpstreamCredit()
+}
+
+// multiplex prepends the multiplexer header of mc to data
+func (ig *IngressServer) multiplex(mc *MultiplexedConnection, data []byte) []byte {
+	return newFrame(mc.ID_bytes, MUX_FRAME_DATA, data)
+}
+
+// resetStream sends a RST upstream for mc, unless its stream was already reset
+func (ig *IngressServer) resetStream(mc *MultiplexedConnection) {
+	if mc.markReset() {
+		socksLog.Lvl2("Ingress server: resetting stream", mc.ID)
+		ig.sendUpstream(newFrame(mc.ID_bytes, MUX_FRAME_RST, nil))
+	}
+}
+
+// sendUpstream sends a control frame upstream, with a credit; it gives up if the server stops
+func (ig *IngressServer) sendUpstream(slice []byte) {
+	if ig.upstreamCredits != nil {
+		select {
+		case <-ig.upstreamCredits:
+		case <-ig.stopped:
+			return
+		}
+	}
+	select {
+	case ig.upstreamChan <- slice:
+	case <-ig.stopped:
+	}
+	ig.releaseUpstreamCredit()
+}
+
+// releaseUpstreamCredit gives back a credit taken by a connection reader
+func (ig *IngressServer) releaseUpstreamCredit() {
+	if ig.upstreamCredits != nil {
+		ig.upstreamCredits <- true
 	}
 }
 
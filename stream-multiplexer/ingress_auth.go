@@ -0,0 +1,118 @@
+package stream_multiplexer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+/*
+The ingress server only forwards bytes; the SOCKS protocol is spoken with the SOCKS server behind the relay. When an
+auth token or credentials are set, the ingress server answers the SOCKS5 method negotiation itself, and only accepts
+the username/password method (RFC 1929), with the token as password (the username is then ignored), or with one of
+the username/password pairs of the credentials. It then replays a "no authentication" negotiation to the SOCKS
+server, and drops the server's answer, so that the rest of the stream (CONNECT request and reply, then the data) goes
+through unchanged. This way, other users of a shared network, or the local applications which were not given
+credentials, cannot use the client as an open proxy into the anonymity network; and the username does not leave the
+client.
+*/
+
+// SOCKS5 values used for the local authentication
+const (
+	socks5Version         = 0x05
+	socks5MethodNoAuth    = 0x00
+	socks5MethodUserPass  = 0x02
+	socks5NoAcceptable    = 0xFF
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+)
+
+// socks5NoAuthGreeting is the method negotiation replayed to the SOCKS server once the client is authenticated
+var socks5NoAuthGreeting = []byte{socks5Version, 1, socks5MethodNoAuth}
+
+// socks5NoAuthReplyLength is the length of the SOCKS server's answer to socks5NoAuthGreeting, which is dropped
+const socks5NoAuthReplyLength = 2
+
+// ingressCredentials are what the applications must give to use the ingress server : the auth token as password,
+// with any username, or one of the username/password pairs of the credentials
+type ingressCredentials struct {
+	token       string
+	credentials func() map[string]string // nil if there are none
+}
+
+// pairs returns the username/password pairs accepted now
+func (c *ingressCredentials) pairs() map[string]string {
+	if c.credentials == nil {
+		return nil
+	}
+	return c.credentials()
+}
+
+// required returns true if the applications must authenticate
+func (c *ingressCredentials) required() bool {
+	return c.token != "" || len(c.pairs()) > 0
+}
+
+// Valid implements socks5.CredentialStore
+func (c *ingressCredentials) Valid(username, password string) bool {
+	valid := c.token != "" && subtle.ConstantTimeCompare([]byte(password), []byte(c.token)) == 1
+	if expected, found := c.pairs()[username]; found && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+		valid = true
+	}
+	return valid
+}
+
+// authenticateSOCKS5 runs the SOCKS5 method negotiation and username/password authentication on conn, and returns
+// nil if the credentials accept the username and password. On failure, the appropriate SOCKS5 error is written to
+// conn.
+func authenticateSOCKS5(conn net.Conn, credentials socks5.CredentialStore) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errors.New("not a SOCKS5 connection")
+	}
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == socks5MethodUserPass
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return errors.New("the SOCKS5 client does not offer username/password authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodUserPass}); err != nil {
+		return err
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5UserPassVersion {
+		return errors.New("wrong username/password authentication version")
+	}
+	username := make([]byte, int(header[1])+1) // + PLEN
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	password := make([]byte, int(username[len(username)-1]))
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if !credentials.Valid(string(username[:len(username)-1]), string(password)) {
+		conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return errors.New("wrong SOCKS5 username or password")
+	}
+	_, err := conn.Write([]byte{socks5UserPassVersion, socks5UserPassSuccess})
+	return err
+}
@@ -0,0 +1,144 @@
+package stream_multiplexer
+
+import (
+	"errors"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/armon/go-socks5"
+	"go.dedis.ch/onet/v3/log"
+)
+
+/*
+When the DC-net of the client is down (before its first schedule, during a resync, or once the protocol stopped), its
+SOCKS data cannot be sent anonymously. IngressOptions.FailureMode chooses what the ingress server does with the new
+connections meanwhile :
+- fail-closed (the default) : they are refused, and the applications get a connection error;
+- fail-open : they go directly to their destination, through a SOCKS server of the client, WITHOUT ANY ANONYMITY;
+  each of them is logged as an error.
+The connections accepted while the DC-net was up stay on it; their data waits for the DC-net to be back. Users who
+must not leak traffic should keep fail-closed.
+*/
+
+// FailureMode is what the ingress server does with new connections while the DC-net is down
+type FailureMode string
+
+// The possible FailureModes
+const (
+	INGRESS_FAIL_CLOSED FailureMode = "fail-closed" // new connections are refused
+	INGRESS_FAIL_OPEN   FailureMode = "fail-open"   // new connections go directly to their destination, without anonymity
+)
+
+// ParseFailureMode returns the FailureMode called name; "" gives INGRESS_FAIL_CLOSED
+func ParseFailureMode(name string) (FailureMode, error) {
+	switch FailureMode(name) {
+	case "", INGRESS_FAIL_CLOSED:
+		return INGRESS_FAIL_CLOSED, nil
+	case INGRESS_FAIL_OPEN:
+		return INGRESS_FAIL_OPEN, nil
+	}
+	return "", errors.New("unknown SOCKS failure mode \"" + name + "\", should be " + string(INGRESS_FAIL_CLOSED) + " or " + string(INGRESS_FAIL_OPEN))
+}
+
+// ingressFailover handles the connections accepted while the DC-net is down
+type ingressFailover struct {
+	mode    FailureMode
+	dcNetUp func() bool // nil means the DC-net is always up
+
+	wasUp         int32 // 1 if the DC-net was up at the last connection (atomic), to log the changes only once
+	refused       int64 // connections refused (atomic)
+	passedThrough int64 // connections sent directly to their destination (atomic)
+
+	directServerLock          sync.Mutex
+	directServer              *socks5.Server
+	directServerAuthenticates bool // true if directServer requires the credentials
+}
+
+// newIngressFailover creates the ingressFailover of options
+func newIngressFailover(options IngressOptions) *ingressFailover {
+	mode := options.FailureMode
+	if mode == "" {
+		mode = INGRESS_FAIL_CLOSED
+	}
+	return &ingressFailover{mode: mode, dcNetUp: options.DCNetUp, wasUp: 1}
+}
+
+// isUp returns true if the DC-net is up, and logs when this changed since the last connection
+func (f *ingressFailover) isUp() bool {
+	up := f.dcNetUp == nil || f.dcNetUp()
+	upInt := int32(0)
+	if up {
+		upInt = 1
+	}
+	if atomic.SwapInt32(&f.wasUp, upInt) != upInt {
+		switch {
+		case up:
+			log.Lvl1("Ingress server: the DC-net is up, the new SOCKS connections go through it again")
+		case f.mode == INGRESS_FAIL_OPEN:
+			log.Error("Ingress server: the DC-net is down, the new SOCKS connections go DIRECTLY to their destination, WITHOUT ANONYMITY (fail-open)")
+		default:
+			log.Lvl1("Ingress server: the DC-net is down, refusing the new SOCKS connections (fail-closed)")
+		}
+	}
+	return up
+}
+
+// handle takes care of conn, accepted while the DC-net is down
+func (f *ingressFailover) handle(conn net.Conn, credentials *ingressCredentials) {
+	if f.mode != INGRESS_FAIL_OPEN {
+		atomic.AddInt64(&f.refused, 1)
+		socksLog.Lvl2("Ingress server: the DC-net is down, refusing the connection from", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	server, err := f.server(credentials)
+	if err != nil {
+		log.Error("Ingress server: cannot pass the connection through directly,", err)
+		conn.Close()
+		return
+	}
+	atomic.AddInt64(&f.passedThrough, 1)
+	log.Error("Ingress server: the DC-net is down, the connection from", conn.RemoteAddr(), "goes DIRECTLY to its destination, WITHOUT ANONYMITY")
+	go func() {
+		if err := server.ServeConn(conn); err != nil {
+			socksLog.Lvl3("Ingress server: direct connection ended,", err)
+		}
+	}()
+}
+
+// server returns the SOCKS server for the direct connections, which requires the auth token or the credentials, if
+// any. The credentials may come with the parameters of the relay, after the first direct connections
+func (f *ingressFailover) server(credentials *ingressCredentials) (*socks5.Server, error) {
+	f.directServerLock.Lock()
+	defer f.directServerLock.Unlock()
+
+	authenticate := credentials.required()
+	if f.directServer == nil || f.directServerAuthenticates != authenticate {
+		config := &socks5.Config{Logger: stdlog.New(ioutil.Discard, "", 0)}
+		if authenticate {
+			config.Credentials = credentials
+		}
+		server, err := socks5.New(config)
+		if err != nil {
+			return nil, err
+		}
+		f.directServer, f.directServerAuthenticates = server, authenticate
+	}
+	return f.directServer, nil
+}
+
+// status describes the failure mode, and what it did
+func (f *ingressFailover) status() []string {
+	up := f.dcNetUp == nil || f.dcNetUp()
+	return []string{
+		"SOCKS failure mode: " + string(f.mode),
+		"DC-net up: " + strconv.FormatBool(up),
+		"SOCKS connections refused (DC-net down): " + strconv.FormatInt(atomic.LoadInt64(&f.refused), 10),
+		"SOCKS connections without anonymity (DC-net down): " + strconv.FormatInt(atomic.LoadInt64(&f.passedThrough), 10),
+	}
+}
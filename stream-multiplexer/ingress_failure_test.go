@@ -0,0 +1,131 @@
+package stream_multiplexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseFailureMode(t *testing.T) {
+	for name, expected := range map[string]FailureMode{"": INGRESS_FAIL_CLOSED, "fail-closed": INGRESS_FAIL_CLOSED, "fail-open": INGRESS_FAIL_OPEN} {
+		if mode, err := ParseFailureMode(name); err != nil || mode != expected {
+			t.Error("\""+name+"\" should be", expected, "got", mode, err)
+		}
+	}
+	if _, err := ParseFailureMode("open"); err == nil {
+		t.Error("\"open\" is not a failure mode")
+	}
+}
+
+// startFailoverIngress starts an ingress server whose DC-net is up when up is 1
+func startFailoverIngress(t *testing.T, mode FailureMode, up *int32) (*IngressServer, chan []byte) {
+	upstreamChan := make(chan []byte, 10)
+	options := IngressOptions{
+		ListenAddress: "127.0.0.1",
+		FailureMode:   mode,
+		DCNetUp:       func() bool { return atomic.LoadInt32(up) == 1 },
+	}
+	ig, err := ListenIngressServer(0, 20, options, upstreamChan, make(chan []byte), make(chan bool, 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ig.Serve()
+	return ig, upstreamChan
+}
+
+func TestIngressFailClosed(t *testing.T) {
+	up := int32(0)
+	ig, upstreamChan := startFailoverIngress(t, INGRESS_FAIL_CLOSED, &up)
+	defer ig.Stop()
+
+	// while the DC-net is down, the connections are closed right away
+	conn, err := net.Dial("tcp", ig.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{5, 1, 0})
+	if _, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Error("The connection should be refused while the DC-net is down")
+	}
+	conn.Close()
+	if ig.ConnectionsRefused() != 1 || ig.ConnectionsWithoutAnonymity() != 0 {
+		t.Error("One connection should be refused, got", ig.FailureStatus())
+	}
+
+	// once it is up, they go through it
+	atomic.StoreInt32(&up, 1)
+	conn, err = net.Dial("tcp", ig.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	select {
+	case data := <-upstreamChan:
+		if !bytes.Equal(data[MULTIPLEXER_HEADER_SIZE:], []byte{5, 1, 0}) {
+			t.Error("Expected the negotiation upstream, got", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("The connection should go through the DC-net once it is up")
+	}
+	if status := ig.FailureStatus(); status[0] != "SOCKS failure mode: fail-closed" || status[1] != "DC-net up: true" {
+		t.Error("Wrong status", status)
+	}
+}
+
+func TestIngressFailOpen(t *testing.T) {
+	up := int32(0)
+	ig, upstreamChan := startFailoverIngress(t, INGRESS_FAIL_OPEN, &up)
+	defer ig.Stop()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// while the DC-net is down, the connection is served by the local SOCKS server, directly to the echo server
+	conn, err := net.Dial("tcp", ig.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	target := echo.Addr().(*net.TCPAddr)
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, target.IP.To4()...)
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(target.Port))
+	conn.Write(append(request, port...))
+	answer := make([]byte, 12)
+	if _, err := io.ReadFull(conn, answer); err != nil || answer[1] != 0 || answer[3] != 0 {
+		t.Fatal("The local SOCKS server should connect to the echo server, got", answer, err)
+	}
+	conn.Write([]byte("direct"))
+	received := make([]byte, 6)
+	if _, err := io.ReadFull(conn, received); err != nil || string(received) != "direct" {
+		t.Error("Expected \"direct\" from the echo server, got", received, err)
+	}
+
+	select {
+	case data := <-upstreamChan:
+		t.Error("Nothing should be sent on the DC-net while it is down, got", data)
+	default:
+	}
+	if ig.ConnectionsWithoutAnonymity() != 1 || ig.ConnectionsRefused() != 0 {
+		t.Error("One connection should go without anonymity, got", ig.FailureStatus())
+	}
+}
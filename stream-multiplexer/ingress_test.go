@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"os"
@@ -331,3 +332,249 @@ func TestDownstreamIngressMultiplexer(t *testing.T) {
 	stopChan <- true
 	time.Sleep(2 * time.Second)
 }
+
+// Tests that with credits, a connection is not read while the upstream channel is not consumed
+func TestIngressUpstreamCredits(t *testing.T) {
+
+	ig := new(IngressServer)
+	ig.maxPayloadSize = 20 - MULTIPLEXER_HEADER_SIZE
+	ig.upstreamChan = make(chan []byte)
+	ig.upstreamCredits = make(chan bool, 1)
+	ig.upstreamCredits <- true
+
+	connections := make([]net.Conn, 2)
+	for i := range connections {
+		appSide, serverSide := net.Pipe()
+		connections[i] = appSide
+		mc := &MultiplexedConnection{conn: serverSide, ID_bytes: []byte{byte(i), 0, 0, 0}, stopChan: make(chan bool, 1)}
+		go ig.ingressConnectionReader(mc)
+		defer func() { mc.stopChan <- true }()
+	}
+
+	// the first write is read, and the reader blocks on the upstream channel with the only credit
+	written := make(chan int, 2)
+	for i, c := range connections {
+		go func(i int, c net.Conn) {
+			c.Write([]byte{byte(i)})
+			written <- i
+		}(i, c)
+	}
+
+	first := <-written
+	select {
+	case i := <-written:
+		t.Error("Connection", i, "should not be read while there is no credit")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// consuming the upstream channel gives the credit back, and the other connection is read
+	data := <-ig.upstreamChan
+	if int(data[0]) != first || data[MULTIPLEXER_HEADER_SIZE] != byte(first) {
+		t.Error("Expected the data of connection", first, "got", data)
+	}
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("The second connection should be read once the credit is back")
+	}
+	data = <-ig.upstreamChan
+	if int(data[0]) == first {
+		t.Error("Expected the data of the other connection, got", data)
+	}
+}
+
+// Tests that with an auth token, only the SOCKS5 clients giving it are served, and that the SOCKS server only sees a
+// "no authentication" negotiation
+func TestIngressAuthToken(t *testing.T) {
+
+	port := 3001
+	payloadLength := 20
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte)
+	stopChan := make(chan bool)
+
+	options := IngressOptions{ListenAddress: "127.0.0.1", AuthToken: "secret"}
+	go StartIngressServerWithOptions(port, payloadLength, options, upstreamChan, downstreamChan, stopChan, true)
+
+	time.Sleep(2 * time.Second)
+
+	authenticate := func(password string) (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal("Could not connect client", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte{5, 2, 0, 2}) // no auth, or username/password
+		reply := make([]byte, 2)
+		if _, err := conn.Read(reply); err != nil || !bytes.Equal(reply, []byte{5, 2}) {
+			t.Fatal("The server should select username/password, got", reply, err)
+		}
+		conn.Write(append([]byte{1, 4, 'u', 's', 'e', 'r', byte(len(password))}, []byte(password)...))
+		if _, err := conn.Read(reply); err != nil {
+			t.Fatal("Could not read the authentication status", err)
+		}
+		return conn, reply
+	}
+
+	// a wrong token is refused, and nothing is sent upstream
+	conn, status := authenticate("wrong")
+	if !bytes.Equal(status, []byte{1, 1}) {
+		t.Error("A wrong token should be refused, got", status)
+	}
+	conn.Close()
+
+	// a client that does not offer username/password is refused
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Could not connect client", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, 0})
+	reply := make([]byte, 2)
+	if _, err := conn.Read(reply); err != nil || !bytes.Equal(reply, []byte{5, 0xFF}) {
+		t.Error("A client without username/password should be refused, got", reply, err)
+	}
+	conn.Close()
+
+	select {
+	case data := <-upstreamChan:
+		t.Error("Nothing should be sent upstream for refused connections, got", data)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// the right token is accepted, and the negotiation is replayed without authentication
+	conn, status = authenticate("secret")
+	if !bytes.Equal(status, []byte{1, 0}) {
+		t.Fatal("The right token should be accepted, got", status)
+	}
+	var ID []byte
+	select {
+	case data := <-upstreamChan:
+		ID = data[0:4]
+		if !bytes.Equal(data[MULTIPLEXER_HEADER_SIZE:], []byte{5, 1, 0}) {
+			t.Error("Expected a no-authentication negotiation upstream, got", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No negotiation written on the upstreamchannel")
+	}
+
+	// then the data goes through unchanged
+	conn.Write([]byte("test"))
+	select {
+	case data := <-upstreamChan:
+		if !bytes.Equal(data[MULTIPLEXER_HEADER_SIZE:], []byte("test")) {
+			t.Error("Expected \"test\" upstream, got", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("No data written on the upstreamchannel")
+	}
+
+	// the server's answer to the replayed negotiation is dropped, even if split or followed by other data
+	downstream := func(data []byte) {
+		slice := make([]byte, MULTIPLEXER_HEADER_SIZE+len(data))
+		copy(slice[0:4], ID)
+		binary.BigEndian.PutUint32(slice[4:8], uint32(len(data)))
+		copy(slice[MULTIPLEXER_HEADER_SIZE:], data)
+		downstreamChan <- slice
+	}
+	downstream([]byte{5})
+	downstream([]byte{0, 'o', 'k'})
+	received := make([]byte, 10)
+	n, err := conn.Read(received)
+	if err != nil || !bytes.Equal(received[:n], []byte("ok")) {
+		t.Error("Expected \"ok\" downstream, got", received[:n], err)
+	}
+	conn.Close()
+
+	stopChan <- true
+	time.Sleep(2 * time.Second)
+}
+
+// Tests that the credentials, which may change while the server runs, accept their username/password pairs
+func TestIngressCredentials(t *testing.T) {
+	pairs := map[string]string{}
+	credentials := &ingressCredentials{credentials: func() map[string]string { return pairs }}
+	if credentials.required() {
+		t.Error("Without token nor credentials, the applications should not authenticate")
+	}
+	pairs = map[string]string{"browser": "s3cret"}
+	if !credentials.required() || !credentials.Valid("browser", "s3cret") {
+		t.Error("The pair of the credentials should be accepted")
+	}
+	if credentials.Valid("browser", "wrong") || credentials.Valid("mail", "s3cret") || credentials.Valid("", "") {
+		t.Error("Only the pairs of the credentials should be accepted")
+	}
+	credentials.token = "token"
+	if !credentials.Valid("anyone", "token") || !credentials.Valid("browser", "s3cret") {
+		t.Error("Both the token and the credentials should be accepted")
+	}
+
+	authenticate := func(username, password string) []byte {
+		appSide, serverSide := tcpConnectionPair(t)
+		defer appSide.Close()
+		defer serverSide.Close()
+		appSide.SetDeadline(time.Now().Add(time.Second))
+		go authenticateSOCKS5(serverSide, credentials)
+
+		appSide.Write([]byte{5, 1, 2})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(appSide, reply); err != nil || !bytes.Equal(reply, []byte{5, 2}) {
+			t.Fatal("The server should select username/password, got", reply, err)
+		}
+		request := append([]byte{1, byte(len(username))}, username...)
+		appSide.Write(append(append(request, byte(len(password))), password...))
+		if _, err := io.ReadFull(appSide, reply); err != nil {
+			t.Fatal("Could not read the authentication status", err)
+		}
+		return reply
+	}
+	if status := authenticate("browser", "s3cret"); !bytes.Equal(status, []byte{1, 0}) {
+		t.Error("The right username and password should be accepted, got", status)
+	}
+	if status := authenticate("mail", "s3cret"); !bytes.Equal(status, []byte{1, 1}) {
+		t.Error("Another username should be refused, got", status)
+	}
+}
+
+// Tests that an idle connection sends keepalive frames (no data) upstream
+func TestIngressKeepalive(t *testing.T) {
+
+	ig := new(IngressServer)
+	ig.maxPayloadSize = 20 - MULTIPLEXER_HEADER_SIZE
+	ig.upstreamChan = make(chan []byte, 10)
+	ig.keepaliveInterval = 100 * time.Millisecond
+
+	appSide, serverSide := tcpConnectionPair(t)
+	defer appSide.Close()
+	mc := &MultiplexedConnection{conn: serverSide, ID_bytes: []byte{1, 2, 3, 4}, stopChan: make(chan bool, 1)}
+	mc.touch()
+	go ig.ingressConnectionReader(mc)
+	defer func() { mc.stopChan <- true }()
+
+	select {
+	case data := <-ig.upstreamChan:
+		if !bytes.Equal(data, []byte{1, 2, 3, 4, 0, 0, 0, 0}) {
+			t.Error("Expected a keepalive frame, got", data)
+		}
+	case <-time.After(3 * INGRESS_READ_TIMEOUT):
+		t.Error("No keepalive sent for the idle connection")
+	}
+}
+
+// tcpConnectionPair returns both ends of a local TCP connection (net.Pipe has no timeouts of type *net.OpError)
+func tcpConnectionPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
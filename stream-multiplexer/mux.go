@@ -0,0 +1,260 @@
+package stream_multiplexer
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The frames of the multiplexer are : stream ID (4 bytes), type (1 byte) and length (3 bytes) of the data, data. The
+type used to be the high byte of a 4-byte length, hence the data frames did not change.
+  - DATA carries data of the stream; without data, it is a keepalive.
+  - WINDOW_UPDATE carries a 4-byte count of bytes : the receiver wrote that many bytes of the stream to its connection
+    (or dropped them), and the sender may send that many more.
+  - RST tells that the sender is done with the stream : the receiver writes what it already received, then closes its
+    connection. It is sent when a connection is closed (there is no half-close), cannot be written to, or when a
+    stream sends more than its window.
+
+Each side may have at most MUX_INITIAL_WINDOW bytes of a stream in flight, i.e. sent but not yet acknowledged by a
+WINDOW_UPDATE. The data received is queued per stream and written to the connection by a goroutine of the stream, so
+a destination (or an application) which does not read only stalls its own stream, and not the dispatcher of all the
+others; the window bounds its queue.
+*/
+
+// The types of the frames, in the high byte of their length field
+const (
+	MUX_FRAME_DATA          = 0
+	MUX_FRAME_WINDOW_UPDATE = 1
+	MUX_FRAME_RST           = 2
+)
+
+// MUX_LENGTH_MASK gives the length of the data of a frame from its length field
+const MUX_LENGTH_MASK = 0x00FFFFFF
+
+// MUX_INITIAL_WINDOW is how many bytes of a stream can be in flight in each direction, before a WINDOW_UPDATE
+const MUX_INITIAL_WINDOW = 256 * 1024
+
+// MUX_FLUSH_TIMEOUT is how long a closed stream has to write the data it still holds to its connection
+const MUX_FLUSH_TIMEOUT = 5 * time.Second
+
+// newFrame returns the frame of the given type carrying data for the stream ID
+func newFrame(ID []byte, frameType byte, data []byte) []byte {
+	slice := make([]byte, len(data)+MULTIPLEXER_HEADER_SIZE)
+	copy(slice[0:4], ID)
+	binary.BigEndian.PutUint32(slice[4:8], uint32(frameType)<<24|uint32(len(data)))
+	copy(slice[MULTIPLEXER_HEADER_SIZE:], data)
+	return slice
+}
+
+// newWindowUpdateFrame returns the frame giving n more bytes of window to the stream ID
+func newWindowUpdateFrame(ID []byte, n int) []byte {
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(n))
+	return newFrame(ID, MUX_FRAME_WINDOW_UPDATE, count)
+}
+
+// parseFrame returns the stream ID, the type and the data of a frame of at least MULTIPLEXER_HEADER_SIZE bytes; the
+// data is trimmed to its length
+func parseFrame(slice []byte) ([]byte, byte, []byte) {
+	field := binary.BigEndian.Uint32(slice[4:MULTIPLEXER_HEADER_SIZE])
+	length := int(field & MUX_LENGTH_MASK)
+	data := slice[MULTIPLEXER_HEADER_SIZE:]
+	if len(data) > length {
+		data = data[:length]
+	}
+	return slice[0:4], byte(field >> 24), data
+}
+
+// windowUpdate returns the count of bytes of a WINDOW_UPDATE, 0 if it is malformed
+func windowUpdate(data []byte) int {
+	if len(data) != 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(data))
+}
+
+// markReset records that the stream was reset, by either side; it returns false if it already was
+func (mc *MultiplexedConnection) markReset() bool {
+	return atomic.CompareAndSwapInt32(&mc.reset, 0, 1)
+}
+
+// isReset returns true once the stream was reset
+func (mc *MultiplexedConnection) isReset() bool {
+	return atomic.LoadInt32(&mc.reset) == 1
+}
+
+// sendWindow is how many bytes of a stream we may still send before the peer acknowledges some. A nil sendWindow
+// has no limit.
+type sendWindow struct {
+	sync.Mutex
+	available int
+	updated   chan bool // signals the reader waiting in take() that the window grew
+}
+
+func newSendWindow(size int) *sendWindow {
+	return &sendWindow{available: size, updated: make(chan bool, 1)}
+}
+
+// add gives n more bytes to the window, e.g. on a WINDOW_UPDATE, or those a reader took but did not use
+func (w *sendWindow) add(n int) {
+	if w == nil || n <= 0 {
+		return
+	}
+	w.Lock()
+	w.available += n
+	w.Unlock()
+	select {
+	case w.updated <- true:
+	default:
+	}
+}
+
+// take waits until the window is open, and takes at most max bytes from it; it returns 0 if the window stays closed
+// for timeout
+func (w *sendWindow) take(max int, timeout time.Duration) int {
+	if w == nil {
+		return max
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		w.Lock()
+		if w.available > 0 {
+			n := max
+			if n > w.available {
+				n = w.available
+			}
+			w.available -= n
+			w.Unlock()
+			return n
+		}
+		w.Unlock()
+
+		select {
+		case <-w.updated:
+		case <-timer.C:
+			return 0
+		}
+	}
+}
+
+// streamWriter writes the data received for a stream to its connection, from a goroutine of its own (see run()). It
+// grants the peer a window of bytes in flight, and acknowledges the bytes written with WINDOW_UPDATEs.
+type streamWriter struct {
+	sync.Mutex
+	conn     net.Conn
+	window   int
+	queue    [][]byte
+	queued   int  // bytes in the queue
+	consumed int  // bytes written or dropped since the last WINDOW_UPDATE
+	closing  bool // once closed, the queue is flushed, then the connection is closed
+	signal   chan bool
+
+	sendUpdate func(n int) // sends a WINDOW_UPDATE of n bytes to the peer
+	failed     func()      // called if the connection cannot be written to; the writer then closes it
+}
+
+func newStreamWriter(conn net.Conn, window int, sendUpdate func(n int), failed func()) *streamWriter {
+	return &streamWriter{conn: conn, window: window, signal: make(chan bool, 1), sendUpdate: sendUpdate, failed: failed}
+}
+
+// push queues data to be written to the connection; it returns false if the peer sent more than its window. The data
+// received once the writer is closed is dropped.
+func (w *streamWriter) push(data []byte) bool {
+	w.Lock()
+	defer w.Unlock()
+	if w.closing {
+		return true
+	}
+	if w.queued+w.consumed+len(data) > w.window {
+		return false
+	}
+	w.queue = append(w.queue, append([]byte(nil), data...)) // the frame may be a pooled cell, reused once dispatched
+	w.queued += len(data)
+	w.wake()
+	return true
+}
+
+// credit counts n bytes of the stream which were dropped instead of written, so that the peer gets them back
+func (w *streamWriter) credit(n int) {
+	w.acknowledge(n)
+}
+
+// close makes the writer write what it holds, then close the connection
+func (w *streamWriter) close() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.closing {
+		return
+	}
+	w.closing = true
+	w.conn.SetWriteDeadline(time.Now().Add(MUX_FLUSH_TIMEOUT))
+	w.wake()
+}
+
+func (w *streamWriter) wake() {
+	select {
+	case w.signal <- true:
+	default:
+	}
+}
+
+// acknowledge counts n bytes written or dropped, and sends a WINDOW_UPDATE once they are half of the window
+func (w *streamWriter) acknowledge(n int) {
+	w.Lock()
+	w.consumed += n
+	if w.closing || w.consumed < w.window/2 {
+		w.Unlock()
+		return
+	}
+	n = w.consumed
+	w.consumed = 0
+	w.Unlock()
+	w.sendUpdate(n)
+}
+
+// run writes the queue to the connection, until the writer is closed and flushed, or the connection fails
+func (w *streamWriter) run() {
+	for {
+		w.Lock()
+		for len(w.queue) == 0 && !w.closing {
+			w.Unlock()
+			<-w.signal
+			w.Lock()
+		}
+		if len(w.queue) == 0 {
+			w.Unlock()
+			w.conn.Close()
+			return
+		}
+		data := w.queue[0]
+		w.Unlock()
+
+		if _, err := w.conn.Write(data); err != nil {
+			w.Lock()
+			closing := w.closing
+			w.closing = true
+			w.queue = nil
+			w.queued = 0
+			w.Unlock()
+			w.conn.Close()
+			if !closing {
+				socksLog.Lvl2("Stream multiplexer: could not write to", w.conn.RemoteAddr(), ",", err)
+				w.failed()
+			}
+			return
+		}
+
+		w.Lock()
+		w.queue = w.queue[1:]
+		w.queued -= len(data)
+		w.Unlock()
+		w.acknowledge(len(data))
+	}
+}
@@ -0,0 +1,195 @@
+package stream_multiplexer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxFrames(t *testing.T) {
+	ID := []byte("1234")
+
+	// a data frame is padded to the payload size in the DC-net
+	frame := append(newFrame(ID, MUX_FRAME_DATA, []byte("hello")), make([]byte, 10)...)
+	if !bytes.Equal(frame[4:8], []byte{0, 0, 0, 5}) {
+		t.Error("A data frame should have the header of the previous framing, got", frame[4:8])
+	}
+	frameID, frameType, data := parseFrame(frame)
+	if !bytes.Equal(frameID, ID) || frameType != MUX_FRAME_DATA || string(data) != "hello" {
+		t.Error("Expected the data frame of stream 1234, got", frameID, frameType, data)
+	}
+
+	frameID, frameType, data = parseFrame(newWindowUpdateFrame(ID, 70000))
+	if !bytes.Equal(frameID, ID) || frameType != MUX_FRAME_WINDOW_UPDATE || windowUpdate(data) != 70000 {
+		t.Error("Expected a window update of 70000 bytes, got", frameType, data)
+	}
+	if windowUpdate([]byte{1, 2}) != 0 {
+		t.Error("A malformed window update should give nothing")
+	}
+	if _, frameType, data = parseFrame(newFrame(ID, MUX_FRAME_RST, nil)); frameType != MUX_FRAME_RST || len(data) != 0 {
+		t.Error("Expected a reset without data, got", frameType, data)
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	w := newSendWindow(100)
+	if n := w.take(60, time.Second); n != 60 {
+		t.Error("Expected 60 bytes of the window, got", n)
+	}
+	if n := w.take(60, time.Second); n != 40 {
+		t.Error("Expected the 40 bytes left in the window, got", n)
+	}
+	if n := w.take(60, 100*time.Millisecond); n != 0 {
+		t.Error("The window should be closed, got", n)
+	}
+
+	// a window update wakes the reader waiting on the window
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.add(30)
+	}()
+	if n := w.take(60, time.Second); n != 30 {
+		t.Error("Expected the 30 bytes of the update, got", n)
+	}
+
+	var unlimited *sendWindow
+	if n := unlimited.take(60, time.Second); n != 60 {
+		t.Error("Without flow control, the window should not limit the reads")
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	appSide, muxSide := net.Pipe()
+	updates := make(chan int, 10)
+	failed := make(chan bool, 1)
+	w := newStreamWriter(muxSide, 100, func(n int) { updates <- n }, func() { failed <- true })
+	go w.run()
+
+	// the application does not read : the writer queues up to the window, without blocking
+	if !w.push(bytes.Repeat([]byte{1}, 60)) || !w.push(bytes.Repeat([]byte{2}, 40)) {
+		t.Fatal("The writer should queue up to the window")
+	}
+	if w.push([]byte{3}) {
+		t.Error("The writer should refuse the data beyond the window")
+	}
+
+	// once half of the window is written, it is given back
+	received := make([]byte, 100)
+	if _, err := io.ReadFull(appSide, received[:60]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-updates:
+		if n != 60 {
+			t.Error("Expected a window update of the 60 bytes written, got", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("No window update once half of the window was written")
+	}
+
+	// once closed, the writer flushes its queue, then closes the connection
+	w.close()
+	if !w.push([]byte{4}) {
+		t.Error("The data received once closing should be dropped")
+	}
+	appSide.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := io.ReadFull(appSide, received[60:]); err != nil || !bytes.Equal(received[60:], bytes.Repeat([]byte{2}, 40)) {
+		t.Error("The queue should be flushed, got", n, "bytes", err)
+	}
+	if _, err := appSide.Read(received); err != io.EOF {
+		t.Error("The connection should be closed after the flush, got", err)
+	}
+
+	// a connection which cannot be written to is reported
+	appSide, muxSide = net.Pipe()
+	appSide.Close()
+	w = newStreamWriter(muxSide, 100, func(n int) {}, func() { failed <- true })
+	go w.run()
+	w.push([]byte{1})
+	select {
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Error("The failed write should be reported")
+	}
+}
+
+// Tests that a destination which does not read only stalls its own stream, and that the streams are reset in both
+// directions
+func TestEgressStalledDestination(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	upstreamChan := make(chan []byte)
+	downstreamChan := make(chan []byte, 100)
+	go StartEgressHandler(l.Addr().String(), 4096+MULTIPLEXER_HEADER_SIZE, upstreamChan, downstreamChan, make(chan bool), false)
+	send := func(slice []byte) {
+		select {
+		case upstreamChan <- slice:
+		case <-time.After(time.Second):
+			t.Fatal("The egress server should not block on a stalled destination")
+		}
+	}
+
+	// stream A sends a whole window to a destination which does not read
+	stalledID := []byte("AAAA")
+	for sent := 0; sent < MUX_INITIAL_WINDOW; sent += 4096 {
+		send(newFrame(stalledID, MUX_FRAME_DATA, bytes.Repeat([]byte{'a'}, 4096)))
+	}
+	stalled := <-accepted
+	defer stalled.Close()
+
+	// stream B still goes through
+	ID := []byte("BBBB")
+	send(newFrame(ID, MUX_FRAME_DATA, []byte("hello")))
+	conn := <-accepted
+	conn.SetDeadline(time.Now().Add(time.Second))
+	received := make([]byte, 5)
+	if _, err := io.ReadFull(conn, received); err != nil || string(received) != "hello" {
+		t.Fatal("Stream B should go through, got", received, err)
+	}
+	conn.Write([]byte("world"))
+	nextFrame := func(ID []byte) (byte, []byte) {
+		for {
+			select {
+			case slice := <-downstreamChan:
+				if frameID, frameType, data := parseFrame(slice); bytes.Equal(frameID, ID) {
+					return frameType, data
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("No frame downstream for stream", string(ID))
+			}
+		}
+	}
+	if frameType, data := nextFrame(ID); frameType != MUX_FRAME_DATA || string(data) != "world" {
+		t.Error("Expected the answer of stream B, got", frameType, data)
+	}
+
+	// the destination closing resets the stream
+	conn.Close()
+	if frameType, _ := nextFrame(ID); frameType != MUX_FRAME_RST {
+		t.Error("The closed stream should be reset, got a frame of type", frameType)
+	}
+
+	// the client resetting the stalled stream closes its connection, once its data is written
+	send(newFrame(stalledID, MUX_FRAME_RST, nil))
+	stalled.SetReadDeadline(time.Now().Add(MUX_FLUSH_TIMEOUT))
+	if n, err := io.Copy(ioutil.Discard, stalled); err != nil || n != MUX_INITIAL_WINDOW {
+		t.Error("The destination should receive the whole window then EOF, got", n, "bytes", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package audit checks the end-to-end integrity of a running PriFi group. An audit client, an ordinary client of the
+// group run by a trustee, periodically sends known-plaintext probes through its SOCKS server, the DC-net and the
+// relay's exit to a cooperating sink. The sink checks that each probe arrived unchanged, and answers a verdict which
+// comes back through the DC-net downstream. Since the audit client looks like any other client to the relay, a relay
+// (or a disruptor) tampering with the data of the clients cannot spare the probes without also sparing the others.
+//
+// The probes and the verdicts are derived from a key shared by the audit client and the sink only : the content of
+// probe n is the SHA-256 counter-mode expansion of HMAC(key, n), and a verdict carries HMAC(key, status | n), so that
+// neither the relay nor the exit can forge one.
+//
+// On the wire, a probe is its sequence number (8 bytes) and the length of its content (4 bytes), both big-endian,
+// then the content; a verdict is the status (1 byte), then its MAC (32 bytes).
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// PROBE_HEADER_SIZE is the size of the header of a probe : the sequence number, then the length of the content
+const PROBE_HEADER_SIZE = 12
+
+// MAX_PROBE_SIZE is the largest content of a probe the sink accepts
+const MAX_PROBE_SIZE = 1 << 20
+
+// VERDICT_SIZE is the size of a verdict : the status, then its MAC
+const VERDICT_SIZE = 1 + sha256.Size
+
+// The status of a verdict
+const (
+	VERDICT_INTACT    byte = 1 // the probe arrived unchanged
+	VERDICT_CORRUPTED byte = 2 // the content of the probe differs from the expected one
+)
+
+// DeriveKey returns the key of the probes shared by the audit client and the sink, from the secret in their
+// configuration (TrusteeAuditKey)
+func DeriveKey(secret string) []byte {
+	h := sha256.Sum256([]byte("prifi-audit|" + secret))
+	return h[:]
+}
+
+// ProbeContent returns the expected content of probe seq, of size bytes
+func ProbeContent(key []byte, seq uint64, size int) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(uint64Bytes(seq))
+	seed := mac.Sum(nil)
+
+	content := make([]byte, 0, size+sha256.Size)
+	block := make([]byte, len(seed)+4)
+	copy(block, seed)
+	for counter := uint32(0); len(content) < size; counter++ {
+		binary.BigEndian.PutUint32(block[len(seed):], counter)
+		h := sha256.Sum256(block)
+		content = append(content, h[:]...)
+	}
+	return content[:size]
+}
+
+// EncodeProbe returns probe seq, with its header
+func EncodeProbe(key []byte, seq uint64, size int) []byte {
+	probe := make([]byte, PROBE_HEADER_SIZE, PROBE_HEADER_SIZE+size)
+	binary.BigEndian.PutUint64(probe[0:8], seq)
+	binary.BigEndian.PutUint32(probe[8:12], uint32(size))
+	return append(probe, ProbeContent(key, seq, size)...)
+}
+
+// ReadProbe reads a probe from r, and returns its sequence number and its content
+func ReadProbe(r io.Reader) (uint64, []byte, error) {
+	header := make([]byte, PROBE_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	seq := binary.BigEndian.Uint64(header[0:8])
+	size := binary.BigEndian.Uint32(header[8:12])
+	if size > MAX_PROBE_SIZE {
+		return seq, nil, errors.New("probe too large")
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return seq, nil, err
+	}
+	return seq, content, nil
+}
+
+// CheckProbe returns VERDICT_INTACT if content is the content of probe seq, VERDICT_CORRUPTED otherwise
+func CheckProbe(key []byte, seq uint64, content []byte) byte {
+	if hmac.Equal(content, ProbeContent(key, seq, len(content))) {
+		return VERDICT_INTACT
+	}
+	return VERDICT_CORRUPTED
+}
+
+// EncodeVerdict returns the verdict of the sink on probe seq
+func EncodeVerdict(key []byte, seq uint64, status byte) []byte {
+	return append([]byte{status}, verdictMAC(key, seq, status)...)
+}
+
+// DecodeVerdict returns the status of the verdict on probe seq, or an error if the verdict was not sent by the sink
+func DecodeVerdict(key []byte, seq uint64, verdict []byte) (byte, error) {
+	if len(verdict) != VERDICT_SIZE {
+		return 0, errors.New("invalid verdict size")
+	}
+	if !hmac.Equal(verdict[1:], verdictMAC(key, seq, verdict[0])) {
+		return 0, errors.New("invalid verdict MAC, the verdict was modified on the way back")
+	}
+	return verdict[0], nil
+}
+
+func verdictMAC(key []byte, seq uint64, status byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{status})
+	mac.Write(uint64Bytes(seq))
+	return mac.Sum(nil)
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestProbesAndVerdicts(t *testing.T) {
+	key := DeriveKey("secret")
+	if bytes.Equal(key, DeriveKey("other secret")) {
+		t.Error("Different secrets should give different keys")
+	}
+
+	probe := EncodeProbe(key, 7, 100)
+	seq, content, err := ReadProbe(bytes.NewReader(probe))
+	if err != nil || seq != 7 || len(content) != 100 {
+		t.Fatal("Could not read the probe back,", seq, len(content), err)
+	}
+	if CheckProbe(key, 7, content) != VERDICT_INTACT {
+		t.Error("The probe should be intact")
+	}
+	if bytes.Equal(content, ProbeContent(key, 8, 100)) || bytes.Equal(content, ProbeContent(DeriveKey("other secret"), 7, 100)) {
+		t.Error("The content of a probe should depend on its sequence number and on the key")
+	}
+	content[50] ^= 1
+	if CheckProbe(key, 7, content) != VERDICT_CORRUPTED {
+		t.Error("A flipped bit should be detected")
+	}
+	if _, _, err := ReadProbe(bytes.NewReader(probe[:50])); err == nil {
+		t.Error("A truncated probe should be refused")
+	}
+
+	verdict := EncodeVerdict(key, 7, VERDICT_INTACT)
+	if status, err := DecodeVerdict(key, 7, verdict); err != nil || status != VERDICT_INTACT {
+		t.Error("The verdict should be intact,", status, err)
+	}
+	if _, err := DecodeVerdict(key, 8, verdict); err == nil {
+		t.Error("The verdict of another probe should be refused")
+	}
+	verdict[0] = VERDICT_CORRUPTED
+	if _, err := DecodeVerdict(key, 7, verdict); err == nil {
+		t.Error("A modified verdict should be refused")
+	}
+}
+
+func TestSinkCorruptedProbe(t *testing.T) {
+	key := DeriveKey("secret")
+	sink, err := ListenSink("127.0.0.1:0", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sink.Serve()
+	defer sink.Close()
+
+	conn, err := net.Dial("tcp", sink.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	probe := EncodeProbe(key, 1, 64)
+	probe[PROBE_HEADER_SIZE+3] ^= 0xFF
+	conn.Write(probe)
+	conn.Write(EncodeProbe(key, 2, 64))
+	for seq, expected := range []byte{VERDICT_CORRUPTED, VERDICT_INTACT} {
+		verdict := make([]byte, VERDICT_SIZE)
+		if _, err := io.ReadFull(conn, verdict); err != nil {
+			t.Fatal(err)
+		}
+		if status, err := DecodeVerdict(key, uint64(seq+1), verdict); err != nil || status != expected {
+			t.Error("Wrong verdict for probe", seq+1, status, err)
+		}
+	}
+	if intact, corrupted, invalid := sink.Counts(); intact != 1 || corrupted != 1 || invalid != 0 {
+		t.Error("The sink should count 1 intact and 1 corrupted probe, got", intact, corrupted, invalid)
+	}
+}
+
+func TestProberThroughSOCKS(t *testing.T) {
+	key := DeriveKey("secret")
+	sink, err := ListenSink("127.0.0.1:0", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sink.Serve()
+	defer sink.Close()
+
+	server, err := socks5.New(&socks5.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+
+	prober := NewProber(ProberConfig{
+		SocksAddress: listener.Addr().String(),
+		SinkAddress:  sink.Addr().String(),
+		Key:          key,
+		Timeout:      5 * time.Second,
+	})
+	for i := 0; i < 3; i++ {
+		if err := prober.Probe(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := prober.Statistics()
+	if stats.Sent != 3 || stats.Intact != 3 || stats.Failed != 0 {
+		t.Error("The 3 probes should be intact, got", stats)
+	}
+
+	// a sink with another key answers verdicts the prober does not accept
+	other, err := ListenSink("127.0.0.1:0", DeriveKey("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go other.Serve()
+	defer other.Close()
+	prober = NewProber(ProberConfig{SocksAddress: listener.Addr().String(), SinkAddress: other.Addr().String(), Key: key, Timeout: 5 * time.Second})
+	if err := prober.Probe(); err == nil {
+		t.Error("The verdict of a sink with another key should be refused")
+	}
+	if stats := prober.Statistics(); stats.Failed != 1 || stats.LastError == "" {
+		t.Error("The probe should have failed, got", stats)
+	}
+}
@@ -0,0 +1,194 @@
+package audit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DEFAULT_PROBE_SIZE is the size of the content of the probes, if not given
+const DEFAULT_PROBE_SIZE = 1000
+
+// DEFAULT_PROBE_TIMEOUT is how long a probe may take to reach the sink and come back with its verdict, if not given
+const DEFAULT_PROBE_TIMEOUT = 60 * time.Second
+
+// ProberConfig describes where the probes go, and how often
+type ProberConfig struct {
+	SocksAddress string        // the SOCKS server of the audit client, e.g. "127.0.0.1:8081"
+	SinkAddress  string        // the sink, as reached from the relay's exit, e.g. "audit.example.org:7100"
+	Key          []byte        // the key shared with the sink, see DeriveKey
+	Interval     time.Duration // the time between two probes
+	Size         int           // the size of the content of the probes; DEFAULT_PROBE_SIZE if <= 0
+	Timeout      time.Duration // DEFAULT_PROBE_TIMEOUT if <= 0
+}
+
+// ProbeStatistics are the results of the probes sent so far
+type ProbeStatistics struct {
+	Sent        int64
+	Intact      int64  // the sink received the probe unchanged, and its verdict came back unchanged
+	Corrupted   int64  // the sink received the probe modified
+	Failed      int64  // the probe or its verdict was lost, or the verdict was modified
+	LastLatency int64  // in ms, the round trip of the last intact probe
+	LastError   string // the reason of the last probe not intact
+}
+
+// Prober sends the probes of an audit client
+type Prober struct {
+	sync.Mutex
+	config ProberConfig
+	seq    uint64
+	stats  ProbeStatistics
+}
+
+// NewProber returns a prober sending its first probe with sequence number 1
+func NewProber(config ProberConfig) *Prober {
+	if config.Size <= 0 {
+		config.Size = DEFAULT_PROBE_SIZE
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DEFAULT_PROBE_TIMEOUT
+	}
+	return &Prober{config: config}
+}
+
+// Run sends a probe every Interval, until stop receives a value
+func (p *Prober) Run(stop chan bool) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.Probe()
+		}
+	}
+}
+
+// Probe sends the next probe to the sink, waits for its verdict, and returns an error if the probe was not intact
+func (p *Prober) Probe() error {
+	p.Lock()
+	p.seq++
+	seq := p.seq
+	p.stats.Sent++
+	p.Unlock()
+
+	start := time.Now()
+	status, err := p.probe(seq)
+
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		p.stats.Failed++
+		p.stats.LastError = err.Error()
+		log.Error("Audit client : probe", seq, "failed;", err)
+		return err
+	}
+	if status != VERDICT_INTACT {
+		p.stats.Corrupted++
+		p.stats.LastError = "probe " + strconv.FormatUint(seq, 10) + " corrupted"
+		e := "Audit client : the sink received probe " + strconv.FormatUint(seq, 10) + " CORRUPTED, the DC-net does not deliver the data of the clients unchanged"
+		log.Error(e)
+		return errors.New(e)
+	}
+	p.stats.Intact++
+	p.stats.LastLatency = time.Since(start).Nanoseconds() / 1e6
+	log.Lvl2("Audit client : probe", seq, "intact, in", p.stats.LastLatency, "ms")
+	return nil
+}
+
+// probe sends probe seq on a new connection through the SOCKS server, and returns the status of the verdict
+func (p *Prober) probe(seq uint64) (byte, error) {
+	conn, err := socks5Connect(p.config.SocksAddress, p.config.SinkAddress, p.config.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.config.Timeout))
+
+	if _, err := conn.Write(EncodeProbe(p.config.Key, seq, p.config.Size)); err != nil {
+		return 0, err
+	}
+	verdict := make([]byte, VERDICT_SIZE)
+	if _, err := io.ReadFull(conn, verdict); err != nil {
+		return 0, errors.New("no verdict from the sink : " + err.Error())
+	}
+	return DecodeVerdict(p.config.Key, seq, verdict)
+}
+
+// Statistics returns the results of the probes sent so far
+func (p *Prober) Statistics() ProbeStatistics {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
+
+// socks5Connect opens a connection to target (host:port) through the SOCKS5 server at proxy, without authentication
+func socks5Connect(proxy, target string, timeout time.Duration) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) > 255 {
+		return nil, errors.New("host name too long")
+	}
+
+	conn, err := net.DialTimeout("tcp", proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// the method negotiation, then a CONNECT to the domain name (or address) of the target
+	request := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the method selection (2 bytes), the header of the reply to the CONNECT (4 bytes), then the bound address
+	answer := make([]byte, 6)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer[1] != 0 || answer[3] != 0 {
+		conn.Close()
+		return nil, errors.New("the SOCKS server refused the connection to " + target + ", reply " + strconv.Itoa(int(answer[3])))
+	}
+	var addressLength int
+	switch answer[5] {
+	case 1:
+		addressLength = net.IPv4len
+	case 4:
+		addressLength = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		addressLength = int(length[0])
+	default:
+		conn.Close()
+		return nil, errors.New("invalid SOCKS reply")
+	}
+	bound := make([]byte, addressLength+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// SINK_TIMEOUT is how long the sink waits for the rest of a probe, and for the next one on the same connection
+const SINK_TIMEOUT = 30 * time.Second
+
+// Sink receives the probes of the audit clients, checks them, and answers a verdict for each
+type Sink struct {
+	intact    int64
+	corrupted int64
+	invalid   int64
+
+	key      []byte
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// ListenSink starts a sink listening on address, e.g. ":7100", for the probes derived from key
+func ListenSink(address string, key []byte) (*Sink, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{key: key, listener: listener, conns: make(map[net.Conn]bool)}, nil
+}
+
+// Addr returns the address the sink listens on
+func (s *Sink) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts the connections of the audit clients until Close is called
+func (s *Sink) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		s.Lock()
+		s.conns[conn] = true
+		s.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers each probe received on conn
+func (s *Sink) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+	for {
+		conn.SetDeadline(time.Now().Add(SINK_TIMEOUT))
+		seq, content, err := ReadProbe(conn)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if s.isClosed() {
+				return
+			}
+			atomic.AddInt64(&s.invalid, 1)
+			log.Error("Audit sink : invalid probe", seq, "from", conn.RemoteAddr(), ";", err)
+			return
+		}
+		status := CheckProbe(s.key, seq, content)
+		if status == VERDICT_INTACT {
+			atomic.AddInt64(&s.intact, 1)
+			log.Lvl3("Audit sink : probe", seq, "intact")
+		} else {
+			atomic.AddInt64(&s.corrupted, 1)
+			log.Error("Audit sink : probe", seq, "from", conn.RemoteAddr(), "was CORRUPTED in the DC-net")
+		}
+		if _, err := conn.Write(EncodeVerdict(s.key, seq, status)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Sink) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+// Counts returns the number of probes received intact, corrupted, and invalid (e.g. truncated)
+func (s *Sink) Counts() (int64, int64, int64) {
+	return atomic.LoadInt64(&s.intact), atomic.LoadInt64(&s.corrupted), atomic.LoadInt64(&s.invalid)
+}
+
+// Close stops the sink, and closes the connections in progress
+func (s *Sink) Close() error {
+	err := s.listener.Close()
+	s.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.Unlock()
+	s.wg.Wait()
+	return err
+}
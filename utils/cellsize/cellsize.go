@@ -0,0 +1,191 @@
+// Package cellsize analyses a traffic workload (a .pcap capture, or a .pkts
+// file as used for the PCAP replay) and recommends the DC-net cell sizes and
+// window size that minimize the padding overhead for that workload.
+//
+// Every DC-net round has a fixed cost (headers, one cipher per client and
+// trustee), so the smallest cell is not always the best: the cost of a cell
+// size C for a packet of s bytes is ceil(s/C) * (C + CellOverhead).
+package cellsize
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/utils"
+)
+
+// DEFAULT_CELL_OVERHEAD is the fixed cost, in bytes, we account for each round
+const DEFAULT_CELL_OVERHEAD = 100
+
+// MIN_CELL_SIZE is the smallest cell size we recommend (the pcap meta-messages are 17 bytes)
+const MIN_CELL_SIZE = 17
+
+// MAX_WINDOW_SIZE is the largest window size we recommend
+const MAX_WINDOW_SIZE = 10
+
+// WINDOW_BURST_DURATION_MS is the time over which we look for bursts when recommending the window size
+const WINDOW_BURST_DURATION_MS = 100
+
+// Sample is one packet of the workload
+type Sample struct {
+	MsTimestamp uint64
+	Size        int
+}
+
+// Recommendation is the output of the analysis
+type Recommendation struct {
+	UpstreamCellSize   int
+	DownstreamCellSize int
+	WindowSize         int
+
+	// fraction of the transmitted bytes which are not useful (padding + per-round overhead), with the recommended sizes
+	UpstreamPaddingOverhead   float64
+	DownstreamPaddingOverhead float64
+}
+
+// LoadWorkload reads the packets of a .pcap or .pkts file
+func LoadWorkload(path string) ([]Sample, error) {
+	var packets []utils.Packet
+	var err error
+
+	//with an "infinite" payload size, the parsers do not fragment the packets
+	switch filepath.Ext(path) {
+	case ".pcap":
+		packets, err = utils.ParsePCAP(path, math.MaxInt32, 0)
+	case ".pkts":
+		packets, err = utils.ParsePKTS(path, math.MaxInt32, 0)
+	default:
+		return nil, errors.New("Unknown workload format for " + path + ", expected .pcap or .pkts")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]Sample, len(packets))
+	for i, p := range packets {
+		samples[i] = Sample{MsTimestamp: p.MsSinceBeginningOfCapture, Size: p.RealLength}
+	}
+	return samples, nil
+}
+
+// Recommend computes the best cell sizes for the upstream and downstream workloads, and the window size for the
+// upstream one. downstream can be nil, in which case the downstream cell size is the upstream one.
+func Recommend(upstream []Sample, downstream []Sample, cellOverhead int) (*Recommendation, error) {
+	if len(upstream) == 0 {
+		return nil, errors.New("Cannot recommend anything for an empty workload")
+	}
+	if cellOverhead < 0 {
+		return nil, errors.New("cellOverhead cannot be negative")
+	}
+
+	r := new(Recommendation)
+	r.UpstreamCellSize, r.UpstreamPaddingOverhead = bestCellSize(upstream, cellOverhead)
+	if len(downstream) > 0 {
+		r.DownstreamCellSize, r.DownstreamPaddingOverhead = bestCellSize(downstream, cellOverhead)
+	} else {
+		r.DownstreamCellSize, r.DownstreamPaddingOverhead = r.UpstreamCellSize, r.UpstreamPaddingOverhead
+	}
+	r.WindowSize = windowSize(upstream, r.UpstreamCellSize)
+
+	return r, nil
+}
+
+// ToParameters packs the recommendation in a ALL_ALL_PARAMETERS message, which can be sent to the relay to apply it
+func (r *Recommendation) ToParameters() *net.ALL_ALL_PARAMETERS {
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("PayloadSize", r.UpstreamCellSize)
+	msg.Add("DownstreamCellSize", r.DownstreamCellSize)
+	msg.Add("WindowSize", r.WindowSize)
+	msg.ForceParams = true
+	return msg
+}
+
+// cost returns the total bytes sent, and the useful bytes, for this cell size
+func cost(samples []Sample, cellSize int, cellOverhead int) (int64, int64) {
+	total := int64(0)
+	useful := int64(0)
+	for _, s := range samples {
+		nCells := int64((s.Size + cellSize - 1) / cellSize)
+		if nCells == 0 {
+			nCells = 1
+		}
+		total += nCells * int64(cellSize+cellOverhead)
+		useful += int64(s.Size)
+	}
+	return total, useful
+}
+
+// the optimal cell size is one of the packet sizes (or a fraction of one), we try those and the powers of two
+func bestCellSize(samples []Sample, cellOverhead int) (int, float64) {
+	maxSize := MIN_CELL_SIZE
+	candidates := make(map[int]bool)
+	for _, s := range samples {
+		if s.Size > maxSize {
+			maxSize = s.Size
+		}
+		for k := 1; k <= 4; k++ {
+			if c := (s.Size + k - 1) / k; c >= MIN_CELL_SIZE {
+				candidates[c] = true
+			}
+		}
+	}
+	for c := MIN_CELL_SIZE; c < maxSize; c *= 2 {
+		candidates[c] = true
+	}
+	candidates[maxSize] = true
+
+	sorted := make([]int, 0, len(candidates))
+	for c := range candidates {
+		sorted = append(sorted, c)
+	}
+	sort.Ints(sorted)
+
+	best := -1
+	bestTotal := int64(math.MaxInt64)
+	bestUseful := int64(0)
+	for _, c := range sorted {
+		total, useful := cost(samples, c, cellOverhead)
+		if total <= bestTotal { // on ties, prefer larger cells (fewer rounds)
+			best, bestTotal, bestUseful = c, total, useful
+		}
+	}
+
+	overhead := 0.0
+	if bestTotal > 0 {
+		overhead = float64(bestTotal-bestUseful) / float64(bestTotal)
+	}
+	return best, overhead
+}
+
+// windowSize is the largest number of cells needed during any WINDOW_BURST_DURATION_MS period, so that a burst can
+// be sent without waiting for round-trips (capped to [1, MAX_WINDOW_SIZE])
+func windowSize(samples []Sample, cellSize int) int {
+	sorted := make([]Sample, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MsTimestamp < sorted[j].MsTimestamp })
+
+	maxCells := 0
+	start := 0
+	cells := 0
+	for end := range sorted {
+		cells += (sorted[end].Size + cellSize - 1) / cellSize
+		for sorted[end].MsTimestamp-sorted[start].MsTimestamp > WINDOW_BURST_DURATION_MS {
+			cells -= (sorted[start].Size + cellSize - 1) / cellSize
+			start++
+		}
+		if cells > maxCells {
+			maxCells = cells
+		}
+	}
+
+	if maxCells < 1 {
+		return 1
+	}
+	if maxCells > MAX_WINDOW_SIZE {
+		return MAX_WINDOW_SIZE
+	}
+	return maxCells
+}
@@ -0,0 +1,65 @@
+package cellsize
+
+import (
+	"testing"
+)
+
+func TestRecommend(t *testing.T) {
+
+	if _, err := Recommend(nil, nil, DEFAULT_CELL_OVERHEAD); err == nil {
+		t.Error("Should not recommend anything for an empty workload")
+	}
+
+	// all packets are 1000 bytes : one 1000-bytes cell per packet is optimal
+	upstream := make([]Sample, 0)
+	for i := 0; i < 20; i++ {
+		upstream = append(upstream, Sample{MsTimestamp: uint64(i * 1000), Size: 1000})
+	}
+	r, err := Recommend(upstream, nil, DEFAULT_CELL_OVERHEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.UpstreamCellSize != 1000 || r.DownstreamCellSize != 1000 {
+		t.Error("Expected cell size 1000, got", r.UpstreamCellSize, r.DownstreamCellSize)
+	}
+	if r.WindowSize != 1 {
+		t.Error("Packets are 1s apart, window should be 1, is", r.WindowSize)
+	}
+
+	// without overhead, the smallest cell dividing all packets wins
+	downstream := []Sample{{0, 100}, {0, 200}, {0, 300}}
+	r, _ = Recommend(upstream, downstream, 0)
+	if r.DownstreamCellSize != 100 || r.DownstreamPaddingOverhead != 0 {
+		t.Error("Expected downstream cell size 100 without padding, got", r.DownstreamCellSize, r.DownstreamPaddingOverhead)
+	}
+
+	// a burst of 5 packets within 100ms needs a window of 5
+	burst := make([]Sample, 0)
+	for i := 0; i < 5; i++ {
+		burst = append(burst, Sample{MsTimestamp: uint64(i * 10), Size: 500})
+	}
+	r, _ = Recommend(burst, nil, DEFAULT_CELL_OVERHEAD)
+	if r.WindowSize != 5 {
+		t.Error("Expected window size 5, got", r.WindowSize)
+	}
+
+	params := r.ToParameters()
+	if params.IntValueOrElse("PayloadSize", -1) != r.UpstreamCellSize || params.IntValueOrElse("WindowSize", -1) != 5 {
+		t.Error("Parameters do not match the recommendation")
+	}
+}
+
+func TestLoadWorkload(t *testing.T) {
+
+	if _, err := LoadWorkload("workload.txt"); err == nil {
+		t.Error("Should not accept unknown formats")
+	}
+
+	samples, err := LoadWorkload("../../pcap/test.pkts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[0].Size != 562 {
+		t.Error("Expected 2 packets of 562 bytes, got", samples)
+	}
+}
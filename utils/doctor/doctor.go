@@ -0,0 +1,264 @@
+// Package doctor audits the configuration of a PriFi node (its prifi.toml and
+// identity.toml) for settings which are fine for experiments but weaken a real
+// deployment: debug sleeps, payload logging, disabled disruption or
+// equivocation protection, plaintext transports and the sample keys shipped
+// with the repository.
+package doctor
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/prifi/prifi-lib/config"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+)
+
+// Severity tells how much a finding weakens the deployment
+type Severity int
+
+// The severities, from the least to the most severe
+const (
+	INFO Severity = iota
+	LOW
+	MEDIUM
+	HIGH
+	CRITICAL
+)
+
+func (s Severity) String() string {
+	switch s {
+	case INFO:
+		return "INFO"
+	case LOW:
+		return "LOW"
+	case MEDIUM:
+		return "MEDIUM"
+	case HIGH:
+		return "HIGH"
+	case CRITICAL:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// MarshalText encodes the severity by name, e.g. in JSON
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding is one insecure setting, and how to fix it
+type Finding struct {
+	Severity Severity
+	Setting  string
+	Problem  string
+	Fix      string
+}
+
+func (f Finding) String() string {
+	return "[" + f.Severity.String() + "] " + f.Setting + ": " + f.Problem + " Fix: " + f.Fix
+}
+
+// Identity is the part of a cothority identity.toml the audit looks at
+type Identity struct {
+	Public  string
+	Private string
+	Address string
+}
+
+// LoadIdentity reads an identity.toml
+func LoadIdentity(path string) (*Identity, error) {
+	identity := new(Identity)
+	if _, err := toml.DecodeFile(path, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// LoadDefaultKeys reads the private keys of the sample identities below dir (e.g. config/identities_default), and
+// maps them to the file they come from. A missing dir gives no keys.
+func LoadDefaultKeys(dir string) (map[string]string, error) {
+	keys := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != "identity.toml" {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		identity := new(Identity)
+		if _, err := toml.Decode(string(raw), identity); err == nil && identity.Private != "" {
+			keys[identity.Private] = path
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// listensOnAllInterfaces tells if addr (host:port, or a bare host) binds to every interface
+func listensOnAllInterfaces(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// Audit checks the configuration of a node. The identity and defaultKeys can be nil, the corresponding checks are then
+// skipped. The findings are sorted from the most to the least severe.
+func Audit(cfg *prifi_protocol.PrifiTomlConfig, identity *Identity, defaultKeys map[string]string) []Finding {
+	findings := make([]Finding, 0)
+	add := func(severity Severity, setting, problem, fix string) {
+		findings = append(findings, Finding{Severity: severity, Setting: setting, Problem: problem, Fix: fix})
+	}
+
+	// protections
+	featureFlags, err := config.ParseFeatureFlags(cfg.FeatureFlags)
+	if err != nil {
+		add(MEDIUM, "FeatureFlags", err.Error()+".", "Remove the malformed flags.")
+		featureFlags, _ = config.ParseFeatureFlags("")
+	}
+	if !featureFlags.ValueOrElse(config.FEATURE_DISRUPTION, cfg.DisruptionProtectionEnabled) {
+		add(HIGH, "DisruptionProtectionEnabled", "A malicious client can jam the DC-net without being identified.",
+			"Set DisruptionProtectionEnabled = true.")
+	}
+	if !featureFlags.ValueOrElse(config.FEATURE_EQUIVOCATION, cfg.EquivocationProtectionEnabled) {
+		add(HIGH, "EquivocationProtectionEnabled", "The relay can send different downstream data to different clients, and deanonymize them.",
+			"Set EquivocationProtectionEnabled = true.")
+	}
+	if cfg.CellsPerRound > 1 && (featureFlags.ValueOrElse(config.FEATURE_DISRUPTION, cfg.DisruptionProtectionEnabled) ||
+		featureFlags.ValueOrElse(config.FEATURE_EQUIVOCATION, cfg.EquivocationProtectionEnabled)) {
+		add(HIGH, "CellsPerRound", "The relay refuses super-rounds with the disruption or equivocation protection, and will not start.",
+			"Set CellsPerRound = 1.")
+	}
+	if cfg.ForceDisruptionSinceRound3 {
+		add(CRITICAL, "ForceDisruptionSinceRound3", "This node deliberately disrupts the DC-net (testing only).",
+			"Set ForceDisruptionSinceRound3 = false.")
+	}
+
+	// debug sleeps and slowdowns
+	if cfg.TrusteeSleepTimeBetweenMessages > 0 {
+		add(LOW, "TrusteeSleepTimeBetweenMessages", "Trustees sleep between ciphers, which slows the whole network down.",
+			"Set TrusteeSleepTimeBetweenMessages = 0.")
+	}
+	if cfg.TrusteeAlwaysSlowDown {
+		add(LOW, "TrusteeAlwaysSlowDown", "Trustees always slow down, whatever the relay's buffers.",
+			"Set TrusteeAlwaysSlowDown = false.")
+	}
+	if cfg.SimulDelayBetweenClients > 0 {
+		add(LOW, "SimulDelayBetweenClients", "Simulation delay between clients is set.",
+			"Set SimulDelayBetweenClients = 0.")
+	}
+
+	// payload logging
+	if cfg.VerboseIngressEgressServers {
+		add(HIGH, "VerboseIngressEgressServers", "The SOCKS servers log a hex dump of every payload, i.e. the users' traffic.",
+			"Set VerboseIngressEgressServers = false.")
+	}
+	if cfg.RelayFlowCaptureFile != "" {
+		add(HIGH, "RelayFlowCaptureFile", "The relay writes every decoded payload to "+cfg.RelayFlowCaptureFile+".",
+			"Set RelayFlowCaptureFile = \"\".")
+	}
+	if cfg.RelayMirrorSink != "" {
+		add(HIGH, "RelayMirrorSink", "The relay is configured to copy every decoded payload to "+cfg.RelayMirrorSink+".",
+			"Set RelayMirrorSink = \"\", and use a relay built without the \"mirror\" build tag.")
+	}
+	if cfg.ClientCellCaptureFile != "" {
+		add(MEDIUM, "ClientCellCaptureFile", "The client logs which rounds were in its slots, and when, to "+cfg.ClientCellCaptureFile+"; with the relay's logs, this file reveals which slot is this client's.",
+			"Set ClientCellCaptureFile = \"\" once the performance issue is diagnosed.")
+	}
+	if cfg.RelayAccessLog == "full" {
+		add(LOW, "RelayAccessLog", "The relay logs the destination and timing of every SOCKS stream to "+cfg.RelayAccessLogFile+"; with a network observer's logs, these lines help deanonymize the users.",
+			"Set RelayAccessLog = \"aggregate\", unless you need per-stream lines to answer abuse complaints, and keep few rotated files.")
+	}
+	if cfg.OverrideLogLevel >= 4 {
+		add(MEDIUM, "OverrideLogLevel", "At this log level, message contents and timings end up in the logs.",
+			"Set OverrideLogLevel to 3 or less.")
+	}
+	if levels, err := prifilog.ParseModuleLevels(cfg.LogLevels); err == nil {
+		for _, module := range prifilog.MODULES {
+			if levels[module] >= 4 {
+				add(MEDIUM, "LogLevels", "At level "+strconv.Itoa(levels[module])+", the "+module+" module writes message contents and timings to the logs.",
+					"Set the level of "+module+" to 3 or less in LogLevels.")
+			}
+		}
+	}
+	if cfg.DoLatencyTests && !cfg.EncryptLatencyTests {
+		add(LOW, "EncryptLatencyTests", "Latency probes are readable by the relay, which can special-case them.",
+			"Set EncryptLatencyTests = true.")
+	}
+
+	// transports
+	if identity != nil && strings.HasPrefix(identity.Address, "tcp://") {
+		add(MEDIUM, "identity.toml Address", "The cothority connections ("+identity.Address+") are not encrypted in transit.",
+			"Use a tls:// address.")
+	}
+	if cfg.UseUDP {
+		add(LOW, "UseUDP", "The downstream cells are broadcast in cleartext UDP; anyone on the network sees the downstream traffic pattern.",
+			"Set UseUDP = false, unless the broadcast is needed for scalability.")
+		if cfg.ClientUDPVerificationRate == 0 {
+			add(INFO, "ClientUDPVerificationRate", "Clients do not check that the relay broadcasts the same data to all of them.",
+				"Set ClientUDPVerificationRate = 5 on the clients.")
+		}
+	}
+	if cfg.UseUDPUplink {
+		add(LOW, "UseUDPUplink", "The upstream ciphers are sent in unauthenticated UDP datagrams.",
+			"Set UseUDPUplink = false.")
+	}
+	if listensOnAllInterfaces(cfg.ClientSocksListenAddress) && cfg.ClientSocksAuthToken == "" && cfg.SocksCredentials == "" {
+		add(HIGH, "ClientSocksListenAddress", "The client's SOCKS server accepts anyone on the network, who can send through this client.",
+			"Set ClientSocksListenAddress = \"127.0.0.1\", or set ClientSocksAuthToken or SocksCredentials.")
+	}
+	if cfg.RelayMetricsAddress != "" && listensOnAllInterfaces(cfg.RelayMetricsAddress) {
+		add(MEDIUM, "RelayMetricsAddress", "The relay's metrics and stalled-rounds diagnostics, which name slow clients, are public, and anyone can change its log levels.",
+			"Bind RelayMetricsAddress to 127.0.0.1, or firewall it.")
+	}
+	if cfg.RelayDemoAddress != "" && cfg.RelayDemoDelay < 10 {
+		add(LOW, "RelayDemoDelay", "The spectators of the demo mode see the rounds and the throughput almost live, and can match them with the activity of the people around them.",
+			"Set RelayDemoDelay = 30.")
+	}
+	if !cfg.EnforceSameVersionOnNodes {
+		add(INFO, "EnforceSameVersionOnNodes", "Nodes running different versions of PriFi can join.",
+			"Set EnforceSameVersionOnNodes = true.")
+	}
+
+	// keys
+	if identity != nil {
+		if path, ok := defaultKeys[identity.Private]; ok {
+			add(CRITICAL, "identity.toml Private", "This node uses the sample key of "+path+", which is public.",
+				"Generate a new identity with \"prifi gen-id\".")
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+	return findings
+}
+
+// WorstSeverity returns the highest severity among the findings, and false if there are none
+func WorstSeverity(findings []Finding) (Severity, bool) {
+	if len(findings) == 0 {
+		return INFO, false
+	}
+	worst := findings[0].Severity
+	for _, f := range findings {
+		if f.Severity > worst {
+			worst = f.Severity
+		}
+	}
+	return worst, true
+}
@@ -0,0 +1,101 @@
+package doctor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	prifi_protocol "github.com/dedis/prifi/sda/protocols"
+)
+
+func hasFinding(findings []Finding, setting string) bool {
+	for _, f := range findings {
+		if f.Setting == setting {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAudit(t *testing.T) {
+	secure := &prifi_protocol.PrifiTomlConfig{
+		DisruptionProtectionEnabled:   true,
+		EquivocationProtectionEnabled: true,
+		EnforceSameVersionOnNodes:     true,
+		ClientSocksListenAddress:      "127.0.0.1",
+		RelayMetricsAddress:           "127.0.0.1:9100",
+	}
+	if findings := Audit(secure, &Identity{Address: "tls://10.0.0.1:7000"}, nil); len(findings) != 0 {
+		t.Error("A secure configuration should have no findings", findings)
+	}
+
+	insecure := &prifi_protocol.PrifiTomlConfig{
+		FeatureFlags:                    "equivocation",
+		TrusteeSleepTimeBetweenMessages: 100,
+		VerboseIngressEgressServers:     true,
+		ForceDisruptionSinceRound3:      true,
+		RelayMetricsAddress:             ":9100",
+		DoLatencyTests:                  true,
+		RelayDemoAddress:                ":8081",
+		RelayDemoDelay:                  0,
+	}
+	findings := Audit(insecure, &Identity{Address: "tcp://10.0.0.1:7000"}, nil)
+	for _, setting := range []string{"DisruptionProtectionEnabled", "TrusteeSleepTimeBetweenMessages", "VerboseIngressEgressServers",
+		"ForceDisruptionSinceRound3", "RelayMetricsAddress", "EncryptLatencyTests", "ClientSocksListenAddress", "identity.toml Address",
+		"RelayDemoDelay"} {
+		if !hasFinding(findings, setting) {
+			t.Error("Missing finding for", setting)
+		}
+	}
+	// the feature flag enables equivocation protection
+	if hasFinding(findings, "EquivocationProtectionEnabled") {
+		t.Error("The feature flag should override EquivocationProtectionEnabled")
+	}
+	for i := 1; i < len(findings); i++ {
+		if findings[i].Severity > findings[i-1].Severity {
+			t.Error("The findings should be sorted by severity")
+		}
+	}
+	if worst, ok := WorstSeverity(findings); !ok || worst != CRITICAL {
+		t.Error("The worst finding should be critical, is", worst)
+	}
+
+	out, err := json.Marshal(findings[0])
+	if err != nil || !strings.Contains(string(out), "\"Severity\":\"CRITICAL\"") {
+		t.Error("Severities should be encoded by name", string(out), err)
+	}
+}
+
+func TestDefaultKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prifi-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "relay"), 0700)
+	identityFile := filepath.Join(dir, "relay", "identity.toml")
+	err = ioutil.WriteFile(identityFile, []byte("Public = \"aa\"\nPrivate = \"bb\"\nAddress = \"tcp://127.0.0.1:7000\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadDefaultKeys(dir)
+	if err != nil || keys["bb"] != identityFile {
+		t.Fatal("Could not load the default keys", keys, err)
+	}
+	identity, err := LoadIdentity(identityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFinding(Audit(&prifi_protocol.PrifiTomlConfig{}, identity, keys), "identity.toml Private") {
+		t.Error("The sample key should be found")
+	}
+
+	if keys, err := LoadDefaultKeys(filepath.Join(dir, "missing")); err != nil || len(keys) != 0 {
+		t.Error("A missing folder should give no keys", keys, err)
+	}
+}
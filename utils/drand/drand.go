@@ -0,0 +1,86 @@
+// Package drand fetches public randomness from a drand beacon (https://drand.love), over its HTTP API, so the relay
+// can fold it into the setup of an epoch.
+//
+// The beacon's BLS signature is not verified here (this would need the drand client library and the chain's public
+// key); we only check that the randomness is the hash of the signature, as drand defines it. The round is recorded in
+// the setup transcript, so an auditor can compare the value with any drand mirror.
+package drand
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+// LATEST_PATH is the path of the latest beacon, relative to the chain's URL
+const LATEST_PATH = "/public/latest"
+
+// FETCH_TIMEOUT is the maximum time we wait for the beacon server
+const FETCH_TIMEOUT = 5 * time.Second
+
+// MAX_RESPONSE_SIZE is the maximum size of a beacon we accept
+const MAX_RESPONSE_SIZE = 1 << 16
+
+// the JSON answer of the drand HTTP API
+type beaconResponse struct {
+	Round      uint64 `json:"round"`
+	Randomness string `json:"randomness"`
+	Signature  string `json:"signature"`
+}
+
+// FetchLatest downloads the latest beacon of the chain at chainURL (e.g., "https://api.drand.sh", or
+// "https://api.drand.sh/<chain-hash>")
+func FetchLatest(chainURL string) (*crypto.RandomBeacon, error) {
+	client := &http.Client{Timeout: FETCH_TIMEOUT}
+	resp, err := client.Get(strings.TrimSuffix(chainURL, "/") + LATEST_PATH)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Random beacon server answered " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	return parseBeacon(data)
+}
+
+// NewSource returns a function fetching the latest beacon of the chain at chainURL each time it is called
+func NewSource(chainURL string) func() (*crypto.RandomBeacon, error) {
+	return func() (*crypto.RandomBeacon, error) {
+		return FetchLatest(chainURL)
+	}
+}
+
+func parseBeacon(data []byte) (*crypto.RandomBeacon, error) {
+	r := new(beaconResponse)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+
+	randomness, err := hex.DecodeString(r.Randomness)
+	if err != nil || len(randomness) == 0 {
+		return nil, errors.New("Random beacon has no valid randomness")
+	}
+	signature, err := hex.DecodeString(r.Signature)
+	if err != nil || len(signature) == 0 {
+		return nil, errors.New("Random beacon has no valid signature")
+	}
+	h := sha256.Sum256(signature)
+	if hex.EncodeToString(h[:]) != strings.ToLower(r.Randomness) {
+		return nil, errors.New("Random beacon's randomness is not the hash of its signature")
+	}
+
+	return &crypto.RandomBeacon{Round: r.Round, Value: randomness}, nil
+}
@@ -0,0 +1,49 @@
+package drand
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchLatest(t *testing.T) {
+	signature := []byte("some BLS signature")
+	h := sha256.Sum256(signature)
+	body := `{"round":42,"randomness":"` + hex.EncodeToString(h[:]) + `","signature":"` + hex.EncodeToString(signature) + `"}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chain"+LATEST_PATH {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	beacon, err := FetchLatest(server.URL + "/chain/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beacon.Round != 42 || !bytes.Equal(beacon.Value, h[:]) {
+		t.Error("Wrong beacon", beacon.String())
+	}
+
+	if _, err := NewSource(server.URL + "/other")(); err == nil {
+		t.Error("Should fail when the server does not serve a beacon")
+	}
+}
+
+func TestParseBeacon(t *testing.T) {
+	if _, err := parseBeacon([]byte(`{"round":1,"randomness":"00","signature":"00"}`)); err == nil {
+		t.Error("Should refuse a randomness which is not the hash of the signature")
+	}
+	if _, err := parseBeacon([]byte(`{"round":1,"randomness":"","signature":"00"}`)); err == nil {
+		t.Error("Should refuse an empty randomness")
+	}
+	if _, err := parseBeacon([]byte(`not json`)); err == nil {
+		t.Error("Should refuse an invalid answer")
+	}
+}
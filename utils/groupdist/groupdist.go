@@ -0,0 +1,214 @@
+// Package groupdist distributes signed group descriptions (the group.toml, with
+// the relay's address and the trustees' keys, and the prifi.toml parameters).
+//
+// The relay operator signs a description with a monotonically increasing
+// version, and hosts it at WELL_KNOWN_PATH. Clients pin the signer's public
+// key, and refuse descriptions that are not signed by it, or whose version is
+// older than the last one they accepted (rollback protection).
+package groupdist
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// WELL_KNOWN_PATH is where the signed group description is served
+const WELL_KNOWN_PATH = "/.well-known/prifi-group.json"
+
+// FETCH_TIMEOUT is the maximum time we wait for the description server
+const FETCH_TIMEOUT = 10 * time.Second
+
+// MAX_DESCRIPTION_SIZE is the maximum size of a signed group description we accept
+const MAX_DESCRIPTION_SIZE = 1 << 20
+
+// SignedGroup is a group description, signed by the relay operator
+type SignedGroup struct {
+	Version   uint64
+	GroupToml string // the content of group.toml
+	PriFiToml string // the content of prifi.toml
+	Signer    string // hex-encoded public key
+	Signature string // hex-encoded schnorr signature on digest()
+}
+
+// Sign creates a SignedGroup with the given version
+func Sign(groupToml, prifiToml []byte, version uint64, private kyber.Scalar) (*SignedGroup, error) {
+	signer, err := encoding.PointToStringHex(config.CryptoSuite, config.CryptoSuite.Point().Mul(private, nil))
+	if err != nil {
+		return nil, err
+	}
+	sg := &SignedGroup{
+		Version:   version,
+		GroupToml: string(groupToml),
+		PriFiToml: string(prifiToml),
+		Signer:    signer,
+	}
+	sig, err := schnorr.Sign(config.CryptoSuite, private, sg.digest())
+	if err != nil {
+		return nil, err
+	}
+	sg.Signature = hex.EncodeToString(sig)
+	return sg, nil
+}
+
+// Verify checks that the description is signed by trustedSigner
+func (sg *SignedGroup) Verify(trustedSigner kyber.Point) error {
+	signer, err := encoding.StringHexToPoint(config.CryptoSuite, sg.Signer)
+	if err != nil {
+		return errors.New("Cannot decode the signer's key: " + err.Error())
+	}
+	if !signer.Equal(trustedSigner) {
+		return errors.New("Group description is signed by " + sg.Signer + ", which is not the trusted signer")
+	}
+	sig, err := hex.DecodeString(sg.Signature)
+	if err != nil {
+		return errors.New("Cannot decode the signature: " + err.Error())
+	}
+	return schnorr.Verify(config.CryptoSuite, trustedSigner, sg.digest(), sig)
+}
+
+// ToBytes encodes the description in JSON
+func (sg *SignedGroup) ToBytes() ([]byte, error) {
+	return json.Marshal(sg)
+}
+
+// SignedGroupFromBytes decodes a description encoded with ToBytes. It does not verify it.
+func SignedGroupFromBytes(data []byte) (*SignedGroup, error) {
+	sg := new(SignedGroup)
+	if err := json.Unmarshal(data, sg); err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
+
+// the signed message is version || len(group) || group || prifi
+func (sg *SignedGroup) digest() []byte {
+	buf := make([]byte, 16, 16+len(sg.GroupToml)+len(sg.PriFiToml))
+	binary.BigEndian.PutUint64(buf[0:8], sg.Version)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(len(sg.GroupToml)))
+	buf = append(buf, sg.GroupToml...)
+	buf = append(buf, sg.PriFiToml...)
+	return buf
+}
+
+// Server serves the latest signed group description at WELL_KNOWN_PATH
+type Server struct {
+	sync.Mutex
+	current *SignedGroup
+	encoded []byte
+}
+
+// NewServer creates a server for the given description
+func NewServer(sg *SignedGroup) (*Server, error) {
+	s := new(Server)
+	if err := s.Update(sg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update replaces the served description. Versions cannot go backwards.
+func (s *Server) Update(sg *SignedGroup) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.current != nil && sg.Version <= s.current.Version {
+		return errors.New("Version " + strconv.FormatUint(sg.Version, 10) + " is not newer than the served version " + strconv.FormatUint(s.current.Version, 10))
+	}
+	encoded, err := sg.ToBytes()
+	if err != nil {
+		return err
+	}
+	s.current = sg
+	s.encoded = encoded
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WELL_KNOWN_PATH {
+		http.NotFound(w, r)
+		return
+	}
+	s.Lock()
+	encoded := s.encoded
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
+
+// Fetch downloads the description from the server at baseURL, and verifies it against trustedSigner.
+// The last accepted version is stored in versionFile; older versions are refused, and the file is updated
+// when a newer one is accepted. If versionFile is empty, no rollback protection is done.
+func Fetch(baseURL string, trustedSigner kyber.Point, versionFile string) (*SignedGroup, error) {
+	client := &http.Client{Timeout: FETCH_TIMEOUT}
+	resp, err := client.Get(strings.TrimSuffix(baseURL, "/") + WELL_KNOWN_PATH)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Group description server answered " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_DESCRIPTION_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_DESCRIPTION_SIZE {
+		return nil, errors.New("Group description is larger than " + strconv.Itoa(MAX_DESCRIPTION_SIZE) + " bytes")
+	}
+	sg, err := SignedGroupFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := sg.Verify(trustedSigner); err != nil {
+		return nil, err
+	}
+
+	if versionFile == "" {
+		return sg, nil
+	}
+	lastVersion, err := readVersion(versionFile)
+	if err != nil {
+		return nil, err
+	}
+	if sg.Version < lastVersion {
+		e := "Refusing group description version " + strconv.FormatUint(sg.Version, 10) + ", we already accepted version " + strconv.FormatUint(lastVersion, 10)
+		log.Error(e)
+		return nil, errors.New(e)
+	}
+	if sg.Version > lastVersion {
+		if err := ioutil.WriteFile(versionFile, []byte(strconv.FormatUint(sg.Version, 10)), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return sg, nil
+}
+
+// readVersion returns the version stored in the file, or 0 if it does not exist
+func readVersion(versionFile string) (uint64, error) {
+	data, err := ioutil.ReadFile(versionFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
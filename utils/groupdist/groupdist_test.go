@@ -0,0 +1,100 @@
+package groupdist
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+func TestSignAndVerify(t *testing.T) {
+
+	pub, priv := crypto.NewKeyPair()
+	otherPub, _ := crypto.NewKeyPair()
+
+	sg, err := Sign([]byte("[[servers]]"), []byte("PayloadSize = 1000"), 3, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sg.Verify(pub); err != nil {
+		t.Error("Signature should verify:", err)
+	}
+	if sg.Verify(otherPub) == nil {
+		t.Error("Should not accept a description signed by another key")
+	}
+
+	data, err := sg.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sg2, err := SignedGroupFromBytes(data)
+	if err != nil || sg2.Verify(pub) != nil {
+		t.Error("Description should survive the encoding", err)
+	}
+
+	sg2.PriFiToml = "PayloadSize = 10"
+	if sg2.Verify(pub) == nil {
+		t.Error("Should not accept a tampered description")
+	}
+	sg2.PriFiToml = sg.PriFiToml
+	sg2.Version = 4
+	if sg2.Verify(pub) == nil {
+		t.Error("Should not accept a description with a tampered version")
+	}
+}
+
+func TestServeAndFetch(t *testing.T) {
+
+	pub, priv := crypto.NewKeyPair()
+	v2, _ := Sign([]byte("group"), []byte("params"), 2, priv)
+	v1, _ := Sign([]byte("old group"), []byte("old params"), 1, priv)
+
+	server, err := NewServer(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Update(v1) == nil {
+		t.Error("Server should not go back to an older version")
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "groupdist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	versionFile := filepath.Join(dir, "version")
+
+	sg, err := Fetch(ts.URL, pub, versionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sg.Version != 2 || sg.GroupToml != "group" {
+		t.Error("Fetched the wrong description", sg)
+	}
+	if v, _ := readVersion(versionFile); v != 2 {
+		t.Error("Accepted version should be stored, is", v)
+	}
+
+	// a (compromised) server rolling back to version 1 is detected
+	ts2 := httptest.NewServer(&Server{current: v1, encoded: mustEncode(t, v1)})
+	defer ts2.Close()
+	if _, err := Fetch(ts2.URL, pub, versionFile); err == nil {
+		t.Error("Should not accept a rollback")
+	}
+	if _, err := Fetch(ts2.URL, pub, ""); err != nil {
+		t.Error("Without version file, there is no rollback protection", err)
+	}
+}
+
+func mustEncode(t *testing.T, sg *SignedGroup) []byte {
+	data, err := sg.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -2,7 +2,9 @@
 // to measure execution times. It identifies measure
 // by names to be able to start and stop the measurements
 // from completely different parts of the code without
-// having to share a variable.
+// having to share a variable. When several measures with
+// the same name can run concurrently (e.g., one per round),
+// use a Timer instead.
 //
 // This package can be configured to use any
 // object that implements the Output interface
@@ -66,3 +68,88 @@ func StopMeasureAndLogWithInfo(name, info string) {
 	duration := StopMeasure(name)
 	log.Lvl1("[StopMeasureAndLog] measured time for", name, ":", duration.Nanoseconds(), "ns, info:", info)
 }
+
+// Timer is a scoped time measure. Contrarily to StartMeasure/StopMeasure, it is not identified by a global name, so
+// several timers with the same name (e.g., one per round, or one per entity) can run concurrently. Timers can be
+// nested with NewChild; the name of a child is prefixed by its parent's name.
+type Timer struct {
+	sync.Mutex
+	name     string
+	start    time.Time
+	stopped  bool
+	duration time.Duration
+	children []*Timer
+}
+
+// NewTimer creates and starts a timer
+func NewTimer(name string) *Timer {
+	return &Timer{
+		name:     name,
+		start:    time.Now(),
+		children: make([]*Timer, 0),
+	}
+}
+
+// NewChild creates and starts a timer nested in this one, named "parent/name"
+func (t *Timer) NewChild(name string) *Timer {
+	child := NewTimer(t.name + "/" + name)
+	t.Lock()
+	t.children = append(t.children, child)
+	t.Unlock()
+	return child
+}
+
+// Child returns the last child started with this name, or nil
+func (t *Timer) Child(name string) *Timer {
+	t.Lock()
+	defer t.Unlock()
+	for i := len(t.children) - 1; i >= 0; i-- {
+		if t.children[i].name == t.name+"/"+name {
+			return t.children[i]
+		}
+	}
+	return nil
+}
+
+// Children returns the timers nested in this one, in the order they were started
+func (t *Timer) Children() []*Timer {
+	t.Lock()
+	defer t.Unlock()
+	children := make([]*Timer, len(t.children))
+	copy(children, t.children)
+	return children
+}
+
+// Name returns the full name of the timer
+func (t *Timer) Name() string {
+	return t.name
+}
+
+// Stop stops the timer, and returns the measured time. Stopping a timer again does not change its measure.
+// Children which are still running are not stopped.
+func (t *Timer) Stop() time.Duration {
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	if !t.stopped {
+		t.stopped = true
+		t.duration = now.Sub(t.start)
+	}
+	return t.duration
+}
+
+// Elapsed returns the measured time if the timer is stopped, or the time since it started otherwise
+func (t *Timer) Elapsed() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	if t.stopped {
+		return t.duration
+	}
+	return time.Since(t.start)
+}
+
+// StopAndLog stops the timer and prints the value to Lvl1 (logs "info" too)
+func (t *Timer) StopAndLog(info string) {
+	duration := t.Stop()
+	log.Lvl1("[StopAndLog] measured time for", t.name, ":", duration.Nanoseconds(), "ns, info:", info)
+}
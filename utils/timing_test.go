@@ -42,3 +42,34 @@ func TestTiming(t *testing.T) {
 		t.Errorf("Invalid return value")
 	}
 }
+
+func TestTimer(t *testing.T) {
+
+	// two timers with the same name do not interfere
+	round1 := NewTimer("round")
+	round2 := NewTimer("round")
+	time.Sleep(2 * time.Millisecond)
+	d2 := round2.Stop()
+	time.Sleep(2 * time.Millisecond)
+
+	child := round1.NewChild("sending-data")
+	if child.Name() != "round/sending-data" || round1.Child("sending-data") != child {
+		t.Error("Wrong child", child.Name())
+	}
+	if round1.Child("waiting") != nil {
+		t.Error("There is no child named waiting")
+	}
+	time.Sleep(1 * time.Millisecond)
+	c := child.Stop()
+	d1 := round1.Stop()
+
+	if d2 < 2*time.Millisecond || d1 < 4*time.Millisecond || c < 1*time.Millisecond || c > d1 {
+		t.Error("Invalid time measurements", d1, d2, c)
+	}
+	if round2.Stop() != d2 || round2.Elapsed() != d2 {
+		t.Error("Stopping again should not change the measure")
+	}
+	if len(round1.Children()) != 1 || len(round2.Children()) != 0 {
+		t.Error("Wrong number of children")
+	}
+}